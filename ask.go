@@ -0,0 +1,58 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package nyquist
+
+import (
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+
+	"gitlab.com/yawning/nyquist.git/hash"
+)
+
+var askLabel = []byte("ask")
+
+func (ss *SymmetricState) askMaster() []byte {
+	askMaster := make([]byte, ss.hashLen)
+	ss.hkdfHash(askLabel, askMaster)
+	return askMaster
+}
+
+// DeriveASK derives an Additional Symmetric Key from the `ask_master` with
+// the provided label, and returns the HASHLEN sized key.  Distinct labels
+// will result in independent keys.
+//
+// Warning: This is a non-standard extension to the protocol.
+func DeriveASK(h hash.Hash, askMaster, label []byte) []byte {
+	ask := make([]byte, h.Size())
+	r := hkdf.New(h.New, label, askMaster, nil)
+	_, _ = io.ReadFull(r, ask)
+	return ask
+}
@@ -0,0 +1,261 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package attest implements a handshake payload extension that carries a
+// remote attestation quote (eg: a TPM2 quote, or a TEE report) bound to the
+// handshake, and verifies it against a policy, so that a peer can prove
+// that it is running approved firmware/software before the channel is used.
+//
+// The quote is generated over a binding derived from the handshake hash
+// immediately prior to the message carrying the payload.  As the binding
+// must include the peer's ephemeral key to be fresh, the payload can not
+// be sent in the first handshake message.  Generating and verifying the
+// platform specific quote is delegated to a Quoter and Verifier.
+package attest // import "gitlab.com/yawning/nyquist.git/attest"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/hash"
+)
+
+const (
+	// BindingSize is the size of the handshake binding in bytes.
+	BindingSize = 32
+
+	payloadVersion = 1
+	maxFormatSize  = 255
+)
+
+var (
+	// ErrMalformed is the error returned when an attestation payload is
+	// malformed.
+	ErrMalformed = errors.New("nyquist/attest: malformed payload")
+
+	// ErrNotFresh is the error returned when the handshake has not
+	// progressed far enough for the binding to be fresh.
+	ErrNotFresh = errors.New("nyquist/attest: binding would not be fresh")
+
+	// ErrPolicy is the error returned when the evidence is rejected by
+	// the policy.
+	ErrPolicy = errors.New("nyquist/attest: evidence rejected by policy")
+
+	errNoVerifier = errors.New("nyquist/attest: no verifier")
+
+	bindingLabel = []byte("nyquist/attest: handshake binding")
+)
+
+// Evidence is an attestation quote.
+type Evidence struct {
+	// Format is the quote format (eg: `tpm2-quote`, `sgx-dcap`).
+	Format string
+
+	// Quote is the platform specific quote, including any certificates
+	// required to verify it.
+	Quote []byte
+}
+
+// MarshalBinary encodes the evidence as an attestation payload.
+func (e *Evidence) MarshalBinary() ([]byte, error) {
+	if l := len(e.Format); l == 0 || l > maxFormatSize {
+		return nil, fmt.Errorf("%w: invalid format", ErrMalformed)
+	}
+
+	b := make([]byte, 0, 2+len(e.Format)+4+len(e.Quote))
+	b = append(b, payloadVersion, byte(len(e.Format)))
+	b = append(b, e.Format...)
+	b = append(b, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[len(b)-4:], uint32(len(e.Quote)))
+	b = append(b, e.Quote...)
+
+	return b, nil
+}
+
+// UnmarshalBinary decodes the evidence from an attestation payload.
+func (e *Evidence) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 || data[0] != payloadVersion {
+		return ErrMalformed
+	}
+	formatLen := int(data[1])
+	data = data[2:]
+	if formatLen == 0 || len(data) < formatLen+4 {
+		return ErrMalformed
+	}
+	format, data := data[:formatLen], data[formatLen:]
+	quoteLen, data := binary.BigEndian.Uint32(data), data[4:]
+	if uint64(len(data)) != uint64(quoteLen) {
+		return ErrMalformed
+	}
+
+	e.Format = string(format)
+	e.Quote = append([]byte{}, data...)
+
+	return nil
+}
+
+// Quoter generates attestation quotes.
+type Quoter interface {
+	// Quote returns evidence covering the binding (eg: as the TPM2
+	// qualifying data, or the TEE report data).
+	Quote(binding []byte) (*Evidence, error)
+}
+
+// Claims are the attested claims extracted from verified evidence.
+type Claims struct {
+	// Format is the evidence format.
+	Format string
+
+	// Measurements are the attested measurements, by name
+	// (eg: `PCR0`, `MRENCLAVE`).
+	Measurements map[string][]byte
+}
+
+// Verifier verifies attestation quotes.
+type Verifier interface {
+	// Verify verifies that the evidence is authentic, and covers the
+	// binding, and returns the attested claims.
+	Verify(evidence *Evidence, binding []byte) (*Claims, error)
+}
+
+// Policy is an attestation policy.
+type Policy struct {
+	// Verifier is the verifier used to authenticate the evidence.
+	Verifier Verifier
+
+	// Formats is the list of accepted evidence formats.  If empty, any
+	// format accepted by Verifier is allowed.
+	Formats []string
+
+	// Measurements is the set of accepted values for each measurement.
+	// Each listed measurement must be present in the claims, and match
+	// one of the accepted values.
+	Measurements map[string][][]byte
+
+	// Check is an optional additional check applied to the claims, after
+	// the rest of the policy is satisfied.
+	Check func(*Claims) error
+}
+
+// Verify decodes and verifies an attestation payload against the policy,
+// using the binding returned by ExpectedBinding, and returns the attested
+// claims.
+func (p *Policy) Verify(payload, binding []byte) (*Claims, error) {
+	if p.Verifier == nil {
+		return nil, errNoVerifier
+	}
+
+	var evidence Evidence
+	if err := evidence.UnmarshalBinary(payload); err != nil {
+		return nil, err
+	}
+	if !p.acceptsFormat(evidence.Format) {
+		return nil, fmt.Errorf("%w: format %s", ErrPolicy, evidence.Format)
+	}
+
+	claims, err := p.Verifier.Verify(&evidence, binding)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPolicy, err)
+	}
+	for name, accepted := range p.Measurements {
+		if !containsValue(accepted, claims.Measurements[name]) {
+			return nil, fmt.Errorf("%w: measurement %s", ErrPolicy, name)
+		}
+	}
+	if p.Check != nil {
+		if err = p.Check(claims); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrPolicy, err)
+		}
+	}
+
+	return claims, nil
+}
+
+func (p *Policy) acceptsFormat(format string) bool {
+	if len(p.Formats) == 0 {
+		return true
+	}
+	for _, v := range p.Formats {
+		if v == format {
+			return true
+		}
+	}
+	return false
+}
+
+func containsValue(accepted [][]byte, value []byte) bool {
+	if value == nil {
+		return false
+	}
+	for _, v := range accepted {
+		if bytes.Equal(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewPayload generates an attestation payload, to be sent as the payload of
+// the next message written with hs.
+func NewPayload(quoter Quoter, h hash.Hash, hs *nyquist.HandshakeState) ([]byte, error) {
+	status := hs.GetStatus()
+	if status.Err != nil || status.RemoteEphemeral == nil {
+		return nil, ErrNotFresh
+	}
+
+	evidence, err := quoter.Quote(binding(h, hs))
+	if err != nil {
+		return nil, err
+	}
+	return evidence.MarshalBinary()
+}
+
+// ExpectedBinding returns the binding that the attestation payload in the
+// next message read with hs must cover, and must be called prior to
+// reading the message.
+func ExpectedBinding(h hash.Hash, hs *nyquist.HandshakeState) ([]byte, error) {
+	status := hs.GetStatus()
+	if status.Err != nil || status.LocalEphemeral == nil {
+		return nil, ErrNotFresh
+	}
+	return binding(h, hs), nil
+}
+
+func binding(h hash.Hash, hs *nyquist.HandshakeState) []byte {
+	b := make([]byte, BindingSize)
+	r := hkdf.New(h.New, hs.SymmetricState().GetHandshakeHash(), nil, bindingLabel)
+	_, _ = io.ReadFull(r, b)
+	return b
+}
@@ -0,0 +1,209 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package attest
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git"
+)
+
+const testFormat = "test-hmac"
+
+var errBadQuote = errors.New("attest/test: bad quote")
+
+// testPlatform is a toy attestation scheme, where the "quote" is the
+// measurement and a MAC over the measurement and binding.
+type testPlatform struct {
+	key         []byte
+	measurement []byte
+}
+
+func (p *testPlatform) mac(binding []byte) []byte {
+	m := hmac.New(sha256.New, p.key)
+	_, _ = m.Write(p.measurement)
+	_, _ = m.Write(binding)
+	return m.Sum(nil)
+}
+
+func (p *testPlatform) Quote(binding []byte) (*Evidence, error) {
+	quote := append([]byte{}, p.measurement...)
+	return &Evidence{
+		Format: testFormat,
+		Quote:  append(quote, p.mac(binding)...),
+	}, nil
+}
+
+type testVerifier struct {
+	key []byte
+}
+
+func (v *testVerifier) Verify(evidence *Evidence, binding []byte) (*Claims, error) {
+	if len(evidence.Quote) < sha256.Size {
+		return nil, errBadQuote
+	}
+	split := len(evidence.Quote) - sha256.Size
+	p := &testPlatform{key: v.key, measurement: evidence.Quote[:split]}
+	if !hmac.Equal(p.mac(binding), evidence.Quote[split:]) {
+		return nil, errBadQuote
+	}
+	return &Claims{
+		Format: evidence.Format,
+		Measurements: map[string][]byte{
+			"PCR0": p.measurement,
+		},
+	}, nil
+}
+
+func newHandshakes(t *testing.T) (*nyquist.Protocol, *nyquist.HandshakeState, *nyquist.HandshakeState) {
+	require := require.New(t)
+
+	protocol, err := nyquist.NewProtocol("Noise_NN_25519_ChaChaPoly_BLAKE2s")
+	require.NoError(err, "NewProtocol")
+	alice, err := nyquist.NewHandshake(&nyquist.HandshakeConfig{
+		Protocol:    protocol,
+		IsInitiator: true,
+	})
+	require.NoError(err, "NewHandshake(alice)")
+	bob, err := nyquist.NewHandshake(&nyquist.HandshakeConfig{
+		Protocol: protocol,
+	})
+	require.NoError(err, "NewHandshake(bob)")
+
+	return protocol, alice, bob
+}
+
+func TestAttest(t *testing.T) {
+	platformKey := make([]byte, 32)
+	_, _ = rand.Read(platformKey)
+
+	goodMeasurement := []byte("approved firmware")
+	policy := &Policy{
+		Verifier: &testVerifier{key: platformKey},
+		Formats:  []string{testFormat},
+		Measurements: map[string][][]byte{
+			"PCR0": {[]byte("old firmware"), goodMeasurement},
+		},
+	}
+
+	// attestedHandshake has Bob attest in the second message, and returns
+	// the payload along with Alice's verification result.
+	attestedHandshake := func(t *testing.T, platform *testPlatform, tamper func([]byte) []byte) ([]byte, *Claims, error) {
+		require := require.New(t)
+
+		protocol, alice, bob := newHandshakes(t)
+		defer alice.Reset()
+		defer bob.Reset()
+
+		_, err := NewPayload(platform, protocol.Hash, alice)
+		require.Equal(ErrNotFresh, err, "NewPayload - first message")
+
+		msg, err := alice.WriteMessage(nil, nil)
+		require.NoError(err, "alice.WriteMessage")
+		_, err = bob.ReadMessage(nil, msg)
+		require.NoError(err, "bob.ReadMessage")
+
+		payload, err := NewPayload(platform, protocol.Hash, bob)
+		require.NoError(err, "NewPayload")
+		if tamper != nil {
+			payload = tamper(payload)
+		}
+		msg, err = bob.WriteMessage(nil, payload)
+		require.Equal(nyquist.ErrDone, err, "bob.WriteMessage")
+
+		binding, err := ExpectedBinding(protocol.Hash, alice)
+		require.NoError(err, "ExpectedBinding")
+		payload, err = alice.ReadMessage(nil, msg)
+		require.Equal(nyquist.ErrDone, err, "alice.ReadMessage")
+
+		claims, err := policy.Verify(payload, binding)
+		return payload, claims, err
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		require := require.New(t)
+
+		platform := &testPlatform{key: platformKey, measurement: goodMeasurement}
+		_, claims, err := attestedHandshake(t, platform, nil)
+		require.NoError(err, "Verify")
+		require.Equal(goodMeasurement, claims.Measurements["PCR0"], "Claims")
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		require := require.New(t)
+
+		platform := &testPlatform{key: platformKey, measurement: []byte("malware")}
+		_, _, err := attestedHandshake(t, platform, nil)
+		require.True(errors.Is(err, ErrPolicy), "Verify - bad measurement")
+
+		platform = &testPlatform{key: []byte("forged"), measurement: goodMeasurement}
+		_, _, err = attestedHandshake(t, platform, nil)
+		require.True(errors.Is(err, ErrPolicy), "Verify - bad quote")
+
+		platform = &testPlatform{key: platformKey, measurement: goodMeasurement}
+		_, _, err = attestedHandshake(t, platform, func(b []byte) []byte {
+			var evidence Evidence
+			require.NoError(evidence.UnmarshalBinary(b), "UnmarshalBinary")
+			evidence.Format = "sgx-dcap"
+			b, err = evidence.MarshalBinary()
+			require.NoError(err, "MarshalBinary")
+			return b
+		})
+		require.True(errors.Is(err, ErrPolicy), "Verify - bad format")
+
+		_, _, err = attestedHandshake(t, platform, func(b []byte) []byte {
+			return b[:len(b)-1]
+		})
+		require.Equal(ErrMalformed, err, "Verify - truncated")
+
+		_, err = (&Policy{}).Verify(nil, nil)
+		require.Equal(errNoVerifier, err, "Verify - no verifier")
+	})
+
+	t.Run("Replay", func(t *testing.T) {
+		require := require.New(t)
+
+		// A payload from a previous handshake is not accepted.
+		platform := &testPlatform{key: platformKey, measurement: goodMeasurement}
+		payload, _, err := attestedHandshake(t, platform, nil)
+		require.NoError(err, "Verify")
+
+		_, _, err = attestedHandshake(t, platform, func([]byte) []byte {
+			return payload
+		})
+		require.True(errors.Is(err, ErrPolicy), "Verify - replayed")
+	})
+}
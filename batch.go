@@ -0,0 +1,152 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package nyquist
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// BatchResponder processes initiators' first handshake messages in bulk,
+// for servers that terminate large numbers of handshakes.  The protocol
+// objects and the template configuration are shared across the batch,
+// the output payloads share a single backing buffer, and the messages are
+// optionally processed across multiple goroutines.
+type BatchResponder struct {
+	// Config is the template responder configuration, copied for each
+	// handshake in the batch.  LocalEphemeral and RemoteEphemeral must
+	// not be set.
+	Config *HandshakeConfig
+
+	// Parallelism is the maximum number of goroutines used to process a
+	// batch.  If the value is `0`, `runtime.GOMAXPROCS(0)` will be used.
+	Parallelism int
+}
+
+// BatchResult is the result of processing a single message in a batch.
+type BatchResult struct {
+	// HandshakeState is the responder handshake state, ready to write the
+	// next handshake message, or nil on failure.
+	HandshakeState *HandshakeState
+
+	// Payload is the first message's payload.
+	Payload []byte
+
+	// Err is the error, if any, encountered when processing the message.
+	Err error
+}
+
+// ReadMessages creates a new responder handshake for each message, and
+// processes the message with it.  The results are returned in the same
+// order as the messages.
+//
+// Note: For one-way patterns, the returned handshakes will be complete,
+// and `HandshakeState.GetStatus` can be used to obtain the CipherState.
+func (br *BatchResponder) ReadMessages(msgs [][]byte) ([]BatchResult, error) {
+	cfg := br.Config
+	if cfg == nil || cfg.IsInitiator || cfg.LocalEphemeral != nil || cfg.RemoteEphemeral != nil {
+		return nil, ErrInvalidConfig
+	}
+
+	// Allocate the per-handshake configurations and the payload backing
+	// store up front.  The payload is never larger than the message.
+	var payloadLen int
+	for _, msg := range msgs {
+		payloadLen += len(msg)
+	}
+	var (
+		results    = make([]BatchResult, len(msgs))
+		cfgs       = make([]HandshakeConfig, len(msgs))
+		payloadBuf = make([]byte, 0, payloadLen)
+		offsets    = make([]int, len(msgs))
+	)
+	for i := range msgs {
+		cfgs[i] = *cfg
+		if i > 0 {
+			offsets[i] = offsets[i-1] + len(msgs[i-1])
+		}
+	}
+
+	process := func(i int) {
+		res := &results[i]
+		hs, err := NewHandshake(&cfgs[i])
+		if err != nil {
+			res.Err = err
+			return
+		}
+
+		off := offsets[i]
+		dst := payloadBuf[off : off : off+len(msgs[i])]
+		res.Payload, err = hs.ReadMessage(dst, msgs[i])
+		switch err {
+		case nil, ErrDone:
+			res.HandshakeState = hs
+		default:
+			hs.Reset()
+			res.Payload, res.Err = nil, err
+		}
+	}
+
+	parallelism := br.Parallelism
+	if parallelism <= 0 {
+		parallelism = runtime.GOMAXPROCS(0)
+	}
+	if parallelism > len(msgs) {
+		parallelism = len(msgs)
+	}
+	if parallelism <= 1 {
+		for i := range msgs {
+			process(i)
+		}
+		return results, nil
+	}
+
+	var (
+		wg   sync.WaitGroup
+		next int64 = -1
+	)
+	wg.Add(parallelism)
+	for w := 0; w < parallelism; w++ {
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= len(msgs) {
+					return
+				}
+				process(i)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return results, nil
+}
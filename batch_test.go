@@ -0,0 +1,119 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package nyquist
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+func TestBatchResponder(t *testing.T) {
+	require := require.New(t)
+
+	protocol, err := NewProtocol("Noise_IK_25519_ChaChaPoly_BLAKE2s")
+	require.NoError(err, "NewProtocol")
+
+	bobStatic, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(err, "GenerateKeypair(bob)")
+
+	const numMsgs = 64
+	var (
+		initiators []*HandshakeState
+		msgs       [][]byte
+	)
+	for i := 0; i < numMsgs; i++ {
+		aliceStatic, kpErr := dh.X25519.GenerateKeypair(rand.Reader)
+		require.NoError(kpErr, "GenerateKeypair(alice)")
+		aliceHs, hsErr := NewHandshake(&HandshakeConfig{
+			Protocol:     protocol,
+			LocalStatic:  aliceStatic,
+			RemoteStatic: bobStatic.Public(),
+			IsInitiator:  true,
+		})
+		require.NoError(hsErr, "NewHandshake(alice)")
+		defer aliceHs.Reset()
+
+		msg, hsErr := aliceHs.WriteMessage(nil, []byte(fmt.Sprintf("payload %d", i)))
+		require.NoError(hsErr, "aliceHs.WriteMessage")
+		if i == 3 {
+			msg[len(msg)-1] ^= 0xa5
+		}
+		initiators = append(initiators, aliceHs)
+		msgs = append(msgs, msg)
+	}
+
+	br := &BatchResponder{
+		Config: &HandshakeConfig{
+			Protocol:    protocol,
+			LocalStatic: bobStatic,
+		},
+	}
+	_, err = (&BatchResponder{Config: &HandshakeConfig{Protocol: protocol, IsInitiator: true}}).ReadMessages(msgs)
+	require.Equal(ErrInvalidConfig, err, "ReadMessages - initiator config")
+
+	for _, parallelism := range []int{1, 0} {
+		br.Parallelism = parallelism
+		results, err := br.ReadMessages(msgs)
+		require.NoError(err, "ReadMessages(%d)", parallelism)
+		require.Len(results, numMsgs, "number of results")
+
+		for i, res := range results {
+			if i == 3 {
+				require.True(errors.Is(res.Err, ErrOpen), "tampered message")
+				require.Nil(res.HandshakeState, "tampered message")
+				continue
+			}
+			require.NoError(res.Err, "result %d", i)
+			require.Equal([]byte(fmt.Sprintf("payload %d", i)), res.Payload, "result %d payload", i)
+
+			// Only complete the handshake once.
+			if parallelism != 0 {
+				res.HandshakeState.Reset()
+				continue
+			}
+			msg, hsErr := res.HandshakeState.WriteMessage(nil, nil)
+			require.Equal(ErrDone, hsErr, "bobHs.WriteMessage")
+			_, hsErr = initiators[i].ReadMessage(nil, msg)
+			require.Equal(ErrDone, hsErr, "aliceHs.ReadMessage")
+			require.Equal(
+				initiators[i].GetStatus().HandshakeHash,
+				res.HandshakeState.GetStatus().HandshakeHash,
+				"handshake hash",
+			)
+			res.HandshakeState.Reset()
+		}
+	}
+}
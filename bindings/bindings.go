@@ -0,0 +1,308 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package bindings provides a flattened API suitable for use with gomobile.
+//
+// The gomobile type system is considerably more restrictive than Go's,
+// so this package exposes the handshake and transport functionality
+// exclusively in terms of concrete types, byte slices, strings and errors.
+// Protocols and primitives are specified by their Noise names.
+package bindings // import "gitlab.com/yawning/nyquist.git/bindings"
+
+import (
+	"crypto/rand"
+	"errors"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+var (
+	errUnsupportedDH    = errors.New("nyquist/bindings: unsupported DH function")
+	errNotDone          = errors.New("nyquist/bindings: handshake is not complete")
+	errSessionNoSend    = errors.New("nyquist/bindings: session can not send (one-way pattern)")
+	errSessionNoReceive = errors.New("nyquist/bindings: session can not receive (one-way pattern)")
+)
+
+// Keypair is a DH keypair.
+type Keypair struct {
+	kp dh.Keypair
+}
+
+// PublicKey returns the binary serialized public key.
+func (kp *Keypair) PublicKey() []byte {
+	return append([]byte{}, kp.kp.Public().Bytes()...)
+}
+
+// PrivateKey returns the binary serialized private key.
+func (kp *Keypair) PrivateKey() ([]byte, error) {
+	return kp.kp.MarshalBinary()
+}
+
+// GenerateKeypair generates a new keypair for the named DH function
+// (eg: "25519").
+func GenerateKeypair(dhName string) (*Keypair, error) {
+	dhImpl := dh.FromString(dhName)
+	if dhImpl == nil {
+		return nil, errUnsupportedDH
+	}
+
+	kp, err := dhImpl.GenerateKeypair(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Keypair{kp}, nil
+}
+
+// ParseKeypair parses a binary serialized private key for the named DH
+// function.
+func ParseKeypair(dhName string, privateKey []byte) (*Keypair, error) {
+	dhImpl := dh.FromString(dhName)
+	if dhImpl == nil {
+		return nil, errUnsupportedDH
+	}
+
+	kp, err := dhImpl.ParsePrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Keypair{kp}, nil
+}
+
+// Config is a handshake configuration.
+type Config struct {
+	protocolName string
+	isInitiator  bool
+
+	prologue       []byte
+	localStatic    *Keypair
+	remoteStatic   []byte
+	preSharedKeys  [][]byte
+	maxMessageSize int
+}
+
+// NewConfig creates a new handshake configuration for the protocol name
+// (eg: "Noise_XX_25519_ChaChaPoly_BLAKE2s"), and role.
+func NewConfig(protocolName string, isInitiator bool) *Config {
+	return &Config{
+		protocolName: protocolName,
+		isInitiator:  isInitiator,
+	}
+}
+
+// SetPrologue sets the optional prologue.
+func (cfg *Config) SetPrologue(prologue []byte) {
+	cfg.prologue = append([]byte{}, prologue...)
+}
+
+// SetLocalStatic sets the local static keypair.
+func (cfg *Config) SetLocalStatic(kp *Keypair) {
+	cfg.localStatic = kp
+}
+
+// SetRemoteStatic sets the binary serialized remote static public key.
+func (cfg *Config) SetRemoteStatic(publicKey []byte) {
+	cfg.remoteStatic = append([]byte{}, publicKey...)
+}
+
+// AddPreSharedKey appends a pre-shared key.  Keys must be added in the
+// order that they are used by the pattern's `psk` modifiers.
+func (cfg *Config) AddPreSharedKey(psk []byte) {
+	cfg.preSharedKeys = append(cfg.preSharedKeys, append([]byte{}, psk...))
+}
+
+// SetMaxMessageSize sets the maximum message size.  See
+// `nyquist.HandshakeConfig.MaxMessageSize` for details.
+func (cfg *Config) SetMaxMessageSize(maxMessageSize int) {
+	cfg.maxMessageSize = maxMessageSize
+}
+
+func (cfg *Config) toNyquist() (*nyquist.HandshakeConfig, error) {
+	protocol, err := nyquist.NewProtocol(cfg.protocolName)
+	if err != nil {
+		return nil, err
+	}
+
+	hsCfg := &nyquist.HandshakeConfig{
+		Protocol:       protocol,
+		Prologue:       cfg.prologue,
+		PreSharedKeys:  cfg.preSharedKeys,
+		MaxMessageSize: cfg.maxMessageSize,
+		IsInitiator:    cfg.isInitiator,
+	}
+	if cfg.localStatic != nil {
+		hsCfg.LocalStatic = cfg.localStatic.kp
+	}
+	if cfg.remoteStatic != nil {
+		if hsCfg.RemoteStatic, err = protocol.DH.ParsePublicKey(cfg.remoteStatic); err != nil {
+			return nil, err
+		}
+	}
+
+	return hsCfg, nil
+}
+
+// Handshake is an in-progress handshake.
+type Handshake struct {
+	hs          *nyquist.HandshakeState
+	isInitiator bool
+	isDone      bool
+}
+
+// NewHandshake creates a new handshake with the provided configuration.
+func NewHandshake(cfg *Config) (*Handshake, error) {
+	hsCfg, err := cfg.toNyquist()
+	if err != nil {
+		return nil, err
+	}
+
+	hs, err := nyquist.NewHandshake(hsCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Handshake{
+		hs:          hs,
+		isInitiator: cfg.isInitiator,
+	}, nil
+}
+
+// WriteMessage processes a write step of the handshake, and returns the
+// handshake message.  Check IsDone to see if the handshake is complete.
+func (h *Handshake) WriteMessage(payload []byte) ([]byte, error) {
+	return h.filterErr(h.hs.WriteMessage(nil, payload))
+}
+
+// ReadMessage processes a read step of the handshake, and returns the
+// message payload.  Check IsDone to see if the handshake is complete.
+func (h *Handshake) ReadMessage(message []byte) ([]byte, error) {
+	return h.filterErr(h.hs.ReadMessage(nil, message))
+}
+
+func (h *Handshake) filterErr(b []byte, err error) ([]byte, error) {
+	if err == nyquist.ErrDone {
+		h.isDone = true
+		err = nil
+	}
+	return b, err
+}
+
+// IsDone returns true iff the handshake is complete.
+func (h *Handshake) IsDone() bool {
+	return h.isDone
+}
+
+// Session returns the transport session for a completed handshake.
+func (h *Handshake) Session() (*Session, error) {
+	if !h.isDone {
+		return nil, errNotDone
+	}
+
+	status := h.hs.GetStatus()
+	s := &Session{
+		tx:            status.CipherStates[0],
+		rx:            status.CipherStates[1],
+		handshakeHash: append([]byte{}, status.HandshakeHash...),
+	}
+	if status.RemoteStatic != nil {
+		s.remoteStatic = append([]byte{}, status.RemoteStatic.Bytes()...)
+	}
+	if !h.isInitiator {
+		s.tx, s.rx = s.rx, s.tx
+	}
+
+	return s, nil
+}
+
+// Close clears the handshake state.
+func (h *Handshake) Close() {
+	h.hs.Reset()
+}
+
+// Session is a transport session.
+type Session struct {
+	tx, rx *nyquist.CipherState
+
+	handshakeHash []byte
+	remoteStatic  []byte
+}
+
+// Encrypt encrypts and authenticates a transport message.
+func (s *Session) Encrypt(plaintext []byte) ([]byte, error) {
+	if s.tx == nil {
+		return nil, errSessionNoSend
+	}
+	return s.tx.EncryptWithAd(nil, nil, plaintext)
+}
+
+// Decrypt authenticates and decrypts a transport message.
+func (s *Session) Decrypt(ciphertext []byte) ([]byte, error) {
+	if s.rx == nil {
+		return nil, errSessionNoReceive
+	}
+	return s.rx.DecryptWithAd(nil, nil, ciphertext)
+}
+
+// RekeySend rekeys the sending direction of the session.
+func (s *Session) RekeySend() error {
+	if s.tx == nil {
+		return errSessionNoSend
+	}
+	return s.tx.Rekey()
+}
+
+// RekeyReceive rekeys the receiving direction of the session.
+func (s *Session) RekeyReceive() error {
+	if s.rx == nil {
+		return errSessionNoReceive
+	}
+	return s.rx.Rekey()
+}
+
+// HandshakeHash returns the handshake hash.
+func (s *Session) HandshakeHash() []byte {
+	return s.handshakeHash
+}
+
+// RemoteStatic returns the remote static public key, or nil.
+func (s *Session) RemoteStatic() []byte {
+	return s.remoteStatic
+}
+
+// Close clears the session state.
+func (s *Session) Close() {
+	for _, cs := range []*nyquist.CipherState{s.tx, s.rx} {
+		if cs != nil {
+			cs.Reset()
+		}
+	}
+	s.tx, s.rx = nil, nil
+}
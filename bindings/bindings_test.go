@@ -0,0 +1,109 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package bindings
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBindings(t *testing.T) {
+	require := require.New(t)
+
+	const protocolName = "Noise_IK_25519_ChaChaPoly_BLAKE2s"
+
+	aliceStatic, err := GenerateKeypair("25519")
+	require.NoError(err, "GenerateKeypair(alice)")
+	bobStatic, err := GenerateKeypair("25519")
+	require.NoError(err, "GenerateKeypair(bob)")
+
+	bobPriv, err := bobStatic.PrivateKey()
+	require.NoError(err, "bobStatic.PrivateKey()")
+	bobStatic2, err := ParseKeypair("25519", bobPriv)
+	require.NoError(err, "ParseKeypair(bob)")
+	require.Equal(bobStatic.PublicKey(), bobStatic2.PublicKey(), "ParseKeypair round trips")
+
+	_, err = GenerateKeypair("invalid")
+	require.Equal(errUnsupportedDH, err, "GenerateKeypair(invalid)")
+
+	aliceCfg := NewConfig(protocolName, true)
+	aliceCfg.SetLocalStatic(aliceStatic)
+	aliceCfg.SetRemoteStatic(bobStatic.PublicKey())
+	aliceHs, err := NewHandshake(aliceCfg)
+	require.NoError(err, "NewHandshake(aliceCfg)")
+	defer aliceHs.Close()
+
+	bobCfg := NewConfig(protocolName, false)
+	bobCfg.SetLocalStatic(bobStatic2)
+	bobHs, err := NewHandshake(bobCfg)
+	require.NoError(err, "NewHandshake(bobCfg)")
+	defer bobHs.Close()
+
+	_, err = aliceHs.Session()
+	require.Equal(errNotDone, err, "aliceHs.Session() - in progress")
+
+	msg, err := aliceHs.WriteMessage([]byte("alice payload"))
+	require.NoError(err, "aliceHs.WriteMessage")
+	payload, err := bobHs.ReadMessage(msg)
+	require.NoError(err, "bobHs.ReadMessage")
+	require.Equal([]byte("alice payload"), payload)
+
+	msg, err = bobHs.WriteMessage(nil)
+	require.NoError(err, "bobHs.WriteMessage")
+	require.True(bobHs.IsDone(), "bobHs.IsDone()")
+	_, err = aliceHs.ReadMessage(msg)
+	require.NoError(err, "aliceHs.ReadMessage")
+	require.True(aliceHs.IsDone(), "aliceHs.IsDone()")
+
+	aliceSession, err := aliceHs.Session()
+	require.NoError(err, "aliceHs.Session()")
+	defer aliceSession.Close()
+	bobSession, err := bobHs.Session()
+	require.NoError(err, "bobHs.Session()")
+	defer bobSession.Close()
+
+	require.Equal(aliceSession.HandshakeHash(), bobSession.HandshakeHash(), "handshake hashes match")
+	require.Equal(aliceStatic.PublicKey(), bobSession.RemoteStatic(), "bob sees alice's static")
+
+	ciphertext, err := aliceSession.Encrypt([]byte("alice transport"))
+	require.NoError(err, "aliceSession.Encrypt")
+	plaintext, err := bobSession.Decrypt(ciphertext)
+	require.NoError(err, "bobSession.Decrypt")
+	require.Equal([]byte("alice transport"), plaintext)
+
+	require.NoError(bobSession.RekeySend(), "bobSession.RekeySend")
+	require.NoError(aliceSession.RekeyReceive(), "aliceSession.RekeyReceive")
+	ciphertext, err = bobSession.Encrypt([]byte("bob transport"))
+	require.NoError(err, "bobSession.Encrypt")
+	plaintext, err = aliceSession.Decrypt(ciphertext)
+	require.NoError(err, "aliceSession.Decrypt")
+	require.Equal([]byte("bob transport"), plaintext)
+}
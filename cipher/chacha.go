@@ -0,0 +1,270 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package cipher
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/poly1305"
+)
+
+const (
+	chachaBlockSize = 64
+	chachaNonceSize = chacha20poly1305.NonceSize
+	chachaTagSize   = poly1305.TagSize
+)
+
+var (
+	// ChaCha8Poly is the ChaChaPoly cipher functions, with ChaCha reduced
+	// to 8 rounds.
+	//
+	// Warning: This cipher is non-standard, and has a reduced security
+	// margin.  It is intended for CPU and power constrained devices.
+	ChaCha8Poly Cipher = &cipherChaChaReduced{name: "ChaCha8Poly", rounds: 8}
+
+	// ChaCha12Poly is the ChaChaPoly cipher functions, with ChaCha reduced
+	// to 12 rounds.
+	//
+	// Warning: This cipher is non-standard, and has a reduced security
+	// margin.  It is intended for CPU and power constrained devices.
+	ChaCha12Poly Cipher = &cipherChaChaReduced{name: "ChaCha12Poly", rounds: 12}
+
+	errChaChaInvalidKey = errors.New("nyquist/cipher/chacha: invalid key size")
+	errChaChaOpen       = errors.New("nyquist/cipher/chacha: message authentication failed")
+)
+
+type cipherChaChaReduced struct {
+	name   string
+	rounds int
+}
+
+func (ci *cipherChaChaReduced) String() string {
+	return ci.name
+}
+
+func (ci *cipherChaChaReduced) New(key []byte) (cipher.AEAD, error) {
+	if len(key) != chacha20poly1305.KeySize {
+		return nil, errChaChaInvalidKey
+	}
+
+	aead := &chachaPoly{
+		rounds: ci.rounds,
+	}
+	for i := range aead.key {
+		aead.key[i] = binary.LittleEndian.Uint32(key[i*4:])
+	}
+
+	return aead, nil
+}
+
+func (ci *cipherChaChaReduced) SetKey(aead cipher.AEAD, key []byte) error {
+	c, ok := aead.(*chachaPoly)
+	if !ok || c.rounds != ci.rounds {
+		return errMismatchedAEAD
+	}
+	if len(key) != chacha20poly1305.KeySize {
+		return errChaChaInvalidKey
+	}
+
+	for i := range c.key {
+		c.key[i] = binary.LittleEndian.Uint32(key[i*4:])
+	}
+
+	return nil
+}
+
+func (ci *cipherChaChaReduced) EncodeNonce(nonce uint64) []byte {
+	return ChaChaPoly.EncodeNonce(nonce)
+}
+
+func (ci *cipherChaChaReduced) Overhead() int {
+	return chachaTagSize
+}
+
+func (ci *cipherChaChaReduced) MaxPlaintextSize() int {
+	return MaxMessageSize - ci.Overhead()
+}
+
+// chachaPoly is the RFC 8439 ChaCha20-Poly1305 AEAD construction, with a
+// configurable number of ChaCha rounds.
+type chachaPoly struct {
+	key    [8]uint32
+	rounds int
+}
+
+func (c *chachaPoly) NonceSize() int {
+	return chachaNonceSize
+}
+
+func (c *chachaPoly) Overhead() int {
+	return chachaTagSize
+}
+
+func (c *chachaPoly) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != chachaNonceSize {
+		panic("nyquist/cipher/chacha: invalid nonce size")
+	}
+	if uint64(len(plaintext)) > (1<<38)-chachaBlockSize {
+		panic("nyquist/cipher/chacha: plaintext too large")
+	}
+
+	ret, out := sliceForAppend(dst, len(plaintext)+chachaTagSize)
+	ct, tag := out[:len(plaintext)], out[len(plaintext):]
+
+	var polyKey [32]byte
+	n := c.nonce(nonce)
+	c.xorKeyStream(polyKey[:], polyKey[:], &n, 0)
+	c.xorKeyStream(ct, plaintext, &n, 1)
+
+	mac := poly1305.New(&polyKey)
+	writeMACData(mac, additionalData, ct)
+	mac.Sum(tag[:0])
+
+	return ret
+}
+
+func (c *chachaPoly) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != chachaNonceSize {
+		panic("nyquist/cipher/chacha: invalid nonce size")
+	}
+	if len(ciphertext) < chachaTagSize {
+		return nil, errChaChaOpen
+	}
+	if uint64(len(ciphertext)) > (1<<38)-48 {
+		panic("nyquist/cipher/chacha: ciphertext too large")
+	}
+
+	ctLen := len(ciphertext) - chachaTagSize
+	ct, tag := ciphertext[:ctLen], ciphertext[ctLen:]
+
+	var polyKey [32]byte
+	n := c.nonce(nonce)
+	c.xorKeyStream(polyKey[:], polyKey[:], &n, 0)
+
+	mac := poly1305.New(&polyKey)
+	writeMACData(mac, additionalData, ct)
+	if !mac.Verify(tag) {
+		return nil, errChaChaOpen
+	}
+
+	ret, out := sliceForAppend(dst, ctLen)
+	c.xorKeyStream(out, ct, &n, 1)
+
+	return ret, nil
+}
+
+func (c *chachaPoly) nonce(nonce []byte) [3]uint32 {
+	return [3]uint32{
+		binary.LittleEndian.Uint32(nonce[0:4]),
+		binary.LittleEndian.Uint32(nonce[4:8]),
+		binary.LittleEndian.Uint32(nonce[8:12]),
+	}
+}
+
+func (c *chachaPoly) xorKeyStream(dst, src []byte, nonce *[3]uint32, counter uint32) {
+	var block [chachaBlockSize]byte
+	for len(src) > 0 {
+		c.block(&block, nonce, counter)
+		n := len(src)
+		if n > chachaBlockSize {
+			n = chachaBlockSize
+		}
+		for i := 0; i < n; i++ {
+			dst[i] = src[i] ^ block[i]
+		}
+		src, dst = src[n:], dst[n:]
+		counter++
+	}
+	for i := range block {
+		block[i] = 0
+	}
+}
+
+func (c *chachaPoly) block(out *[chachaBlockSize]byte, nonce *[3]uint32, counter uint32) {
+	var s, x [16]uint32
+	s[0], s[1], s[2], s[3] = 0x61707865, 0x3320646e, 0x79622d32, 0x6b206574
+	copy(s[4:12], c.key[:])
+	s[12] = counter
+	copy(s[13:], nonce[:])
+
+	x = s
+	for i := 0; i < c.rounds; i += 2 {
+		// Column round.
+		x[0], x[4], x[8], x[12] = quarterRound(x[0], x[4], x[8], x[12])
+		x[1], x[5], x[9], x[13] = quarterRound(x[1], x[5], x[9], x[13])
+		x[2], x[6], x[10], x[14] = quarterRound(x[2], x[6], x[10], x[14])
+		x[3], x[7], x[11], x[15] = quarterRound(x[3], x[7], x[11], x[15])
+
+		// Diagonal round.
+		x[0], x[5], x[10], x[15] = quarterRound(x[0], x[5], x[10], x[15])
+		x[1], x[6], x[11], x[12] = quarterRound(x[1], x[6], x[11], x[12])
+		x[2], x[7], x[8], x[13] = quarterRound(x[2], x[7], x[8], x[13])
+		x[3], x[4], x[9], x[14] = quarterRound(x[3], x[4], x[9], x[14])
+	}
+	for i := range x {
+		binary.LittleEndian.PutUint32(out[i*4:], x[i]+s[i])
+	}
+}
+
+func quarterRound(a, b, c, d uint32) (uint32, uint32, uint32, uint32) {
+	a += b
+	d = bits.RotateLeft32(d^a, 16)
+	c += d
+	b = bits.RotateLeft32(b^c, 12)
+	a += b
+	d = bits.RotateLeft32(d^a, 8)
+	c += d
+	b = bits.RotateLeft32(b^c, 7)
+	return a, b, c, d
+}
+
+func writeMACData(mac *poly1305.MAC, additionalData, ciphertext []byte) {
+	var pad [16]byte
+	_, _ = mac.Write(additionalData)
+	if r := len(additionalData) % 16; r != 0 {
+		_, _ = mac.Write(pad[:16-r])
+	}
+	_, _ = mac.Write(ciphertext)
+	if r := len(ciphertext) % 16; r != 0 {
+		_, _ = mac.Write(pad[:16-r])
+	}
+	binary.LittleEndian.PutUint64(pad[0:8], uint64(len(additionalData)))
+	binary.LittleEndian.PutUint64(pad[8:16], uint64(len(ciphertext)))
+	_, _ = mac.Write(pad[:])
+}
+
+func init() {
+	Register(ChaCha8Poly)
+	Register(ChaCha12Poly)
+}
@@ -0,0 +1,101 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package cipher
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func TestChaChaReduced(t *testing.T) {
+	t.Run("Keystream", testChaChaReducedKeystream)
+	t.Run("ChaCha20", testChaChaReducedChaCha20)
+}
+
+func testChaChaReducedKeystream(t *testing.T) {
+	require := require.New(t)
+
+	// Test vectors from draft-strombergson-chacha-test-vectors-01 (TC1:
+	// all zero key and IV).
+	for _, v := range []struct {
+		rounds    int
+		keystream string
+	}{
+		{8, "3e00ef2f895f40d67f5bb8e81f09a5a12c840ec3ce9a7f3b181be188ef711a1e984ce172b9216f419f445367456d5619314a42a3da86b001387bfdb80e0cfe42"},
+		{12, "9bf49a6a0755f953811fce125f2683d50429c3bb49e074147e0089a52eae155f0564f879d27ae3c02ce82834acfa8c793a629f2ca0de6919610be82f411326be"},
+		{20, "76b8e0ada0f13d90405d6ae55386bd28bdd219b8a08ded1aa836efcc8b770dc7da41597c5157488d7724e03fb8d84a376a43b8f41518a11cc387b669b2ee6586"},
+	} {
+		c := &chachaPoly{rounds: v.rounds}
+		var (
+			nonce [3]uint32
+			b     [chachaBlockSize]byte
+		)
+		c.xorKeyStream(b[:], b[:], &nonce, 0)
+		require.Equal(v.keystream, hex.EncodeToString(b[:]), "ChaCha%d keystream", v.rounds)
+	}
+}
+
+func testChaChaReducedChaCha20(t *testing.T) {
+	require := require.New(t)
+
+	// With 20 rounds, the construction must match ChaCha20-Poly1305.
+	var key [chacha20poly1305.KeySize]byte
+	_, err := rand.Read(key[:])
+	require.NoError(err, "rand.Read")
+
+	ci := &cipherChaChaReduced{name: "ChaCha20Poly", rounds: 20}
+	aead, err := ci.New(key[:])
+	require.NoError(err, "New")
+	expectedAead, err := chacha20poly1305.New(key[:])
+	require.NoError(err, "chacha20poly1305.New")
+
+	nonce := ci.EncodeNonce(0x0102030405060708)
+	ad := []byte("additional data")
+	for _, sz := range []int{0, 1, 15, 16, 63, 64, 65, 1024, 1025} {
+		pt := make([]byte, sz)
+		_, _ = rand.Read(pt)
+
+		ct := aead.Seal(nil, nonce, pt, ad)
+		require.Equal(expectedAead.Seal(nil, nonce, pt, ad), ct, "Seal(%d)", sz)
+
+		b, err := aead.Open(nil, nonce, ct, ad)
+		require.NoError(err, "Open(%d)", sz)
+		require.Equal(len(pt), len(b), "Open(%d)", sz)
+		require.Equal(hex.EncodeToString(pt), hex.EncodeToString(b), "Open(%d)", sz)
+
+		ct[0] ^= 0xa5
+		_, err = aead.Open(nil, nonce, ct, ad)
+		require.Error(err, "Open(%d) - tampered", sz)
+	}
+}
@@ -34,22 +34,30 @@ package cipher // import "gitlab.com/yawning/nyquist.git/cipher"
 import (
 	"crypto/cipher"
 	"encoding/binary"
-	"fmt"
+	"errors"
 
-	"github.com/oasislabs/deoxysii"
 	"gitlab.com/yawning/bsaes.git"
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
+const (
+	// MaxMessageSize is the maximum size of a Noise message in bytes.
+	MaxMessageSize = 65535
+
+	gcmTagSize = 16
+)
+
+var errMismatchedAEAD = errors.New("nyquist/cipher: mismatched AEAD instance")
+
 var supportedCiphers = map[string]Cipher{
 	"ChaChaPoly": ChaChaPoly,
 	"AESGCM":     AESGCM,
-	"DeoxysII":   DeoxysII,
 }
 
 // Cipher is an AEAD algorithm factory.
 type Cipher interface {
-	fmt.Stringer
+	// String returns the string representation of the cipher function name.
+	String() string
 
 	// New constructs a new keyed `cipher.AEAD` instance, with the provided
 	// key.
@@ -58,6 +66,14 @@ type Cipher interface {
 	// EncodeNonce encodes a Noise nonce to a nonce suitable for use with
 	// the `cipher.AEAD` instances created by `Cipher.New`.
 	EncodeNonce(nonce uint64) []byte
+
+	// Overhead returns the size of the authentication tag in bytes, which
+	// is the difference between the ciphertext and plaintext lengths.
+	Overhead() int
+
+	// MaxPlaintextSize returns the maximum size of a plaintext in bytes,
+	// such that the ciphertext fits in a single Noise message.
+	MaxPlaintextSize() int
 }
 
 // Rekeyable is the interface implemented by Cipher instances that have a
@@ -67,6 +83,19 @@ type Rekeyable interface {
 	Rekey(k []byte) []byte
 }
 
+// KeySetter is the interface implemented by Cipher instances whose AEAD
+// instances can be re-keyed in place, avoiding the allocation and key
+// schedule setup cost of `Cipher.New` on every key change.
+//
+// ChaCha8Poly, ChaCha12Poly, AESOCB and KuznyechikMGM implement this.
+// ChaChaPoly and AESGCM do not, as their underlying AEAD implementations
+// are opaque and can not be re-keyed.
+type KeySetter interface {
+	// SetKey re-keys an AEAD instance previously returned by `Cipher.New`
+	// with the provided key.
+	SetKey(aead cipher.AEAD, key []byte) error
+}
+
 // FromString returns a Cipher by algorithm name, or nil.
 func FromString(s string) Cipher {
 	return supportedCiphers[s]
@@ -91,6 +120,14 @@ func (ci *cipherChaChaPoly) EncodeNonce(nonce uint64) []byte {
 	return encodedNonce[:]
 }
 
+func (ci *cipherChaChaPoly) Overhead() int {
+	return chacha20poly1305.Overhead
+}
+
+func (ci *cipherChaChaPoly) MaxPlaintextSize() int {
+	return MaxMessageSize - ci.Overhead()
+}
+
 // AESGCM is the AESGCM cipher functions.
 //
 // Note: This Cipher implementation is always constant time, even on systems
@@ -118,27 +155,27 @@ func (ci *cipherAesGcm) EncodeNonce(nonce uint64) []byte {
 	return encodedNonce[:]
 }
 
-// DeoxysII is the DeoxysII cipher functions.
-//
-// Warning: This cipher is non-standard.
-var DeoxysII Cipher = &cipherDeoxysII{}
-
-type cipherDeoxysII struct{}
-
-func (ci *cipherDeoxysII) String() string {
-	return "DeoxysII"
+func (ci *cipherAesGcm) Overhead() int {
+	return gcmTagSize
 }
 
-func (ci *cipherDeoxysII) New(key []byte) (cipher.AEAD, error) {
-	return deoxysii.New(key)
+func (ci *cipherAesGcm) MaxPlaintextSize() int {
+	return MaxMessageSize - ci.Overhead()
 }
 
-func (ci *cipherDeoxysII) EncodeNonce(nonce uint64) []byte {
-	// Using the full nonce-space is fine, and big endian follows how
-	// Deoxys-II encodes things internally.
-	var encodedNonce [deoxysii.NonceSize]byte // 120 bits
-	binary.BigEndian.PutUint64(encodedNonce[7:], nonce)
-	return encodedNonce[:]
+// sliceForAppend takes a slice and a requested number of bytes. It returns a
+// slice with the contents of the given slice followed by that many bytes and a
+// second slice that aliases into it and contains only the extra bytes. If the
+// original slice has sufficient capacity then no allocation is performed.
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
 }
 
 // Register registers a new cipher for use with `FromString()`.
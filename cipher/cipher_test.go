@@ -0,0 +1,105 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package cipher
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverhead(t *testing.T) {
+	truncated, err := UnsafeTruncated(AESGCM, 12)
+	require.NoError(t, err, "UnsafeTruncated")
+
+	ciphers := []Cipher{truncated}
+	for _, ci := range supportedCiphers {
+		ciphers = append(ciphers, ci)
+	}
+	for _, ci := range ciphers {
+		t.Run(ci.String(), func(t *testing.T) {
+			require := require.New(t)
+
+			aead, err := ci.New(make([]byte, 32))
+			require.NoError(err, "New")
+			require.Equal(aead.Overhead(), ci.Overhead(), "Overhead")
+			require.Equal(MaxMessageSize-aead.Overhead(), ci.MaxPlaintextSize(), "MaxPlaintextSize")
+
+			ct := aead.Seal(nil, ci.EncodeNonce(0), make([]byte, ci.MaxPlaintextSize()), nil)
+			require.Len(ct, MaxMessageSize, "Seal - MaxPlaintextSize")
+		})
+	}
+}
+
+func TestKeySetter(t *testing.T) {
+	var numKeySetters int
+	for _, ci := range supportedCiphers {
+		ks, ok := ci.(KeySetter)
+		if !ok {
+			continue
+		}
+		numKeySetters++
+		t.Run(ci.String(), func(t *testing.T) {
+			require := require.New(t)
+
+			key1, key2 := make([]byte, 32), make([]byte, 32)
+			for i := range key2 {
+				key2[i] = byte(i)
+			}
+			nonce := ci.EncodeNonce(7)
+			msg := []byte("re-keyed in place")
+
+			ref, err := ci.New(key2)
+			require.NoError(err, "New(key2)")
+			expected := ref.Seal(nil, nonce, msg, nil)
+
+			aead, err := ci.New(key1)
+			require.NoError(err, "New(key1)")
+			require.NotEqual(expected, aead.Seal(nil, nonce, msg, nil), "Seal - key1")
+			require.NoError(ks.SetKey(aead, key2), "SetKey")
+			require.Equal(expected, aead.Seal(nil, nonce, msg, nil), "Seal - SetKey")
+
+			require.Error(ks.SetKey(aead, key2[1:]), "SetKey - truncated key")
+			other, err := AESGCM.New(key1)
+			require.NoError(err, "AESGCM.New")
+			require.Equal(errMismatchedAEAD, ks.SetKey(other, key2), "SetKey - mismatched AEAD")
+		})
+	}
+	require.NotZero(t, numKeySetters, "no KeySetter ciphers")
+}
+
+func mustUnhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
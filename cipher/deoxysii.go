@@ -0,0 +1,75 @@
+// Copyright (C) 2019, 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build !tinygo && !nyquist_omit_deoxysii
+// +build !tinygo,!nyquist_omit_deoxysii
+
+package cipher
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+
+	"github.com/oasislabs/deoxysii"
+)
+
+// DeoxysII is the DeoxysII cipher functions.
+//
+// Warning: This cipher is non-standard.
+var DeoxysII Cipher = &cipherDeoxysII{}
+
+type cipherDeoxysII struct{}
+
+func (ci *cipherDeoxysII) String() string {
+	return "DeoxysII"
+}
+
+func (ci *cipherDeoxysII) New(key []byte) (cipher.AEAD, error) {
+	return deoxysii.New(key)
+}
+
+func (ci *cipherDeoxysII) EncodeNonce(nonce uint64) []byte {
+	// Using the full nonce-space is fine, and big endian follows how
+	// Deoxys-II encodes things internally.
+	var encodedNonce [deoxysii.NonceSize]byte // 120 bits
+	binary.BigEndian.PutUint64(encodedNonce[7:], nonce)
+	return encodedNonce[:]
+}
+
+func (ci *cipherDeoxysII) Overhead() int {
+	return deoxysii.TagSize
+}
+
+func (ci *cipherDeoxysII) MaxPlaintextSize() int {
+	return MaxMessageSize - ci.Overhead()
+}
+
+func init() {
+	Register(DeoxysII)
+}
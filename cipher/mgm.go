@@ -0,0 +1,244 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build !nyquist_omit_gost
+// +build !nyquist_omit_gost
+
+package cipher
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+
+	"gitlab.com/yawning/nyquist.git/internal/gost"
+)
+
+const (
+	mgmBlockSize = gost.BlockSize
+	mgmNonceSize = gost.BlockSize
+	mgmTagSize   = gost.BlockSize
+)
+
+var errMGMOpen = errors.New("nyquist/cipher/mgm: message authentication failed")
+
+// KuznyechikMGM is the GOST R 34.12-2015 "Kuznyechik" block cipher in
+// Multilinear Galois Mode (RFC 9058), with a 128-bit tag, for deployments
+// subject to Russian regulatory requirements.
+//
+// Warning: This cipher is non-standard, and the Kuznyechik implementation
+// is not constant time.
+var KuznyechikMGM Cipher = &cipherKuznyechikMGM{}
+
+type cipherKuznyechikMGM struct{}
+
+func (ci *cipherKuznyechikMGM) String() string {
+	return "KuznyechikMGM"
+}
+
+func (ci *cipherKuznyechikMGM) New(key []byte) (cipher.AEAD, error) {
+	block, err := gost.NewKuznyechik(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mgm{block: block}, nil
+}
+
+func (ci *cipherKuznyechikMGM) SetKey(aead cipher.AEAD, key []byte) error {
+	m, ok := aead.(*mgm)
+	if !ok {
+		return errMismatchedAEAD
+	}
+
+	return m.block.SetKey(key)
+}
+
+func (ci *cipherKuznyechikMGM) EncodeNonce(nonce uint64) []byte {
+	// The most significant bit of the MGM nonce must be 0.
+	var encodedNonce [mgmNonceSize]byte
+	binary.BigEndian.PutUint64(encodedNonce[8:], nonce)
+	return encodedNonce[:]
+}
+
+func (ci *cipherKuznyechikMGM) Overhead() int {
+	return mgmTagSize
+}
+
+func (ci *cipherKuznyechikMGM) MaxPlaintextSize() int {
+	return MaxMessageSize - ci.Overhead()
+}
+
+type mgmBlock [mgmBlockSize]byte
+
+func (b *mgmBlock) xor(x *mgmBlock) {
+	for i := range b {
+		b[i] ^= x[i]
+	}
+}
+
+// mul sets b = b * x in GF(2^128), with the polynomial
+// x^128 + x^7 + x^2 + x + 1.
+func (b *mgmBlock) mul(x *mgmBlock) {
+	bHi, bLo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	xHi, xLo := binary.BigEndian.Uint64(x[:8]), binary.BigEndian.Uint64(x[8:])
+
+	var zHi, zLo uint64
+	for i := 127; i >= 0; i-- {
+		carry := zHi >> 63
+		zHi = zHi<<1 | zLo>>63
+		zLo = zLo<<1 ^ (0x87 & -carry)
+
+		var bit uint64
+		if i >= 64 {
+			bit = bHi >> (i - 64) & 1
+		} else {
+			bit = bLo >> i & 1
+		}
+		zHi ^= xHi & -bit
+		zLo ^= xLo & -bit
+	}
+
+	binary.BigEndian.PutUint64(b[:8], zHi)
+	binary.BigEndian.PutUint64(b[8:], zLo)
+}
+
+// incr increments the big-endian 64-bit half of the block.
+func (b *mgmBlock) incr(half int) {
+	v := b[half*8 : half*8+8]
+	binary.BigEndian.PutUint64(v, binary.BigEndian.Uint64(v)+1)
+}
+
+type mgm struct {
+	block *gost.Kuznyechik
+}
+
+func (m *mgm) NonceSize() int {
+	return mgmNonceSize
+}
+
+func (m *mgm) Overhead() int {
+	return mgmTagSize
+}
+
+func (m *mgm) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	m.checkNonce(nonce)
+
+	ret, out := sliceForAppend(dst, len(plaintext)+mgmTagSize)
+	m.ctr(out[:len(plaintext)], nonce, plaintext)
+	m.tag(out[len(plaintext):], nonce, out[:len(plaintext)], additionalData)
+
+	return ret
+}
+
+func (m *mgm) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	m.checkNonce(nonce)
+	if len(ciphertext) < mgmTagSize {
+		return nil, errMGMOpen
+	}
+
+	ctLen := len(ciphertext) - mgmTagSize
+	var tag [mgmTagSize]byte
+	m.tag(tag[:], nonce, ciphertext[:ctLen], additionalData)
+	if subtle.ConstantTimeCompare(tag[:], ciphertext[ctLen:]) != 1 {
+		return nil, errMGMOpen
+	}
+
+	ret, out := sliceForAppend(dst, ctLen)
+	m.ctr(out, nonce, ciphertext[:ctLen])
+
+	return ret, nil
+}
+
+func (m *mgm) checkNonce(nonce []byte) {
+	if len(nonce) != mgmNonceSize || nonce[0]&0x80 != 0 {
+		panic("nyquist/cipher/mgm: invalid nonce")
+	}
+}
+
+// ctr encrypts/decrypts src into dst, with the counter starting at
+// Y_1 = E_K(0 || ICN), and incrementing the right half.
+func (m *mgm) ctr(dst, nonce, src []byte) {
+	var y, ks mgmBlock
+	copy(y[:], nonce)
+	m.block.Encrypt(y[:], y[:])
+
+	for len(src) > 0 {
+		m.block.Encrypt(ks[:], y[:])
+		y.incr(1)
+
+		n := len(src)
+		if n > mgmBlockSize {
+			n = mgmBlockSize
+		}
+		for i := 0; i < n; i++ {
+			dst[i] = src[i] ^ ks[i]
+		}
+		src, dst = src[n:], dst[n:]
+	}
+}
+
+// tag computes the authentication tag over the additional data and
+// ciphertext, with the counter starting at Z_1 = E_K(1 || ICN), and
+// incrementing the left half.
+func (m *mgm) tag(dst, nonce, ciphertext, additionalData []byte) {
+	var z, h, sum mgmBlock
+	copy(z[:], nonce)
+	z[0] |= 0x80
+	m.block.Encrypt(z[:], z[:])
+
+	absorb := func(b *mgmBlock) {
+		m.block.Encrypt(h[:], z[:])
+		z.incr(0)
+		h.mul(b)
+		sum.xor(&h)
+	}
+	absorbPadded := func(data []byte) {
+		for len(data) > 0 {
+			var b mgmBlock
+			n := copy(b[:], data)
+			absorb(&b)
+			data = data[n:]
+		}
+	}
+	absorbPadded(additionalData)
+	absorbPadded(ciphertext)
+
+	var lengths mgmBlock
+	binary.BigEndian.PutUint64(lengths[:8], uint64(len(additionalData))*8)
+	binary.BigEndian.PutUint64(lengths[8:], uint64(len(ciphertext))*8)
+	absorb(&lengths)
+
+	m.block.Encrypt(dst, sum[:])
+}
+
+func init() {
+	Register(KuznyechikMGM)
+}
@@ -0,0 +1,80 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build !nyquist_omit_gost
+// +build !nyquist_omit_gost
+
+package cipher
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKuznyechikMGM(t *testing.T) {
+	t.Run("RFC9058", testMGMRFC9058)
+	t.Run("EncodeNonce", func(t *testing.T) {
+		aead, err := KuznyechikMGM.New(make([]byte, 32))
+		require.NoError(t, err, "New")
+		require.NotPanics(t, func() {
+			aead.Seal(nil, KuznyechikMGM.EncodeNonce(^uint64(0)), nil, nil)
+		}, "Seal - max Noise nonce")
+	})
+}
+
+func testMGMRFC9058(t *testing.T) {
+	require := require.New(t)
+
+	// RFC 9058 Appendix A (Kuznyechik).
+	key := mustUnhex("8899AABBCCDDEEFF0011223344556677FEDCBA98765432100123456789ABCDEF")
+	nonce := mustUnhex("1122334455667700FFEEDDCCBBAA9988")
+	ad := mustUnhex("0202020202020202010101010101010104040404040404040303030303030303EA0505050505050505")
+	pt := mustUnhex("1122334455667700FFEEDDCCBBAA998800112233445566778899AABBCCEEFF0A112233445566778899AABBCCEEFF0A002233445566778899AABBCCEEFF0A0011AABBCC")
+	ct := mustUnhex("A9757B8147956E9055B8A33DE89F42FC8075D2212BF9FD5BD3F7069AADC16B39497AB15915A6BA85936B5D0EA9F6851CC60C14D4D3F883D0AB94420695C76DEB2C7552")
+	tag := mustUnhex("CF5D656F40C34F5C46E8BB0E29FCDB4C")
+
+	aead, err := KuznyechikMGM.New(key)
+	require.NoError(err, "New")
+
+	sealed := aead.Seal(nil, nonce, pt, ad)
+	require.Equal(append(ct, tag...), sealed, "Seal")
+
+	opened, err := aead.Open(nil, nonce, sealed, ad)
+	require.NoError(err, "Open")
+	require.Equal(pt, opened, "Open")
+
+	sealed[0] ^= 1
+	_, err = aead.Open(nil, nonce, sealed, ad)
+	require.Equal(errMGMOpen, err, "Open - tampered")
+
+	require.Panics(func() {
+		aead.Seal(nil, mustUnhex("80000000000000000000000000000000"), pt, ad)
+	}, "Seal - nonce MSB set")
+}
@@ -0,0 +1,296 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build !nyquist_omit_aesocb
+// +build !nyquist_omit_aesocb
+
+package cipher
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+
+	"gitlab.com/yawning/bsaes.git"
+)
+
+const (
+	ocbBlockSize = bsaes.BlockSize
+	ocbNonceSize = 12
+	ocbTagSize   = 16
+)
+
+var errOCBOpen = errors.New("nyquist/cipher/ocb: message authentication failed")
+
+// AESOCB is the AES-256-OCB3 (RFC 7253) cipher functions, with a 128-bit
+// tag.  OCB3 only requires a single block cipher invocation per block of
+// input, making it considerably faster than AESGCM on systems without
+// hardware accelerated GHASH.
+//
+// Warning: This cipher is non-standard.
+var AESOCB Cipher = &cipherAesOcb{}
+
+type cipherAesOcb struct{}
+
+func (ci *cipherAesOcb) String() string {
+	return "AESOCB"
+}
+
+func (ci *cipherAesOcb) New(key []byte) (cipher.AEAD, error) {
+	block, err := bsaes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return newOCB(block), nil
+}
+
+func (ci *cipherAesOcb) SetKey(aead cipher.AEAD, key []byte) error {
+	o, ok := aead.(*ocb)
+	if !ok {
+		return errMismatchedAEAD
+	}
+	block, err := bsaes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	o.setBlock(block)
+
+	return nil
+}
+
+func (ci *cipherAesOcb) EncodeNonce(nonce uint64) []byte {
+	var encodedNonce [ocbNonceSize]byte // 96 bits
+	binary.BigEndian.PutUint64(encodedNonce[4:], nonce)
+	return encodedNonce[:]
+}
+
+func (ci *cipherAesOcb) Overhead() int {
+	return ocbTagSize
+}
+
+func (ci *cipherAesOcb) MaxPlaintextSize() int {
+	return MaxMessageSize - ci.Overhead()
+}
+
+type ocbBlock [ocbBlockSize]byte
+
+func (b *ocbBlock) xor(x *ocbBlock) {
+	for i := range b {
+		b[i] ^= x[i]
+	}
+}
+
+func (b *ocbBlock) double() ocbBlock {
+	var ret ocbBlock
+	carry := b[0] >> 7
+	for i := 0; i < ocbBlockSize-1; i++ {
+		ret[i] = b[i]<<1 | b[i+1]>>7
+	}
+	ret[ocbBlockSize-1] = b[ocbBlockSize-1]<<1 ^ (0x87 & -carry)
+	return ret
+}
+
+type ocb struct {
+	block cipher.Block
+
+	lStar   ocbBlock
+	lDollar ocbBlock
+	l       [64]ocbBlock
+}
+
+func (o *ocb) NonceSize() int {
+	return ocbNonceSize
+}
+
+func (o *ocb) Overhead() int {
+	return ocbTagSize
+}
+
+func (o *ocb) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != ocbNonceSize {
+		panic("nyquist/cipher/ocb: invalid nonce size")
+	}
+
+	ret, out := sliceForAppend(dst, len(plaintext)+ocbTagSize)
+	var tag ocbBlock
+	o.crypt(out[:len(plaintext)], nonce, plaintext, additionalData, true, &tag)
+	copy(out[len(plaintext):], tag[:])
+
+	return ret
+}
+
+func (o *ocb) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != ocbNonceSize {
+		panic("nyquist/cipher/ocb: invalid nonce size")
+	}
+	if len(ciphertext) < ocbTagSize {
+		return nil, errOCBOpen
+	}
+
+	ctLen := len(ciphertext) - ocbTagSize
+	expectedTag := ciphertext[ctLen:]
+	ret, out := sliceForAppend(dst, ctLen)
+	var tag ocbBlock
+	o.crypt(out, nonce, ciphertext[:ctLen], additionalData, false, &tag)
+	if subtle.ConstantTimeCompare(tag[:], expectedTag) != 1 {
+		for i := range out {
+			out[i] = 0
+		}
+		return nil, errOCBOpen
+	}
+
+	return ret, nil
+}
+
+func (o *ocb) crypt(dst, nonce, src, additionalData []byte, isEncrypt bool, tag *ocbBlock) {
+	// Nonce-dependent and per-encryption variables.
+	var nonceBlock, kTop ocbBlock
+	nonceBlock[ocbBlockSize-ocbNonceSize-1] = 1 // TAGLEN mod 128 = 0
+	copy(nonceBlock[ocbBlockSize-ocbNonceSize:], nonce)
+	bottom := uint(nonceBlock[ocbBlockSize-1] & 0x3f)
+	nonceBlock[ocbBlockSize-1] &= 0xc0
+	o.block.Encrypt(kTop[:], nonceBlock[:])
+
+	var stretch [ocbBlockSize + 8]byte
+	copy(stretch[:], kTop[:])
+	for i := 0; i < 8; i++ {
+		stretch[ocbBlockSize+i] = kTop[i] ^ kTop[i+1]
+	}
+	var offset ocbBlock
+	byteShift, bitShift := bottom/8, bottom%8
+	for i := range offset {
+		offset[i] = stretch[i+int(byteShift)] << bitShift
+		if bitShift != 0 {
+			offset[i] |= stretch[i+int(byteShift)+1] >> (8 - bitShift)
+		}
+	}
+
+	// Process any whole blocks.
+	var checksum, tmp ocbBlock
+	i := uint64(1)
+	for ; len(src) >= ocbBlockSize; i++ {
+		offset.xor(&o.l[bits.TrailingZeros64(i)])
+		copy(tmp[:], src[:ocbBlockSize])
+		if isEncrypt {
+			checksum.xor(&tmp)
+		}
+		tmp.xor(&offset)
+		if isEncrypt {
+			o.block.Encrypt(tmp[:], tmp[:])
+		} else {
+			o.block.Decrypt(tmp[:], tmp[:])
+		}
+		tmp.xor(&offset)
+		if !isEncrypt {
+			checksum.xor(&tmp)
+		}
+		copy(dst, tmp[:])
+
+		src, dst = src[ocbBlockSize:], dst[ocbBlockSize:]
+	}
+
+	// Process any final partial block and compute the raw tag.
+	if n := len(src); n > 0 {
+		offset.xor(&o.lStar)
+		var pad ocbBlock
+		o.block.Encrypt(pad[:], offset[:])
+		for j := 0; j < n; j++ {
+			dst[j] = src[j] ^ pad[j]
+		}
+
+		var p ocbBlock
+		if isEncrypt {
+			copy(p[:], src)
+		} else {
+			copy(p[:], dst[:n])
+		}
+		p[n] = 0x80
+		checksum.xor(&p)
+	}
+	checksum.xor(&offset)
+	checksum.xor(&o.lDollar)
+	o.block.Encrypt(tag[:], checksum[:])
+
+	o.hash(tag, additionalData)
+}
+
+func (o *ocb) hash(sum *ocbBlock, additionalData []byte) {
+	var offset, tmp ocbBlock
+
+	// Process any whole blocks.
+	i := uint64(1)
+	for ; len(additionalData) >= ocbBlockSize; i++ {
+		offset.xor(&o.l[bits.TrailingZeros64(i)])
+		copy(tmp[:], additionalData[:ocbBlockSize])
+		tmp.xor(&offset)
+		o.block.Encrypt(tmp[:], tmp[:])
+		sum.xor(&tmp)
+
+		additionalData = additionalData[ocbBlockSize:]
+	}
+
+	// Process any final partial block.
+	if n := len(additionalData); n > 0 {
+		offset.xor(&o.lStar)
+		tmp = ocbBlock{}
+		copy(tmp[:], additionalData)
+		tmp[n] = 0x80
+		tmp.xor(&offset)
+		o.block.Encrypt(tmp[:], tmp[:])
+		sum.xor(&tmp)
+	}
+}
+
+func newOCB(block cipher.Block) *ocb {
+	o := &ocb{}
+	o.setBlock(block)
+
+	return o
+}
+
+func (o *ocb) setBlock(block cipher.Block) {
+	o.block = block
+
+	// Key-dependent variables.
+	o.lStar = ocbBlock{}
+	o.block.Encrypt(o.lStar[:], o.lStar[:])
+	o.lDollar = o.lStar.double()
+	o.l[0] = o.lDollar.double()
+	for i := 1; i < len(o.l); i++ {
+		o.l[i] = o.l[i-1].double()
+	}
+}
+
+func init() {
+	Register(AESOCB)
+}
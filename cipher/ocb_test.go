@@ -0,0 +1,144 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build !nyquist_omit_aesocb
+// +build !nyquist_omit_aesocb
+
+package cipher
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/bsaes.git"
+)
+
+func TestOCB(t *testing.T) {
+	t.Run("RFC7253", testOCBRFC7253)
+	t.Run("Iterative", testOCBIterative)
+}
+
+func testOCBRFC7253(t *testing.T) {
+	require := require.New(t)
+
+	// RFC 7253 Appendix A (AES-128, 128-bit tag).
+	key := mustUnhex("000102030405060708090A0B0C0D0E0F")
+	block, err := bsaes.NewCipher(key)
+	require.NoError(err, "bsaes.NewCipher")
+	aead := newOCB(block)
+
+	for _, v := range []struct {
+		nonce, ad, pt, ct string
+	}{
+		{
+			nonce: "BBAA99887766554433221100",
+			ct:    "785407BFFFC8AD9EDCC5520AC9111EE6",
+		},
+		{
+			nonce: "BBAA99887766554433221101",
+			ad:    "0001020304050607",
+			pt:    "0001020304050607",
+			ct:    "6820B3657B6F615A5725BDA0D3B4EB3A257C9AF1F8F03009",
+		},
+		{
+			nonce: "BBAA99887766554433221102",
+			ad:    "0001020304050607",
+			ct:    "81017F8203F081277152FADE694A0A00",
+		},
+		{
+			nonce: "BBAA99887766554433221103",
+			pt:    "0001020304050607",
+			ct:    "45DD69F8F5AAE72414054CD1F35D82760B2CD00D2F99BFA9",
+		},
+		{
+			nonce: "BBAA99887766554433221104",
+			ad:    "000102030405060708090A0B0C0D0E0F",
+			pt:    "000102030405060708090A0B0C0D0E0F",
+			ct:    "571D535B60B277188BE5147170A9A22C3AD7A4FF3835B8C5701C1CCEC8FC3358",
+		},
+		{
+			nonce: "BBAA99887766554433221107",
+			ad:    "000102030405060708090A0B0C0D0E0F1011121314151617",
+			pt:    "000102030405060708090A0B0C0D0E0F1011121314151617",
+			ct:    "1CA2207308C87C010756104D8840CE1952F09673A448A122C92C62241051F57356D7F3C90BB0E07F",
+		},
+	} {
+		nonce, ad, pt, ct := mustUnhex(v.nonce), mustUnhex(v.ad), mustUnhex(v.pt), mustUnhex(v.ct)
+
+		b := aead.Seal(nil, nonce, pt, ad)
+		require.Equal(v.ct, strings.ToUpper(hex.EncodeToString(b)), "Seal(%s)", v.nonce)
+
+		b, err = aead.Open(nil, nonce, ct, ad)
+		require.NoError(err, "Open(%s)", v.nonce)
+		require.Equal(v.pt, strings.ToUpper(hex.EncodeToString(b)), "Open(%s)", v.nonce)
+
+		ct[0] ^= 0xa5
+		_, err = aead.Open(nil, nonce, ct, ad)
+		require.Error(err, "Open(%s) - tampered", v.nonce)
+	}
+}
+
+func testOCBIterative(t *testing.T) {
+	require := require.New(t)
+
+	// RFC 7253 Appendix A iterative test (128-bit tags).
+	for _, v := range []struct {
+		keyLen int
+		output string
+	}{
+		{16, "67E944D23256C5E0B6C61FA22FDF1EA2"},
+		{32, "D90EB8E9C977C88B79DD793D7FFA161C"},
+	} {
+		key := make([]byte, v.keyLen)
+		key[len(key)-1] = 128
+		block, err := bsaes.NewCipher(key)
+		require.NoError(err, "bsaes.NewCipher")
+		aead := newOCB(block)
+
+		nonce := func(n uint64) []byte {
+			var b [ocbNonceSize]byte
+			binary.BigEndian.PutUint64(b[4:], n)
+			return b[:]
+		}
+
+		var c []byte
+		for i := 0; i < 128; i++ {
+			s := make([]byte, i)
+			c = aead.Seal(c, nonce(uint64(3*i+1)), s, s)
+			c = aead.Seal(c, nonce(uint64(3*i+2)), s, nil)
+			c = aead.Seal(c, nonce(uint64(3*i+3)), nil, s)
+		}
+		b := aead.Seal(nil, nonce(385), nil, c)
+		require.Equal(mustUnhex(v.output), b, "Iterative(%d)", v.keyLen)
+	}
+}
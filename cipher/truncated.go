@@ -0,0 +1,164 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package cipher
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+	"strconv"
+)
+
+// MinTruncatedTagSize is the minimum tag size in bytes accepted by
+// UnsafeTruncated.
+const MinTruncatedTagSize = 4
+
+var (
+	errTruncatedTagSize     = errors.New("nyquist/cipher: invalid truncated tag size")
+	errTruncatedUnsupported = errors.New("nyquist/cipher: cipher does not support tag truncation")
+	errTruncatedOpen        = errors.New("nyquist/cipher/truncated: message authentication failed")
+
+	// truncatableCiphers are the ciphers where the ciphertext is the
+	// plaintext XORed with a keystream that only depends on the key and
+	// nonce, which is required to verify a truncated tag.
+	truncatableCiphers = map[string]bool{
+		"ChaChaPoly":   true,
+		"ChaCha8Poly":  true,
+		"ChaCha12Poly": true,
+		"AESGCM":       true,
+	}
+)
+
+// UnsafeTruncated returns a Cipher that truncates the tags of the provided
+// cipher to tagSize bytes.  The tag size is included in the cipher name
+// (eg: `ChaChaPoly-T64`, for a 64-bit tag), so both peers must opt in.
+// The returned Cipher is not registered for use with `FromString()`.
+//
+// Warning: This is non-standard, and trivially reduces the forgery
+// resistance of every message to `2^-(8*tagSize)`.  It is only intended
+// for severely bandwidth constrained links, where the lower layers
+// provide some other form of integrity protection.
+func UnsafeTruncated(ci Cipher, tagSize int) (Cipher, error) {
+	if !truncatableCiphers[ci.String()] {
+		return nil, errTruncatedUnsupported
+	}
+
+	if tagSize < MinTruncatedTagSize || tagSize >= ci.Overhead() {
+		return nil, errTruncatedTagSize
+	}
+
+	return &cipherTruncated{
+		inner:   ci,
+		name:    ci.String() + "-T" + strconv.Itoa(tagSize*8),
+		tagSize: tagSize,
+	}, nil
+}
+
+type cipherTruncated struct {
+	inner   Cipher
+	name    string
+	tagSize int
+}
+
+func (ci *cipherTruncated) String() string {
+	return ci.name
+}
+
+func (ci *cipherTruncated) New(key []byte) (cipher.AEAD, error) {
+	aead, err := ci.inner.New(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &truncatedAEAD{
+		aead:    aead,
+		tagSize: ci.tagSize,
+	}, nil
+}
+
+func (ci *cipherTruncated) EncodeNonce(nonce uint64) []byte {
+	return ci.inner.EncodeNonce(nonce)
+}
+
+func (ci *cipherTruncated) Overhead() int {
+	return ci.tagSize
+}
+
+func (ci *cipherTruncated) MaxPlaintextSize() int {
+	return MaxMessageSize - ci.Overhead()
+}
+
+type truncatedAEAD struct {
+	aead    cipher.AEAD
+	tagSize int
+}
+
+func (t *truncatedAEAD) NonceSize() int {
+	return t.aead.NonceSize()
+}
+
+func (t *truncatedAEAD) Overhead() int {
+	return t.tagSize
+}
+
+func (t *truncatedAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	ret := t.aead.Seal(dst, nonce, plaintext, additionalData)
+	return ret[:len(dst)+len(plaintext)+t.tagSize]
+}
+
+func (t *truncatedAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < t.tagSize {
+		return nil, errTruncatedOpen
+	}
+	ctLen := len(ciphertext) - t.tagSize
+	tag := ciphertext[ctLen:]
+
+	// Recover the plaintext with the keystream, and recompute the full tag
+	// over it, as a truncated tag can not be passed to the underlying
+	// AEAD's Open.
+	keyStream := t.aead.Seal(nil, nonce, make([]byte, ctLen), nil)
+	ret, out := sliceForAppend(dst, ctLen)
+	for i := range out {
+		out[i] = ciphertext[i] ^ keyStream[i]
+	}
+	expected := t.aead.Seal(keyStream[:0], nonce, out, additionalData)
+	ok := subtle.ConstantTimeCompare(expected[ctLen:ctLen+t.tagSize], tag) == 1
+	for i := range expected {
+		expected[i] = 0
+	}
+	if !ok {
+		for i := range out {
+			out[i] = 0
+		}
+		return nil, errTruncatedOpen
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,128 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package cipher
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnsafeTruncated(t *testing.T) {
+	t.Run("Constructor", testUnsafeTruncatedConstructor)
+	t.Run("AEAD", testUnsafeTruncatedAEAD)
+}
+
+func testUnsafeTruncatedConstructor(t *testing.T) {
+	require := require.New(t)
+
+	ci, err := UnsafeTruncated(ChaChaPoly, 8)
+	require.NoError(err, "UnsafeTruncated")
+	require.Equal("ChaChaPoly-T64", ci.String(), "String")
+	require.Nil(FromString(ci.String()), "FromString - not registered")
+
+	for _, sz := range []int{0, MinTruncatedTagSize - 1, 16, 17} {
+		_, err = UnsafeTruncated(AESGCM, sz)
+		require.Equal(errTruncatedTagSize, err, "UnsafeTruncated(%d)", sz)
+	}
+
+	_, err = UnsafeTruncated(&unsupportedCipher{}, 8)
+	require.Equal(errTruncatedUnsupported, err, "UnsafeTruncated - unsupported cipher")
+}
+
+func testUnsafeTruncatedAEAD(t *testing.T) {
+	var key [32]byte
+	_, err := rand.Read(key[:])
+	require.NoError(t, err, "rand.Read")
+
+	for _, inner := range []Cipher{ChaChaPoly, ChaCha8Poly, AESGCM} {
+		t.Run(inner.String(), func(t *testing.T) {
+			require := require.New(t)
+
+			ci, err := UnsafeTruncated(inner, 8)
+			require.NoError(err, "UnsafeTruncated")
+			aead, err := ci.New(key[:])
+			require.NoError(err, "New")
+			innerAead, err := inner.New(key[:])
+			require.NoError(err, "inner.New")
+			require.Equal(8, aead.Overhead(), "Overhead")
+
+			nonce := ci.EncodeNonce(0x0102030405060708)
+			ad := []byte("additional data")
+			for _, sz := range []int{0, 1, 15, 16, 63, 64, 65, 1024} {
+				pt := make([]byte, sz)
+				_, _ = rand.Read(pt)
+
+				ct := aead.Seal(nil, nonce, pt, ad)
+				require.Len(ct, sz+8, "Seal(%d)", sz)
+				require.Equal(innerAead.Seal(nil, nonce, pt, ad)[:sz+8], ct, "Seal(%d) - truncated", sz)
+
+				b, err := aead.Open(nil, nonce, ct, ad)
+				require.NoError(err, "Open(%d)", sz)
+				require.Equal(pt, append([]byte{}, b...), "Open(%d)", sz)
+
+				// In-place decryption.
+				inPlace := append([]byte{}, ct...)
+				b, err = aead.Open(inPlace[:0], nonce, inPlace, ad)
+				require.NoError(err, "Open(%d) - in-place", sz)
+				require.Equal(pt, append([]byte{}, b...), "Open(%d) - in-place", sz)
+
+				_, err = aead.Open(nil, nonce, ct, []byte("other additional data"))
+				require.Equal(errTruncatedOpen, err, "Open(%d) - bad AD", sz)
+
+				for _, idx := range []int{0, sz, sz + 7} {
+					if idx >= len(ct) {
+						continue
+					}
+					tampered := append([]byte{}, ct...)
+					tampered[idx] ^= 0xa5
+					dst := make([]byte, 0, len(tampered))
+					_, err = aead.Open(dst, nonce, tampered, ad)
+					require.Equal(errTruncatedOpen, err, "Open(%d) - tampered %d", sz, idx)
+					require.Equal(make([]byte, len(tampered)-8), dst[:len(tampered)-8], "Open(%d) - plaintext cleared", sz)
+				}
+			}
+
+			_, err = aead.Open(nil, nonce, make([]byte, 7), ad)
+			require.Equal(errTruncatedOpen, err, "Open - short")
+		})
+	}
+}
+
+// unsupportedCipher is a cipher that does not support truncation, which
+// AESOCB can be omitted from the build.
+type unsupportedCipher struct {
+	cipherAesGcm
+}
+
+func (ci *unsupportedCipher) String() string {
+	return "Unsupported"
+}
@@ -45,8 +45,9 @@ const (
 )
 
 var (
-	errInvalidKeySize = errors.New("nyquist/CipherState: invalid key size")
-	errNoExistingKey  = errors.New("nyquist/CipherState: failed to rekey, no existing key")
+	errInvalidKeySize  = errors.New("nyquist/CipherState: invalid key size")
+	errNoExistingKey   = errors.New("nyquist/CipherState: failed to rekey, no existing key")
+	errShortCiphertext = newMalformedError(errors.New("nyquist/CipherState: truncated ciphertext"))
 
 	zeroes [32]byte
 )
@@ -72,27 +73,46 @@ func (cs *CipherState) InitializeKey(key []byte) {
 }
 
 func (cs *CipherState) setKey(key []byte) error {
-	cs.Reset()
-
 	switch len(key) {
 	case 0:
+		cs.Reset()
 	case SymmetricKeySize:
-		var err error
-		if cs.aead, err = cs.cipher.New(key); err != nil {
+		if err := cs.newAEAD(key); err != nil {
+			cs.Reset()
 			return err
 		}
 
-		cs.aeadOverhead = cs.aead.Overhead()
-
-		cs.k = make([]byte, SymmetricKeySize)
+		// Reuse the existing key buffer if possible.
+		if cs.k == nil {
+			cs.k = make([]byte, SymmetricKeySize)
+		}
 		copy(cs.k, key)
 	default:
+		cs.Reset()
 		return errInvalidKeySize
 	}
 
 	return nil
 }
 
+func (cs *CipherState) newAEAD(key []byte) error {
+	if cs.aead != nil {
+		// Re-key the existing AEAD instance in place if supported.
+		if keySetter, ok := (cs.cipher).(cipher.KeySetter); ok {
+			return keySetter.SetKey(cs.aead, key)
+		}
+	}
+
+	aead, err := cs.cipher.New(key)
+	if err != nil {
+		return err
+	}
+	cs.aead = aead
+	cs.aeadOverhead = aead.Overhead()
+
+	return nil
+}
+
 // HasKey returns true iff the CipherState is keyed.
 func (cs *CipherState) HasKey() bool {
 	return cs.aead != nil
@@ -103,6 +123,12 @@ func (cs *CipherState) SetNonce(nonce uint64) {
 	cs.n = nonce
 }
 
+// Nonce returns the CipherState's nonce, the number of messages encrypted
+// or decrypted with the CipherState.
+func (cs *CipherState) Nonce() uint64 {
+	return cs.n
+}
+
 // EncryptWithAd encrypts and authenticates the additional data and plaintext
 // and increments the nonce iff the CipherState is keyed, and otherwise returns
 // the plaintext.
@@ -134,6 +160,10 @@ func (cs *CipherState) EncryptWithAd(dst, ad, plaintext []byte) ([]byte, error)
 // the plaintext.  If an authentication failure occurs, the nonce is not
 // incremented.
 //
+// Authentication failures return ErrOpen, ciphertexts that are too short
+// to be valid return an error matching ErrMalformed, and nonce exhaustion
+// returns ErrNonceExhausted.
+//
 // Note: The plaintext is appended to `dst`, and the new slice is returned.
 func (cs *CipherState) DecryptWithAd(dst, ad, ciphertext []byte) ([]byte, error) {
 	aead := cs.aead
@@ -148,6 +178,9 @@ func (cs *CipherState) DecryptWithAd(dst, ad, ciphertext []byte) ([]byte, error)
 	if cs.maxMessageSize > 0 && len(ciphertext) > cs.maxMessageSize {
 		return nil, ErrMessageSize
 	}
+	if len(ciphertext) < cs.aeadOverhead {
+		return nil, errShortCiphertext
+	}
 
 	nonce := cs.cipher.EncodeNonce(cs.n)
 	plaintext, err := aead.Open(dst, nonce, ciphertext, ad)
@@ -172,21 +205,41 @@ func (cs *CipherState) Rekey() error {
 	} else {
 		// The cipher function set has no `REKEY` function defined, use the
 		// default generic implementation.
+		var buf [SymmetricKeySize + 64]byte
 		nonce := cs.cipher.EncodeNonce(maxnonce)
-		newKey = cs.aead.Seal(nil, nonce, zeroes[:], nil)
+		newKey = cs.aead.Seal(buf[:0], nonce, zeroes[:], nil)
 
 		// "defaults to returning the first 32 bytes"
 		newKey = truncateTo32BytesMax(newKey)
 	}
 
 	err := cs.setKey(newKey)
+	zero(newKey)
 
 	return err
 }
 
-// Reset sets the CipherState to a un-keyed state.
+// Clone returns an independent copy of the CipherState, including the key
+// and nonce.
+func (cs *CipherState) Clone() *CipherState {
+	newCs := newCipherState(cs.cipher, cs.maxMessageSize)
+	if cs.HasKey() {
+		if err := newCs.setKey(cs.k); err != nil {
+			panic("nyquist/CipherState: failed to clone key: " + err.Error())
+		}
+	}
+	newCs.n = cs.n
+
+	return newCs
+}
+
+// Reset sets the CipherState to a un-keyed state, overwriting the key.
+//
+// Note: The expanded key schedule held by the AEAD instance can not be
+// sanitized, and is merely dropped.
 func (cs *CipherState) Reset() {
 	if cs.k != nil {
+		zero(cs.k)
 		cs.k = nil
 	}
 	if cs.aead != nil {
@@ -30,6 +30,8 @@
 package nyquist
 
 import (
+	goCipher "crypto/cipher"
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -47,7 +49,9 @@ func TestCipherState(t *testing.T) {
 		{"MaxMessageSize", testCipherStateMaxMessageSize},
 		{"Rekey", testCipherStateRekey},
 		{"Reset", testCipherStateReset},
+		{"Clone", testCipherStateClone},
 		{"Auth", testCipherStateAuth},
+		{"KeySetter", testCipherStateKeySetter},
 	} {
 		t.Run(v.n, v.fn)
 	}
@@ -79,6 +83,7 @@ func testCipherStateExhaustedNonce(t *testing.T) {
 	var testKey [32]byte
 	cs.InitializeKey(testKey[:])
 	cs.SetNonce(maxnonce)
+	require.Equal(uint64(maxnonce), cs.Nonce(), "cs.Nonce()")
 
 	ciphertext, err := cs.EncryptWithAd(nil, nil, []byte("exhausted nonce plaintext"))
 	require.Equal(ErrNonceExhausted, err, "cs.EncryptWithAd() - exhauted nonce")
@@ -91,7 +96,7 @@ func testCipherStateExhaustedNonce(t *testing.T) {
 
 func testCipherStateMaxMessageSize(t *testing.T) {
 	require := require.New(t)
-	cs := newCipherState(cipher.DeoxysII, DefaultMaxMessageSize)
+	cs := newCipherState(cipher.ChaChaPoly, DefaultMaxMessageSize)
 
 	var testKey [32]byte
 	cs.InitializeKey(testKey[:])
@@ -141,7 +146,7 @@ func testCipherStateRekey(t *testing.T) {
 
 func testCipherStateReset(t *testing.T) {
 	require := require.New(t)
-	cs := newCipherState(cipher.DeoxysII, DefaultMaxMessageSize)
+	cs := newCipherState(cipher.ChaChaPoly, DefaultMaxMessageSize)
 
 	var testKey [32]byte
 	cs.InitializeKey(testKey[:])
@@ -150,9 +155,39 @@ func testCipherStateReset(t *testing.T) {
 	require.Nil(cs.aead, "cs.Reset()")
 }
 
+func testCipherStateClone(t *testing.T) {
+	require := require.New(t)
+	cs := newCipherState(cipher.ChaChaPoly, DefaultMaxMessageSize)
+
+	testPlaintext := []byte("clone test plaintext")
+
+	var testKey [32]byte
+	cs.InitializeKey(testKey[:])
+	cs.SetNonce(42)
+
+	clone := cs.Clone()
+	require.Equal(cs.Nonce(), clone.Nonce(), "clone.Nonce()")
+	ciphertext, err := cs.EncryptWithAd(nil, nil, testPlaintext)
+	require.NoError(err, "cs.EncryptWithAd()")
+	plaintext, err := clone.DecryptWithAd(nil, nil, ciphertext)
+	require.NoError(err, "clone.DecryptWithAd()")
+	require.Equal(testPlaintext, plaintext, "clone.DecryptWithAd()")
+
+	// The clone must be independent of the original.
+	err = clone.Rekey()
+	require.NoError(err, "clone.Rekey()")
+	clone.Reset()
+	require.True(cs.HasKey(), "cs.HasKey() - after clone.Reset()")
+	ciphertext2, err := cs.EncryptWithAd(nil, nil, testPlaintext)
+	require.NoError(err, "cs.EncryptWithAd() - after clone.Rekey()")
+	require.NotEqual(ciphertext, ciphertext2, "nonce advanced")
+
+	require.False(newCipherState(cipher.ChaChaPoly, 0).Clone().HasKey(), "Clone() - no key")
+}
+
 func testCipherStateAuth(t *testing.T) {
 	require := require.New(t)
-	cs := newCipherState(cipher.DeoxysII, DefaultMaxMessageSize)
+	cs := newCipherState(cipher.ChaChaPoly, DefaultMaxMessageSize)
 
 	testPlaintext := []byte("auth test plaintext")
 
@@ -169,8 +204,94 @@ func testCipherStateAuth(t *testing.T) {
 	_, err = cs.DecryptWithAd(nil, nil, ciphertext)
 	require.Equal(ErrOpen, err, "cs.DecryptWithAd(tampered ciphertext)")
 
+	_, err = cs.DecryptWithAd(nil, nil, ciphertext[:cs.aeadOverhead-1])
+	require.True(errors.Is(err, ErrMalformed), "cs.DecryptWithAd(truncated ciphertext)")
+	require.False(errors.Is(err, ErrOpen), "cs.DecryptWithAd(truncated ciphertext)")
+
 	ciphertext[0] ^= 0xa5
 	plaintext, err := cs.DecryptWithAd(nil, nil, ciphertext)
 	require.NoError(err, "cs.DecryptWithAd()")
 	require.Equal(testPlaintext, plaintext, "cs.DecryptWithAd()")
 }
+
+type keySetterCipher struct {
+	cipher.Cipher
+
+	numNew, numSetKey int
+}
+
+type settableAEAD struct {
+	goCipher.AEAD
+}
+
+func (c *keySetterCipher) New(key []byte) (goCipher.AEAD, error) {
+	c.numNew++
+	aead, err := c.Cipher.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &settableAEAD{aead}, nil
+}
+
+func (c *keySetterCipher) SetKey(aead goCipher.AEAD, key []byte) error {
+	c.numSetKey++
+	inner, err := c.Cipher.New(key)
+	if err != nil {
+		return err
+	}
+	aead.(*settableAEAD).AEAD = inner
+	return nil
+}
+
+func testCipherStateKeySetter(t *testing.T) {
+	require := require.New(t)
+
+	ks := &keySetterCipher{Cipher: cipher.ChaChaPoly}
+	cs := newCipherState(ks, DefaultMaxMessageSize)
+	csRef := newCipherState(cipher.ChaChaPoly, DefaultMaxMessageSize)
+
+	var testKey [32]byte
+	for i := range testKey {
+		testKey[i] = byte(i)
+	}
+	cs.InitializeKey(testKey[:])
+	csRef.InitializeKey(testKey[:])
+
+	for i := 0; i < 3; i++ {
+		ct, err := cs.EncryptWithAd(nil, nil, []byte("plaintext"))
+		require.NoError(err, "EncryptWithAd")
+		ctRef, err := csRef.EncryptWithAd(nil, nil, []byte("plaintext"))
+		require.NoError(err, "EncryptWithAd - reference")
+		require.Equal(ctRef, ct, "ciphertext matches reference")
+
+		require.NoError(cs.Rekey(), "Rekey")
+		require.NoError(csRef.Rekey(), "Rekey - reference")
+	}
+
+	require.Equal(1, ks.numNew, "New called once")
+	require.Equal(3, ks.numSetKey, "SetKey used for rekeying")
+}
+
+func BenchmarkCipherStateRekey(b *testing.B) {
+	for _, v := range []struct {
+		n  string
+		ci cipher.Cipher
+	}{
+		{"SetKey", cipher.ChaCha8Poly},
+		// Hide the KeySetter implementation to force `Cipher.New`.
+		{"New", struct{ cipher.Cipher }{cipher.ChaCha8Poly}},
+	} {
+		b.Run(v.n, func(b *testing.B) {
+			cs := newCipherState(v.ci, DefaultMaxMessageSize)
+			cs.InitializeKey(make([]byte, SymmetricKeySize))
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := cs.Rekey(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package clock provides an injectable clock for time-based policies (eg:
+// key lifetimes, idle timeouts, ticket expiry), so that they may be tested
+// deterministically or driven by a simulation.
+package clock // import "gitlab.com/yawning/nyquist.git/clock"
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a source of time, and of timers.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// AfterFunc waits for the duration to elapse and then calls f.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer created by Clock.AfterFunc.
+type Timer interface {
+	// Stop prevents the timer from firing.  It returns true if the call
+	// stops the timer, false if the timer has already expired or been
+	// stopped.
+	Stop() bool
+
+	// Reset changes the timer to expire after duration d.  It returns
+	// true if the timer had been active, false if the timer had expired
+	// or been stopped.
+	Reset(d time.Duration) bool
+}
+
+// System is the Clock backed by the system clock, via the `time` package.
+var System Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// Get returns clk, or System if clk is nil.
+func Get(clk Clock) Clock {
+	if clk == nil {
+		return System
+	}
+	return clk
+}
+
+// Fake is a Clock that only advances when instructed to, for testing.
+type Fake struct {
+	mu sync.Mutex
+
+	now    time.Time
+	timers map[*fakeTimer]bool
+}
+
+// Now returns the fake clock's current time.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.now
+}
+
+// AfterFunc calls f, once the fake clock has been advanced past d.
+func (f *Fake) AfterFunc(d time.Duration, fn func()) Timer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t := &fakeTimer{
+		clk:  f,
+		when: f.now.Add(d),
+		fn:   fn,
+	}
+	f.timers[t] = true
+
+	return t
+}
+
+// Advance advances the fake clock by d, and synchronously calls the
+// functions of the timers that expire, in order of expiry.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	target := f.now.Add(d)
+	for {
+		var next *fakeTimer
+		for t := range f.timers {
+			if t.when.After(target) {
+				continue
+			}
+			if next == nil || t.when.Before(next.when) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+
+		delete(f.timers, next)
+		if next.when.After(f.now) {
+			f.now = next.when
+		}
+
+		// Timer functions may use the clock.
+		f.mu.Unlock()
+		next.fn()
+		f.mu.Lock()
+	}
+	f.now = target
+	f.mu.Unlock()
+}
+
+// NewFake creates a new fake clock, set to now.
+func NewFake(now time.Time) *Fake {
+	return &Fake{
+		now:    now,
+		timers: make(map[*fakeTimer]bool),
+	}
+}
+
+type fakeTimer struct {
+	clk  *Fake
+	when time.Time
+	fn   func()
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clk.mu.Lock()
+	defer t.clk.mu.Unlock()
+
+	wasActive := t.clk.timers[t]
+	delete(t.clk.timers, t)
+
+	return wasActive
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clk.mu.Lock()
+	defer t.clk.mu.Unlock()
+
+	wasActive := t.clk.timers[t]
+	t.when = t.clk.now.Add(d)
+	t.clk.timers[t] = true
+
+	return wasActive
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFake(t *testing.T) {
+	require := require.New(t)
+
+	epoch := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := NewFake(epoch)
+	require.Equal(epoch, clk.Now(), "Now - initial")
+
+	var fired []string
+	record := func(name string) func() {
+		return func() {
+			fired = append(fired, name+"@"+clk.Now().Sub(epoch).String())
+		}
+	}
+
+	clk.AfterFunc(3*time.Second, record("a"))
+	clk.AfterFunc(1*time.Second, record("b"))
+	stopped := clk.AfterFunc(2*time.Second, record("c"))
+	require.True(stopped.Stop(), "Stop - active")
+	require.False(stopped.Stop(), "Stop - stopped")
+
+	// Timers that re-arm themselves fire again within the same Advance.
+	var rearm Timer
+	rearm = clk.AfterFunc(2*time.Second, func() {
+		record("d")()
+		if len(fired) < 4 {
+			rearm.Reset(2 * time.Second)
+		}
+	})
+
+	clk.Advance(5 * time.Second)
+	require.Equal([]string{"b@1s", "d@2s", "a@3s", "d@4s"}, fired, "Advance - fired")
+	require.Equal(epoch.Add(5*time.Second), clk.Now(), "Now - advanced")
+
+	require.False(rearm.Reset(time.Second), "Reset - expired")
+	clk.Advance(time.Second)
+	require.Len(fired, 5, "Advance - reset timer fired")
+}
+
+func TestGet(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal(System, Get(nil), "Get(nil)")
+	clk := NewFake(time.Time{})
+	require.Equal(clk, Get(clk), "Get(clk)")
+}
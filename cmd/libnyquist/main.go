@@ -0,0 +1,456 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Command libnyquist is a C shared library wrapper around the bindings
+// package, exposing the handshake and transport operations behind a
+// stable C ABI.
+//
+// Build with:
+//
+//	go build -buildmode=c-shared -o libnyquist.so ./cmd/libnyquist
+//
+// All functions return one of the `NYQUIST_*` status codes, with output
+// written to caller provided buffers.  Handshake messages are at most
+// 65535 bytes unless a different maximum message size is configured.
+// Transport ciphertexts are the plaintext length plus the AEAD tag
+// (16 bytes for all standard ciphers).  Objects are referred to by opaque
+// handles, that must be released with the appropriate `_free` call.
+//
+// Input buffers larger than 1 GiB are rejected with NYQUIST_ERR_INVALID.
+// An output buffer that is too small for a handshake message or payload,
+// or for a transport ciphertext, returns NYQUIST_ERR_BUFFER after the
+// handshake or session state has already advanced, so the handle is
+// invalidated, and all further operations on it fail with
+// NYQUIST_ERR_HANDLE, though it must still be released.  Transport
+// plaintexts are decrypted only if the output buffer is at least as large
+// as the ciphertext, so decryption does not invalidate the session.
+package main
+
+/*
+#include <stddef.h>
+#include <stdint.h>
+
+#define NYQUIST_OK                 0
+#define NYQUIST_DONE               1
+#define NYQUIST_ERR_INVALID       -1
+#define NYQUIST_ERR_HANDLE        -2
+#define NYQUIST_ERR_BUFFER        -3
+#define NYQUIST_ERR_OPEN          -4
+#define NYQUIST_ERR_MESSAGE_SIZE  -5
+#define NYQUIST_ERR_NONCE         -6
+#define NYQUIST_ERR_OUT_OF_ORDER  -7
+#define NYQUIST_ERR_NOT_SUPPORTED -8
+#define NYQUIST_ERR_FAILED        -9
+
+// Input buffers may be at most NYQUIST_MAX_BUFFER_SIZE bytes.
+//
+// NYQUIST_ERR_BUFFER from a handshake operation or from encryption
+// invalidates the handle, so further operations on it fail with
+// NYQUIST_ERR_HANDLE.  It must still be released with the appropriate
+// _free call.
+#define NYQUIST_MAX_BUFFER_SIZE   (1 << 30)
+
+typedef uintptr_t nyquist_handle;
+*/
+import "C"
+
+import (
+	"errors"
+	"sync"
+	"unsafe"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/bindings"
+)
+
+const maxBufferSize = C.NYQUIST_MAX_BUFFER_SIZE
+
+// Go names for the C types, as the tests may not use cgo.
+type (
+	cChar   = C.char
+	cInt    = C.int
+	cSize   = C.size_t
+	cUint8  = C.uint8_t
+	cHandle = C.nyquist_handle
+)
+
+var (
+	handlesLock sync.Mutex
+	handles     = make(map[C.nyquist_handle]interface{})
+	nextHandle  C.nyquist_handle
+
+	errorStrings = map[C.int]*C.char{
+		C.NYQUIST_OK:                C.CString("ok"),
+		C.NYQUIST_DONE:              C.CString("handshake complete"),
+		C.NYQUIST_ERR_INVALID:       C.CString("invalid argument"),
+		C.NYQUIST_ERR_HANDLE:        C.CString("invalid handle"),
+		C.NYQUIST_ERR_BUFFER:        C.CString("output buffer too small"),
+		C.NYQUIST_ERR_OPEN:          C.CString("decryption failure"),
+		C.NYQUIST_ERR_MESSAGE_SIZE:  C.CString("oversized message"),
+		C.NYQUIST_ERR_NONCE:         C.CString("nonce exhausted"),
+		C.NYQUIST_ERR_OUT_OF_ORDER:  C.CString("out of order handshake operation"),
+		C.NYQUIST_ERR_NOT_SUPPORTED: C.CString("protocol not supported"),
+		C.NYQUIST_ERR_FAILED:        C.CString("operation failed"),
+	}
+)
+
+func newHandle(v interface{}) C.nyquist_handle {
+	handlesLock.Lock()
+	defer handlesLock.Unlock()
+
+	nextHandle++
+	handles[nextHandle] = v
+	return nextHandle
+}
+
+// invalidHandle is the value of a handle that is no longer usable, but has
+// yet to be released.
+type invalidHandle struct{}
+
+func invalidateHandle(h C.nyquist_handle) {
+	handlesLock.Lock()
+	defer handlesLock.Unlock()
+
+	if _, ok := handles[h]; ok {
+		handles[h] = invalidHandle{}
+	}
+}
+
+func getHandle(h C.nyquist_handle) interface{} {
+	handlesLock.Lock()
+	defer handlesLock.Unlock()
+
+	return handles[h]
+}
+
+func freeHandle(h C.nyquist_handle) interface{} {
+	handlesLock.Lock()
+	defer handlesLock.Unlock()
+
+	v := handles[h]
+	delete(handles, h)
+	return v
+}
+
+func toStatus(err error) C.int {
+	switch {
+	case err == nil:
+		return C.NYQUIST_OK
+	case errors.Is(err, nyquist.ErrOpen):
+		return C.NYQUIST_ERR_OPEN
+	case errors.Is(err, nyquist.ErrMessageSize):
+		return C.NYQUIST_ERR_MESSAGE_SIZE
+	case errors.Is(err, nyquist.ErrNonceExhausted):
+		return C.NYQUIST_ERR_NONCE
+	case errors.Is(err, nyquist.ErrOutOfOrder):
+		return C.NYQUIST_ERR_OUT_OF_ORDER
+	case errors.Is(err, nyquist.ErrProtocolNotSupported):
+		return C.NYQUIST_ERR_NOT_SUPPORTED
+	default:
+		return C.NYQUIST_ERR_FAILED
+	}
+}
+
+func goBytes(p *C.uint8_t, n C.size_t) ([]byte, bool) {
+	if n > maxBufferSize {
+		return nil, false
+	}
+	if p == nil || n == 0 {
+		return nil, true
+	}
+	return C.GoBytes(unsafe.Pointer(p), C.int(n)), true
+}
+
+func writeOut(b []byte, dst *C.uint8_t, dstCap C.size_t, dstLen *C.size_t) C.int {
+	if dstLen == nil {
+		return C.NYQUIST_ERR_INVALID
+	}
+	*dstLen = C.size_t(len(b))
+	if len(b) == 0 {
+		return C.NYQUIST_OK
+	}
+	if dst == nil || C.size_t(len(b)) > dstCap || len(b) > maxBufferSize {
+		return C.NYQUIST_ERR_BUFFER
+	}
+	out := (*[maxBufferSize]byte)(unsafe.Pointer(dst))[:len(b):len(b)]
+	copy(out, b)
+	return C.NYQUIST_OK
+}
+
+// nyquist_strerror returns a static string describing a status code.
+//
+//export nyquist_strerror
+func nyquist_strerror(status C.int) *C.char {
+	if s, ok := errorStrings[status]; ok {
+		return s
+	}
+	return errorStrings[C.NYQUIST_ERR_FAILED]
+}
+
+// nyquist_keypair_generate generates a new keypair for the named DH
+// function, writing out the serialized private and public keys.
+//
+//export nyquist_keypair_generate
+func nyquist_keypair_generate(dhName *C.char, priv *C.uint8_t, privCap C.size_t, privLen *C.size_t, pub *C.uint8_t, pubCap C.size_t, pubLen *C.size_t) C.int {
+	if dhName == nil {
+		return C.NYQUIST_ERR_INVALID
+	}
+	kp, err := bindings.GenerateKeypair(C.GoString(dhName))
+	if err != nil {
+		return C.NYQUIST_ERR_NOT_SUPPORTED
+	}
+	privBytes, err := kp.PrivateKey()
+	if err != nil {
+		return toStatus(err)
+	}
+	if status := writeOut(privBytes, priv, privCap, privLen); status != C.NYQUIST_OK {
+		return status
+	}
+	return writeOut(kp.PublicKey(), pub, pubCap, pubLen)
+}
+
+// nyquist_handshake_new creates a new handshake.  The optional pre-shared
+// keys are passed as a concatenation of 32 byte keys, in the order that
+// they are used by the pattern.
+//
+//export nyquist_handshake_new
+func nyquist_handshake_new(protocolName *C.char, isInitiator C.int, localStatic *C.uint8_t, localStaticLen C.size_t, remoteStatic *C.uint8_t, remoteStaticLen C.size_t, psks *C.uint8_t, psksLen C.size_t, prologue *C.uint8_t, prologueLen C.size_t, out *C.nyquist_handle) C.int {
+	if protocolName == nil || out == nil || psksLen%nyquist.PreSharedKeySize != 0 {
+		return C.NYQUIST_ERR_INVALID
+	}
+
+	name := C.GoString(protocolName)
+	protocol, err := nyquist.NewProtocol(name)
+	if err != nil {
+		return toStatus(err)
+	}
+
+	prologueBytes, ok1 := goBytes(prologue, prologueLen)
+	localStaticBytes, ok2 := goBytes(localStatic, localStaticLen)
+	remoteStaticBytes, ok3 := goBytes(remoteStatic, remoteStaticLen)
+	pskBytes, ok4 := goBytes(psks, psksLen)
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return C.NYQUIST_ERR_INVALID
+	}
+
+	cfg := bindings.NewConfig(name, isInitiator != 0)
+	cfg.SetPrologue(prologueBytes)
+	if localStaticBytes != nil {
+		kp, kpErr := bindings.ParseKeypair(protocol.DH.String(), localStaticBytes)
+		if kpErr != nil {
+			return C.NYQUIST_ERR_INVALID
+		}
+		cfg.SetLocalStatic(kp)
+	}
+	if remoteStaticBytes != nil {
+		cfg.SetRemoteStatic(remoteStaticBytes)
+	}
+	for len(pskBytes) > 0 {
+		cfg.AddPreSharedKey(pskBytes[:nyquist.PreSharedKeySize])
+		pskBytes = pskBytes[nyquist.PreSharedKeySize:]
+	}
+
+	hs, err := bindings.NewHandshake(cfg)
+	if err != nil {
+		return C.NYQUIST_ERR_INVALID
+	}
+	*out = newHandle(hs)
+
+	return C.NYQUIST_OK
+}
+
+func handshakeOp(h C.nyquist_handle, in *C.uint8_t, inLen C.size_t, dst *C.uint8_t, dstCap C.size_t, dstLen *C.size_t, isWrite bool) C.int {
+	hs, ok := getHandle(h).(*bindings.Handshake)
+	if !ok {
+		return C.NYQUIST_ERR_HANDLE
+	}
+	src, ok := goBytes(in, inLen)
+	if !ok {
+		return C.NYQUIST_ERR_INVALID
+	}
+
+	var (
+		b   []byte
+		err error
+	)
+	if isWrite {
+		b, err = hs.WriteMessage(src)
+	} else {
+		b, err = hs.ReadMessage(src)
+	}
+	if err != nil {
+		return toStatus(err)
+	}
+	if status := writeOut(b, dst, dstCap, dstLen); status != C.NYQUIST_OK {
+		// The handshake has advanced, so the handle is unusable.
+		if status == C.NYQUIST_ERR_BUFFER {
+			invalidateHandle(h)
+			hs.Close()
+		}
+		return status
+	}
+	if hs.IsDone() {
+		return C.NYQUIST_DONE
+	}
+	return C.NYQUIST_OK
+}
+
+// nyquist_handshake_write_message processes a write step of the handshake,
+// returning NYQUIST_DONE iff the handshake is complete.  Providing an
+// output buffer that is too small will invalidate the handle.
+//
+//export nyquist_handshake_write_message
+func nyquist_handshake_write_message(h C.nyquist_handle, payload *C.uint8_t, payloadLen C.size_t, dst *C.uint8_t, dstCap C.size_t, dstLen *C.size_t) C.int {
+	return handshakeOp(h, payload, payloadLen, dst, dstCap, dstLen, true)
+}
+
+// nyquist_handshake_read_message processes a read step of the handshake,
+// returning NYQUIST_DONE iff the handshake is complete.  Providing an
+// output buffer that is too small will invalidate the handle.
+//
+//export nyquist_handshake_read_message
+func nyquist_handshake_read_message(h C.nyquist_handle, message *C.uint8_t, messageLen C.size_t, dst *C.uint8_t, dstCap C.size_t, dstLen *C.size_t) C.int {
+	return handshakeOp(h, message, messageLen, dst, dstCap, dstLen, false)
+}
+
+// nyquist_handshake_session returns a new session handle for a completed
+// handshake.
+//
+//export nyquist_handshake_session
+func nyquist_handshake_session(h C.nyquist_handle, out *C.nyquist_handle) C.int {
+	hs, ok := getHandle(h).(*bindings.Handshake)
+	if !ok {
+		return C.NYQUIST_ERR_HANDLE
+	}
+	if out == nil {
+		return C.NYQUIST_ERR_INVALID
+	}
+	s, err := hs.Session()
+	if err != nil {
+		return C.NYQUIST_ERR_OUT_OF_ORDER
+	}
+	*out = newHandle(s)
+
+	return C.NYQUIST_OK
+}
+
+// nyquist_handshake_free releases a handshake handle.
+//
+//export nyquist_handshake_free
+func nyquist_handshake_free(h C.nyquist_handle) {
+	if hs, ok := freeHandle(h).(*bindings.Handshake); ok {
+		hs.Close()
+	}
+}
+
+func sessionOp(h C.nyquist_handle, in *C.uint8_t, inLen C.size_t, dst *C.uint8_t, dstCap C.size_t, dstLen *C.size_t, isEncrypt bool) C.int {
+	s, ok := getHandle(h).(*bindings.Session)
+	if !ok {
+		return C.NYQUIST_ERR_HANDLE
+	}
+	src, ok := goBytes(in, inLen)
+	if !ok {
+		return C.NYQUIST_ERR_INVALID
+	}
+
+	var (
+		b   []byte
+		err error
+	)
+	if isEncrypt {
+		b, err = s.Encrypt(src)
+	} else {
+		if inLen > dstCap {
+			return C.NYQUIST_ERR_BUFFER
+		}
+		b, err = s.Decrypt(src)
+	}
+	if err != nil {
+		return toStatus(err)
+	}
+	if status := writeOut(b, dst, dstCap, dstLen); status != C.NYQUIST_OK {
+		// The nonce has been consumed, so the session is unusable.
+		if isEncrypt {
+			invalidateHandle(h)
+			s.Close()
+		}
+		return status
+	}
+	return C.NYQUIST_OK
+}
+
+// nyquist_session_encrypt encrypts a transport message.  Providing an
+// output buffer that is too small will render the session unusable.
+//
+//export nyquist_session_encrypt
+func nyquist_session_encrypt(h C.nyquist_handle, plaintext *C.uint8_t, plaintextLen C.size_t, dst *C.uint8_t, dstCap C.size_t, dstLen *C.size_t) C.int {
+	return sessionOp(h, plaintext, plaintextLen, dst, dstCap, dstLen, true)
+}
+
+// nyquist_session_decrypt decrypts a transport message.  The output buffer
+// must be at least as large as the ciphertext.
+//
+//export nyquist_session_decrypt
+func nyquist_session_decrypt(h C.nyquist_handle, ciphertext *C.uint8_t, ciphertextLen C.size_t, dst *C.uint8_t, dstCap C.size_t, dstLen *C.size_t) C.int {
+	return sessionOp(h, ciphertext, ciphertextLen, dst, dstCap, dstLen, false)
+}
+
+// nyquist_session_handshake_hash writes out the session's handshake hash.
+//
+//export nyquist_session_handshake_hash
+func nyquist_session_handshake_hash(h C.nyquist_handle, dst *C.uint8_t, dstCap C.size_t, dstLen *C.size_t) C.int {
+	s, ok := getHandle(h).(*bindings.Session)
+	if !ok {
+		return C.NYQUIST_ERR_HANDLE
+	}
+	return writeOut(s.HandshakeHash(), dst, dstCap, dstLen)
+}
+
+// nyquist_session_remote_static writes out the session's remote static
+// public key, if any.
+//
+//export nyquist_session_remote_static
+func nyquist_session_remote_static(h C.nyquist_handle, dst *C.uint8_t, dstCap C.size_t, dstLen *C.size_t) C.int {
+	s, ok := getHandle(h).(*bindings.Session)
+	if !ok {
+		return C.NYQUIST_ERR_HANDLE
+	}
+	return writeOut(s.RemoteStatic(), dst, dstCap, dstLen)
+}
+
+// nyquist_session_free releases a session handle.
+//
+//export nyquist_session_free
+func nyquist_session_free(h C.nyquist_handle) {
+	if s, ok := freeHandle(h).(*bindings.Session); ok {
+		s.Close()
+	}
+}
+
+func main() {}
@@ -0,0 +1,229 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The status codes are part of the ABI, so they are deliberately
+// duplicated here, rather than taken from the header.
+const (
+	statusOK         cInt = 0
+	statusDone       cInt = 1
+	statusErrInvalid cInt = -1
+	statusErrHandle  cInt = -2
+	statusErrBuffer  cInt = -3
+	statusErrOpen    cInt = -4
+)
+
+func cBuf(b []byte) (*cUint8, cSize) {
+	if len(b) == 0 {
+		return nil, 0
+	}
+	return (*cUint8)(unsafe.Pointer(&b[0])), cSize(len(b))
+}
+
+func cStr(s string) *cChar {
+	b := append([]byte(s), 0)
+	return (*cChar)(unsafe.Pointer(&b[0]))
+}
+
+func newTestHandshake(t *testing.T, isInitiator bool) cHandle {
+	var (
+		h         cHandle
+		initiator cInt
+	)
+	if isInitiator {
+		initiator = 1
+	}
+	status := nyquist_handshake_new(cStr("Noise_NN_25519_ChaChaPoly_BLAKE2s"), initiator, nil, 0, nil, 0, nil, 0, nil, 0, &h)
+	require.Equal(t, statusOK, status, "nyquist_handshake_new")
+	return h
+}
+
+type handshakeFunc func(cHandle, *cUint8, cSize, *cUint8, cSize, *cSize) cInt
+
+func handshakeStep(t *testing.T, fn handshakeFunc, h cHandle, in []byte) ([]byte, cInt) {
+	var (
+		dst    = make([]byte, 1024)
+		dstLen cSize
+	)
+	inPtr, inLen := cBuf(in)
+	dstPtr, dstCap := cBuf(dst)
+	status := fn(h, inPtr, inLen, dstPtr, dstCap, &dstLen)
+	require.True(t, status == statusOK || status == statusDone, "handshake step: %d", status)
+	return dst[:dstLen], status
+}
+
+func newTestSessions(t *testing.T) (cHandle, cHandle) {
+	require := require.New(t)
+
+	initHs, respHs := newTestHandshake(t, true), newTestHandshake(t, false)
+	defer nyquist_handshake_free(initHs)
+	defer nyquist_handshake_free(respHs)
+
+	msg, _ := handshakeStep(t, nyquist_handshake_write_message, initHs, nil)
+	_, status := handshakeStep(t, nyquist_handshake_read_message, respHs, msg)
+	require.Equal(statusOK, status, "responder read")
+	msg, status = handshakeStep(t, nyquist_handshake_write_message, respHs, nil)
+	require.Equal(statusDone, status, "responder write")
+	_, status = handshakeStep(t, nyquist_handshake_read_message, initHs, msg)
+	require.Equal(statusDone, status, "initiator read")
+
+	var initS, respS cHandle
+	require.Equal(statusOK, nyquist_handshake_session(initHs, &initS), "initiator session")
+	require.Equal(statusOK, nyquist_handshake_session(respHs, &respS), "responder session")
+	return initS, respS
+}
+
+func TestLibnyquist(t *testing.T) {
+	t.Run("Keypair", func(t *testing.T) {
+		require := require.New(t)
+
+		var (
+			priv, pub       = make([]byte, 16), make([]byte, 32)
+			privLen, pubLen cSize
+		)
+		privPtr, privCap := cBuf(priv)
+		pubPtr, pubCap := cBuf(pub)
+		status := nyquist_keypair_generate(cStr("25519"), privPtr, privCap, &privLen, pubPtr, pubCap, &pubLen)
+		require.Equal(statusErrBuffer, status, "short private key buffer")
+		require.EqualValues(32, privLen, "required private key length")
+
+		priv = make([]byte, 32)
+		privPtr, privCap = cBuf(priv)
+		status = nyquist_keypair_generate(cStr("25519"), privPtr, privCap, &privLen, pubPtr, pubCap, &pubLen)
+		require.Equal(statusOK, status, "nyquist_keypair_generate")
+		require.EqualValues(32, pubLen, "public key length")
+
+		status = nyquist_keypair_generate(nil, privPtr, privCap, &privLen, pubPtr, pubCap, &pubLen)
+		require.Equal(statusErrInvalid, status, "nil DH name")
+	})
+
+	t.Run("Handshake/ShortBuffer", func(t *testing.T) {
+		require := require.New(t)
+
+		h := newTestHandshake(t, true)
+		defer nyquist_handshake_free(h)
+
+		var (
+			dst    = make([]byte, 8)
+			dstLen cSize
+		)
+		dstPtr, dstCap := cBuf(dst)
+		status := nyquist_handshake_write_message(h, nil, 0, dstPtr, dstCap, &dstLen)
+		require.Equal(statusErrBuffer, status, "short output buffer")
+		require.EqualValues(32, dstLen, "required message length")
+
+		// The handshake has advanced, so the handle is invalidated, but
+		// remains registered until released.
+		dst = make([]byte, 1024)
+		dstPtr, dstCap = cBuf(dst)
+		status = nyquist_handshake_write_message(h, nil, 0, dstPtr, dstCap, &dstLen)
+		require.Equal(statusErrHandle, status, "invalidated handle")
+		require.IsType(invalidHandle{}, getHandle(h), "handle still registered")
+		nyquist_handshake_free(h)
+		require.Nil(getHandle(h), "handle released")
+	})
+
+	t.Run("Handshake/OversizedInput", func(t *testing.T) {
+		require := require.New(t)
+
+		h := newTestHandshake(t, true)
+		defer nyquist_handshake_free(h)
+
+		var (
+			payload = []byte("payload")
+			dst     = make([]byte, 1024)
+			dstLen  cSize
+		)
+		payloadPtr, _ := cBuf(payload)
+		dstPtr, dstCap := cBuf(dst)
+		status := nyquist_handshake_write_message(h, payloadPtr, maxBufferSize+1, dstPtr, dstCap, &dstLen)
+		require.Equal(statusErrInvalid, status, "oversized input")
+
+		// The input is rejected before the handshake is touched.
+		_, status = handshakeStep(t, nyquist_handshake_write_message, h, payload)
+		require.Equal(statusOK, status, "write after oversized input")
+	})
+
+	t.Run("Session", func(t *testing.T) {
+		require := require.New(t)
+
+		initS, respS := newTestSessions(t)
+		defer nyquist_session_free(initS)
+		defer nyquist_session_free(respS)
+
+		var (
+			plaintext = []byte("libnyquist test message")
+			ct        = make([]byte, len(plaintext)+16)
+			pt        = make([]byte, len(ct))
+			ctLen     cSize
+			ptLen     cSize
+		)
+		plaintextPtr, plaintextLen := cBuf(plaintext)
+		ctPtr, ctCap := cBuf(ct)
+		status := nyquist_session_encrypt(initS, plaintextPtr, plaintextLen, ctPtr, ctCap, &ctLen)
+		require.Equal(statusOK, status, "nyquist_session_encrypt")
+		require.EqualValues(len(ct), ctLen, "ciphertext length")
+
+		// Decryption checks the output buffer up front, so a short buffer
+		// does not invalidate the session.
+		ptPtr, _ := cBuf(pt)
+		status = nyquist_session_decrypt(respS, ctPtr, ctLen, ptPtr, ctLen-1, &ptLen)
+		require.Equal(statusErrBuffer, status, "decrypt - short output buffer")
+		status = nyquist_session_decrypt(respS, ctPtr, ctLen, ptPtr, cSize(len(pt)), &ptLen)
+		require.Equal(statusOK, status, "nyquist_session_decrypt")
+		require.Equal(plaintext, pt[:ptLen], "decrypted plaintext")
+
+		status = nyquist_session_decrypt(respS, ctPtr, ctLen, ptPtr, cSize(len(pt)), &ptLen)
+		require.Equal(statusErrOpen, status, "decrypt - replayed ciphertext")
+
+		// Encryption consumes the nonce before the output buffer size is
+		// known, so a short buffer invalidates the session.
+		status = nyquist_session_encrypt(initS, plaintextPtr, plaintextLen, ctPtr, ctCap-1, &ctLen)
+		require.Equal(statusErrBuffer, status, "encrypt - short output buffer")
+		status = nyquist_session_encrypt(initS, plaintextPtr, plaintextLen, ctPtr, ctCap, &ctLen)
+		require.Equal(statusErrHandle, status, "encrypt - invalidated handle")
+	})
+
+	t.Run("Strerror", func(t *testing.T) {
+		require := require.New(t)
+
+		for _, status := range []cInt{statusOK, statusErrBuffer, 42} {
+			require.NotNil(nyquist_strerror(status), "nyquist_strerror(%d)", status)
+		}
+		require.Equal(nyquist_strerror(statusErrHandle), errorStrings[statusErrHandle], "nyquist_strerror - known status")
+	})
+}
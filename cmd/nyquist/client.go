@@ -0,0 +1,100 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const packetLinger = 1 * time.Second
+
+func runClient(args []string) error {
+	var sf sessionFlags
+	fs := flag.NewFlagSet("client", flag.ExitOnError)
+	sf.register(fs)
+	_ = fs.Parse(args)
+
+	rawConn, err := net.Dial(sf.network, sf.addr)
+	if err != nil {
+		return err
+	}
+
+	var (
+		conn     msgConn
+		isPacket bool
+	)
+	switch sf.network {
+	case "tcp", "tcp4", "tcp6":
+		conn = &streamConn{rawConn}
+	case "udp", "udp4", "udp6":
+		conn = &packetConn{rawConn, make([]byte, 65536)}
+		isPacket = true
+	default:
+		rawConn.Close()
+		return fmt.Errorf("unsupported network: '%s'", sf.network)
+	}
+
+	s, err := handshake(&sf, conn, true)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer s.Close()
+
+	errCh := make(chan error, 1)
+	if s.rx != nil {
+		go func() {
+			errCh <- pipeStdout(s)
+		}()
+	}
+	if err = pipeStdin(s); err != nil {
+		return err
+	}
+	if s.rx == nil {
+		return nil
+	}
+
+	// Keep printing responses until the server closes the connection,
+	// or in the case of datagrams, stops responding.
+	if isPacket {
+		_ = rawConn.SetReadDeadline(time.Now().Add(packetLinger))
+	} else if tcpConn, ok := rawConn.(*net.TCPConn); ok {
+		_ = tcpConn.CloseWrite()
+	}
+	err = <-errCh
+	if netErr, ok := err.(net.Error); err == io.EOF || (ok && netErr.Timeout()) {
+		err = nil
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+const (
+	formatHex = "hex"
+	formatRaw = "raw"
+	formatPEM = "pem"
+
+	pemPrivateSuffix = " PRIVATE KEY"
+	pemPublicSuffix  = " PUBLIC KEY"
+	pemPrefix        = "NOISE "
+)
+
+var keyFormats = []string{formatHex, formatRaw, formatPEM}
+
+func pemType(dhImpl dh.DH, isPrivate bool) string {
+	suffix := pemPublicSuffix
+	if isPrivate {
+		suffix = pemPrivateSuffix
+	}
+	return pemPrefix + dhImpl.String() + suffix
+}
+
+func encodeKey(format string, dhImpl dh.DH, b []byte, isPrivate bool) ([]byte, error) {
+	switch format {
+	case formatHex:
+		return []byte(hex.EncodeToString(b) + "\n"), nil
+	case formatRaw:
+		return append([]byte{}, b...), nil
+	case formatPEM:
+		return pem.EncodeToMemory(&pem.Block{
+			Type:  pemType(dhImpl, isPrivate),
+			Bytes: b,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unsupported key format: '%s'", format)
+	}
+}
+
+// decodeKey decodes a serialized key, automatically detecting the format.
+func decodeKey(dhImpl dh.DH, b []byte, isPrivate bool) ([]byte, error) {
+	if blk, _ := pem.Decode(b); blk != nil {
+		if expected := pemType(dhImpl, isPrivate); blk.Type != expected {
+			return nil, fmt.Errorf("unexpected PEM block type: '%s' (expected '%s')", blk.Type, expected)
+		}
+		return blk.Bytes, nil
+	}
+	if decoded, err := hex.DecodeString(string(bytes.TrimSpace(b))); err == nil {
+		return decoded, nil
+	}
+	return b, nil
+}
+
+func loadPrivateKey(dhImpl dh.DH, fn string) (dh.Keypair, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = decodeKey(dhImpl, b, true); err != nil {
+		return nil, err
+	}
+	return dhImpl.ParsePrivateKey(b)
+}
+
+// parsePublicKey parses a public key from either a hex string, or a file.
+func parsePublicKey(dhImpl dh.DH, s string) (dh.PublicKey, error) {
+	if b, err := hex.DecodeString(s); err == nil && len(b) == dhImpl.Size() {
+		return dhImpl.ParsePublicKey(b)
+	}
+
+	b, err := ioutil.ReadFile(s)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = decodeKey(dhImpl, b, false); err != nil {
+		return nil, err
+	}
+	return dhImpl.ParsePublicKey(b)
+}
+
+// fingerprint returns the human readable fingerprint of a public key.
+func fingerprint(pk dh.PublicKey) string {
+	digest := sha256.Sum256(pk.Bytes())
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(digest[:])
+}
+
+func formatList() string {
+	return strings.Join(keyFormats, ", ")
+}
@@ -0,0 +1,92 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+func runKeygen(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	dhName := fs.String("dh", "25519", "DH function")
+	format := fs.String("format", formatHex, "output format ("+formatList()+")")
+	out := fs.String("out", "", "output file prefix (`<out>` and `<out>.pub`), stdout if unset")
+	_ = fs.Parse(args)
+
+	dhImpl := dh.FromString(*dhName)
+	if dhImpl == nil {
+		return fmt.Errorf("unsupported DH function: '%s'", *dhName)
+	}
+
+	kp, err := dhImpl.GenerateKeypair(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate keypair: %w", err)
+	}
+	defer kp.DropPrivate()
+
+	privBytes, err := kp.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("failed to serialize private key: %w", err)
+	}
+	encodedPriv, err := encodeKey(*format, dhImpl, privBytes, true)
+	if err != nil {
+		return err
+	}
+	encodedPub, err := encodeKey(*format, dhImpl, kp.Public().Bytes(), false)
+	if err != nil {
+		return err
+	}
+
+	switch *out {
+	case "":
+		if *format == formatRaw {
+			return fmt.Errorf("refusing to write raw keys to stdout")
+		}
+		_, _ = os.Stdout.Write(encodedPriv)
+		_, _ = os.Stdout.Write(encodedPub)
+	default:
+		if err = ioutil.WriteFile(*out, encodedPriv, 0o600); err != nil {
+			return fmt.Errorf("failed to write private key: %w", err)
+		}
+		if err = ioutil.WriteFile(*out+".pub", encodedPub, 0o644); err != nil {
+			return fmt.Errorf("failed to write public key: %w", err)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "%s %s\n", dhImpl.String(), fingerprint(kp.Public()))
+
+	return nil
+}
@@ -0,0 +1,201 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+func runServer(args []string) error {
+	var sf sessionFlags
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+	sf.register(fs)
+	pipe := fs.Bool("pipe", false, "pipe stdin/stdout instead of echoing (single session)")
+	_ = fs.Parse(args)
+
+	handler := serveEcho
+	if *pipe {
+		handler = servePipe
+	}
+
+	switch sf.network {
+	case "tcp", "tcp4", "tcp6":
+		return serveStream(&sf, handler)
+	case "udp", "udp4", "udp6":
+		return servePacket(&sf, handler)
+	default:
+		return fmt.Errorf("unsupported network: '%s'", sf.network)
+	}
+}
+
+func serveStream(sf *sessionFlags, handler func(*sessionFlags, *session)) error {
+	ln, err := net.Listen(sf.network, sf.addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	sf.logf("listening on %s/%s", sf.network, ln.Addr())
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go serveConn(sf, &streamConn{conn}, conn.RemoteAddr(), handler)
+	}
+}
+
+func servePacket(sf *sessionFlags, handler func(*sessionFlags, *session)) error {
+	pc, err := net.ListenPacket(sf.network, sf.addr)
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	sf.logf("listening on %s/%s", sf.network, pc.LocalAddr())
+
+	var (
+		peersLock sync.Mutex
+		peers     = make(map[string]*peerConn)
+	)
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		peersLock.Lock()
+		peer, ok := peers[addr.String()]
+		if !ok {
+			peer = &peerConn{
+				pc:     pc,
+				addr:   addr,
+				recvCh: make(chan []byte, 16),
+				onClose: func() {
+					peersLock.Lock()
+					delete(peers, addr.String())
+					peersLock.Unlock()
+				},
+			}
+			peers[addr.String()] = peer
+			go serveConn(sf, peer, addr, handler)
+		}
+		peersLock.Unlock()
+
+		select {
+		case peer.recvCh <- append([]byte{}, buf[:n]...):
+		default:
+			// Drop the datagram if the session is not keeping up.
+		}
+	}
+}
+
+func serveConn(sf *sessionFlags, conn msgConn, addr net.Addr, handler func(*sessionFlags, *session)) {
+	s, err := handshake(sf, conn, false)
+	if err != nil {
+		sf.logf("%s: handshake failed: %v", addr, err)
+		conn.Close()
+		return
+	}
+	defer s.Close()
+
+	handler(sf, s)
+	sf.logf("%s: session closed", addr)
+}
+
+func serveEcho(sf *sessionFlags, s *session) {
+	for {
+		b, err := s.Recv()
+		if err != nil {
+			if err != io.EOF {
+				sf.logf("recv failed: %v", err)
+			}
+			return
+		}
+		if s.tx == nil {
+			sf.logf("received %d bytes (one-way)", len(b))
+			continue
+		}
+		if err = s.Send(b); err != nil {
+			sf.logf("send failed: %v", err)
+			return
+		}
+	}
+}
+
+var pipeLock sync.Mutex
+
+func servePipe(sf *sessionFlags, s *session) {
+	// Only one session at a time gets to use stdin/stdout.
+	pipeLock.Lock()
+	defer pipeLock.Unlock()
+
+	if s.tx != nil {
+		go func() {
+			if err := pipeStdin(s); err != nil {
+				sf.logf("send failed: %v", err)
+			}
+		}()
+	}
+	if err := pipeStdout(s); err != nil && err != io.EOF {
+		sf.logf("recv failed: %v", err)
+	}
+}
+
+// peerConn is a per-peer message connection over a shared packet socket.
+type peerConn struct {
+	pc      net.PacketConn
+	addr    net.Addr
+	recvCh  chan []byte
+	onClose func()
+	once    sync.Once
+}
+
+func (c *peerConn) ReadMsg() ([]byte, error) {
+	b, ok := <-c.recvCh
+	if !ok {
+		return nil, io.EOF
+	}
+	return b, nil
+}
+
+func (c *peerConn) WriteMsg(b []byte) error {
+	_, err := c.pc.WriteTo(b, c.addr)
+	return err
+}
+
+func (c *peerConn) Close() error {
+	c.once.Do(c.onClose)
+	return nil
+}
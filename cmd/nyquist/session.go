@@ -0,0 +1,303 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"gitlab.com/yawning/nyquist.git"
+)
+
+const (
+	defaultProtocol = "Noise_XX_25519_ChaChaPoly_BLAKE2s"
+
+	maxPlaintextChunk = nyquist.DefaultMaxMessageSize - 64
+)
+
+var errOneWay = errors.New("one-way pattern, responder can not send")
+
+// sessionFlags are the flags shared by the client and server commands.
+type sessionFlags struct {
+	protocol     string
+	network      string
+	addr         string
+	localStatic  string
+	remoteStatic string
+	psks         string
+	prologue     string
+	verbose      bool
+}
+
+func (sf *sessionFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&sf.protocol, "protocol", defaultProtocol, "Noise protocol name")
+	fs.StringVar(&sf.network, "net", "tcp", "network (tcp, udp)")
+	fs.StringVar(&sf.addr, "addr", "127.0.0.1:4242", "address")
+	fs.StringVar(&sf.localStatic, "key", "", "local static private key file")
+	fs.StringVar(&sf.remoteStatic, "remote", "", "remote static public key (hex or file)")
+	fs.StringVar(&sf.psks, "psk", "", "comma separated hex encoded pre-shared keys")
+	fs.StringVar(&sf.prologue, "prologue", "", "prologue")
+	fs.BoolVar(&sf.verbose, "v", false, "verbose output")
+}
+
+func (sf *sessionFlags) handshakeConfig(isInitiator bool) (*nyquist.HandshakeConfig, error) {
+	protocol, err := nyquist.NewProtocol(sf.protocol)
+	if err != nil {
+		return nil, fmt.Errorf("invalid protocol '%s': %w", sf.protocol, err)
+	}
+
+	cfg := &nyquist.HandshakeConfig{
+		Protocol:    protocol,
+		Prologue:    []byte(sf.prologue),
+		IsInitiator: isInitiator,
+	}
+	if sf.localStatic != "" {
+		if cfg.LocalStatic, err = loadPrivateKey(protocol.DH, sf.localStatic); err != nil {
+			return nil, fmt.Errorf("failed to load local static key: %w", err)
+		}
+	}
+	if sf.remoteStatic != "" {
+		if cfg.RemoteStatic, err = parsePublicKey(protocol.DH, sf.remoteStatic); err != nil {
+			return nil, fmt.Errorf("failed to load remote static key: %w", err)
+		}
+	}
+	if sf.psks != "" {
+		for _, v := range strings.Split(sf.psks, ",") {
+			psk, pskErr := hex.DecodeString(v)
+			if pskErr != nil {
+				return nil, fmt.Errorf("malformed pre-shared key: %w", pskErr)
+			}
+			cfg.PreSharedKeys = append(cfg.PreSharedKeys, psk)
+		}
+	}
+
+	return cfg, nil
+}
+
+func (sf *sessionFlags) logf(format string, a ...interface{}) {
+	if sf.verbose {
+		fmt.Fprintf(os.Stderr, format+"\n", a...)
+	}
+}
+
+// msgConn is a message oriented connection.
+type msgConn interface {
+	ReadMsg() ([]byte, error)
+	WriteMsg([]byte) error
+	Close() error
+}
+
+// streamConn frames messages over a stream with a 16 bit big endian
+// length prefix.
+type streamConn struct {
+	conn net.Conn
+}
+
+func (c *streamConn) ReadMsg() ([]byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(c.conn, hdr[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+	if _, err := io.ReadFull(c.conn, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (c *streamConn) WriteMsg(b []byte) error {
+	if len(b) > 0xffff {
+		return nyquist.ErrMessageSize
+	}
+	frame := make([]byte, 2, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	_, err := c.conn.Write(append(frame, b...))
+	return err
+}
+
+func (c *streamConn) Close() error {
+	return c.conn.Close()
+}
+
+// packetConn sends each message as a single datagram.
+type packetConn struct {
+	conn net.Conn
+	buf  []byte
+}
+
+func (c *packetConn) ReadMsg() ([]byte, error) {
+	n, err := c.conn.Read(c.buf)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{}, c.buf[:n]...), nil
+}
+
+func (c *packetConn) WriteMsg(b []byte) error {
+	_, err := c.conn.Write(b)
+	return err
+}
+
+func (c *packetConn) Close() error {
+	return c.conn.Close()
+}
+
+// session is an established transport session.
+type session struct {
+	conn   msgConn
+	tx, rx *nyquist.CipherState
+}
+
+func (s *session) Send(plaintext []byte) error {
+	if s.tx == nil {
+		return errOneWay
+	}
+	ciphertext, err := s.tx.EncryptWithAd(nil, nil, plaintext)
+	if err != nil {
+		return err
+	}
+	return s.conn.WriteMsg(ciphertext)
+}
+
+func (s *session) Recv() ([]byte, error) {
+	ciphertext, err := s.conn.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if s.rx == nil {
+		return nil, errOneWay
+	}
+	return s.rx.DecryptWithAd(nil, nil, ciphertext)
+}
+
+func (s *session) Close() {
+	for _, cs := range []*nyquist.CipherState{s.tx, s.rx} {
+		if cs != nil {
+			cs.Reset()
+		}
+	}
+	_ = s.conn.Close()
+}
+
+// handshake runs the handshake over the connection, and returns the
+// established session.
+func handshake(sf *sessionFlags, conn msgConn, isInitiator bool) (*session, error) {
+	cfg, err := sf.handshakeConfig(isInitiator)
+	if err != nil {
+		return nil, err
+	}
+	hs, err := nyquist.NewHandshake(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer hs.Reset()
+
+	for i := 0; ; i++ {
+		if (i&1 == 0) == isInitiator {
+			var msg []byte
+			msg, err = hs.WriteMessage(nil, nil)
+			if err != nil && err != nyquist.ErrDone {
+				return nil, fmt.Errorf("handshake message %d: %w", i, err)
+			}
+			if wrErr := conn.WriteMsg(msg); wrErr != nil {
+				return nil, wrErr
+			}
+		} else {
+			var msg []byte
+			if msg, err = conn.ReadMsg(); err != nil {
+				return nil, err
+			}
+			if _, err = hs.ReadMessage(nil, msg); err != nil && err != nyquist.ErrDone {
+				return nil, fmt.Errorf("handshake message %d: %w", i, err)
+			}
+		}
+		if err == nyquist.ErrDone {
+			break
+		}
+	}
+
+	status := hs.GetStatus()
+	s := &session{
+		conn: conn,
+		tx:   status.CipherStates[0],
+		rx:   status.CipherStates[1],
+	}
+	if !isInitiator {
+		s.tx, s.rx = s.rx, s.tx
+	}
+
+	sf.logf("handshake complete: %s", cfg.Protocol)
+	sf.logf("  handshake hash: %x", status.HandshakeHash)
+	if status.RemoteStatic != nil {
+		sf.logf("  remote static: %s", fingerprint(status.RemoteStatic))
+	}
+
+	return s, nil
+}
+
+// pipeStdin encrypts stdin to the peer until EOF.
+func pipeStdin(s *session) error {
+	buf := make([]byte, maxPlaintextChunk)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n > 0 {
+			if sendErr := s.Send(buf[:n]); sendErr != nil {
+				return sendErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// pipeStdout decrypts messages from the peer to stdout until an error
+// occurs.
+func pipeStdout(s *session) error {
+	for {
+		b, err := s.Recv()
+		if err != nil {
+			return err
+		}
+		if _, err = os.Stdout.Write(b); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"gitlab.com/yawning/nyquist.git/vectors"
+	"gitlab.com/yawning/nyquist.git/vectors/runner"
+)
+
+func runVectors(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: vectors <generate|verify> [arguments]")
+	}
+
+	switch args[0] {
+	case "generate":
+		return runVectorsGenerate(args[1:])
+	case "verify":
+		return runVectorsVerify(args[1:])
+	default:
+		return fmt.Errorf("unknown vectors command: '%s'", args[0])
+	}
+}
+
+func runVectorsGenerate(args []string) error {
+	fs := flag.NewFlagSet("vectors generate", flag.ExitOnError)
+	out := fs.String("out", "", "output file, stdout if unset")
+	formatName := fs.String("format", "json", "output format (json, cbor, msgpack)")
+	golden := fs.Bool("golden", false, "generate the golden transcripts")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: vectors generate [-out file] [-format format] <-golden | protocol name...>\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 && !*golden {
+		fs.Usage()
+		return fmt.Errorf("no protocol names specified")
+	}
+	format, err := vectors.ParseFormat(*formatName)
+	if err != nil {
+		return err
+	}
+
+	var vectorsFile vectors.File
+	if *golden {
+		f, err := runner.GenerateGolden()
+		if err != nil {
+			return fmt.Errorf("failed to generate golden transcripts: %w", err)
+		}
+		vectorsFile = *f
+	}
+	for _, protocolName := range fs.Args() {
+		v, err := runner.Generate(protocolName, rand.Reader)
+		if err != nil {
+			return fmt.Errorf("failed to generate '%s': %w", protocolName, err)
+		}
+		vectorsFile.Vectors = append(vectorsFile.Vectors, *v)
+	}
+
+	var b []byte
+	if format == vectors.FormatJSON {
+		if b, err = json.MarshalIndent(&vectorsFile, "", "  "); err == nil {
+			b = append(b, '\n')
+		}
+	} else {
+		b, err = vectors.Marshal(&vectorsFile, format)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to serialize vectors: %w", err)
+	}
+
+	if *out == "" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return ioutil.WriteFile(*out, b, 0o644)
+}
+
+func runVectorsVerify(args []string) error {
+	fs := flag.NewFlagSet("vectors verify", flag.ExitOnError)
+	quiet := fs.Bool("q", false, "only report failures")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: vectors verify [-q] <file>...\n")
+		fmt.Fprintf(fs.Output(), "The format (json, cbor, msgpack) of each file is detected automatically.\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no vector files specified")
+	}
+
+	var numPassed, numFailed, numSkipped int
+	for _, fn := range fs.Args() {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		format, err := vectors.DetectFormat(b)
+		if err != nil {
+			return fmt.Errorf("failed to parse '%s': %w", fn, err)
+		}
+		vectorsFile, err := vectors.Unmarshal(b, format)
+		if err != nil {
+			return fmt.Errorf("failed to parse '%s': %w", fn, err)
+		}
+
+		for i := range vectorsFile.Vectors {
+			v := &vectorsFile.Vectors[i]
+			if v.ProtocolName == "" {
+				// Some implementations only set `name`.
+				v.ProtocolName = v.Name
+			}
+			if v.Name == "" {
+				v.Name = v.ProtocolName
+			}
+			if v.ProtocolName == "" {
+				continue
+			}
+
+			err = runner.Verify(v)
+			switch {
+			case err == nil:
+				numPassed++
+				if !*quiet {
+					fmt.Printf("PASS %s: %s\n", fn, v.Name)
+				}
+			case errors.Is(err, runner.ErrUnsupported):
+				numSkipped++
+				if !*quiet {
+					fmt.Printf("SKIP %s: %s (%v)\n", fn, v.Name, err)
+				}
+			default:
+				numFailed++
+				fmt.Printf("FAIL %s: %s (%v)\n", fn, v.Name, err)
+			}
+		}
+	}
+
+	fmt.Printf("passed: %d, failed: %d, skipped: %d\n", numPassed, numFailed, numSkipped)
+	if numFailed > 0 {
+		return fmt.Errorf("%d vector(s) failed", numFailed)
+	}
+
+	return nil
+}
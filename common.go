@@ -47,6 +47,16 @@ var (
 	// ErrOpen is the error returned on a authenticated decryption failure.
 	ErrOpen = errors.New("nyquist: decryption failure")
 
+	// ErrMalformed is the error returned when a message is structurally
+	// malformed (eg: too short for the expected tokens, or containing an
+	// invalid public key).  Errors that match ErrMalformed via `errors.Is`
+	// may also wrap a more specific error.
+	ErrMalformed = errors.New("nyquist: malformed message")
+
+	// ErrUnexpectedRemoteStatic is the error returned when the remote
+	// static public key is not one of the expected keys.
+	ErrUnexpectedRemoteStatic = errors.New("nyquist: unexpected remote static public key")
+
 	// ErrInvalidConfig is the error returned when the configuration is invalid.
 	ErrInvalidConfig = errors.New("nyquist: invalid configuration")
 
@@ -62,6 +72,35 @@ var (
 	ErrProtocolNotSupported = errors.New("nyquist: protocol not supported")
 )
 
+// malformedError is an error caused by a structurally malformed message.
+type malformedError struct {
+	err error
+}
+
+func (e *malformedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *malformedError) Unwrap() error {
+	return e.err
+}
+
+func (e *malformedError) Is(target error) bool {
+	return target == ErrMalformed
+}
+
+func newMalformedError(err error) error {
+	return &malformedError{err}
+}
+
+// zero overwrites the provided buffer with zeroes.  It is a best-effort
+// measure, see the README for the (many) caveats.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
 func truncateTo32BytesMax(b []byte) []byte {
 	if len(b) <= 32 {
 		return b
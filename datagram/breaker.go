@@ -0,0 +1,171 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package datagram
+
+import (
+	"net"
+	"time"
+
+	"gitlab.com/yawning/nyquist.git/clock"
+)
+
+const (
+	// DefaultBlockDuration is the default duration that a source is
+	// blocked for, once it trips the circuit breaker.
+	DefaultBlockDuration = time.Minute
+
+	// maxTrackedSources bounds the number of source addresses that the
+	// circuit breaker tracks failures for.
+	maxTrackedSources = 4096
+)
+
+// CircuitBreaker is a policy for handling repeated decryption failures,
+// to mitigate online forgery attempts, garbage floods, and desynchronized
+// peers consuming CPU.
+//
+// As receiver indexes and source addresses are not secret, an attacker
+// that can observe or spoof traffic can deliberately trip the breaker for
+// a victim's session or address.  The thresholds should be chosen with
+// this in mind.
+type CircuitBreaker struct {
+	// MaxSessionFailures is the number of consecutive data packets that
+	// fail to authenticate, after which a session is closed.  If 0, the
+	// per-session breaker is disabled.
+	MaxSessionFailures int
+
+	// MaxSourceFailures is the number of consecutive handshake or data
+	// packets from a source host that fail to authenticate, after which
+	// all packets from the host are dropped for BlockDuration.  If 0, the
+	// per-source breaker is disabled.
+	MaxSourceFailures int
+
+	// BlockDuration is the duration that a source host is blocked for.
+	// If 0, DefaultBlockDuration is used.
+	BlockDuration time.Duration
+
+	// OnTrip, if set, is called when the breaker trips, with the source
+	// address of the final failure, and the session if it was closed.
+	// It is called synchronously from the endpoint's read loop.
+	OnTrip func(addr net.Addr, s *Session)
+}
+
+func (cb *CircuitBreaker) blockDuration() time.Duration {
+	if cb.BlockDuration > 0 {
+		return cb.BlockDuration
+	}
+	return DefaultBlockDuration
+}
+
+type sourceState struct {
+	failures     int
+	blockedUntil time.Time
+}
+
+// breaker is the per-endpoint circuit breaker state.  It is only accessed
+// from the endpoint's read loop.
+type breaker struct {
+	cb      *CircuitBreaker
+	clk     clock.Clock
+	sources map[string]*sourceState
+}
+
+func sourceKey(addr net.Addr) string {
+	s := addr.String()
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+	return s
+}
+
+// isBlocked returns true iff packets from addr should be dropped.
+func (b *breaker) isBlocked(addr net.Addr) bool {
+	if b.cb == nil || b.cb.MaxSourceFailures <= 0 {
+		return false
+	}
+
+	st := b.sources[sourceKey(addr)]
+	if st == nil || st.blockedUntil.IsZero() {
+		return false
+	}
+	if b.clk.Now().Before(st.blockedUntil) {
+		return true
+	}
+	delete(b.sources, sourceKey(addr))
+	return false
+}
+
+// onFailure records an authentication failure from addr, and returns
+// true iff the source is now blocked.
+func (b *breaker) onFailure(addr net.Addr) bool {
+	if b.cb == nil || b.cb.MaxSourceFailures <= 0 {
+		return false
+	}
+
+	key := sourceKey(addr)
+	st := b.sources[key]
+	if st == nil {
+		if len(b.sources) >= maxTrackedSources {
+			b.prune()
+			if len(b.sources) >= maxTrackedSources {
+				return false
+			}
+		}
+		st = &sourceState{}
+		b.sources[key] = st
+	}
+
+	st.failures++
+	if st.failures < b.cb.MaxSourceFailures {
+		return false
+	}
+	st.blockedUntil = b.clk.Now().Add(b.cb.blockDuration())
+	if b.cb.OnTrip != nil {
+		b.cb.OnTrip(addr, nil)
+	}
+	return true
+}
+
+// onSuccess records an authenticated packet from addr.
+func (b *breaker) onSuccess(addr net.Addr) {
+	if b.cb == nil || b.cb.MaxSourceFailures <= 0 || len(b.sources) == 0 {
+		return
+	}
+	delete(b.sources, sourceKey(addr))
+}
+
+// prune discards the state of sources that are not blocked.
+func (b *breaker) prune() {
+	now := b.clk.Now()
+	for key, st := range b.sources {
+		if !now.Before(st.blockedUntil) {
+			delete(b.sources, key)
+		}
+	}
+}
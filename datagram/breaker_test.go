@@ -0,0 +1,168 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package datagram
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git/clock"
+)
+
+// tripRecorder records circuit breaker trips.
+type tripRecorder struct {
+	sync.Mutex
+	addrs    []string
+	sessions []*Session
+}
+
+func (r *tripRecorder) onTrip(addr net.Addr, s *Session) {
+	r.Lock()
+	defer r.Unlock()
+	r.addrs = append(r.addrs, addr.String())
+	r.sessions = append(r.sessions, s)
+}
+
+func (r *tripRecorder) get() ([]string, []*Session) {
+	r.Lock()
+	defer r.Unlock()
+	return append([]string{}, r.addrs...), append([]*Session{}, r.sessions...)
+}
+
+func garbageData(s *Session) []byte {
+	pkt := make([]byte, dataHeaderSize+32)
+	pkt[0] = packetTypeData
+	binary.BigEndian.PutUint32(pkt[1:], s.localIndex)
+	pkt[12] = 0xff
+	return pkt
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	serverAddr := memAddr("server:1")
+
+	t.Run("Session", func(t *testing.T) {
+		require := require.New(t)
+
+		var trips tripRecorder
+		n, _, client, server := newTestPairWithConfig(t, &Config{
+			CircuitBreaker: &CircuitBreaker{
+				MaxSessionFailures: 3,
+				OnTrip:             trips.onTrip,
+			},
+		}, nil)
+
+		// Failures are only counted when consecutive.
+		for i := 0; i < 2; i++ {
+			n.inject(garbageData(server), memAddr("attacker:1"), serverAddr)
+		}
+		_, err := client.Write([]byte("reset"))
+		require.NoError(err, "client.Write")
+		require.Equal([]byte("reset"), mustRead(t, server), "server.Read")
+
+		for i := 0; i < 3; i++ {
+			n.inject(garbageData(server), memAddr("attacker:1"), serverAddr)
+		}
+		select {
+		case <-server.closeCh:
+		case <-time.After(5 * time.Second):
+			require.FailNow("session not closed")
+		}
+		_, err = server.Read(make([]byte, 16))
+		require.Equal(ErrClosed, err, "server.Read - tripped")
+
+		addrs, sessions := trips.get()
+		require.Equal([]string{"attacker:1"}, addrs, "OnTrip - addr")
+		require.Equal([]*Session{server}, sessions, "OnTrip - session")
+	})
+
+	t.Run("Source", func(t *testing.T) {
+		require := require.New(t)
+
+		clk := clock.NewFake(time.Unix(1700000000, 0))
+		var trips tripRecorder
+		n, _, client, server := newTestPairWithConfig(t, &Config{
+			Clock: clk,
+			CircuitBreaker: &CircuitBreaker{
+				MaxSourceFailures: 3,
+				BlockDuration:     time.Minute,
+				OnTrip:            trips.onTrip,
+			},
+		}, nil)
+
+		// Garbage initiations and data from the client's host, on a
+		// different port.
+		for i := 0; i < 2; i++ {
+			n.inject([]byte{packetTypeInitiation, 0, 0, 0, 1, 0xff}, memAddr("client:9"), serverAddr)
+		}
+		n.inject(garbageData(server), memAddr("client:9"), serverAddr)
+
+		// The client's host is blocked.
+		require.Eventually(func() bool {
+			addrs, _ := trips.get()
+			return len(addrs) == 1
+		}, 5*time.Second, 10*time.Millisecond, "OnTrip")
+		addrs, sessions := trips.get()
+		require.Equal([]string{"client:9"}, addrs, "OnTrip - addr")
+		require.Equal([]*Session{nil}, sessions, "OnTrip - session")
+
+		_, err := client.Write([]byte("blocked"))
+		require.NoError(err, "client.Write")
+		requireNoRead(t, server)
+
+		// Unrelated hosts are not.
+		n.inject(garbageData(server), memAddr("other:1"), serverAddr)
+		_, err = server.Write([]byte("still up"))
+		require.NoError(err, "server.Write")
+		require.Equal([]byte("still up"), mustRead(t, client), "client.Read")
+
+		// The block expires.
+		clk.Advance(time.Minute)
+		_, err = client.Write([]byte("unblocked"))
+		require.NoError(err, "client.Write")
+		require.Equal([]byte("unblocked"), mustRead(t, server), "server.Read")
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		require := require.New(t)
+		n, _, client, server := newTestPair(t)
+
+		for i := 0; i < 64; i++ {
+			n.inject(garbageData(server), memAddr("client:9"), serverAddr)
+		}
+		_, err := client.Write([]byte("ping"))
+		require.NoError(err, "client.Write")
+		require.Equal([]byte("ping"), mustRead(t, server), "server.Read")
+	})
+}
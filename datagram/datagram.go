@@ -0,0 +1,553 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package datagram implements Noise sessions over a datagram-oriented
+// net.PacketConn, using WireGuard-style receiver indices.
+//
+// Each endpoint assigns a random 32 bit index to each of its sessions,
+// and peers address packets to the index rather than the source address.
+// This allows established sessions to survive changes to the peer's
+// network address (eg: NAT rebinding, roaming), as the remote address is
+// updated to the source of the most recent authenticated packet.
+//
+// Incoming packets are demultiplexed to sessions by receiver index via a
+// sharded, lock-striped table, so that a single socket can serve a large
+// number of concurrent sessions.
+//
+// The packet formats are:
+//
+//	initiation: type(1) || sender_index(4) || noise_message
+//	response:   type(1) || sender_index(4) || receiver_index(4) || noise_message
+//	data:       type(1) || receiver_index(4) || epoch(2) || counter(8) || ciphertext
+//	fragment:   type(1) || sender_index(4) || digest(16) || index(1) || count(1) || payload
+//
+// All integers are big endian, and the data packet header is used as the
+// associated data.
+//
+// Traffic keys may be updated via Session.Rekey, which advances the
+// sending epoch and applies the Noise `REKEY` function to the sending
+// key.  As the peer derives the next receiving key on the first packet of
+// the new epoch to authenticate, no key update message is required, and
+// rekeys survive packet loss.  Keys for the previous epoch remain valid
+// for Config.RekeyGracePeriod, to tolerate reordering, and each epoch has
+// a separate replay window.
+//
+// If Config.MTU is set, handshake packets that exceed it (eg: when using
+// hybrid KEMs) are split into fragments.  Fragments carry a truncated
+// SHA-256 digest of the whole packet, which is checked on reassembly, and
+// reassembly is keyed by the digest, so that forged fragments can not
+// corrupt legitimate handshakes.  Data packets are never fragmented.
+// Only patterns with exactly two handshake messages (eg: IK, KK, NK, NN,
+// IX) are supported.
+//
+// Packets that fail to authenticate are silently dropped.  If
+// Config.CircuitBreaker is set, repeated failures close the session, or
+// temporarily block the source host.
+package datagram // import "gitlab.com/yawning/nyquist.git/datagram"
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/clock"
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+const (
+	// DefaultHandshakeTimeout is the default handshake timeout.
+	DefaultHandshakeTimeout = 5 * time.Second
+
+	// DefaultRetransmitInterval is the default handshake retransmit interval.
+	DefaultRetransmitInterval = 500 * time.Millisecond
+
+	// DefaultRekeyGracePeriod is the default duration that the previous
+	// epoch's receive key remains valid for after a rekey.
+	DefaultRekeyGracePeriod = 10 * time.Second
+
+	packetTypeInitiation = 0x01
+	packetTypeResponse   = 0x02
+	packetTypeData       = 0x03
+	packetTypeFragment   = 0x04
+
+	initiationHeaderSize = 1 + 4
+	responseHeaderSize   = 1 + 4 + 4
+	dataHeaderSize       = 1 + 4 + 2 + 8
+
+	maxPacketSize  = 65535
+	acceptBacklog  = 64
+	sessionBacklog = 128
+)
+
+var (
+	// ErrClosed is the error returned when the endpoint or session is
+	// closed.
+	ErrClosed = errors.New("nyquist/datagram: use of closed endpoint or session")
+
+	// ErrHandshakeTimeout is the error returned when a handshake times out.
+	ErrHandshakeTimeout = errors.New("nyquist/datagram: handshake timeout")
+
+	// ErrEpochExhausted is the error returned when the session can not be
+	// rekeyed as the epoch would wrap.
+	ErrEpochExhausted = errors.New("nyquist/datagram: epoch exhausted")
+
+	errUnsupportedPattern = errors.New("nyquist/datagram: pattern must have exactly 2 messages")
+	errReplayed           = errors.New("nyquist/datagram: replayed packet")
+	errInvalidMTU         = errors.New("nyquist/datagram: MTU too small")
+	errPacketTooLarge     = errors.New("nyquist/datagram: handshake packet too large to fragment")
+
+	prologuePrefix = []byte("nyquist/datagram")
+)
+
+// Config is a datagram endpoint configuration.
+type Config struct {
+	// Protocol is the noise protocol to use.
+	Protocol *nyquist.Protocol
+
+	// Prologue is the optional pre-handshake prologue input to be included
+	// in the handshake hash.
+	Prologue []byte
+
+	// LocalStatic is the local static keypair, if any (`s`).
+	LocalStatic dh.Keypair
+
+	// RemoteStatic is the remote static public key, if any (`rs`), used
+	// when dialing.
+	RemoteStatic dh.PublicKey
+
+	// PreSharedKeys is the vector of pre-shared symmetric key for PSK mode
+	// handshakes.
+	PreSharedKeys [][]byte
+
+	// Rng is the entropy source to be used when generating new DH key pairs.
+	// If the value is `nil`, `crypto/rand.Reader` will be used.
+	Rng io.Reader
+
+	// HandshakeTimeout is the handshake timeout.  If 0,
+	// DefaultHandshakeTimeout is used.
+	HandshakeTimeout time.Duration
+
+	// RetransmitInterval is the handshake retransmit interval.  If 0,
+	// DefaultRetransmitInterval is used.
+	RetransmitInterval time.Duration
+
+	// RekeyGracePeriod is the duration that the previous epoch's receive
+	// key remains valid for after the peer rekeys.  If 0,
+	// DefaultRekeyGracePeriod is used.
+	RekeyGracePeriod time.Duration
+
+	// MTU is the path MTU, the maximum size of a packet sent over the
+	// underlying net.PacketConn.  If > 0, handshake packets that exceed
+	// it are fragmented.
+	MTU int
+
+	// Clock is the clock used for the handshake timeout, retransmission,
+	// and the rekey grace period.  If nil, the system clock is used.
+	Clock clock.Clock
+
+	// CircuitBreaker is the optional decryption failure policy.
+	CircuitBreaker *CircuitBreaker
+}
+
+func (cfg *Config) newHandshake(isInitiator bool) (*nyquist.HandshakeState, error) {
+	if len(cfg.Protocol.Pattern.Messages()) != 2 {
+		return nil, errUnsupportedPattern
+	}
+
+	prologue := make([]byte, 0, len(prologuePrefix)+len(cfg.Prologue))
+	prologue = append(prologue, prologuePrefix...)
+	prologue = append(prologue, cfg.Prologue...)
+
+	hsCfg := &nyquist.HandshakeConfig{
+		Protocol:      cfg.Protocol,
+		Prologue:      prologue,
+		LocalStatic:   cfg.LocalStatic,
+		PreSharedKeys: cfg.PreSharedKeys,
+		Rng:           cfg.Rng,
+		IsInitiator:   isInitiator,
+	}
+	if isInitiator {
+		hsCfg.RemoteStatic = cfg.RemoteStatic
+	}
+
+	return nyquist.NewHandshake(hsCfg)
+}
+
+func (cfg *Config) handshakeTimeout() time.Duration {
+	if cfg.HandshakeTimeout > 0 {
+		return cfg.HandshakeTimeout
+	}
+	return DefaultHandshakeTimeout
+}
+
+func (cfg *Config) retransmitInterval() time.Duration {
+	if cfg.RetransmitInterval > 0 {
+		return cfg.RetransmitInterval
+	}
+	return DefaultRetransmitInterval
+}
+
+func (cfg *Config) rekeyGracePeriod() time.Duration {
+	if cfg.RekeyGracePeriod > 0 {
+		return cfg.RekeyGracePeriod
+	}
+	return DefaultRekeyGracePeriod
+}
+
+type handshakeResponse struct {
+	senderIndex uint32
+	msg         []byte
+	addr        net.Addr
+}
+
+// Endpoint is a datagram endpoint, that can both initiate and accept
+// sessions over a single net.PacketConn.
+type Endpoint struct {
+	conn net.PacketConn
+	cfg  *Config
+
+	table       sessionTable
+	reassembler reassembler
+	breaker     breaker
+
+	mu        sync.Mutex
+	responses map[string][]byte
+
+	acceptCh  chan *Session
+	closeCh   chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// Dial establishes a new session with the peer at addr.
+func (e *Endpoint) Dial(addr net.Addr) (*Session, error) {
+	hs, err := e.cfg.newHandshake(true)
+	if err != nil {
+		return nil, err
+	}
+	defer hs.Reset()
+
+	ent := &tableEntry{
+		respCh: make(chan *handshakeResponse, 1),
+	}
+	localIndex, err := e.table.reserve(ent)
+	if err != nil {
+		return nil, err
+	}
+	defer e.table.remove(localIndex, ent)
+
+	pkt := make([]byte, initiationHeaderSize, maxPacketSize)
+	pkt[0] = packetTypeInitiation
+	binary.BigEndian.PutUint32(pkt[1:], localIndex)
+	if pkt, err = hs.WriteMessage(pkt, nil); err != nil {
+		return nil, err
+	}
+
+	clk := clock.Get(e.cfg.Clock)
+	deadlineCh := make(chan struct{})
+	deadline := clk.AfterFunc(e.cfg.handshakeTimeout(), func() {
+		close(deadlineCh)
+	})
+	defer deadline.Stop()
+	retransmitCh := make(chan struct{}, 1)
+	retransmit := clk.AfterFunc(e.cfg.retransmitInterval(), func() {
+		retransmitCh <- struct{}{}
+	})
+	defer retransmit.Stop()
+
+	if err = e.writeHandshakePacket(pkt, addr); err != nil {
+		return nil, err
+	}
+	for {
+		select {
+		case resp := <-ent.respCh:
+			if _, err = hs.ReadMessage(nil, resp.msg); err != nyquist.ErrDone {
+				return nil, err
+			}
+			return e.newSession(hs.GetStatus(), ent, true, localIndex, resp.senderIndex, resp.addr, "")
+		case <-retransmitCh:
+			retransmit.Reset(e.cfg.retransmitInterval())
+			if err = e.writeHandshakePacket(pkt, addr); err != nil {
+				return nil, err
+			}
+		case <-deadlineCh:
+			return nil, ErrHandshakeTimeout
+		case <-e.closeCh:
+			return nil, ErrClosed
+		}
+	}
+}
+
+// Accept waits for and returns the next session initiated by a peer.
+func (e *Endpoint) Accept() (*Session, error) {
+	select {
+	case s := <-e.acceptCh:
+		return s, nil
+	case <-e.closeCh:
+		return nil, e.closeErr()
+	}
+}
+
+// NumSessions returns the number of sessions, including those with
+// handshakes in progress.
+func (e *Endpoint) NumSessions() int {
+	return e.table.len()
+}
+
+// LocalAddr returns the local network address.
+func (e *Endpoint) LocalAddr() net.Addr {
+	return e.conn.LocalAddr()
+}
+
+// Close closes the endpoint, and all of its sessions.
+func (e *Endpoint) Close() error {
+	err := e.conn.Close()
+	e.shutdown(ErrClosed)
+	return err
+}
+
+func (e *Endpoint) closeErr() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
+}
+
+func (e *Endpoint) shutdown(err error) {
+	e.closeOnce.Do(func() {
+		e.mu.Lock()
+		e.err = err
+		e.responses = make(map[string][]byte)
+		e.mu.Unlock()
+
+		sessions := e.table.drain()
+
+		close(e.closeCh)
+		for _, s := range sessions {
+			s.close()
+		}
+	})
+}
+
+func (e *Endpoint) newSession(status *nyquist.HandshakeStatus, reserved *tableEntry, isInitiator bool, localIndex, remoteIndex uint32, addr net.Addr, responseKey string) (*Session, error) {
+	s := &Session{
+		e:             e,
+		localIndex:    localIndex,
+		remoteIndex:   remoteIndex,
+		remoteStatic:  status.RemoteStatic,
+		handshakeHash: status.HandshakeHash,
+		rxWindow:      newReplayWindow(),
+		remoteAddr:    addr,
+		responseKey:   responseKey,
+		recvCh:        make(chan []byte, sessionBacklog),
+		closeCh:       make(chan struct{}),
+	}
+	if isInitiator {
+		s.tx, s.rx = status.CipherStates[0], status.CipherStates[1]
+	} else {
+		s.rx, s.tx = status.CipherStates[0], status.CipherStates[1]
+	}
+
+	s.ent = &tableEntry{
+		session: s,
+	}
+	if !e.table.replace(localIndex, reserved, s.ent) {
+		// The endpoint was closed.
+		s.close()
+		return nil, ErrClosed
+	}
+
+	return s, nil
+}
+
+func (e *Endpoint) removeSession(s *Session) {
+	e.table.remove(s.localIndex, s.ent)
+
+	if s.responseKey != "" {
+		e.mu.Lock()
+		delete(e.responses, s.responseKey)
+		e.mu.Unlock()
+	}
+}
+
+func (e *Endpoint) readLoop() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := e.conn.ReadFrom(buf)
+		if err != nil {
+			e.shutdown(err)
+			return
+		}
+		if n == 0 || e.breaker.isBlocked(addr) {
+			continue
+		}
+
+		pkt := append([]byte{}, buf[:n]...)
+		if pkt[0] == packetTypeFragment {
+			if pkt = e.reassembler.onFragment(pkt, addr); pkt == nil {
+				continue
+			}
+		}
+		switch pkt[0] {
+		case packetTypeInitiation:
+			e.onInitiation(pkt, addr)
+		case packetTypeResponse:
+			e.onResponse(pkt, addr)
+		case packetTypeData:
+			e.onData(pkt, addr)
+		}
+	}
+}
+
+func (e *Endpoint) onInitiation(pkt []byte, addr net.Addr) {
+	if len(pkt) < initiationHeaderSize {
+		return
+	}
+	remoteIndex := binary.BigEndian.Uint32(pkt[1:])
+	responseKey := addr.String() + "/" + string(pkt[1:5])
+
+	// Retransmit the response if this is a duplicate initiation.
+	e.mu.Lock()
+	cached := e.responses[responseKey]
+	e.mu.Unlock()
+	if cached != nil {
+		_ = e.writeHandshakePacket(cached, addr)
+		return
+	}
+
+	hs, err := e.cfg.newHandshake(false)
+	if err != nil {
+		return
+	}
+	defer hs.Reset()
+	if _, err = hs.ReadMessage(nil, pkt[initiationHeaderSize:]); err != nil {
+		e.breaker.onFailure(addr)
+		return
+	}
+
+	reserved := &tableEntry{}
+	localIndex, err := e.table.reserve(reserved)
+	if err != nil {
+		return
+	}
+
+	resp := make([]byte, responseHeaderSize, maxPacketSize)
+	resp[0] = packetTypeResponse
+	binary.BigEndian.PutUint32(resp[1:], localIndex)
+	binary.BigEndian.PutUint32(resp[5:], remoteIndex)
+	if resp, err = hs.WriteMessage(resp, nil); err != nyquist.ErrDone {
+		e.table.remove(localIndex, reserved)
+		return
+	}
+
+	s, err := e.newSession(hs.GetStatus(), reserved, false, localIndex, remoteIndex, addr, responseKey)
+	if err != nil {
+		return
+	}
+
+	select {
+	case e.acceptCh <- s:
+	default:
+		// Accept backlog is full.
+		s.Close()
+		return
+	}
+
+	e.mu.Lock()
+	e.responses[responseKey] = resp
+	e.mu.Unlock()
+
+	_ = e.writeHandshakePacket(resp, addr)
+}
+
+func (e *Endpoint) onResponse(pkt []byte, addr net.Addr) {
+	if len(pkt) < responseHeaderSize {
+		return
+	}
+	localIndex := binary.BigEndian.Uint32(pkt[5:])
+
+	ent := e.table.get(localIndex)
+	if ent == nil || ent.respCh == nil {
+		return
+	}
+
+	select {
+	case ent.respCh <- &handshakeResponse{
+		senderIndex: binary.BigEndian.Uint32(pkt[1:]),
+		msg:         pkt[responseHeaderSize:],
+		addr:        addr,
+	}:
+	default:
+	}
+}
+
+func (e *Endpoint) onData(pkt []byte, addr net.Addr) {
+	if len(pkt) < dataHeaderSize {
+		return
+	}
+	localIndex := binary.BigEndian.Uint32(pkt[1:])
+
+	ent := e.table.get(localIndex)
+	if ent == nil || ent.session == nil {
+		return
+	}
+
+	ent.session.onData(pkt, addr)
+}
+
+// NewEndpoint creates a new Endpoint over conn.
+func NewEndpoint(conn net.PacketConn, cfg *Config) (*Endpoint, error) {
+	if len(cfg.Protocol.Pattern.Messages()) != 2 {
+		return nil, errUnsupportedPattern
+	}
+	if cfg.MTU > 0 && cfg.MTU < minFragmentMTU {
+		return nil, errInvalidMTU
+	}
+
+	e := &Endpoint{
+		conn:      conn,
+		cfg:       cfg,
+		responses: make(map[string][]byte),
+		acceptCh:  make(chan *Session, acceptBacklog),
+		closeCh:   make(chan struct{}),
+	}
+	e.reassembler.clk = clock.Get(cfg.Clock)
+	e.reassembler.m = make(map[string]*reassembly)
+	e.breaker = breaker{
+		cb:      cfg.CircuitBreaker,
+		clk:     clock.Get(cfg.Clock),
+		sources: make(map[string]*sourceState),
+	}
+	go e.readLoop()
+
+	return e, nil
+}
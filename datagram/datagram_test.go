@@ -0,0 +1,716 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package datagram
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/clock"
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+type memPacket struct {
+	b    []byte
+	from net.Addr
+}
+
+type memNet struct {
+	sync.Mutex
+	conns map[string]*memConn
+	tap   func(pkt []byte, from, to net.Addr) bool
+}
+
+func (n *memNet) listen(addr string) *memConn {
+	n.Lock()
+	defer n.Unlock()
+
+	c := &memConn{
+		n:       n,
+		addr:    memAddr(addr),
+		inCh:    make(chan memPacket, 1024),
+		closeCh: make(chan struct{}),
+	}
+	n.conns[addr] = c
+	return c
+}
+
+func (n *memNet) rebind(c *memConn, addr string) {
+	n.Lock()
+	defer n.Unlock()
+
+	delete(n.conns, c.addr.String())
+	c.addr = memAddr(addr)
+	n.conns[addr] = c
+}
+
+func (n *memNet) inject(pkt []byte, from, to net.Addr) {
+	n.Lock()
+	dst := n.conns[to.String()]
+	n.Unlock()
+	if dst == nil {
+		return
+	}
+	select {
+	case dst.inCh <- memPacket{append([]byte{}, pkt...), from}:
+	default:
+	}
+}
+
+type memConn struct {
+	n         *memNet
+	addr      memAddr
+	inCh      chan memPacket
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *memConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.inCh:
+		return copy(p, pkt.b), pkt.from, nil
+	case <-c.closeCh:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *memConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	from := c.LocalAddr()
+	c.n.Lock()
+	tap := c.n.tap
+	c.n.Unlock()
+	if tap != nil && tap(p, from, addr) {
+		// Dropped.
+		return len(p), nil
+	}
+	c.n.inject(p, from, addr)
+	return len(p), nil
+}
+
+func (c *memConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closeCh) })
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr {
+	c.n.Lock()
+	defer c.n.Unlock()
+	return c.addr
+}
+
+func (c *memConn) SetDeadline(t time.Time) error      { return nil }
+func (c *memConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *memConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func newTestPair(t *testing.T) (*memNet, *memConn, *Session, *Session) {
+	return newTestPairWithClock(t, nil)
+}
+
+func newTestPairWithClock(t *testing.T, clk clock.Clock) (*memNet, *memConn, *Session, *Session) {
+	return newTestPairWithConfig(t, &Config{Clock: clk}, nil)
+}
+
+// newTestPairWithConfig establishes a session pair, with the Clock and MTU
+// taken from cfg, the server using cfg.CircuitBreaker, and tap installed
+// prior to the handshake.
+func newTestPairWithConfig(t *testing.T, cfg *Config, tap func([]byte, net.Addr, net.Addr) bool) (*memNet, *memConn, *Session, *Session) {
+	require := require.New(t)
+
+	protocol, err := nyquist.NewProtocol("Noise_IK_25519_ChaChaPoly_BLAKE2s")
+	require.NoError(err, "NewProtocol")
+	serverKey, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(err, "GenerateKeypair - server")
+	clientKey, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(err, "GenerateKeypair - client")
+
+	n := &memNet{conns: make(map[string]*memConn), tap: tap}
+	serverConn, clientConn := n.listen("server:1"), n.listen("client:1")
+
+	server, err := NewEndpoint(serverConn, &Config{
+		Protocol:       protocol,
+		LocalStatic:    serverKey,
+		Clock:          cfg.Clock,
+		MTU:            cfg.MTU,
+		CircuitBreaker: cfg.CircuitBreaker,
+	})
+	require.NoError(err, "NewEndpoint - server")
+	t.Cleanup(func() { server.Close() })
+
+	client, err := NewEndpoint(clientConn, &Config{
+		Protocol:     protocol,
+		LocalStatic:  clientKey,
+		RemoteStatic: serverKey.Public(),
+		Clock:        cfg.Clock,
+		MTU:          cfg.MTU,
+	})
+	require.NoError(err, "NewEndpoint - client")
+	t.Cleanup(func() { client.Close() })
+
+	clientSession, err := client.Dial(serverConn.LocalAddr())
+	require.NoError(err, "Dial")
+	serverSession, err := server.Accept()
+	require.NoError(err, "Accept")
+
+	require.Equal(clientSession.HandshakeHash(), serverSession.HandshakeHash(), "HandshakeHash")
+	require.Equal(clientKey.Public().Bytes(), serverSession.RemoteStatic().Bytes(), "RemoteStatic")
+	require.Equal(clientSession.LocalIndex(), serverSession.RemoteIndex(), "client index")
+	require.Equal(serverSession.LocalIndex(), clientSession.RemoteIndex(), "server index")
+
+	return n, clientConn, clientSession, serverSession
+}
+
+func mustRead(t *testing.T, s *Session) []byte {
+	ch := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, 1024)
+		n, err := s.Read(b)
+		if err != nil {
+			close(ch)
+			return
+		}
+		ch <- b[:n]
+	}()
+
+	select {
+	case b, ok := <-ch:
+		require.True(t, ok, "Read")
+		return b
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "Read timed out")
+	}
+	return nil
+}
+
+func requireNoRead(t *testing.T, s *Session) {
+	select {
+	case b := <-s.recvCh:
+		require.FailNow(t, "unexpected datagram", "%x", b)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDatagram(t *testing.T) {
+	t.Run("RoundTrip", func(t *testing.T) {
+		require := require.New(t)
+		_, _, client, server := newTestPair(t)
+
+		for i := 0; i < 8; i++ {
+			msg := []byte("ping")
+			_, err := client.Write(msg)
+			require.NoError(err, "client.Write")
+			require.Equal(msg, mustRead(t, server), "server.Read")
+
+			msg = []byte("pong")
+			_, err = server.Write(msg)
+			require.NoError(err, "server.Write")
+			require.Equal(msg, mustRead(t, client), "client.Read")
+		}
+	})
+
+	t.Run("Migration", func(t *testing.T) {
+		require := require.New(t)
+		n, clientConn, client, server := newTestPair(t)
+
+		_, err := client.Write([]byte("before"))
+		require.NoError(err, "client.Write")
+		require.Equal([]byte("before"), mustRead(t, server), "server.Read")
+		require.Equal("client:1", server.RemoteAddr().String(), "RemoteAddr - before")
+
+		n.rebind(clientConn, "client:2")
+		_, err = client.Write([]byte("after"))
+		require.NoError(err, "client.Write")
+		require.Equal([]byte("after"), mustRead(t, server), "server.Read")
+		require.Equal("client:2", server.RemoteAddr().String(), "RemoteAddr - after")
+
+		_, err = server.Write([]byte("reply"))
+		require.NoError(err, "server.Write")
+		require.Equal([]byte("reply"), mustRead(t, client), "client.Read")
+	})
+
+	t.Run("Spoofing", func(t *testing.T) {
+		require := require.New(t)
+		n, _, client, server := newTestPair(t)
+
+		var (
+			mu       sync.Mutex
+			captured [][]byte
+		)
+		n.Lock()
+		n.tap = func(pkt []byte, from, to net.Addr) bool {
+			if pkt[0] == packetTypeData && from.String() == "client:1" {
+				mu.Lock()
+				captured = append(captured, append([]byte{}, pkt...))
+				mu.Unlock()
+			}
+			return false
+		}
+		n.Unlock()
+
+		_, err := client.Write([]byte("legitimate"))
+		require.NoError(err, "client.Write")
+		require.Equal([]byte("legitimate"), mustRead(t, server), "server.Read")
+
+		attacker := memAddr("attacker:1")
+		serverAddr := memAddr("server:1")
+
+		// Garbage addressed to a valid receiver index.
+		garbage := make([]byte, dataHeaderSize+32)
+		garbage[0] = packetTypeData
+		copy(garbage[1:], captured[0][1:5])
+		garbage[12] = 0xff
+		n.inject(garbage, attacker, serverAddr)
+		requireNoRead(t, server)
+		require.Equal("client:1", server.RemoteAddr().String(), "RemoteAddr - garbage")
+
+		// Replay of a valid packet.
+		mu.Lock()
+		replayed := captured[0]
+		mu.Unlock()
+		n.inject(replayed, attacker, serverAddr)
+		requireNoRead(t, server)
+		require.Equal("client:1", server.RemoteAddr().String(), "RemoteAddr - replay")
+
+		// Tampered valid packet.
+		tampered := append([]byte{}, replayed...)
+		tampered[5+7]++
+		tampered[len(tampered)-1] ^= 0x01
+		n.inject(tampered, attacker, serverAddr)
+		requireNoRead(t, server)
+		require.Equal("client:1", server.RemoteAddr().String(), "RemoteAddr - tampered")
+	})
+
+	t.Run("Reordering", func(t *testing.T) {
+		require := require.New(t)
+		n, clientConn, client, server := newTestPair(t)
+
+		var (
+			mu      sync.Mutex
+			delayed []byte
+		)
+		n.Lock()
+		n.tap = func(pkt []byte, from, to net.Addr) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			if pkt[0] == packetTypeData && delayed == nil {
+				delayed = append([]byte{}, pkt...)
+				return true
+			}
+			return false
+		}
+		n.Unlock()
+
+		_, err := client.Write([]byte("first"))
+		require.NoError(err, "client.Write")
+
+		n.rebind(clientConn, "client:2")
+		_, err = client.Write([]byte("second"))
+		require.NoError(err, "client.Write")
+		require.Equal([]byte("second"), mustRead(t, server), "server.Read")
+		require.Equal("client:2", server.RemoteAddr().String(), "RemoteAddr - migrated")
+
+		// A delayed packet from the old address is still delivered, but
+		// must not move the session back.
+		mu.Lock()
+		stale := delayed
+		mu.Unlock()
+		n.inject(stale, memAddr("client:1"), memAddr("server:1"))
+		require.Equal([]byte("first"), mustRead(t, server), "server.Read - delayed")
+		require.Equal("client:2", server.RemoteAddr().String(), "RemoteAddr - delayed")
+	})
+}
+
+func TestEpochs(t *testing.T) {
+	require := require.New(t)
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+	n, _, client, server := newTestPairWithClock(t, clk)
+
+	var (
+		mu       sync.Mutex
+		drop     bool
+		captured [][]byte
+	)
+	n.Lock()
+	n.tap = func(pkt []byte, from, to net.Addr) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if pkt[0] == packetTypeData && from.String() == "client:1" {
+			captured = append(captured, append([]byte{}, pkt...))
+			return drop
+		}
+		return false
+	}
+	n.Unlock()
+	setDrop := func(b bool) {
+		mu.Lock()
+		drop = b
+		mu.Unlock()
+	}
+	lastCaptured := func() []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		return captured[len(captured)-1]
+	}
+
+	// Delay a packet from epoch 0.
+	setDrop(true)
+	_, err := client.Write([]byte("epoch 0"))
+	require.NoError(err, "client.Write - epoch 0")
+	delayed := lastCaptured()
+	setDrop(false)
+
+	require.NoError(client.Rekey(), "client.Rekey")
+	require.EqualValues(1, client.Epoch(), "client.Epoch")
+	_, err = client.Write([]byte("epoch 1"))
+	require.NoError(err, "client.Write - epoch 1")
+	require.Equal([]byte("epoch 1"), mustRead(t, server), "server.Read - epoch 1")
+	epoch1 := lastCaptured()
+
+	// The previous epoch's key is still valid during the grace period.
+	n.inject(delayed, memAddr("client:1"), memAddr("server:1"))
+	require.Equal([]byte("epoch 0"), mustRead(t, server), "server.Read - delayed epoch 0")
+
+	// Replay windows are per-epoch, and the counter resets on rekey.
+	n.inject(delayed, memAddr("client:1"), memAddr("server:1"))
+	requireNoRead(t, server)
+	n.inject(epoch1, memAddr("client:1"), memAddr("server:1"))
+	requireNoRead(t, server)
+
+	// Rekeys survive the loss of every packet in an epoch.
+	require.NoError(client.Rekey(), "client.Rekey")
+	setDrop(true)
+	_, err = client.Write([]byte("epoch 2"))
+	require.NoError(err, "client.Write - epoch 2")
+	lost := lastCaptured()
+	setDrop(false)
+	require.NoError(client.Rekey(), "client.Rekey")
+	_, err = client.Write([]byte("epoch 3"))
+	require.NoError(err, "client.Write - epoch 3")
+	require.Equal([]byte("epoch 3"), mustRead(t, server), "server.Read - epoch 3")
+
+	// Only the immediately preceding epoch is retained.
+	n.inject(lost, memAddr("client:1"), memAddr("server:1"))
+	requireNoRead(t, server)
+
+	// The other direction is unaffected.
+	require.EqualValues(0, server.Epoch(), "server.Epoch")
+	_, err = server.Write([]byte("reply"))
+	require.NoError(err, "server.Write")
+	require.Equal([]byte("reply"), mustRead(t, client), "client.Read")
+
+	// The previous epoch's key expires after the grace period.
+	setDrop(true)
+	_, err = client.Write([]byte("epoch 3, again"))
+	require.NoError(err, "client.Write - epoch 3")
+	delayed = lastCaptured()
+	setDrop(false)
+	require.NoError(client.Rekey(), "client.Rekey")
+	_, err = client.Write([]byte("epoch 4"))
+	require.NoError(err, "client.Write - epoch 4")
+	require.Equal([]byte("epoch 4"), mustRead(t, server), "server.Read - epoch 4")
+	clk.Advance(DefaultRekeyGracePeriod)
+	n.inject(delayed, memAddr("client:1"), memAddr("server:1"))
+	requireNoRead(t, server)
+
+	// Epochs that are too far in the future are rejected.
+	for i := 0; i <= maxEpochSkip; i++ {
+		require.NoError(client.Rekey(), "client.Rekey")
+	}
+	_, err = client.Write([]byte("too far"))
+	require.NoError(err, "client.Write - too far")
+	requireNoRead(t, server)
+
+	client.txMu.Lock()
+	client.txEpoch = math.MaxUint16
+	client.txMu.Unlock()
+	require.Equal(ErrEpochExhausted, client.Rekey(), "client.Rekey - exhausted")
+}
+
+func TestFragmentation(t *testing.T) {
+	t.Run("Handshake", func(t *testing.T) {
+		require := require.New(t)
+
+		var (
+			mu        sync.Mutex
+			numFrags  int
+			oversized bool
+		)
+		tap := func(pkt []byte, from, to net.Addr) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case pkt[0] == packetTypeFragment:
+				numFrags++
+			case pkt[0] != packetTypeData && len(pkt) > minFragmentMTU:
+				oversized = true
+			}
+			return false
+		}
+		_, _, client, server := newTestPairWithConfig(t, &Config{MTU: minFragmentMTU}, tap)
+
+		mu.Lock()
+		require.False(oversized, "handshake packet exceeded MTU")
+		require.NotZero(numFrags, "handshake was fragmented")
+		mu.Unlock()
+
+		_, err := client.Write([]byte("fragmented handshake"))
+		require.NoError(err, "client.Write")
+		require.Equal([]byte("fragmented handshake"), mustRead(t, server), "server.Read")
+	})
+
+	t.Run("Reassembly", func(t *testing.T) {
+		require := require.New(t)
+
+		pkt := make([]byte, 1000)
+		_, _ = rand.Read(pkt)
+		pkt[0] = packetTypeInitiation
+		frags, err := fragment(pkt, minFragmentMTU)
+		require.NoError(err, "fragment")
+		require.Len(frags, (len(pkt)+minFragmentMTU-fragmentHeaderSize-1)/(minFragmentMTU-fragmentHeaderSize), "fragment count")
+		for _, frag := range frags {
+			require.LessOrEqual(len(frag), minFragmentMTU, "fragment size")
+		}
+
+		r := &reassembler{
+			clk: clock.System,
+			m:   make(map[string]*reassembly),
+		}
+		addr := memAddr("peer:1")
+
+		// A forged fragment does not interfere with reassembly.
+		forged := append([]byte{}, frags[1]...)
+		forged[5] ^= 0xff
+		forged[len(forged)-1] ^= 0xff
+		require.Nil(r.onFragment(forged, addr), "onFragment - forged")
+
+		// Out of order, with duplicates.
+		for i := len(frags) - 1; i > 0; i-- {
+			require.Nil(r.onFragment(frags[i], addr), "onFragment(%d)", i)
+			require.Nil(r.onFragment(frags[i], addr), "onFragment(%d) - duplicate", i)
+		}
+		require.Equal(pkt, r.onFragment(frags[0], addr), "onFragment - reassembled")
+
+		// A corrupted fragment that claims the correct digest fails the
+		// digest check on reassembly.
+		for i, frag := range frags {
+			frag = append([]byte{}, frag...)
+			if i == 1 {
+				frag[len(frag)-1] ^= 0xff
+			}
+			require.Nil(r.onFragment(frag, addr), "onFragment(%d) - corrupted", i)
+		}
+
+		_, err = fragment(make([]byte, maxFragments*(minFragmentMTU-fragmentHeaderSize)+1), minFragmentMTU)
+		require.Equal(errPacketTooLarge, err, "fragment - too large")
+	})
+
+	t.Run("InvalidMTU", func(t *testing.T) {
+		protocol, err := nyquist.NewProtocol("Noise_NN_25519_ChaChaPoly_BLAKE2s")
+		require.NoError(t, err, "NewProtocol")
+		n := &memNet{conns: make(map[string]*memConn)}
+		_, err = NewEndpoint(n.listen("a:1"), &Config{
+			Protocol: protocol,
+			MTU:      minFragmentMTU - 1,
+		})
+		require.Equal(t, errInvalidMTU, err, "NewEndpoint")
+	})
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	require := require.New(t)
+
+	protocol, err := nyquist.NewProtocol("Noise_NN_25519_ChaChaPoly_BLAKE2s")
+	require.NoError(err, "NewProtocol")
+
+	sentCh := make(chan struct{}, 16)
+	n := &memNet{
+		conns: make(map[string]*memConn),
+		tap: func(pkt []byte, from, to net.Addr) bool {
+			sentCh <- struct{}{}
+			return true
+		},
+	}
+
+	clk := clock.NewFake(time.Now())
+	client, err := NewEndpoint(n.listen("client:1"), &Config{
+		Protocol:           protocol,
+		HandshakeTimeout:   10 * time.Second,
+		RetransmitInterval: 3 * time.Second,
+		Clock:              clk,
+	})
+	require.NoError(err, "NewEndpoint")
+	defer client.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := client.Dial(memAddr("server:1"))
+		errCh <- err
+	}()
+
+	// The initial transmission, and 3 retransmissions.
+	<-sentCh
+	for i := 0; i < 3; i++ {
+		clk.Advance(3 * time.Second)
+		<-sentCh
+	}
+
+	clk.Advance(time.Second)
+	require.Equal(ErrHandshakeTimeout, <-errCh, "Dial")
+	require.Len(sentCh, 0, "no further retransmissions")
+}
+
+func TestSessionTable(t *testing.T) {
+	require := require.New(t)
+
+	const n = 10000
+
+	var tbl sessionTable
+	entries := make(map[uint32]*tableEntry)
+	for i := 0; i < n; i++ {
+		ent := &tableEntry{}
+		idx, err := tbl.reserve(ent)
+		require.NoError(err, "reserve")
+		require.NotZero(idx, "reserve - index")
+		require.Nil(entries[idx], "reserve - unique")
+		entries[idx] = ent
+	}
+	require.Equal(n, tbl.len(), "len")
+
+	var removed int
+	for idx, ent := range entries {
+		require.True(tbl.get(idx) == ent, "get")
+
+		established := &tableEntry{session: &Session{localIndex: idx}}
+		require.False(tbl.replace(idx, established, ent), "replace - mismatch")
+		require.True(tbl.replace(idx, ent, established), "replace")
+		require.True(tbl.get(idx) == established, "get - replaced")
+
+		if removed < n/2 {
+			tbl.remove(idx, ent)
+			require.NotNil(tbl.get(idx), "remove - mismatch")
+			tbl.remove(idx, established)
+			require.Nil(tbl.get(idx), "remove")
+			removed++
+		}
+	}
+	require.Equal(n-removed, tbl.len(), "len - after remove")
+
+	sessions := tbl.drain()
+	require.Len(sessions, n-removed, "drain")
+	require.Zero(tbl.len(), "len - after drain")
+}
+
+func TestEndpointManySessions(t *testing.T) {
+	require := require.New(t)
+
+	protocol, err := nyquist.NewProtocol("Noise_NN_25519_ChaChaPoly_BLAKE2s")
+	require.NoError(err, "NewProtocol")
+
+	n := &memNet{conns: make(map[string]*memConn)}
+	serverConn, clientConn := n.listen("server:1"), n.listen("client:1")
+	cfg := &Config{
+		Protocol: protocol,
+	}
+
+	server, err := NewEndpoint(serverConn, cfg)
+	require.NoError(err, "NewEndpoint - server")
+	defer server.Close()
+	client, err := NewEndpoint(clientConn, cfg)
+	require.NoError(err, "NewEndpoint - client")
+	defer client.Close()
+
+	const numSessions = 256
+
+	go func() {
+		for {
+			s, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				b := make([]byte, 64)
+				n, err := s.Read(b)
+				if err != nil {
+					return
+				}
+				_, _ = s.Write(b[:n])
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, numSessions)
+	for i := 0; i < numSessions; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s, err := client.Dial(serverConn.LocalAddr())
+			if err != nil {
+				errCh <- err
+				return
+			}
+			msg := []byte{byte(i), byte(i >> 8)}
+			if _, err = s.Write(msg); err != nil {
+				errCh <- err
+				return
+			}
+			b := make([]byte, 64)
+			n, err := s.Read(b)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if !bytes.Equal(msg, b[:n]) {
+				errCh <- errors.New("echo mismatch")
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		require.NoError(err, "session")
+	}
+
+	require.Equal(numSessions, client.NumSessions(), "client.NumSessions")
+	require.Equal(numSessions, server.NumSessions(), "server.NumSessions")
+}
@@ -0,0 +1,179 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package datagram
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"gitlab.com/yawning/nyquist.git/clock"
+)
+
+const (
+	fragmentDigestSize = 16
+	fragmentHeaderSize = 1 + 4 + fragmentDigestSize + 1 + 1
+
+	maxFragments      = 255
+	maxReassemblies   = 64
+	minFragmentMTU    = fragmentHeaderSize + 64
+	reassemblyTimeout = DefaultHandshakeTimeout
+)
+
+// reassembly is a handshake packet that is being reassembled.
+type reassembly struct {
+	fragments [][]byte
+	remaining int
+	size      int
+	expiry    time.Time
+}
+
+// reassembler reassembles fragmented handshake packets.
+//
+// Fragments are keyed by source address, sender index, and the digest of
+// the reassembled packet, so that forged fragments can not interfere with
+// the reassembly of legitimate packets, and the reassembled packet is
+// checked against the digest before it is processed.
+type reassembler struct {
+	sync.Mutex
+
+	clk clock.Clock
+	m   map[string]*reassembly
+}
+
+func (r *reassembler) onFragment(pkt []byte, addr net.Addr) []byte {
+	if len(pkt) <= fragmentHeaderSize {
+		return nil
+	}
+	digest := pkt[5 : 5+fragmentDigestSize]
+	idx, count := int(pkt[fragmentHeaderSize-2]), int(pkt[fragmentHeaderSize-1])
+	if count < 2 || idx >= count {
+		return nil
+	}
+	key := addr.String() + "/" + string(pkt[1:5+fragmentDigestSize])
+
+	r.Lock()
+	defer r.Unlock()
+
+	now := r.clk.Now()
+	ra := r.m[key]
+	if ra == nil {
+		for k, v := range r.m {
+			if !now.Before(v.expiry) {
+				delete(r.m, k)
+			}
+		}
+		if len(r.m) >= maxReassemblies {
+			return nil
+		}
+		ra = &reassembly{
+			fragments: make([][]byte, count),
+			remaining: count,
+			expiry:    now.Add(reassemblyTimeout),
+		}
+		r.m[key] = ra
+	}
+	if len(ra.fragments) != count || ra.fragments[idx] != nil {
+		return nil
+	}
+	ra.fragments[idx] = pkt[fragmentHeaderSize:]
+	ra.size += len(pkt) - fragmentHeaderSize
+	if ra.remaining--; ra.remaining > 0 {
+		return nil
+	}
+	delete(r.m, key)
+
+	b := make([]byte, 0, ra.size)
+	for _, v := range ra.fragments {
+		b = append(b, v...)
+	}
+	if sum := sha256.Sum256(b); subtle.ConstantTimeCompare(sum[:fragmentDigestSize], digest) != 1 {
+		return nil
+	}
+	if len(b) < initiationHeaderSize || binary.BigEndian.Uint32(b[1:]) != binary.BigEndian.Uint32(pkt[1:]) {
+		return nil
+	}
+	if b[0] != packetTypeInitiation && b[0] != packetTypeResponse {
+		return nil
+	}
+
+	return b
+}
+
+// fragment splits a handshake packet into fragments no larger than mtu.
+func fragment(pkt []byte, mtu int) ([][]byte, error) {
+	payloadSize := mtu - fragmentHeaderSize
+	count := (len(pkt) + payloadSize - 1) / payloadSize
+	if count > maxFragments {
+		return nil, errPacketTooLarge
+	}
+
+	digest := sha256.Sum256(pkt)
+	frags := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		payload := pkt[i*payloadSize:]
+		if len(payload) > payloadSize {
+			payload = payload[:payloadSize]
+		}
+
+		frag := make([]byte, fragmentHeaderSize, fragmentHeaderSize+len(payload))
+		frag[0] = packetTypeFragment
+		copy(frag[1:5], pkt[1:5]) // Sender index.
+		copy(frag[5:], digest[:fragmentDigestSize])
+		frag[fragmentHeaderSize-2] = byte(i)
+		frag[fragmentHeaderSize-1] = byte(count)
+		frags = append(frags, append(frag, payload...))
+	}
+
+	return frags, nil
+}
+
+// writeHandshakePacket sends a handshake packet to addr, fragmenting it if
+// it exceeds the configured MTU.
+func (e *Endpoint) writeHandshakePacket(pkt []byte, addr net.Addr) error {
+	if e.cfg.MTU <= 0 || len(pkt) <= e.cfg.MTU {
+		_, err := e.conn.WriteTo(pkt, addr)
+		return err
+	}
+
+	frags, err := fragment(pkt, e.cfg.MTU)
+	if err != nil {
+		return err
+	}
+	for _, frag := range frags {
+		if _, err = e.conn.WriteTo(frag, addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
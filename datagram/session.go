@@ -0,0 +1,333 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package datagram
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/clock"
+	"gitlab.com/yawning/nyquist.git/dh"
+	"gitlab.com/yawning/nyquist.git/replay"
+)
+
+const (
+	// maxEpochSkip is the maximum number of epochs that the receive key
+	// will be advanced by for a single packet.
+	maxEpochSkip = 8
+
+	replayWindowSize = 2048
+)
+
+// Session is an established datagram session.
+type Session struct {
+	e   *Endpoint
+	ent *tableEntry
+
+	localIndex    uint32
+	remoteIndex   uint32
+	remoteStatic  dh.PublicKey
+	handshakeHash []byte
+	responseKey   string
+
+	txMu      sync.Mutex
+	tx        *nyquist.CipherState
+	txEpoch   uint16
+	txCounter uint64
+
+	// Only accessed from the endpoint's read loop.
+	rx         *nyquist.CipherState
+	rxEpoch    uint16
+	rxWindow   *replay.Window
+	prevRx     *nyquist.CipherState
+	prevEpoch  uint16
+	prevWindow *replay.Window
+	prevExpiry time.Time
+	confirmed  bool
+	rxFailures int
+
+	addrMu     sync.Mutex
+	remoteAddr net.Addr
+
+	recvCh    chan []byte
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+// LocalIndex returns the session's local receiver index.
+func (s *Session) LocalIndex() uint32 {
+	return s.localIndex
+}
+
+// RemoteIndex returns the session's remote receiver index.
+func (s *Session) RemoteIndex() uint32 {
+	return s.remoteIndex
+}
+
+// RemoteStatic returns the peer's static public key, if any.
+func (s *Session) RemoteStatic() dh.PublicKey {
+	return s.remoteStatic
+}
+
+// HandshakeHash returns the handshake hash.
+func (s *Session) HandshakeHash() []byte {
+	return s.handshakeHash
+}
+
+// RemoteAddr returns the peer's current network address.
+func (s *Session) RemoteAddr() net.Addr {
+	s.addrMu.Lock()
+	defer s.addrMu.Unlock()
+
+	return s.remoteAddr
+}
+
+// Epoch returns the session's current sending epoch.
+func (s *Session) Epoch() uint16 {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	return s.txEpoch
+}
+
+// Rekey advances the sending epoch, and updates the sending key.  The peer
+// switches to the new receive key once a packet from the new epoch is
+// authenticated.
+func (s *Session) Rekey() error {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	if s.tx == nil {
+		return ErrClosed
+	}
+	if s.txEpoch == math.MaxUint16 {
+		return ErrEpochExhausted
+	}
+	if err := s.tx.Rekey(); err != nil {
+		return err
+	}
+	s.txEpoch++
+	s.txCounter = 0
+
+	return nil
+}
+
+// Write encrypts and sends p as a single datagram.
+func (s *Session) Write(p []byte) (int, error) {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	if s.tx == nil {
+		return 0, ErrClosed
+	}
+	if s.txCounter == math.MaxUint64 {
+		return 0, nyquist.ErrNonceExhausted
+	}
+
+	pkt := make([]byte, dataHeaderSize, dataHeaderSize+len(p)+s.e.cfg.Protocol.Cipher.Overhead())
+	pkt[0] = packetTypeData
+	binary.BigEndian.PutUint32(pkt[1:], s.remoteIndex)
+	binary.BigEndian.PutUint16(pkt[5:], s.txEpoch)
+	binary.BigEndian.PutUint64(pkt[7:], s.txCounter)
+
+	s.tx.SetNonce(s.txCounter)
+	pkt, err := s.tx.EncryptWithAd(pkt, pkt[:dataHeaderSize], p)
+	if err != nil {
+		return 0, err
+	}
+	s.txCounter++
+
+	if _, err = s.e.conn.WriteTo(pkt, s.RemoteAddr()); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Read reads the next datagram into p.  If p is too small, the excess is
+// discarded.
+func (s *Session) Read(p []byte) (int, error) {
+	select {
+	case b := <-s.recvCh:
+		return copy(p, b), nil
+	case <-s.closeCh:
+		return 0, ErrClosed
+	}
+}
+
+// Close closes the session.
+func (s *Session) Close() error {
+	s.e.removeSession(s)
+	s.close()
+	return nil
+}
+
+func (s *Session) close() {
+	s.closeOnce.Do(func() {
+		close(s.closeCh)
+
+		s.txMu.Lock()
+		if s.tx != nil {
+			s.tx.Reset()
+			s.tx = nil
+		}
+		s.txMu.Unlock()
+	})
+}
+
+func (s *Session) onData(pkt []byte, addr net.Addr) {
+	select {
+	case <-s.closeCh:
+		return
+	default:
+	}
+
+	epoch := binary.BigEndian.Uint16(pkt[5:])
+	counter := binary.BigEndian.Uint64(pkt[7:])
+
+	now := clock.Get(s.e.cfg.Clock).Now()
+	if s.prevRx != nil && !now.Before(s.prevExpiry) {
+		s.prevRx.Reset()
+		s.prevRx = nil
+	}
+
+	var (
+		rx     *nyquist.CipherState
+		window *replay.Window
+		isNext bool
+	)
+	switch skip := epoch - s.rxEpoch; {
+	case skip == 0:
+		rx, window = s.rx, s.rxWindow
+	case epoch > s.rxEpoch && skip <= maxEpochSkip:
+		// Derive the receive key for the new epoch, which is only
+		// committed to if the packet authenticates.
+		rx, window, isNext = s.rx.Clone(), newReplayWindow(), true
+		for i := uint16(0); i < skip; i++ {
+			if err := rx.Rekey(); err != nil {
+				rx.Reset()
+				return
+			}
+		}
+	case s.prevRx != nil && epoch == s.prevEpoch:
+		rx, window = s.prevRx, s.prevWindow
+	default:
+		return
+	}
+
+	plaintext, err := s.decrypt(rx, window, counter, pkt)
+	if err != nil {
+		if isNext {
+			rx.Reset()
+		}
+		if err != errReplayed {
+			s.onDecryptFailure(addr)
+		}
+		return
+	}
+	s.rxFailures = 0
+	s.e.breaker.onSuccess(addr)
+	isNewest := isNext || (epoch == s.rxEpoch && counter >= s.rxWindow.Max())
+	window.Accept(counter)
+
+	if isNext {
+		if s.prevRx != nil {
+			s.prevRx.Reset()
+		}
+		s.prevRx, s.prevEpoch, s.prevWindow = s.rx, s.rxEpoch, s.rxWindow
+		s.prevExpiry = now.Add(s.e.cfg.rekeyGracePeriod())
+		s.rx, s.rxEpoch, s.rxWindow = rx, epoch, window
+	}
+
+	// Only authenticated, non-replayed packets that are the most recent
+	// seen, may update the peer's address.
+	if isNewest {
+		s.addrMu.Lock()
+		if s.remoteAddr.String() != addr.String() {
+			s.remoteAddr = addr
+		}
+		s.addrMu.Unlock()
+	}
+
+	// The peer has the session keys, stop retransmitting the response.
+	if !s.confirmed {
+		s.confirmed = true
+		if s.responseKey != "" {
+			s.e.mu.Lock()
+			delete(s.e.responses, s.responseKey)
+			s.e.mu.Unlock()
+		}
+	}
+
+	select {
+	case s.recvCh <- plaintext:
+	default:
+		// Receive backlog is full, drop the packet.
+	}
+}
+
+// onDecryptFailure applies the circuit breaker policy to a data packet
+// that failed to authenticate.
+func (s *Session) onDecryptFailure(addr net.Addr) {
+	s.e.breaker.onFailure(addr)
+
+	cb := s.e.cfg.CircuitBreaker
+	if cb == nil || cb.MaxSessionFailures <= 0 {
+		return
+	}
+	if s.rxFailures++; s.rxFailures < cb.MaxSessionFailures {
+		return
+	}
+	if cb.OnTrip != nil {
+		cb.OnTrip(addr, s)
+	}
+	_ = s.Close()
+}
+
+func (s *Session) decrypt(rx *nyquist.CipherState, window *replay.Window, counter uint64, pkt []byte) ([]byte, error) {
+	if !window.Check(counter) {
+		return nil, errReplayed
+	}
+
+	rx.SetNonce(counter)
+	return rx.DecryptWithAd(nil, pkt[:dataHeaderSize], pkt[dataHeaderSize:])
+}
+
+func newReplayWindow() *replay.Window {
+	w, err := replay.New(replayWindowSize)
+	if err != nil {
+		panic("nyquist/datagram: failed to create replay window: " + err.Error())
+	}
+	return w
+}
@@ -0,0 +1,156 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package datagram
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+const (
+	tableShardBits = 8
+	tableShards    = 1 << tableShardBits
+)
+
+// tableEntry is an immutable session table entry.  At most one of respCh
+// (an outgoing handshake in progress) and session (an established session)
+// is set, with neither set for reserved entries.
+type tableEntry struct {
+	respCh  chan *handshakeResponse
+	session *Session
+}
+
+type tableShard struct {
+	sync.RWMutex
+	m map[uint32]*tableEntry
+}
+
+// sessionTable is a sharded, lock-striped table mapping local receiver
+// indexes to sessions.  As indexes are uniformly random, the low bits
+// are used to select the shard.
+type sessionTable struct {
+	shards [tableShards]tableShard
+}
+
+func (t *sessionTable) shard(idx uint32) *tableShard {
+	return &t.shards[idx&(tableShards-1)]
+}
+
+// reserve allocates a new unique non-zero random index, and associates it
+// with ent.
+func (t *sessionTable) reserve(ent *tableEntry) (uint32, error) {
+	var b [4]byte
+	for {
+		if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+			return 0, err
+		}
+		idx := binary.BigEndian.Uint32(b[:])
+		if idx == 0 {
+			continue
+		}
+
+		sh := t.shard(idx)
+		sh.Lock()
+		if _, ok := sh.m[idx]; !ok {
+			if sh.m == nil {
+				sh.m = make(map[uint32]*tableEntry)
+			}
+			sh.m[idx] = ent
+			sh.Unlock()
+			return idx, nil
+		}
+		sh.Unlock()
+	}
+}
+
+// get returns the entry associated with idx, if any.
+func (t *sessionTable) get(idx uint32) *tableEntry {
+	sh := t.shard(idx)
+	sh.RLock()
+	defer sh.RUnlock()
+
+	return sh.m[idx]
+}
+
+// replace replaces the entry associated with idx with ent iff it is old.
+func (t *sessionTable) replace(idx uint32, old, ent *tableEntry) bool {
+	sh := t.shard(idx)
+	sh.Lock()
+	defer sh.Unlock()
+
+	if sh.m[idx] != old {
+		return false
+	}
+	sh.m[idx] = ent
+	return true
+}
+
+// remove removes the entry associated with idx iff it is ent.
+func (t *sessionTable) remove(idx uint32, ent *tableEntry) {
+	sh := t.shard(idx)
+	sh.Lock()
+	defer sh.Unlock()
+
+	if sh.m[idx] == ent {
+		delete(sh.m, idx)
+	}
+}
+
+// len returns the number of entries in the table.
+func (t *sessionTable) len() int {
+	var n int
+	for i := range t.shards {
+		sh := &t.shards[i]
+		sh.RLock()
+		n += len(sh.m)
+		sh.RUnlock()
+	}
+	return n
+}
+
+// drain removes all entries from the table, and returns the established
+// sessions.
+func (t *sessionTable) drain() []*Session {
+	var sessions []*Session
+	for i := range t.shards {
+		sh := &t.shards[i]
+		sh.Lock()
+		for _, ent := range sh.m {
+			if ent.session != nil {
+				sessions = append(sessions, ent.session)
+			}
+		}
+		sh.m = nil
+		sh.Unlock()
+	}
+	return sessions
+}
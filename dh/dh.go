@@ -34,11 +34,11 @@ package dh // import "gitlab.com/yawning/nyquist.git/dh"
 import (
 	"encoding"
 	"errors"
-	"fmt"
 	"io"
 
+	"github.com/oasisprotocol/curve25519-voi/curve"
+	"github.com/oasisprotocol/curve25519-voi/curve/scalar"
 	"github.com/oasisprotocol/curve25519-voi/primitives/x25519"
-	"gitlab.com/yawning/x448.git"
 )
 
 var (
@@ -56,13 +56,13 @@ var (
 
 	supportedDHs = map[string]DH{
 		"25519": X25519,
-		"448":   X448,
 	}
 )
 
 // DH is a Diffie-Hellman key exchange algorithm.
 type DH interface {
-	fmt.Stringer
+	// String returns the string representation of the DH function name.
+	String() string
 
 	// GenerateKeypair generates a new Diffie-Hellman keypair using the
 	// provided entropy source.
@@ -75,6 +75,8 @@ type DH interface {
 	ParsePublicKey(data []byte) (PublicKey, error)
 
 	// Size returns the size of public keys and DH outputs in bytes (`DHLEN`).
+	// DH outputs may be a different size for curves where the public key
+	// is not a single field element (eg: P384).
 	Size() int
 }
 
@@ -111,6 +113,29 @@ type PublicKey interface {
 	Bytes() []byte
 }
 
+// Precomputable is the interface implemented by PublicKey instances that
+// support precomputing tables to accelerate repeated DH calculations with
+// the same public key.
+type Precomputable interface {
+	// Precompute precomputes the DH acceleration table for the public key.
+	// It must be called before the public key is used concurrently.
+	Precompute() error
+}
+
+// ScalarMultiplier is the interface implemented by DH instances that expose
+// the raw scalar multiplication, so that other key exchange constructions
+// (eg: ntor-like handshakes) can reuse the curve implementation.
+type ScalarMultiplier interface {
+	// ScalarMult returns the DH calculation between the binary serialized
+	// private key (scalar) and public key (point).  Like the Noise DH
+	// function, the output is not checked for being all zero.
+	ScalarMult(privateKey, publicKey []byte) ([]byte, error)
+
+	// ScalarBaseMult returns the binary serialized public key for the
+	// binary serialized private key (scalar).
+	ScalarBaseMult(privateKey []byte) ([]byte, error)
+}
+
 // X25519 is the 25519 DH function.
 var X25519 DH = &dh25519{}
 
@@ -153,6 +178,40 @@ func (dh *dh25519) Size() int {
 	return 32
 }
 
+func (dh *dh25519) ScalarMult(privateKey, publicKey []byte) ([]byte, error) {
+	var sk, pk, sharedSecret [32]byte
+	if len(privateKey) != len(sk) {
+		return nil, ErrMalformedPrivateKey
+	}
+	if len(publicKey) != len(pk) {
+		return nil, ErrMalformedPublicKey
+	}
+	copy(sk[:], privateKey)
+	copy(pk[:], publicKey)
+
+	x25519.ScalarMult(&sharedSecret, &sk, &pk)
+	for i := range sk {
+		sk[i] = 0
+	}
+
+	return sharedSecret[:], nil
+}
+
+func (dh *dh25519) ScalarBaseMult(privateKey []byte) ([]byte, error) {
+	var sk, pk [32]byte
+	if len(privateKey) != len(sk) {
+		return nil, ErrMalformedPrivateKey
+	}
+	copy(sk[:], privateKey)
+
+	x25519.ScalarBaseMult(&pk, &sk)
+	for i := range sk {
+		sk[i] = 0
+	}
+
+	return pk[:], nil
+}
+
 // Keypair25519 is a X25519 keypair.
 type Keypair25519 struct {
 	rawPrivateKey [32]byte
@@ -192,11 +251,45 @@ func (kp *Keypair25519) DH(publicKey PublicKey) ([]byte, error) {
 	}
 
 	var sharedSecret [32]byte
-	x25519.ScalarMult(&sharedSecret, &kp.rawPrivateKey, &pubKey.rawPublicKey)
+	if pubKey.table != nil {
+		kp.scalarMultPrecomputed(&sharedSecret, pubKey.table)
+	} else {
+		x25519.ScalarMult(&sharedSecret, &kp.rawPrivateKey, &pubKey.rawPublicKey)
+	}
 
 	return sharedSecret[:], nil
 }
 
+func (kp *Keypair25519) scalarMultPrecomputed(dst *[32]byte, table *curve.EdwardsBasepointTable) {
+	// The table is for `[8]P`, so the clamped scalar (which is always a
+	// multiple of the cofactor) is divided by 8, which also guarantees
+	// that it is less than the group order.
+	var k [32]byte
+	copy(k[:], kp.rawPrivateKey[:])
+	k[0] &= 248
+	k[31] &= 127
+	k[31] |= 64
+	for i := 0; i < len(k)-1; i++ {
+		k[i] = k[i]>>3 | k[i+1]<<5
+	}
+	k[len(k)-1] >>= 3
+
+	var (
+		s  scalar.Scalar
+		p  curve.EdwardsPoint
+		mp curve.MontgomeryPoint
+	)
+	_, _ = s.SetBytesModOrder(k[:])
+	p.MulBasepoint(table, &s)
+	mp.SetEdwards(&p)
+	copy(dst[:], mp[:])
+
+	for i := range k {
+		k[i] = 0
+	}
+	s.Zero()
+}
+
 // DropPrivate discards the private key.
 func (kp *Keypair25519) DropPrivate() {
 	for i := range kp.rawPrivateKey {
@@ -207,6 +300,7 @@ func (kp *Keypair25519) DropPrivate() {
 // PublicKey25519 is a X25519 public key.
 type PublicKey25519 struct {
 	rawPublicKey [32]byte
+	table        *curve.EdwardsBasepointTable
 }
 
 // MarshalBinary marshals the public key to binary form.
@@ -222,129 +316,29 @@ func (pk *PublicKey25519) UnmarshalBinary(data []byte) error {
 	}
 
 	copy(pk.rawPublicKey[:], data)
+	pk.table = nil
 
 	return nil
 }
 
-// Bytes returns the binary serialized public key.
-//
-// Warning: Altering the returned slice is unsupported and will lead to
-// unexpected behavior.
-func (pk *PublicKey25519) Bytes() []byte {
-	return pk.rawPublicKey[:]
-}
-
-// X448 is the X448 DH function.
-var X448 DH = &dh448{}
-
-type dh448 struct{}
-
-func (dh *dh448) String() string {
-	return "448"
-}
-
-func (dh *dh448) GenerateKeypair(rng io.Reader) (Keypair, error) {
-	var kp Keypair448
-	if _, err := io.ReadFull(rng, kp.rawPrivateKey[:]); err != nil {
-		return nil, err
-	}
-
-	x448.ScalarBaseMult(&kp.publicKey.rawPublicKey, &kp.rawPrivateKey)
-
-	return &kp, nil
-}
-
-func (dh *dh448) ParsePrivateKey(data []byte) (Keypair, error) {
-	var kp Keypair448
-	if err := kp.UnmarshalBinary(data); err != nil {
-		return nil, err
-	}
-
-	return &kp, nil
-}
-
-func (dh *dh448) ParsePublicKey(data []byte) (PublicKey, error) {
-	var pk PublicKey448
-	if err := pk.UnmarshalBinary(data); err != nil {
-		return nil, err
-	}
-
-	return &pk, nil
-}
-
-func (dh *dh448) Size() int {
-	return 56
-}
-
-// Keypair448 is a X448 keypair.
-type Keypair448 struct {
-	rawPrivateKey [56]byte
-	publicKey     PublicKey448
-}
-
-// MarshalBinary marshals the keypair's private key to binary form.
-func (kp *Keypair448) MarshalBinary() ([]byte, error) {
-	out := make([]byte, 0, len(kp.rawPrivateKey))
-	return append(out, kp.rawPrivateKey[:]...), nil
-}
-
-// UnmarshalBinary unmarshals the keypair's private key from binary form,
-// and re-derives the corresponding public key.
-func (kp *Keypair448) UnmarshalBinary(data []byte) error {
-	if len(data) != 56 {
-		return ErrMalformedPrivateKey
-	}
-
-	copy(kp.rawPrivateKey[:], data)
-	x448.ScalarBaseMult(&kp.publicKey.rawPublicKey, &kp.rawPrivateKey)
-
-	return nil
-}
-
-// Public returns the public key of the keypair.
-func (kp *Keypair448) Public() PublicKey {
-	return &kp.publicKey
-}
-
-// DH performs a Diffie-Hellman calculation between the private key in the
-// keypair and the provided public key.
-func (kp *Keypair448) DH(publicKey PublicKey) ([]byte, error) {
-	pubKey, ok := publicKey.(*PublicKey448)
-	if !ok {
-		return nil, ErrMismatchedPublicKey
-	}
-
-	var sharedSecret [56]byte
-	x448.ScalarMult(&sharedSecret, &kp.rawPrivateKey, &pubKey.rawPublicKey)
-
-	return sharedSecret[:], nil
-}
-
-// DropPrivate discards the private key.
-func (kp *Keypair448) DropPrivate() {
-	for i := range kp.rawPrivateKey {
-		kp.rawPrivateKey[i] = 0
-	}
-}
-
-// PublicKey448 is a X448 public key.
-type PublicKey448 struct {
-	rawPublicKey [56]byte
-}
-
-// MarshalBinary marshals the public key to binary form.
-func (pk *PublicKey448) MarshalBinary() ([]byte, error) {
-	out := make([]byte, 0, len(pk.rawPublicKey))
-	return append(out, pk.rawPublicKey[:]...), nil
-}
-
-// UnmarshalBinary unmarshals the public key from binary form.
-func (pk *PublicKey448) UnmarshalBinary(data []byte) error {
-	if len(data) != 56 {
+// Precompute precomputes a scalar multiplication table for the public key,
+// accelerating subsequent DH calculations with it, at the cost of
+// approximately 30 KiB of memory.  This is intended for remote static
+// public keys that are used repeatedly (eg: an initiator that makes many
+// connections to the same responder).  It must be called before the public
+// key is used concurrently.
+func (pk *PublicKey25519) Precompute() error {
+	var (
+		mp curve.MontgomeryPoint
+		p  curve.EdwardsPoint
+	)
+	copy(mp[:], pk.rawPublicKey[:])
+	if _, err := p.SetMontgomery(&mp, 0); err != nil {
+		// Points on the twist are handled by the regular code path.
 		return ErrMalformedPublicKey
 	}
-
-	copy(pk.rawPublicKey[:], data)
+	p.MulByCofactor(&p)
+	pk.table = curve.NewEdwardsBasepointTable(&p)
 
 	return nil
 }
@@ -353,7 +347,7 @@ func (pk *PublicKey448) UnmarshalBinary(data []byte) error {
 //
 // Warning: Altering the returned slice is unsupported and will lead to
 // unexpected behavior.
-func (pk *PublicKey448) Bytes() []byte {
+func (pk *PublicKey25519) Bytes() []byte {
 	return pk.rawPublicKey[:]
 }
 
@@ -0,0 +1,135 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package dh
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestX25519Precompute(t *testing.T) {
+	require := require.New(t)
+
+	for i := 0; i < 16; i++ {
+		alice, err := X25519.GenerateKeypair(rand.Reader)
+		require.NoError(err, "GenerateKeypair(alice)")
+		bob, err := X25519.GenerateKeypair(rand.Reader)
+		require.NoError(err, "GenerateKeypair(bob)")
+
+		expected, err := alice.DH(bob.Public())
+		require.NoError(err, "DH")
+
+		bobPublic, err := X25519.ParsePublicKey(bob.Public().Bytes())
+		require.NoError(err, "ParsePublicKey")
+		err = bobPublic.(Precomputable).Precompute()
+		require.NoError(err, "Precompute")
+
+		sharedSecret, err := alice.DH(bobPublic)
+		require.NoError(err, "DH - precomputed")
+		require.Equal(expected, sharedSecret, "DH - precomputed")
+	}
+
+	// Small order points.
+	alice, err := X25519.GenerateKeypair(rand.Reader)
+	require.NoError(err, "GenerateKeypair(alice)")
+	for _, b := range [][]byte{
+		make([]byte, 32),
+		append([]byte{1}, make([]byte, 31)...),
+	} {
+		pk, err := X25519.ParsePublicKey(b)
+		require.NoError(err, "ParsePublicKey(small order)")
+		expected, err := alice.DH(pk)
+		require.NoError(err, "DH(small order)")
+
+		err = pk.(Precomputable).Precompute()
+		require.NoError(err, "Precompute(small order)")
+		sharedSecret, err := alice.DH(pk)
+		require.NoError(err, "DH(small order) - precomputed")
+		require.Equal(expected, sharedSecret, "DH(small order) - precomputed")
+	}
+}
+
+func TestScalarMultiplier(t *testing.T) {
+	for _, dh := range supportedDHs {
+		t.Run(dh.String(), func(t *testing.T) {
+			require := require.New(t)
+
+			sm, ok := dh.(ScalarMultiplier)
+			require.True(ok, "ScalarMultiplier")
+
+			alice, err := dh.GenerateKeypair(rand.Reader)
+			require.NoError(err, "GenerateKeypair(alice)")
+			bob, err := dh.GenerateKeypair(rand.Reader)
+			require.NoError(err, "GenerateKeypair(bob)")
+			aliceRaw, err := alice.MarshalBinary()
+			require.NoError(err, "MarshalBinary(alice)")
+
+			pk, err := sm.ScalarBaseMult(aliceRaw)
+			require.NoError(err, "ScalarBaseMult")
+			require.Equal(alice.Public().Bytes(), pk, "ScalarBaseMult")
+
+			expected, err := alice.DH(bob.Public())
+			require.NoError(err, "DH")
+			sharedSecret, err := sm.ScalarMult(aliceRaw, bob.Public().Bytes())
+			require.NoError(err, "ScalarMult")
+			require.Equal(expected, sharedSecret, "ScalarMult")
+
+			_, err = sm.ScalarMult(aliceRaw[1:], bob.Public().Bytes())
+			require.Equal(ErrMalformedPrivateKey, err, "ScalarMult - truncated private key")
+			_, err = sm.ScalarMult(aliceRaw, bob.Public().Bytes()[1:])
+			require.Equal(ErrMalformedPublicKey, err, "ScalarMult - truncated public key")
+			_, err = sm.ScalarBaseMult(aliceRaw[1:])
+			require.Equal(ErrMalformedPrivateKey, err, "ScalarBaseMult - truncated private key")
+		})
+	}
+}
+
+func BenchmarkX25519(b *testing.B) {
+	alice, _ := X25519.GenerateKeypair(rand.Reader)
+	bob, _ := X25519.GenerateKeypair(rand.Reader)
+	bobPrecomputed, _ := X25519.ParsePublicKey(bob.Public().Bytes())
+	_ = bobPrecomputed.(Precomputable).Precompute()
+
+	for _, v := range []struct {
+		n  string
+		pk PublicKey
+	}{
+		{"Ladder", bob.Public()},
+		{"Precomputed", bobPrecomputed},
+	} {
+		b.Run(v.n, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, _ = alice.DH(v.pk)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build go1.20 && !nyquist_omit_nist
+// +build go1.20,!nyquist_omit_nist
+
+package dh
+
+import (
+	"crypto/ecdh"
+	"io"
+)
+
+var (
+	// P384 is the NIST P-384 DH function.
+	P384 DH = &dhNIST{
+		name:       "P384",
+		curve:      ecdh.P384(),
+		scalarSize: 48,
+		pointSize:  1 + 2*48,
+		topMask:    0xff,
+	}
+
+	// P521 is the NIST P-521 DH function.
+	P521 DH = &dhNIST{
+		name:       "P521",
+		curve:      ecdh.P521(),
+		scalarSize: 66,
+		pointSize:  1 + 2*66,
+		topMask:    0x01,
+	}
+)
+
+// dhNIST is a NIST curve DH function.  Public keys are SEC 1 uncompressed
+// points, which is what `Size` (`DHLEN`) reports, and DH outputs are the
+// shared point's x-coordinate, which is shorter.
+type dhNIST struct {
+	name       string
+	curve      ecdh.Curve
+	scalarSize int
+	pointSize  int
+	topMask    byte
+}
+
+func (dh *dhNIST) String() string {
+	return dh.name
+}
+
+func (dh *dhNIST) GenerateKeypair(rng io.Reader) (Keypair, error) {
+	// crypto/ecdh may disregard the provided entropy source, so sample
+	// the scalar by rejection here, to keep key generation deterministic
+	// with respect to rng.
+	b := make([]byte, dh.scalarSize)
+	defer func() {
+		for i := range b {
+			b[i] = 0
+		}
+	}()
+	for {
+		if _, err := io.ReadFull(rng, b); err != nil {
+			return nil, err
+		}
+		b[0] &= dh.topMask
+
+		sk, err := dh.curve.NewPrivateKey(b)
+		if err != nil {
+			// Zero, or not less than the group order.
+			continue
+		}
+
+		return dh.newKeypair(sk), nil
+	}
+}
+
+func (dh *dhNIST) ParsePrivateKey(data []byte) (Keypair, error) {
+	kp := &KeypairNIST{dh: dh}
+	if err := kp.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+
+	return kp, nil
+}
+
+func (dh *dhNIST) ParsePublicKey(data []byte) (PublicKey, error) {
+	pk := &PublicKeyNIST{dh: dh}
+	if err := pk.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+
+	return pk, nil
+}
+
+func (dh *dhNIST) Size() int {
+	return dh.pointSize
+}
+
+func (dh *dhNIST) ScalarMult(privateKey, publicKey []byte) ([]byte, error) {
+	if len(privateKey) != dh.scalarSize {
+		return nil, ErrMalformedPrivateKey
+	}
+	if len(publicKey) != dh.pointSize {
+		return nil, ErrMalformedPublicKey
+	}
+	sk, err := dh.curve.NewPrivateKey(privateKey)
+	if err != nil {
+		return nil, ErrMalformedPrivateKey
+	}
+	pk, err := dh.curve.NewPublicKey(publicKey)
+	if err != nil {
+		return nil, ErrMalformedPublicKey
+	}
+
+	return sk.ECDH(pk)
+}
+
+func (dh *dhNIST) ScalarBaseMult(privateKey []byte) ([]byte, error) {
+	if len(privateKey) != dh.scalarSize {
+		return nil, ErrMalformedPrivateKey
+	}
+	sk, err := dh.curve.NewPrivateKey(privateKey)
+	if err != nil {
+		return nil, ErrMalformedPrivateKey
+	}
+
+	return sk.PublicKey().Bytes(), nil
+}
+
+func (dh *dhNIST) newKeypair(sk *ecdh.PrivateKey) *KeypairNIST {
+	return &KeypairNIST{
+		dh:         dh,
+		privateKey: sk,
+		publicKey: PublicKeyNIST{
+			dh:        dh,
+			publicKey: sk.PublicKey(),
+		},
+	}
+}
+
+// nistFromSize returns the NIST curve DH function with the given scalar or
+// point size, so that zero valued keys can be unmarshaled.
+func nistFromSize(size int, isPoint bool) *dhNIST {
+	for _, v := range []DH{P384, P521} {
+		dh := v.(*dhNIST)
+		if (isPoint && size == dh.pointSize) || (!isPoint && size == dh.scalarSize) {
+			return dh
+		}
+	}
+	return nil
+}
+
+// KeypairNIST is a NIST curve keypair.
+type KeypairNIST struct {
+	dh         *dhNIST
+	privateKey *ecdh.PrivateKey
+	publicKey  PublicKeyNIST
+}
+
+// MarshalBinary marshals the keypair's private key to binary form.
+func (kp *KeypairNIST) MarshalBinary() ([]byte, error) {
+	if kp.privateKey == nil {
+		return nil, ErrMalformedPrivateKey
+	}
+	return kp.privateKey.Bytes(), nil
+}
+
+// UnmarshalBinary unmarshals the keypair's private key from binary form,
+// and re-derives the corresponding public key.
+func (kp *KeypairNIST) UnmarshalBinary(data []byte) error {
+	dh := kp.dh
+	if dh == nil {
+		dh = nistFromSize(len(data), false)
+	}
+	if dh == nil || len(data) != dh.scalarSize {
+		return ErrMalformedPrivateKey
+	}
+
+	sk, err := dh.curve.NewPrivateKey(data)
+	if err != nil {
+		return ErrMalformedPrivateKey
+	}
+	*kp = *dh.newKeypair(sk)
+
+	return nil
+}
+
+// Public returns the public key of the keypair.
+func (kp *KeypairNIST) Public() PublicKey {
+	return &kp.publicKey
+}
+
+// DH performs a Diffie-Hellman calculation between the private key in the
+// keypair and the provided public key.
+func (kp *KeypairNIST) DH(publicKey PublicKey) ([]byte, error) {
+	pubKey, ok := publicKey.(*PublicKeyNIST)
+	if !ok || pubKey.dh != kp.dh {
+		return nil, ErrMismatchedPublicKey
+	}
+	if kp.privateKey == nil {
+		return nil, ErrMalformedPrivateKey
+	}
+
+	return kp.privateKey.ECDH(pubKey.publicKey)
+}
+
+// DropPrivate discards the private key.
+//
+// Note: crypto/ecdh does not support overwriting the private key, so this
+// only drops the reference to it.
+func (kp *KeypairNIST) DropPrivate() {
+	kp.privateKey = nil
+}
+
+// PublicKeyNIST is a NIST curve public key.
+type PublicKeyNIST struct {
+	dh        *dhNIST
+	publicKey *ecdh.PublicKey
+}
+
+// MarshalBinary marshals the public key to binary form.
+func (pk *PublicKeyNIST) MarshalBinary() ([]byte, error) {
+	if pk.publicKey == nil {
+		return nil, ErrMalformedPublicKey
+	}
+	return pk.publicKey.Bytes(), nil
+}
+
+// UnmarshalBinary unmarshals the public key from binary form.  The point
+// must be a valid SEC 1 uncompressed point on the curve.
+func (pk *PublicKeyNIST) UnmarshalBinary(data []byte) error {
+	dh := pk.dh
+	if dh == nil {
+		dh = nistFromSize(len(data), true)
+	}
+	if dh == nil || len(data) != dh.pointSize {
+		return ErrMalformedPublicKey
+	}
+
+	publicKey, err := dh.curve.NewPublicKey(data)
+	if err != nil {
+		return ErrMalformedPublicKey
+	}
+	pk.dh, pk.publicKey = dh, publicKey
+
+	return nil
+}
+
+// Bytes returns the binary serialized public key.
+//
+// Warning: Altering the returned slice is unsupported and will lead to
+// unexpected behavior.
+func (pk *PublicKeyNIST) Bytes() []byte {
+	if pk.publicKey == nil {
+		return nil
+	}
+	return pk.publicKey.Bytes()
+}
+
+func init() {
+	Register(P384)
+	Register(P521)
+}
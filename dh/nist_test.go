@@ -0,0 +1,126 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build go1.20 && !nyquist_omit_nist
+// +build go1.20,!nyquist_omit_nist
+
+package dh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNIST(t *testing.T) {
+	for _, v := range []struct {
+		dh         DH
+		pointSize  int
+		outputSize int
+	}{
+		{P384, 97, 48},
+		{P521, 133, 66},
+	} {
+		t.Run(v.dh.String(), func(t *testing.T) {
+			require := require.New(t)
+
+			require.Equal(v.dh, FromString(v.dh.String()), "FromString")
+			require.Equal(v.pointSize, v.dh.Size(), "Size")
+
+			alice, err := v.dh.GenerateKeypair(rand.Reader)
+			require.NoError(err, "GenerateKeypair(alice)")
+			bob, err := v.dh.GenerateKeypair(rand.Reader)
+			require.NoError(err, "GenerateKeypair(bob)")
+			require.Len(alice.Public().Bytes(), v.pointSize, "Public")
+
+			aliceShared, err := alice.DH(bob.Public())
+			require.NoError(err, "DH(alice, bob)")
+			bobShared, err := bob.DH(alice.Public())
+			require.NoError(err, "DH(bob, alice)")
+			require.Len(aliceShared, v.outputSize, "DH - output size")
+			require.Equal(aliceShared, bobShared, "DH - shared secret")
+
+			// Key generation is deterministic with respect to the rng.
+			seed := bytes.Repeat([]byte{0x2a}, 2*v.outputSize)
+			kp1, err := v.dh.GenerateKeypair(bytes.NewReader(seed))
+			require.NoError(err, "GenerateKeypair(seed)")
+			kp2, err := v.dh.GenerateKeypair(bytes.NewReader(seed))
+			require.NoError(err, "GenerateKeypair(seed) - again")
+			require.Equal(kp1.Public().Bytes(), kp2.Public().Bytes(), "GenerateKeypair - deterministic")
+
+			// Serialization round trips, including into zero valued keys.
+			raw, err := alice.MarshalBinary()
+			require.NoError(err, "MarshalBinary(alice)")
+			parsed, err := v.dh.ParsePrivateKey(raw)
+			require.NoError(err, "ParsePrivateKey")
+			require.Equal(alice.Public().Bytes(), parsed.Public().Bytes(), "ParsePrivateKey - public key")
+			var kp KeypairNIST
+			require.NoError(kp.UnmarshalBinary(raw), "KeypairNIST.UnmarshalBinary")
+			require.Equal(alice.Public().Bytes(), kp.Public().Bytes(), "KeypairNIST.UnmarshalBinary - public key")
+
+			var pk PublicKeyNIST
+			require.NoError(pk.UnmarshalBinary(bob.Public().Bytes()), "PublicKeyNIST.UnmarshalBinary")
+			sharedSecret, err := alice.DH(&pk)
+			require.NoError(err, "DH - unmarshaled public key")
+			require.Equal(aliceShared, sharedSecret, "DH - unmarshaled public key")
+
+			// Invalid points and scalars are rejected.
+			_, err = v.dh.ParsePublicKey(make([]byte, v.pointSize))
+			require.Equal(ErrMalformedPublicKey, err, "ParsePublicKey - identity")
+			offCurve := append([]byte{}, bob.Public().Bytes()...)
+			offCurve[len(offCurve)-1] ^= 1
+			_, err = v.dh.ParsePublicKey(offCurve)
+			require.Equal(ErrMalformedPublicKey, err, "ParsePublicKey - off curve")
+			_, err = v.dh.ParsePrivateKey(make([]byte, v.outputSize))
+			require.Equal(ErrMalformedPrivateKey, err, "ParsePrivateKey - zero")
+			_, err = v.dh.ParsePrivateKey(bytes.Repeat([]byte{0xff}, v.outputSize))
+			require.Equal(ErrMalformedPrivateKey, err, "ParsePrivateKey - out of range")
+
+			// Keys for other curves are rejected.
+			x25519, err := X25519.GenerateKeypair(rand.Reader)
+			require.NoError(err, "GenerateKeypair(X25519)")
+			_, err = alice.DH(x25519.Public())
+			require.Equal(ErrMismatchedPublicKey, err, "DH - X25519 public key")
+			other := P384
+			if v.dh == P384 {
+				other = P521
+			}
+			otherKp, err := other.GenerateKeypair(rand.Reader)
+			require.NoError(err, "GenerateKeypair(other)")
+			_, err = alice.DH(otherKp.Public())
+			require.Equal(ErrMismatchedPublicKey, err, "DH - other curve public key")
+
+			alice.DropPrivate()
+			_, err = alice.DH(bob.Public())
+			require.Equal(ErrMalformedPrivateKey, err, "DH - dropped private key")
+		})
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright (C) 2019, 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build !nyquist_omit_x448
+// +build !nyquist_omit_x448
+
+package dh
+
+import (
+	"io"
+
+	"gitlab.com/yawning/x448.git"
+)
+
+// X448 is the X448 DH function.
+var X448 DH = &dh448{}
+
+type dh448 struct{}
+
+func (dh *dh448) String() string {
+	return "448"
+}
+
+func (dh *dh448) GenerateKeypair(rng io.Reader) (Keypair, error) {
+	var kp Keypair448
+	if _, err := io.ReadFull(rng, kp.rawPrivateKey[:]); err != nil {
+		return nil, err
+	}
+
+	x448.ScalarBaseMult(&kp.publicKey.rawPublicKey, &kp.rawPrivateKey)
+
+	return &kp, nil
+}
+
+func (dh *dh448) ParsePrivateKey(data []byte) (Keypair, error) {
+	var kp Keypair448
+	if err := kp.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+
+	return &kp, nil
+}
+
+func (dh *dh448) ParsePublicKey(data []byte) (PublicKey, error) {
+	var pk PublicKey448
+	if err := pk.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+
+	return &pk, nil
+}
+
+func (dh *dh448) Size() int {
+	return 56
+}
+
+func (dh *dh448) ScalarMult(privateKey, publicKey []byte) ([]byte, error) {
+	var sk, pk, sharedSecret [56]byte
+	if len(privateKey) != len(sk) {
+		return nil, ErrMalformedPrivateKey
+	}
+	if len(publicKey) != len(pk) {
+		return nil, ErrMalformedPublicKey
+	}
+	copy(sk[:], privateKey)
+	copy(pk[:], publicKey)
+
+	x448.ScalarMult(&sharedSecret, &sk, &pk)
+	for i := range sk {
+		sk[i] = 0
+	}
+
+	return sharedSecret[:], nil
+}
+
+func (dh *dh448) ScalarBaseMult(privateKey []byte) ([]byte, error) {
+	var sk, pk [56]byte
+	if len(privateKey) != len(sk) {
+		return nil, ErrMalformedPrivateKey
+	}
+	copy(sk[:], privateKey)
+
+	x448.ScalarBaseMult(&pk, &sk)
+	for i := range sk {
+		sk[i] = 0
+	}
+
+	return pk[:], nil
+}
+
+// Keypair448 is a X448 keypair.
+type Keypair448 struct {
+	rawPrivateKey [56]byte
+	publicKey     PublicKey448
+}
+
+// MarshalBinary marshals the keypair's private key to binary form.
+func (kp *Keypair448) MarshalBinary() ([]byte, error) {
+	out := make([]byte, 0, len(kp.rawPrivateKey))
+	return append(out, kp.rawPrivateKey[:]...), nil
+}
+
+// UnmarshalBinary unmarshals the keypair's private key from binary form,
+// and re-derives the corresponding public key.
+func (kp *Keypair448) UnmarshalBinary(data []byte) error {
+	if len(data) != 56 {
+		return ErrMalformedPrivateKey
+	}
+
+	copy(kp.rawPrivateKey[:], data)
+	x448.ScalarBaseMult(&kp.publicKey.rawPublicKey, &kp.rawPrivateKey)
+
+	return nil
+}
+
+// Public returns the public key of the keypair.
+func (kp *Keypair448) Public() PublicKey {
+	return &kp.publicKey
+}
+
+// DH performs a Diffie-Hellman calculation between the private key in the
+// keypair and the provided public key.
+func (kp *Keypair448) DH(publicKey PublicKey) ([]byte, error) {
+	pubKey, ok := publicKey.(*PublicKey448)
+	if !ok {
+		return nil, ErrMismatchedPublicKey
+	}
+
+	var sharedSecret [56]byte
+	x448.ScalarMult(&sharedSecret, &kp.rawPrivateKey, &pubKey.rawPublicKey)
+
+	return sharedSecret[:], nil
+}
+
+// DropPrivate discards the private key.
+func (kp *Keypair448) DropPrivate() {
+	for i := range kp.rawPrivateKey {
+		kp.rawPrivateKey[i] = 0
+	}
+}
+
+// PublicKey448 is a X448 public key.
+type PublicKey448 struct {
+	rawPublicKey [56]byte
+}
+
+// MarshalBinary marshals the public key to binary form.
+func (pk *PublicKey448) MarshalBinary() ([]byte, error) {
+	out := make([]byte, 0, len(pk.rawPublicKey))
+	return append(out, pk.rawPublicKey[:]...), nil
+}
+
+// UnmarshalBinary unmarshals the public key from binary form.
+func (pk *PublicKey448) UnmarshalBinary(data []byte) error {
+	if len(data) != 56 {
+		return ErrMalformedPublicKey
+	}
+
+	copy(pk.rawPublicKey[:], data)
+
+	return nil
+}
+
+// Bytes returns the binary serialized public key.
+//
+// Warning: Altering the returned slice is unsupported and will lead to
+// unexpected behavior.
+func (pk *PublicKey448) Bytes() []byte {
+	return pk.rawPublicKey[:]
+}
+
+func init() {
+	Register(X448)
+}
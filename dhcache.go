@@ -0,0 +1,132 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package nyquist
+
+import (
+	"container/list"
+	"sync"
+
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+// StaticDHCache is a bounded least-recently-used cache of static-static
+// (`ss`) DH results, keyed by the local and remote static public keys.
+// It is intended for responders that repeatedly handshake with the same
+// set of known initiators (eg: `IK` or `KK` in a hub-and-spoke deployment),
+// and saves one scalar multiplication per handshake on a cache hit.
+//
+// A single cache is safe for concurrent use by multiple handshakes.
+//
+// Warning: The cache holds shared secrets in memory for as long as they
+// remain cached.  Use Purge to clear them.
+type StaticDHCache struct {
+	mu sync.Mutex
+
+	capacity int
+	lru      *list.List
+	entries  map[string]*list.Element
+}
+
+type staticDHCacheEntry struct {
+	key    string
+	secret []byte
+}
+
+// Len returns the number of entries in the cache.
+func (c *StaticDHCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+// Purge removes all entries from the cache, overwriting the cached secrets.
+func (c *StaticDHCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		zero(e.Value.(*staticDHCacheEntry).secret)
+	}
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+func (c *StaticDHCache) dh(s dh.Keypair, rs dh.PublicKey) ([]byte, error) {
+	key := string(s.Public().Bytes()) + string(rs.Bytes())
+
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		secret := append([]byte{}, e.Value.(*staticDHCacheEntry).secret...)
+		c.mu.Unlock()
+		return secret, nil
+	}
+	c.mu.Unlock()
+
+	// Do the scalar multiplication without holding the lock.
+	secret, err := s.DH(rs)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok {
+		c.entries[key] = c.lru.PushFront(&staticDHCacheEntry{
+			key:    key,
+			secret: append([]byte{}, secret...),
+		})
+		for c.lru.Len() > c.capacity {
+			e := c.lru.Back()
+			ent := e.Value.(*staticDHCacheEntry)
+			zero(ent.secret)
+			delete(c.entries, ent.key)
+			c.lru.Remove(e)
+		}
+	}
+
+	return secret, nil
+}
+
+// NewStaticDHCache creates a new StaticDHCache that holds at most capacity
+// entries.
+func NewStaticDHCache(capacity int) *StaticDHCache {
+	if capacity <= 0 {
+		panic("nyquist/StaticDHCache: invalid capacity")
+	}
+
+	return &StaticDHCache{
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
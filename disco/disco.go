@@ -0,0 +1,268 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package disco implements the Disco extension to the Noise Protocol
+// Framework, where the SymmetricState and CipherState are replaced by a
+// Strobe duplex construction.
+//
+// Protocol names take the form `Noise_<pattern>_<dh>_STROBEv1.0.2`, and
+// the handshake patterns and DH functions are shared with nyquist.
+//
+// Warning: This is not interoperable with standard Noise implementations.
+package disco // import "gitlab.com/yawning/nyquist.git/disco"
+
+import (
+	"errors"
+	"strings"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/dh"
+	"gitlab.com/yawning/nyquist.git/internal/strobe"
+	"gitlab.com/yawning/nyquist.git/pattern"
+)
+
+const (
+	// TagSize is the size of the authentication tag in bytes.
+	TagSize = 16
+
+	hashLen = 32
+
+	protocolPrefix  = "Noise"
+	invalidProtocol = "[invalid protocol]"
+)
+
+var (
+	errCipherStateReset = errors.New("nyquist/disco/CipherState: reset")
+
+	labelInitiator = []byte("initiator")
+	labelResponder = []byte("responder")
+)
+
+// Protocol is a the protocol to be used with a handshake.
+type Protocol struct {
+	Pattern pattern.Pattern
+
+	DH dh.DH
+}
+
+// String returns the string representation of the protocol name.
+func (pr *Protocol) String() string {
+	if pr.Pattern == nil || pr.DH == nil {
+		return invalidProtocol
+	}
+
+	parts := []string{
+		protocolPrefix,
+		pr.Pattern.String(),
+		pr.DH.String(),
+		strobe.Version,
+	}
+	return strings.Join(parts, "_")
+}
+
+// NewProtocol returns a Protocol from the provided (case-sensitive) protocol
+// name.
+func NewProtocol(s string) (*Protocol, error) {
+	parts := strings.Split(s, "_")
+	if len(parts) != 4 || parts[0] != protocolPrefix || parts[3] != strobe.Version {
+		return nil, nyquist.ErrProtocolNotSupported
+	}
+
+	var pr Protocol
+	pr.Pattern = pattern.FromString(parts[1])
+	pr.DH = dh.FromString(parts[2])
+
+	if pr.Pattern == nil || pr.DH == nil {
+		return nil, nyquist.ErrProtocolNotSupported
+	}
+
+	return &pr, nil
+}
+
+// CipherState is a Strobe based transport CipherState.
+type CipherState struct {
+	s *strobe.Strobe
+
+	maxMessageSize int
+}
+
+// EncryptWithAd encrypts and authenticates the additional data and
+// plaintext, and appends the ciphertext to dst.
+//
+// Note: For compatibility with other Disco implementations, the
+// additional data is only processed if it is non-empty.
+func (cs *CipherState) EncryptWithAd(dst, ad, plaintext []byte) ([]byte, error) {
+	if cs.s == nil {
+		return nil, errCipherStateReset
+	}
+	if cs.maxMessageSize > 0 && len(plaintext)+TagSize > cs.maxMessageSize {
+		return nil, nyquist.ErrMessageSize
+	}
+
+	dst = cs.s.SendENC(false, dst, plaintext)
+	if len(ad) > 0 {
+		cs.s.AD(false, ad)
+	}
+	return cs.s.SendMAC(false, dst, TagSize), nil
+}
+
+// DecryptWithAd authenticates and decrypts the additional data and
+// ciphertext, and appends the plaintext to dst.  On failure, the
+// CipherState is left unaltered.
+func (cs *CipherState) DecryptWithAd(dst, ad, ciphertext []byte) ([]byte, error) {
+	if cs.s == nil {
+		return nil, errCipherStateReset
+	}
+	if cs.maxMessageSize > 0 && len(ciphertext) > cs.maxMessageSize {
+		return nil, nyquist.ErrMessageSize
+	}
+	if len(ciphertext) < TagSize {
+		return nil, nyquist.ErrOpen
+	}
+
+	// Strobe alters the state even on authentication failure, so operate
+	// on a copy.
+	s := cs.s.Clone()
+	ctLen := len(ciphertext) - TagSize
+	plaintext := s.RecvENC(false, nil, ciphertext[:ctLen])
+	if len(ad) > 0 {
+		s.AD(false, ad)
+	}
+	if !s.RecvMAC(false, ciphertext[ctLen:]) {
+		s.Reset()
+		zero(plaintext)
+		return nil, nyquist.ErrOpen
+	}
+
+	cs.s.Reset()
+	cs.s = s
+
+	return append(dst, plaintext...), nil
+}
+
+// Rekey ratchets the CipherState to prevent rollback.
+func (cs *CipherState) Rekey() error {
+	if cs.s == nil {
+		return errCipherStateReset
+	}
+	cs.s.RATCHET(hashLen)
+	return nil
+}
+
+// Reset sanitizes the CipherState, to prevent future calls.
+func (cs *CipherState) Reset() {
+	if cs.s != nil {
+		cs.s.Reset()
+		cs.s = nil
+	}
+}
+
+type symmetricState struct {
+	s *strobe.Strobe
+
+	maxMessageSize int
+	isKeyed        bool
+}
+
+func (ss *symmetricState) mixKey(inputKeyMaterial []byte) {
+	ss.s.AD(false, inputKeyMaterial)
+	ss.isKeyed = true
+}
+
+func (ss *symmetricState) mixHash(data []byte) {
+	ss.s.AD(false, data)
+}
+
+func (ss *symmetricState) mixKeyAndHash(inputKeyMaterial []byte) {
+	ss.mixKey(inputKeyMaterial)
+}
+
+func (ss *symmetricState) getHandshakeHash() []byte {
+	return ss.s.PRF(hashLen)
+}
+
+func (ss *symmetricState) encryptAndHash(dst, plaintext []byte) []byte {
+	if !ss.isKeyed {
+		ss.s.SendCLR(false, plaintext)
+		return append(dst, plaintext...)
+	}
+
+	dst = ss.s.SendENC(false, dst, plaintext)
+	return ss.s.SendMAC(false, dst, TagSize)
+}
+
+func (ss *symmetricState) decryptAndHash(dst, ciphertext []byte) ([]byte, error) {
+	if !ss.isKeyed {
+		ss.s.RecvCLR(false, ciphertext)
+		return append(dst, ciphertext...), nil
+	}
+
+	if len(ciphertext) < TagSize {
+		return nil, nyquist.ErrOpen
+	}
+	ctLen := len(ciphertext) - TagSize
+	plaintext := ss.s.RecvENC(false, nil, ciphertext[:ctLen])
+	if !ss.s.RecvMAC(false, ciphertext[ctLen:]) {
+		zero(plaintext)
+		return nil, nyquist.ErrOpen
+	}
+
+	return append(dst, plaintext...), nil
+}
+
+func (ss *symmetricState) split() (*CipherState, *CipherState) {
+	s1, s2 := ss.s.Clone(), ss.s.Clone()
+	s1.AD(true, labelInitiator)
+	s1.RATCHET(hashLen)
+	s2.AD(true, labelResponder)
+	s2.RATCHET(hashLen)
+
+	return &CipherState{s: s1, maxMessageSize: ss.maxMessageSize},
+		&CipherState{s: s2, maxMessageSize: ss.maxMessageSize}
+}
+
+func (ss *symmetricState) reset() {
+	if ss.s != nil {
+		ss.s.Reset()
+		ss.s = nil
+	}
+}
+
+func newSymmetricState(protocolName []byte, maxMessageSize int) *symmetricState {
+	return &symmetricState{
+		s:              strobe.New(protocolName),
+		maxMessageSize: maxMessageSize,
+	}
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package disco
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+func runHandshake(t *testing.T, aliceCfg, bobCfg *HandshakeConfig) (*HandshakeStatus, *HandshakeStatus, error) {
+	require := require.New(t)
+
+	alice, err := NewHandshake(aliceCfg)
+	require.NoError(err, "NewHandshake - alice")
+	defer alice.Reset()
+	bob, err := NewHandshake(bobCfg)
+	require.NoError(err, "NewHandshake - bob")
+	defer bob.Reset()
+
+	writer, reader := alice, bob
+	for i := 0; ; i++ {
+		payload := []byte{byte(i)}
+		msg, err := writer.WriteMessage(nil, payload)
+		if err != nyquist.ErrDone {
+			require.NoError(err, "WriteMessage(%d)", i)
+		}
+		decrypted, rErr := reader.ReadMessage(nil, msg)
+		if rErr != nil && rErr != nyquist.ErrDone {
+			return nil, nil, rErr
+		}
+		require.Equal(err, rErr, "ReadMessage(%d)", i)
+		require.Equal(payload, decrypted, "ReadMessage(%d) - payload", i)
+		if err == nyquist.ErrDone {
+			break
+		}
+		writer, reader = reader, writer
+	}
+
+	return alice.GetStatus(), bob.GetStatus(), nil
+}
+
+func TestDisco(t *testing.T) {
+	psk := make([]byte, nyquist.PreSharedKeySize)
+	_, _ = rand.Read(psk)
+
+	for _, v := range []struct {
+		name   string
+		dhName string
+	}{
+		{"Noise_NN_25519_STROBEv1.0.2", "25519"},
+		{"Noise_XX_25519_STROBEv1.0.2", "25519"},
+		{"Noise_IK_25519_STROBEv1.0.2", "25519"},
+		{"Noise_KK_448_STROBEv1.0.2", "448"},
+		{"Noise_NNpsk2_25519_STROBEv1.0.2", "25519"},
+		{"Noise_N_25519_STROBEv1.0.2", "25519"},
+	} {
+		v := v
+		t.Run(v.name, func(t *testing.T) {
+			require := require.New(t)
+			if dh.FromString(v.dhName) == nil {
+				t.Skip("DH function not included in the build")
+			}
+
+			protocol, err := NewProtocol(v.name)
+			require.NoError(err, "NewProtocol")
+			require.Equal(v.name, protocol.String(), "String")
+
+			aliceStatic, err := protocol.DH.GenerateKeypair(rand.Reader)
+			require.NoError(err, "GenerateKeypair - alice")
+			bobStatic, err := protocol.DH.GenerateKeypair(rand.Reader)
+			require.NoError(err, "GenerateKeypair - bob")
+
+			aliceCfg := &HandshakeConfig{
+				Protocol:     protocol,
+				Prologue:     []byte("disco prologue"),
+				LocalStatic:  aliceStatic,
+				RemoteStatic: bobStatic.Public(),
+				IsInitiator:  true,
+			}
+			bobCfg := &HandshakeConfig{
+				Protocol:     protocol,
+				Prologue:     []byte("disco prologue"),
+				LocalStatic:  bobStatic,
+				RemoteStatic: aliceStatic.Public(),
+			}
+			if protocol.Pattern.NumPSKs() > 0 {
+				aliceCfg.PreSharedKeys = [][]byte{psk}
+				bobCfg.PreSharedKeys = [][]byte{psk}
+			}
+			aliceStatus, bobStatus, err := runHandshake(t, aliceCfg, bobCfg)
+			require.NoError(err, "runHandshake")
+			require.Equal(aliceStatus.HandshakeHash, bobStatus.HandshakeHash, "HandshakeHash")
+
+			aliceTx, bobRx := aliceStatus.CipherStates[0], bobStatus.CipherStates[0]
+			for i := 0; i < 3; i++ {
+				ad := []byte("ad")
+				if i == 0 {
+					ad = nil
+				}
+				ct, err := aliceTx.EncryptWithAd(nil, ad, []byte("transport message"))
+				require.NoError(err, "EncryptWithAd(%d)", i)
+
+				// Failures must not desynchronize the CipherState.
+				tampered := append([]byte{}, ct...)
+				tampered[0] ^= 0x01
+				_, err = bobRx.DecryptWithAd(nil, ad, tampered)
+				require.Equal(nyquist.ErrOpen, err, "DecryptWithAd(%d) - tampered", i)
+
+				pt, err := bobRx.DecryptWithAd(nil, ad, ct)
+				require.NoError(err, "DecryptWithAd(%d)", i)
+				require.Equal([]byte("transport message"), pt, "DecryptWithAd(%d) - plaintext", i)
+			}
+
+			if protocol.Pattern.IsOneWay() {
+				require.Nil(aliceStatus.CipherStates[1], "one-way cs2")
+				return
+			}
+
+			bobTx, aliceRx := bobStatus.CipherStates[1], aliceStatus.CipherStates[1]
+			require.NoError(bobTx.Rekey(), "Rekey - bob")
+			require.NoError(aliceRx.Rekey(), "Rekey - alice")
+			ct, err := bobTx.EncryptWithAd(nil, nil, []byte("reply"))
+			require.NoError(err, "EncryptWithAd - reply")
+			pt, err := aliceRx.DecryptWithAd(nil, nil, ct)
+			require.NoError(err, "DecryptWithAd - reply")
+			require.Equal([]byte("reply"), pt, "DecryptWithAd - reply plaintext")
+
+			bobTx.Reset()
+			_, err = bobTx.EncryptWithAd(nil, nil, []byte("reply"))
+			require.Equal(errCipherStateReset, err, "EncryptWithAd - after Reset")
+		})
+	}
+
+	t.Run("PrologueMismatch", func(t *testing.T) {
+		protocol, err := NewProtocol("Noise_NN_25519_STROBEv1.0.2")
+		require.NoError(t, err, "NewProtocol")
+
+		_, _, err = runHandshake(t,
+			&HandshakeConfig{Protocol: protocol, Prologue: []byte("A"), IsInitiator: true},
+			&HandshakeConfig{Protocol: protocol, Prologue: []byte("B")},
+		)
+		require.Equal(t, nyquist.ErrOpen, err, "runHandshake")
+	})
+
+	t.Run("BadProtocol", func(t *testing.T) {
+		for _, v := range []string{
+			"Noise_NN_25519_ChaChaPoly_BLAKE2s",
+			"Noise_NN_25519_STROBEv1.0.1",
+			"Disco_NN_25519_STROBEv1.0.2",
+			"Noise_ZZ_25519_STROBEv1.0.2",
+		} {
+			_, err := NewProtocol(v)
+			require.Equal(t, nyquist.ErrProtocolNotSupported, err, "NewProtocol(%s)", v)
+		}
+	})
+}
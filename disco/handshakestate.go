@@ -0,0 +1,484 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package disco
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/dh"
+	"gitlab.com/yawning/nyquist.git/pattern"
+)
+
+var (
+	errTruncatedE = errors.New("nyquist/disco/HandshakeState/ReadMessage/e: truncated message")
+	errTruncatedS = errors.New("nyquist/disco/HandshakeState/ReadMessage/s: truncated message")
+	errMissingS   = errors.New("nyquist/disco/HandshakeState/WriteMessage/s: s not set")
+
+	errMissingPSK = errors.New("nyquist/disco/New: missing or excessive PreSharedKey(s)")
+	errBadPSK     = errors.New("nyquist/disco/New: malformed PreSharedKey(s)")
+)
+
+// HandshakeConfig is a handshake configuration.  See
+// `nyquist.HandshakeConfig` for details.
+type HandshakeConfig struct {
+	// Protocol is the disco protocol to use for this handshake.
+	Protocol *Protocol
+
+	// Prologue is the optional pre-handshake prologue input to be included
+	// in the handshake hash.
+	Prologue []byte
+
+	// LocalStatic is the local static keypair, if any (`s`).
+	LocalStatic dh.Keypair
+
+	// LocalEphemeral is the local ephemeral keypair, if any (`e`).
+	LocalEphemeral dh.Keypair
+
+	// RemoteStatic is the remote static public key, if any (`rs`).
+	RemoteStatic dh.PublicKey
+
+	// RemoteEphemeral is the remote ephemeral public key, if any (`re`).
+	RemoteEphemeral dh.PublicKey
+
+	// PreSharedKeys is the vector of pre-shared symmetric key for PSK mode
+	// handshakes.
+	PreSharedKeys [][]byte
+
+	// Observer is the optional handshake observer.
+	Observer nyquist.HandshakeObserver
+
+	// Rng is the entropy source to be used when generating new DH key pairs.
+	// If the value is `nil`, `crypto/rand.Reader` will be used.
+	Rng io.Reader
+
+	// MaxMessageSize specifies the maximum message size the handshake
+	// and session will process or generate.  If the value is `0`,
+	// `nyquist.DefaultMaxMessageSize` will be used.  A negative value
+	// will disable the maximum message size enforcement entirely.
+	MaxMessageSize int
+
+	// IsInitiator should be set to true if this handshake is in the
+	// initiator role.
+	IsInitiator bool
+}
+
+func (cfg *HandshakeConfig) getRng() io.Reader {
+	if cfg.Rng == nil {
+		return rand.Reader
+	}
+	return cfg.Rng
+}
+
+func (cfg *HandshakeConfig) getMaxMessageSize() int {
+	if cfg.MaxMessageSize > 0 {
+		return cfg.MaxMessageSize
+	}
+	if cfg.MaxMessageSize == 0 {
+		return nyquist.DefaultMaxMessageSize
+	}
+	return 0
+}
+
+// HandshakeStatus is the status of a handshake.  See
+// `nyquist.HandshakeStatus` for details.
+type HandshakeStatus struct {
+	// Err is the error representing the status of the handshake.
+	Err error
+
+	// LocalEphemeral is the local ephemeral public key, if any (`e`).
+	LocalEphemeral dh.PublicKey
+
+	// RemoteStatic is the remote static public key, if any (`rs`).
+	RemoteStatic dh.PublicKey
+
+	// RemoteEphemeral is the remote ephemeral public key, if any (`re`).
+	RemoteEphemeral dh.PublicKey
+
+	// CipherStates is the resulting CipherState pair (`(cs1, cs2)`).
+	//
+	// Note: To prevent misuse, for one-way patterns `cs2` will be nil.
+	CipherStates []*CipherState
+
+	// HandshakeHash is the handshake hash.  This field is only set
+	// once the handshake is completed.
+	HandshakeHash []byte
+}
+
+// HandshakeState is the per-handshake state.
+type HandshakeState struct {
+	cfg *HandshakeConfig
+
+	dh       dh.DH
+	patterns []pattern.Message
+
+	ss *symmetricState
+
+	s  dh.Keypair
+	e  dh.Keypair
+	rs dh.PublicKey
+	re dh.PublicKey
+
+	status *HandshakeStatus
+
+	patternIndex   int
+	pskIndex       int
+	maxMessageSize int
+	dhLen          int
+	isInitiator    bool
+}
+
+// GetStatus returns the HandshakeState's status.
+func (hs *HandshakeState) GetStatus() *HandshakeStatus {
+	return hs.status
+}
+
+// Reset clears the HandshakeState, to prevent future calls.
+//
+// Warning: If either of the local keypairs were provided by the
+// HandshakeConfig, they will be left intact.
+func (hs *HandshakeState) Reset() {
+	if hs.ss != nil {
+		hs.ss.reset()
+		hs.ss = nil
+	}
+	if hs.s != nil && hs.s != hs.cfg.LocalStatic {
+		hs.s.DropPrivate()
+	}
+	if hs.e != nil && hs.e != hs.cfg.LocalEphemeral {
+		hs.e.DropPrivate()
+	}
+}
+
+func (hs *HandshakeState) mixE(eBytes []byte) {
+	hs.ss.mixHash(eBytes)
+	if hs.cfg.Protocol.Pattern.NumPSKs() > 0 {
+		hs.ss.mixKey(eBytes)
+	}
+}
+
+func (hs *HandshakeState) onWriteTokenE(dst []byte) []byte {
+	if hs.e == nil {
+		if hs.e, hs.status.Err = hs.dh.GenerateKeypair(hs.cfg.getRng()); hs.status.Err != nil {
+			return nil
+		}
+	}
+	eBytes := hs.e.Public().Bytes()
+	hs.mixE(eBytes)
+	hs.status.LocalEphemeral = hs.e.Public()
+	return append(dst, eBytes...)
+}
+
+func (hs *HandshakeState) onReadTokenE(payload []byte) []byte {
+	if len(payload) < hs.dhLen {
+		hs.status.Err = errTruncatedE
+		return nil
+	}
+	eBytes, tail := payload[:hs.dhLen], payload[hs.dhLen:]
+	if hs.re, hs.status.Err = hs.dh.ParsePublicKey(eBytes); hs.status.Err != nil {
+		return nil
+	}
+	hs.status.RemoteEphemeral = hs.re
+	if hs.cfg.Observer != nil {
+		if hs.status.Err = hs.cfg.Observer.OnPeerPublicKey(pattern.Token_e, hs.re); hs.status.Err != nil {
+			return nil
+		}
+	}
+	hs.mixE(eBytes)
+	return tail
+}
+
+func (hs *HandshakeState) onWriteTokenS(dst []byte) []byte {
+	if hs.s == nil {
+		hs.status.Err = errMissingS
+		return nil
+	}
+	return hs.ss.encryptAndHash(dst, hs.s.Public().Bytes())
+}
+
+func (hs *HandshakeState) onReadTokenS(payload []byte) []byte {
+	tempLen := hs.dhLen
+	if hs.ss.isKeyed {
+		tempLen += TagSize
+	}
+	if len(payload) < tempLen {
+		hs.status.Err = errTruncatedS
+		return nil
+	}
+	temp, tail := payload[:tempLen], payload[tempLen:]
+
+	var sBytes []byte
+	if sBytes, hs.status.Err = hs.ss.decryptAndHash(nil, temp); hs.status.Err != nil {
+		return nil
+	}
+	if hs.rs, hs.status.Err = hs.dh.ParsePublicKey(sBytes); hs.status.Err != nil {
+		return nil
+	}
+	hs.status.RemoteStatic = hs.rs
+	if hs.cfg.Observer != nil {
+		if hs.status.Err = hs.cfg.Observer.OnPeerPublicKey(pattern.Token_s, hs.rs); hs.status.Err != nil {
+			return nil
+		}
+	}
+	return tail
+}
+
+func (hs *HandshakeState) onTokenDH(local dh.Keypair, remote dh.PublicKey) {
+	var sharedSecret []byte
+	if sharedSecret, hs.status.Err = local.DH(remote); hs.status.Err != nil {
+		return
+	}
+	hs.ss.mixKey(sharedSecret)
+	zero(sharedSecret)
+}
+
+func (hs *HandshakeState) onToken(v pattern.Token) {
+	switch v {
+	case pattern.Token_ee:
+		hs.onTokenDH(hs.e, hs.re)
+	case pattern.Token_es:
+		if hs.isInitiator {
+			hs.onTokenDH(hs.e, hs.rs)
+		} else {
+			hs.onTokenDH(hs.s, hs.re)
+		}
+	case pattern.Token_se:
+		if hs.isInitiator {
+			hs.onTokenDH(hs.s, hs.re)
+		} else {
+			hs.onTokenDH(hs.e, hs.rs)
+		}
+	case pattern.Token_ss:
+		hs.onTokenDH(hs.s, hs.rs)
+	case pattern.Token_psk:
+		// PSK is validated at handshake creation.
+		hs.ss.mixKeyAndHash(hs.cfg.PreSharedKeys[hs.pskIndex])
+		hs.pskIndex++
+	default:
+		hs.status.Err = errors.New("nyquist/disco/HandshakeState: invalid token: " + v.String())
+	}
+}
+
+func (hs *HandshakeState) onDone(dst []byte) ([]byte, error) {
+	hs.patternIndex++
+	if hs.patternIndex < len(hs.patterns) {
+		return dst, nil
+	}
+
+	hs.status.Err = nyquist.ErrDone
+	cs1, cs2 := hs.ss.split()
+	if hs.cfg.Protocol.Pattern.IsOneWay() {
+		cs2.Reset()
+		cs2 = nil
+	}
+	hs.status.CipherStates = []*CipherState{cs1, cs2}
+	hs.status.HandshakeHash = hs.ss.getHandshakeHash()
+
+	hs.Reset()
+
+	return dst, hs.status.Err
+}
+
+// WriteMessage processes a write step of the handshake protocol, appending the
+// handshake protocol message to dst, and returning the potentially new slice.
+//
+// Iff the handshake is complete, the error returned will be `nyquist.ErrDone`.
+func (hs *HandshakeState) WriteMessage(dst, payload []byte) ([]byte, error) {
+	if hs.status.Err != nil {
+		return nil, hs.status.Err
+	}
+
+	if hs.isInitiator != (hs.patternIndex&1 == 0) {
+		hs.status.Err = nyquist.ErrOutOfOrder
+		return nil, hs.status.Err
+	}
+
+	baseLen := len(dst)
+	for _, v := range hs.patterns[hs.patternIndex] {
+		switch v {
+		case pattern.Token_e:
+			dst = hs.onWriteTokenE(dst)
+		case pattern.Token_s:
+			dst = hs.onWriteTokenS(dst)
+		default:
+			hs.onToken(v)
+		}
+
+		if hs.status.Err != nil {
+			return nil, hs.status.Err
+		}
+	}
+
+	dst = hs.ss.encryptAndHash(dst, payload)
+	if hs.maxMessageSize > 0 && len(dst)-baseLen > hs.maxMessageSize {
+		hs.status.Err = nyquist.ErrMessageSize
+		return nil, hs.status.Err
+	}
+
+	return hs.onDone(dst)
+}
+
+// ReadMessage processes a read step of the handshake protocol, appending the
+// authentiated/decrypted message payload to dst, and returning the potentially
+// new slice.
+//
+// Iff the handshake is complete, the error returned will be `nyquist.ErrDone`.
+func (hs *HandshakeState) ReadMessage(dst, payload []byte) ([]byte, error) {
+	if hs.status.Err != nil {
+		return nil, hs.status.Err
+	}
+
+	if hs.maxMessageSize > 0 && len(payload) > hs.maxMessageSize {
+		hs.status.Err = nyquist.ErrMessageSize
+		return nil, hs.status.Err
+	}
+
+	if hs.isInitiator != (hs.patternIndex&1 != 0) {
+		hs.status.Err = nyquist.ErrOutOfOrder
+		return nil, hs.status.Err
+	}
+
+	for _, v := range hs.patterns[hs.patternIndex] {
+		switch v {
+		case pattern.Token_e:
+			payload = hs.onReadTokenE(payload)
+		case pattern.Token_s:
+			payload = hs.onReadTokenS(payload)
+		default:
+			hs.onToken(v)
+		}
+
+		if hs.status.Err != nil {
+			return nil, hs.status.Err
+		}
+	}
+
+	dst, hs.status.Err = hs.ss.decryptAndHash(dst, payload)
+	if hs.status.Err != nil {
+		return nil, hs.status.Err
+	}
+
+	return hs.onDone(dst)
+}
+
+func (hs *HandshakeState) handlePreMessages() error {
+	preMessages := hs.cfg.Protocol.Pattern.PreMessages()
+	if len(preMessages) == 0 {
+		return nil
+	}
+
+	// Gather all the public keys from the config, from the initiator's
+	// point of view.
+	var s, e, rs, re dh.PublicKey
+	rs, re = hs.rs, hs.re
+	if hs.s != nil {
+		s = hs.s.Public()
+	}
+	if hs.e != nil {
+		e = hs.e.Public()
+	}
+	if !hs.isInitiator {
+		s, e, rs, re = rs, re, s, e
+	}
+
+	for i, keys := range []struct {
+		s, e dh.PublicKey
+		side string
+	}{
+		{s, e, "initiator"},
+		{rs, re, "responder"},
+	} {
+		if i+1 > len(preMessages) {
+			break
+		}
+
+		for _, v := range preMessages[i] {
+			switch v {
+			case pattern.Token_e:
+				if keys.e == nil {
+					return errors.New("nyquist/disco/New: " + keys.side + " e not set")
+				}
+				hs.mixE(keys.e.Bytes())
+			case pattern.Token_s:
+				if keys.s == nil {
+					return errors.New("nyquist/disco/New: " + keys.side + " s not set")
+				}
+				hs.ss.mixHash(keys.s.Bytes())
+			default:
+				return errors.New("nyquist/disco/New: invalid pre-message token: " + v.String())
+			}
+		}
+	}
+
+	return nil
+}
+
+// NewHandshake constructs a new HandshakeState with the provided configuration.
+func NewHandshake(cfg *HandshakeConfig) (*HandshakeState, error) {
+	if cfg.Protocol.Pattern.NumPSKs() != len(cfg.PreSharedKeys) {
+		return nil, errMissingPSK
+	}
+	for _, v := range cfg.PreSharedKeys {
+		if len(v) != nyquist.PreSharedKeySize {
+			return nil, errBadPSK
+		}
+	}
+
+	maxMessageSize := cfg.getMaxMessageSize()
+	hs := &HandshakeState{
+		cfg:      cfg,
+		dh:       cfg.Protocol.DH,
+		patterns: cfg.Protocol.Pattern.Messages(),
+		ss:       newSymmetricState([]byte(cfg.Protocol.String()), maxMessageSize),
+		s:        cfg.LocalStatic,
+		e:        cfg.LocalEphemeral,
+		rs:       cfg.RemoteStatic,
+		re:       cfg.RemoteEphemeral,
+		status: &HandshakeStatus{
+			RemoteStatic:    cfg.RemoteStatic,
+			RemoteEphemeral: cfg.RemoteEphemeral,
+		},
+		maxMessageSize: maxMessageSize,
+		dhLen:          cfg.Protocol.DH.Size(),
+		isInitiator:    cfg.IsInitiator,
+	}
+	if cfg.LocalEphemeral != nil {
+		hs.status.LocalEphemeral = cfg.LocalEphemeral.Public()
+	}
+
+	hs.ss.mixHash(cfg.Prologue)
+	if err := hs.handlePreMessages(); err != nil {
+		return nil, err
+	}
+
+	return hs, nil
+}
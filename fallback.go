@@ -0,0 +1,93 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package nyquist
+
+import (
+	"errors"
+
+	"gitlab.com/yawning/nyquist.git/pattern"
+)
+
+var errFallbackState = errors.New("nyquist/HandshakeState/Fallback: initiator ephemeral key not available")
+
+// Fallback returns a new HandshakeState for a fallback protocol (eg:
+// `Noise_XXfallback_25519_ChaChaPoly_BLAKE2s`), re-initialized from a
+// handshake that has processed the initiator's first message, including
+// responder handshakes that failed to process it.
+//
+// As per the `fallback` modifier, the roles are reversed, with the
+// responder becoming the initiator of the fallback handshake, and the
+// original initiator's ephemeral key being used as a pre-message.  All
+// other configuration is retained, except for the remote static public
+// key (unless it is a pre-message of the fallback pattern), and the
+// pre-shared keys (if not required by the fallback pattern).
+//
+// The caller is still responsible for calling Reset on hs.
+func (hs *HandshakeState) Fallback(protocol *Protocol) (*HandshakeState, error) {
+	if hs.ss == nil || hs.status.Err == ErrDone {
+		return nil, ErrOutOfOrder
+	}
+
+	cfg := *hs.cfg
+	cfg.Protocol = protocol
+	cfg.IsInitiator = !hs.isInitiator
+	cfg.Tracer = nil
+	if hs.isInitiator {
+		if hs.e == nil || hs.patternIndex != 1 {
+			return nil, errFallbackState
+		}
+		cfg.LocalEphemeral, cfg.RemoteEphemeral = hs.e, nil
+	} else {
+		if hs.re == nil || hs.patternIndex > 1 {
+			return nil, errFallbackState
+		}
+		cfg.RemoteEphemeral = hs.re
+	}
+	if !pattern.RequiresRemoteStaticPreMessage(protocol.Pattern, cfg.IsInitiator) {
+		cfg.RemoteStatic = nil
+	}
+	if protocol.Pattern.NumPSKs() == 0 {
+		cfg.PreSharedKeys = nil
+	}
+
+	newHs, err := NewHandshake(&cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Transfer ownership of a generated ephemeral key, so that it is
+	// dropped by the new HandshakeState's Reset.
+	if hs.isInitiator && hs.e != hs.cfg.LocalEphemeral {
+		cfg.LocalEphemeral = nil
+		hs.e = nil
+	}
+
+	return newHs, nil
+}
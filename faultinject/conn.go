@@ -0,0 +1,185 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package faultinject
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+)
+
+// Action is the action taken on a frame by a FrameFilter.
+type Action int
+
+const (
+	// Pass passes the frame unmodified.
+	Pass Action = iota
+
+	// Corrupt flips a bit in the last byte of the frame body, which will
+	// cause authentication of a Noise message to fail.
+	Corrupt
+
+	// Drop silently discards the frame.
+	Drop
+)
+
+// FrameFilter decides the action taken on the n-th frame (numbered from 0)
+// sent in one direction of a connection.
+type FrameFilter func(n int, frame []byte) Action
+
+// CorruptFrames returns a FrameFilter that corrupts the specified frames.
+func CorruptFrames(frames ...int) FrameFilter {
+	return framesFilter(Corrupt, frames)
+}
+
+// DropFrames returns a FrameFilter that drops the specified frames.
+func DropFrames(frames ...int) FrameFilter {
+	return framesFilter(Drop, frames)
+}
+
+func framesFilter(action Action, frames []int) FrameFilter {
+	trigger := OnCall(frames...)
+	return func(n int, frame []byte) Action {
+		if trigger(n) {
+			return action
+		}
+		return Pass
+	}
+}
+
+type frameFilterer struct {
+	sync.Mutex
+
+	filter FrameFilter
+	buf    []byte
+	n      int
+}
+
+// process appends b to the buffered stream, and returns the filtered
+// complete frames.
+func (f *frameFilterer) process(b []byte) []byte {
+	f.Lock()
+	defer f.Unlock()
+
+	f.buf = append(f.buf, b...)
+
+	var out []byte
+	for len(f.buf) >= 2 {
+		frameLen := 2 + int(binary.BigEndian.Uint16(f.buf))
+		if len(f.buf) < frameLen {
+			break
+		}
+		frame := f.buf[:frameLen]
+
+		switch f.filter(f.n, frame[2:]) {
+		case Corrupt:
+			out = append(out, frame...)
+			if frameLen > 2 {
+				out[len(out)-1] ^= 0x01
+			}
+		case Drop:
+		default:
+			out = append(out, frame...)
+		}
+
+		f.n++
+		f.buf = f.buf[frameLen:]
+	}
+	if len(f.buf) == 0 {
+		f.buf = nil
+	}
+
+	return out
+}
+
+type conn struct {
+	net.Conn
+
+	write *frameFilterer
+	read  *frameFilterer
+
+	readMu  sync.Mutex
+	readBuf []byte
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	if c.write == nil {
+		return c.Conn.Write(p)
+	}
+
+	if b := c.write.process(p); len(b) > 0 {
+		if _, err := c.Conn.Write(b); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	if c.read == nil {
+		return c.Conn.Read(p)
+	}
+
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.readBuf) == 0 {
+		var tmp [4096]byte
+		n, err := c.Conn.Read(tmp[:])
+		c.readBuf = c.read.process(tmp[:n])
+		if err != nil && len(c.readBuf) == 0 {
+			return 0, err
+		}
+	}
+
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+// NewConn returns a connection that wraps conn, and applies write and read
+// to the frames sent and received respectively.  Either filter may be nil.
+//
+// Frames are assumed to be prefixed with a 16 bit big endian length, as
+// is the case for each message sent by the `transport` package, where each
+// handshake message consists of a negotiation data frame followed by a
+// Noise message frame.
+func NewConn(c net.Conn, write, read FrameFilter) net.Conn {
+	fc := &conn{
+		Conn: c,
+	}
+	if write != nil {
+		fc.write = &frameFilterer{filter: write}
+	}
+	if read != nil {
+		fc.read = &frameFilterer{filter: read}
+	}
+	return fc
+}
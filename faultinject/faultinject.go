@@ -0,0 +1,187 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package faultinject implements fault injection for testing applications'
+// handling of Noise-level failures.
+//
+// Faults are injected by wrapping the entropy source, DH algorithm, static
+// keypair, or underlying network connection used by a handshake or a
+// transport connection.  This package is intended for use in tests only.
+package faultinject // import "gitlab.com/yawning/nyquist.git/faultinject"
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+// ErrInjected is the error returned by injected failures.
+var ErrInjected = errors.New("nyquist/faultinject: injected fault")
+
+// Trigger decides if a fault should be injected into the n-th call
+// (numbered from 0) of a wrapped operation.
+type Trigger func(n int) bool
+
+// Always is a Trigger that injects a fault into every call.
+func Always(n int) bool {
+	return true
+}
+
+// OnCall returns a Trigger that injects a fault into the specified calls.
+func OnCall(calls ...int) Trigger {
+	return func(n int) bool {
+		for _, v := range calls {
+			if v == n {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// After returns a Trigger that injects a fault into every call after the
+// first n calls.
+func After(n int) Trigger {
+	return func(i int) bool {
+		return i >= n
+	}
+}
+
+type counter struct {
+	sync.Mutex
+
+	trigger Trigger
+	n       int
+}
+
+func (c *counter) fire() bool {
+	if c == nil || c.trigger == nil {
+		return false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	n := c.n
+	c.n++
+	return c.trigger(n)
+}
+
+func newCounter(trigger Trigger) *counter {
+	return &counter{trigger: trigger}
+}
+
+type reader struct {
+	r io.Reader
+	c *counter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.c.fire() {
+		return 0, ErrInjected
+	}
+	return r.r.Read(p)
+}
+
+// NewReader returns an entropy source that wraps r, and fails reads
+// selected by trigger.
+func NewReader(r io.Reader, trigger Trigger) io.Reader {
+	return &reader{
+		r: r,
+		c: newCounter(trigger),
+	}
+}
+
+type dhImpl struct {
+	dh.DH
+
+	generate *counter
+	calc     *counter
+}
+
+func (impl *dhImpl) GenerateKeypair(rng io.Reader) (dh.Keypair, error) {
+	if impl.generate.fire() {
+		return nil, ErrInjected
+	}
+	kp, err := impl.DH.GenerateKeypair(rng)
+	if err != nil {
+		return nil, err
+	}
+	return &keypair{Keypair: kp, c: impl.calc}, nil
+}
+
+func (impl *dhImpl) ParsePrivateKey(data []byte) (dh.Keypair, error) {
+	kp, err := impl.DH.ParsePrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	return &keypair{Keypair: kp, c: impl.calc}, nil
+}
+
+// NewDH returns a DH algorithm that wraps impl, and fails keypair generation
+// selected by generate, and DH calculations (across all keypairs generated
+// or parsed by the returned DH) selected by calc.  Either trigger may be
+// nil.
+//
+// The returned DH may be used in a nyquist.Protocol to inject failures into
+// a handshake's ephemeral key operations.
+func NewDH(impl dh.DH, generate, calc Trigger) dh.DH {
+	return &dhImpl{
+		DH:       impl,
+		generate: newCounter(generate),
+		calc:     newCounter(calc),
+	}
+}
+
+type keypair struct {
+	dh.Keypair
+
+	c *counter
+}
+
+func (kp *keypair) DH(publicKey dh.PublicKey) ([]byte, error) {
+	if kp.c.fire() {
+		return nil, ErrInjected
+	}
+	return kp.Keypair.DH(publicKey)
+}
+
+// NewKeypair returns a keypair that wraps kp, and fails DH calculations
+// selected by trigger.
+//
+// The returned keypair may be used as a static keypair to inject failures
+// into a handshake's static key operations.
+func NewKeypair(kp dh.Keypair, trigger Trigger) dh.Keypair {
+	return &keypair{
+		Keypair: kp,
+		c:       newCounter(trigger),
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package faultinject
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/cipher"
+	"gitlab.com/yawning/nyquist.git/dh"
+	"gitlab.com/yawning/nyquist.git/hash"
+	"gitlab.com/yawning/nyquist.git/pattern"
+	"gitlab.com/yawning/nyquist.git/transport"
+)
+
+func TestFaultInject(t *testing.T) {
+	t.Run("Triggers", testFaultInjectTriggers)
+	t.Run("Reader", testFaultInjectReader)
+	t.Run("DH", testFaultInjectDH)
+	t.Run("Keypair", testFaultInjectKeypair)
+	t.Run("Conn", testFaultInjectConn)
+}
+
+func testFaultInjectTriggers(t *testing.T) {
+	require := require.New(t)
+
+	onCall := OnCall(1, 3)
+	after := After(2)
+	for i, v := range []struct {
+		onCall, after bool
+	}{
+		{false, false},
+		{true, false},
+		{false, true},
+		{true, true},
+	} {
+		require.Equal(v.onCall, onCall(i), "OnCall(%d)", i)
+		require.Equal(v.after, after(i), "After(%d)", i)
+		require.True(Always(i), "Always(%d)", i)
+	}
+}
+
+func testFaultInjectReader(t *testing.T) {
+	require := require.New(t)
+
+	protocol, err := nyquist.NewProtocol("Noise_NN_25519_ChaChaPoly_BLAKE2s")
+	require.NoError(err, "NewProtocol")
+
+	hs, err := nyquist.NewHandshake(&nyquist.HandshakeConfig{
+		Protocol:    protocol,
+		Rng:         NewReader(rand.Reader, Always),
+		IsInitiator: true,
+	})
+	require.NoError(err, "NewHandshake")
+	defer hs.Reset()
+
+	_, err = hs.WriteMessage(nil, nil)
+	require.True(errors.Is(err, ErrInjected), "WriteMessage: %v", err)
+}
+
+func testFaultInjectDH(t *testing.T) {
+	for _, v := range []struct {
+		name             string
+		generate, calc   Trigger
+		initiatorFailure bool
+	}{
+		{"Generate", Always, nil, true},
+		{"Calc", nil, Always, false},
+	} {
+		t.Run(v.name, func(t *testing.T) {
+			require := require.New(t)
+
+			protocol := &nyquist.Protocol{
+				Pattern: pattern.NN,
+				DH:      NewDH(dh.X25519, v.generate, v.calc),
+				Cipher:  cipher.ChaChaPoly,
+				Hash:    hash.BLAKE2s,
+			}
+
+			initiator, err := nyquist.NewHandshake(&nyquist.HandshakeConfig{
+				Protocol:    protocol,
+				IsInitiator: true,
+			})
+			require.NoError(err, "NewHandshake(initiator)")
+			defer initiator.Reset()
+
+			msg, err := initiator.WriteMessage(nil, nil)
+			if v.initiatorFailure {
+				require.True(errors.Is(err, ErrInjected), "initiator.WriteMessage: %v", err)
+				return
+			}
+			require.NoError(err, "initiator.WriteMessage")
+
+			responder, err := nyquist.NewHandshake(&nyquist.HandshakeConfig{
+				Protocol: protocol,
+			})
+			require.NoError(err, "NewHandshake(responder)")
+			defer responder.Reset()
+
+			_, err = responder.ReadMessage(nil, msg)
+			require.NoError(err, "responder.ReadMessage")
+			_, err = responder.WriteMessage(nil, nil)
+			require.True(errors.Is(err, ErrInjected), "responder.WriteMessage: %v", err)
+		})
+	}
+}
+
+func testFaultInjectKeypair(t *testing.T) {
+	require := require.New(t)
+
+	protocol, err := nyquist.NewProtocol("Noise_NK_25519_ChaChaPoly_BLAKE2s")
+	require.NoError(err, "NewProtocol")
+
+	responderStatic, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(err, "GenerateKeypair")
+
+	initiator, err := nyquist.NewHandshake(&nyquist.HandshakeConfig{
+		Protocol:     protocol,
+		RemoteStatic: responderStatic.Public(),
+		IsInitiator:  true,
+	})
+	require.NoError(err, "NewHandshake(initiator)")
+	defer initiator.Reset()
+
+	responder, err := nyquist.NewHandshake(&nyquist.HandshakeConfig{
+		Protocol:    protocol,
+		LocalStatic: NewKeypair(responderStatic, OnCall(0)),
+	})
+	require.NoError(err, "NewHandshake(responder)")
+	defer responder.Reset()
+
+	msg, err := initiator.WriteMessage(nil, nil)
+	require.NoError(err, "initiator.WriteMessage")
+	_, err = responder.ReadMessage(nil, msg)
+	require.True(errors.Is(err, ErrInjected), "responder.ReadMessage: %v", err)
+}
+
+func testFaultInjectConn(t *testing.T) {
+	protocol, err := nyquist.NewProtocol("Noise_NN_25519_ChaChaPoly_BLAKE2s")
+	require.NoError(t, err, "NewProtocol")
+	cfg := &transport.Config{
+		Protocol: protocol,
+	}
+
+	newConnPair := func(write FrameFilter) (*transport.Conn, *transport.Conn, error) {
+		// A TCP connection is used instead of net.Pipe, as the authenticated
+		// close record would otherwise block on the unread peer.
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, nil, err
+		}
+		defer l.Close()
+		clientRaw, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return nil, nil, err
+		}
+		serverRaw, err := l.Accept()
+		if err != nil {
+			clientRaw.Close()
+			return nil, nil, err
+		}
+
+		errCh := make(chan error, 1)
+		connCh := make(chan *transport.Conn, 1)
+		go func() {
+			conn, err := transport.Server(serverRaw, cfg)
+			if err != nil {
+				serverRaw.Close()
+			}
+			errCh <- err
+			connCh <- conn
+		}()
+
+		client, err := transport.Client(NewConn(clientRaw, write, nil), cfg)
+		if err != nil {
+			clientRaw.Close()
+		}
+		if serverErr := <-errCh; serverErr != nil {
+			return nil, nil, serverErr
+		}
+		return client, <-connCh, err
+	}
+
+	t.Run("CorruptHandshake", func(t *testing.T) {
+		// Frame 0 is the negotiation data, and frame 1 is the client's
+		// ephemeral key, both of which are bound into the handshake.
+		for _, frame := range []int{0, 1} {
+			_, _, err := newConnPair(CorruptFrames(frame))
+			require.Error(t, err, "corrupted frame %d", frame)
+		}
+	})
+
+	t.Run("DropRecord", func(t *testing.T) {
+		require := require.New(t)
+
+		// Frames 0 and 1 are the client's handshake message, so frame 2
+		// is the first transport record.
+		client, server, err := newConnPair(DropFrames(2))
+		require.NoError(err, "handshake")
+		defer client.Close()
+		defer server.Close()
+
+		go func() {
+			_, _ = client.Write([]byte("dropped"))
+			_, _ = client.Write([]byte("received"))
+		}()
+
+		_, err = io.ReadFull(server, make([]byte, len("received")))
+		require.True(errors.Is(err, nyquist.ErrOpen), "server.Read: %v", err)
+	})
+}
@@ -0,0 +1,310 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package filecrypt implements file (stream) encryption to a recipient's
+// static public key, using a one-way handshake pattern (N, K, X), followed
+// by chunked transport encryption.
+//
+// The encrypted format is the following:
+//
+//	magic           [16]byte "nyquist-fcrypt1\x00"
+//	protocol_len    uint8
+//	protocol_name   [protocol_len]byte
+//	message_len     uint16 (big endian)
+//	message         [message_len]byte (one-way handshake message)
+//	chunks...
+//
+// The chunks are encrypted with the stream package.  The cleartext header
+// is used as the handshake prologue.
+//
+// If Config.Segmented is set, the magic is "nyquist-fcrypt2\x00", and the
+// chunks are encrypted with the stream package's parallel segmented mode,
+// with the segment master key derived from the handshake's Additional
+// Symmetric Keys master key.
+package filecrypt // import "gitlab.com/yawning/nyquist.git/filecrypt"
+
+import (
+	"errors"
+	"io"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/dh"
+	"gitlab.com/yawning/nyquist.git/stream"
+)
+
+// ChunkSize is the maximum size of each plaintext chunk.
+const ChunkSize = stream.DefaultChunkSize
+
+var (
+	// ErrTruncated is the error returned when the encrypted stream is
+	// truncated.
+	ErrTruncated = stream.ErrTruncated
+
+	// ErrTrailingData is the error returned when there is data following
+	// the final chunk.
+	ErrTrailingData = stream.ErrTrailingData
+
+	// ErrMalformedHeader is the error returned when the header is malformed.
+	ErrMalformedHeader = errors.New("nyquist/filecrypt: malformed header")
+
+	// ErrProtocolMismatch is the error returned when the protocol in the
+	// header is not the expected one.
+	ErrProtocolMismatch = errors.New("nyquist/filecrypt: protocol mismatch")
+
+	errNotOneWay   = errors.New("nyquist/filecrypt: protocol pattern is not one-way")
+	errNoRecipient = errors.New("nyquist/filecrypt: no recipient key")
+
+	magic          = []byte("nyquist-fcrypt1\x00")
+	magicSegmented = []byte("nyquist-fcrypt2\x00")
+
+	segmentASKLabel = []byte("nyquist/filecrypt: segments")
+)
+
+// Config is a file encryption/decryption configuration.
+type Config struct {
+	// Protocol is the protocol to use when encrypting.  When decrypting,
+	// if set, the protocol in the header must match.  The pattern must
+	// be one-way.
+	Protocol *nyquist.Protocol
+
+	// LocalStatic is the local static keypair.  When encrypting, this is
+	// the sender's keypair (K, X), when decrypting, this is the
+	// recipient's keypair.
+	LocalStatic dh.Keypair
+
+	// RemoteStatic is the remote static public key.  When encrypting, this
+	// is the recipient's public key, when decrypting, this is the
+	// sender's public key (K).
+	RemoteStatic dh.PublicKey
+
+	// PreSharedKeys is the vector of pre-shared keys for PSK mode
+	// protocols.
+	PreSharedKeys [][]byte
+
+	// Rng is the entropy source to be used when encrypting.  If the value
+	// is `nil`, `crypto/rand.Reader` will be used.
+	Rng io.Reader
+
+	// Segmented enables the parallel segmented format when encrypting.
+	// When decrypting, the format is determined by the header.
+	Segmented bool
+
+	// Parallelism is the maximum number of segments processed at once
+	// when using the segmented format.  If the value is `0`,
+	// `runtime.GOMAXPROCS(0)` will be used.
+	Parallelism int
+}
+
+func makePrologue(magic []byte, protocolName string) []byte {
+	b := make([]byte, 0, len(magic)+1+len(protocolName))
+	b = append(b, magic...)
+	b = append(b, byte(len(protocolName)))
+	return append(b, protocolName...)
+}
+
+func newParallelConfig(cfg *Config, protocol *nyquist.Protocol, status *nyquist.HandshakeStatus) *stream.ParallelConfig {
+	key := nyquist.DeriveASK(protocol.Hash, status.ASKMaster, segmentASKLabel)
+	for i := range status.ASKMaster {
+		status.ASKMaster[i] = 0
+	}
+	status.CipherStates[0].Reset()
+
+	return &stream.ParallelConfig{
+		Protocol:    protocol,
+		Key:         key,
+		ChunkSize:   ChunkSize,
+		Parallelism: cfg.Parallelism,
+	}
+}
+
+func zeroKey(pCfg *stream.ParallelConfig) {
+	for i := range pCfg.Key {
+		pCfg.Key[i] = 0
+	}
+}
+
+// Writer is an encrypting io.WriteCloser.
+type Writer struct {
+	io.WriteCloser
+}
+
+// NewWriter writes the header to w, and returns a Writer that will encrypt
+// data to the recipient.  The caller must call Close to finalize the
+// encrypted stream.
+func NewWriter(w io.Writer, cfg *Config) (*Writer, error) {
+	if cfg.Protocol == nil || !cfg.Protocol.Pattern.IsOneWay() {
+		return nil, errNotOneWay
+	}
+	if cfg.RemoteStatic == nil {
+		return nil, errNoRecipient
+	}
+
+	protocolName := cfg.Protocol.String()
+	if len(protocolName) > 0xff {
+		return nil, ErrMalformedHeader
+	}
+	hdrMagic := magic
+	if cfg.Segmented {
+		hdrMagic = magicSegmented
+	}
+	prologue := makePrologue(hdrMagic, protocolName)
+
+	hs, err := nyquist.NewHandshake(&nyquist.HandshakeConfig{
+		Protocol:      cfg.Protocol,
+		Prologue:      prologue,
+		LocalStatic:   cfg.LocalStatic,
+		RemoteStatic:  cfg.RemoteStatic,
+		PreSharedKeys: cfg.PreSharedKeys,
+		Rng:           cfg.Rng,
+		EnableASK:     cfg.Segmented,
+		IsInitiator:   true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer hs.Reset()
+
+	msg, err := hs.WriteMessage(nil, nil)
+	if err != nyquist.ErrDone {
+		return nil, err
+	}
+
+	if _, err = w.Write(prologue); err != nil {
+		return nil, err
+	}
+	if err = stream.WriteFrame(w, msg); err != nil {
+		return nil, err
+	}
+
+	if cfg.Segmented {
+		pCfg := newParallelConfig(cfg, cfg.Protocol, hs.GetStatus())
+		defer zeroKey(pCfg)
+		pw, err := stream.NewParallelWriter(w, pCfg)
+		if err != nil {
+			return nil, err
+		}
+		return &Writer{pw}, nil
+	}
+
+	return &Writer{
+		WriteCloser: stream.NewWriter(w, hs.GetStatus().CipherStates[0]),
+	}, nil
+}
+
+// Reader is a decrypting io.Reader.
+type Reader struct {
+	io.Reader
+
+	status *nyquist.HandshakeStatus
+}
+
+// HandshakeStatus returns the status of the handshake, including the
+// sender's static public key if any.
+func (r *Reader) HandshakeStatus() *nyquist.HandshakeStatus {
+	return r.status
+}
+
+// NewReader reads the header from r, and returns a Reader that will
+// decrypt data from r.
+func NewReader(r io.Reader, cfg *Config) (*Reader, error) {
+	hdr := make([]byte, len(magic)+1)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, ErrMalformedHeader
+	}
+	hdrMagic, isSegmented := magic, false
+	switch string(hdr[:len(magic)]) {
+	case string(magic):
+	case string(magicSegmented):
+		hdrMagic, isSegmented = magicSegmented, true
+	default:
+		return nil, ErrMalformedHeader
+	}
+	rawName := make([]byte, hdr[len(magic)])
+	if _, err := io.ReadFull(r, rawName); err != nil {
+		return nil, ErrMalformedHeader
+	}
+	protocolName := string(rawName)
+
+	protocol := cfg.Protocol
+	switch protocol {
+	case nil:
+		var err error
+		if protocol, err = nyquist.NewProtocol(protocolName); err != nil {
+			return nil, err
+		}
+	default:
+		if protocol.String() != protocolName {
+			return nil, ErrProtocolMismatch
+		}
+	}
+	if !protocol.Pattern.IsOneWay() {
+		return nil, errNotOneWay
+	}
+
+	msg, err := stream.ReadFrame(r)
+	if err != nil {
+		return nil, ErrMalformedHeader
+	}
+
+	hs, err := nyquist.NewHandshake(&nyquist.HandshakeConfig{
+		Protocol:      protocol,
+		Prologue:      makePrologue(hdrMagic, protocolName),
+		LocalStatic:   cfg.LocalStatic,
+		RemoteStatic:  cfg.RemoteStatic,
+		PreSharedKeys: cfg.PreSharedKeys,
+		EnableASK:     isSegmented,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer hs.Reset()
+
+	if _, err = hs.ReadMessage(nil, msg); err != nyquist.ErrDone {
+		return nil, err
+	}
+	status := hs.GetStatus()
+
+	if isSegmented {
+		pCfg := newParallelConfig(cfg, protocol, status)
+		defer zeroKey(pCfg)
+		pr, err := stream.NewParallelReader(r, pCfg)
+		if err != nil {
+			return nil, err
+		}
+		return &Reader{
+			Reader: pr,
+			status: status,
+		}, nil
+	}
+
+	return &Reader{
+		Reader: stream.NewReader(r, status.CipherStates[0]),
+		status: status,
+	}, nil
+}
@@ -0,0 +1,198 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package filecrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+func encryptForTest(t *testing.T, cfg *Config, plaintext []byte) []byte {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, cfg)
+	require.NoError(t, err, "NewWriter")
+	_, err = w.Write(plaintext)
+	require.NoError(t, err, "Write")
+	require.NoError(t, w.Close(), "Close")
+	return buf.Bytes()
+}
+
+func TestFilecrypt(t *testing.T) {
+	recipient, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(t, err, "GenerateKeypair - recipient")
+	sender, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(t, err, "GenerateKeypair - sender")
+
+	psk := make([]byte, 32)
+	_, _ = rand.Read(psk)
+
+	for _, v := range []struct {
+		protocol string
+		sender   bool
+		psk      bool
+	}{
+		{"Noise_N_25519_ChaChaPoly_BLAKE2s", false, false},
+		{"Noise_K_25519_AESGCM_SHA256", true, false},
+		{"Noise_X_25519_ChaChaPoly_BLAKE2b", true, false},
+		{"Noise_Npsk0_25519_ChaChaPoly_SHA512", false, true},
+	} {
+		t.Run(v.protocol, func(t *testing.T) {
+			require := require.New(t)
+
+			protocol, err := nyquist.NewProtocol(v.protocol)
+			require.NoError(err, "NewProtocol")
+
+			encCfg := &Config{
+				Protocol:     protocol,
+				RemoteStatic: recipient.Public(),
+			}
+			decCfg := &Config{
+				LocalStatic: recipient,
+			}
+			if v.sender {
+				encCfg.LocalStatic = sender
+				if protocol.Pattern.String() == "K" {
+					decCfg.RemoteStatic = sender.Public()
+				}
+			}
+			if v.psk {
+				encCfg.PreSharedKeys = [][]byte{psk}
+				decCfg.PreSharedKeys = [][]byte{psk}
+			}
+
+			for _, segmented := range []bool{false, true} {
+				encCfg.Segmented = segmented
+				for _, sz := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3 * ChunkSize, 3*ChunkSize + 17} {
+					plaintext := make([]byte, sz)
+					_, _ = rand.Read(plaintext)
+
+					ciphertext := encryptForTest(t, encCfg, plaintext)
+
+					r, err := NewReader(bytes.NewReader(ciphertext), decCfg)
+					require.NoError(err, "NewReader(%d, %v)", sz, segmented)
+					decrypted, err := ioutil.ReadAll(r)
+					require.NoError(err, "ReadAll(%d, %v)", sz, segmented)
+					require.Equal(plaintext, decrypted, "round trip(%d, %v)", sz, segmented)
+
+					if v.sender {
+						require.Equal(sender.Public().Bytes(), r.HandshakeStatus().RemoteStatic.Bytes(), "RemoteStatic")
+					}
+				}
+			}
+		})
+	}
+
+	t.Run("Tampering", func(t *testing.T) {
+		protocol, err := nyquist.NewProtocol("Noise_N_25519_ChaChaPoly_BLAKE2s")
+		require.NoError(t, err, "NewProtocol")
+		encCfg := &Config{
+			Protocol:     protocol,
+			RemoteStatic: recipient.Public(),
+		}
+		decCfg := &Config{
+			LocalStatic: recipient,
+		}
+
+		plaintext := make([]byte, 2*ChunkSize+100)
+		ciphertext := encryptForTest(t, encCfg, plaintext)
+		hdrLen := len(makePrologue(magic, protocol.String())) + 2 + 32
+		chunkLen := 2 + ChunkSize + 16
+
+		decrypt := func(b []byte) error {
+			r, err := NewReader(bytes.NewReader(b), decCfg)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(ioutil.Discard, r)
+			return err
+		}
+
+		require := require.New(t)
+		require.NoError(decrypt(ciphertext), "decrypt - untampered")
+
+		// Truncated at a chunk boundary.
+		err = decrypt(ciphertext[:hdrLen+chunkLen])
+		require.Equal(ErrTruncated, err, "decrypt - truncated at chunk")
+
+		// Truncated mid-chunk.
+		err = decrypt(ciphertext[:len(ciphertext)-1])
+		require.Equal(ErrTruncated, err, "decrypt - truncated mid-chunk")
+
+		// Trailing data.
+		err = decrypt(append(append([]byte{}, ciphertext...), 0x00))
+		require.Equal(ErrTrailingData, err, "decrypt - trailing data")
+
+		// Chunk corruption.
+		corrupted := append([]byte{}, ciphertext...)
+		corrupted[hdrLen+chunkLen+10] ^= 0x01
+		err = decrypt(corrupted)
+		require.Equal(nyquist.ErrOpen, err, "decrypt - corrupted chunk")
+
+		// Header corruption.
+		corrupted = append([]byte{}, ciphertext...)
+		corrupted[0] ^= 0x01
+		err = decrypt(corrupted)
+		require.Equal(ErrMalformedHeader, err, "decrypt - corrupted magic")
+
+		// Protocol mismatch.
+		otherProtocol, err := nyquist.NewProtocol("Noise_N_25519_AESGCM_BLAKE2s")
+		require.NoError(err, "NewProtocol - other")
+		_, err = NewReader(bytes.NewReader(ciphertext), &Config{
+			Protocol:    otherProtocol,
+			LocalStatic: recipient,
+		})
+		require.Equal(ErrProtocolMismatch, err, "NewReader - protocol mismatch")
+
+		// Wrong recipient.
+		other, err := dh.X25519.GenerateKeypair(rand.Reader)
+		require.NoError(err, "GenerateKeypair - other")
+		_, err = NewReader(bytes.NewReader(ciphertext), &Config{
+			LocalStatic: other,
+		})
+		require.Error(err, "NewReader - wrong recipient")
+
+		// Non one-way pattern.
+		xx, err := nyquist.NewProtocol("Noise_XX_25519_ChaChaPoly_BLAKE2s")
+		require.NoError(err, "NewProtocol - XX")
+		_, err = NewWriter(ioutil.Discard, &Config{
+			Protocol:     xx,
+			RemoteStatic: recipient.Public(),
+		})
+		require.Equal(errNotOneWay, err, "NewWriter - XX")
+	})
+}
@@ -4,9 +4,9 @@ go 1.16
 
 require (
 	github.com/oasislabs/deoxysii v0.0.0-20190807103041-6159f99c2236
-	github.com/oasisprotocol/curve25519-voi v0.0.0-20210831082354-38e59a871ca9
+	github.com/oasisprotocol/curve25519-voi v0.0.0-20230904125328-1f23a7beb09a
 	github.com/stretchr/testify v1.7.0
 	gitlab.com/yawning/bsaes.git v0.0.0-20190805113838-0a714cd429ec
 	gitlab.com/yawning/x448.git v0.0.0-20190810030840-dcc677c7bddf
-	golang.org/x/crypto v0.0.0-20210813211128-0a44fdfbc16e
+	golang.org/x/crypto v0.0.0-20220321153916-2c7772ba3064
 )
@@ -31,9 +31,10 @@ package nyquist
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
 	"errors"
-	"fmt"
 	"io"
+	"strconv"
 	"strings"
 
 	"gitlab.com/yawning/nyquist.git/cipher"
@@ -54,14 +55,46 @@ const (
 )
 
 var (
-	errTruncatedE = errors.New("nyquist/HandshakeState/ReadMessage/e: truncated message")
-	errTruncatedS = errors.New("nyquist/HandshakeState/ReadMessage/s: truncated message")
+	errTruncatedE = newMalformedError(errors.New("nyquist/HandshakeState/ReadMessage/e: truncated message"))
+	errTruncatedS = newMalformedError(errors.New("nyquist/HandshakeState/ReadMessage/s: truncated message"))
 	errMissingS   = errors.New("nyquist/HandshakeState/WriteMessage/s: s not set")
 
 	errMissingPSK = errors.New("nyquist/New: missing or excessive PreSharedKey(s)")
 	errBadPSK     = errors.New("nyquist/New: malformed PreSharedKey(s)")
 )
 
+// HandshakeError is the error returned by ReadMessage when processing a
+// handshake message fails, annotated with where the failure occurred.
+type HandshakeError struct {
+	// MessageIndex is the index of the message in the handshake pattern.
+	MessageIndex int
+
+	// Token is the token being processed, or `pattern.Token_invalid` if
+	// the failure occurred while processing the payload.
+	Token pattern.Token
+
+	// Err is the underlying error.
+	Err error
+}
+
+// Error returns the string representation of the error.
+func (e *HandshakeError) Error() string {
+	what := "payload"
+	if e.Token != pattern.Token_invalid {
+		what = "token " + e.Token.String()
+	}
+	msg := "nyquist/HandshakeState/ReadMessage: message " + strconv.Itoa(e.MessageIndex) + ", " + what
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the underlying error.
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
 // Protocol is a the protocol to be used with a handshake.
 type Protocol struct {
 	Pattern pattern.Pattern
@@ -141,17 +174,44 @@ type HandshakeConfig struct {
 	// RemoteEphemeral is the remote ephemeral public key, if any (`re`).
 	RemoteEphemeral dh.PublicKey
 
+	// ExpectedRemoteStatics is the optional set of acceptable remote static
+	// public keys.  If set, the handshake will fail with
+	// ErrUnexpectedRemoteStatic as soon as a remote static public key that
+	// is not in the set is received, before any further processing.
+	ExpectedRemoteStatics []dh.PublicKey
+
 	// PreSharedKeys is the vector of pre-shared symmetric key for PSK mode
 	// handshakes.
 	PreSharedKeys [][]byte
 
+	// PreSharedKeyFunc is the optional callback used to obtain the
+	// pre-shared keys lazily, when PreSharedKeys is empty.  It is called
+	// when each `psk` token is processed, with the index of the PSK and the
+	// remote static public key (nil if not yet known), allowing the PSK to
+	// be selected based on the peer's identity (eg: `IKpsk2` responders).
+	PreSharedKeyFunc func(index int, remoteStatic dh.PublicKey) ([]byte, error)
+
 	// Observer is the optional handshake observer.
 	Observer HandshakeObserver
 
+	// Tracer is the optional handshake tracer.  It is not inherited by
+	// fallback handshakes.
+	Tracer HandshakeTracer
+
 	// Rng is the entropy source to be used when generating new DH key pairs.
 	// If the value is `nil`, `crypto/rand.Reader` will be used.
 	Rng io.Reader
 
+	// HedgeEphemeral derives the ephemeral private key by hashing the
+	// output of Rng together with a counter, the local static private key
+	// (if any), and the handshake hash, so that a catastrophically bad Rng
+	// does not immediately result in a predictable ephemeral key.
+	//
+	// Note: The hedge only helps if the local static private key is secret,
+	// or the handshake hash includes unpredictable input (eg: the remote
+	// ephemeral public key).
+	HedgeEphemeral bool
+
 	// MaxMessageSize specifies the maximum Noise message size the handshake
 	// and session will process or generate.  If the value is `0`,
 	// `DefaultMaxMessageSize` will be used.  A negative value will disable
@@ -161,6 +221,36 @@ type HandshakeConfig struct {
 	// to the protocol.
 	MaxMessageSize int
 
+	// StaticDHCache is the optional cache of static-static DH results,
+	// shared across handshakes.
+	StaticDHCache *StaticDHCache
+
+	// EnableASK enables the derivation of the Additional Symmetric Keys
+	// master key (`ask_master`) on handshake completion.
+	//
+	// Warning: This is a non-standard extension to the protocol.
+	EnableASK bool
+
+	// ExportTrafficKeys enables exporting the raw traffic keys (`k1`, `k2`)
+	// on handshake completion.
+	//
+	// Warning: This allows anyone with access to the keys to decrypt the
+	// session, and is only intended for key escrow.
+	ExportTrafficKeys bool
+
+	// ExportChainingKey enables exporting the final chaining key (`ck`)
+	// on handshake completion, for protocols that derive additional keys
+	// from it (eg: NTCP2).
+	//
+	// Warning: This is a non-standard extension to the protocol.
+	ExportChainingKey bool
+
+	// PayloadCodec is the optional codec for structured handshake
+	// payloads.  If set, payloads exceeding the codec's size limit are
+	// rejected, and received payloads are validated by the codec before
+	// being returned.
+	PayloadCodec PayloadCodec
+
 	// IsInitiator should be set to true if this handshake is in the
 	// initiator role.
 	IsInitiator bool
@@ -195,6 +285,21 @@ type HandshakeStatus struct {
 	// HandshakeHash is the handshake hash (`h`).  This field is only set
 	// once the handshake is completed.
 	HandshakeHash []byte
+
+	// ASKMaster is the Additional Symmetric Keys master key (`ask_master`).
+	// This field is only set once the handshake is completed, iff
+	// `HandshakeConfig.EnableASK` is set.
+	ASKMaster []byte
+
+	// TrafficKeys are the raw traffic keys of CipherStates (`k1`, `k2`).
+	// This field is only set once the handshake is completed, iff
+	// `HandshakeConfig.ExportTrafficKeys` is set.
+	TrafficKeys [][]byte
+
+	// ChainingKey is the final chaining key (`ck`).  This field is only
+	// set once the handshake is completed, iff
+	// `HandshakeConfig.ExportChainingKey` is set.
+	ChainingKey []byte
 }
 
 // HandshakeObserver is a handshake observer for monitoring handshake status.
@@ -207,6 +312,17 @@ type HandshakeObserver interface {
 	OnPeerPublicKey(pattern.Token, dh.PublicKey) error
 }
 
+// HandshakeTracer is a handshake tracer for recording concrete handshake
+// executions (eg: to cross-check them against a formal model).
+type HandshakeTracer interface {
+	// OnMessage will be called after each handshake message is written or
+	// read successfully, with the message index, the payload, the message,
+	// and the handshake hash (`h`) after processing the message.
+	//
+	// Warning: The arguments must not be retained or altered.
+	OnMessage(idx int, isWrite bool, payload, message, handshakeHash []byte)
+}
+
 func (cfg *HandshakeConfig) getRng() io.Reader {
 	if cfg.Rng == nil {
 		return rand.Reader
@@ -214,6 +330,19 @@ func (cfg *HandshakeConfig) getRng() io.Reader {
 	return cfg.Rng
 }
 
+func (cfg *HandshakeConfig) isExpectedRemoteStatic(rs dh.PublicKey) bool {
+	if len(cfg.ExpectedRemoteStatics) == 0 {
+		return true
+	}
+
+	rsBytes := rs.Bytes()
+	var ok int
+	for _, v := range cfg.ExpectedRemoteStatics {
+		ok |= subtle.ConstantTimeCompare(rsBytes, v.Bytes())
+	}
+	return ok == 1
+}
+
 func (cfg *HandshakeConfig) getMaxMessageSize() int {
 	if cfg.MaxMessageSize > 0 {
 		return cfg.MaxMessageSize
@@ -283,7 +412,13 @@ func (hs *HandshakeState) onWriteTokenE(dst []byte) []byte {
 	// hs.cfg.LocalEphemeral can be used to pre-generate the ephemeral key,
 	// so only generate when required.
 	if hs.e == nil {
-		if hs.e, hs.status.Err = hs.dh.GenerateKeypair(hs.cfg.getRng()); hs.status.Err != nil {
+		rng := hs.cfg.getRng()
+		if hs.cfg.HedgeEphemeral {
+			if rng, hs.status.Err = hs.hedgedRng(); hs.status.Err != nil {
+				return nil
+			}
+		}
+		if hs.e, hs.status.Err = hs.dh.GenerateKeypair(rng); hs.status.Err != nil {
 			return nil
 		}
 	}
@@ -303,6 +438,7 @@ func (hs *HandshakeState) onReadTokenE(payload []byte) []byte {
 	}
 	eBytes, tail := payload[:hs.dhLen], payload[hs.dhLen:]
 	if hs.re, hs.status.Err = hs.dh.ParsePublicKey(eBytes); hs.status.Err != nil {
+		hs.status.Err = newMalformedError(hs.status.Err)
 		return nil
 	}
 	hs.status.RemoteEphemeral = hs.re
@@ -346,6 +482,12 @@ func (hs *HandshakeState) onReadTokenS(payload []byte) []byte {
 		return nil
 	}
 	if hs.rs, hs.status.Err = hs.dh.ParsePublicKey(sBytes); hs.status.Err != nil {
+		hs.status.Err = newMalformedError(hs.status.Err)
+		return nil
+	}
+	if !hs.cfg.isExpectedRemoteStatic(hs.rs) {
+		hs.rs = nil
+		hs.status.Err = ErrUnexpectedRemoteStatic
 		return nil
 	}
 	hs.status.RemoteStatic = hs.rs
@@ -363,6 +505,7 @@ func (hs *HandshakeState) onTokenEE() {
 		return
 	}
 	hs.ss.MixKey(eeBytes)
+	zero(eeBytes)
 }
 
 func (hs *HandshakeState) onTokenES() {
@@ -376,6 +519,7 @@ func (hs *HandshakeState) onTokenES() {
 		return
 	}
 	hs.ss.MixKey(esBytes)
+	zero(esBytes)
 }
 
 func (hs *HandshakeState) onTokenSE() {
@@ -389,19 +533,38 @@ func (hs *HandshakeState) onTokenSE() {
 		return
 	}
 	hs.ss.MixKey(seBytes)
+	zero(seBytes)
 }
 
 func (hs *HandshakeState) onTokenSS() {
 	var ssBytes []byte
-	if ssBytes, hs.status.Err = hs.s.DH(hs.rs); hs.status.Err != nil {
+	if c := hs.cfg.StaticDHCache; c != nil {
+		ssBytes, hs.status.Err = c.dh(hs.s, hs.rs)
+	} else {
+		ssBytes, hs.status.Err = hs.s.DH(hs.rs)
+	}
+	if hs.status.Err != nil {
 		return
 	}
 	hs.ss.MixKey(ssBytes)
+	zero(ssBytes)
 }
 
 func (hs *HandshakeState) onTokenPsk() {
-	// PSK is validated at handshake creation.
-	hs.ss.MixKeyAndHash(hs.cfg.PreSharedKeys[hs.pskIndex])
+	var psk []byte
+	if len(hs.cfg.PreSharedKeys) > 0 {
+		// PSK is validated at handshake creation.
+		psk = hs.cfg.PreSharedKeys[hs.pskIndex]
+	} else {
+		if psk, hs.status.Err = hs.cfg.PreSharedKeyFunc(hs.pskIndex, hs.rs); hs.status.Err != nil {
+			return
+		}
+		if len(psk) != PreSharedKeySize {
+			hs.status.Err = errBadPSK
+			return
+		}
+	}
+	hs.ss.MixKeyAndHash(psk)
 	hs.pskIndex++
 }
 
@@ -419,6 +582,19 @@ func (hs *HandshakeState) onDone(dst []byte) ([]byte, error) {
 	}
 	hs.status.CipherStates = []*CipherState{cs1, cs2}
 	hs.status.HandshakeHash = hs.ss.GetHandshakeHash()
+	if hs.cfg.EnableASK {
+		hs.status.ASKMaster = hs.ss.askMaster()
+	}
+	if hs.cfg.ExportTrafficKeys {
+		hs.status.TrafficKeys = hs.ss.trafficKeys()
+		if cs2 == nil {
+			zero(hs.status.TrafficKeys[1])
+			hs.status.TrafficKeys = hs.status.TrafficKeys[:1]
+		}
+	}
+	if hs.cfg.ExportChainingKey {
+		hs.status.ChainingKey = append([]byte{}, hs.ss.ck...)
+	}
 
 	// This will end up being called redundantly if the developer has any
 	// sense at al, but it's cheap foot+gun avoidance.
@@ -441,6 +617,11 @@ func (hs *HandshakeState) WriteMessage(dst, payload []byte) ([]byte, error) {
 		return nil, hs.status.Err
 	}
 
+	if hs.cfg.PayloadCodec != nil && len(payload) > hs.cfg.PayloadCodec.MaxPayloadSize(hs.patternIndex) {
+		hs.status.Err = ErrPayloadSize
+		return nil, hs.status.Err
+	}
+
 	baseLen := len(dst)
 	for _, v := range hs.patterns[hs.patternIndex] {
 		switch v {
@@ -472,6 +653,9 @@ func (hs *HandshakeState) WriteMessage(dst, payload []byte) ([]byte, error) {
 		hs.status.Err = ErrMessageSize
 		return nil, hs.status.Err
 	}
+	if hs.cfg.Tracer != nil {
+		hs.cfg.Tracer.OnMessage(hs.patternIndex, true, payload, dst[baseLen:], hs.ss.GetHandshakeHash())
+	}
 
 	return hs.onDone(dst)
 }
@@ -482,20 +666,26 @@ func (hs *HandshakeState) WriteMessage(dst, payload []byte) ([]byte, error) {
 //
 // Iff the handshake is complete, the error returned will be `ErrDone`.
 func (hs *HandshakeState) ReadMessage(dst, payload []byte) ([]byte, error) {
+	dst, _, err := hs.readMessage(dst, payload)
+	return dst, err
+}
+
+func (hs *HandshakeState) readMessage(dst, payload []byte) ([]byte, interface{}, error) {
 	if hs.status.Err != nil {
-		return nil, hs.status.Err
+		return nil, nil, hs.status.Err
 	}
 
 	if hs.maxMessageSize > 0 && len(payload) > hs.maxMessageSize {
 		hs.status.Err = ErrMessageSize
-		return nil, hs.status.Err
+		return nil, nil, hs.status.Err
 	}
 
 	if hs.isInitiator != (hs.patternIndex&1 != 0) {
 		hs.status.Err = ErrOutOfOrder
-		return nil, hs.status.Err
+		return nil, nil, hs.status.Err
 	}
 
+	baseLen, message := len(dst), payload
 	for _, v := range hs.patterns[hs.patternIndex] {
 		switch v {
 		case pattern.Token_e:
@@ -517,16 +707,44 @@ func (hs *HandshakeState) ReadMessage(dst, payload []byte) ([]byte, error) {
 		}
 
 		if hs.status.Err != nil {
-			return nil, hs.status.Err
+			hs.status.Err = &HandshakeError{
+				MessageIndex: hs.patternIndex,
+				Token:        v,
+				Err:          hs.status.Err,
+			}
+			return nil, nil, hs.status.Err
+		}
+	}
+
+	// Enforce the codec's size limit before anything is decrypted.
+	if hs.cfg.PayloadCodec != nil && hs.ss.cs.plaintextSize(payload) > hs.cfg.PayloadCodec.MaxPayloadSize(hs.patternIndex) {
+		hs.status.Err = &HandshakeError{
+			MessageIndex: hs.patternIndex,
+			Err:          ErrPayloadSize,
 		}
+		return nil, nil, hs.status.Err
 	}
 
+	var value interface{}
 	dst, hs.status.Err = hs.ss.DecryptAndHash(dst, payload)
+	if hs.status.Err == nil && hs.cfg.PayloadCodec != nil {
+		if value, hs.status.Err = hs.cfg.PayloadCodec.Unmarshal(hs.patternIndex, dst[baseLen:]); hs.status.Err != nil {
+			zero(dst[baseLen:])
+		}
+	}
 	if hs.status.Err != nil {
-		return nil, hs.status.Err
+		hs.status.Err = &HandshakeError{
+			MessageIndex: hs.patternIndex,
+			Err:          hs.status.Err,
+		}
+		return nil, nil, hs.status.Err
+	}
+	if hs.cfg.Tracer != nil {
+		hs.cfg.Tracer.OnMessage(hs.patternIndex, false, dst[baseLen:], message, hs.ss.GetHandshakeHash())
 	}
 
-	return hs.onDone(dst)
+	dst, err := hs.onDone(dst)
+	return dst, value, err
 }
 
 func (hs *HandshakeState) handlePreMessages() error {
@@ -571,7 +789,7 @@ func (hs *HandshakeState) handlePreMessages() error {
 				// one that is missing, that would be stretching a use-case
 				// that is already somewhat nonsensical.
 				if keys.e == nil {
-					return fmt.Errorf("nyquist/New: %s e not set", keys.side)
+					return errors.New("nyquist/New: " + keys.side + " e not set")
 				}
 				pkBytes := keys.e.Bytes()
 				hs.ss.MixHash(pkBytes)
@@ -580,7 +798,7 @@ func (hs *HandshakeState) handlePreMessages() error {
 				}
 			case pattern.Token_s:
 				if keys.s == nil {
-					return fmt.Errorf("nyquist/New: %s s not set", keys.side)
+					return errors.New("nyquist/New: " + keys.side + " s not set")
 				}
 				hs.ss.MixHash(keys.s.Bytes())
 			default:
@@ -598,7 +816,7 @@ func (hs *HandshakeState) handlePreMessages() error {
 func NewHandshake(cfg *HandshakeConfig) (*HandshakeState, error) {
 	// TODO: Validate the config further?
 
-	if cfg.Protocol.Pattern.NumPSKs() != len(cfg.PreSharedKeys) {
+	if cfg.Protocol.Pattern.NumPSKs() != len(cfg.PreSharedKeys) && (len(cfg.PreSharedKeys) != 0 || cfg.PreSharedKeyFunc == nil) {
 		return nil, errMissingPSK
 	}
 	for _, v := range cfg.PreSharedKeys {
@@ -607,6 +825,10 @@ func NewHandshake(cfg *HandshakeConfig) (*HandshakeState, error) {
 		}
 	}
 
+	if cfg.RemoteStatic != nil && !cfg.isExpectedRemoteStatic(cfg.RemoteStatic) {
+		return nil, ErrUnexpectedRemoteStatic
+	}
+
 	maxMessageSize := cfg.getMaxMessageSize()
 	hs := &HandshakeState{
 		cfg:      cfg,
@@ -30,13 +30,21 @@
 package nyquist
 
 import (
+	"bytes"
+	goCipher "crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha512"
+	"encoding/json"
 	"errors"
+	"io"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 
+	"gitlab.com/yawning/nyquist.git/cipher"
 	"gitlab.com/yawning/nyquist.git/dh"
+	"gitlab.com/yawning/nyquist.git/hash"
 	"gitlab.com/yawning/nyquist.git/pattern"
 )
 
@@ -98,6 +106,17 @@ func TestHandshakeState(t *testing.T) {
 		{"Observer", testHandshakeStateObserver},
 		{"BadPSK", testHandshakeStateBadPSK},
 		{"MissingS", testHandshakeStateMissingS},
+		{"Zeroize", testHandshakeStateZeroize},
+		{"ASK", testHandshakeStateASK},
+		{"Fallback", testHandshakeStateFallback},
+		{"StaticDHCache", testHandshakeStateStaticDHCache},
+		{"ExpectedRemoteStatics", testHandshakeStateExpectedRemoteStatics},
+		{"PreSharedKeyFunc", testHandshakeStatePreSharedKeyFunc},
+		{"HedgeEphemeral", testHandshakeStateHedgeEphemeral},
+		{"TruncatedTags", testHandshakeStateTruncatedTags},
+		{"ExportTrafficKeys", testHandshakeStateExportTrafficKeys},
+		{"PayloadCodec", testHandshakeStatePayloadCodec},
+		{"LargeDH", testHandshakeStateLargeDH},
 	} {
 		t.Run(v.n, v.fn)
 	}
@@ -145,7 +164,8 @@ func testHandshakeStateTruncatedE(t *testing.T) {
 	_, bobHs := mustMakeX(t, 0)
 	dst, err := bobHs.ReadMessage(nil, make([]byte, 31))
 	require.Nil(dst, "bobHs.ReadMessage - truncated E")
-	require.Equal(errTruncatedE, err)
+	require.True(errors.Is(err, errTruncatedE), "errors.Is(err, errTruncatedE)")
+	require.True(errors.Is(err, ErrMalformed), "errors.Is(err, ErrMalformed)")
 }
 
 func testHandshakeStateTruncatedS(t *testing.T) {
@@ -158,7 +178,14 @@ func testHandshakeStateTruncatedS(t *testing.T) {
 
 	dst, err = bobHs.ReadMessage(nil, dst[:32+32]) // Clip off both tags.
 	require.Nil(dst, "bobHs.ReadMessage - truncated s")
-	require.Equal(errTruncatedS, err)
+	require.True(errors.Is(err, errTruncatedS), "errors.Is(err, errTruncatedS)")
+	require.True(errors.Is(err, ErrMalformed), "errors.Is(err, ErrMalformed)")
+
+	var hsErr *HandshakeError
+	require.True(errors.As(err, &hsErr), "errors.As(err, *HandshakeError)")
+	require.Equal(0, hsErr.MessageIndex, "HandshakeError.MessageIndex")
+	require.Equal(pattern.Token_s, hsErr.Token, "HandshakeError.Token")
+	require.Contains(err.Error(), "message 0, token s", "HandshakeError.Error()")
 }
 
 func testHandshakeStateOutOfOrder(t *testing.T) {
@@ -313,3 +340,862 @@ func testHandshakeStateMissingS(t *testing.T) {
 	require.Equal(errMissingS, err, "aliceHs.WriteMessage()")
 	require.Nil(dst, "aliceHs.WriteMessage()")
 }
+
+// secretAuditor records references to every piece of key material that
+// passes through the DH and Cipher interfaces, so that it is possible to
+// check that none of it is left intact after the various states are Reset.
+type secretAuditor struct {
+	secrets [][]byte
+}
+
+func (a *secretAuditor) track(b []byte) {
+	a.secrets = append(a.secrets, b)
+}
+
+func (a *secretAuditor) requireWiped(t *testing.T) {
+	require := require.New(t)
+
+	require.NotEmpty(a.secrets, "auditor observed key material")
+	for i, v := range a.secrets {
+		require.Equal(make([]byte, len(v)), v, "secret %d wiped", i)
+	}
+}
+
+type auditedDH struct {
+	dh.DH
+	auditor *secretAuditor
+}
+
+func (d *auditedDH) GenerateKeypair(rng io.Reader) (dh.Keypair, error) {
+	kp, err := d.DH.GenerateKeypair(rng)
+	if err != nil {
+		return nil, err
+	}
+	return &auditedKeypair{kp, d.auditor}, nil
+}
+
+type auditedKeypair struct {
+	dh.Keypair
+	auditor *secretAuditor
+}
+
+func (kp *auditedKeypair) DH(publicKey dh.PublicKey) ([]byte, error) {
+	sharedSecret, err := kp.Keypair.DH(publicKey)
+	if err == nil {
+		kp.auditor.track(sharedSecret)
+	}
+	return sharedSecret, err
+}
+
+type auditedCipher struct {
+	cipher.Cipher
+	auditor *secretAuditor
+}
+
+func (c *auditedCipher) New(key []byte) (goCipher.AEAD, error) {
+	c.auditor.track(key)
+	return c.Cipher.New(key)
+}
+
+func testHandshakeStateZeroize(t *testing.T) {
+	require := require.New(t)
+
+	auditor := new(secretAuditor)
+	baseProtocol, err := NewProtocol("Noise_XX_25519_ChaChaPoly_BLAKE2s")
+	require.NoError(err, "NewProtocol")
+	protocol := &Protocol{
+		Pattern: baseProtocol.Pattern,
+		DH:      &auditedDH{baseProtocol.DH, auditor},
+		Cipher:  &auditedCipher{baseProtocol.Cipher, auditor},
+		Hash:    baseProtocol.Hash,
+	}
+
+	aliceStatic, err := protocol.DH.GenerateKeypair(rand.Reader)
+	require.NoError(err, "Generate Alice's static keypair")
+	bobStatic, err := protocol.DH.GenerateKeypair(rand.Reader)
+	require.NoError(err, "Generate Bob's static keypair")
+
+	aliceHs, err := NewHandshake(&HandshakeConfig{
+		Protocol:    protocol,
+		LocalStatic: aliceStatic,
+		IsInitiator: true,
+	})
+	require.NoError(err, "NewHandshake(aliceCfg)")
+	bobHs, err := NewHandshake(&HandshakeConfig{
+		Protocol:    protocol,
+		LocalStatic: bobStatic,
+	})
+	require.NoError(err, "NewHandshake(bobCfg)")
+
+	for i, step := range []struct {
+		w, r *HandshakeState
+	}{
+		{aliceHs, bobHs},
+		{bobHs, aliceHs},
+		{aliceHs, bobHs},
+	} {
+		// Hold on to the chaining keys and the in-handshake cipher keys,
+		// the references will be dropped when the handshake completes.
+		for _, hs := range []*HandshakeState{step.w, step.r} {
+			auditor.track(hs.ss.ck)
+			if hs.ss.cs.HasKey() {
+				auditor.track(hs.ss.cs.k)
+			}
+		}
+
+		msg, wErr := step.w.WriteMessage(nil, []byte("zeroize test payload"))
+		_, rErr := step.r.ReadMessage(nil, msg)
+		if i < 2 {
+			require.NoError(wErr, "WriteMessage(%d)", i)
+			require.NoError(rErr, "ReadMessage(%d)", i)
+		} else {
+			require.Equal(ErrDone, wErr, "WriteMessage(%d)", i)
+			require.Equal(ErrDone, rErr, "ReadMessage(%d)", i)
+		}
+	}
+
+	// Exercise rekeying, then tear down the transport CipherStates.
+	for _, hs := range []*HandshakeState{aliceHs, bobHs} {
+		for _, cs := range hs.GetStatus().CipherStates {
+			auditor.track(cs.k)
+			require.NoError(cs.Rekey(), "cs.Rekey()")
+			auditor.track(cs.k)
+			cs.Reset()
+		}
+	}
+
+	auditor.requireWiped(t)
+}
+
+func testHandshakeStateASK(t *testing.T) {
+	require := require.New(t)
+
+	aliceHs, bobHs := mustMakeX(t, 0)
+	aliceHs.cfg.EnableASK = true
+	bobHs.cfg.EnableASK = true
+
+	msg, err := aliceHs.WriteMessage(nil, nil)
+	require.Equal(ErrDone, err, "aliceHs.WriteMessage")
+	_, err = bobHs.ReadMessage(nil, msg)
+	require.Equal(ErrDone, err, "bobHs.ReadMessage")
+
+	aliceStatus, bobStatus := aliceHs.GetStatus(), bobHs.GetStatus()
+	require.Len(aliceStatus.ASKMaster, 32, "alice: ASKMaster")
+	require.Equal(aliceStatus.ASKMaster, bobStatus.ASKMaster, "ASKMaster")
+
+	h := aliceHs.cfg.Protocol.Hash
+	askA := DeriveASK(h, aliceStatus.ASKMaster, []byte("label A"))
+	askB := DeriveASK(h, bobStatus.ASKMaster, []byte("label B"))
+	require.Len(askA, 32, "DeriveASK")
+	require.Equal(askA, DeriveASK(h, bobStatus.ASKMaster, []byte("label A")), "DeriveASK - same label")
+	require.NotEqual(askA, askB, "DeriveASK - distinct labels")
+
+	// Disabled by default.
+	aliceHs, bobHs = mustMakeX(t, 0)
+	msg, err = aliceHs.WriteMessage(nil, nil)
+	require.Equal(ErrDone, err, "aliceHs.WriteMessage - disabled")
+	_, err = bobHs.ReadMessage(nil, msg)
+	require.Equal(ErrDone, err, "bobHs.ReadMessage - disabled")
+	require.Nil(aliceHs.GetStatus().ASKMaster, "alice: ASKMaster - disabled")
+	require.Nil(bobHs.GetStatus().ASKMaster, "bob: ASKMaster - disabled")
+}
+
+func testHandshakeStateFallback(t *testing.T) {
+	require := require.New(t)
+
+	protoIK, err := NewProtocol("Noise_IK_25519_ChaChaPoly_BLAKE2s")
+	require.NoError(err, "NewProtocol(IK)")
+	protoXXfallback, err := NewProtocol("Noise_XXfallback_25519_ChaChaPoly_BLAKE2s")
+	require.NoError(err, "NewProtocol(XXfallback)")
+
+	aliceStatic, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(err, "GenerateKeypair(alice)")
+	bobStatic, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(err, "GenerateKeypair(bob)")
+	staleStatic, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(err, "GenerateKeypair(stale)")
+
+	// Alice attempts IK with a stale copy of Bob's static key.
+	aliceHs, err := NewHandshake(&HandshakeConfig{
+		Protocol:     protoIK,
+		LocalStatic:  aliceStatic,
+		RemoteStatic: staleStatic.Public(),
+		IsInitiator:  true,
+	})
+	require.NoError(err, "NewHandshake(alice)")
+	defer aliceHs.Reset()
+	bobHs, err := NewHandshake(&HandshakeConfig{
+		Protocol:    protoIK,
+		LocalStatic: bobStatic,
+	})
+	require.NoError(err, "NewHandshake(bob)")
+	defer bobHs.Reset()
+
+	_, err = bobHs.Fallback(protoXXfallback)
+	require.Error(err, "bobHs.Fallback - too early")
+
+	msg, err := aliceHs.WriteMessage(nil, nil)
+	require.NoError(err, "aliceHs.WriteMessage(IK)")
+	_, err = bobHs.ReadMessage(nil, msg)
+	require.Error(err, "bobHs.ReadMessage(IK)")
+
+	// Both sides fall back to XXfallback, with Bob as the initiator.
+	bobFallback, err := bobHs.Fallback(protoXXfallback)
+	require.NoError(err, "bobHs.Fallback")
+	defer bobFallback.Reset()
+	aliceFallback, err := aliceHs.Fallback(protoXXfallback)
+	require.NoError(err, "aliceHs.Fallback")
+	defer aliceFallback.Reset()
+
+	msg, err = bobFallback.WriteMessage(nil, []byte("bob"))
+	require.NoError(err, "bobFallback.WriteMessage")
+	payload, err := aliceFallback.ReadMessage(nil, msg)
+	require.NoError(err, "aliceFallback.ReadMessage")
+	require.Equal([]byte("bob"), payload, "aliceFallback.ReadMessage - payload")
+
+	msg, err = aliceFallback.WriteMessage(nil, []byte("alice"))
+	require.Equal(ErrDone, err, "aliceFallback.WriteMessage")
+	payload, err = bobFallback.ReadMessage(nil, msg)
+	require.Equal(ErrDone, err, "bobFallback.ReadMessage")
+	require.Equal([]byte("alice"), payload, "bobFallback.ReadMessage - payload")
+
+	aliceStatus, bobStatus := aliceFallback.GetStatus(), bobFallback.GetStatus()
+	require.Equal(aliceStatus.HandshakeHash, bobStatus.HandshakeHash, "HandshakeHash")
+	require.Equal(bobStatic.Public().Bytes(), aliceStatus.RemoteStatic.Bytes(), "alice: RemoteStatic")
+	require.Equal(aliceStatic.Public().Bytes(), bobStatus.RemoteStatic.Bytes(), "bob: RemoteStatic")
+
+	// Bob is the initiator, so CipherStates[0] is Bob -> Alice.
+	ct, err := bobStatus.CipherStates[0].EncryptWithAd(nil, nil, []byte("transport"))
+	require.NoError(err, "bob: EncryptWithAd")
+	pt, err := aliceStatus.CipherStates[0].DecryptWithAd(nil, nil, ct)
+	require.NoError(err, "alice: DecryptWithAd")
+	require.Equal([]byte("transport"), pt, "transport payload")
+}
+
+func testHandshakeStateStaticDHCache(t *testing.T) {
+	require := require.New(t)
+
+	protocol, err := NewProtocol("Noise_KK_25519_ChaChaPoly_BLAKE2s")
+	require.NoError(err, "NewProtocol")
+
+	bobStatic, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(err, "GenerateKeypair(bob)")
+
+	var initiators []dh.Keypair
+	for i := 0; i < 3; i++ {
+		kp, kpErr := dh.X25519.GenerateKeypair(rand.Reader)
+		require.NoError(kpErr, "GenerateKeypair(initiator)")
+		initiators = append(initiators, kp)
+	}
+
+	cache := NewStaticDHCache(2)
+	doHandshake := func(aliceStatic dh.Keypair, cache *StaticDHCache) []byte {
+		aliceEphemeral, kpErr := dh.X25519.GenerateKeypair(rand.Reader)
+		require.NoError(kpErr, "GenerateKeypair(alice ephemeral)")
+		bobEphemeral, kpErr := dh.X25519.GenerateKeypair(rand.Reader)
+		require.NoError(kpErr, "GenerateKeypair(bob ephemeral)")
+
+		// Run the handshake twice, with and without the cache, to
+		// ensure that the cached result is correct.
+		var hashes [][]byte
+		for _, c := range []*StaticDHCache{nil, cache} {
+			aliceHs, hsErr := NewHandshake(&HandshakeConfig{
+				Protocol:       protocol,
+				LocalStatic:    aliceStatic,
+				LocalEphemeral: aliceEphemeral,
+				RemoteStatic:   bobStatic.Public(),
+				IsInitiator:    true,
+			})
+			require.NoError(hsErr, "NewHandshake(alice)")
+			bobHs, hsErr := NewHandshake(&HandshakeConfig{
+				Protocol:       protocol,
+				LocalStatic:    bobStatic,
+				LocalEphemeral: bobEphemeral,
+				RemoteStatic:   aliceStatic.Public(),
+				StaticDHCache:  c,
+			})
+			require.NoError(hsErr, "NewHandshake(bob)")
+
+			msg, hsErr := aliceHs.WriteMessage(nil, nil)
+			require.NoError(hsErr, "aliceHs.WriteMessage")
+			_, hsErr = bobHs.ReadMessage(nil, msg)
+			require.NoError(hsErr, "bobHs.ReadMessage")
+			msg, hsErr = bobHs.WriteMessage(nil, nil)
+			require.Equal(ErrDone, hsErr, "bobHs.WriteMessage")
+			_, hsErr = aliceHs.ReadMessage(nil, msg)
+			require.Equal(ErrDone, hsErr, "aliceHs.ReadMessage")
+
+			require.Equal(aliceHs.GetStatus().HandshakeHash, bobHs.GetStatus().HandshakeHash, "handshake hashes match")
+			hashes = append(hashes, bobHs.GetStatus().HandshakeHash)
+			aliceHs.Reset()
+			bobHs.Reset()
+		}
+		require.Equal(hashes[0], hashes[1], "cached handshake hash matches uncached")
+
+		return hashes[1]
+	}
+
+	// Repeated handshakes with the same initiator hit the cache.
+	_ = doHandshake(initiators[0], cache)
+	_ = doHandshake(initiators[0], cache)
+	require.Equal(1, cache.Len(), "cache.Len() - single initiator")
+
+	// The cache is bounded.
+	_ = doHandshake(initiators[1], cache)
+	_ = doHandshake(initiators[2], cache)
+	require.Equal(2, cache.Len(), "cache.Len() - bounded")
+	_ = doHandshake(initiators[0], cache)
+
+	cache.Purge()
+	require.Equal(0, cache.Len(), "cache.Len() - purged")
+}
+
+func testHandshakeStateExpectedRemoteStatics(t *testing.T) {
+	protocol, err := NewProtocol("Noise_XX_25519_ChaChaPoly_BLAKE2s")
+	require.NoError(t, err, "NewProtocol")
+
+	var keys []dh.Keypair
+	for i := 0; i < 3; i++ {
+		kp, kpErr := dh.X25519.GenerateKeypair(rand.Reader)
+		require.NoError(t, kpErr, "GenerateKeypair")
+		keys = append(keys, kp)
+	}
+	aliceStatic, bobStatic, otherStatic := keys[0], keys[1], keys[2]
+
+	for _, v := range []struct {
+		name                   string
+		alicePins, bobPins     []dh.PublicKey
+		aliceErrIdx, bobErrIdx int
+	}{
+		{"Unpinned", nil, nil, -1, -1},
+		{"Pinned", []dh.PublicKey{otherStatic.Public(), bobStatic.Public()}, []dh.PublicKey{aliceStatic.Public()}, -1, -1},
+		{"InitiatorMismatch", []dh.PublicKey{otherStatic.Public()}, nil, 1, -1},
+		{"ResponderMismatch", nil, []dh.PublicKey{otherStatic.Public()}, -1, 2},
+	} {
+		t.Run(v.name, func(t *testing.T) {
+			require := require.New(t)
+
+			aliceHs, err := NewHandshake(&HandshakeConfig{
+				Protocol:              protocol,
+				LocalStatic:           aliceStatic,
+				ExpectedRemoteStatics: v.alicePins,
+				IsInitiator:           true,
+			})
+			require.NoError(err, "NewHandshake(alice)")
+			defer aliceHs.Reset()
+			bobHs, err := NewHandshake(&HandshakeConfig{
+				Protocol:              protocol,
+				LocalStatic:           bobStatic,
+				ExpectedRemoteStatics: v.bobPins,
+			})
+			require.NoError(err, "NewHandshake(bob)")
+			defer bobHs.Reset()
+
+			for idx := 0; idx < 3; idx++ {
+				w, r, errIdx := aliceHs, bobHs, v.bobErrIdx
+				if idx == 1 {
+					w, r, errIdx = bobHs, aliceHs, v.aliceErrIdx
+				}
+
+				msg, wErr := w.WriteMessage(nil, []byte("payload"))
+				payload, rErr := r.ReadMessage(nil, msg)
+				if idx == errIdx {
+					require.True(errors.Is(rErr, ErrUnexpectedRemoteStatic), "ReadMessage(%d) - mismatch", idx)
+					require.Nil(payload, "ReadMessage(%d) - mismatch payload", idx)
+					require.Nil(r.GetStatus().RemoteStatic, "ReadMessage(%d) - mismatch RemoteStatic", idx)
+					return
+				}
+				require.Equal(wErr, rErr, "ReadMessage(%d)", idx)
+				require.Equal([]byte("payload"), payload, "ReadMessage(%d) - payload", idx)
+			}
+		})
+	}
+
+	protoIK, err := NewProtocol("Noise_IK_25519_ChaChaPoly_BLAKE2s")
+	require.NoError(t, err, "NewProtocol(IK)")
+	_, err = NewHandshake(&HandshakeConfig{
+		Protocol:              protoIK,
+		LocalStatic:           aliceStatic,
+		RemoteStatic:          otherStatic.Public(),
+		ExpectedRemoteStatics: []dh.PublicKey{bobStatic.Public()},
+		IsInitiator:           true,
+	})
+	require.Equal(t, ErrUnexpectedRemoteStatic, err, "NewHandshake - pre-message mismatch")
+}
+
+func testHandshakeStatePreSharedKeyFunc(t *testing.T) {
+	require := require.New(t)
+
+	protocol, err := NewProtocol("Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s")
+	require.NoError(err, "NewProtocol")
+
+	bobStatic, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(err, "GenerateKeypair(bob)")
+
+	// Bob has a database of per-client PSKs.
+	pskDB := make(map[string][]byte)
+	var clients []dh.Keypair
+	for i := 0; i < 3; i++ {
+		kp, kpErr := dh.X25519.GenerateKeypair(rand.Reader)
+		require.NoError(kpErr, "GenerateKeypair(client)")
+		psk := make([]byte, PreSharedKeySize)
+		_, _ = rand.Read(psk)
+		pskDB[string(kp.Public().Bytes())] = psk
+		clients = append(clients, kp)
+	}
+	errUnknownClient := errors.New("unknown client")
+	pskFunc := func(index int, remoteStatic dh.PublicKey) ([]byte, error) {
+		require.Equal(0, index, "PreSharedKeyFunc - index")
+		require.NotNil(remoteStatic, "PreSharedKeyFunc - remoteStatic")
+		psk, ok := pskDB[string(remoteStatic.Bytes())]
+		if !ok {
+			return nil, errUnknownClient
+		}
+		return psk, nil
+	}
+
+	doHandshake := func(client dh.Keypair, psk []byte) error {
+		aliceHs, hsErr := NewHandshake(&HandshakeConfig{
+			Protocol:      protocol,
+			LocalStatic:   client,
+			RemoteStatic:  bobStatic.Public(),
+			PreSharedKeys: [][]byte{psk},
+			IsInitiator:   true,
+		})
+		require.NoError(hsErr, "NewHandshake(alice)")
+		defer aliceHs.Reset()
+		bobHs, hsErr := NewHandshake(&HandshakeConfig{
+			Protocol:         protocol,
+			LocalStatic:      bobStatic,
+			PreSharedKeyFunc: pskFunc,
+		})
+		require.NoError(hsErr, "NewHandshake(bob)")
+		defer bobHs.Reset()
+
+		msg, hsErr := aliceHs.WriteMessage(nil, nil)
+		require.NoError(hsErr, "aliceHs.WriteMessage")
+		if _, hsErr = bobHs.ReadMessage(nil, msg); hsErr != nil {
+			return hsErr
+		}
+		if msg, hsErr = bobHs.WriteMessage(nil, nil); hsErr != ErrDone {
+			return hsErr
+		}
+		_, hsErr = aliceHs.ReadMessage(nil, msg)
+		return hsErr
+	}
+
+	for _, client := range clients {
+		err = doHandshake(client, pskDB[string(client.Public().Bytes())])
+		require.Equal(ErrDone, err, "handshake - known client")
+	}
+
+	// Wrong PSK.
+	err = doHandshake(clients[0], pskDB[string(clients[1].Public().Bytes())])
+	require.True(errors.Is(err, ErrOpen), "handshake - wrong psk")
+
+	// Unknown client.
+	stranger, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(err, "GenerateKeypair(stranger)")
+	err = doHandshake(stranger, pskDB[string(clients[0].Public().Bytes())])
+	require.True(errors.Is(err, errUnknownClient), "handshake - unknown client")
+}
+
+type zeroReader struct{}
+
+func (r zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func testHandshakeStateHedgeEphemeral(t *testing.T) {
+	require := require.New(t)
+
+	protocol, err := NewProtocol("Noise_XX_25519_ChaChaPoly_BLAKE2s")
+	require.NoError(err, "NewProtocol")
+
+	newStatic := func() dh.Keypair {
+		kp, kpErr := dh.X25519.GenerateKeypair(rand.Reader)
+		require.NoError(kpErr, "GenerateKeypair")
+		return kp
+	}
+
+	// Generate the initiator's ephemeral key with a broken entropy source.
+	initiatorE := func(hedge bool) []byte {
+		hs, hsErr := NewHandshake(&HandshakeConfig{
+			Protocol:       protocol,
+			LocalStatic:    newStatic(),
+			Rng:            zeroReader{},
+			HedgeEphemeral: hedge,
+			IsInitiator:    true,
+		})
+		require.NoError(hsErr, "NewHandshake")
+		defer hs.Reset()
+
+		msg, hsErr := hs.WriteMessage(nil, nil)
+		require.NoError(hsErr, "WriteMessage")
+		return msg
+	}
+
+	require.Equal(initiatorE(false), initiatorE(false), "unhedged ephemerals are predictable")
+	require.NotEqual(initiatorE(true), initiatorE(true), "hedged ephemerals are distinct")
+
+	// Hedged handshakes complete normally.
+	aliceHs, err := NewHandshake(&HandshakeConfig{
+		Protocol:       protocol,
+		LocalStatic:    newStatic(),
+		HedgeEphemeral: true,
+		IsInitiator:    true,
+	})
+	require.NoError(err, "NewHandshake(alice)")
+	defer aliceHs.Reset()
+	bobHs, err := NewHandshake(&HandshakeConfig{
+		Protocol:       protocol,
+		LocalStatic:    newStatic(),
+		HedgeEphemeral: true,
+	})
+	require.NoError(err, "NewHandshake(bob)")
+	defer bobHs.Reset()
+
+	msg, err := aliceHs.WriteMessage(nil, nil)
+	require.NoError(err, "aliceHs.WriteMessage")
+	_, err = bobHs.ReadMessage(nil, msg)
+	require.NoError(err, "bobHs.ReadMessage")
+	msg, err = bobHs.WriteMessage(nil, nil)
+	require.NoError(err, "bobHs.WriteMessage")
+	_, err = aliceHs.ReadMessage(nil, msg)
+	require.NoError(err, "aliceHs.ReadMessage")
+	msg, err = aliceHs.WriteMessage(nil, nil)
+	require.Equal(ErrDone, err, "aliceHs.WriteMessage")
+	_, err = bobHs.ReadMessage(nil, msg)
+	require.Equal(ErrDone, err, "bobHs.ReadMessage")
+
+	// Entropy source failures are still reported.
+	hs, err := NewHandshake(&HandshakeConfig{
+		Protocol:       protocol,
+		LocalStatic:    newStatic(),
+		Rng:            &failReader{},
+		HedgeEphemeral: true,
+		IsInitiator:    true,
+	})
+	require.NoError(err, "NewHandshake(failReader)")
+	defer hs.Reset()
+	_, err = hs.WriteMessage(nil, nil)
+	require.Equal(errFailReader, err, "WriteMessage - failReader")
+}
+
+func testHandshakeStateTruncatedTags(t *testing.T) {
+	require := require.New(t)
+
+	truncated, err := cipher.UnsafeTruncated(cipher.ChaChaPoly, 8)
+	require.NoError(err, "UnsafeTruncated")
+
+	newProtocol := func(ci cipher.Cipher) *Protocol {
+		return &Protocol{
+			Pattern: pattern.NN,
+			DH:      dh.X25519,
+			Cipher:  ci,
+			Hash:    hash.BLAKE2s,
+		}
+	}
+	protocol := newProtocol(truncated)
+	require.Equal("Noise_NN_25519_ChaChaPoly-T64_BLAKE2s", protocol.String(), "String")
+
+	handshake := func(aliceProtocol, bobProtocol *Protocol) (*HandshakeStatus, *HandshakeStatus, error) {
+		aliceHs, hsErr := NewHandshake(&HandshakeConfig{
+			Protocol:    aliceProtocol,
+			IsInitiator: true,
+		})
+		require.NoError(hsErr, "NewHandshake(alice)")
+		defer aliceHs.Reset()
+		bobHs, hsErr := NewHandshake(&HandshakeConfig{
+			Protocol: bobProtocol,
+		})
+		require.NoError(hsErr, "NewHandshake(bob)")
+		defer bobHs.Reset()
+
+		msg, hsErr := aliceHs.WriteMessage(nil, []byte("alice"))
+		require.NoError(hsErr, "aliceHs.WriteMessage")
+		if _, hsErr = bobHs.ReadMessage(nil, msg); hsErr != nil {
+			return nil, nil, hsErr
+		}
+		msg, hsErr = bobHs.WriteMessage(nil, []byte("bob"))
+		require.Equal(ErrDone, hsErr, "bobHs.WriteMessage")
+		if bobProtocol == protocol {
+			require.Len(msg, 32+3+8, "bobHs.WriteMessage - truncated tag")
+		}
+		if _, hsErr = aliceHs.ReadMessage(nil, msg); hsErr != ErrDone {
+			return nil, nil, hsErr
+		}
+
+		return aliceHs.GetStatus(), bobHs.GetStatus(), nil
+	}
+
+	aliceStatus, bobStatus, err := handshake(protocol, protocol)
+	require.NoError(err, "handshake")
+	ct, err := aliceStatus.CipherStates[0].EncryptWithAd(nil, nil, []byte("transport"))
+	require.NoError(err, "EncryptWithAd")
+	require.Len(ct, 9+8, "EncryptWithAd - truncated tag")
+	pt, err := bobStatus.CipherStates[0].DecryptWithAd(nil, nil, ct)
+	require.NoError(err, "DecryptWithAd")
+	require.Equal([]byte("transport"), pt, "DecryptWithAd")
+
+	// Both peers must opt in, as the protocol name differs.
+	_, _, err = handshake(protocol, newProtocol(cipher.ChaChaPoly))
+	require.Error(err, "handshake - mismatched ciphers")
+}
+
+func testHandshakeStateExportTrafficKeys(t *testing.T) {
+	require := require.New(t)
+
+	protocol, err := NewProtocol("Noise_NN_25519_AESGCM_SHA512")
+	require.NoError(err, "NewProtocol")
+
+	aliceHs, err := NewHandshake(&HandshakeConfig{
+		Protocol:          protocol,
+		ExportTrafficKeys: true,
+		ExportChainingKey: true,
+		IsInitiator:       true,
+	})
+	require.NoError(err, "NewHandshake(alice)")
+	defer aliceHs.Reset()
+	bobHs, err := NewHandshake(&HandshakeConfig{
+		Protocol: protocol,
+	})
+	require.NoError(err, "NewHandshake(bob)")
+	defer bobHs.Reset()
+
+	msg, err := aliceHs.WriteMessage(nil, nil)
+	require.NoError(err, "aliceHs.WriteMessage")
+	_, err = bobHs.ReadMessage(nil, msg)
+	require.NoError(err, "bobHs.ReadMessage")
+	msg, err = bobHs.WriteMessage(nil, nil)
+	require.Equal(ErrDone, err, "bobHs.WriteMessage")
+	_, err = aliceHs.ReadMessage(nil, msg)
+	require.Equal(ErrDone, err, "aliceHs.ReadMessage")
+
+	aliceStatus, bobStatus := aliceHs.GetStatus(), bobHs.GetStatus()
+	require.Nil(bobStatus.TrafficKeys, "TrafficKeys - not enabled")
+	require.Len(aliceStatus.TrafficKeys, 2, "TrafficKeys")
+	require.Nil(bobStatus.ChainingKey, "ChainingKey - not enabled")
+
+	// Split is `HKDF(ck, zerolen)`.
+	mac := hmac.New(sha512.New, aliceStatus.ChainingKey)
+	mac.Write(nil)
+	mac = hmac.New(sha512.New, mac.Sum(nil))
+	mac.Write([]byte{0x01})
+	require.Equal(aliceStatus.TrafficKeys[0], mac.Sum(nil)[:32], "ChainingKey")
+
+	// The exported keys can decrypt traffic in both directions.
+	for i, key := range aliceStatus.TrafficKeys {
+		require.Len(key, 32, "TrafficKeys[%d]", i)
+
+		ct, err := bobStatus.CipherStates[i].EncryptWithAd(nil, nil, []byte("escrowed"))
+		require.NoError(err, "EncryptWithAd(%d)", i)
+
+		cs := newCipherState(protocol.Cipher, 0)
+		cs.InitializeKey(key)
+		pt, err := cs.DecryptWithAd(nil, nil, ct)
+		require.NoError(err, "DecryptWithAd(%d)", i)
+		require.Equal([]byte("escrowed"), pt, "DecryptWithAd(%d)", i)
+	}
+}
+
+type testPayload struct {
+	Name string `json:"name"`
+}
+
+type testPayloadCodec struct {
+	maxSize     int
+	unmarshaled int
+}
+
+func (c *testPayloadCodec) MaxPayloadSize(idx int) int {
+	return c.maxSize
+}
+
+func (c *testPayloadCodec) Marshal(idx int, v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c *testPayloadCodec) Unmarshal(idx int, payload []byte) (interface{}, error) {
+	c.unmarshaled++
+
+	var v testPayload
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if v.Name == "" {
+		return nil, errors.New("nyquist/test: missing name")
+	}
+	return &v, nil
+}
+
+func testHandshakeStatePayloadCodec(t *testing.T) {
+	require := require.New(t)
+
+	protocol, err := NewProtocol("Noise_NN_25519_ChaChaPoly_BLAKE2s")
+	require.NoError(err, "NewProtocol")
+
+	newHandshakes := func(aliceCodec, bobCodec PayloadCodec) (*HandshakeState, *HandshakeState) {
+		aliceHs, err := NewHandshake(&HandshakeConfig{
+			Protocol:     protocol,
+			PayloadCodec: aliceCodec,
+			IsInitiator:  true,
+		})
+		require.NoError(err, "NewHandshake(alice)")
+		bobHs, err := NewHandshake(&HandshakeConfig{
+			Protocol:     protocol,
+			PayloadCodec: bobCodec,
+		})
+		require.NoError(err, "NewHandshake(bob)")
+		return aliceHs, bobHs
+	}
+
+	// Structured payloads round trip.
+	aliceCodec, bobCodec := &testPayloadCodec{maxSize: 64}, &testPayloadCodec{maxSize: 64}
+	aliceHs, bobHs := newHandshakes(aliceCodec, bobCodec)
+	msg, err := aliceHs.WritePayload(nil, &testPayload{Name: "alice"})
+	require.NoError(err, "aliceHs.WritePayload")
+	v, err := bobHs.ReadPayload(msg)
+	require.NoError(err, "bobHs.ReadPayload")
+	require.Equal(&testPayload{Name: "alice"}, v, "bobHs.ReadPayload")
+	msg, err = bobHs.WritePayload(nil, &testPayload{Name: "bob"})
+	require.Equal(ErrDone, err, "bobHs.WritePayload")
+	v, err = aliceHs.ReadPayload(msg)
+	require.Equal(ErrDone, err, "aliceHs.ReadPayload")
+	require.Equal(&testPayload{Name: "bob"}, v, "aliceHs.ReadPayload")
+
+	// Oversized payloads are rejected on write.
+	aliceHs, _ = newHandshakes(&testPayloadCodec{maxSize: 8}, nil)
+	_, err = aliceHs.WritePayload(nil, &testPayload{Name: "alice"})
+	require.Equal(ErrPayloadSize, err, "WritePayload - oversized")
+
+	// Oversized payloads are rejected on read, before decoding.
+	_, bobHs = newHandshakes(nil, bobCodec)
+	aliceHs, _ = newHandshakes(nil, nil)
+	msg, err = aliceHs.WriteMessage(nil, make([]byte, 65))
+	require.NoError(err, "WriteMessage - oversized")
+	bobCodec.unmarshaled = 0
+	_, err = bobHs.ReadMessage(nil, msg)
+	require.True(errors.Is(err, ErrPayloadSize), "ReadMessage - oversized")
+	require.Zero(bobCodec.unmarshaled, "ReadMessage - oversized payload not decoded")
+
+	// Invalid payloads abort the handshake, even via ReadMessage.
+	for _, payload := range [][]byte{
+		[]byte(`{"name":""}`),
+		[]byte(`{"name":"mallory","admin":true}`),
+	} {
+		aliceHs, bobHs = newHandshakes(nil, bobCodec)
+		msg, err = aliceHs.WriteMessage(nil, payload)
+		require.NoError(err, "WriteMessage - invalid")
+		dst, err := bobHs.ReadMessage(nil, msg)
+		require.Nil(dst, "ReadMessage - invalid")
+		var hsErr *HandshakeError
+		require.True(errors.As(err, &hsErr), "ReadMessage - invalid")
+		require.Equal(pattern.Token_invalid, hsErr.Token, "ReadMessage - invalid")
+		require.Equal(err, bobHs.GetStatus().Err, "ReadMessage - invalid, handshake failed")
+	}
+
+	// The codec is required for the structured API.
+	aliceHs, _ = newHandshakes(nil, nil)
+	_, err = aliceHs.WritePayload(nil, &testPayload{Name: "alice"})
+	require.Equal(errNoPayloadCodec, err, "WritePayload - no codec")
+	_, err = aliceHs.ReadPayload(nil)
+	require.Equal(errNoPayloadCodec, err, "ReadPayload - no codec")
+}
+
+func testHandshakeStateLargeDH(t *testing.T) {
+	for _, dhName := range []string{"P384", "P521"} {
+		t.Run(dhName, func(t *testing.T) {
+			require := require.New(t)
+
+			if dh.FromString(dhName) == nil {
+				t.Skip("DH function not included in the build")
+			}
+			protocol, err := NewProtocol("Noise_XX_" + dhName + "_AESGCM_SHA512")
+			require.NoError(err, "NewProtocol")
+			dhLen := protocol.DH.Size()
+
+			aliceStatic, err := protocol.DH.GenerateKeypair(rand.Reader)
+			require.NoError(err, "Generate Alice's static keypair")
+			bobStatic, err := protocol.DH.GenerateKeypair(rand.Reader)
+			require.NoError(err, "Generate Bob's static keypair")
+
+			aliceHs, err := NewHandshake(&HandshakeConfig{
+				Protocol:    protocol,
+				LocalStatic: aliceStatic,
+				IsInitiator: true,
+			})
+			require.NoError(err, "NewHandshake(alice)")
+			defer aliceHs.Reset()
+			bobHs, err := NewHandshake(&HandshakeConfig{
+				Protocol:    protocol,
+				LocalStatic: bobStatic,
+			})
+			require.NoError(err, "NewHandshake(bob)")
+			defer bobHs.Reset()
+
+			msg, err := aliceHs.WriteMessage(nil, nil)
+			require.NoError(err, "aliceHs.WriteMessage(1)")
+			require.Len(msg, dhLen, "aliceHs.WriteMessage(1)")
+			_, err = bobHs.ReadMessage(nil, msg)
+			require.NoError(err, "bobHs.ReadMessage(1)")
+
+			msg, err = bobHs.WriteMessage(nil, nil)
+			require.NoError(err, "bobHs.WriteMessage(2)")
+			require.Len(msg, 2*dhLen+2*16, "bobHs.WriteMessage(2)")
+			_, err = aliceHs.ReadMessage(nil, msg)
+			require.NoError(err, "aliceHs.ReadMessage(2)")
+
+			msg, err = aliceHs.WriteMessage(nil, nil)
+			require.Equal(ErrDone, err, "aliceHs.WriteMessage(3)")
+			_, err = bobHs.ReadMessage(nil, msg)
+			require.Equal(ErrDone, err, "bobHs.ReadMessage(3)")
+
+			aliceStatus, bobStatus := aliceHs.GetStatus(), bobHs.GetStatus()
+			require.Equal(aliceStatus.HandshakeHash, bobStatus.HandshakeHash, "HandshakeHash")
+			require.Equal(bobStatic.Public().Bytes(), aliceStatus.RemoteStatic.Bytes(), "RemoteStatic(alice)")
+			require.Equal(aliceStatic.Public().Bytes(), bobStatus.RemoteStatic.Bytes(), "RemoteStatic(bob)")
+		})
+	}
+}
+
+func BenchmarkHandshakeXX(b *testing.B) {
+	protocol, err := NewProtocol("Noise_XX_25519_ChaChaPoly_BLAKE2s")
+	require.NoError(b, err, "NewProtocol")
+
+	aliceStatic, err := protocol.DH.GenerateKeypair(rand.Reader)
+	require.NoError(b, err, "GenerateKeypair - alice")
+	bobStatic, err := protocol.DH.GenerateKeypair(rand.Reader)
+	require.NoError(b, err, "GenerateKeypair - bob")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		alice, _ := NewHandshake(&HandshakeConfig{
+			Protocol:    protocol,
+			LocalStatic: aliceStatic,
+			IsInitiator: true,
+		})
+		bob, _ := NewHandshake(&HandshakeConfig{
+			Protocol:    protocol,
+			LocalStatic: bobStatic,
+		})
+
+		msg, _ := alice.WriteMessage(nil, nil)
+		_, _ = bob.ReadMessage(nil, msg)
+		msg, _ = bob.WriteMessage(nil, nil)
+		_, _ = alice.ReadMessage(nil, msg)
+		msg, _ = alice.WriteMessage(nil, nil)
+		if _, err = bob.ReadMessage(nil, msg); err != ErrDone {
+			b.Fatalf("handshake failed: %v", err)
+		}
+
+		alice.Reset()
+		bob.Reset()
+	}
+}
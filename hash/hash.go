@@ -34,7 +34,6 @@ package hash // import "gitlab.com/yawning/nyquist.git/hash"
 import (
 	"crypto/sha256"
 	"crypto/sha512"
-	"fmt"
 	"hash"
 
 	"golang.org/x/crypto/blake2b"
@@ -48,6 +47,10 @@ var (
 	// SHA512 is the SHA512 hash function.
 	SHA512 Hash = &hashSha512{}
 
+	// SHA512_256 is the SHA-512/256 hash function.  It has the same
+	// `HASHLEN` as SHA256, but is typically faster on 64-bit systems.
+	SHA512_256 Hash = &hashSha512_256{}
+
 	// BLAKE2s is the BLAKE2s hash function.
 	BLAKE2s Hash = &hashBlake2s{}
 
@@ -55,16 +58,18 @@ var (
 	BLAKE2b Hash = &hashBlake2b{}
 
 	supportedHashes = map[string]Hash{
-		"SHA256":  SHA256,
-		"SHA512":  SHA512,
-		"BLAKE2s": BLAKE2s,
-		"BLAKE2b": BLAKE2b,
+		"SHA256":     SHA256,
+		"SHA512":     SHA512,
+		"SHA512/256": SHA512_256,
+		"BLAKE2s":    BLAKE2s,
+		"BLAKE2b":    BLAKE2b,
 	}
 )
 
 // Hash is a collision-resistant cryptographic hash function factory.
 type Hash interface {
-	fmt.Stringer
+	// String returns the string representation of the hash function name.
+	String() string
 
 	// New constructs a new `hash.Hash` instance.
 	New() hash.Hash
@@ -106,6 +111,20 @@ func (h *hashSha512) Size() int {
 	return sha512.Size
 }
 
+type hashSha512_256 struct{}
+
+func (h *hashSha512_256) String() string {
+	return "SHA512/256"
+}
+
+func (h *hashSha512_256) New() hash.Hash {
+	return sha512.New512_256()
+}
+
+func (h *hashSha512_256) Size() int {
+	return sha512.Size256
+}
+
 type hashBlake2s struct{}
 
 func (h *hashBlake2s) String() string {
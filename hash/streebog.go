@@ -0,0 +1,65 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build !nyquist_omit_gost
+// +build !nyquist_omit_gost
+
+package hash
+
+import (
+	"hash"
+
+	"gitlab.com/yawning/nyquist.git/internal/gost"
+)
+
+// Streebog256 is the GOST R 34.11-2012 "Streebog" hash function, with a
+// 256-bit digest, for deployments subject to Russian regulatory
+// requirements.
+//
+// Warning: This hash function is non-standard, and the implementation is
+// not constant time.
+var Streebog256 Hash = &hashStreebog256{}
+
+type hashStreebog256 struct{}
+
+func (h *hashStreebog256) String() string {
+	return "Streebog256"
+}
+
+func (h *hashStreebog256) New() hash.Hash {
+	return gost.NewStreebog256()
+}
+
+func (h *hashStreebog256) Size() int {
+	return gost.Size256
+}
+
+func init() {
+	Register(Streebog256)
+}
@@ -0,0 +1,73 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package nyquist
+
+import (
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const hedgeEntropySize = 64
+
+var (
+	hedgeLabel = []byte("nyquist: hedged ephemeral")
+
+	// hedgeCounter is a process-wide counter, ensuring that each hedged
+	// ephemeral key generation has distinct inputs.
+	hedgeCounter uint64
+)
+
+// hedgedRng returns the entropy source used to generate a hedged ephemeral
+// keypair, derived from the configured entropy source, a counter, the local
+// static private key (if any), and the handshake hash.
+func (hs *HandshakeState) hedgedRng() (io.Reader, error) {
+	var ikm []byte
+	defer func() {
+		zero(ikm)
+	}()
+
+	ikm = make([]byte, hedgeEntropySize+8, hedgeEntropySize+8+len(hs.ss.h)+hs.dhLen)
+	if _, err := io.ReadFull(hs.cfg.getRng(), ikm[:hedgeEntropySize]); err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint64(ikm[hedgeEntropySize:], atomic.AddUint64(&hedgeCounter, 1))
+	ikm = append(ikm, hs.ss.h...)
+	if hs.s != nil {
+		if sk, err := hs.s.MarshalBinary(); err == nil {
+			ikm = append(ikm, sk...)
+			zero(sk)
+		}
+	}
+
+	return hkdf.New(hs.cfg.Protocol.Hash.New, ikm, hedgeLabel, nil), nil
+}
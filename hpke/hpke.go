@@ -0,0 +1,537 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package hpke implements RFC 9180 Hybrid Public Key Encryption with the
+// DHKEM(X25519, HKDF-SHA256) KEM, using nyquist X25519 keys, so that
+// systems standardizing on HPKE for at-rest payloads can share static
+// key material and identities with their Noise transport.
+//
+// All four modes are supported.  The auth modes authenticate the sender's
+// static key, as with the `K` and `X` one-way patterns.  SuiteForProtocol
+// maps a Noise protocol to the corresponding HPKE cipher suite.
+package hpke // import "gitlab.com/yawning/nyquist.git/hpke"
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	gohash "hash"
+	"io"
+	"math"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+// KEMX25519HKDFSHA256 is the DHKEM(X25519, HKDF-SHA256) KEM identifier.
+const KEMX25519HKDFSHA256 = 0x0020
+
+// KDF is an HPKE KDF identifier.
+type KDF uint16
+
+const (
+	// KDFHKDFSHA256 is HKDF-SHA256.
+	KDFHKDFSHA256 KDF = 0x0001
+
+	// KDFHKDFSHA512 is HKDF-SHA512.
+	KDFHKDFSHA512 KDF = 0x0003
+)
+
+func (kdf KDF) hash() func() gohash.Hash {
+	switch kdf {
+	case KDFHKDFSHA256:
+		return sha256.New
+	case KDFHKDFSHA512:
+		return sha512.New
+	default:
+		return nil
+	}
+}
+
+// AEAD is an HPKE AEAD identifier.
+type AEAD uint16
+
+const (
+	// AEADAES128GCM is AES-128-GCM.
+	AEADAES128GCM AEAD = 0x0001
+
+	// AEADAES256GCM is AES-256-GCM.
+	AEADAES256GCM AEAD = 0x0002
+
+	// AEADChaCha20Poly1305 is ChaCha20Poly1305.
+	AEADChaCha20Poly1305 AEAD = 0x0003
+)
+
+func (aead AEAD) keySize() int {
+	switch aead {
+	case AEADAES128GCM:
+		return 16
+	case AEADAES256GCM, AEADChaCha20Poly1305:
+		return 32
+	default:
+		return 0
+	}
+}
+
+func (aead AEAD) new(key []byte) (cipher.AEAD, error) {
+	switch aead {
+	case AEADAES128GCM, AEADAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case AEADChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	default:
+		return nil, ErrUnsupported
+	}
+}
+
+// Mode is an HPKE mode.
+type Mode byte
+
+const (
+	// ModeBase is the base mode.
+	ModeBase Mode = 0x00
+
+	// ModePSK is the pre-shared key mode.
+	ModePSK Mode = 0x01
+
+	// ModeAuth is the sender authenticated mode.
+	ModeAuth Mode = 0x02
+
+	// ModeAuthPSK is the sender authenticated pre-shared key mode.
+	ModeAuthPSK Mode = 0x03
+)
+
+const (
+	versionLabel = "HPKE-v1"
+	nonceSize    = 12
+	x25519Size   = 32
+)
+
+var (
+	// ErrUnsupported is the error returned when a cipher suite, key, or
+	// protocol is not supported.
+	ErrUnsupported = errors.New("nyquist/hpke: unsupported suite or key")
+
+	// ErrOpen is the error returned when decryption fails.
+	ErrOpen = errors.New("nyquist/hpke: message authentication failed")
+
+	errInvalidPSK       = errors.New("nyquist/hpke: invalid PSK inputs")
+	errInvalidEnc       = errors.New("nyquist/hpke: invalid encapsulated key")
+	errZeroSharedSecret = errors.New("nyquist/hpke: all-zero shared secret")
+	errMessageLimit     = errors.New("nyquist/hpke: message limit reached")
+	errExportSize       = errors.New("nyquist/hpke: invalid export size")
+	errRoleMismatch     = errors.New("nyquist/hpke: operation invalid for role")
+)
+
+// Suite is an HPKE cipher suite, with the DHKEM(X25519, HKDF-SHA256) KEM.
+type Suite struct {
+	// KDF is the KDF.
+	KDF KDF
+
+	// AEAD is the AEAD.
+	AEAD AEAD
+}
+
+// SuiteForProtocol returns the HPKE cipher suite that uses the same
+// primitives as the Noise protocol.  The protocol must use the 25519 DH
+// function, and a SHA-2 hash function.
+func SuiteForProtocol(protocol *nyquist.Protocol) (*Suite, error) {
+	if protocol.DH != dh.X25519 {
+		return nil, ErrUnsupported
+	}
+
+	var suite Suite
+	switch protocol.Hash.String() {
+	case "SHA256":
+		suite.KDF = KDFHKDFSHA256
+	case "SHA512":
+		suite.KDF = KDFHKDFSHA512
+	default:
+		return nil, ErrUnsupported
+	}
+	switch protocol.Cipher.String() {
+	case "ChaChaPoly":
+		suite.AEAD = AEADChaCha20Poly1305
+	case "AESGCM":
+		suite.AEAD = AEADAES256GCM
+	default:
+		return nil, ErrUnsupported
+	}
+
+	return &suite, nil
+}
+
+func (suite *Suite) id() []byte {
+	b := []byte("HPKE")
+	b = appendUint16(b, KEMX25519HKDFSHA256)
+	b = appendUint16(b, uint16(suite.KDF))
+	return appendUint16(b, uint16(suite.AEAD))
+}
+
+func (suite *Suite) validate() error {
+	if suite.KDF.hash() == nil || suite.AEAD.keySize() == 0 {
+		return ErrUnsupported
+	}
+	return nil
+}
+
+// labeledKDF is LabeledExtract/LabeledExpand for a given suite_id.
+type labeledKDF struct {
+	hash    func() gohash.Hash
+	suiteID []byte
+}
+
+func (k *labeledKDF) extract(salt []byte, label string, ikm []byte) []byte {
+	b := make([]byte, 0, len(versionLabel)+len(k.suiteID)+len(label)+len(ikm))
+	b = append(b, versionLabel...)
+	b = append(b, k.suiteID...)
+	b = append(b, label...)
+	b = append(b, ikm...)
+	return hkdf.Extract(k.hash, b, salt)
+}
+
+func (k *labeledKDF) expand(prk []byte, label string, info []byte, length int) []byte {
+	b := appendUint16(nil, uint16(length))
+	b = append(b, versionLabel...)
+	b = append(b, k.suiteID...)
+	b = append(b, label...)
+	b = append(b, info...)
+
+	out := make([]byte, length)
+	_, _ = io.ReadFull(hkdf.Expand(k.hash, prk, b), out)
+	return out
+}
+
+var kemKDF = &labeledKDF{
+	hash:    sha256.New,
+	suiteID: appendUint16([]byte("KEM"), KEMX25519HKDFSHA256),
+}
+
+// DeriveKeypair deterministically derives an X25519 keypair from the
+// input keying material, which must have at least 32 bytes of entropy.
+func DeriveKeypair(ikm []byte) (dh.Keypair, error) {
+	prk := kemKDF.extract(nil, "dkp_prk", ikm)
+	sk := kemKDF.expand(prk, "sk", nil, x25519Size)
+	return dh.X25519.ParsePrivateKey(sk)
+}
+
+func x25519DH(kp dh.Keypair, pk dh.PublicKey) ([]byte, error) {
+	if _, ok := kp.(*dh.Keypair25519); !ok {
+		return nil, ErrUnsupported
+	}
+	if _, ok := pk.(*dh.PublicKey25519); !ok {
+		return nil, ErrUnsupported
+	}
+
+	ss, err := kp.DH(pk)
+	if err != nil {
+		return nil, err
+	}
+	var acc byte
+	for _, v := range ss {
+		acc |= v
+	}
+	if acc == 0 {
+		return nil, errZeroSharedSecret
+	}
+	return ss, nil
+}
+
+func kemSharedSecret(dhs, kemContext []byte) []byte {
+	prk := kemKDF.extract(nil, "eae_prk", dhs)
+	return kemKDF.expand(prk, "shared_secret", kemContext, sha256.Size)
+}
+
+// Config is an HPKE sender or recipient configuration.
+type Config struct {
+	// Suite is the cipher suite.
+	Suite *Suite
+
+	// Info is the application supplied information.
+	Info []byte
+
+	// PreSharedKey and PreSharedKeyID are the optional pre-shared key
+	// and its identifier, for the PSK modes.
+	PreSharedKey   []byte
+	PreSharedKeyID []byte
+
+	// LocalStatic is the local static keypair.  When sending, this is the
+	// sender's keypair (auth modes only), when receiving, this is the
+	// recipient's keypair.
+	LocalStatic dh.Keypair
+
+	// RemoteStatic is the remote static public key.  When sending, this
+	// is the recipient's public key, when receiving, this is the sender's
+	// public key (auth modes only).
+	RemoteStatic dh.PublicKey
+
+	// Rng is the entropy source to be used when sending.  If unset,
+	// crypto/rand.Reader will be used.
+	Rng io.Reader
+}
+
+func (cfg *Config) mode(isSender bool) (Mode, error) {
+	hasPSK, hasPSKID := len(cfg.PreSharedKey) > 0, len(cfg.PreSharedKeyID) > 0
+	if hasPSK != hasPSKID || (hasPSK && len(cfg.PreSharedKey) < 32) {
+		return 0, errInvalidPSK
+	}
+
+	isAuth := (isSender && cfg.LocalStatic != nil) || (!isSender && cfg.RemoteStatic != nil)
+	switch {
+	case isAuth && hasPSK:
+		return ModeAuthPSK, nil
+	case isAuth:
+		return ModeAuth, nil
+	case hasPSK:
+		return ModePSK, nil
+	default:
+		return ModeBase, nil
+	}
+}
+
+// Context is an HPKE encryption context.
+type Context struct {
+	aead cipher.AEAD
+	kdf  *labeledKDF
+
+	baseNonce      []byte
+	exporterSecret []byte
+	seq            uint64
+	isSender       bool
+}
+
+// NewSender creates a new sender context to cfg.RemoteStatic, and returns
+// the encapsulated key, to be sent to the recipient, and the context.
+func NewSender(cfg *Config) ([]byte, *Context, error) {
+	mode, err := cfg.mode(true)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.RemoteStatic == nil {
+		return nil, nil, ErrUnsupported
+	}
+
+	rng := cfg.Rng
+	if rng == nil {
+		rng = rand.Reader
+	}
+	ikm := make([]byte, x25519Size)
+	if _, err = io.ReadFull(rng, ikm); err != nil {
+		return nil, nil, err
+	}
+	ephemeral, err := DeriveKeypair(ikm)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ephemeral.DropPrivate()
+
+	dhs, err := x25519DH(ephemeral, cfg.RemoteStatic)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc := ephemeral.Public().Bytes()
+	kemContext := append(append([]byte{}, enc...), cfg.RemoteStatic.Bytes()...)
+	if mode == ModeAuth || mode == ModeAuthPSK {
+		dhAuth, err := x25519DH(cfg.LocalStatic, cfg.RemoteStatic)
+		if err != nil {
+			return nil, nil, err
+		}
+		dhs = append(dhs, dhAuth...)
+		kemContext = append(kemContext, cfg.LocalStatic.Public().Bytes()...)
+	}
+
+	ctx, err := newContext(cfg, mode, kemSharedSecret(dhs, kemContext), true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, ctx, nil
+}
+
+// NewRecipient creates a new recipient context for cfg.LocalStatic, from
+// the encapsulated key sent by the sender.
+func NewRecipient(cfg *Config, enc []byte) (*Context, error) {
+	mode, err := cfg.mode(false)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.LocalStatic == nil {
+		return nil, ErrUnsupported
+	}
+
+	pkE, err := dh.X25519.ParsePublicKey(enc)
+	if err != nil {
+		return nil, errInvalidEnc
+	}
+	dhs, err := x25519DH(cfg.LocalStatic, pkE)
+	if err != nil {
+		return nil, err
+	}
+	kemContext := append(append([]byte{}, enc...), cfg.LocalStatic.Public().Bytes()...)
+	if mode == ModeAuth || mode == ModeAuthPSK {
+		dhAuth, err := x25519DH(cfg.LocalStatic, cfg.RemoteStatic)
+		if err != nil {
+			return nil, err
+		}
+		dhs = append(dhs, dhAuth...)
+		kemContext = append(kemContext, cfg.RemoteStatic.Bytes()...)
+	}
+
+	return newContext(cfg, mode, kemSharedSecret(dhs, kemContext), false)
+}
+
+func newContext(cfg *Config, mode Mode, sharedSecret []byte, isSender bool) (*Context, error) {
+	if cfg.Suite == nil {
+		return nil, ErrUnsupported
+	}
+	if err := cfg.Suite.validate(); err != nil {
+		return nil, err
+	}
+
+	kdf := &labeledKDF{
+		hash:    cfg.Suite.KDF.hash(),
+		suiteID: cfg.Suite.id(),
+	}
+	keyScheduleContext := []byte{byte(mode)}
+	keyScheduleContext = append(keyScheduleContext, kdf.extract(nil, "psk_id_hash", cfg.PreSharedKeyID)...)
+	keyScheduleContext = append(keyScheduleContext, kdf.extract(nil, "info_hash", cfg.Info)...)
+
+	secret := kdf.extract(sharedSecret, "secret", cfg.PreSharedKey)
+	key := kdf.expand(secret, "key", keyScheduleContext, cfg.Suite.AEAD.keySize())
+	aead, err := cfg.Suite.AEAD.new(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Context{
+		aead:           aead,
+		kdf:            kdf,
+		baseNonce:      kdf.expand(secret, "base_nonce", keyScheduleContext, nonceSize),
+		exporterSecret: kdf.expand(secret, "exp", keyScheduleContext, kdf.hash().Size()),
+		isSender:       isSender,
+	}, nil
+}
+
+// nonce returns the nonce for the current sequence number.
+func (ctx *Context) nonce() ([]byte, error) {
+	if ctx.seq == math.MaxUint64 {
+		return nil, errMessageLimit
+	}
+
+	nonce := append([]byte{}, ctx.baseNonce...)
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], ctx.seq)
+	for i, v := range seq {
+		nonce[nonceSize-8+i] ^= v
+	}
+
+	return nonce, nil
+}
+
+// Seal encrypts and authenticates plaintext, and authenticates aad.  It
+// may only be called on a sender context.
+func (ctx *Context) Seal(aad, plaintext []byte) ([]byte, error) {
+	if !ctx.isSender {
+		return nil, errRoleMismatch
+	}
+	nonce, err := ctx.nonce()
+	if err != nil {
+		return nil, err
+	}
+	ctx.seq++
+
+	return ctx.aead.Seal(nil, nonce, plaintext, aad), nil
+}
+
+// Open decrypts and authenticates ciphertext, and authenticates aad.  It
+// may only be called on a recipient context.
+func (ctx *Context) Open(aad, ciphertext []byte) ([]byte, error) {
+	if ctx.isSender {
+		return nil, errRoleMismatch
+	}
+	nonce, err := ctx.nonce()
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := ctx.aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, ErrOpen
+	}
+	ctx.seq++
+
+	return plaintext, nil
+}
+
+// Export derives a secret of the specified length from the context, and
+// the exporter context.
+func (ctx *Context) Export(exporterContext []byte, length int) ([]byte, error) {
+	if length <= 0 || length > 255*ctx.kdf.hash().Size() {
+		return nil, errExportSize
+	}
+	return ctx.kdf.expand(ctx.exporterSecret, "sec", exporterContext, length), nil
+}
+
+// Seal is a single-shot HPKE encryption of plaintext to cfg.RemoteStatic,
+// and returns the encapsulated key and the ciphertext.
+func Seal(cfg *Config, aad, plaintext []byte) ([]byte, []byte, error) {
+	enc, ctx, err := NewSender(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	ct, err := ctx.Seal(aad, plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, ct, nil
+}
+
+// Open is a single-shot HPKE decryption with cfg.LocalStatic.
+func Open(cfg *Config, enc, aad, ciphertext []byte) ([]byte, error) {
+	ctx, err := NewRecipient(cfg, enc)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.Open(aad, ciphertext)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	var tmp [2]byte
+	binary.BigEndian.PutUint16(tmp[:], v)
+	return append(b, tmp[:]...)
+}
@@ -0,0 +1,238 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package hpke
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+func mustUnhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err, "hex.DecodeString")
+	return b
+}
+
+func TestVector(t *testing.T) {
+	require := require.New(t)
+
+	// RFC 9180 Appendix A.1.1: DHKEM(X25519, HKDF-SHA256), HKDF-SHA256,
+	// AES-128-GCM, Base mode.
+	ikmE := mustUnhex(t, "7268600d403fce431561aef583ee1613527cff655c1343f29812e66706df3234")
+	ikmR := mustUnhex(t, "6db9df30aa07dd42ee5e8181afdb977e538f5e1fec8a06223f33f7013e525037")
+	info := mustUnhex(t, "4f6465206f6e2061204772656369616e2055726e")
+	pt := mustUnhex(t, "4265617574792069732074727574682c20747275746820626561757479")
+
+	kpR, err := DeriveKeypair(ikmR)
+	require.NoError(err, "DeriveKeypair(ikmR)")
+	skR, err := kpR.MarshalBinary()
+	require.NoError(err, "MarshalBinary")
+	require.Equal(mustUnhex(t, "4612c550263fc8ad58375df3f557aac531d26850903e55a9f23f21d8534e8ac8"), skR, "skRm")
+
+	suite := &Suite{KDF: KDFHKDFSHA256, AEAD: AEADAES128GCM}
+	enc, sender, err := NewSender(&Config{
+		Suite:        suite,
+		Info:         info,
+		RemoteStatic: kpR.Public(),
+		Rng:          bytes.NewReader(ikmE),
+	})
+	require.NoError(err, "NewSender")
+	require.Equal(mustUnhex(t, "37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431"), enc, "enc")
+
+	recipient, err := NewRecipient(&Config{
+		Suite:       suite,
+		Info:        info,
+		LocalStatic: kpR,
+	}, enc)
+	require.NoError(err, "NewRecipient")
+
+	ct, err := sender.Seal(mustUnhex(t, "436f756e742d30"), pt)
+	require.NoError(err, "Seal")
+	require.Equal(mustUnhex(t, "f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a"), ct, "ct - sequence 0")
+	opened, err := recipient.Open(mustUnhex(t, "436f756e742d30"), ct)
+	require.NoError(err, "Open")
+	require.Equal(pt, opened, "Open")
+
+	for _, ctx := range []*Context{sender, recipient} {
+		exported, err := ctx.Export(nil, 32)
+		require.NoError(err, "Export")
+		require.Equal(mustUnhex(t, "3853fe2b4035195a573ffc53856e77058e15d9ea064de3e59f4961d0095250ee"), exported, "Export")
+	}
+}
+
+func TestHPKE(t *testing.T) {
+	// HPKE keys are ordinary nyquist X25519 keys.
+	recipient, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(t, err, "GenerateKeypair - recipient")
+	sender, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(t, err, "GenerateKeypair - sender")
+	other, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(t, err, "GenerateKeypair - other")
+
+	psk := make([]byte, 32)
+	_, _ = rand.Read(psk)
+	pskID := []byte("psk id")
+	aad, pt := []byte("aad"), []byte("at-rest payload")
+
+	t.Run("Modes", func(t *testing.T) {
+		for _, v := range []struct {
+			name   string
+			mode   Mode
+			auth   bool
+			hasPSK bool
+		}{
+			{"Base", ModeBase, false, false},
+			{"PSK", ModePSK, false, true},
+			{"Auth", ModeAuth, true, false},
+			{"AuthPSK", ModeAuthPSK, true, true},
+		} {
+			t.Run(v.name, func(t *testing.T) {
+				require := require.New(t)
+
+				suite := &Suite{KDF: KDFHKDFSHA512, AEAD: AEADChaCha20Poly1305}
+				sealCfg := &Config{Suite: suite, Info: []byte("info"), RemoteStatic: recipient.Public()}
+				openCfg := &Config{Suite: suite, Info: []byte("info"), LocalStatic: recipient}
+				if v.auth {
+					sealCfg.LocalStatic = sender
+					openCfg.RemoteStatic = sender.Public()
+				}
+				if v.hasPSK {
+					sealCfg.PreSharedKey, sealCfg.PreSharedKeyID = psk, pskID
+					openCfg.PreSharedKey, openCfg.PreSharedKeyID = psk, pskID
+				}
+				mode, err := sealCfg.mode(true)
+				require.NoError(err, "mode")
+				require.Equal(v.mode, mode, "mode")
+
+				enc, ct, err := Seal(sealCfg, aad, pt)
+				require.NoError(err, "Seal")
+				opened, err := Open(openCfg, enc, aad, ct)
+				require.NoError(err, "Open")
+				require.Equal(pt, opened, "Open")
+
+				_, err = Open(&Config{Suite: suite, Info: []byte("info"), LocalStatic: other}, enc, aad, ct)
+				require.Equal(ErrOpen, err, "Open - wrong recipient")
+				_, err = Open(openCfg, enc, []byte("wrong aad"), ct)
+				require.Equal(ErrOpen, err, "Open - wrong aad")
+				if v.auth {
+					badCfg := *openCfg
+					badCfg.RemoteStatic = other.Public()
+					_, err = Open(&badCfg, enc, aad, ct)
+					require.Equal(ErrOpen, err, "Open - wrong sender")
+				}
+			})
+		}
+	})
+
+	t.Run("Context", func(t *testing.T) {
+		require := require.New(t)
+
+		suite := &Suite{KDF: KDFHKDFSHA256, AEAD: AEADAES256GCM}
+		enc, s, err := NewSender(&Config{Suite: suite, RemoteStatic: recipient.Public()})
+		require.NoError(err, "NewSender")
+		r, err := NewRecipient(&Config{Suite: suite, LocalStatic: recipient}, enc)
+		require.NoError(err, "NewRecipient")
+
+		var cts [][]byte
+		for i := 0; i < 3; i++ {
+			ct, err := s.Seal(nil, []byte{byte(i)})
+			require.NoError(err, "Seal(%d)", i)
+			cts = append(cts, ct)
+		}
+		_, err = r.Open(nil, cts[1])
+		require.Equal(ErrOpen, err, "Open - out of order")
+		for i, ct := range cts {
+			opened, err := r.Open(nil, ct)
+			require.NoError(err, "Open(%d)", i)
+			require.Equal([]byte{byte(i)}, opened, "Open(%d)", i)
+		}
+
+		_, err = s.Open(nil, cts[0])
+		require.Equal(errRoleMismatch, err, "sender.Open")
+		_, err = r.Seal(nil, pt)
+		require.Equal(errRoleMismatch, err, "recipient.Seal")
+		_, err = s.Export(nil, 0)
+		require.Equal(errExportSize, err, "Export - 0 bytes")
+	})
+
+	t.Run("InvalidConfig", func(t *testing.T) {
+		require := require.New(t)
+
+		suite := &Suite{KDF: KDFHKDFSHA256, AEAD: AEADChaCha20Poly1305}
+		_, _, err := Seal(&Config{Suite: suite, RemoteStatic: recipient.Public(), PreSharedKey: psk}, nil, pt)
+		require.Equal(errInvalidPSK, err, "Seal - PSK without ID")
+		_, _, err = Seal(&Config{Suite: suite, RemoteStatic: recipient.Public(), PreSharedKey: psk[:16], PreSharedKeyID: pskID}, nil, pt)
+		require.Equal(errInvalidPSK, err, "Seal - short PSK")
+		_, _, err = Seal(&Config{Suite: &Suite{KDF: 0x0002, AEAD: AEADChaCha20Poly1305}, RemoteStatic: recipient.Public()}, nil, pt)
+		require.Equal(ErrUnsupported, err, "Seal - unsupported KDF")
+
+		if alg := dh.FromString("448"); alg != nil {
+			x448, err := alg.GenerateKeypair(rand.Reader)
+			require.NoError(err, "GenerateKeypair - X448")
+			_, _, err = Seal(&Config{Suite: suite, RemoteStatic: x448.Public()}, nil, pt)
+			require.Equal(ErrUnsupported, err, "Seal - X448 recipient")
+		}
+
+		_, err = Open(&Config{Suite: suite, LocalStatic: recipient}, make([]byte, 32), nil, pt)
+		require.Equal(errZeroSharedSecret, err, "Open - low order enc")
+	})
+}
+
+func TestSuiteForProtocol(t *testing.T) {
+	for _, v := range []struct {
+		protocol string
+		suite    *Suite
+	}{
+		{"Noise_XX_25519_ChaChaPoly_SHA256", &Suite{KDF: KDFHKDFSHA256, AEAD: AEADChaCha20Poly1305}},
+		{"Noise_N_25519_AESGCM_SHA512", &Suite{KDF: KDFHKDFSHA512, AEAD: AEADAES256GCM}},
+		{"Noise_XX_25519_ChaChaPoly_BLAKE2s", nil},
+		{"Noise_XX_448_ChaChaPoly_SHA256", nil},
+	} {
+		protocol, err := nyquist.NewProtocol(v.protocol)
+		if err != nil {
+			// X448 may be omitted from the build.
+			continue
+		}
+		suite, err := SuiteForProtocol(protocol)
+		if v.suite == nil {
+			require.Equal(t, ErrUnsupported, err, "SuiteForProtocol(%s)", v.protocol)
+			continue
+		}
+		require.NoError(t, err, "SuiteForProtocol(%s)", v.protocol)
+		require.Equal(t, v.suite, suite, "SuiteForProtocol(%s)", v.protocol)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package gost
+
+import (
+	"crypto/cipher"
+	"errors"
+)
+
+const (
+	// BlockSize is the Kuznyechik block size in bytes.
+	BlockSize = 16
+
+	// KeySize is the Kuznyechik key size in bytes.
+	KeySize = 32
+
+	kuzRounds = 10
+)
+
+var (
+	errInvalidKeySize = errors.New("nyquist/internal/gost: invalid key size")
+
+	// kuzLinear are the coefficients of the linear function l.
+	kuzLinear = [BlockSize]byte{
+		148, 32, 133, 16, 194, 192, 1, 251, 1, 192, 194, 16, 133, 32, 148, 1,
+	}
+
+	piInv     [256]byte
+	kuzEncLS  [BlockSize][256][BlockSize]byte // L(S(x)), per byte position.
+	kuzDecL   [BlockSize][256][BlockSize]byte // L^-1(x), per byte position.
+	kuzRoundC [32][BlockSize]byte
+)
+
+// gfMul multiplies in GF(2^8) with the polynomial x^8 + x^7 + x^6 + x + 1.
+func gfMul(a, b byte) byte {
+	var r byte
+	for b != 0 {
+		if b&1 != 0 {
+			r ^= a
+		}
+		a = a<<1 ^ (0xc3 & -(a >> 7))
+		b >>= 1
+	}
+	return r
+}
+
+func kuzR(b *[BlockSize]byte) {
+	var t byte
+	for i, c := range kuzLinear {
+		t ^= gfMul(b[i], c)
+	}
+	copy(b[1:], b[:BlockSize-1])
+	b[0] = t
+}
+
+func kuzRInv(b *[BlockSize]byte) {
+	t := b[0]
+	copy(b[:BlockSize-1], b[1:])
+	b[BlockSize-1] = t
+	for i, c := range kuzLinear[:BlockSize-1] {
+		b[BlockSize-1] ^= gfMul(b[i], c)
+	}
+}
+
+func kuzL(b *[BlockSize]byte) {
+	for i := 0; i < BlockSize; i++ {
+		kuzR(b)
+	}
+}
+
+func kuzLInv(b *[BlockSize]byte) {
+	for i := 0; i < BlockSize; i++ {
+		kuzRInv(b)
+	}
+}
+
+// Kuznyechik is a keyed Kuznyechik instance.
+type Kuznyechik struct {
+	encKeys [kuzRounds][BlockSize]byte
+}
+
+// BlockSize returns the Kuznyechik block size.
+func (k *Kuznyechik) BlockSize() int {
+	return BlockSize
+}
+
+// Encrypt encrypts the first block in src into dst.
+func (k *Kuznyechik) Encrypt(dst, src []byte) {
+	if len(src) < BlockSize || len(dst) < BlockSize {
+		panic("nyquist/internal/gost: invalid block")
+	}
+
+	var b [BlockSize]byte
+	copy(b[:], src)
+	for i := 0; i < kuzRounds-1; i++ {
+		xorBlock(&b, &k.encKeys[i])
+		b = lookupLinear(&kuzEncLS, &b)
+	}
+	xorBlock(&b, &k.encKeys[kuzRounds-1])
+	copy(dst, b[:])
+}
+
+// Decrypt decrypts the first block in src into dst.
+func (k *Kuznyechik) Decrypt(dst, src []byte) {
+	if len(src) < BlockSize || len(dst) < BlockSize {
+		panic("nyquist/internal/gost: invalid block")
+	}
+
+	var b [BlockSize]byte
+	copy(b[:], src)
+	for i := kuzRounds - 1; i > 0; i-- {
+		xorBlock(&b, &k.encKeys[i])
+		b = lookupLinear(&kuzDecL, &b)
+		for j := range b {
+			b[j] = piInv[b[j]]
+		}
+	}
+	xorBlock(&b, &k.encKeys[0])
+	copy(dst, b[:])
+}
+
+// Reset overwrites the key schedule.
+func (k *Kuznyechik) Reset() {
+	k.encKeys = [kuzRounds][BlockSize]byte{}
+}
+
+// NewKuznyechik creates a new Kuznyechik instance with the provided key.
+func NewKuznyechik(key []byte) (*Kuznyechik, error) {
+	var k Kuznyechik
+	if err := k.SetKey(key); err != nil {
+		return nil, err
+	}
+
+	return &k, nil
+}
+
+// SetKey re-keys the Kuznyechik instance in place.
+func (k *Kuznyechik) SetKey(key []byte) error {
+	if len(key) != KeySize {
+		return errInvalidKeySize
+	}
+
+	copy(k.encKeys[0][:], key[:BlockSize])
+	copy(k.encKeys[1][:], key[BlockSize:])
+	for i := 0; i < 4; i++ {
+		a1, a0 := k.encKeys[2*i], k.encKeys[2*i+1]
+		for j := 0; j < 8; j++ {
+			// F[C](a1, a0) = (LSX[C](a1) ^ a0, a1)
+			t := a1
+			xorBlock(&t, &kuzRoundC[8*i+j])
+			t = lookupLinear(&kuzEncLS, &t)
+			xorBlock(&t, &a0)
+			a1, a0 = t, a1
+		}
+		k.encKeys[2*i+2], k.encKeys[2*i+3] = a1, a0
+	}
+
+	return nil
+}
+
+var _ cipher.Block = (*Kuznyechik)(nil)
+
+func xorBlock(dst, src *[BlockSize]byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+func lookupLinear(tbl *[BlockSize][256][BlockSize]byte, b *[BlockSize]byte) [BlockSize]byte {
+	var r [BlockSize]byte
+	for i, v := range b {
+		xorBlock(&r, &tbl[i][v])
+	}
+	return r
+}
+
+func init() {
+	for i, v := range pi {
+		piInv[v] = byte(i)
+	}
+	for i := 0; i < BlockSize; i++ {
+		for v := 0; v < 256; v++ {
+			var b [BlockSize]byte
+			b[i] = pi[v]
+			kuzL(&b)
+			kuzEncLS[i][v] = b
+
+			b = [BlockSize]byte{}
+			b[i] = byte(v)
+			kuzLInv(&b)
+			kuzDecL[i][v] = b
+		}
+	}
+	for i := range kuzRoundC {
+		kuzRoundC[i][BlockSize-1] = byte(i + 1)
+		kuzL(&kuzRoundC[i])
+	}
+}
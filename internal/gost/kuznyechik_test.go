@@ -0,0 +1,69 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package gost
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func mustUnhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestKuznyechik(t *testing.T) {
+	require := require.New(t)
+
+	// RFC 7801 Section 5.
+	key := mustUnhex("8899aabbccddeeff0011223344556677fedcba98765432100123456789abcdef")
+	pt := mustUnhex("1122334455667700ffeeddccbbaa9988")
+	ct := mustUnhex("7f679d90bebc24305a468d42b9d4edcd")
+
+	k, err := NewKuznyechik(key)
+	require.NoError(err, "NewKuznyechik")
+	require.Equal(mustUnhex("8899aabbccddeeff0011223344556677"), k.encKeys[0][:], "K1")
+	require.Equal(mustUnhex("db31485315694343228d6aef8cc78c44"), k.encKeys[2][:], "K3")
+	require.Equal(mustUnhex("72e9dd7416bcf45b755dbaa88e4a4043"), k.encKeys[kuzRounds-1][:], "K10")
+
+	b := make([]byte, BlockSize)
+	k.Encrypt(b, pt)
+	require.Equal(ct, b, "Encrypt")
+	k.Decrypt(b, b)
+	require.Equal(pt, b, "Decrypt")
+
+	_, err = NewKuznyechik(key[1:])
+	require.Equal(errInvalidKeySize, err, "NewKuznyechik - truncated key")
+}
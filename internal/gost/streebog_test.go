@@ -0,0 +1,99 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package gost
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// reversed converts the RFC 6986 test messages, which are written as
+// big-endian integers, to byte strings.
+func reversed(s string) []byte {
+	b := mustUnhex(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b
+}
+
+func TestStreebog(t *testing.T) {
+	// RFC 6986 Section 10.  Digests are serialized in little-endian byte
+	// order, per the common convention.
+	m1 := reversed("323130393837363534333231303938373635343332313039383736353433323130393837363534333231303938373635343332313039383736353433323130")
+	m2 := reversed("fbe2e5f0eee3c820fbeafaebef20fffbf0e1e0f0f520e0ed20e8ece0ebe5f0f2f120fff0eeec20f120faf2fee5e2202ce8f6f3ede220e8e6eee1e8f0f2d1202ce8f0f2e5e220e5d1")
+	require.Equal(t, []byte("012345678901234567890123456789012345678901234567890123456789012"), m1, "M1")
+
+	for _, v := range []struct {
+		n        string
+		size     int
+		msg      []byte
+		expected []byte
+	}{
+		{"512/M1", Size512, m1, mustUnhex("1b54d01a4af5b9d5cc3d86d68d285462b19abc2475222f35c085122be4ba1ffa00ad30f8767b3a82384c6574f024c311e2a481332b08ef7f41797891c1646f48")},
+		{"256/M1", Size256, m1, mustUnhex("9d151eefd8590b89daa6ba6cb74af9275dd051026bb149a452fd84e5e57b5500")},
+		{"512/M2", Size512, m2, mustUnhex("1e88e62226bfca6f9994f1f2d51569e0daf8475a3b0fe61a5300eee46d961376035fe83549ada2b8620fcd7c496ce5b33f0cb9dddc2b6460143b03dabac9fb28")},
+		{"256/M2", Size256, m2, mustUnhex("9dd2fe4e90409e5da87f53976d7405b0c0cac628fc669a741d50063c557e8f50")},
+	} {
+		t.Run(v.n, func(t *testing.T) {
+			require := require.New(t)
+
+			h := newStreebog(v.size)
+			_, _ = h.Write(v.msg)
+			require.Equal(v.expected, h.Sum(nil), "Sum")
+			require.Equal(v.expected, h.Sum(nil), "Sum - again")
+
+			// Incremental writes must match.
+			h.Reset()
+			for _, b := range v.msg {
+				_, _ = h.Write([]byte{b})
+			}
+			require.Equal(v.expected, h.Sum(nil), "Sum - incremental")
+		})
+	}
+
+	// Multiple blocks, and a message that is an exact multiple of the
+	// block size.
+	t.Run("Blocks", func(t *testing.T) {
+		require := require.New(t)
+
+		msg := bytes.Repeat([]byte{0xa5}, 3*StreebogBlockSize)
+		h := NewStreebog256()
+		_, _ = h.Write(msg)
+		expected := h.Sum(nil)
+
+		h.Reset()
+		_, _ = h.Write(msg[:StreebogBlockSize+7])
+		_, _ = h.Write(msg[StreebogBlockSize+7:])
+		require.Equal(expected, h.Sum(nil), "Sum - split")
+	})
+}
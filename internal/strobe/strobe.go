@@ -0,0 +1,223 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package strobe implements the subset of the Strobe protocol framework
+// (v1.0.2, 128-bit security) required by Disco.
+package strobe // import "gitlab.com/yawning/nyquist.git/internal/strobe"
+
+const (
+	// Version is the Strobe version string.
+	Version = "STROBEv1.0.2"
+
+	stateSize = 200
+	strobeR   = stateSize - (2 * 128 / 8) - 2
+)
+
+type flag uint8
+
+const (
+	flagI flag = 1 << iota
+	flagA
+	flagC
+	flagT
+	flagM
+	flagK
+
+	opAD      = flagA
+	opKEY     = flagA | flagC
+	opPRF     = flagI | flagA | flagC
+	opSendCLR = flagA | flagT
+	opRecvCLR = flagI | flagA | flagT
+	opSendENC = flagA | flagC | flagT
+	opRecvENC = flagI | flagA | flagC | flagT
+	opSendMAC = flagC | flagT
+	opRecvMAC = flagI | flagC | flagT
+	opRATCHET = flagC
+)
+
+type role uint8
+
+const (
+	roleInitiator role = iota
+	roleResponder
+	roleNone
+)
+
+// Strobe is a Strobe-128/1600 instance.  Instances may be copied by value
+// to clone the state.
+type Strobe struct {
+	st          [stateSize]byte
+	pos         int
+	posBegin    uint8
+	i0          role
+	initialized bool
+}
+
+// New returns a new Strobe instance, initialized with the customization
+// string.
+func New(customization []byte) *Strobe {
+	s := &Strobe{
+		i0: roleNone,
+	}
+
+	domain := []byte{1, strobeR + 2, 1, 0, 1, 12 * 8}
+	domain = append(domain, Version...)
+	s.duplex(domain, false, false, true)
+	s.initialized = true
+	s.AD(true, customization)
+
+	return s
+}
+
+// Clone returns a copy of the Strobe instance.
+func (s *Strobe) Clone() *Strobe {
+	ret := *s
+	return &ret
+}
+
+// Reset sanitizes the Strobe instance.
+func (s *Strobe) Reset() {
+	for i := range s.st {
+		s.st[i] = 0
+	}
+	s.pos, s.posBegin = 0, 0
+}
+
+// AD absorbs associated data.
+func (s *Strobe) AD(meta bool, data []byte) {
+	s.operate(opAD, meta, append([]byte{}, data...))
+}
+
+// KEY absorbs a symmetric key.
+func (s *Strobe) KEY(key []byte) {
+	s.operate(opKEY, false, append([]byte{}, key...))
+}
+
+// PRF returns n bytes of pseudo-random output.
+func (s *Strobe) PRF(n int) []byte {
+	return s.operate(opPRF, false, make([]byte, n))
+}
+
+// SendCLR sends cleartext data.
+func (s *Strobe) SendCLR(meta bool, data []byte) {
+	s.operate(opSendCLR, meta, append([]byte{}, data...))
+}
+
+// RecvCLR receives cleartext data.
+func (s *Strobe) RecvCLR(meta bool, data []byte) {
+	s.operate(opRecvCLR, meta, append([]byte{}, data...))
+}
+
+// SendENC encrypts plaintext, and appends the ciphertext to dst.
+func (s *Strobe) SendENC(meta bool, dst, plaintext []byte) []byte {
+	return append(dst, s.operate(opSendENC, meta, append([]byte{}, plaintext...))...)
+}
+
+// RecvENC decrypts ciphertext, and appends the plaintext to dst.
+func (s *Strobe) RecvENC(meta bool, dst, ciphertext []byte) []byte {
+	return append(dst, s.operate(opRecvENC, meta, append([]byte{}, ciphertext...))...)
+}
+
+// SendMAC appends a n byte MAC to dst.
+func (s *Strobe) SendMAC(meta bool, dst []byte, n int) []byte {
+	return append(dst, s.operate(opSendMAC, meta, make([]byte, n))...)
+}
+
+// RecvMAC verifies a MAC, and returns true iff it is valid.
+func (s *Strobe) RecvMAC(meta bool, mac []byte) bool {
+	b := s.operate(opRecvMAC, meta, append([]byte{}, mac...))
+
+	var failures byte
+	for _, v := range b {
+		failures |= v
+	}
+	return failures == 0
+}
+
+// RATCHET overwrites n bytes of the state to prevent rollback.
+func (s *Strobe) RATCHET(n int) {
+	s.operate(opRATCHET, false, make([]byte, n))
+}
+
+func (s *Strobe) operate(flags flag, meta bool, data []byte) []byte {
+	if meta {
+		flags |= flagM
+	}
+	s.beginOp(flags)
+
+	cAfter := flags&(flagC|flagI|flagT) == flagC|flagT
+	cBefore := flags&flagC != 0 && !cAfter
+	s.duplex(data, cBefore, cAfter, false)
+
+	return data
+}
+
+func (s *Strobe) beginOp(flags flag) {
+	if flags&flagT != 0 {
+		if s.i0 == roleNone {
+			s.i0 = role(flags & flagI)
+		}
+		flags ^= flag(s.i0)
+	}
+
+	oldBegin := s.posBegin
+	s.posBegin = uint8(s.pos + 1)
+	forceF := flags&(flagC|flagK) != 0
+	s.duplex([]byte{oldBegin, byte(flags)}, false, false, forceF)
+}
+
+func (s *Strobe) duplex(data []byte, cBefore, cAfter, forceF bool) {
+	for i := range data {
+		if cBefore {
+			data[i] ^= s.st[s.pos]
+		}
+		s.st[s.pos] ^= data[i]
+		if cAfter {
+			data[i] = s.st[s.pos]
+		}
+		s.pos++
+		if s.pos == strobeR {
+			s.runF()
+		}
+	}
+	if forceF && s.pos != 0 {
+		s.runF()
+	}
+}
+
+func (s *Strobe) runF() {
+	if s.initialized {
+		s.st[s.pos] ^= s.posBegin
+		s.st[s.pos+1] ^= 0x04
+		s.st[strobeR+1] ^= 0x80
+	}
+	keccakF1600(&s.st)
+	s.pos = 0
+	s.posBegin = 0
+}
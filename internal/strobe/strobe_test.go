@@ -0,0 +1,88 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package strobe
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func mustUnhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	require.NoError(t, err, "hex.DecodeString")
+	return b
+}
+
+func TestStrobe(t *testing.T) {
+	// The "simple tests" test vector from StrobeGo.
+	t.Run("KAT", func(t *testing.T) {
+		require := require.New(t)
+
+		msg := []byte("hi how are you")
+
+		s := New([]byte("custom string"))
+		s.KEY([]byte("010101"))
+		s.AD(false, []byte("hello, how are you good sir?"))
+		require.Equal(mustUnhex(t, "5ce86d0815c02a27d8bdd923f2cb0bd8"), s.PRF(16), "PRF")
+		s.RATCHET(32)
+		require.Equal(mustUnhex(t, "5dfb4863302857637184a2e633b3"), s.SendENC(false, nil, msg), "SendENC")
+		require.Equal(mustUnhex(t, "579edbad40d64825e61024808a36"), s.RecvENC(false, nil, msg), "RecvENC")
+		require.Equal(mustUnhex(t, "dbc27e18c45c707da242c782a4dbd9ca"), s.SendMAC(false, nil, 16), "SendMAC")
+		require.False(s.RecvMAC(false, msg), "RecvMAC")
+		s.SendCLR(false, msg)
+		s.RecvCLR(false, msg)
+
+		expectedState := mustUnhex(t, "686920686f772061726520796f753cb8aa00ef1fbb00603fa6db593ee0286ad398f3980f02bd943462343fd084f6a1b73b82aad44bcffaf2a2c1755a1f1bd92f94114cda7e3a82f2f40d3cb44731b76d768bc54cca5a4ce4d0581af603d10244cf559c4d39caff777250fb8739666ac4b09b9a79ddc4603e8e45812e393658756e269ebbb43371d7cd12157074f76b31d0510ac35ceb1e9272ca2713d16c8e646357791572b484d46ef3ffa3e9c4b77367e8ea49b2ef665ba2ef1b7d0accbadac6d82d944c0df6ac")
+		require.Equal(expectedState, s.st[:], "Final state")
+	})
+
+	t.Run("AEAD", func(t *testing.T) {
+		require := require.New(t)
+
+		alice := New([]byte("test"))
+		alice.KEY([]byte("some key"))
+		bob := alice.Clone()
+
+		msg := []byte("Ex nihilo nihil fit")
+		ct := alice.SendENC(false, nil, msg)
+		ct = alice.SendMAC(false, ct, 16)
+
+		pt := bob.RecvENC(false, nil, ct[:len(msg)])
+		require.Equal(msg, pt, "RecvENC")
+		require.True(bob.RecvMAC(false, ct[len(msg):]), "RecvMAC")
+
+		require.Equal(alice.PRF(32), bob.PRF(32), "PRF after exchange")
+
+		alice.Reset()
+		require.Equal(make([]byte, stateSize), alice.st[:], "Reset")
+	})
+}
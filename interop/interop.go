@@ -0,0 +1,295 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package interop implements a cross-implementation interoperability
+// harness.  External Noise Protocol implementations are wired in via the
+// Driver interface, and are run against each other (and against nyquist)
+// over deterministically generated test cases.
+package interop // import "gitlab.com/yawning/nyquist.git/interop"
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/vectors"
+	"gitlab.com/yawning/nyquist.git/vectors/runner"
+)
+
+var (
+	// ErrUnsupported is the error returned by a Driver when it does not
+	// support a given protocol or configuration.
+	ErrUnsupported = errors.New("nyquist/interop: unsupported")
+
+	errMismatch = errors.New("nyquist/interop: output mismatch")
+)
+
+// PartyConfig is the configuration of one side of a test case.  All keys
+// are in the Noise Protocol wire encoding, and implementations MUST use
+// the provided ephemeral key so that the output is deterministic.
+type PartyConfig struct {
+	// ProtocolName is the full Noise protocol name.
+	ProtocolName string
+
+	// IsInitiator is true iff the party is the initiator.
+	IsInitiator bool
+
+	// Prologue is the optional prologue.
+	Prologue []byte
+
+	// LocalStatic is the optional local static private key.
+	LocalStatic []byte
+
+	// LocalEphemeral is the optional local ephemeral private key.
+	LocalEphemeral []byte
+
+	// RemoteStatic is the optional remote static public key.
+	RemoteStatic []byte
+
+	// PreSharedKeys are the optional pre-shared keys.
+	PreSharedKeys [][]byte
+}
+
+// Party is one side of a test case, driven by an implementation.
+type Party interface {
+	// WriteMessage processes a write step of the handshake pattern, and
+	// returns the handshake message.
+	WriteMessage(payload []byte) ([]byte, error)
+
+	// ReadMessage processes a read step of the handshake pattern, and
+	// returns the payload.
+	ReadMessage(msg []byte) ([]byte, error)
+
+	// HandshakeHash returns the handshake hash, after the handshake has
+	// completed.  Implementations that do not expose the handshake hash
+	// may return nil.
+	HandshakeHash() []byte
+
+	// Encrypt encrypts a transport message.
+	Encrypt(plaintext []byte) ([]byte, error)
+
+	// Decrypt decrypts a transport message.
+	Decrypt(ciphertext []byte) ([]byte, error)
+
+	// Close releases all resources associated with the party.
+	Close()
+}
+
+// Driver is an implementation under test.
+type Driver interface {
+	// Name returns the name of the implementation.
+	Name() string
+
+	// NewParty creates a new party with the provided configuration,
+	// returning ErrUnsupported if the configuration is not supported.
+	NewParty(cfg *PartyConfig) (Party, error)
+}
+
+// Result is the outcome of a single test case.
+type Result struct {
+	Protocol  string
+	Initiator string
+	Responder string
+
+	// Err is nil iff the test case passed.
+	Err error
+}
+
+// Passed returns true iff the test case passed.
+func (r *Result) Passed() bool {
+	return r.Err == nil
+}
+
+// Skipped returns true iff the test case was not run due to one of the
+// implementations not supporting the protocol.
+func (r *Result) Skipped() bool {
+	return errors.Is(r.Err, ErrUnsupported) || errors.Is(r.Err, runner.ErrUnsupported)
+}
+
+// Matrix is the pass/fail matrix produced by a harness run.
+type Matrix struct {
+	Results []Result
+}
+
+// Failed returns the results of all test cases that failed (excluding
+// those that were skipped).
+func (m *Matrix) Failed() []Result {
+	var ret []Result
+	for _, r := range m.Results {
+		if !r.Passed() && !r.Skipped() {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+// String returns a human readable table of the results.
+func (m *Matrix) String() string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "PROTOCOL\tINITIATOR\tRESPONDER\tRESULT\n")
+	for _, r := range m.Results {
+		var status string
+		switch {
+		case r.Passed():
+			status = "PASS"
+		case r.Skipped():
+			status = "SKIP"
+		default:
+			status = "FAIL: " + r.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Protocol, r.Initiator, r.Responder, status)
+	}
+	w.Flush()
+
+	return b.String()
+}
+
+// Run runs every protocol, for every ordered pair of drivers (including
+// each driver against itself), using the provided entropy source to
+// generate the keys and expected outputs.
+func Run(drivers []Driver, protocols []string, rng io.Reader) *Matrix {
+	m := new(Matrix)
+	for _, protocolName := range protocols {
+		for _, initDriver := range drivers {
+			for _, respDriver := range drivers {
+				m.Results = append(m.Results, Result{
+					Protocol:  protocolName,
+					Initiator: initDriver.Name(),
+					Responder: respDriver.Name(),
+					Err:       runCase(initDriver, respDriver, protocolName, rng),
+				})
+			}
+		}
+	}
+
+	return m
+}
+
+func runCase(initDriver, respDriver Driver, protocolName string, rng io.Reader) error {
+	// Use nyquist to generate the keys, and the expected output.
+	v, err := runner.Generate(protocolName, rng)
+	if err != nil {
+		return err
+	}
+	protocol, err := nyquist.NewProtocol(protocolName)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+
+	initParty, err := initDriver.NewParty(&PartyConfig{
+		ProtocolName:   protocolName,
+		IsInitiator:    true,
+		Prologue:       v.InitPrologue,
+		LocalStatic:    v.InitStatic,
+		LocalEphemeral: v.InitEphemeral,
+		RemoteStatic:   v.InitRemoteStatic,
+		PreSharedKeys:  toBytesSlice(v.InitPsks),
+	})
+	if err != nil {
+		return fmt.Errorf("initiator: %w", err)
+	}
+	defer initParty.Close()
+
+	respParty, err := respDriver.NewParty(&PartyConfig{
+		ProtocolName:   protocolName,
+		Prologue:       v.RespPrologue,
+		LocalStatic:    v.RespStatic,
+		LocalEphemeral: v.RespEphemeral,
+		RemoteStatic:   v.RespRemoteStatic,
+		PreSharedKeys:  toBytesSlice(v.RespPsks),
+	})
+	if err != nil {
+		return fmt.Errorf("responder: %w", err)
+	}
+	defer respParty.Close()
+
+	numHandshakeMessages := len(protocol.Pattern.Messages())
+	for idx, msg := range v.Messages {
+		initWrites := idx&1 == 0
+		if protocol.Pattern.IsOneWay() && idx >= numHandshakeMessages {
+			initWrites = true
+		}
+		w, r := initParty, respParty
+		if !initWrites {
+			w, r = r, w
+		}
+
+		var ciphertext, plaintext []byte
+		if idx < numHandshakeMessages {
+			if ciphertext, err = w.WriteMessage(msg.Payload); err != nil {
+				return fmt.Errorf("handshake message %d: write: %w", idx, err)
+			}
+			if plaintext, err = r.ReadMessage(ciphertext); err != nil {
+				return fmt.Errorf("handshake message %d: read: %w", idx, err)
+			}
+		} else {
+			if idx == numHandshakeMessages {
+				if err = checkHandshakeHash(v, initParty, respParty); err != nil {
+					return err
+				}
+			}
+			if ciphertext, err = w.Encrypt(msg.Payload); err != nil {
+				return fmt.Errorf("transport message %d: encrypt: %w", idx, err)
+			}
+			if plaintext, err = r.Decrypt(ciphertext); err != nil {
+				return fmt.Errorf("transport message %d: decrypt: %w", idx, err)
+			}
+		}
+		if !bytes.Equal(ciphertext, msg.Ciphertext) {
+			return fmt.Errorf("message %d: ciphertext: %w", idx, errMismatch)
+		}
+		if !bytes.Equal(plaintext, msg.Payload) {
+			return fmt.Errorf("message %d: plaintext: %w", idx, errMismatch)
+		}
+	}
+
+	return nil
+}
+
+func checkHandshakeHash(v *vectors.Vector, parties ...Party) error {
+	for _, p := range parties {
+		if h := p.HandshakeHash(); h != nil && !bytes.Equal(h, v.HandshakeHash) {
+			return fmt.Errorf("handshake hash: %w", errMismatch)
+		}
+	}
+	return nil
+}
+
+func toBytesSlice(bufs []vectors.HexBuffer) [][]byte {
+	var ret [][]byte
+	for _, b := range bufs {
+		ret = append(ret, []byte(b))
+	}
+	return ret
+}
@@ -0,0 +1,94 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package interop
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// tamperDriver is a Driver that corrupts every transport message.
+type tamperDriver struct{}
+
+func (d *tamperDriver) Name() string {
+	return "tamper"
+}
+
+func (d *tamperDriver) NewParty(cfg *PartyConfig) (Party, error) {
+	p, err := Nyquist.NewParty(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &tamperParty{p}, nil
+}
+
+type tamperParty struct {
+	Party
+}
+
+func (p *tamperParty) Encrypt(plaintext []byte) ([]byte, error) {
+	ciphertext, err := p.Party.Encrypt(plaintext)
+	if err == nil {
+		ciphertext[0] ^= 0xa5
+	}
+	return ciphertext, err
+}
+
+func TestHarness(t *testing.T) {
+	protocols := []string{
+		"Noise_N_25519_ChaChaPoly_BLAKE2s",
+		"Noise_XX_25519_ChaChaPoly_SHA256",
+		"Noise_IKpsk2_448_AESGCM_BLAKE2b",
+		"Noise_KK1_25519_ChaChaPoly_SHA512",
+		"Noise_XX_NoSuchDH_ChaChaPoly_SHA256",
+	}
+
+	t.Run("Nyquist", func(t *testing.T) {
+		require := require.New(t)
+
+		m := Run([]Driver{Nyquist}, protocols, rand.Reader)
+		require.Len(m.Results, len(protocols), "number of results")
+		require.Empty(m.Failed(), "no failures")
+		require.True(m.Results[len(protocols)-1].Skipped(), "unsupported protocol skipped")
+		require.Contains(m.String(), "PASS", "String()")
+	})
+	t.Run("Tampered", func(t *testing.T) {
+		require := require.New(t)
+
+		m := Run([]Driver{Nyquist, &tamperDriver{}}, protocols[:1], rand.Reader)
+		require.Len(m.Results, 4, "number of results")
+		for _, r := range m.Results {
+			expectPass := r.Initiator == "nyquist"
+			require.Equal(expectPass, r.Passed(), "%s -> %s", r.Initiator, r.Responder)
+		}
+	})
+}
@@ -0,0 +1,148 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package interop
+
+import (
+	"errors"
+	"fmt"
+
+	"gitlab.com/yawning/nyquist.git"
+)
+
+var errNotReady = errors.New("nyquist/interop: handshake not complete")
+
+// Nyquist is the Driver backed by this implementation.
+var Nyquist Driver = &nyquistDriver{}
+
+type nyquistDriver struct{}
+
+func (d *nyquistDriver) Name() string {
+	return "nyquist"
+}
+
+func (d *nyquistDriver) NewParty(cfg *PartyConfig) (Party, error) {
+	protocol, err := nyquist.NewProtocol(cfg.ProtocolName)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+
+	hsCfg := &nyquist.HandshakeConfig{
+		Protocol:      protocol,
+		Prologue:      cfg.Prologue,
+		PreSharedKeys: cfg.PreSharedKeys,
+		IsInitiator:   cfg.IsInitiator,
+	}
+	if len(cfg.LocalStatic) > 0 {
+		if hsCfg.LocalStatic, err = protocol.DH.ParsePrivateKey(cfg.LocalStatic); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.LocalEphemeral) > 0 {
+		if hsCfg.LocalEphemeral, err = protocol.DH.ParsePrivateKey(cfg.LocalEphemeral); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.RemoteStatic) > 0 {
+		if hsCfg.RemoteStatic, err = protocol.DH.ParsePublicKey(cfg.RemoteStatic); err != nil {
+			return nil, err
+		}
+	}
+
+	hs, err := nyquist.NewHandshake(hsCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &nyquistParty{
+		hs:          hs,
+		isInitiator: cfg.IsInitiator,
+	}, nil
+}
+
+type nyquistParty struct {
+	hs          *nyquist.HandshakeState
+	status      *nyquist.HandshakeStatus
+	tx, rx      *nyquist.CipherState
+	isInitiator bool
+}
+
+func (p *nyquistParty) WriteMessage(payload []byte) ([]byte, error) {
+	msg, err := p.hs.WriteMessage(nil, payload)
+	return msg, p.onHandshakeMessage(err)
+}
+
+func (p *nyquistParty) ReadMessage(msg []byte) ([]byte, error) {
+	payload, err := p.hs.ReadMessage(nil, msg)
+	return payload, p.onHandshakeMessage(err)
+}
+
+func (p *nyquistParty) onHandshakeMessage(err error) error {
+	switch err {
+	case nyquist.ErrDone:
+		p.status = p.hs.GetStatus()
+		p.tx, p.rx = p.status.CipherStates[0], p.status.CipherStates[1]
+		if !p.isInitiator {
+			p.tx, p.rx = p.rx, p.tx
+		}
+		return nil
+	default:
+		return err
+	}
+}
+
+func (p *nyquistParty) HandshakeHash() []byte {
+	if p.status == nil {
+		return nil
+	}
+	return p.status.HandshakeHash
+}
+
+func (p *nyquistParty) Encrypt(plaintext []byte) ([]byte, error) {
+	if p.tx == nil {
+		return nil, errNotReady
+	}
+	return p.tx.EncryptWithAd(nil, nil, plaintext)
+}
+
+func (p *nyquistParty) Decrypt(ciphertext []byte) ([]byte, error) {
+	if p.rx == nil {
+		return nil, errNotReady
+	}
+	return p.rx.DecryptWithAd(nil, nil, ciphertext)
+}
+
+func (p *nyquistParty) Close() {
+	p.hs.Reset()
+	for _, cs := range []*nyquist.CipherState{p.tx, p.rx} {
+		if cs != nil {
+			cs.Reset()
+		}
+	}
+}
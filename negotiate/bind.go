@@ -0,0 +1,88 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package negotiate
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"gitlab.com/yawning/nyquist.git"
+)
+
+const bindingLabel = "nyquist/negotiate: binding"
+
+var errNotNegotiated = errors.New("nyquist/negotiate: protocol not supported by both parties")
+
+// Bind binds a handshake to the negotiation that selected its protocol, by
+// replacing cfg.Prologue with a prologue containing the initiator's and
+// responder's advertised capabilities, the selected protocol name (from
+// cfg.Protocol), and the original cfg.Prologue (if any).
+//
+// As the prologue is mixed into the handshake hash, any tampering with
+// either party's advertisement (eg: to force a downgrade) will cause the
+// handshake to fail, as long as both parties call Bind with the
+// capabilities that they each sent and received.
+func Bind(cfg *nyquist.HandshakeConfig, initiator, responder *Capabilities) error {
+	if cfg.Protocol == nil {
+		return errNotNegotiated
+	}
+	protocolName := cfg.Protocol.String()
+	if !initiator.Supports(protocolName) || !responder.Supports(protocolName) {
+		return errNotNegotiated
+	}
+
+	initBytes, err := initiator.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	respBytes, err := responder.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	// All variable length fields are length prefixed, so that the
+	// prologue is unambiguous.
+	prologue := make([]byte, 0, len(bindingLabel)+3*2+len(initBytes)+len(respBytes)+len(protocolName)+len(cfg.Prologue))
+	prologue = append(prologue, bindingLabel...)
+	for _, v := range [][]byte{
+		initBytes,
+		respBytes,
+		[]byte(protocolName),
+	} {
+		var l [2]byte
+		binary.BigEndian.PutUint16(l[:], uint16(len(v)))
+		prologue = append(prologue, l[:]...)
+		prologue = append(prologue, v...)
+	}
+	prologue = append(prologue, cfg.Prologue...)
+	cfg.Prologue = prologue
+
+	return nil
+}
@@ -0,0 +1,244 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package negotiate implements a compact canonical encoding of a node's
+// supported protocols and primitives, suitable for embedding in discovery
+// records or negotiation data, and selection of a mutually supported
+// protocol.
+package negotiate // import "gitlab.com/yawning/nyquist.git/negotiate"
+
+import (
+	"errors"
+	"strings"
+
+	"gitlab.com/yawning/nyquist.git"
+)
+
+const (
+	encodingVersion = 1
+
+	maxEntries   = 255
+	maxEntrySize = 255
+)
+
+var (
+	// ErrMalformed is the error returned when a serialized capability
+	// advertisement is malformed or not canonical.
+	ErrMalformed = errors.New("nyquist/negotiate: malformed capabilities")
+
+	// ErrNoCommonProtocol is the error returned when there is no mutually
+	// supported protocol.
+	ErrNoCommonProtocol = errors.New("nyquist/negotiate: no common protocol")
+
+	errInvalidEntry = errors.New("nyquist/negotiate: invalid capability entry")
+)
+
+// Capabilities is the set of protocols supported by a node.  Each list is
+// in order of preference, most preferred first.
+//
+// A protocol is supported if it is listed in Protocols, or if each of its
+// components is listed in the corresponding primitive list.
+type Capabilities struct {
+	// Protocols is the list of supported protocol names
+	// (eg: `Noise_XX_25519_ChaChaPoly_BLAKE2s`).
+	Protocols []string
+
+	// Patterns is the list of supported handshake pattern names.
+	Patterns []string
+
+	// DHs is the list of supported DH function names.
+	DHs []string
+
+	// Ciphers is the list of supported cipher function names.
+	Ciphers []string
+
+	// Hashes is the list of supported hash function names.
+	Hashes []string
+}
+
+func (c *Capabilities) lists() []*[]string {
+	return []*[]string{
+		&c.Protocols,
+		&c.Patterns,
+		&c.DHs,
+		&c.Ciphers,
+		&c.Hashes,
+	}
+}
+
+// MarshalBinary encodes the capabilities to the canonical binary form.
+//
+// The encoding is a version byte, followed by the Protocols, Patterns,
+// DHs, Ciphers and Hashes lists, each encoded as an entry count byte,
+// followed by each entry as a length byte and the entry.
+func (c *Capabilities) MarshalBinary() ([]byte, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	b := []byte{encodingVersion}
+	for _, l := range c.lists() {
+		b = append(b, byte(len(*l)))
+		for _, v := range *l {
+			b = append(b, byte(len(v)))
+			b = append(b, v...)
+		}
+	}
+
+	return b, nil
+}
+
+// UnmarshalBinary decodes the capabilities from the canonical binary form.
+// Non-canonical encodings (including duplicate entries) are rejected.
+func (c *Capabilities) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 || data[0] != encodingVersion {
+		return ErrMalformed
+	}
+	data = data[1:]
+
+	var tmp Capabilities
+	for _, l := range tmp.lists() {
+		if len(data) < 1 {
+			return ErrMalformed
+		}
+		n := int(data[0])
+		data = data[1:]
+		for i := 0; i < n; i++ {
+			if len(data) < 1 {
+				return ErrMalformed
+			}
+			sz := int(data[0])
+			data = data[1:]
+			if len(data) < sz {
+				return ErrMalformed
+			}
+			*l = append(*l, string(data[:sz]))
+			data = data[sz:]
+		}
+	}
+	if len(data) != 0 {
+		return ErrMalformed
+	}
+	if tmp.validate() != nil {
+		return ErrMalformed
+	}
+
+	*c = tmp
+
+	return nil
+}
+
+func (c *Capabilities) validate() error {
+	for i, l := range c.lists() {
+		if len(*l) > maxEntries {
+			return errInvalidEntry
+		}
+		seen := make(map[string]bool)
+		for _, v := range *l {
+			if len(v) == 0 || len(v) > maxEntrySize || seen[v] {
+				return errInvalidEntry
+			}
+			isProtocol := i == 0
+			if isProtocol != (strings.Count(v, "_") == 4) {
+				return errInvalidEntry
+			}
+			seen[v] = true
+		}
+	}
+	return nil
+}
+
+// Supports returns true iff the capabilities include the protocol.
+func (c *Capabilities) Supports(protocolName string) bool {
+	if contains(c.Protocols, protocolName) {
+		return true
+	}
+
+	parts := strings.Split(protocolName, "_")
+	if len(parts) != 5 {
+		return false
+	}
+	return contains(c.Patterns, parts[1]) &&
+		contains(c.DHs, parts[2]) &&
+		contains(c.Ciphers, parts[3]) &&
+		contains(c.Hashes, parts[4])
+}
+
+// candidates calls fn with each protocol name supported by the
+// capabilities, in order of preference, until fn returns true.
+func (c *Capabilities) candidates(fn func(string) bool) {
+	for _, v := range c.Protocols {
+		if fn(v) {
+			return
+		}
+	}
+	for _, pa := range c.Patterns {
+		for _, dh := range c.DHs {
+			for _, ci := range c.Ciphers {
+				for _, h := range c.Hashes {
+					if fn(strings.Join([]string{"Noise", pa, dh, ci, h}, "_")) {
+						return
+					}
+				}
+			}
+		}
+	}
+}
+
+// Select returns the most preferred protocol (per the preferred
+// capabilities) that is supported by both the preferred and other
+// capabilities, and by this implementation.
+func Select(preferred, other *Capabilities) (*nyquist.Protocol, error) {
+	var protocol *nyquist.Protocol
+	preferred.candidates(func(protocolName string) bool {
+		if !other.Supports(protocolName) {
+			return false
+		}
+		pr, err := nyquist.NewProtocol(protocolName)
+		if err != nil {
+			return false
+		}
+		protocol = pr
+		return true
+	})
+	if protocol == nil {
+		return nil, ErrNoCommonProtocol
+	}
+
+	return protocol, nil
+}
+
+func contains(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
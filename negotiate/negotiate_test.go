@@ -0,0 +1,225 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package negotiate
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+func TestCapabilities(t *testing.T) {
+	t.Run("Encoding", testCapabilitiesEncoding)
+	t.Run("Select", testCapabilitiesSelect)
+	t.Run("Bind", testCapabilitiesBind)
+}
+
+func testCapabilitiesEncoding(t *testing.T) {
+	require := require.New(t)
+
+	caps := &Capabilities{
+		Protocols: []string{"Noise_IK_25519_ChaChaPoly_BLAKE2s"},
+		Patterns:  []string{"XX", "IK"},
+		DHs:       []string{"25519"},
+		Ciphers:   []string{"ChaChaPoly", "AESGCM"},
+		Hashes:    []string{"BLAKE2s", "SHA256"},
+	}
+	b, err := caps.MarshalBinary()
+	require.NoError(err, "MarshalBinary")
+
+	var decoded Capabilities
+	err = decoded.UnmarshalBinary(b)
+	require.NoError(err, "UnmarshalBinary")
+	require.Equal(caps, &decoded, "UnmarshalBinary - round trip")
+
+	b2, err := decoded.MarshalBinary()
+	require.NoError(err, "MarshalBinary - decoded")
+	require.Equal(b, b2, "MarshalBinary - canonical")
+
+	var empty Capabilities
+	b, err = empty.MarshalBinary()
+	require.NoError(err, "MarshalBinary - empty")
+	require.Equal([]byte{encodingVersion, 0, 0, 0, 0, 0}, b, "MarshalBinary - empty")
+
+	for _, v := range []struct {
+		n    string
+		caps Capabilities
+	}{
+		{"EmptyEntry", Capabilities{Patterns: []string{""}}},
+		{"Duplicate", Capabilities{Ciphers: []string{"AESGCM", "AESGCM"}}},
+		{"BadProtocol", Capabilities{Protocols: []string{"XX"}}},
+		{"BadPrimitive", Capabilities{Hashes: []string{"Noise_XX_25519_AESGCM_SHA256"}}},
+	} {
+		_, err = v.caps.MarshalBinary()
+		require.Error(err, "MarshalBinary(%s)", v.n)
+	}
+
+	for _, v := range []struct {
+		n string
+		b []byte
+	}{
+		{"Empty", nil},
+		{"BadVersion", []byte{0, 0, 0, 0, 0, 0}},
+		{"Truncated", []byte{encodingVersion, 0, 1, 2, 'X'}},
+		{"TrailingData", []byte{encodingVersion, 0, 0, 0, 0, 0, 0}},
+		{"Duplicate", []byte{encodingVersion, 0, 2, 2, 'X', 'X', 2, 'X', 'X', 0, 0, 0}},
+	} {
+		err = decoded.UnmarshalBinary(v.b)
+		require.ErrorIs(err, ErrMalformed, "UnmarshalBinary(%s)", v.n)
+	}
+}
+
+func testCapabilitiesSelect(t *testing.T) {
+	require := require.New(t)
+
+	server := &Capabilities{
+		Patterns: []string{"XX", "IK"},
+		DHs:      []string{"25519"},
+		Ciphers:  []string{"AESGCM", "ChaChaPoly"},
+		Hashes:   []string{"SHA256", "BLAKE2s"},
+	}
+	client := &Capabilities{
+		Protocols: []string{
+			"Noise_XX_448_ChaChaPoly_BLAKE2b",
+			"Noise_IK_25519_ChaChaPoly_BLAKE2s",
+			"Noise_XX_25519_AESGCM_SHA256",
+		},
+	}
+
+	protocol, err := Select(client, server)
+	require.NoError(err, "Select(client, server)")
+	require.Equal("Noise_IK_25519_ChaChaPoly_BLAKE2s", protocol.String())
+
+	protocol, err = Select(server, client)
+	require.NoError(err, "Select(server, client)")
+	require.Equal("Noise_XX_25519_AESGCM_SHA256", protocol.String())
+
+	// Protocols unsupported by this implementation are never selected.
+	client.Protocols = []string{"Noise_XX_25519_ChaChaPoly_MD5"}
+	server.Hashes = append(server.Hashes, "MD5")
+	server.Ciphers = []string{"ChaChaPoly"}
+	_, err = Select(client, server)
+	require.ErrorIs(err, ErrNoCommonProtocol, "Select - no common protocol")
+}
+
+func testCapabilitiesBind(t *testing.T) {
+	require := require.New(t)
+
+	client := &Capabilities{
+		Protocols: []string{
+			"Noise_XX_25519_ChaChaPoly_BLAKE2s",
+			"Noise_XX_25519_AESGCM_SHA256",
+		},
+	}
+	server := &Capabilities{
+		Patterns: []string{"XX"},
+		DHs:      []string{"25519"},
+		Ciphers:  []string{"ChaChaPoly", "AESGCM"},
+		Hashes:   []string{"BLAKE2s", "SHA256"},
+	}
+
+	type view struct {
+		initiator, responder *Capabilities
+	}
+	doHandshake := func(clientView, serverView *view) error {
+		clientStatic, err := dh.X25519.GenerateKeypair(rand.Reader)
+		require.NoError(err, "GenerateKeypair(client)")
+		serverStatic, err := dh.X25519.GenerateKeypair(rand.Reader)
+		require.NoError(err, "GenerateKeypair(server)")
+
+		clientProtocol, err := Select(clientView.initiator, clientView.responder)
+		require.NoError(err, "Select(client)")
+		serverProtocol, err := Select(serverView.initiator, serverView.responder)
+		require.NoError(err, "Select(server)")
+
+		clientCfg := &nyquist.HandshakeConfig{
+			Protocol:    clientProtocol,
+			Prologue:    []byte("application prologue"),
+			LocalStatic: clientStatic,
+			IsInitiator: true,
+		}
+		err = Bind(clientCfg, clientView.initiator, clientView.responder)
+		require.NoError(err, "Bind(client)")
+		serverCfg := &nyquist.HandshakeConfig{
+			Protocol:    serverProtocol,
+			Prologue:    []byte("application prologue"),
+			LocalStatic: serverStatic,
+		}
+		err = Bind(serverCfg, serverView.initiator, serverView.responder)
+		require.NoError(err, "Bind(server)")
+
+		clientHs, err := nyquist.NewHandshake(clientCfg)
+		require.NoError(err, "NewHandshake(client)")
+		defer clientHs.Reset()
+		serverHs, err := nyquist.NewHandshake(serverCfg)
+		require.NoError(err, "NewHandshake(server)")
+		defer serverHs.Reset()
+
+		msg, err := clientHs.WriteMessage(nil, nil)
+		require.NoError(err, "clientHs.WriteMessage(0)")
+		if _, err = serverHs.ReadMessage(nil, msg); err != nil {
+			return err
+		}
+		msg, err = serverHs.WriteMessage(nil, nil)
+		require.NoError(err, "serverHs.WriteMessage(1)")
+		_, err = clientHs.ReadMessage(nil, msg)
+		return err
+	}
+
+	honest := &view{client, server}
+	err := doHandshake(honest, honest)
+	require.NoError(err, "handshake - honest")
+
+	// An attacker strips ChaChaPoly from the server's advertisement, to
+	// force the client to pick AESGCM.
+	downgraded := &view{client, &Capabilities{
+		Patterns: server.Patterns,
+		DHs:      server.DHs,
+		Ciphers:  []string{"AESGCM"},
+		Hashes:   server.Hashes,
+	}}
+	err = doHandshake(downgraded, &view{
+		// The server sees the client's advertisement with the
+		// preferred protocol removed.
+		initiator: &Capabilities{Protocols: client.Protocols[1:]},
+		responder: server,
+	})
+	require.ErrorIs(err, nyquist.ErrOpen, "handshake - downgraded")
+
+	// Binding to a protocol that was not negotiated is rejected.
+	protocol, err := nyquist.NewProtocol("Noise_IK_25519_ChaChaPoly_BLAKE2s")
+	require.NoError(err, "NewProtocol")
+	err = Bind(&nyquist.HandshakeConfig{Protocol: protocol}, client, server)
+	require.Error(err, "Bind - not negotiated")
+}
@@ -0,0 +1,130 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package ntcp2
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// BlockType is a NTCP2 block type.
+type BlockType byte
+
+const (
+	// BlockDateTime is a DateTime block.
+	BlockDateTime BlockType = 0
+
+	// BlockOptions is an Options block.
+	BlockOptions BlockType = 1
+
+	// BlockRouterInfo is a RouterInfo block.
+	BlockRouterInfo BlockType = 2
+
+	// BlockI2NP is an I2NP message block.
+	BlockI2NP BlockType = 3
+
+	// BlockTermination is a Termination block.
+	BlockTermination BlockType = 4
+
+	// BlockPadding is a Padding block, which must be the last block
+	// in a frame.
+	BlockPadding BlockType = 254
+
+	blockHeaderSize      = 3
+	terminationBlockSize = 9
+)
+
+// TerminationNormal is the normal close termination reason.
+const TerminationNormal = 0
+
+// Block is a NTCP2 block.
+type Block struct {
+	// Type is the block type.
+	Type BlockType
+
+	// Data is the block data.
+	Data []byte
+}
+
+// TerminationError is the error returned when the peer terminates the
+// connection with a Termination block.
+type TerminationError struct {
+	// ValidFrames is the number of valid frames received by the peer.
+	ValidFrames uint64
+
+	// Reason is the termination reason.
+	Reason byte
+}
+
+// Error returns the string representation of a TerminationError.
+func (e *TerminationError) Error() string {
+	return fmt.Sprintf("nyquist/ntcp2: terminated by peer (reason: %d)", e.Reason)
+}
+
+func terminationBlock(validFrames uint64, reason byte) Block {
+	data := make([]byte, terminationBlockSize)
+	binary.BigEndian.PutUint64(data, validFrames)
+	data[8] = reason
+	return Block{Type: BlockTermination, Data: data}
+}
+
+func appendBlocks(dst []byte, blocks []Block) ([]byte, error) {
+	for i, v := range blocks {
+		if v.Type == BlockPadding && i != len(blocks)-1 {
+			return nil, fmt.Errorf("%w: padding is not the last block", ErrMalformed)
+		}
+		if len(v.Data) > 0xffff {
+			return nil, fmt.Errorf("%w: oversized block", ErrMalformed)
+		}
+		dst = append(dst, byte(v.Type), byte(len(v.Data)>>8), byte(len(v.Data)))
+		dst = append(dst, v.Data...)
+	}
+	return dst, nil
+}
+
+func parseBlocks(b []byte) ([]Block, error) {
+	var blocks []Block
+	for len(b) > 0 {
+		if len(b) < blockHeaderSize {
+			return nil, fmt.Errorf("%w: truncated block header", ErrMalformed)
+		}
+		t, l := BlockType(b[0]), int(binary.BigEndian.Uint16(b[1:3]))
+		b = b[blockHeaderSize:]
+		if len(b) < l {
+			return nil, fmt.Errorf("%w: truncated block", ErrMalformed)
+		}
+		if t == BlockPadding && len(b) != l {
+			return nil, fmt.Errorf("%w: padding is not the last block", ErrMalformed)
+		}
+		blocks = append(blocks, Block{Type: t, Data: b[:l]})
+		b = b[l:]
+	}
+	return blocks, nil
+}
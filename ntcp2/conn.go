@@ -0,0 +1,537 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package ntcp2
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+const (
+	// MaxFrameSize is the maximum size of a data phase frame, excluding
+	// the length.
+	MaxFrameSize = 65535
+
+	// MaxFramePayload is the maximum size of the serialized blocks in a
+	// data phase frame.
+	MaxFramePayload = MaxFrameSize - macSize
+
+	closeTimeout = 5 * time.Second
+)
+
+// ErrFrameSize is the error returned when the blocks passed to WriteFrame
+// do not fit in a single frame.
+var ErrFrameSize = errors.New("nyquist/ntcp2: frame too large")
+
+// ConnectionState is the state of a NTCP2 connection.
+type ConnectionState struct {
+	// IsClient is true iff the local side is the initiator.
+	IsClient bool
+
+	// RemoteStatic is the peer's static public key.
+	RemoteStatic dh.PublicKey
+
+	// RemoteRouterInfo is the initiator's serialized RouterInfo.  Only
+	// set for responders.
+	RemoteRouterInfo []byte
+
+	// HandshakeHash is the handshake hash.
+	HandshakeHash []byte
+}
+
+// Conn is a NTCP2 connection.
+type Conn struct {
+	rxFrames uint64 // Accessed atomically, must be first.
+
+	conn net.Conn
+	cfg  *Config
+
+	state ConnectionState
+
+	rdMu   sync.Mutex
+	rx     *nyquist.CipherState
+	rxMask lengthMask
+	rdErr  error
+
+	wrMu   sync.Mutex
+	tx     *nyquist.CipherState
+	txMask lengthMask
+	wrErr  error
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// ConnectionState returns the connection state.
+func (c *Conn) ConnectionState() ConnectionState {
+	return c.state
+}
+
+// ReadFrame reads a data phase frame, and returns the blocks.  If the
+// frame contains a Termination block, the blocks are returned along with
+// a TerminationError.
+//
+// Warning: The returned block data is only valid until the next call.
+func (c *Conn) ReadFrame() ([]Block, error) {
+	c.rdMu.Lock()
+	defer c.rdMu.Unlock()
+
+	if c.rdErr != nil {
+		return nil, c.rdErr
+	}
+
+	blocks, err := c.readFrame()
+	if err != nil {
+		c.rdErr = err
+	}
+	return blocks, err
+}
+
+func (c *Conn) readFrame() ([]Block, error) {
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(c.conn, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	frameLen := int(binary.BigEndian.Uint16(lenBuf[:]) ^ c.rxMask.next())
+	if frameLen < macSize {
+		return nil, fmt.Errorf("%w: undersized frame", ErrMalformed)
+	}
+
+	frame := make([]byte, frameLen)
+	if _, err := io.ReadFull(c.conn, frame); err != nil {
+		return nil, err
+	}
+	plaintext, err := c.rx.DecryptWithAd(frame[:0], nil, frame)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddUint64(&c.rxFrames, 1)
+
+	blocks, err := parseBlocks(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range blocks {
+		if v.Type == BlockTermination {
+			if len(v.Data) < terminationBlockSize {
+				return nil, fmt.Errorf("%w: truncated termination", ErrMalformed)
+			}
+			return blocks, &TerminationError{
+				ValidFrames: binary.BigEndian.Uint64(v.Data),
+				Reason:      v.Data[8],
+			}
+		}
+	}
+
+	return blocks, nil
+}
+
+// WriteFrame writes the blocks as a data phase frame, with random padding
+// appended if there is no Padding block.
+func (c *Conn) WriteFrame(blocks ...Block) error {
+	return c.writeFrame(blocks, true)
+}
+
+func (c *Conn) writeFrame(blocks []Block, pad bool) error {
+	c.wrMu.Lock()
+	defer c.wrMu.Unlock()
+
+	if c.wrErr != nil {
+		return c.wrErr
+	}
+
+	plaintext, err := appendBlocks(make([]byte, 2, 2+MaxFrameSize), blocks)
+	if err != nil {
+		return err
+	}
+	payloadLen := len(plaintext) - 2
+	if payloadLen > MaxFramePayload {
+		return ErrFrameSize
+	}
+	if n := len(blocks); pad && (n == 0 || blocks[n-1].Type != BlockPadding) {
+		padding, err := c.cfg.randomPadding(MaxFramePayload - payloadLen - blockHeaderSize)
+		if err != nil {
+			return err
+		}
+		if padding != nil {
+			plaintext, _ = appendBlocks(plaintext, []Block{{Type: BlockPadding, Data: padding}})
+		}
+	}
+
+	frameLen := len(plaintext) - 2 + macSize
+	binary.BigEndian.PutUint16(plaintext[:2], uint16(frameLen)^c.txMask.next())
+	frame, err := c.tx.EncryptWithAd(plaintext[:2], nil, plaintext[2:])
+	if err != nil {
+		c.wrErr = err
+		return err
+	}
+	if _, err = c.conn.Write(frame); err != nil {
+		c.wrErr = err
+	}
+	return err
+}
+
+// Close sends a Termination block, and closes the connection.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		// Unblock any pending writes, and send the termination.
+		_ = c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+		termination := terminationBlock(atomic.LoadUint64(&c.rxFrames), TerminationNormal)
+		_ = c.writeFrame([]Block{termination}, false)
+
+		c.closeErr = c.conn.Close()
+	})
+	return c.closeErr
+}
+
+// LocalAddr returns the local network address.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines associated with the
+// connection.
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline associated with the connection.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline associated with the connection.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// Client returns a new initiator side NTCP2 connection, using conn as the
+// underlying transport, after completing the handshake.
+func Client(conn net.Conn, cfg *Config) (*Conn, error) {
+	c := &Conn{
+		conn: conn,
+		cfg:  cfg,
+	}
+	if err := c.clientHandshake(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Server returns a new responder side NTCP2 connection, using conn as the
+// underlying transport, after completing the handshake.
+func Server(conn net.Conn, cfg *Config) (*Conn, error) {
+	c := &Conn{
+		conn: conn,
+		cfg:  cfg,
+	}
+	if err := c.serverHandshake(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Conn) clientHandshake() error {
+	cfg := c.cfg
+	if err := cfg.validate(true); err != nil {
+		return err
+	}
+	obfs, err := newAESObfs(cfg)
+	if err != nil {
+		return err
+	}
+
+	hs, err := nyquist.NewHandshake(&nyquist.HandshakeConfig{
+		Protocol:          Protocol,
+		LocalStatic:       cfg.LocalStatic,
+		RemoteStatic:      cfg.RemoteStatic,
+		Rng:               cfg.Rng,
+		ExportChainingKey: true,
+		IsInitiator:       true,
+	})
+	if err != nil {
+		return err
+	}
+	defer hs.Reset()
+
+	// The final message's payload length is sent in the first message,
+	// so serialize it up front.
+	routerInfo := make([]byte, 0, 1+len(cfg.RouterInfo))
+	routerInfo = append(append(routerInfo, 0), cfg.RouterInfo...) // Flag: no flood request.
+	blocks := []Block{{Type: BlockRouterInfo, Data: routerInfo}}
+	msg3Payload, err := appendBlocks(nil, blocks)
+	if err != nil {
+		return err
+	}
+	padding, err := cfg.randomPadding(MaxFramePayload - len(msg3Payload) - blockHeaderSize)
+	if err != nil {
+		return err
+	}
+	if padding != nil {
+		msg3Payload, _ = appendBlocks(msg3Payload, []Block{{Type: BlockPadding, Data: padding}})
+	}
+	if len(msg3Payload)+macSize > MaxFrameSize {
+		return fmt.Errorf("%w: oversized RouterInfo", errInvalidConfig)
+	}
+
+	// -> e, es (SessionRequest)
+	if padding, err = cfg.randomPadding(0xffff); err != nil {
+		return err
+	}
+	var options [optionsSize]byte
+	options[0] = cfg.networkID()
+	options[1] = protocolVersion
+	binary.BigEndian.PutUint16(options[2:4], uint16(len(padding)))
+	binary.BigEndian.PutUint16(options[4:6], uint16(len(msg3Payload)+macSize))
+	binary.BigEndian.PutUint32(options[8:12], cfg.timestamp())
+	msg, err := hs.WriteMessage(nil, options[:])
+	if err != nil {
+		return err
+	}
+	obfs.encrypt(msg[:keySize])
+	if err = c.writeHandshakeMessage(hs, msg, padding); err != nil {
+		return err
+	}
+
+	// <- e, ee (SessionCreated)
+	msg = make([]byte, msg2Size)
+	if _, err = io.ReadFull(c.conn, msg); err != nil {
+		return err
+	}
+	obfs.decrypt(msg[:keySize])
+	payload, err := hs.ReadMessage(nil, msg)
+	if err != nil {
+		return err
+	}
+	if err = cfg.checkTimestamp(binary.BigEndian.Uint32(payload[8:12])); err != nil {
+		return err
+	}
+	if err = c.readHandshakePadding(hs, int(binary.BigEndian.Uint16(payload[2:4]))); err != nil {
+		return err
+	}
+
+	// -> s, se (SessionConfirmed)
+	msg, err = hs.WriteMessage(nil, msg3Payload)
+	if err != nyquist.ErrDone {
+		return err
+	}
+	if _, err = c.conn.Write(msg); err != nil {
+		return err
+	}
+
+	return c.onHandshakeDone(hs.GetStatus(), true)
+}
+
+func (c *Conn) serverHandshake() error {
+	cfg := c.cfg
+	if err := cfg.validate(false); err != nil {
+		return err
+	}
+	obfs, err := newAESObfs(cfg)
+	if err != nil {
+		return err
+	}
+
+	hs, err := nyquist.NewHandshake(&nyquist.HandshakeConfig{
+		Protocol:          Protocol,
+		LocalStatic:       cfg.LocalStatic,
+		Rng:               cfg.Rng,
+		ExportChainingKey: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer hs.Reset()
+
+	// -> e, es (SessionRequest)
+	msg := make([]byte, msg1Size)
+	if _, err = io.ReadFull(c.conn, msg); err != nil {
+		return err
+	}
+	obfs.decrypt(msg[:keySize])
+	payload, err := hs.ReadMessage(nil, msg)
+	if err != nil {
+		return err
+	}
+	switch {
+	case payload[0] != cfg.networkID():
+		return ErrNetworkID
+	case payload[1] != protocolVersion:
+		return fmt.Errorf("%w: unsupported version: %d", ErrMalformed, payload[1])
+	}
+	msg3Len := int(binary.BigEndian.Uint16(payload[4:6]))
+	if msg3Len < macSize+blockHeaderSize+1 {
+		return fmt.Errorf("%w: invalid SessionConfirmed length", ErrMalformed)
+	}
+	if err = cfg.checkTimestamp(binary.BigEndian.Uint32(payload[8:12])); err != nil {
+		return err
+	}
+	if err = c.readHandshakePadding(hs, int(binary.BigEndian.Uint16(payload[2:4]))); err != nil {
+		return err
+	}
+
+	// <- e, ee (SessionCreated)
+	padding, err := cfg.randomPadding(0xffff)
+	if err != nil {
+		return err
+	}
+	var options [optionsSize]byte
+	binary.BigEndian.PutUint16(options[2:4], uint16(len(padding)))
+	binary.BigEndian.PutUint32(options[8:12], cfg.timestamp())
+	if msg, err = hs.WriteMessage(nil, options[:]); err != nil {
+		return err
+	}
+	obfs.encrypt(msg[:keySize])
+	if err = c.writeHandshakeMessage(hs, msg, padding); err != nil {
+		return err
+	}
+
+	// -> s, se (SessionConfirmed)
+	msg = make([]byte, msg3Part1Size+msg3Len)
+	if _, err = io.ReadFull(c.conn, msg); err != nil {
+		return err
+	}
+	if payload, err = hs.ReadMessage(nil, msg); err != nyquist.ErrDone {
+		return err
+	}
+	blocks, err := parseBlocks(payload)
+	if err != nil {
+		return err
+	}
+	if len(blocks) == 0 || blocks[0].Type != BlockRouterInfo || len(blocks[0].Data) < 2 {
+		return ErrRouterInfo
+	}
+	status := hs.GetStatus()
+	routerInfo := blocks[0].Data[1:]
+	if cfg.VerifyRouterInfo != nil {
+		if err = cfg.VerifyRouterInfo(routerInfo, status.RemoteStatic); err != nil {
+			return fmt.Errorf("%w: %v", ErrRouterInfo, err)
+		}
+	}
+	c.state.RemoteRouterInfo = append([]byte{}, routerInfo...)
+
+	return c.onHandshakeDone(status, false)
+}
+
+func (c *Conn) writeHandshakeMessage(hs *nyquist.HandshakeState, msg, padding []byte) error {
+	if len(padding) > 0 {
+		hs.SymmetricState().MixHash(padding)
+		msg = append(msg, padding...)
+	}
+	_, err := c.conn.Write(msg)
+	return err
+}
+
+func (c *Conn) readHandshakePadding(hs *nyquist.HandshakeState, n int) error {
+	if n == 0 {
+		return nil
+	}
+	padding := make([]byte, n)
+	if _, err := io.ReadFull(c.conn, padding); err != nil {
+		return err
+	}
+	hs.SymmetricState().MixHash(padding)
+	return nil
+}
+
+func (c *Conn) onHandshakeDone(status *nyquist.HandshakeStatus, isClient bool) error {
+	defer zero(status.ChainingKey)
+
+	sipKeysAB, sipKeysBA := deriveSipKeys(status.ChainingKey, status.HandshakeHash)
+	defer zero(sipKeysAB)
+	defer zero(sipKeysBA)
+
+	csAB, csBA := status.CipherStates[0], status.CipherStates[1]
+	if isClient {
+		c.tx, c.rx = csAB, csBA
+		c.txMask.init(sipKeysAB)
+		c.rxMask.init(sipKeysBA)
+	} else {
+		c.tx, c.rx = csBA, csAB
+		c.txMask.init(sipKeysBA)
+		c.rxMask.init(sipKeysAB)
+	}
+
+	c.state.IsClient = isClient
+	c.state.RemoteStatic = status.RemoteStatic
+	c.state.HandshakeHash = status.HandshakeHash
+
+	return nil
+}
+
+// deriveSipKeys derives the per-direction SipHash keys and IVs from the
+// final chaining key and handshake hash.
+func deriveSipKeys(ck, h []byte) ([]byte, []byte) {
+	// ask_master = HKDF(ck, zerolen, info="ask")
+	askMaster := hmacSHA256(hmacSHA256(ck, nil), []byte("ask"), []byte{0x01})
+	defer zero(askMaster)
+
+	// sip_master = HKDF(ask_master, h || "siphash")
+	sipMaster := hmacSHA256(hmacSHA256(askMaster, h, []byte("siphash")), []byte{0x01})
+	defer zero(sipMaster)
+
+	tempKey := hmacSHA256(sipMaster, nil)
+	defer zero(tempKey)
+
+	sipKeysAB := hmacSHA256(tempKey, []byte{0x01})
+	sipKeysBA := hmacSHA256(tempKey, sipKeysAB, []byte{0x02})
+
+	return sipKeysAB, sipKeysBA
+}
+
+func hmacSHA256(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, v := range data {
+		_, _ = mac.Write(v)
+	}
+	return mac.Sum(nil)
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
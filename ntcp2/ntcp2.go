@@ -0,0 +1,301 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package ntcp2 implements the I2P NTCP2 transport protocol, on top of a
+// net.Conn.
+//
+// NTCP2 is a XK handshake, with the ephemeral keys obfuscated with
+// AES-256-CBC keyed by the responder's router hash, random padding mixed
+// into the handshake hash after the first two messages, and data phase
+// frame lengths obfuscated with a SipHash-2-4 keystream.
+//
+// Parsing and validating RouterInfos, and the contents of I2NP messages,
+// are the responsibility of the caller.  Responders should also maintain
+// a replay cache of the initiator ephemeral keys, and on handshake failure
+// read a random amount of data before closing the connection to resist
+// active probing, both of which are out of scope of this package.
+package ntcp2 // import "gitlab.com/yawning/nyquist.git/ntcp2"
+
+import (
+	"crypto/aes"
+	goCipher "crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/clock"
+	"gitlab.com/yawning/nyquist.git/dh"
+	"gitlab.com/yawning/nyquist.git/pattern"
+)
+
+const (
+	// ProtocolName is the NTCP2 Noise protocol name.
+	ProtocolName = "Noise_" + PatternName + "_25519_ChaChaPoly_SHA256"
+
+	// PatternName is the NTCP2 handshake pattern name.
+	PatternName = "XKaesobfse+hs2+hs3"
+
+	// RouterHashSize is the size of a router hash in bytes.
+	RouterHashSize = 32
+
+	// IVSize is the size of the published AES obfuscation IV in bytes.
+	IVSize = aes.BlockSize
+
+	// DefaultNetworkID is the I2P main network ID.
+	DefaultNetworkID = 2
+
+	// DefaultMaxPadding is the default maximum amount of random padding
+	// added to each handshake message and data phase frame.
+	DefaultMaxPadding = 64
+
+	// DefaultMaxClockSkew is the default maximum accepted difference
+	// between the local and peer clocks.
+	DefaultMaxClockSkew = 60 * time.Second
+
+	protocolVersion = 2
+
+	keySize     = 32
+	macSize     = 16
+	optionsSize = 16
+
+	msg1Size      = keySize + optionsSize + macSize
+	msg2Size      = keySize + optionsSize + macSize
+	msg3Part1Size = keySize + macSize
+)
+
+var (
+	// ErrMalformed is the error returned when a message is malformed.
+	ErrMalformed = errors.New("nyquist/ntcp2: malformed message")
+
+	// ErrClockSkew is the error returned when the peer's clock differs
+	// from the local clock by more than Config.MaxClockSkew.
+	ErrClockSkew = errors.New("nyquist/ntcp2: excessive clock skew")
+
+	// ErrNetworkID is the error returned when the peer is on a different
+	// I2P network.
+	ErrNetworkID = errors.New("nyquist/ntcp2: network ID mismatch")
+
+	// ErrRouterInfo is the error returned when the initiator's RouterInfo
+	// is missing or is rejected by Config.VerifyRouterInfo.
+	ErrRouterInfo = errors.New("nyquist/ntcp2: invalid RouterInfo")
+
+	errInvalidConfig = errors.New("nyquist/ntcp2: invalid config")
+
+	// Protocol is the NTCP2 Noise protocol.
+	Protocol *nyquist.Protocol
+
+	// Pattern is the NTCP2 handshake pattern, which is XK with a
+	// different name, so that the handshake hash is initialized
+	// correctly.
+	Pattern pattern.Pattern = &aesobfsPattern{pattern.XK}
+)
+
+type aesobfsPattern struct {
+	pattern.Pattern
+}
+
+func (pa *aesobfsPattern) String() string {
+	return PatternName
+}
+
+// Config is a NTCP2 configuration.
+type Config struct {
+	// LocalStatic is the local X25519 static keypair.
+	LocalStatic dh.Keypair
+
+	// RemoteStatic is the responder's static public key.  Only used by
+	// initiators.
+	RemoteStatic dh.PublicKey
+
+	// RouterHash is the responder's router hash.  Initiators must set this
+	// to the peer's router hash, and responders to their own.
+	RouterHash []byte
+
+	// IV is the responder's published AES obfuscation IV.
+	IV []byte
+
+	// RouterInfo is the initiator's serialized RouterInfo, sent in the
+	// final handshake message.  Only used by initiators.
+	RouterInfo []byte
+
+	// VerifyRouterInfo is the optional responder callback for validating
+	// the initiator's RouterInfo, and that it contains the initiator's
+	// static public key.
+	VerifyRouterInfo func(routerInfo []byte, remoteStatic dh.PublicKey) error
+
+	// NetworkID is the I2P network ID.  If 0, DefaultNetworkID is used.
+	NetworkID byte
+
+	// MaxPadding is the maximum amount of random padding added to each
+	// handshake message and data phase frame.  If 0, DefaultMaxPadding is
+	// used, and if negative, no padding is added.
+	MaxPadding int
+
+	// MaxClockSkew is the maximum accepted clock skew.  If 0,
+	// DefaultMaxClockSkew is used, and if negative, the peer's clock is
+	// not checked.
+	MaxClockSkew time.Duration
+
+	// Rng is the entropy source used for ephemeral keys and padding.  If
+	// nil, `crypto/rand.Reader` will be used.
+	Rng io.Reader
+
+	// Clock is the clock used for the handshake timestamps.  If nil, the
+	// system clock is used.
+	Clock clock.Clock
+}
+
+func (cfg *Config) networkID() byte {
+	if cfg.NetworkID == 0 {
+		return DefaultNetworkID
+	}
+	return cfg.NetworkID
+}
+
+func (cfg *Config) maxPadding() int {
+	switch {
+	case cfg.MaxPadding == 0:
+		return DefaultMaxPadding
+	case cfg.MaxPadding < 0:
+		return 0
+	default:
+		return cfg.MaxPadding
+	}
+}
+
+func (cfg *Config) rng() io.Reader {
+	if cfg.Rng == nil {
+		return rand.Reader
+	}
+	return cfg.Rng
+}
+
+func (cfg *Config) timestamp() uint32 {
+	return uint32(clock.Get(cfg.Clock).Now().Unix())
+}
+
+func (cfg *Config) checkTimestamp(ts uint32) error {
+	maxSkew := cfg.MaxClockSkew
+	switch {
+	case maxSkew == 0:
+		maxSkew = DefaultMaxClockSkew
+	case maxSkew < 0:
+		return nil
+	}
+
+	skew := time.Duration(int64(ts)-int64(cfg.timestamp())) * time.Second
+	if skew < -maxSkew || skew > maxSkew {
+		return fmt.Errorf("%w: %v", ErrClockSkew, skew)
+	}
+	return nil
+}
+
+func (cfg *Config) validate(isClient bool) error {
+	if _, ok := cfg.LocalStatic.(*dh.Keypair25519); !ok {
+		return fmt.Errorf("%w: missing or invalid LocalStatic", errInvalidConfig)
+	}
+	switch {
+	case len(cfg.RouterHash) != RouterHashSize:
+		return fmt.Errorf("%w: invalid RouterHash", errInvalidConfig)
+	case len(cfg.IV) != IVSize:
+		return fmt.Errorf("%w: invalid IV", errInvalidConfig)
+	}
+	if isClient {
+		if _, ok := cfg.RemoteStatic.(*dh.PublicKey25519); !ok {
+			return fmt.Errorf("%w: missing or invalid RemoteStatic", errInvalidConfig)
+		}
+		if len(cfg.RouterInfo) == 0 {
+			return fmt.Errorf("%w: missing RouterInfo", errInvalidConfig)
+		}
+	}
+	return nil
+}
+
+func (cfg *Config) randomPadding(maxLen int) ([]byte, error) {
+	if maxPadding := cfg.maxPadding(); maxLen > maxPadding {
+		maxLen = maxPadding
+	}
+	if maxLen <= 0 {
+		return nil, nil
+	}
+
+	var tmp [2]byte
+	if _, err := io.ReadFull(cfg.rng(), tmp[:]); err != nil {
+		return nil, err
+	}
+	padding := make([]byte, int(binary.BigEndian.Uint16(tmp[:]))%(maxLen+1))
+	if _, err := io.ReadFull(cfg.rng(), padding); err != nil {
+		return nil, err
+	}
+	return padding, nil
+}
+
+// aesObfs is the AES-256-CBC ephemeral key obfuscation, with the CBC state
+// carried over from the first message to the second.
+type aesObfs struct {
+	block goCipher.Block
+	iv    [aes.BlockSize]byte
+}
+
+func (o *aesObfs) encrypt(b []byte) {
+	goCipher.NewCBCEncrypter(o.block, o.iv[:]).CryptBlocks(b, b)
+	copy(o.iv[:], b[len(b)-aes.BlockSize:])
+}
+
+func (o *aesObfs) decrypt(b []byte) {
+	var nextIV [aes.BlockSize]byte
+	copy(nextIV[:], b[len(b)-aes.BlockSize:])
+	goCipher.NewCBCDecrypter(o.block, o.iv[:]).CryptBlocks(b, b)
+	o.iv = nextIV
+}
+
+func newAESObfs(cfg *Config) (*aesObfs, error) {
+	block, err := aes.NewCipher(cfg.RouterHash)
+	if err != nil {
+		return nil, err
+	}
+	o := &aesObfs{block: block}
+	copy(o.iv[:], cfg.IV)
+	return o, nil
+}
+
+func init() {
+	if err := pattern.Register(Pattern); err != nil {
+		panic("nyquist/ntcp2: failed to register pattern: " + err.Error())
+	}
+
+	var err error
+	if Protocol, err = nyquist.NewProtocol(ProtocolName); err != nil {
+		panic("nyquist/ntcp2: failed to create protocol: " + err.Error())
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package ntcp2
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git/clock"
+	"gitlab.com/yawning/nyquist.git/dh"
+	"gitlab.com/yawning/nyquist.git/pattern"
+)
+
+type testPeers struct {
+	clientCfg, serverCfg *Config
+}
+
+func newTestPeers(t *testing.T) *testPeers {
+	require := require.New(t)
+
+	clientStatic, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(err, "GenerateKeypair(client)")
+	serverStatic, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(err, "GenerateKeypair(server)")
+
+	routerHash, iv := make([]byte, RouterHashSize), make([]byte, IVSize)
+	_, _ = rand.Read(routerHash)
+	_, _ = rand.Read(iv)
+
+	return &testPeers{
+		clientCfg: &Config{
+			LocalStatic:  clientStatic,
+			RemoteStatic: serverStatic.Public(),
+			RouterHash:   routerHash,
+			IV:           iv,
+			RouterInfo:   []byte("client RouterInfo"),
+		},
+		serverCfg: &Config{
+			LocalStatic: serverStatic,
+			RouterHash:  routerHash,
+			IV:          iv,
+		},
+	}
+}
+
+func (p *testPeers) handshake() (*Conn, *Conn, error, error) {
+	c1, c2 := net.Pipe()
+
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	ch := make(chan result)
+	go func() {
+		conn, err := Server(c2, p.serverCfg)
+		if err != nil {
+			c2.Close()
+		}
+		ch <- result{conn, err}
+	}()
+	client, clientErr := Client(c1, p.clientCfg)
+	if clientErr != nil {
+		c1.Close()
+	}
+	res := <-ch
+
+	return client, res.conn, clientErr, res.err
+}
+
+func TestNTCP2(t *testing.T) {
+	t.Run("Protocol", func(t *testing.T) {
+		require := require.New(t)
+
+		require.Equal(ProtocolName, Protocol.String(), "Protocol")
+		require.Equal(Pattern, pattern.FromString(PatternName), "Pattern registered")
+		require.Equal(pattern.XK.Messages(), Pattern.Messages(), "Pattern is XK")
+	})
+
+	t.Run("SipHash", func(t *testing.T) {
+		require := require.New(t)
+
+		// Reference implementation test vector (8 byte message).
+		require.Equal(uint64(0x93f5f5799a932462), sipHash24(0x0706050403020100, 0x0f0e0d0c0b0a0908, 0x0706050403020100), "sipHash24")
+	})
+
+	t.Run("Integration", func(t *testing.T) {
+		require := require.New(t)
+
+		peers := newTestPeers(t)
+		var verifiedStatic dh.PublicKey
+		peers.serverCfg.VerifyRouterInfo = func(routerInfo []byte, remoteStatic dh.PublicKey) error {
+			verifiedStatic = remoteStatic
+			return nil
+		}
+
+		client, server, clientErr, serverErr := peers.handshake()
+		require.NoError(clientErr, "Client")
+		require.NoError(serverErr, "Server")
+
+		clientState, serverState := client.ConnectionState(), server.ConnectionState()
+		require.True(clientState.IsClient, "IsClient - client")
+		require.False(serverState.IsClient, "IsClient - server")
+		require.Equal(clientState.HandshakeHash, serverState.HandshakeHash, "HandshakeHash")
+		require.Equal(peers.serverCfg.LocalStatic.Public().Bytes(), clientState.RemoteStatic.Bytes(), "RemoteStatic - client")
+		require.Equal(peers.clientCfg.LocalStatic.Public().Bytes(), serverState.RemoteStatic.Bytes(), "RemoteStatic - server")
+		require.Equal(serverState.RemoteStatic, verifiedStatic, "VerifyRouterInfo")
+		require.Equal(peers.clientCfg.RouterInfo, serverState.RemoteRouterInfo, "RemoteRouterInfo")
+
+		i2np := Block{Type: BlockI2NP, Data: bytes.Repeat([]byte{0xa5}, 1024)}
+		for i := 0; i < 3; i++ {
+			errCh := make(chan error)
+			go func() {
+				errCh <- client.WriteFrame(i2np)
+			}()
+			blocks, err := server.ReadFrame()
+			require.NoError(err, "ReadFrame(server, %d)", i)
+			require.NoError(<-errCh, "WriteFrame(client, %d)", i)
+			require.Equal(i2np, blocks[0], "ReadFrame(server, %d)", i)
+			if len(blocks) == 2 {
+				require.Equal(BlockPadding, blocks[1].Type, "ReadFrame(server, %d) - padding", i)
+			}
+
+			go func() {
+				errCh <- server.WriteFrame(i2np, Block{Type: BlockPadding})
+			}()
+			blocks, err = client.ReadFrame()
+			require.NoError(err, "ReadFrame(client, %d)", i)
+			require.NoError(<-errCh, "WriteFrame(server, %d)", i)
+			require.Equal([]Block{i2np, {Type: BlockPadding, Data: []byte{}}}, blocks, "ReadFrame(client, %d)", i)
+		}
+
+		err := client.WriteFrame(Block{Type: BlockI2NP, Data: make([]byte, MaxFramePayload)})
+		require.Equal(ErrFrameSize, err, "WriteFrame - oversized")
+		err = client.WriteFrame(Block{Type: BlockPadding}, i2np)
+		require.True(errors.Is(err, ErrMalformed), "WriteFrame - padding not last")
+
+		go client.Close()
+		_, err = server.ReadFrame()
+		var termErr *TerminationError
+		require.True(errors.As(err, &termErr), "ReadFrame - termination")
+		require.EqualValues(3, termErr.ValidFrames, "ValidFrames")
+		require.EqualValues(TerminationNormal, termErr.Reason, "Reason")
+		server.conn.Close()
+	})
+
+	t.Run("Mismatched", func(t *testing.T) {
+		require := require.New(t)
+
+		// Wrong router hash (AES obfuscation key).
+		peers := newTestPeers(t)
+		peers.clientCfg.RouterHash = append([]byte{}, peers.clientCfg.RouterHash...)
+		peers.clientCfg.RouterHash[0] ^= 0xff
+		_, _, clientErr, serverErr := peers.handshake()
+		require.Error(clientErr, "Client - bad RouterHash")
+		require.Error(serverErr, "Server - bad RouterHash")
+
+		// Wrong network ID.
+		peers = newTestPeers(t)
+		peers.serverCfg.NetworkID = 3
+		_, _, clientErr, serverErr = peers.handshake()
+		require.Error(clientErr, "Client - bad NetworkID")
+		require.Equal(ErrNetworkID, serverErr, "Server - bad NetworkID")
+
+		// Excessive clock skew.
+		peers = newTestPeers(t)
+		peers.serverCfg.Clock = clock.NewFake(time.Now().Add(2 * DefaultMaxClockSkew))
+		_, _, clientErr, serverErr = peers.handshake()
+		require.Error(clientErr, "Client - clock skew")
+		require.True(errors.Is(serverErr, ErrClockSkew), "Server - clock skew")
+
+		// RouterInfo rejected.
+		peers = newTestPeers(t)
+		peers.serverCfg.VerifyRouterInfo = func([]byte, dh.PublicKey) error {
+			return errors.New("banned")
+		}
+		client, _, clientErr, serverErr := peers.handshake()
+		require.NoError(clientErr, "Client - RouterInfo rejected")
+		require.True(errors.Is(serverErr, ErrRouterInfo), "Server - RouterInfo rejected")
+		client.conn.Close()
+
+		// Invalid configuration.
+		peers = newTestPeers(t)
+		peers.clientCfg.RouterInfo = nil
+		_, err := Client(nil, peers.clientCfg)
+		require.True(errors.Is(err, errInvalidConfig), "Client - missing RouterInfo")
+	})
+
+	t.Run("Blocks", func(t *testing.T) {
+		require := require.New(t)
+
+		b, err := appendBlocks(nil, []Block{{Type: BlockDateTime, Data: []byte{1, 2, 3, 4}}, {Type: BlockPadding, Data: []byte{0}}})
+		require.NoError(err, "appendBlocks")
+		require.Equal([]byte{0, 0, 4, 1, 2, 3, 4, 254, 0, 1, 0}, b, "appendBlocks")
+
+		blocks, err := parseBlocks(b)
+		require.NoError(err, "parseBlocks")
+		require.Len(blocks, 2, "parseBlocks")
+
+		_, err = parseBlocks(b[:len(b)-1])
+		require.True(errors.Is(err, ErrMalformed), "parseBlocks - truncated")
+		_, err = parseBlocks(append([]byte{254, 0, 0}, b...))
+		require.True(errors.Is(err, ErrMalformed), "parseBlocks - padding not last")
+	})
+}
@@ -0,0 +1,279 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"io"
+	"math"
+
+	"github.com/oasisprotocol/curve25519-voi/curve"
+	"github.com/oasisprotocol/curve25519-voi/curve/scalar"
+	"golang.org/x/crypto/hkdf"
+)
+
+// ClientConfig is the client configuration, shared by registration and
+// login.
+type ClientConfig struct {
+	// CredentialID is the credential identifier (eg: the user name).
+	CredentialID []byte
+
+	// Password is the user's password.
+	Password []byte
+
+	// ServerIdentity is the server identity (eg: the server's static
+	// public key), that the envelope is bound to.
+	ServerIdentity []byte
+
+	// Stretch is the optional key stretching function applied to the
+	// OPRF output (eg: argon2id), to harden the password against
+	// offline guessing should the server's records be compromised.  It
+	// must be the same for registration and login.
+	Stretch func(oprfOutput []byte) []byte
+
+	// Rng is the entropy source.  If unset, crypto/rand.Reader will be
+	// used.
+	Rng io.Reader
+}
+
+func (cfg *ClientConfig) getRng() io.Reader {
+	if cfg.Rng == nil {
+		return rand.Reader
+	}
+	return cfg.Rng
+}
+
+// client is the OPRF blinding state common to registration and login.
+type client struct {
+	cfg   *ClientConfig
+	blind scalar.Scalar
+	done  bool
+}
+
+// init blinds the password, and returns the request prefixed with the
+// credential identifier.
+func (c *client) init(cfg *ClientConfig) ([]byte, error) {
+	if len(cfg.CredentialID) > math.MaxUint16 || len(cfg.Password) > math.MaxUint16 {
+		return nil, ErrMalformed
+	}
+	c.cfg = cfg
+
+	p, err := hashToGroup(cfg.Password)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = c.blind.SetRandom(cfg.getRng()); err != nil {
+		return nil, err
+	}
+
+	var blinded curve.RistrettoPoint
+	blinded.Mul(p, &c.blind)
+
+	req := appendLV(nil, cfg.CredentialID)
+	return append(req, encodeElement(&blinded)...), nil
+}
+
+// randomizedPassword unblinds the evaluated element, and derives the
+// randomized password.
+func (c *client) randomizedPassword(evaluated []byte) ([]byte, error) {
+	z, err := decodeElement(evaluated)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		inv scalar.Scalar
+		n   curve.RistrettoPoint
+	)
+	n.Mul(z, inv.Invert(&c.blind))
+
+	h := sha512.New()
+	_, _ = h.Write(appendLV(nil, c.cfg.Password))
+	_, _ = h.Write(appendLV(nil, encodeElement(&n)))
+	_, _ = h.Write([]byte("Finalize"))
+	oprfOutput := h.Sum(nil)
+
+	stretched := oprfOutput
+	if c.cfg.Stretch != nil {
+		stretched = c.cfg.Stretch(oprfOutput)
+	}
+
+	return hkdf.Extract(sha512.New, append(oprfOutput, stretched...), nil), nil
+}
+
+// Reset clears the blinding scalar, and marks the exchange as finished.
+func (c *client) Reset() {
+	c.blind.Zero()
+	c.done = true
+}
+
+// envelopeKeys derives the client key pair, the envelope MAC, and the
+// export key from the randomized password and the envelope nonce.
+func (c *client) envelopeKeys(rwd, nonce []byte) (*scalar.Scalar, []byte, []byte, []byte, error) {
+	seed := expand(rwd, 32, nonce, []byte("PrivateKey"))
+	sk, pk, err := deriveKeyPair(seed, "OPAQUE-DeriveDiffieHellmanKeyPair")
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	authKey := expand(rwd, sha512.Size, nonce, []byte("AuthKey"))
+	tag := mac(authKey, nonce, appendLV(nil, c.cfg.ServerIdentity), appendLV(nil, c.cfg.CredentialID), pk)
+	exportKey := expand(rwd, ExportKeySize, nonce, []byte("ExportKey"))
+
+	return sk, pk, tag, exportKey, nil
+}
+
+// ClientRegistration is an in-progress client registration.
+type ClientRegistration struct {
+	client
+	req []byte
+}
+
+// NewClientRegistration creates a new client registration.
+func NewClientRegistration(cfg *ClientConfig) (*ClientRegistration, error) {
+	var (
+		reg ClientRegistration
+		err error
+	)
+	if reg.req, err = reg.init(cfg); err != nil {
+		return nil, err
+	}
+	return &reg, nil
+}
+
+// Request returns the registration request, to be sent to the server.
+func (reg *ClientRegistration) Request() []byte {
+	return append([]byte{}, reg.req...)
+}
+
+// Finish processes the server's registration response, and returns the
+// record to be uploaded to the server, and the export key.
+func (reg *ClientRegistration) Finish(resp []byte) (*Record, []byte, error) {
+	if reg.done {
+		return nil, nil, errFinished
+	}
+	defer reg.Reset()
+
+	if len(resp) != elementSize {
+		return nil, nil, ErrMalformed
+	}
+	rwd, err := reg.randomizedPassword(resp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err = io.ReadFull(reg.cfg.getRng(), nonce); err != nil {
+		return nil, nil, err
+	}
+	sk, pk, tag, exportKey, err := reg.envelopeKeys(rwd, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	sk.Zero()
+
+	return &Record{
+		ClientPublicKey: pk,
+		MaskingKey:      expand(rwd, sha512.Size, []byte("MaskingKey")),
+		Envelope:        append(nonce, tag...),
+	}, exportKey, nil
+}
+
+// ClientLogin is an in-progress client login.
+type ClientLogin struct {
+	client
+	ke1 []byte
+}
+
+// NewClientLogin creates a new client login.
+func NewClientLogin(cfg *ClientConfig) (*ClientLogin, error) {
+	var (
+		login ClientLogin
+		err   error
+	)
+	if login.ke1, err = login.init(cfg); err != nil {
+		return nil, err
+	}
+	return &login, nil
+}
+
+// Start returns the first login message (KE1), to be sent to the server.
+func (login *ClientLogin) Start() []byte {
+	return append([]byte{}, login.ke1...)
+}
+
+// Finish processes the server's response (KE2), and returns the final
+// login message (KE3) to be sent to the server, and the export key.  The
+// binding must be the channel binding (eg: the handshake hash), and
+// match the server's.
+func (login *ClientLogin) Finish(ke2, binding []byte) ([]byte, []byte, error) {
+	if login.done {
+		return nil, nil, errFinished
+	}
+	defer login.Reset()
+
+	if len(ke2) != ke2Size {
+		return nil, nil, ErrMalformed
+	}
+	evaluated, ke2Rest := ke2[:elementSize], ke2[elementSize:]
+	maskingNonce, ke2Rest := ke2Rest[:nonceSize], ke2Rest[nonceSize:]
+	masked, ke2Rest := ke2Rest[:envelopeSize], ke2Rest[envelopeSize:]
+	x, err := decodeElement(ke2Rest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rwd, err := login.randomizedPassword(evaluated)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	maskingKey := expand(rwd, sha512.Size, []byte("MaskingKey"))
+	pad := expand(maskingKey, envelopeSize, maskingNonce, []byte("CredentialResponsePad"))
+	envelope := make([]byte, envelopeSize)
+	xorBytes(envelope, masked, pad)
+
+	nonce, expectedTag := envelope[:nonceSize], envelope[nonceSize:]
+	sk, _, tag, exportKey, err := login.envelopeKeys(rwd, nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer sk.Zero()
+	if !hmac.Equal(tag, expectedTag) {
+		return nil, nil, ErrAuthentication
+	}
+
+	var dh curve.RistrettoPoint
+	dh.Mul(x, sk)
+
+	return clientMAC(encodeElement(&dh), binding, login.ke1, ke2), exportKey, nil
+}
@@ -0,0 +1,256 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package opaque implements OPAQUE-style asymmetric password
+// authentication over an established Noise channel, so that servers can
+// authenticate users by password without ever seeing it.
+//
+// The exchange is intended to be run immediately after a handshake that
+// authenticates the server (eg: `NK`, `XX`), with the handshake hash as
+// the channel binding.  The server identity is typically the server's
+// static public key, and the credential identifier the user name.
+//
+// Registration is a single round trip, after which the client uploads a
+// Record that the server stores:
+//
+//	client: req := reg.Request()
+//	server: resp := server.RegistrationResponse(req)
+//	client: record, exportKey := reg.Finish(resp)
+//
+// Login is 3 messages, after which the server has authenticated the
+// client, bound to the channel, and the client has recovered the same
+// export key as during registration:
+//
+//	client: ke1 := login.Start()
+//	server: ke2 := server.Login(ke1, binding, lookup)
+//	client: ke3, exportKey := login.Finish(ke2, binding)
+//	server: credentialID := serverLogin.Finish(ke3)
+//
+// The OPRF, key derivation, and envelope are modeled after RFC 9497 and
+// RFC 9807 with ristretto255 and SHA-512, however as the channel already
+// provides the AKE, OPAQUE-3DH is replaced by a proof of possession of
+// the client key that is bound to the channel.  The messages are not
+// interoperable with other implementations.
+package opaque // import "gitlab.com/yawning/nyquist.git/opaque"
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+
+	"github.com/oasisprotocol/curve25519-voi/curve"
+	"github.com/oasisprotocol/curve25519-voi/curve/scalar"
+	"github.com/oasisprotocol/curve25519-voi/primitives/h2c"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// SeedSize is the size of the server's OPRF seed.
+	SeedSize = sha512.Size
+
+	// ExportKeySize is the size of the client's export key.
+	ExportKeySize = sha512.Size
+
+	// RecordSize is the size of a serialized Record.
+	RecordSize = elementSize + sha512.Size + envelopeSize
+
+	elementSize  = curve.CompressedPointSize
+	nonceSize    = 32
+	macSize      = sha512.Size
+	envelopeSize = nonceSize + macSize
+	ke2Size      = elementSize + nonceSize + envelopeSize + elementSize
+
+	contextString = "OPRFV1-\x00-ristretto255-SHA512"
+)
+
+var (
+	// ErrMalformed is the error returned when a message or record is
+	// malformed.
+	ErrMalformed = errors.New("nyquist/opaque: malformed message")
+
+	// ErrAuthentication is the error returned when authentication fails,
+	// due to an incorrect password, an unknown credential identifier, or
+	// a mismatched server identity or channel binding.
+	ErrAuthentication = errors.New("nyquist/opaque: authentication failed")
+
+	errFinished    = errors.New("nyquist/opaque: already finished")
+	errInvalidSeed = errors.New("nyquist/opaque: invalid OPRF seed")
+)
+
+// Record is the registration record stored by the server for each
+// credential identifier.
+type Record struct {
+	// ClientPublicKey is the client's public key.
+	ClientPublicKey []byte
+
+	// MaskingKey is the key used to mask the envelope in login responses.
+	MaskingKey []byte
+
+	// Envelope is the client's envelope.
+	Envelope []byte
+}
+
+// MarshalBinary serializes the record.
+func (r *Record) MarshalBinary() ([]byte, error) {
+	if len(r.ClientPublicKey) != elementSize || len(r.MaskingKey) != sha512.Size || len(r.Envelope) != envelopeSize {
+		return nil, ErrMalformed
+	}
+
+	b := make([]byte, 0, RecordSize)
+	b = append(b, r.ClientPublicKey...)
+	b = append(b, r.MaskingKey...)
+	return append(b, r.Envelope...), nil
+}
+
+// UnmarshalBinary deserializes a record.
+func (r *Record) UnmarshalBinary(data []byte) error {
+	if len(data) != RecordSize {
+		return ErrMalformed
+	}
+	if _, err := decodeElement(data[:elementSize]); err != nil {
+		return err
+	}
+
+	data = append([]byte{}, data...)
+	r.ClientPublicKey = data[:elementSize]
+	r.MaskingKey = data[elementSize : elementSize+sha512.Size]
+	r.Envelope = data[elementSize+sha512.Size:]
+
+	return nil
+}
+
+func hashToGroup(input []byte) (*curve.RistrettoPoint, error) {
+	return h2c.Ristretto255_XMD_R255MAP_RO(crypto.SHA512, []byte("HashToGroup-"+contextString), input)
+}
+
+func hashToScalar(input []byte, dst string) (*scalar.Scalar, error) {
+	var uniform [scalar.ScalarWideSize]byte
+	if err := h2c.ExpandMessageXMD(uniform[:], crypto.SHA512, []byte(dst), input); err != nil {
+		return nil, err
+	}
+	return scalar.NewFromBytesModOrderWide(uniform[:])
+}
+
+// deriveKeyPair deterministically derives a secret scalar and the
+// corresponding public element from a seed (RFC 9497 DeriveKeyPair).
+func deriveKeyPair(seed []byte, info string) (*scalar.Scalar, []byte, error) {
+	input := append([]byte{}, seed...)
+	input = appendLV(input, []byte(info))
+	input = append(input, 0)
+
+	zero := scalar.New()
+	for counter := 0; counter < 256; counter++ {
+		input[len(input)-1] = byte(counter)
+		sk, err := hashToScalar(input, "DeriveKeyPair"+contextString)
+		if err != nil {
+			return nil, nil, err
+		}
+		if sk.Equal(zero) == 0 {
+			var pk curve.RistrettoPoint
+			pk.MulBasepoint(curve.RISTRETTO_BASEPOINT_TABLE, sk)
+			return sk, encodeElement(&pk), nil
+		}
+	}
+
+	return nil, nil, errors.New("nyquist/opaque: failed to derive key pair")
+}
+
+func encodeElement(p *curve.RistrettoPoint) []byte {
+	var cp curve.CompressedRistretto
+	cp.SetRistrettoPoint(p)
+	return append([]byte{}, cp[:]...)
+}
+
+// decodeElement decodes a group element, rejecting the identity.
+func decodeElement(b []byte) (*curve.RistrettoPoint, error) {
+	var (
+		cp curve.CompressedRistretto
+		p  curve.RistrettoPoint
+	)
+	if _, err := cp.SetBytes(b); err != nil {
+		return nil, ErrMalformed
+	}
+	if _, err := p.SetCompressed(&cp); err != nil || p.IsIdentity() {
+		return nil, ErrMalformed
+	}
+	return &p, nil
+}
+
+func expand(prk []byte, n int, info ...[]byte) []byte {
+	var b []byte
+	for _, v := range info {
+		b = append(b, v...)
+	}
+
+	out := make([]byte, n)
+	_, _ = hkdf.Expand(sha512.New, prk, b).Read(out)
+	return out
+}
+
+func mac(key []byte, data ...[]byte) []byte {
+	m := hmac.New(sha512.New, key)
+	for _, v := range data {
+		_, _ = m.Write(v)
+	}
+	return m.Sum(nil)
+}
+
+func xorBytes(dst, a, b []byte) {
+	for i := range dst {
+		dst[i] = a[i] ^ b[i]
+	}
+}
+
+func appendLV(b, data []byte) []byte {
+	var tmp [2]byte
+	binary.BigEndian.PutUint16(tmp[:], uint16(len(data)))
+	b = append(b, tmp[:]...)
+	return append(b, data...)
+}
+
+func splitLV(b []byte) ([]byte, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, ErrMalformed
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return nil, nil, ErrMalformed
+	}
+	return b[2 : 2+n], b[2+n:], nil
+}
+
+// clientMAC computes the client's channel-bound proof of possession of
+// the client key.
+func clientMAC(dh, binding, ke1, ke2 []byte) []byte {
+	prk := hkdf.Extract(sha512.New, dh, nil)
+	key := expand(prk, macSize, []byte("nyquist/opaque: client mac"))
+	return mac(key, appendLV(nil, binding), ke1, ke2)
+}
@@ -0,0 +1,229 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git"
+)
+
+func channelBindings(t *testing.T) ([]byte, []byte) {
+	require := require.New(t)
+
+	protocol, err := nyquist.NewProtocol("Noise_NN_25519_ChaChaPoly_BLAKE2s")
+	require.NoError(err, "NewProtocol")
+	alice, err := nyquist.NewHandshake(&nyquist.HandshakeConfig{
+		Protocol:    protocol,
+		IsInitiator: true,
+	})
+	require.NoError(err, "NewHandshake(alice)")
+	defer alice.Reset()
+	bob, err := nyquist.NewHandshake(&nyquist.HandshakeConfig{
+		Protocol: protocol,
+	})
+	require.NoError(err, "NewHandshake(bob)")
+	defer bob.Reset()
+
+	msg, err := alice.WriteMessage(nil, nil)
+	require.NoError(err, "alice.WriteMessage")
+	_, err = bob.ReadMessage(nil, msg)
+	require.NoError(err, "bob.ReadMessage")
+	msg, err = bob.WriteMessage(nil, nil)
+	require.Equal(nyquist.ErrDone, err, "bob.WriteMessage")
+	_, err = alice.ReadMessage(nil, msg)
+	require.Equal(nyquist.ErrDone, err, "alice.ReadMessage")
+
+	return alice.GetStatus().HandshakeHash, bob.GetStatus().HandshakeHash
+}
+
+func TestOPAQUE(t *testing.T) {
+	seed := make([]byte, SeedSize)
+	_, _ = rand.Read(seed)
+	server := &Server{OPRFSeed: seed}
+
+	serverIdentity := []byte("server static public key")
+	newClientConfig := func(password string) *ClientConfig {
+		return &ClientConfig{
+			CredentialID:   []byte("alice"),
+			Password:       []byte(password),
+			ServerIdentity: serverIdentity,
+		}
+	}
+
+	register := func(cfg *ClientConfig) (*Record, []byte) {
+		require := require.New(t)
+
+		reg, err := NewClientRegistration(cfg)
+		require.NoError(err, "NewClientRegistration")
+		credentialID, resp, err := server.RegistrationResponse(reg.Request())
+		require.NoError(err, "RegistrationResponse")
+		require.Equal(cfg.CredentialID, credentialID, "RegistrationResponse - credential ID")
+		record, exportKey, err := reg.Finish(resp)
+		require.NoError(err, "reg.Finish")
+
+		// The record survives serialization.
+		b, err := record.MarshalBinary()
+		require.NoError(err, "record.MarshalBinary")
+		require.Len(b, RecordSize, "record.MarshalBinary")
+		var stored Record
+		require.NoError(stored.UnmarshalBinary(b), "record.UnmarshalBinary")
+
+		return &stored, exportKey
+	}
+
+	record, regExportKey := register(newClientConfig("hunter2"))
+	lookup := func(credentialID []byte) (*Record, error) {
+		if string(credentialID) == "alice" {
+			return record, nil
+		}
+		return nil, nil
+	}
+
+	login := func(cfg *ClientConfig, clientBinding, serverBinding []byte) ([]byte, error, []byte, error) {
+		require := require.New(t)
+
+		cl, err := NewClientLogin(cfg)
+		require.NoError(err, "NewClientLogin")
+		sl, ke2, err := server.Login(cl.Start(), serverBinding, lookup)
+		require.NoError(err, "server.Login")
+		ke3, exportKey, clientErr := cl.Finish(ke2, clientBinding)
+		if clientErr != nil {
+			// Send a garbage KE3, to exercise the server.
+			ke3 = make([]byte, macSize)
+		}
+		credentialID, serverErr := sl.Finish(ke3)
+		return exportKey, clientErr, credentialID, serverErr
+	}
+
+	t.Run("Login", func(t *testing.T) {
+		require := require.New(t)
+
+		clientBinding, serverBinding := channelBindings(t)
+		exportKey, clientErr, credentialID, serverErr := login(newClientConfig("hunter2"), clientBinding, serverBinding)
+		require.NoError(clientErr, "client.Finish")
+		require.NoError(serverErr, "server.Finish")
+		require.Equal([]byte("alice"), credentialID, "credential ID")
+		require.Equal(regExportKey, exportKey, "export key")
+	})
+
+	t.Run("WrongPassword", func(t *testing.T) {
+		require := require.New(t)
+
+		clientBinding, serverBinding := channelBindings(t)
+		_, clientErr, _, serverErr := login(newClientConfig("hunter3"), clientBinding, serverBinding)
+		require.Equal(ErrAuthentication, clientErr, "client.Finish")
+		require.Equal(ErrAuthentication, serverErr, "server.Finish")
+	})
+
+	t.Run("UnknownCredential", func(t *testing.T) {
+		require := require.New(t)
+
+		cfg := newClientConfig("hunter2")
+		cfg.CredentialID = []byte("mallory")
+		clientBinding, serverBinding := channelBindings(t)
+		_, clientErr, _, serverErr := login(cfg, clientBinding, serverBinding)
+		require.Equal(ErrAuthentication, clientErr, "client.Finish")
+		require.Equal(ErrAuthentication, serverErr, "server.Finish")
+	})
+
+	t.Run("WrongServerIdentity", func(t *testing.T) {
+		require := require.New(t)
+
+		cfg := newClientConfig("hunter2")
+		cfg.ServerIdentity = []byte("impostor static public key")
+		clientBinding, serverBinding := channelBindings(t)
+		_, clientErr, _, _ := login(cfg, clientBinding, serverBinding)
+		require.Equal(ErrAuthentication, clientErr, "client.Finish")
+	})
+
+	t.Run("MismatchedBinding", func(t *testing.T) {
+		require := require.New(t)
+
+		// The client's login is relayed from a different channel.
+		clientBinding, _ := channelBindings(t)
+		_, serverBinding := channelBindings(t)
+		_, clientErr, _, serverErr := login(newClientConfig("hunter2"), clientBinding, serverBinding)
+		require.NoError(clientErr, "client.Finish")
+		require.Equal(ErrAuthentication, serverErr, "server.Finish")
+	})
+
+	t.Run("Stretch", func(t *testing.T) {
+		require := require.New(t)
+
+		stretch := func(b []byte) []byte {
+			h := sha256.Sum256(b)
+			return h[:]
+		}
+		cfg := newClientConfig("hunter2")
+		cfg.Stretch = stretch
+		record, _ = register(cfg)
+
+		clientBinding, serverBinding := channelBindings(t)
+		_, clientErr, _, serverErr := login(cfg, clientBinding, serverBinding)
+		require.NoError(clientErr, "client.Finish - stretched")
+		require.NoError(serverErr, "server.Finish - stretched")
+
+		_, clientErr, _, _ = login(newClientConfig("hunter2"), clientBinding, serverBinding)
+		require.Equal(ErrAuthentication, clientErr, "client.Finish - unstretched")
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		require := require.New(t)
+
+		cl, err := NewClientLogin(newClientConfig("hunter2"))
+		require.NoError(err, "NewClientLogin")
+		ke1 := cl.Start()
+
+		_, _, err = server.Login(ke1[:len(ke1)-1], nil, lookup)
+		require.Equal(ErrMalformed, err, "server.Login - truncated")
+		badKE1 := append([]byte{}, ke1...)
+		copy(badKE1[len(badKE1)-elementSize:], make([]byte, elementSize))
+		_, _, err = server.Login(badKE1, nil, lookup)
+		require.Equal(ErrMalformed, err, "server.Login - identity element")
+
+		_, _, err = (&Server{}).Login(ke1, nil, lookup)
+		require.Equal(errInvalidSeed, err, "server.Login - no seed")
+
+		_, _, err = cl.Finish(make([]byte, ke2Size-1), nil)
+		require.Equal(ErrMalformed, err, "client.Finish - truncated")
+		_, _, err = cl.Finish(make([]byte, ke2Size), nil)
+		require.Equal(errFinished, err, "client.Finish - again")
+
+		var r Record
+		require.Equal(ErrMalformed, r.UnmarshalBinary(make([]byte, RecordSize-1)), "UnmarshalBinary - truncated")
+		_, err = r.MarshalBinary()
+		require.Equal(ErrMalformed, err, "MarshalBinary - empty")
+	})
+}
@@ -0,0 +1,205 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package opaque
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"io"
+
+	"github.com/oasisprotocol/curve25519-voi/curve"
+	"github.com/oasisprotocol/curve25519-voi/curve/scalar"
+)
+
+// Server is an OPAQUE server.
+type Server struct {
+	// OPRFSeed is the long-term secret from which the per-credential
+	// OPRF keys are derived.  It must be SeedSize bytes, and kept for
+	// as long as any records are.
+	OPRFSeed []byte
+
+	// Rng is the entropy source.  If unset, crypto/rand.Reader will be
+	// used.
+	Rng io.Reader
+}
+
+func (s *Server) getRng() io.Reader {
+	if s.Rng == nil {
+		return rand.Reader
+	}
+	return s.Rng
+}
+
+// evaluate parses a registration request or KE1, and returns the
+// credential identifier and the evaluated element.
+func (s *Server) evaluate(req []byte) ([]byte, []byte, error) {
+	if len(s.OPRFSeed) != SeedSize {
+		return nil, nil, errInvalidSeed
+	}
+
+	credentialID, rest, err := splitLV(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rest) != elementSize {
+		return nil, nil, ErrMalformed
+	}
+	blinded, err := decodeElement(rest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	seed := expand(s.OPRFSeed, 32, credentialID, []byte("OprfKey"))
+	k, _, err := deriveKeyPair(seed, "OPAQUE-DeriveKeyPair")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer k.Zero()
+
+	var evaluated curve.RistrettoPoint
+	evaluated.Mul(blinded, k)
+
+	return append([]byte{}, credentialID...), encodeElement(&evaluated), nil
+}
+
+// RegistrationResponse processes a client's registration request, and
+// returns the credential identifier, and the response to be sent to the
+// client.  The record subsequently uploaded by the client should be
+// stored under the credential identifier, on a channel that has
+// authenticated the client as being entitled to register it.
+func (s *Server) RegistrationResponse(req []byte) ([]byte, []byte, error) {
+	return s.evaluate(req)
+}
+
+// ServerLogin is an in-progress server login.
+type ServerLogin struct {
+	credentialID []byte
+	binding      []byte
+	transcript   []byte
+
+	clientPublicKey *curve.RistrettoPoint
+	x               scalar.Scalar
+
+	done bool
+}
+
+// Login processes a client's first login message (KE1), and returns the
+// in-progress login and the response (KE2) to be sent to the client.  The
+// binding must be the channel binding (eg: the handshake hash).
+//
+// The lookup function must return the record for the credential
+// identifier, or nil if none exists, in which case a response that is
+// indistinguishable from that for a registered credential is sent, and
+// the login will fail.
+func (s *Server) Login(ke1, binding []byte, lookup func(credentialID []byte) (*Record, error)) (*ServerLogin, []byte, error) {
+	credentialID, evaluated, err := s.evaluate(ke1)
+	if err != nil {
+		return nil, nil, err
+	}
+	record, err := lookup(credentialID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sl := &ServerLogin{
+		credentialID: credentialID,
+		binding:      append([]byte{}, binding...),
+	}
+
+	maskingNonce := make([]byte, nonceSize)
+	masked := make([]byte, envelopeSize)
+	if _, err = io.ReadFull(s.getRng(), maskingNonce); err != nil {
+		return nil, nil, err
+	}
+	if record == nil {
+		if _, err = io.ReadFull(s.getRng(), masked); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		if len(record.MaskingKey) != sha512.Size || len(record.Envelope) != envelopeSize {
+			return nil, nil, ErrMalformed
+		}
+		if sl.clientPublicKey, err = decodeElement(record.ClientPublicKey); err != nil {
+			return nil, nil, err
+		}
+		pad := expand(record.MaskingKey, envelopeSize, maskingNonce, []byte("CredentialResponsePad"))
+		xorBytes(masked, record.Envelope, pad)
+	}
+
+	if _, err = sl.x.SetRandom(s.getRng()); err != nil {
+		return nil, nil, err
+	}
+	var x curve.RistrettoPoint
+	x.MulBasepoint(curve.RISTRETTO_BASEPOINT_TABLE, &sl.x)
+
+	ke2 := make([]byte, 0, ke2Size)
+	ke2 = append(ke2, evaluated...)
+	ke2 = append(ke2, maskingNonce...)
+	ke2 = append(ke2, masked...)
+	ke2 = append(ke2, encodeElement(&x)...)
+
+	sl.transcript = append(append([]byte{}, ke1...), ke2...)
+
+	return sl, ke2, nil
+}
+
+// Finish processes the client's final login message (KE3), and returns
+// the authenticated credential identifier.
+func (sl *ServerLogin) Finish(ke3 []byte) ([]byte, error) {
+	if sl.done {
+		return nil, errFinished
+	}
+	defer sl.Reset()
+
+	if len(ke3) != macSize {
+		return nil, ErrMalformed
+	}
+	if sl.clientPublicKey == nil {
+		return nil, ErrAuthentication
+	}
+
+	var dh curve.RistrettoPoint
+	dh.Mul(sl.clientPublicKey, &sl.x)
+
+	ke1Len := len(sl.transcript) - ke2Size
+	expected := clientMAC(encodeElement(&dh), sl.binding, sl.transcript[:ke1Len], sl.transcript[ke1Len:])
+	if !hmac.Equal(expected, ke3) {
+		return nil, ErrAuthentication
+	}
+
+	return sl.credentialID, nil
+}
+
+// Reset clears the ephemeral secret, and marks the login as finished.
+func (sl *ServerLogin) Reset() {
+	sl.x.Zero()
+	sl.done = true
+}
@@ -0,0 +1,185 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package pairing
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	bech32Charset  = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+	bech32mConst   = 0x2bc830a3
+	bech32Checksum = 6
+
+	// The BCH code used by bech32 guarantees detection of up to 4 errors
+	// for strings up to this length.
+	bech32MaxLength = 1023
+)
+
+var (
+	errBech32Length   = errors.New("nyquist/pairing: invalid bech32 length")
+	errBech32Case     = errors.New("nyquist/pairing: mixed case bech32 string")
+	errBech32Char     = errors.New("nyquist/pairing: invalid bech32 character")
+	errBech32Checksum = errors.New("nyquist/pairing: invalid bech32 checksum")
+	errBech32Padding  = errors.New("nyquist/pairing: invalid bech32 padding")
+
+	bech32Rev [128]int8
+)
+
+func bech32Polymod(values []byte) uint32 {
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		b := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (b>>uint(i))&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HRPExpand(hrp string) []byte {
+	ret := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		ret = append(ret, hrp[i]>>5)
+	}
+	ret = append(ret, 0)
+	for i := 0; i < len(hrp); i++ {
+		ret = append(ret, hrp[i]&31)
+	}
+	return ret
+}
+
+func bech32Encode(hrp string, data []byte) (string, error) {
+	values := convertBits(data, 8, 5, true)
+	if len(hrp)+1+len(values)+bech32Checksum > bech32MaxLength {
+		return "", errBech32Length
+	}
+
+	tmp := append(bech32HRPExpand(hrp), values...)
+	tmp = append(tmp, make([]byte, bech32Checksum)...)
+	polymod := bech32Polymod(tmp) ^ bech32mConst
+	for i := 0; i < bech32Checksum; i++ {
+		values = append(values, byte(polymod>>uint(5*(5-i)))&31)
+	}
+
+	var b strings.Builder
+	b.Grow(len(hrp) + 1 + len(values))
+	b.WriteString(hrp)
+	b.WriteByte('1')
+	for _, v := range values {
+		b.WriteByte(bech32Charset[v])
+	}
+	return b.String(), nil
+}
+
+func bech32Decode(s string) (string, []byte, error) {
+	if len(s) > bech32MaxLength {
+		return "", nil, errBech32Length
+	}
+
+	lower, upper := strings.ToLower(s), strings.ToUpper(s)
+	if s != lower && s != upper {
+		return "", nil, errBech32Case
+	}
+	s = lower
+
+	pos := strings.LastIndexByte(s, '1')
+	if pos < 1 || pos+1+bech32Checksum > len(s) {
+		return "", nil, errBech32Length
+	}
+	hrp := s[:pos]
+	for i := 0; i < len(hrp); i++ {
+		if hrp[i] < 33 || hrp[i] > 126 {
+			return "", nil, errBech32Char
+		}
+	}
+
+	values := make([]byte, 0, len(s)-pos-1)
+	for i := pos + 1; i < len(s); i++ {
+		c := s[i]
+		if c >= 128 || bech32Rev[c] < 0 {
+			return "", nil, errBech32Char
+		}
+		values = append(values, byte(bech32Rev[c]))
+	}
+
+	if bech32Polymod(append(bech32HRPExpand(hrp), values...)) != bech32mConst {
+		return "", nil, errBech32Checksum
+	}
+
+	data := convertBits(values[:len(values)-bech32Checksum], 5, 8, false)
+	if data == nil {
+		return "", nil, errBech32Padding
+	}
+
+	return hrp, data, nil
+}
+
+// convertBits regroups a sequence of fromBits-bit values into toBits-bit
+// values.  If pad is false, nil is returned if the input has non-zero or
+// excessive padding.
+func convertBits(data []byte, fromBits, toBits uint, pad bool) []byte {
+	var (
+		acc  uint32
+		bits uint
+	)
+	maxv := uint32(1)<<toBits - 1
+	ret := make([]byte, 0, (len(data)*int(fromBits)+int(toBits)-1)/int(toBits))
+	for _, v := range data {
+		acc = acc<<fromBits | uint32(v)
+		bits += fromBits
+		for bits >= toBits {
+			bits -= toBits
+			ret = append(ret, byte((acc>>bits)&maxv))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			ret = append(ret, byte((acc<<(toBits-bits))&maxv))
+		}
+	} else if bits >= fromBits || (acc<<(toBits-bits))&maxv != 0 {
+		return nil
+	}
+	return ret
+}
+
+func init() {
+	for i := range bech32Rev {
+		bech32Rev[i] = -1
+	}
+	for i := 0; i < len(bech32Charset); i++ {
+		bech32Rev[bech32Charset[i]] = int8(i)
+	}
+}
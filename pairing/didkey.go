@@ -0,0 +1,165 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package pairing
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"strings"
+
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+const (
+	didKeyPrefix    = "did:key:"
+	base58Multibase = 'z'
+	base58Alphabet  = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+)
+
+var (
+	errInvalidDIDKey = errors.New("nyquist/pairing: invalid did:key")
+
+	// multicodecs maps DH algorithm names to their multicodec codes.
+	multicodecs = map[string]uint64{
+		"25519": 0xec,   // x25519-pub
+		"448":   0x1204, // x448-pub
+	}
+)
+
+// EncodeDIDKey encodes a public key for the specified DH algorithm as a
+// did:key identifier.
+func EncodeDIDKey(alg dh.DH, pk dh.PublicKey) (string, error) {
+	code, ok := multicodecs[alg.String()]
+	if !ok {
+		return "", ErrUnsupportedDH
+	}
+	pkBytes := pk.Bytes()
+	if len(pkBytes) != alg.Size() {
+		return "", dh.ErrMismatchedPublicKey
+	}
+
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], code)
+	b := append(tmp[:n:n], pkBytes...)
+
+	return didKeyPrefix + string(base58Multibase) + base58Encode(b), nil
+}
+
+// DecodeDIDKey decodes a did:key identifier, returning the DH algorithm
+// and the public key.
+func DecodeDIDKey(s string) (dh.DH, dh.PublicKey, error) {
+	if !strings.HasPrefix(s, didKeyPrefix) {
+		return nil, nil, errInvalidDIDKey
+	}
+	s = strings.TrimPrefix(s, didKeyPrefix)
+	if len(s) < 1 || s[0] != base58Multibase {
+		return nil, nil, errInvalidDIDKey
+	}
+
+	b, err := base58Decode(s[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+	code, n := binary.Uvarint(b)
+	if n <= 0 {
+		return nil, nil, errInvalidDIDKey
+	}
+
+	var alg dh.DH
+	for name, v := range multicodecs {
+		if v == code {
+			alg = dh.FromString(name)
+			break
+		}
+	}
+	if alg == nil {
+		return nil, nil, ErrUnsupportedDH
+	}
+
+	b = b[n:]
+	if len(b) != alg.Size() {
+		return nil, nil, ErrMalformed
+	}
+	pk, err := alg.ParsePublicKey(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return alg, pk, nil
+}
+
+func base58Encode(b []byte) string {
+	var zeros int
+	for zeros < len(b) && b[zeros] == 0 {
+		zeros++
+	}
+
+	var (
+		n     = new(big.Int).SetBytes(b)
+		radix = big.NewInt(58)
+		mod   = new(big.Int)
+		ret   []byte
+	)
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		ret = append(ret, base58Alphabet[mod.Int64()])
+	}
+	for i := 0; i < zeros; i++ {
+		ret = append(ret, base58Alphabet[0])
+	}
+	for i, j := 0, len(ret)-1; i < j; i, j = i+1, j-1 {
+		ret[i], ret[j] = ret[j], ret[i]
+	}
+
+	return string(ret)
+}
+
+func base58Decode(s string) ([]byte, error) {
+	var zeros int
+	for zeros < len(s) && s[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+
+	var (
+		n     = new(big.Int)
+		radix = big.NewInt(58)
+	)
+	for i := 0; i < len(s); i++ {
+		idx := strings.IndexByte(base58Alphabet, s[i])
+		if idx < 0 {
+			return nil, errInvalidDIDKey
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(idx)))
+	}
+
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
@@ -0,0 +1,238 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package pairing implements compact, checksummed text encodings of static
+// public keys and bootstrap bundles, suitable for QR codes and manual entry
+// in pairing flows.
+//
+// Encodings use bech32m (BIP-350), with a human readable prefix identifying
+// the kind of object, and the DH algorithm name embedded in the payload.
+// Encoded strings are lower case; they may be converted to upper case in
+// their entirety (eg: to use the QR alphanumeric mode), and decoding is case
+// insensitive.  Whitespace and dashes are ignored when decoding, so that
+// strings may be displayed in groups for manual entry.
+//
+// Static public keys may also be encoded as did:key identifiers, for
+// interoperability with decentralized identity systems.
+package pairing // import "gitlab.com/yawning/nyquist.git/pairing"
+
+import (
+	"errors"
+	"strings"
+
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+const (
+	// PublicKeyPrefix is the human readable prefix of an encoded public key.
+	PublicKeyPrefix = "nqpk"
+
+	// BundlePrefix is the human readable prefix of an encoded bootstrap
+	// bundle.
+	BundlePrefix = "nqbs"
+
+	maxFieldSize = 255
+)
+
+var (
+	// ErrMalformed is the error returned when an encoded public key or
+	// bundle is malformed.
+	ErrMalformed = errors.New("nyquist/pairing: malformed encoding")
+
+	// ErrUnsupportedDH is the error returned when an encoded public key
+	// or bundle is for an unsupported DH algorithm.
+	ErrUnsupportedDH = errors.New("nyquist/pairing: unsupported DH algorithm")
+
+	errInvalidPrefix = errors.New("nyquist/pairing: invalid prefix")
+	errFieldTooLarge = errors.New("nyquist/pairing: field too large")
+)
+
+// Bundle is a bootstrap bundle, containing everything needed to initiate
+// a handshake with a peer.
+type Bundle struct {
+	// DH is the DH algorithm of the static public key.
+	DH dh.DH
+
+	// PublicKey is the peer's static public key.
+	PublicKey dh.PublicKey
+
+	// Address is the peer's address (eg: `host:port`), and may be empty.
+	Address string
+
+	// PSKHint is an opaque hint identifying a pre-shared key, and may be
+	// empty.
+	PSKHint []byte
+}
+
+// EncodePublicKey encodes a public key for the specified DH algorithm.
+func EncodePublicKey(alg dh.DH, pk dh.PublicKey) (string, error) {
+	b, err := appendPublicKey(nil, alg, pk)
+	if err != nil {
+		return "", err
+	}
+	return bech32Encode(PublicKeyPrefix, b)
+}
+
+// DecodePublicKey decodes an encoded public key, returning the DH algorithm
+// and the public key.
+func DecodePublicKey(s string) (dh.DH, dh.PublicKey, error) {
+	b, err := decode(PublicKeyPrefix, s)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	alg, pk, b, err := splitPublicKey(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(b) != 0 {
+		return nil, nil, ErrMalformed
+	}
+
+	return alg, pk, nil
+}
+
+// Encode encodes the bootstrap bundle.
+func (bundle *Bundle) Encode() (string, error) {
+	if len(bundle.Address) > maxFieldSize || len(bundle.PSKHint) > maxFieldSize {
+		return "", errFieldTooLarge
+	}
+
+	b, err := appendPublicKey(nil, bundle.DH, bundle.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	b = append(b, byte(len(bundle.Address)))
+	b = append(b, bundle.Address...)
+	b = append(b, byte(len(bundle.PSKHint)))
+	b = append(b, bundle.PSKHint...)
+
+	return bech32Encode(BundlePrefix, b)
+}
+
+// DecodeBundle decodes an encoded bootstrap bundle.
+func DecodeBundle(s string) (*Bundle, error) {
+	b, err := decode(BundlePrefix, s)
+	if err != nil {
+		return nil, err
+	}
+
+	var bundle Bundle
+	if bundle.DH, bundle.PublicKey, b, err = splitPublicKey(b); err != nil {
+		return nil, err
+	}
+
+	var addr, hint []byte
+	if addr, b, err = splitField(b); err != nil {
+		return nil, err
+	}
+	if hint, b, err = splitField(b); err != nil {
+		return nil, err
+	}
+	if len(b) != 0 {
+		return nil, ErrMalformed
+	}
+
+	bundle.Address = string(addr)
+	if len(hint) > 0 {
+		bundle.PSKHint = append([]byte{}, hint...)
+	}
+
+	return &bundle, nil
+}
+
+func appendPublicKey(b []byte, alg dh.DH, pk dh.PublicKey) ([]byte, error) {
+	name := alg.String()
+	if len(name) > maxFieldSize {
+		return nil, errFieldTooLarge
+	}
+	pkBytes := pk.Bytes()
+	if len(pkBytes) != alg.Size() {
+		return nil, dh.ErrMismatchedPublicKey
+	}
+
+	b = append(b, byte(len(name)))
+	b = append(b, name...)
+	return append(b, pkBytes...), nil
+}
+
+func splitPublicKey(b []byte) (dh.DH, dh.PublicKey, []byte, error) {
+	name, b, err := splitField(b)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	alg := dh.FromString(string(name))
+	if alg == nil {
+		return nil, nil, nil, ErrUnsupportedDH
+	}
+
+	pkLen := alg.Size()
+	if len(b) < pkLen {
+		return nil, nil, nil, ErrMalformed
+	}
+	pk, err := alg.ParsePublicKey(b[:pkLen])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return alg, pk, b[pkLen:], nil
+}
+
+func splitField(b []byte) ([]byte, []byte, error) {
+	if len(b) < 1 {
+		return nil, nil, ErrMalformed
+	}
+	l := int(b[0])
+	b = b[1:]
+	if len(b) < l {
+		return nil, nil, ErrMalformed
+	}
+	return b[:l], b[l:], nil
+}
+
+func decode(expectedPrefix, s string) ([]byte, error) {
+	s = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n', '-':
+			return -1
+		}
+		return r
+	}, s)
+
+	prefix, b, err := bech32Decode(s)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != expectedPrefix {
+		return nil, errInvalidPrefix
+	}
+
+	return b, nil
+}
@@ -0,0 +1,252 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package pairing
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+func TestPairing(t *testing.T) {
+	t.Run("Bech32m", testPairingBech32m)
+	t.Run("PublicKey", testPairingPublicKey)
+	t.Run("Bundle", testPairingBundle)
+}
+
+func testPairingBech32m(t *testing.T) {
+	// BIP-350 test vectors.
+	for _, v := range []string{
+		"A1LQFN3A",
+		"a1lqfn3a",
+		"abcdef1l7aum6echk45nj3s0wdvt2fg8x9yrzpqzd3ryx",
+		"split1checkupstagehandshakeupstreamerranterredcaperredlc445v",
+		"?1v759aa",
+	} {
+		t.Run(v, func(t *testing.T) {
+			_, _, err := bech32Decode(v)
+			require.NoError(t, err, "bech32Decode")
+		})
+	}
+
+	for _, v := range []string{
+		"a1lqfn3q", // Invalid checksum.
+		"A1LQfN3A", // Mixed case.
+		"1lqfn3a",  // Empty prefix.
+		"a1qfn3a",  // Too short.
+		"a1lqfn3b", // Invalid character.
+	} {
+		t.Run(v, func(t *testing.T) {
+			_, _, err := bech32Decode(v)
+			require.Error(t, err, "bech32Decode")
+		})
+	}
+}
+
+func testPairingPublicKey(t *testing.T) {
+	for _, name := range []string{"25519", "448"} {
+		alg := dh.FromString(name)
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+
+			if alg == nil {
+				t.Skip("DH function not included in the build")
+			}
+
+			kp, err := alg.GenerateKeypair(rand.Reader)
+			require.NoError(err, "GenerateKeypair")
+
+			s, err := EncodePublicKey(alg, kp.Public())
+			require.NoError(err, "EncodePublicKey")
+			require.True(strings.HasPrefix(s, PublicKeyPrefix+"1"), "EncodePublicKey - prefix")
+
+			for _, encoded := range []string{
+				s,
+				strings.ToUpper(s),
+				groupString(s),
+			} {
+				decodedAlg, pk, err := DecodePublicKey(encoded)
+				require.NoError(err, "DecodePublicKey")
+				require.Equal(alg, decodedAlg, "DecodePublicKey - DH")
+				require.Equal(kp.Public().Bytes(), pk.Bytes(), "DecodePublicKey - public key")
+			}
+
+			// Corrupt a single character.
+			corrupted := []byte(s)
+			idx := len(PublicKeyPrefix) + 10
+			if corrupted[idx] == 'q' {
+				corrupted[idx] = 'p'
+			} else {
+				corrupted[idx] = 'q'
+			}
+			_, _, err = DecodePublicKey(string(corrupted))
+			require.Error(err, "DecodePublicKey - corrupted")
+
+			// Bundles are not public keys.
+			bundleStr, err := (&Bundle{DH: alg, PublicKey: kp.Public()}).Encode()
+			require.NoError(err, "Bundle.Encode")
+			_, _, err = DecodePublicKey(bundleStr)
+			require.Equal(errInvalidPrefix, err, "DecodePublicKey - bundle")
+		})
+	}
+}
+
+func testPairingBundle(t *testing.T) {
+	require := require.New(t)
+
+	kp, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(err, "GenerateKeypair")
+
+	for _, v := range []*Bundle{
+		{
+			DH:        dh.X25519,
+			PublicKey: kp.Public(),
+		},
+		{
+			DH:        dh.X25519,
+			PublicKey: kp.Public(),
+			Address:   "192.0.2.1:4242",
+			PSKHint:   []byte("living room"),
+		},
+	} {
+		s, err := v.Encode()
+		require.NoError(err, "Encode")
+		require.True(strings.HasPrefix(s, BundlePrefix+"1"), "Encode - prefix")
+
+		decoded, err := DecodeBundle(strings.ToUpper(s))
+		require.NoError(err, "DecodeBundle")
+		require.Equal(v.DH, decoded.DH, "DecodeBundle - DH")
+		require.Equal(v.PublicKey.Bytes(), decoded.PublicKey.Bytes(), "DecodeBundle - public key")
+		require.Equal(v.Address, decoded.Address, "DecodeBundle - address")
+		require.Equal(v.PSKHint, decoded.PSKHint, "DecodeBundle - PSK hint")
+	}
+
+	_, err = (&Bundle{
+		DH:        dh.X25519,
+		PublicKey: kp.Public(),
+		Address:   strings.Repeat("a", maxFieldSize+1),
+	}).Encode()
+	require.Equal(errFieldTooLarge, err, "Encode - oversized address")
+
+	// Trailing garbage.
+	b, err := appendPublicKey(nil, dh.X25519, kp.Public())
+	require.NoError(err, "appendPublicKey")
+	b = append(b, 0, 0, 0)
+	s, err := bech32Encode(BundlePrefix, b)
+	require.NoError(err, "bech32Encode")
+	_, err = DecodeBundle(s)
+	require.Equal(ErrMalformed, err, "DecodeBundle - trailing garbage")
+}
+
+func groupString(s string) string {
+	var groups []string
+	for len(s) > 4 {
+		groups = append(groups, s[:4])
+		s = s[4:]
+	}
+	groups = append(groups, s)
+	return strings.Join(groups, "-")
+}
+
+func TestDIDKey(t *testing.T) {
+	t.Run("Base58", testDIDKeyBase58)
+	t.Run("RoundTrip", testDIDKeyRoundTrip)
+	t.Run("Invalid", testDIDKeyInvalid)
+}
+
+func testDIDKeyBase58(t *testing.T) {
+	for _, v := range []struct {
+		raw     string
+		encoded string
+	}{
+		{"", ""},
+		{"\x00", "1"},
+		{"\x00\x00\x01", "112"},
+		{"Hello World!", "2NEpo7TZRRrLZSi2U"},
+	} {
+		require.Equal(t, v.encoded, base58Encode([]byte(v.raw)), "base58Encode(%q)", v.raw)
+		b, err := base58Decode(v.encoded)
+		require.NoError(t, err, "base58Decode(%q)", v.encoded)
+		require.Equal(t, v.raw, string(b), "base58Decode(%q)", v.encoded)
+	}
+}
+
+func testDIDKeyRoundTrip(t *testing.T) {
+	for _, v := range []struct {
+		name   string
+		prefix string
+	}{
+		{"25519", "did:key:z6LS"},
+		{"448", "did:key:z"},
+	} {
+		alg := dh.FromString(v.name)
+		t.Run(v.name, func(t *testing.T) {
+			require := require.New(t)
+
+			if alg == nil {
+				t.Skip("DH function not included in the build")
+			}
+
+			kp, err := alg.GenerateKeypair(rand.Reader)
+			require.NoError(err, "GenerateKeypair")
+
+			s, err := EncodeDIDKey(alg, kp.Public())
+			require.NoError(err, "EncodeDIDKey")
+			require.True(strings.HasPrefix(s, v.prefix), "EncodeDIDKey - prefix: %s", s)
+
+			decodedAlg, pk, err := DecodeDIDKey(s)
+			require.NoError(err, "DecodeDIDKey")
+			require.Equal(alg, decodedAlg, "DecodeDIDKey - DH")
+			require.Equal(kp.Public().Bytes(), pk.Bytes(), "DecodeDIDKey - public key")
+		})
+	}
+}
+
+func testDIDKeyInvalid(t *testing.T) {
+	for _, v := range []struct {
+		s   string
+		err error
+	}{
+		{"did:web:example.com", errInvalidDIDKey},
+		{"did:key:mAAAA", errInvalidDIDKey},
+		{"did:key:z0OIl", errInvalidDIDKey},
+		// Ed25519 (0xed) is not a DH public key.
+		{"did:key:z6MkhaXgBZDvotDkL5257faiztiGiC2QtKLGpbnnEGta2doK", ErrUnsupportedDH},
+		// Truncated X25519 public key.
+		{"did:key:z" + base58Encode([]byte{0xec, 0x01, 0x42}), ErrMalformed},
+	} {
+		_, _, err := DecodeDIDKey(v.s)
+		require.Equal(t, v.err, err, "DecodeDIDKey(%s)", v.s)
+	}
+}
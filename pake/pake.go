@@ -0,0 +1,230 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package pake implements password-authenticated PSK establishment, with
+// the CPace balanced PAKE over ristretto255, as a pre-step to a `psk`
+// modified handshake.
+//
+// Each side sends a single message (in any order), after which both sides
+// derive the same pre-shared key iff they used the same password, channel
+// identifier, and session identifier.  Unlike using a password directly
+// as a PSK, an eavesdropper learns nothing that allows the password to be
+// guessed offline, and an active attacker is limited to one online guess
+// per run.
+//
+// The construction is modeled after draft-irtf-cfrg-cpace, with SHA-512
+// and the initiator-responder transcript, but is not intended to be
+// interoperable with other implementations.  The derived PSK should be
+// used with a pattern that authenticates the handshake with the PSK (eg:
+// `NNpsk0`, `XXpsk3`), and the PAKE messages should be bound into the
+// handshake (eg: via the prologue) where possible.
+package pake // import "gitlab.com/yawning/nyquist.git/pake"
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/oasisprotocol/curve25519-voi/curve"
+	"github.com/oasisprotocol/curve25519-voi/curve/scalar"
+	"golang.org/x/crypto/hkdf"
+
+	"gitlab.com/yawning/nyquist.git"
+)
+
+const (
+	// MessageSize is the size of a CPace message.
+	MessageSize = curve.CompressedPointSize
+
+	dsi      = "CPaceRistretto255"
+	dsiISK   = dsi + "_ISK"
+	pskLabel = "nyquist/pake: psk"
+
+	// hashBlockSize is the SHA-512 input block size, used to pad the
+	// password to a block boundary when deriving the generator.
+	hashBlockSize = 128
+)
+
+var (
+	// ErrInvalidMessage is the error returned when the peer's message is
+	// malformed, or is an invalid group element.
+	ErrInvalidMessage = errors.New("nyquist/pake: invalid message")
+
+	errNoPassword = errors.New("nyquist/pake: no password")
+	errFinished   = errors.New("nyquist/pake: already finished")
+)
+
+// Config is a CPace configuration.
+type Config struct {
+	// Password is the shared, possibly low-entropy, password.
+	Password []byte
+
+	// ChannelID is the optional channel identifier, binding the run to
+	// the parties (eg: their identities or addresses).
+	ChannelID []byte
+
+	// SessionID is the optional session identifier.  If available, it
+	// should be unique per run (eg: chosen by the initiator, and sent in
+	// the clear alongside its message).
+	SessionID []byte
+
+	// AssociatedData is the optional associated data sent alongside this
+	// side's message, that is bound into the derived key.  The peer must
+	// supply it as PeerAssociatedData.
+	AssociatedData []byte
+
+	// PeerAssociatedData is the peer's AssociatedData.
+	PeerAssociatedData []byte
+
+	// IsInitiator should be set to true iff this side is the initiator.
+	IsInitiator bool
+
+	// Rng is the entropy source to be used when generating the secret
+	// scalar.  If unset, crypto/rand.Reader will be used.
+	Rng io.Reader
+}
+
+// CPace is an in-progress CPace run.
+type CPace struct {
+	cfg *Config
+
+	y   scalar.Scalar
+	msg []byte
+
+	done bool
+}
+
+// New creates a new CPace run, generating this side's secret scalar.
+func New(cfg *Config) (*CPace, error) {
+	if len(cfg.Password) == 0 {
+		return nil, errNoPassword
+	}
+
+	// g = map_to_group(SHA-512(generator_string(DSI, PRS, CI, sid)))
+	padLen := hashBlockSize - len(prependLen(nil, cfg.Password)) - len(prependLen(nil, []byte(dsi))) - 1
+	if padLen < 0 {
+		padLen = 0
+	}
+	genStr := lvCat(nil, []byte(dsi), cfg.Password, make([]byte, padLen), cfg.ChannelID, cfg.SessionID)
+	digest := sha512.Sum512(genStr)
+	var g curve.RistrettoPoint
+	if _, err := g.SetUniformBytes(digest[:]); err != nil {
+		return nil, err
+	}
+
+	c := &CPace{
+		cfg: cfg,
+	}
+	if _, err := c.y.SetRandom(cfg.Rng); err != nil {
+		return nil, err
+	}
+
+	var (
+		Y  curve.RistrettoPoint
+		cY curve.CompressedRistretto
+	)
+	cY.SetRistrettoPoint(Y.Mul(&g, &c.y))
+	c.msg = append([]byte{}, cY[:]...)
+
+	return c, nil
+}
+
+// Message returns this side's message, to be sent to the peer.
+func (c *CPace) Message() []byte {
+	return append([]byte{}, c.msg...)
+}
+
+// Finish processes the peer's message, and returns the derived pre-shared
+// key.  The run may only be finished once.
+func (c *CPace) Finish(peerMsg []byte) ([]byte, error) {
+	if c.done {
+		return nil, errFinished
+	}
+	c.done = true
+	defer c.Reset()
+
+	if len(peerMsg) != MessageSize {
+		return nil, ErrInvalidMessage
+	}
+	var (
+		cY curve.CompressedRistretto
+		Y  curve.RistrettoPoint
+	)
+	_, _ = cY.SetBytes(peerMsg)
+	if _, err := Y.SetCompressed(&cY); err != nil {
+		return nil, ErrInvalidMessage
+	}
+
+	var (
+		K  curve.RistrettoPoint
+		cK curve.CompressedRistretto
+	)
+	K.Mul(&Y, &c.y)
+	if K.IsIdentity() {
+		return nil, ErrInvalidMessage
+	}
+	cK.SetRistrettoPoint(&K)
+
+	// ISK = SHA-512(lv_cat(DSI || "_ISK", sid, K) || transcript_ir)
+	msgA, adA, msgB, adB := c.msg, c.cfg.AssociatedData, peerMsg, c.cfg.PeerAssociatedData
+	if !c.cfg.IsInitiator {
+		msgA, adA, msgB, adB = msgB, adB, msgA, adA
+	}
+	b := lvCat(nil, []byte(dsiISK), c.cfg.SessionID, cK[:])
+	b = lvCat(b, msgA, adA)
+	b = lvCat(b, msgB, adB)
+	isk := sha512.Sum512(b)
+
+	psk := make([]byte, nyquist.PreSharedKeySize)
+	r := hkdf.New(sha512.New, isk[:], nil, []byte(pskLabel))
+	_, _ = io.ReadFull(r, psk)
+
+	return psk, nil
+}
+
+// Reset clears the secret scalar, and marks the run as finished.
+func (c *CPace) Reset() {
+	c.y.Zero()
+	c.done = true
+}
+
+func prependLen(b, data []byte) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(len(data)))
+	b = append(b, tmp[:n]...)
+	return append(b, data...)
+}
+
+func lvCat(b []byte, data ...[]byte) []byte {
+	for _, v := range data {
+		b = prependLen(b, v)
+	}
+	return b
+}
@@ -0,0 +1,170 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package pake
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git"
+)
+
+func runCPace(t *testing.T, initCfg, respCfg *Config) ([]byte, []byte) {
+	require := require.New(t)
+
+	initCfg.IsInitiator = true
+	alice, err := New(initCfg)
+	require.NoError(err, "New(alice)")
+	bob, err := New(respCfg)
+	require.NoError(err, "New(bob)")
+
+	alicePSK, err := alice.Finish(bob.Message())
+	require.NoError(err, "alice.Finish")
+	bobPSK, err := bob.Finish(alice.Message())
+	require.NoError(err, "bob.Finish")
+
+	return alicePSK, bobPSK
+}
+
+func TestCPace(t *testing.T) {
+	password := []byte("hunter2")
+	channelID := []byte("alice@example.com bob@example.com")
+
+	t.Run("Matching", func(t *testing.T) {
+		require := require.New(t)
+
+		alicePSK, bobPSK := runCPace(t, &Config{
+			Password:           password,
+			ChannelID:          channelID,
+			SessionID:          []byte("session"),
+			AssociatedData:     []byte("alice ad"),
+			PeerAssociatedData: []byte("bob ad"),
+		}, &Config{
+			Password:           password,
+			ChannelID:          channelID,
+			SessionID:          []byte("session"),
+			AssociatedData:     []byte("bob ad"),
+			PeerAssociatedData: []byte("alice ad"),
+		})
+		require.Len(alicePSK, nyquist.PreSharedKeySize, "PSK size")
+		require.Equal(alicePSK, bobPSK, "PSKs match")
+
+		// Each run derives a fresh PSK.
+		alicePSK2, bobPSK2 := runCPace(t, &Config{Password: password}, &Config{Password: password})
+		require.Equal(alicePSK2, bobPSK2, "PSKs match - defaults")
+		require.NotEqual(alicePSK, alicePSK2, "PSKs are per-run")
+	})
+
+	t.Run("Mismatched", func(t *testing.T) {
+		for _, v := range []struct {
+			name       string
+			init, resp *Config
+		}{
+			{"Password", &Config{Password: password}, &Config{Password: []byte("hunter3")}},
+			{"ChannelID", &Config{Password: password, ChannelID: channelID}, &Config{Password: password}},
+			{"SessionID", &Config{Password: password, SessionID: []byte("a")}, &Config{Password: password, SessionID: []byte("b")}},
+			{"AssociatedData", &Config{Password: password, AssociatedData: []byte("a")}, &Config{Password: password, PeerAssociatedData: []byte("b")}},
+		} {
+			t.Run(v.name, func(t *testing.T) {
+				alicePSK, bobPSK := runCPace(t, v.init, v.resp)
+				require.NotEqual(t, alicePSK, bobPSK, "PSKs differ")
+			})
+		}
+	})
+
+	t.Run("InvalidMessage", func(t *testing.T) {
+		require := require.New(t)
+
+		for _, v := range []struct {
+			name string
+			msg  []byte
+		}{
+			{"Truncated", make([]byte, MessageSize-1)},
+			{"Identity", make([]byte, MessageSize)},
+			{"NonCanonical", []byte{
+				0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+				0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+				0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+				0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f,
+			}},
+		} {
+			c, err := New(&Config{Password: password})
+			require.NoError(err, "New")
+			_, err = c.Finish(v.msg)
+			require.Equal(ErrInvalidMessage, err, "Finish - %s", v.name)
+		}
+
+		_, err := New(&Config{})
+		require.Equal(errNoPassword, err, "New - no password")
+	})
+
+	t.Run("FinishOnce", func(t *testing.T) {
+		require := require.New(t)
+
+		alice, err := New(&Config{Password: password, IsInitiator: true})
+		require.NoError(err, "New(alice)")
+		bob, err := New(&Config{Password: password})
+		require.NoError(err, "New(bob)")
+
+		_, err = alice.Finish(bob.Message())
+		require.NoError(err, "alice.Finish")
+		_, err = alice.Finish(bob.Message())
+		require.Equal(errFinished, err, "alice.Finish - again")
+	})
+
+	t.Run("Handshake", func(t *testing.T) {
+		require := require.New(t)
+
+		alicePSK, bobPSK := runCPace(t, &Config{Password: password}, &Config{Password: password})
+
+		protocol, err := nyquist.NewProtocol("Noise_NNpsk0_25519_ChaChaPoly_BLAKE2s")
+		require.NoError(err, "NewProtocol")
+		alice, err := nyquist.NewHandshake(&nyquist.HandshakeConfig{
+			Protocol:      protocol,
+			PreSharedKeys: [][]byte{alicePSK},
+			IsInitiator:   true,
+		})
+		require.NoError(err, "NewHandshake(alice)")
+		defer alice.Reset()
+		bob, err := nyquist.NewHandshake(&nyquist.HandshakeConfig{
+			Protocol:      protocol,
+			PreSharedKeys: [][]byte{bobPSK},
+		})
+		require.NoError(err, "NewHandshake(bob)")
+		defer bob.Reset()
+
+		msg, err := alice.WriteMessage(nil, []byte("hello"))
+		require.NoError(err, "alice.WriteMessage")
+		payload, err := bob.ReadMessage(nil, msg)
+		require.NoError(err, "bob.ReadMessage")
+		require.Equal([]byte("hello"), payload, "payload")
+	})
+}
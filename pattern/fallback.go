@@ -0,0 +1,107 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package pattern
+
+import "errors"
+
+const suffixFallback = "fallback"
+
+// XXfallback is the XXfallback pattern.
+var XXfallback = mustMakeFallback(XX)
+
+// MakeFallback applies the `fallback` modifier to an existing pattern,
+// returning the new pattern.
+//
+// The modifier converts the template's first message into a pre-message,
+// and reverses the roles of the parties, such that the template's
+// responder is the initiator of the new pattern.  As such, only patterns
+// where the first message consists solely of `e` and `s` tokens can be
+// used as templates.
+func MakeFallback(template Pattern) (Pattern, error) {
+	if template.IsOneWay() {
+		return nil, errors.New("nyquist/pattern: fallback template pattern is one-way")
+	}
+	if template.NumPSKs() > 0 {
+		return nil, errors.New("nyquist/pattern: fallback template pattern has PSKs")
+	}
+	templateMessages := template.Messages()
+	if len(templateMessages) < 2 {
+		return nil, errors.New("nyquist/pattern: fallback template pattern has too few messages")
+	}
+	for _, v := range templateMessages[0] {
+		if v != Token_e && v != Token_s {
+			return nil, errors.New("nyquist/pattern: fallback template first message has non-public key token: " + v.String())
+		}
+	}
+
+	// The template responder's pre-message becomes the initiator's, and the
+	// template initiator's pre-message and first message become the
+	// responder's.
+	var initPre, respPre Message
+	templatePreMessages := template.PreMessages()
+	if len(templatePreMessages) > 1 {
+		initPre = append(initPre, templatePreMessages[1]...)
+	}
+	if len(templatePreMessages) > 0 {
+		respPre = append(respPre, templatePreMessages[0]...)
+	}
+	respPre = append(respPre, templateMessages[0]...)
+
+	pa := &builtIn{
+		name:        template.String() + suffixFallback,
+		preMessages: []Message{initPre, respPre},
+	}
+
+	// With the roles reversed, the DH tokens that refer to one key from
+	// each side are swapped.
+	for _, msg := range templateMessages[1:] {
+		newMsg := make(Message, 0, len(msg))
+		for _, v := range msg {
+			switch v {
+			case Token_es:
+				v = Token_se
+			case Token_se:
+				v = Token_es
+			}
+			newMsg = append(newMsg, v)
+		}
+		pa.messages = append(pa.messages, newMsg)
+	}
+
+	return pa, nil
+}
+
+func mustMakeFallback(template Pattern) Pattern {
+	pa, err := MakeFallback(template)
+	if err != nil {
+		panic(err)
+	}
+	return pa
+}
@@ -31,7 +31,7 @@
 // abstract interface and standard patterns.
 package pattern // import "gitlab.com/yawning/nyquist.git/pattern"
 
-import "fmt"
+import "strconv"
 
 var supportedPatterns = make(map[string]Pattern)
 
@@ -67,7 +67,7 @@ func (t Token) String() string {
 	case Token_psk:
 		return "psk"
 	default:
-		return fmt.Sprintf("[invalid token: %d]", int(t))
+		return "[invalid token: " + strconv.Itoa(int(t)) + "]"
 	}
 }
 
@@ -76,7 +76,8 @@ type Message []Token
 
 // Pattern is a handshake pattern.
 type Pattern interface {
-	fmt.Stringer
+	// String returns the string representation of the pattern name.
+	String() string
 
 	// PreMessages returns the pre-message message patterns.
 	PreMessages() []Message
@@ -176,6 +177,9 @@ func init() {
 		IKpsk2,
 		IXpsk2,
 
+		// Fallback patterns.
+		XXfallback,
+
 		// Deferred patterns.
 		NK1,
 		NX1,
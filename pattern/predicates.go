@@ -0,0 +1,149 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package pattern
+
+// NumMessages returns the number of handshake messages in the pattern,
+// excluding pre-messages.
+func NumMessages(pa Pattern) int {
+	return len(pa.Messages())
+}
+
+// IsDeferred returns true iff the pattern defers at least one of the
+// authentication DH calculations (`es` or `se`) to a message after the
+// first one in which both public keys are available, as is the case with
+// the deferred patterns (eg: `XX1`, `I1K`).
+func IsDeferred(pa Pattern) bool {
+	const preMessage = -1
+
+	// Track the index of the message that each public key is first known
+	// to both parties.
+	known := make(map[bool]map[Token]int)
+	known[true] = make(map[Token]int)
+	known[false] = make(map[Token]int)
+	for i, msg := range pa.PreMessages() {
+		for _, v := range msg {
+			known[i == 0][v] = preMessage
+		}
+	}
+
+	earliest := func(initToken, respToken Token) (int, bool) {
+		initIdx, ok := known[true][initToken]
+		if !ok {
+			return 0, false
+		}
+		respIdx, ok := known[false][respToken]
+		if !ok {
+			return 0, false
+		}
+		if initIdx > respIdx {
+			return initIdx, true
+		}
+		return respIdx, true
+	}
+
+	for i, msg := range pa.Messages() {
+		isInitiator := i&1 == 0
+		for _, v := range msg {
+			var (
+				idx int
+				ok  bool
+			)
+			switch v {
+			case Token_e, Token_s:
+				if _, seen := known[isInitiator][v]; !seen {
+					known[isInitiator][v] = i
+				}
+				continue
+			case Token_es:
+				idx, ok = earliest(Token_e, Token_s)
+			case Token_se:
+				idx, ok = earliest(Token_s, Token_e)
+			default:
+				continue
+			}
+			if ok && i > idx {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// RequiresLocalStatic returns true iff the specified side of the pattern
+// requires a local static keypair (`s`).
+func RequiresLocalStatic(pa Pattern, isInitiator bool) bool {
+	localDH, preIdx := Token_se, 0
+	if !isInitiator {
+		localDH, preIdx = Token_es, 1
+	}
+
+	preMessages := pa.PreMessages()
+	if len(preMessages) > preIdx && hasToken(preMessages[preIdx], Token_s) {
+		return true
+	}
+	for i, msg := range pa.Messages() {
+		isLocal := (i&1 == 0) == isInitiator
+		for _, v := range msg {
+			switch {
+			case v == Token_ss, v == localDH:
+				return true
+			case v == Token_s && isLocal:
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// RequiresRemoteStaticPreMessage returns true iff the specified side of the
+// pattern requires the remote static public key (`rs`) to be known prior to
+// the handshake.
+func RequiresRemoteStaticPreMessage(pa Pattern, isInitiator bool) bool {
+	idx := 1
+	if !isInitiator {
+		idx = 0
+	}
+	preMessages := pa.PreMessages()
+	if len(preMessages) <= idx {
+		return false
+	}
+	return hasToken(preMessages[idx], Token_s)
+}
+
+func hasToken(msg Message, t Token) bool {
+	for _, v := range msg {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
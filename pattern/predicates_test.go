@@ -0,0 +1,101 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package pattern
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPredicates(t *testing.T) {
+	t.Run("IsDeferred", func(t *testing.T) {
+		require := require.New(t)
+
+		deferred := make(map[string]bool)
+		for _, name := range deferredPatterns {
+			deferred[name] = true
+		}
+		for _, pa := range supportedPatterns {
+			require.Equal(deferred[pa.String()], IsDeferred(pa), "IsDeferred(%s)", pa)
+		}
+	})
+	t.Run("NumMessages", func(t *testing.T) {
+		require := require.New(t)
+
+		require.Equal(1, NumMessages(N), "NumMessages(N)")
+		require.Equal(2, NumMessages(IK), "NumMessages(IK)")
+		require.Equal(3, NumMessages(XX), "NumMessages(XX)")
+		require.Equal(4, NumMessages(X1X), "NumMessages(X1X)")
+	})
+	t.Run("RequiresLocalStatic", func(t *testing.T) {
+		require := require.New(t)
+
+		for _, v := range []struct {
+			pa         Pattern
+			init, resp bool
+		}{
+			{N, false, true},
+			{K, true, true},
+			{NN, false, false},
+			{NK, false, true},
+			{XN, true, false},
+			{XX, true, true},
+			{KN, true, false},
+			{IK, true, true},
+			{NX1, false, true},
+			{I1N, true, false},
+			{XXfallback, true, true},
+			{NNpsk0, false, false},
+		} {
+			require.Equal(v.init, RequiresLocalStatic(v.pa, true), "RequiresLocalStatic(%s, initiator)", v.pa)
+			require.Equal(v.resp, RequiresLocalStatic(v.pa, false), "RequiresLocalStatic(%s, responder)", v.pa)
+		}
+	})
+	t.Run("RequiresRemoteStaticPreMessage", func(t *testing.T) {
+		require := require.New(t)
+
+		for _, v := range []struct {
+			pa         Pattern
+			init, resp bool
+		}{
+			{N, true, false},
+			{K, true, true},
+			{XX, false, false},
+			{NK, true, false},
+			{KN, false, true},
+			{IK, true, false},
+			{K1K1, true, true},
+		} {
+			require.Equal(v.init, RequiresRemoteStaticPreMessage(v.pa, true), "RequiresRemoteStaticPreMessage(%s, initiator)", v.pa)
+			require.Equal(v.resp, RequiresRemoteStaticPreMessage(v.pa, false), "RequiresRemoteStaticPreMessage(%s, responder)", v.pa)
+		}
+	})
+}
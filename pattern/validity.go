@@ -29,10 +29,7 @@
 
 package pattern
 
-import (
-	"errors"
-	"fmt"
-)
+import "errors"
 
 // IsValid checks a pattern for validity according to the handshake pattern
 // validity rules, and implementation limitations.
@@ -72,11 +69,11 @@ func IsValid(pa Pattern) error {
 				// 2. Parties must not send their static public key or ephemeral
 				// public key more than once per handshake.
 				if m[v] {
-					return fmt.Errorf("nyquist/pattern: redundant pre-message token (%s): %s", side, v)
+					return errors.New("nyquist/pattern: redundant pre-message token (" + side + "): " + v.String())
 				}
 				m[v] = true
 			default:
-				return fmt.Errorf("nyquist/pattern: invalid pre-message token: %s", v)
+				return errors.New("nyquist/pattern: invalid pre-message token: " + v.String())
 			}
 		}
 	}
@@ -98,19 +95,19 @@ func IsValid(pa Pattern) error {
 				// 2. Parties must not send their static public key or ephemeral
 				// public key more than once per handshake.
 				if m[v] {
-					return fmt.Errorf("nyquist/pattern: redundant public key (%s): %s", side, v)
+					return errors.New("nyquist/pattern: redundant public key (" + side + "): " + v.String())
 				}
 			case Token_ee, Token_es, Token_se, Token_ss:
 				// 3. Parties must not perform a DH calculation more than once
 				// per handshake.
 				if inEither(v) {
-					return fmt.Errorf("nyquist/pattern: redundant DH calcuation: %s", v)
+					return errors.New("nyquist/pattern: redundant DH calcuation: " + v.String())
 				}
 				numDHs++
 			case Token_psk:
 				numPSKs++
 			default:
-				return fmt.Errorf("nyquist/pattern: invalid message token: %s", v)
+				return errors.New("nyquist/pattern: invalid message token: " + v.String())
 			}
 
 			// 1. Parties can only perform DH between private keys and public
@@ -136,7 +133,7 @@ func IsValid(pa Pattern) error {
 			default:
 			}
 			if impossibleDH != Token_invalid {
-				return fmt.Errorf("nyquist/pattern: impossible DH: %s", v)
+				return errors.New("nyquist/pattern: impossible DH: " + v.String())
 			}
 
 			m[v] = true
@@ -163,7 +160,7 @@ func IsValid(pa Pattern) error {
 			}
 		}
 		if missingDH != Token_invalid {
-			return fmt.Errorf("nyquist/pattern: missing DH calculation (%s): %s", side, missingDH)
+			return errors.New("nyquist/pattern: missing DH calculation (" + side + "): " + missingDH.String())
 		}
 
 		if inEither(Token_psk) {
@@ -171,7 +168,7 @@ func IsValid(pa Pattern) error {
 			// "psk" token unless it has previously sent an epmeheral public
 			// key (an "e" token), either before or after the "psk" token.
 			if !m[Token_e] {
-				return fmt.Errorf("nyquist/pattern: payload after pre-shared key without ephemeral (%s)", side)
+				return errors.New("nyquist/pattern: payload after pre-shared key without ephemeral (" + side + ")")
 			}
 		}
 	}
@@ -30,6 +30,7 @@
 package pattern
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -45,3 +46,46 @@ func TestBuiltInPatternValidity(t *testing.T) {
 		})
 	}
 }
+
+// deferredPatterns is the list of deferred patterns from section 7.6 of
+// the specification.
+var deferredPatterns = []string{
+	"NK1", "NX1",
+	"X1N", "X1K", "XK1", "X1K1", "X1X", "XX1", "X1X1",
+	"K1N", "K1K", "KK1", "K1K1", "K1X", "KX1", "K1X1",
+	"I1N", "I1K", "IK1", "I1K1", "I1X", "IX1", "I1X1",
+}
+
+func TestDeferredPatterns(t *testing.T) {
+	for _, name := range deferredPatterns {
+		t.Run(name, func(t *testing.T) {
+			require := require.New(t)
+
+			pa := FromString(name)
+			require.NotNil(pa, "FromString(deferred)")
+			require.Equal(name, pa.String(), "String()")
+
+			// A deferred pattern contains the same tokens as the
+			// fundamental pattern it is derived from, with some of the
+			// DH operations moved to later messages, and without `ss`.
+			base := FromString(strings.ReplaceAll(name, "1", ""))
+			require.NotNil(base, "FromString(fundamental)")
+			require.Equal(base.PreMessages(), pa.PreMessages(), "PreMessages()")
+			require.Equal(countTokens(base.Messages()), countTokens(pa.Messages()), "Messages() - tokens")
+			require.GreaterOrEqual(len(pa.Messages()), len(base.Messages()), "Messages() - length")
+		})
+	}
+}
+
+func countTokens(msgs []Message) map[Token]int {
+	m := make(map[Token]int)
+	for _, msg := range msgs {
+		for _, tok := range msg {
+			if tok == Token_ss {
+				continue
+			}
+			m[tok]++
+		}
+	}
+	return m
+}
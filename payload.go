@@ -0,0 +1,106 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package nyquist
+
+import "errors"
+
+var (
+	// ErrPayloadSize is the error returned when a handshake payload
+	// exceeds the PayloadCodec's size limit.
+	ErrPayloadSize = errors.New("nyquist: oversized handshake payload")
+
+	errNoPayloadCodec = errors.New("nyquist/HandshakeState: no PayloadCodec")
+)
+
+// PayloadCodec marshals and validates structured handshake payloads
+// (eg: protobuf, CBOR, flatbuffers), so that oversized or malformed
+// payloads abort the handshake before reaching the application.
+type PayloadCodec interface {
+	// MaxPayloadSize returns the maximum size of the encoded payload of
+	// the handshake message at index idx.
+	MaxPayloadSize(idx int) int
+
+	// Marshal encodes the payload of the handshake message at index idx.
+	Marshal(idx int, v interface{}) ([]byte, error)
+
+	// Unmarshal decodes and validates the payload of the handshake
+	// message at index idx, including empty payloads.  The payload must
+	// not be retained.
+	Unmarshal(idx int, payload []byte) (interface{}, error)
+}
+
+// WritePayload encodes v with the PayloadCodec, and writes it as the
+// payload of the next handshake message, appending the message to dst, and
+// returning the potentially new slice.
+//
+// Iff the handshake is complete, the error returned will be `ErrDone`.
+func (hs *HandshakeState) WritePayload(dst []byte, v interface{}) ([]byte, error) {
+	if hs.cfg.PayloadCodec == nil {
+		return nil, errNoPayloadCodec
+	}
+	if hs.status.Err != nil {
+		return nil, hs.status.Err
+	}
+
+	payload, err := hs.cfg.PayloadCodec.Marshal(hs.patternIndex, v)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(payload)
+
+	return hs.WriteMessage(dst, payload)
+}
+
+// ReadPayload reads the next handshake message, and returns the payload
+// decoded with the PayloadCodec.
+//
+// Iff the handshake is complete, the error returned will be `ErrDone`.
+func (hs *HandshakeState) ReadPayload(message []byte) (interface{}, error) {
+	if hs.cfg.PayloadCodec == nil {
+		return nil, errNoPayloadCodec
+	}
+
+	payload, v, err := hs.readMessage(nil, message)
+	zero(payload)
+
+	return v, err
+}
+
+// plaintextSize returns the size of the plaintext that decrypting the
+// ciphertext would yield.
+func (cs *CipherState) plaintextSize(ciphertext []byte) int {
+	if !cs.HasKey() {
+		return len(ciphertext)
+	}
+	if n := len(ciphertext) - cs.aeadOverhead; n > 0 {
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,353 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package profiles provides a registry of named, pre-validated
+// configurations for well-known Noise protocol deployments, bundling the
+// protocol, prologue, framing and policy defaults, so that they do not need
+// to be assembled by hand.
+//
+// Note that a profile only covers the parts of a deployment that are
+// expressible in terms of this module.  Application specific payloads
+// (eg: WireGuard's TAI64N timestamp and MACs, libp2p's signed identity
+// payload) are the responsibility of the caller.
+package profiles // import "gitlab.com/yawning/nyquist.git/profiles"
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/ntcp2"
+	"gitlab.com/yawning/nyquist.git/transport"
+)
+
+const (
+	// WireGuard is the WireGuard profile name.
+	WireGuard = "wireguard"
+
+	// Lightning is the Lightning Network (BOLT #8) profile name.
+	Lightning = "lightning"
+
+	// NTCP2 is the I2P NTCP2 profile name.
+	NTCP2 = "ntcp2"
+
+	// Libp2p is the libp2p Noise handshake profile name.
+	Libp2p = "libp2p"
+
+	// NoiseSocketDefault is the profile name of this module's default
+	// NoiseSocket style transport configuration.
+	NoiseSocketDefault = "noisesocket-default"
+)
+
+var (
+	// ErrUnknownProfile is the error returned when a profile is not
+	// registered.
+	ErrUnknownProfile = errors.New("nyquist/profiles: unknown profile")
+
+	// ErrUnavailable is the error returned when a profile's protocol
+	// can not be instantiated, as one or more of the primitives are not
+	// supported (or were omitted at build time).
+	ErrUnavailable = errors.New("nyquist/profiles: profile unavailable")
+
+	// ErrFraming is the error returned when a configuration is requested
+	// for a profile with an incompatible framing.
+	ErrFraming = errors.New("nyquist/profiles: incompatible framing")
+
+	errInvalidProfile = errors.New("nyquist/profiles: invalid profile")
+	errDuplicate      = errors.New("nyquist/profiles: profile already registered")
+)
+
+// Framing is how a profile frames Noise messages on the wire.
+type Framing int
+
+const (
+	// FramingDatagram is one Noise message per datagram, with the
+	// deployment's own message header.
+	FramingDatagram Framing = iota
+
+	// FramingLength16 is each Noise message prefixed with a 16-bit
+	// big-endian length.
+	FramingLength16
+
+	// FramingEncryptedLength is each transport message prefixed with a
+	// separately encrypted and authenticated 16-bit length.
+	FramingEncryptedLength
+
+	// FramingObfuscatedLength is each transport message prefixed with a
+	// 16-bit length, masked with a SipHash based keystream.
+	FramingObfuscatedLength
+
+	// FramingNoiseSocket is the NoiseSocket style framing implemented by
+	// the transport package.
+	FramingNoiseSocket
+
+	framingMax
+)
+
+// String returns the string representation of a Framing.
+func (f Framing) String() string {
+	switch f {
+	case FramingDatagram:
+		return "datagram"
+	case FramingLength16:
+		return "length16"
+	case FramingEncryptedLength:
+		return "encrypted-length"
+	case FramingObfuscatedLength:
+		return "obfuscated-length"
+	case FramingNoiseSocket:
+		return "noisesocket"
+	default:
+		return fmt.Sprintf("[unknown framing: %d]", int(f))
+	}
+}
+
+// Profile is a named protocol configuration.
+type Profile struct {
+	// Name is the profile name.
+	Name string
+
+	// ProtocolName is the full Noise protocol name.
+	ProtocolName string
+
+	// Prologue is the prologue, if any.
+	Prologue []byte
+
+	// Framing is the wire framing.
+	Framing Framing
+
+	// RekeyAfterMessages is the number of transport messages after which
+	// the traffic keys should be updated, if any.
+	RekeyAfterMessages uint64
+
+	// RekeyAfterTime is the duration after which the traffic keys should
+	// be updated, if any.
+	RekeyAfterTime time.Duration
+
+	// RejectAfterTime is the duration after which the traffic keys must
+	// no longer be used, if any.
+	RejectAfterTime time.Duration
+
+	// Reference is the specification the profile is derived from.
+	Reference string
+}
+
+// Protocol returns the profile's Noise protocol.
+func (p *Profile) Protocol() (*nyquist.Protocol, error) {
+	protocol, err := nyquist.NewProtocol(p.ProtocolName)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrUnavailable, p.Name, err)
+	}
+	return protocol, nil
+}
+
+// Available returns true iff the profile's protocol can be instantiated.
+func (p *Profile) Available() bool {
+	_, err := p.Protocol()
+	return err == nil
+}
+
+// HandshakeConfig returns a new handshake configuration with the profile's
+// protocol and prologue.  The caller is responsible for filling in the keys,
+// and any other parameters.
+func (p *Profile) HandshakeConfig(isInitiator bool) (*nyquist.HandshakeConfig, error) {
+	protocol, err := p.Protocol()
+	if err != nil {
+		return nil, err
+	}
+
+	return &nyquist.HandshakeConfig{
+		Protocol:    protocol,
+		Prologue:    append([]byte{}, p.Prologue...),
+		IsInitiator: isInitiator,
+	}, nil
+}
+
+// TransportConfig returns a new transport configuration with the profile's
+// protocol, prologue and policy.  Only profiles using FramingNoiseSocket
+// are supported.
+func (p *Profile) TransportConfig() (*transport.Config, error) {
+	if p.Framing != FramingNoiseSocket {
+		return nil, fmt.Errorf("%w: %s uses %s framing", ErrFraming, p.Name, p.Framing)
+	}
+	protocol, err := p.Protocol()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &transport.Config{
+		Protocol: protocol,
+		Prologue: append([]byte{}, p.Prologue...),
+	}
+	switch {
+	case p.RekeyAfterTime > 0:
+		cfg.MaxLifetime = p.RekeyAfterTime
+		cfg.LifetimeAction = transport.LifetimeKeyUpdate
+	case p.RejectAfterTime > 0:
+		cfg.MaxLifetime = p.RejectAfterTime
+		cfg.LifetimeAction = transport.LifetimeClose
+	}
+
+	return cfg, nil
+}
+
+func (p *Profile) clone() *Profile {
+	newP := *p
+	if p.Prologue != nil {
+		newP.Prologue = append([]byte{}, p.Prologue...)
+	}
+	return &newP
+}
+
+func (p *Profile) validate() error {
+	switch {
+	case p.Name == "":
+		return fmt.Errorf("%w: missing name", errInvalidProfile)
+	case p.ProtocolName == "":
+		return fmt.Errorf("%w: %s: missing protocol name", errInvalidProfile, p.Name)
+	case p.Framing < 0 || p.Framing >= framingMax:
+		return fmt.Errorf("%w: %s: invalid framing", errInvalidProfile, p.Name)
+	case p.RekeyAfterTime < 0 || p.RejectAfterTime < 0:
+		return fmt.Errorf("%w: %s: negative duration", errInvalidProfile, p.Name)
+	case p.RejectAfterTime > 0 && p.RekeyAfterTime > p.RejectAfterTime:
+		return fmt.Errorf("%w: %s: rekey after reject", errInvalidProfile, p.Name)
+	}
+
+	// Profiles that are unavailable only due to missing primitives are
+	// allowed, but the protocol name must otherwise be sensible.
+	if protocol, err := p.Protocol(); err == nil {
+		if protocol.Pattern.IsOneWay() && p.Framing == FramingNoiseSocket {
+			return fmt.Errorf("%w: %s: one-way pattern", errInvalidProfile, p.Name)
+		}
+	}
+
+	return nil
+}
+
+var (
+	registryLock sync.RWMutex
+	registry     = make(map[string]*Profile)
+)
+
+// Register registers a new profile for use with `Get()`.
+func Register(p *Profile) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if registry[p.Name] != nil {
+		return fmt.Errorf("%w: %s", errDuplicate, p.Name)
+	}
+	registry[p.Name] = p.clone()
+
+	return nil
+}
+
+// Get returns a copy of the named profile.
+func Get(name string) (*Profile, error) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	p := registry[name]
+	if p == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownProfile, name)
+	}
+	return p.clone(), nil
+}
+
+// Names returns the sorted names of all registered profiles.
+func Names() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for k := range registry {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func init() {
+	for _, v := range []*Profile{
+		{
+			Name:         WireGuard,
+			ProtocolName: "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s",
+			// WireGuard mixes the identifier into the handshake hash
+			// immediately after initialization, which is identical to
+			// it being the prologue.
+			Prologue:           []byte("WireGuard v1 zx2c4 Jason@zx2c4.com"),
+			Framing:            FramingDatagram,
+			RekeyAfterMessages: 1 << 60,
+			RekeyAfterTime:     120 * time.Second,
+			RejectAfterTime:    180 * time.Second,
+			Reference:          "https://www.wireguard.com/protocol/",
+		},
+		{
+			Name: Lightning,
+			// secp256k1 is not provided by this module, and must be
+			// registered with the dh package by the caller.
+			ProtocolName:       "Noise_XK_secp256k1_ChaChaPoly_SHA256",
+			Prologue:           []byte("lightning"),
+			Framing:            FramingEncryptedLength,
+			RekeyAfterMessages: 1000,
+			Reference:          "https://github.com/lightning/bolts/blob/master/08-transport.md",
+		},
+		{
+			Name: NTCP2,
+			// The handshake itself is implemented by the ntcp2 package.
+			ProtocolName: ntcp2.ProtocolName,
+			Framing:      FramingObfuscatedLength,
+			Reference:    "https://geti2p.net/spec/ntcp2",
+		},
+		{
+			Name:         Libp2p,
+			ProtocolName: "Noise_XX_25519_ChaChaPoly_SHA256",
+			Framing:      FramingLength16,
+			Reference:    "https://github.com/libp2p/specs/blob/master/noise/README.md",
+		},
+		{
+			Name:         NoiseSocketDefault,
+			ProtocolName: "Noise_XX_25519_ChaChaPoly_BLAKE2s",
+			Framing:      FramingNoiseSocket,
+			Reference:    "https://noisesocket.org/",
+		},
+	} {
+		if err := Register(v); err != nil {
+			panic("nyquist/profiles: failed to register builtin: " + err.Error())
+		}
+	}
+}
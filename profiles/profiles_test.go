@@ -0,0 +1,149 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package profiles
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git/transport"
+)
+
+func TestProfiles(t *testing.T) {
+	t.Run("Builtin", func(t *testing.T) {
+		require := require.New(t)
+
+		require.Equal([]string{Libp2p, Lightning, NoiseSocketDefault, NTCP2, WireGuard}, Names(), "Names")
+
+		for _, name := range Names() {
+			p, err := Get(name)
+			require.NoError(err, "Get(%s)", name)
+			require.Equal(name, p.Name, "Name")
+			require.NoError(p.validate(), "validate(%s)", name)
+		}
+
+		wg, err := Get(WireGuard)
+		require.NoError(err, "Get(WireGuard)")
+		require.True(wg.Available(), "Available(WireGuard)")
+		cfg, err := wg.HandshakeConfig(true)
+		require.NoError(err, "HandshakeConfig(WireGuard)")
+		require.Equal("Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s", cfg.Protocol.String(), "Protocol")
+		require.Equal([]byte("WireGuard v1 zx2c4 Jason@zx2c4.com"), cfg.Prologue, "Prologue")
+		require.True(cfg.IsInitiator, "IsInitiator")
+		_, err = wg.TransportConfig()
+		require.True(errors.Is(err, ErrFraming), "TransportConfig(WireGuard)")
+
+		ntcp2, err := Get(NTCP2)
+		require.NoError(err, "Get(NTCP2)")
+		require.True(ntcp2.Available(), "Available(NTCP2)")
+
+		// secp256k1 is not provided.
+		ln, err := Get(Lightning)
+		require.NoError(err, "Get(Lightning)")
+		require.False(ln.Available(), "Available(Lightning)")
+		_, err = ln.HandshakeConfig(true)
+		require.True(errors.Is(err, ErrUnavailable), "HandshakeConfig(Lightning)")
+
+		// Mutating the returned profile must not alter the registry.
+		wg.Prologue[0] ^= 0xff
+		wg2, _ := Get(WireGuard)
+		require.Equal(byte('W'), wg2.Prologue[0], "Get returns a copy")
+
+		_, err = Get("tinc")
+		require.True(errors.Is(err, ErrUnknownProfile), "Get(unknown)")
+	})
+
+	t.Run("Register", func(t *testing.T) {
+		require := require.New(t)
+
+		err := Register(&Profile{Name: WireGuard, ProtocolName: "Noise_NN_25519_ChaChaPoly_BLAKE2s"})
+		require.Error(err, "Register(duplicate)")
+
+		for _, v := range []*Profile{
+			{ProtocolName: "Noise_NN_25519_ChaChaPoly_BLAKE2s"},
+			{Name: "test-no-protocol"},
+			{Name: "test-framing", ProtocolName: "Noise_NN_25519_ChaChaPoly_BLAKE2s", Framing: framingMax},
+			{Name: "test-one-way", ProtocolName: "Noise_N_25519_ChaChaPoly_BLAKE2s", Framing: FramingNoiseSocket},
+			{Name: "test-rekey", ProtocolName: "Noise_NN_25519_ChaChaPoly_BLAKE2s", RekeyAfterTime: time.Hour, RejectAfterTime: time.Minute},
+		} {
+			require.Error(Register(v), "Register(%+v)", v)
+		}
+		require.Len(Names(), 5, "Names - invalid profiles not registered")
+	})
+
+	t.Run("NoiseSocketDefault", func(t *testing.T) {
+		require := require.New(t)
+
+		p, err := Get(NoiseSocketDefault)
+		require.NoError(err, "Get")
+		protocol, err := p.Protocol()
+		require.NoError(err, "Protocol")
+
+		serverKey, err := protocol.DH.GenerateKeypair(rand.Reader)
+		require.NoError(err, "GenerateKeypair(server)")
+		clientKey, err := protocol.DH.GenerateKeypair(rand.Reader)
+		require.NoError(err, "GenerateKeypair(client)")
+
+		serverCfg, err := p.TransportConfig()
+		require.NoError(err, "TransportConfig(server)")
+		serverCfg.LocalStatic = serverKey
+		clientCfg, err := p.TransportConfig()
+		require.NoError(err, "TransportConfig(client)")
+		clientCfg.LocalStatic = clientKey
+
+		c1, c2 := net.Pipe()
+		type result struct {
+			conn *transport.Conn
+			err  error
+		}
+		ch := make(chan result)
+		go func() {
+			conn, err := transport.Server(c2, serverCfg)
+			ch <- result{conn, err}
+		}()
+		client, err := transport.Client(c1, clientCfg)
+		require.NoError(err, "Client")
+		res := <-ch
+		require.NoError(res.err, "Server")
+		// Tear down the underlying connections, as closing a Conn over an
+		// unbuffered net.Pipe blocks until the close record is read.
+		defer func() {
+			c1.Close()
+			c2.Close()
+		}()
+
+		require.Equal(protocol.String(), client.ConnectionState().Protocol, "Protocol")
+	})
+}
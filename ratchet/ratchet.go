@@ -0,0 +1,112 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package ratchet exports the result of a completed Noise handshake in a
+// form suitable for seeding a Double Ratchet session, allowing a Noise
+// handshake (eg: X, IK) to be used as a replacement for X3DH.
+//
+// The shared secret key (`SK`) is derived from the handshake's Additional
+// Symmetric Keys master key, so the handshake must be created with
+// `HandshakeConfig.EnableASK` set.  The associated data (`AD`) is the
+// handshake hash, which commits to both parties' public keys.
+//
+// The responder's static key is used as the responder's initial ratchet
+// key, like the signed prekey in X3DH, so the pattern must transmit or
+// pre-share the responder's static key.
+package ratchet // import "gitlab.com/yawning/nyquist.git/ratchet"
+
+import (
+	"errors"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+// SharedKeySize is the size of the Double Ratchet shared secret key.
+const SharedKeySize = 32
+
+var (
+	errNotDone        = errors.New("nyquist/ratchet: handshake not complete")
+	errNoASK          = errors.New("nyquist/ratchet: handshake ask_master not available")
+	errNoRemoteStatic = errors.New("nyquist/ratchet: no responder static key")
+
+	askLabel = []byte("DoubleRatchet")
+)
+
+// Bootstrap is the material required to initialize a Double Ratchet
+// session.
+type Bootstrap struct {
+	// SharedKey is the shared secret key (`SK`).
+	SharedKey []byte
+
+	// AssociatedData is the associated data (`AD`).
+	AssociatedData []byte
+
+	// RemoteRatchetKey is the responder's initial ratchet public key.  This
+	// is only set for the initiator, the responder should use its own
+	// static keypair.
+	RemoteRatchetKey dh.PublicKey
+}
+
+// Reset sanitizes the shared secret key.
+func (b *Bootstrap) Reset() {
+	for i := range b.SharedKey {
+		b.SharedKey[i] = 0
+	}
+	b.SharedKey = nil
+}
+
+// NewBootstrap derives the Double Ratchet bootstrap material from the
+// status of a completed handshake.
+func NewBootstrap(protocol *nyquist.Protocol, status *nyquist.HandshakeStatus, isInitiator bool) (*Bootstrap, error) {
+	if status.Err != nyquist.ErrDone {
+		return nil, errNotDone
+	}
+	if status.ASKMaster == nil {
+		return nil, errNoASK
+	}
+
+	b := &Bootstrap{
+		AssociatedData: append([]byte{}, status.HandshakeHash...),
+	}
+	if isInitiator {
+		if status.RemoteStatic == nil {
+			return nil, errNoRemoteStatic
+		}
+		b.RemoteRatchetKey = status.RemoteStatic
+	}
+
+	ask := nyquist.DeriveASK(protocol.Hash, status.ASKMaster, askLabel)
+	b.SharedKey = append([]byte{}, ask[:SharedKeySize]...)
+	for i := range ask {
+		ask[i] = 0
+	}
+
+	return b, nil
+}
@@ -0,0 +1,141 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package ratchet
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+func runHandshake(t *testing.T, aliceCfg, bobCfg *nyquist.HandshakeConfig) (*nyquist.HandshakeStatus, *nyquist.HandshakeStatus) {
+	require := require.New(t)
+
+	alice, err := nyquist.NewHandshake(aliceCfg)
+	require.NoError(err, "NewHandshake - alice")
+	defer alice.Reset()
+	bob, err := nyquist.NewHandshake(bobCfg)
+	require.NoError(err, "NewHandshake - bob")
+	defer bob.Reset()
+
+	writer, reader := alice, bob
+	for {
+		msg, err := writer.WriteMessage(nil, nil)
+		if err != nyquist.ErrDone {
+			require.NoError(err, "WriteMessage")
+		}
+		_, rErr := reader.ReadMessage(nil, msg)
+		require.Equal(err, rErr, "ReadMessage")
+		if err == nyquist.ErrDone {
+			break
+		}
+		writer, reader = reader, writer
+	}
+
+	return alice.GetStatus(), bob.GetStatus()
+}
+
+func TestBootstrap(t *testing.T) {
+	aliceStatic, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(t, err, "GenerateKeypair - alice")
+	bobStatic, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(t, err, "GenerateKeypair - bob")
+
+	for _, v := range []string{
+		"Noise_X_25519_ChaChaPoly_BLAKE2s",
+		"Noise_IK_25519_ChaChaPoly_SHA256",
+		"Noise_XX_25519_AESGCM_BLAKE2b",
+	} {
+		t.Run(v, func(t *testing.T) {
+			require := require.New(t)
+
+			protocol, err := nyquist.NewProtocol(v)
+			require.NoError(err, "NewProtocol")
+
+			aliceCfg := &nyquist.HandshakeConfig{
+				Protocol:    protocol,
+				LocalStatic: aliceStatic,
+				EnableASK:   true,
+				IsInitiator: true,
+			}
+			if protocol.Pattern.String() != "XX" {
+				aliceCfg.RemoteStatic = bobStatic.Public()
+			}
+			bobCfg := &nyquist.HandshakeConfig{
+				Protocol:    protocol,
+				LocalStatic: bobStatic,
+				EnableASK:   true,
+			}
+			aliceStatus, bobStatus := runHandshake(t, aliceCfg, bobCfg)
+
+			aliceB, err := NewBootstrap(protocol, aliceStatus, true)
+			require.NoError(err, "NewBootstrap - alice")
+			bobB, err := NewBootstrap(protocol, bobStatus, false)
+			require.NoError(err, "NewBootstrap - bob")
+
+			require.Len(aliceB.SharedKey, SharedKeySize, "SharedKey")
+			require.Equal(aliceB.SharedKey, bobB.SharedKey, "SharedKey")
+			require.Equal(aliceB.AssociatedData, bobB.AssociatedData, "AssociatedData")
+			require.Equal(bobStatic.Public().Bytes(), aliceB.RemoteRatchetKey.Bytes(), "RemoteRatchetKey")
+			require.Nil(bobB.RemoteRatchetKey, "RemoteRatchetKey - responder")
+
+			aliceB.Reset()
+			require.Nil(aliceB.SharedKey, "Reset")
+		})
+	}
+
+	t.Run("Errors", func(t *testing.T) {
+		require := require.New(t)
+
+		protocol, err := nyquist.NewProtocol("Noise_NN_25519_ChaChaPoly_BLAKE2s")
+		require.NoError(err, "NewProtocol")
+
+		aliceStatus, _ := runHandshake(t,
+			&nyquist.HandshakeConfig{Protocol: protocol, IsInitiator: true},
+			&nyquist.HandshakeConfig{Protocol: protocol},
+		)
+		_, err = NewBootstrap(protocol, aliceStatus, true)
+		require.Equal(errNoASK, err, "NewBootstrap - no ASK")
+
+		aliceStatus, _ = runHandshake(t,
+			&nyquist.HandshakeConfig{Protocol: protocol, EnableASK: true, IsInitiator: true},
+			&nyquist.HandshakeConfig{Protocol: protocol, EnableASK: true},
+		)
+		_, err = NewBootstrap(protocol, aliceStatus, true)
+		require.Equal(errNoRemoteStatic, err, "NewBootstrap - no remote static")
+
+		_, err = NewBootstrap(protocol, &nyquist.HandshakeStatus{}, true)
+		require.Equal(errNotDone, err, "NewBootstrap - not done")
+	})
+}
@@ -0,0 +1,208 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package replay implements a RFC 6479 style sliding window anti-replay
+// filter, for use by datagram-oriented integrations, where packets may be
+// lost, duplicated, or reordered, and explicit nonces are sent on the
+// wire.
+//
+// The typical usage is to Check the counter before authenticating the
+// packet, and to Accept it only once the packet has been authenticated, so
+// that forged packets can not advance the window.
+package replay // import "gitlab.com/yawning/nyquist.git/replay"
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// DefaultSize is the default window size.
+	DefaultSize = 2048
+
+	blockBits = 64
+
+	marshaledHeaderSize = 8 + 4
+)
+
+var (
+	errInvalidSize = errors.New("nyquist/replay: invalid window size")
+	errMalformed   = errors.New("nyquist/replay: malformed serialized window")
+)
+
+// Window is a sliding window replay filter.  All methods are safe for
+// concurrent use.
+type Window struct {
+	// Accessed atomically, and must be 64 bit aligned.
+	max uint64
+
+	mu     sync.Mutex
+	size   uint64
+	bitmap []uint64
+}
+
+// Size returns the window size, the maximum distance behind the highest
+// counter seen that a counter may be and still be accepted.
+func (w *Window) Size() int {
+	return int(w.size)
+}
+
+// Max returns the highest counter that has been accepted.
+func (w *Window) Max() uint64 {
+	return atomic.LoadUint64(&w.max)
+}
+
+// Check returns true iff the counter has not been accepted, and is within
+// the window.  It does not update the window.
+func (w *Window) Check(counter uint64) bool {
+	// Fast path: Reject counters that are behind the window, without
+	// acquiring the lock.
+	if max := atomic.LoadUint64(&w.max); counter < max && max-counter >= w.size {
+		return false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.check(counter)
+}
+
+// Accept marks the counter as seen.  It returns false, leaving the window
+// unmodified, iff Check would have returned false.
+func (w *Window) Accept(counter uint64) bool {
+	if max := atomic.LoadUint64(&w.max); counter < max && max-counter >= w.size {
+		return false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.check(counter) {
+		return false
+	}
+
+	numBlocks := uint64(len(w.bitmap))
+	if max := w.max; counter > max {
+		curBlock, newBlock := max/blockBits, counter/blockBits
+		diff := newBlock - curBlock
+		if diff > numBlocks {
+			diff = numBlocks
+		}
+		for i := uint64(1); i <= diff; i++ {
+			w.bitmap[(curBlock+i)%numBlocks] = 0
+		}
+		atomic.StoreUint64(&w.max, counter)
+	}
+
+	bit := counter % (numBlocks * blockBits)
+	w.bitmap[bit/blockBits] |= 1 << (bit % blockBits)
+
+	return true
+}
+
+// Reset resets the window to the initial state.
+func (w *Window) Reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for i := range w.bitmap {
+		w.bitmap[i] = 0
+	}
+	atomic.StoreUint64(&w.max, 0)
+}
+
+func (w *Window) check(counter uint64) bool {
+	max := w.max
+	if counter > max {
+		return true
+	}
+	if max-counter >= w.size {
+		return false
+	}
+
+	bit := counter % (uint64(len(w.bitmap)) * blockBits)
+	return w.bitmap[bit/blockBits]&(1<<(bit%blockBits)) == 0
+}
+
+// MarshalBinary serializes the window, for persistence.
+func (w *Window) MarshalBinary() ([]byte, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	b := make([]byte, marshaledHeaderSize+8*len(w.bitmap))
+	binary.BigEndian.PutUint64(b[0:], w.max)
+	binary.BigEndian.PutUint32(b[8:], uint32(w.size))
+	for i, v := range w.bitmap {
+		binary.BigEndian.PutUint64(b[marshaledHeaderSize+8*i:], v)
+	}
+
+	return b, nil
+}
+
+// UnmarshalBinary restores a window serialized with MarshalBinary.  The
+// serialized window must be the same size as w.
+func (w *Window) UnmarshalBinary(data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(data) != marshaledHeaderSize+8*len(w.bitmap) {
+		return errMalformed
+	}
+	if uint64(binary.BigEndian.Uint32(data[8:])) != w.size {
+		return errMalformed
+	}
+	for i := range w.bitmap {
+		w.bitmap[i] = binary.BigEndian.Uint64(data[marshaledHeaderSize+8*i:])
+	}
+	atomic.StoreUint64(&w.max, binary.BigEndian.Uint64(data[0:]))
+
+	return nil
+}
+
+// New returns a new Window, that will accept counters up to size behind
+// the highest counter seen.  If size is 0, DefaultSize is used.
+func New(size int) (*Window, error) {
+	switch {
+	case size == 0:
+		size = DefaultSize
+	case size < 0 || size > 1<<24:
+		return nil, errInvalidSize
+	}
+
+	// The bitmap has an extra block, as the block containing the oldest
+	// counters in the window is cleared when the window advances.
+	numBlocks := (size+blockBits-1)/blockBits + 1
+
+	return &Window{
+		size:   uint64(size),
+		bitmap: make([]uint64, numBlocks),
+	}, nil
+}
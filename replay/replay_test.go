@@ -0,0 +1,169 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package replay
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWindow(t *testing.T) {
+	t.Run("Basic", func(t *testing.T) {
+		require := require.New(t)
+
+		w, err := New(0)
+		require.NoError(err, "New")
+		require.Equal(DefaultSize, w.Size(), "Size")
+
+		for _, v := range []uint64{0, 1, 2, 5, 4, 3} {
+			require.True(w.Check(v), "Check(%d)", v)
+			require.True(w.Accept(v), "Accept(%d)", v)
+			require.False(w.Check(v), "Check(%d) - replay", v)
+			require.False(w.Accept(v), "Accept(%d) - replay", v)
+		}
+		require.EqualValues(5, w.Max(), "Max")
+
+		const max = DefaultSize * 4
+		require.True(w.Accept(max), "Accept - jump")
+		for _, v := range []uint64{0, 5, max - DefaultSize} {
+			require.False(w.Check(v), "Check(%d) - too old", v)
+			require.False(w.Accept(v), "Accept(%d) - too old", v)
+		}
+		require.True(w.Check(max-DefaultSize+1), "Check - oldest in window")
+		require.True(w.Check(max-1), "Check - in window")
+		require.False(w.Check(max), "Check - max")
+		require.True(w.Check(max+1), "Check - new")
+
+		w.Reset()
+		require.Zero(w.Max(), "Max - after Reset")
+		require.True(w.Check(0), "Check - after Reset")
+	})
+
+	t.Run("Sizes", func(t *testing.T) {
+		for _, size := range []int{1, 63, 64, 65, 1000, 4096} {
+			require := require.New(t)
+
+			w, err := New(size)
+			require.NoError(err, "New(%d)", size)
+
+			// Exhaustively compare against a trivially correct filter,
+			// with a bias towards reordering within the window.
+			seen := make(map[uint64]bool)
+			var max uint64
+			rng := rand.New(rand.NewSource(int64(size)))
+			for i := 0; i < 20000; i++ {
+				counter := max + uint64(rng.Intn(8))
+				if d := uint64(rng.Intn(2*size + 2)); d <= counter {
+					counter -= d
+				}
+
+				expected := !seen[counter] && (counter > max || max-counter < uint64(size))
+				require.Equal(expected, w.Check(counter), "Check(%d) - size %d, max %d", counter, size, max)
+				require.Equal(expected, w.Accept(counter), "Accept(%d) - size %d, max %d", counter, size, max)
+				if expected {
+					seen[counter] = true
+					if counter > max {
+						max = counter
+					}
+				}
+			}
+		}
+	})
+
+	t.Run("Serialization", func(t *testing.T) {
+		require := require.New(t)
+
+		w, err := New(256)
+		require.NoError(err, "New")
+		for _, v := range []uint64{1000, 990, 999, 800} {
+			require.True(w.Accept(v), "Accept(%d)", v)
+		}
+
+		b, err := w.MarshalBinary()
+		require.NoError(err, "MarshalBinary")
+
+		w2, err := New(256)
+		require.NoError(err, "New")
+		require.NoError(w2.UnmarshalBinary(b), "UnmarshalBinary")
+		require.Equal(w.Max(), w2.Max(), "Max")
+		for _, v := range []uint64{1000, 990, 999, 800, 700} {
+			require.False(w2.Check(v), "Check(%d) - restored", v)
+		}
+		require.True(w2.Check(991), "Check - restored, unseen")
+
+		w3, err := New(512)
+		require.NoError(err, "New")
+		require.Equal(errMalformed, w3.UnmarshalBinary(b), "UnmarshalBinary - size mismatch")
+		require.Equal(errMalformed, w2.UnmarshalBinary(b[:len(b)-1]), "UnmarshalBinary - truncated")
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		require := require.New(t)
+
+		w, err := New(1024)
+		require.NoError(err, "New")
+
+		const (
+			numGoroutines = 8
+			numCounters   = 1000
+		)
+		var (
+			wg       sync.WaitGroup
+			mu       sync.Mutex
+			accepted = make(map[uint64]int)
+		)
+		for i := 0; i < numGoroutines; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for c := uint64(0); c < numCounters; c++ {
+					if w.Accept(c) {
+						mu.Lock()
+						accepted[c]++
+						mu.Unlock()
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		for c, n := range accepted {
+			require.Equal(1, n, "counter %d accepted more than once", c)
+		}
+	})
+
+	t.Run("InvalidSize", func(t *testing.T) {
+		_, err := New(-1)
+		require.Equal(t, errInvalidSize, err, "New(-1)")
+	})
+}
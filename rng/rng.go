@@ -0,0 +1,210 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package rng implements an entropy source wrapper that performs the
+// NIST SP 800-90B startup and continuous health tests (the repetition
+// count test and the adaptive proportion test) on the output of the
+// wrapped source.
+//
+// Once a health test fails, the wrapper fails closed, returning an error
+// on all subsequent reads, so that a misbehaving entropy source causes
+// handshakes to fail rather than silently generating weak ephemeral keys.
+package rng // import "gitlab.com/yawning/nyquist.git/rng"
+
+import (
+	"errors"
+	"io"
+	"math"
+	"sync"
+)
+
+const (
+	// DefaultMinEntropy is the default assumed min-entropy of the wrapped
+	// source in bits per byte.  This is deliberately conservative, so
+	// that the health tests only detect catastrophic failures.
+	DefaultMinEntropy = 4.0
+
+	// The false positive probability for each test is 2^-falsePositiveLog2.
+	falsePositiveLog2 = 40
+
+	aptWindowSize   = 512
+	startupSamples  = 1024
+	maxMinEntropy   = 8.0
+	minMinEntropy   = 0.5
+	readChunkLength = 256
+)
+
+var (
+	// ErrHealthTestFailed is the error returned when the wrapped source
+	// fails a health test.
+	ErrHealthTestFailed = errors.New("nyquist/rng: entropy source health test failed")
+
+	errInvalidMinEntropy = errors.New("nyquist/rng: invalid min-entropy")
+)
+
+// Reader is an entropy source that performs health tests on the output of
+// the wrapped source.  It is safe for concurrent use.
+type Reader struct {
+	sync.Mutex
+
+	r   io.Reader
+	err error
+
+	rctCutoff int
+	rctLast   byte
+	rctCount  int
+
+	aptCutoff int
+	aptFirst  byte
+	aptCount  int
+	aptIndex  int
+}
+
+// Read reads len(p) bytes of health tested entropy into p.
+func (r *Reader) Read(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	if _, err := io.ReadFull(r.r, p); err != nil {
+		return 0, err
+	}
+	if err := r.test(p); err != nil {
+		zero(p)
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// test runs the continuous health tests on the samples.  The caller must
+// hold the lock.
+func (r *Reader) test(samples []byte) error {
+	for _, v := range samples {
+		// Repetition count test (SP 800-90B 4.4.1).
+		if v == r.rctLast && r.rctCount > 0 {
+			r.rctCount++
+			if r.rctCount >= r.rctCutoff {
+				r.err = ErrHealthTestFailed
+			}
+		} else {
+			r.rctLast, r.rctCount = v, 1
+		}
+
+		// Adaptive proportion test (SP 800-90B 4.4.2).
+		if r.aptIndex == 0 {
+			r.aptFirst, r.aptCount = v, 1
+		} else if v == r.aptFirst {
+			r.aptCount++
+			if r.aptCount >= r.aptCutoff {
+				r.err = ErrHealthTestFailed
+			}
+		}
+		r.aptIndex = (r.aptIndex + 1) % aptWindowSize
+
+		if r.err != nil {
+			return r.err
+		}
+	}
+
+	return nil
+}
+
+// NewReader wraps the entropy source r, which is assumed to provide at
+// least minEntropy bits of min-entropy per byte, with health tests.  If
+// minEntropy is 0, DefaultMinEntropy is used.
+//
+// The startup health tests are run on samples read from r before
+// returning, and an error is returned if they fail.
+func NewReader(r io.Reader, minEntropy float64) (*Reader, error) {
+	if minEntropy == 0 {
+		minEntropy = DefaultMinEntropy
+	}
+	if minEntropy < minMinEntropy || minEntropy > maxMinEntropy || math.IsNaN(minEntropy) {
+		return nil, errInvalidMinEntropy
+	}
+
+	hr := &Reader{
+		r:         r,
+		rctCutoff: 1 + int(math.Ceil(falsePositiveLog2/minEntropy)),
+		aptCutoff: aptCutoff(minEntropy),
+	}
+
+	// Startup health tests (SP 800-90B 4.3), the samples are discarded.
+	var buf [readChunkLength]byte
+	for i := 0; i < startupSamples; i += len(buf) {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return nil, err
+		}
+		err := hr.test(buf[:])
+		zero(buf[:])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return hr, nil
+}
+
+// aptCutoff returns the smallest cutoff c, such that the probability of
+// a sample with the assumed min-entropy occurring at least c times in a
+// window is at most 2^-falsePositiveLog2.
+func aptCutoff(minEntropy float64) int {
+	p := math.Exp2(-minEntropy)
+	threshold := math.Exp2(-falsePositiveLog2)
+
+	// The first sample in the window is given, so the remaining
+	// aptWindowSize - 1 samples are binomially distributed.
+	const n = aptWindowSize - 1
+	var tail float64
+	for k := n; k >= 0; k-- {
+		tail += binomialPMF(n, k, p)
+		if tail > threshold {
+			// 1 (the first sample) + (k + 1) occurrences.
+			return k + 2
+		}
+	}
+	return 1
+}
+
+func binomialPMF(n, k int, p float64) float64 {
+	lnN, _ := math.Lgamma(float64(n + 1))
+	lnK, _ := math.Lgamma(float64(k + 1))
+	lnNK, _ := math.Lgamma(float64(n - k + 1))
+	return math.Exp(lnN - lnK - lnNK + float64(k)*math.Log(p) + float64(n-k)*math.Log1p(-p))
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
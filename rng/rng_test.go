@@ -0,0 +1,166 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package rng
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git"
+)
+
+// patternReader is an entropy source that returns a repeating pattern,
+// after the first good bytes from crypto/rand.
+type patternReader struct {
+	good    int
+	pattern []byte
+	off     int
+}
+
+func (r *patternReader) Read(p []byte) (int, error) {
+	for i := range p {
+		if r.good > 0 {
+			if _, err := rand.Read(p[i : i+1]); err != nil {
+				return i, err
+			}
+			r.good--
+			continue
+		}
+		p[i] = r.pattern[r.off%len(r.pattern)]
+		r.off++
+	}
+	return len(p), nil
+}
+
+func TestReader(t *testing.T) {
+	t.Run("Good", testReaderGood)
+	t.Run("Startup", testReaderStartup)
+	t.Run("Continuous", testReaderContinuous)
+	t.Run("Handshake", testReaderHandshake)
+	t.Run("MinEntropy", testReaderMinEntropy)
+}
+
+func testReaderGood(t *testing.T) {
+	require := require.New(t)
+
+	r, err := NewReader(rand.Reader, 0)
+	require.NoError(err, "NewReader")
+
+	b := make([]byte, 1<<20)
+	n, err := r.Read(b)
+	require.NoError(err, "Read")
+	require.Len(b, n, "Read - length")
+}
+
+func testReaderStartup(t *testing.T) {
+	for _, v := range []struct {
+		name    string
+		pattern []byte
+	}{
+		// Fails the repetition count test.
+		{"Stuck", []byte{0x42}},
+		// Fails the adaptive proportion test.
+		{"LowEntropy", []byte{0, 1, 2, 3}},
+	} {
+		t.Run(v.name, func(t *testing.T) {
+			_, err := NewReader(&patternReader{pattern: v.pattern}, 0)
+			require.Equal(t, ErrHealthTestFailed, err, "NewReader")
+		})
+	}
+}
+
+func testReaderContinuous(t *testing.T) {
+	require := require.New(t)
+
+	src := &patternReader{
+		good:    startupSamples + 32,
+		pattern: []byte{0x00},
+	}
+	r, err := NewReader(src, 0)
+	require.NoError(err, "NewReader")
+
+	b := make([]byte, 32)
+	_, err = r.Read(b)
+	require.NoError(err, "Read - good")
+
+	_, err = r.Read(b)
+	require.Equal(ErrHealthTestFailed, err, "Read - stuck")
+	require.Equal(make([]byte, 32), b, "Read - output cleared")
+
+	// The failure is permanent, even if the source recovers.
+	src.good = 1 << 20
+	_, err = r.Read(b)
+	require.Equal(ErrHealthTestFailed, err, "Read - after failure")
+}
+
+func testReaderHandshake(t *testing.T) {
+	require := require.New(t)
+
+	protocol, err := nyquist.NewProtocol("Noise_NN_25519_ChaChaPoly_BLAKE2s")
+	require.NoError(err, "NewProtocol")
+
+	r, err := NewReader(&patternReader{
+		good:    startupSamples,
+		pattern: []byte{0xff},
+	}, 0)
+	require.NoError(err, "NewReader")
+
+	hs, err := nyquist.NewHandshake(&nyquist.HandshakeConfig{
+		Protocol:    protocol,
+		Rng:         r,
+		IsInitiator: true,
+	})
+	require.NoError(err, "NewHandshake")
+	defer hs.Reset()
+
+	_, err = hs.WriteMessage(nil, nil)
+	require.True(errors.Is(err, ErrHealthTestFailed), "WriteMessage: %v", err)
+}
+
+func testReaderMinEntropy(t *testing.T) {
+	require := require.New(t)
+
+	for _, v := range []float64{-1, 0.1, 8.5} {
+		_, err := NewReader(rand.Reader, v)
+		require.Equal(errInvalidMinEntropy, err, "NewReader(%v)", v)
+	}
+
+	// Higher assumed min-entropy results in stricter cutoffs.
+	prev := aptWindowSize + 1
+	for _, v := range []float64{0.5, 1, 2, 4, 8} {
+		cutoff := aptCutoff(v)
+		require.True(cutoff < prev, "aptCutoff(%v) decreasing", v)
+		require.True(cutoff > 1, "aptCutoff(%v) sane", v)
+		prev = cutoff
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package sas implements short authentication strings (SAS) and public key
+// fingerprints, for out-of-band verification of a handshake or a peer's
+// identity between users.
+//
+// A SAS is derived from the handshake hash, which both parties share iff
+// the handshake was not subject to a man-in-the-middle attack, and is
+// rendered as a number, a sequence of words, or a sequence of emoji, to be
+// compared by the users (eg: read aloud over a phone call).
+package sas // import "gitlab.com/yawning/nyquist.git/sas"
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+
+	"gitlab.com/yawning/nyquist.git/dh"
+	"gitlab.com/yawning/nyquist.git/hash"
+)
+
+const (
+	// MaxDigits is the maximum number of digits supported by Numeric.
+	MaxDigits = 30
+
+	// MaxWords is the maximum number of words supported by Words.
+	MaxWords = sasSize
+
+	// MaxEmoji is the maximum number of emoji supported by Emoji.
+	MaxEmoji = sasSize * 8 / 6
+
+	sasSize = 32
+
+	fingerprintSize = 20
+)
+
+var (
+	sasLabel          = []byte("nyquist/sas: short authentication string")
+	fingerprintLabel  = []byte("nyquist/sas: fingerprint")
+	safetyNumberLabel = []byte("nyquist/sas: safety number")
+
+	errNoHandshakeHash = errors.New("nyquist/sas: no handshake hash")
+	errInvalidLength   = errors.New("nyquist/sas: invalid length")
+)
+
+// SAS is a short authentication string derived from a handshake.
+type SAS struct {
+	b [sasSize]byte
+}
+
+// Numeric returns the SAS as a decimal number with the specified number of
+// digits.
+func (s *SAS) Numeric(digits int) (string, error) {
+	if digits < 1 || digits > MaxDigits {
+		return "", errInvalidLength
+	}
+	return toDecimal(s.b[:], digits), nil
+}
+
+// Words returns the SAS as a sequence of n words.
+func (s *SAS) Words(n int) ([]string, error) {
+	if n < 1 || n > MaxWords {
+		return nil, errInvalidLength
+	}
+
+	ret := make([]string, 0, n)
+	for _, v := range s.b[:n] {
+		ret = append(ret, wordList[v])
+	}
+	return ret, nil
+}
+
+// Emoji is an emoji used to render a SAS, along with a description of the
+// emoji, for display alongside the emoji (eg: as a hint for users with
+// differing emoji renderings).
+type Emoji struct {
+	Symbol      string
+	Description string
+}
+
+// Emoji returns the SAS as a sequence of n emoji.
+func (s *SAS) Emoji(n int) ([]Emoji, error) {
+	if n < 1 || n > MaxEmoji {
+		return nil, errInvalidLength
+	}
+
+	ret := make([]Emoji, 0, n)
+	for i := 0; i < n; i++ {
+		// Extract 6 bits at a time, big endian.
+		bitOff := i * 6
+		v := uint(s.b[bitOff/8]) << 8
+		if bitOff/8+1 < len(s.b) {
+			v |= uint(s.b[bitOff/8+1])
+		}
+		idx := (v >> (10 - bitOff%8)) & 0x3f
+		ret = append(ret, emojiList[idx])
+	}
+	return ret, nil
+}
+
+// New derives a SAS from a handshake hash, using the protocol's hash
+// function.  Both parties will derive the same SAS iff their handshake
+// hashes are identical.
+func New(h hash.Hash, handshakeHash []byte) (*SAS, error) {
+	if len(handshakeHash) == 0 {
+		return nil, errNoHandshakeHash
+	}
+
+	var s SAS
+	kdf(h, s.b[:], sasLabel, handshakeHash)
+	return &s, nil
+}
+
+// Fingerprint returns a fingerprint of a static public key, as groups of
+// hexadecimal digits (eg: `1A2B 3C4D ...`).
+func Fingerprint(h hash.Hash, publicKey dh.PublicKey) string {
+	var b [fingerprintSize]byte
+	kdf(h, b[:], fingerprintLabel, publicKey.Bytes())
+
+	s := strings.ToUpper(hex.EncodeToString(b[:]))
+	return group(s, 4)
+}
+
+// SafetyNumber returns a decimal safety number for a pair of static public
+// keys, as groups of digits.  The safety number is independent of the order
+// of the keys, so both parties will derive the same value.
+func SafetyNumber(h hash.Hash, a, b dh.PublicKey) string {
+	const halfDigits = 30
+
+	var (
+		aNum = numericFingerprint(h, a, halfDigits)
+		bNum = numericFingerprint(h, b, halfDigits)
+	)
+	if aNum > bNum {
+		aNum, bNum = bNum, aNum
+	}
+	return group(aNum+bNum, 5)
+}
+
+// Compare returns true iff the two rendered values (eg: a SAS read aloud
+// and entered by the user) are equal, ignoring case, whitespace, and `-`
+// separators.  The comparison is constant time with respect to the
+// normalized values, if they are the same length.
+func Compare(a, b string) bool {
+	normA, normB := normalize(a), normalize(b)
+	return subtle.ConstantTimeCompare([]byte(normA), []byte(normB)) == 1
+}
+
+func numericFingerprint(h hash.Hash, publicKey dh.PublicKey, digits int) string {
+	var b [sasSize]byte
+	kdf(h, b[:], safetyNumberLabel, publicKey.Bytes())
+	return toDecimal(b[:], digits)
+}
+
+func kdf(h hash.Hash, dst, label, ikm []byte) {
+	r := hkdf.New(h.New, ikm, nil, label)
+	_, _ = io.ReadFull(r, dst)
+}
+
+func toDecimal(b []byte, digits int) string {
+	// With 256 bits of input, the modulo bias is negligible.
+	var n, modulus big.Int
+	n.SetBytes(b)
+	modulus.Exp(big.NewInt(10), big.NewInt(int64(digits)), nil)
+	n.Mod(&n, &modulus)
+
+	s := n.String()
+	return strings.Repeat("0", digits-len(s)) + s
+}
+
+func group(s string, sz int) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i += sz {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		end := i + sz
+		if end > len(s) {
+			end = len(s)
+		}
+		sb.WriteString(s[i:end])
+	}
+	return sb.String()
+}
+
+func normalize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\n', '\r', '-':
+			return -1
+		default:
+			return r
+		}
+	}, strings.ToLower(s))
+}
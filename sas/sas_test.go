@@ -0,0 +1,174 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package sas
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/dh"
+	"gitlab.com/yawning/nyquist.git/hash"
+)
+
+func TestSAS(t *testing.T) {
+	t.Run("Tables", testSASTables)
+	t.Run("Handshake", testSASHandshake)
+	t.Run("Fingerprint", testSASFingerprint)
+	t.Run("Compare", testSASCompare)
+}
+
+func testSASTables(t *testing.T) {
+	require := require.New(t)
+
+	words := make(map[string]bool)
+	for _, v := range wordList {
+		require.NotEmpty(v, "word")
+		require.False(words[v], "duplicate word: %s", v)
+		words[v] = true
+	}
+
+	emoji := make(map[string]bool)
+	for _, v := range emojiList {
+		require.NotEmpty(v.Symbol, "emoji")
+		require.NotEmpty(v.Description, "emoji description")
+		require.False(emoji[v.Symbol], "duplicate emoji: %s", v.Description)
+		emoji[v.Symbol] = true
+	}
+}
+
+func testSASHandshake(t *testing.T) {
+	require := require.New(t)
+
+	protocol, err := nyquist.NewProtocol("Noise_NN_25519_ChaChaPoly_BLAKE2s")
+	require.NoError(err, "NewProtocol")
+
+	doHandshake := func() (*nyquist.HandshakeStatus, *nyquist.HandshakeStatus) {
+		aliceHs, err := nyquist.NewHandshake(&nyquist.HandshakeConfig{
+			Protocol:    protocol,
+			IsInitiator: true,
+		})
+		require.NoError(err, "NewHandshake(alice)")
+		defer aliceHs.Reset()
+		bobHs, err := nyquist.NewHandshake(&nyquist.HandshakeConfig{
+			Protocol: protocol,
+		})
+		require.NoError(err, "NewHandshake(bob)")
+		defer bobHs.Reset()
+
+		msg, err := aliceHs.WriteMessage(nil, nil)
+		require.NoError(err, "aliceHs.WriteMessage")
+		_, err = bobHs.ReadMessage(nil, msg)
+		require.NoError(err, "bobHs.ReadMessage")
+		msg, err = bobHs.WriteMessage(nil, nil)
+		require.Equal(nyquist.ErrDone, err, "bobHs.WriteMessage")
+		_, err = aliceHs.ReadMessage(nil, msg)
+		require.Equal(nyquist.ErrDone, err, "aliceHs.ReadMessage")
+
+		return aliceHs.GetStatus(), bobHs.GetStatus()
+	}
+
+	aliceStatus, bobStatus := doHandshake()
+	aliceSAS, err := New(protocol.Hash, aliceStatus.HandshakeHash)
+	require.NoError(err, "New(alice)")
+	bobSAS, err := New(protocol.Hash, bobStatus.HandshakeHash)
+	require.NoError(err, "New(bob)")
+
+	aliceNum, err := aliceSAS.Numeric(6)
+	require.NoError(err, "Numeric(alice)")
+	require.Len(aliceNum, 6, "Numeric - length")
+	bobNum, err := bobSAS.Numeric(6)
+	require.NoError(err, "Numeric(bob)")
+	require.Equal(aliceNum, bobNum, "Numeric - match")
+
+	aliceWords, err := aliceSAS.Words(5)
+	require.NoError(err, "Words(alice)")
+	require.Len(aliceWords, 5, "Words - length")
+	bobWords, err := bobSAS.Words(5)
+	require.NoError(err, "Words(bob)")
+	require.Equal(aliceWords, bobWords, "Words - match")
+
+	aliceEmoji, err := aliceSAS.Emoji(MaxEmoji)
+	require.NoError(err, "Emoji(alice)")
+	require.Len(aliceEmoji, MaxEmoji, "Emoji - length")
+	bobEmoji, err := bobSAS.Emoji(MaxEmoji)
+	require.NoError(err, "Emoji(bob)")
+	require.Equal(aliceEmoji, bobEmoji, "Emoji - match")
+
+	// A different handshake yields a different SAS.
+	otherStatus, _ := doHandshake()
+	otherSAS, err := New(protocol.Hash, otherStatus.HandshakeHash)
+	require.NoError(err, "New(other)")
+	otherNum, err := otherSAS.Numeric(MaxDigits)
+	require.NoError(err, "Numeric(other)")
+	aliceNum, err = aliceSAS.Numeric(MaxDigits)
+	require.NoError(err, "Numeric(alice)")
+	require.NotEqual(aliceNum, otherNum, "Numeric - different handshake")
+
+	// Invalid lengths.
+	_, err = aliceSAS.Numeric(0)
+	require.Error(err, "Numeric(0)")
+	_, err = aliceSAS.Words(MaxWords + 1)
+	require.Error(err, "Words(MaxWords+1)")
+	_, err = aliceSAS.Emoji(MaxEmoji + 1)
+	require.Error(err, "Emoji(MaxEmoji+1)")
+	_, err = New(protocol.Hash, nil)
+	require.Error(err, "New(nil)")
+}
+
+func testSASFingerprint(t *testing.T) {
+	require := require.New(t)
+
+	alice, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(err, "GenerateKeypair(alice)")
+	bob, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(err, "GenerateKeypair(bob)")
+
+	fp := Fingerprint(hash.BLAKE2s, alice.Public())
+	require.Len(strings.Fields(fp), fingerprintSize/2, "Fingerprint - groups")
+	require.Equal(fp, Fingerprint(hash.BLAKE2s, alice.Public()), "Fingerprint - deterministic")
+	require.NotEqual(fp, Fingerprint(hash.BLAKE2s, bob.Public()), "Fingerprint - distinct")
+
+	sn := SafetyNumber(hash.SHA256, alice.Public(), bob.Public())
+	require.Len(strings.Fields(sn), 12, "SafetyNumber - groups")
+	require.Equal(sn, SafetyNumber(hash.SHA256, bob.Public(), alice.Public()), "SafetyNumber - symmetric")
+}
+
+func testSASCompare(t *testing.T) {
+	require := require.New(t)
+
+	require.True(Compare("1A2B 3C4D", "1a2b-3c4d"), "Compare - normalized")
+	require.True(Compare("apple banana", " Apple  Banana\n"), "Compare - words")
+	require.False(Compare("1A2B 3C4D", "1A2B 3C4E"), "Compare - mismatch")
+	require.False(Compare("1A2B", "1A2B 3C4D"), "Compare - length mismatch")
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package sas
+
+// wordList is the list of words used to render a SAS, one per byte.  The
+// words are short, common, and (mostly) phonetically distinct.
+var wordList = [256]string{
+	"acorn", "actor", "album", "alpha", "amber", "anchor", "angle", "apple",
+	"arena", "armor", "arrow", "atlas", "audio", "award", "bacon", "badge",
+	"bagel", "baker", "bamboo", "banjo", "barn", "beach", "beetle", "bell",
+	"bench", "berry", "bison", "blade", "blanket", "blimp", "bloom", "board",
+	"bonus", "boot", "bottle", "brass", "bread", "brick", "bridge", "broom",
+	"bubble", "bucket", "buffalo", "bugle", "butter", "cabin", "cactus",
+	"camel", "camera", "candle", "canoe", "canyon", "carpet", "castle",
+	"cedar", "cello", "chalk", "cherry", "chess", "chimney", "cider",
+	"circus", "clover", "cobra", "cocoa", "comet", "copper", "coral",
+	"cotton", "cowboy", "crane", "crayon", "cricket", "crystal", "cupcake",
+	"daisy", "dancer", "dart", "delta", "desert", "dingo", "dolphin",
+	"domino", "donkey", "dragon", "drum", "eagle", "easel", "echo", "eclipse",
+	"elephant", "elm", "ember", "engine", "falcon", "fern", "ferry", "fiddle",
+	"fig", "flame", "flute", "forest", "fossil", "fox", "galaxy", "garden",
+	"garlic", "gecko", "geyser", "ginger", "giraffe", "glacier", "globe",
+	"goblin", "gopher", "granite", "grape", "gravel", "guitar", "hammer",
+	"harbor", "harp", "hazel", "helmet", "hippo", "honey", "hornet", "husky",
+	"igloo", "indigo", "iris", "island", "ivory", "jacket", "jaguar",
+	"jasmine", "jelly", "jester", "jigsaw", "jockey", "jungle", "kayak",
+	"kettle", "kiwi", "koala", "ladder", "lagoon", "lantern", "laser",
+	"lemon", "lentil", "lilac", "lion", "lizard", "llama", "lobster",
+	"locket", "lotus", "lunar", "magnet", "mango", "maple", "marble",
+	"meadow", "melon", "meteor", "mint", "mitten", "monkey", "moose",
+	"mosaic", "muffin", "mustard", "napkin", "nectar", "needle", "nickel",
+	"noodle", "nutmeg", "oasis", "ocean", "olive", "onion", "opal", "orbit",
+	"orchid", "otter", "oyster", "paddle", "panda", "parrot", "peanut",
+	"pebble", "pepper", "piano", "pilot", "planet", "plum", "pocket", "poppy",
+	"potato", "pretzel", "pumpkin", "puzzle", "quartz", "quiver", "rabbit",
+	"radar", "radish", "raven", "ribbon", "robot", "rocket", "ruby", "saddle",
+	"salmon", "sandal", "scarf", "shadow", "shovel", "silver", "skunk",
+	"sonar", "spider", "sprout", "squid", "statue", "sugar", "summit",
+	"sunset", "teapot", "tiger", "tomato", "topaz", "tractor", "trumpet",
+	"tulip", "tundra", "turtle", "tuxedo", "umbrella", "unicorn", "valley",
+	"velvet", "violin", "viper", "volcano", "waffle", "walnut", "walrus",
+	"wizard", "yacht", "yogurt", "zebra", "zigzag", "zipper",
+}
+
+// emojiList is the list of emoji used to render a SAS, one per 6 bits.
+var emojiList = [64]Emoji{
+	{"🐶", "Dog"}, {"🐱", "Cat"}, {"🦁", "Lion"}, {"🐎", "Horse"},
+	{"🦄", "Unicorn"}, {"🐷", "Pig"}, {"🐘", "Elephant"}, {"🐰", "Rabbit"},
+	{"🐼", "Panda"}, {"🐓", "Rooster"}, {"🐧", "Penguin"}, {"🐢", "Turtle"},
+	{"🐟", "Fish"}, {"🐙", "Octopus"}, {"🦋", "Butterfly"}, {"🌷", "Flower"},
+	{"🌳", "Tree"}, {"🌵", "Cactus"}, {"🍄", "Mushroom"}, {"🌏", "Globe"},
+	{"🌙", "Moon"}, {"☁️", "Cloud"}, {"🔥", "Fire"}, {"🍌", "Banana"},
+	{"🍎", "Apple"}, {"🍓", "Strawberry"}, {"🌽", "Corn"}, {"🍕", "Pizza"},
+	{"🎂", "Cake"}, {"❤️", "Heart"}, {"😀", "Smiley"}, {"🤖", "Robot"},
+	{"🎩", "Hat"}, {"👓", "Glasses"}, {"🔧", "Spanner"}, {"🎅", "Santa"},
+	{"👍", "Thumbs Up"}, {"☂️", "Umbrella"}, {"⌛", "Hourglass"}, {"⏰", "Clock"},
+	{"🎁", "Gift"}, {"💡", "Light Bulb"}, {"📕", "Book"}, {"✏️", "Pencil"},
+	{"📎", "Paperclip"}, {"✂️", "Scissors"}, {"🔒", "Lock"}, {"🔑", "Key"},
+	{"🔨", "Hammer"}, {"☎️", "Telephone"}, {"🏁", "Flag"}, {"🚂", "Train"},
+	{"🚲", "Bicycle"}, {"✈️", "Aeroplane"}, {"🚀", "Rocket"}, {"🏆", "Trophy"},
+	{"⚽", "Ball"}, {"🎸", "Guitar"}, {"🎺", "Trumpet"}, {"🔔", "Bell"},
+	{"⚓", "Anchor"}, {"🎧", "Headphones"}, {"📁", "Folder"}, {"📌", "Pin"},
+}
@@ -0,0 +1,189 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package seal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+const payloadKeySize = 32
+
+var (
+	// ErrNotRecipient is the error returned by OpenMulti when the local
+	// static keypair is not one of the message's recipients.
+	ErrNotRecipient = errors.New("nyquist/seal: not a recipient")
+
+	errMalformedMulti    = errors.New("nyquist/seal: malformed multi-recipient message")
+	errTooManyRecipients = errors.New("nyquist/seal: too many recipients")
+)
+
+// SealMulti encrypts and authenticates payload to each of the recipients,
+// and returns the resulting message.  The payload is encrypted once with
+// a random payload key, which is sealed to each recipient (as with Seal)
+// along with a digest of the encrypted payload.  cfg.RemoteStatic is
+// ignored.
+//
+// The message is of the form:
+//
+//	num_recipients  uint16 (big endian)
+//	recipients      [num_recipients]{len uint16, sealed [len]byte}
+//	payload         []byte
+//
+// Recipients are not identified in the message, and OpenMulti tries each
+// sealed key in turn.  Note that with the K and X patterns, each recipient
+// can verify that the payload is from the sender, but not which other
+// recipients it was sent to.
+func SealMulti(cfg *Config, recipients []dh.PublicKey, payload []byte) ([]byte, error) {
+	switch {
+	case len(recipients) == 0:
+		return nil, errNoRecipient
+	case len(recipients) > math.MaxUint16:
+		return nil, errTooManyRecipients
+	case cfg.Protocol == nil:
+		return nil, errNotOneWay
+	}
+
+	payloadKey := make([]byte, payloadKeySize)
+	defer zero(payloadKey)
+	rng := cfg.Rng
+	if rng == nil {
+		rng = rand.Reader
+	}
+	if _, err := io.ReadFull(rng, payloadKey); err != nil {
+		return nil, err
+	}
+	ciphertext, err := sealPayload(cfg.Protocol, payloadKey, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	keyMsg := append(append([]byte{}, payloadKey...), digest(cfg.Protocol, ciphertext)...)
+	defer zero(keyMsg)
+
+	recipientCfg := *cfg
+	out := make([]byte, 2, 2+len(ciphertext))
+	binary.BigEndian.PutUint16(out, uint16(len(recipients)))
+	for _, recipient := range recipients {
+		recipientCfg.RemoteStatic = recipient
+		sealed, err := Seal(&recipientCfg, keyMsg)
+		if err != nil {
+			return nil, err
+		}
+		var l [2]byte
+		binary.BigEndian.PutUint16(l[:], uint16(len(sealed)))
+		out = append(out, l[:]...)
+		out = append(out, sealed...)
+	}
+
+	return append(out, ciphertext...), nil
+}
+
+// OpenMulti decrypts and authenticates a message produced by SealMulti,
+// with cfg.LocalStatic, and returns the resulting payload, and the
+// sender's static public key if any.
+func OpenMulti(cfg *Config, message []byte) ([]byte, dh.PublicKey, error) {
+	if len(message) < 2 {
+		return nil, nil, errMalformedMulti
+	}
+	n := int(binary.BigEndian.Uint16(message))
+	message = message[2:]
+
+	sealed := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		if len(message) < 2 {
+			return nil, nil, errMalformedMulti
+		}
+		l := int(binary.BigEndian.Uint16(message))
+		if len(message) < 2+l {
+			return nil, nil, errMalformedMulti
+		}
+		sealed = append(sealed, message[2:2+l])
+		message = message[2+l:]
+	}
+	ciphertext := message
+
+	for _, v := range sealed {
+		keyMsg, sender, err := Open(cfg, v)
+		if err != nil {
+			if err == errNotOneWay {
+				return nil, nil, err
+			}
+			continue
+		}
+		defer zero(keyMsg)
+
+		if len(keyMsg) <= payloadKeySize || !hmac.Equal(keyMsg[payloadKeySize:], digest(cfg.Protocol, ciphertext)) {
+			return nil, nil, errMalformedMulti
+		}
+		payload, err := openPayload(cfg.Protocol, keyMsg[:payloadKeySize], ciphertext)
+		if err != nil {
+			return nil, nil, err
+		}
+		return payload, sender, nil
+	}
+
+	return nil, nil, ErrNotRecipient
+}
+
+func sealPayload(protocol *nyquist.Protocol, key, payload []byte) ([]byte, error) {
+	aead, err := protocol.Cipher.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, protocol.Cipher.EncodeNonce(0), payload, nil), nil
+}
+
+func openPayload(protocol *nyquist.Protocol, key, ciphertext []byte) ([]byte, error) {
+	aead, err := protocol.Cipher.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, protocol.Cipher.EncodeNonce(0), ciphertext, nil)
+}
+
+func digest(protocol *nyquist.Protocol, b []byte) []byte {
+	h := protocol.Hash.New()
+	_, _ = h.Write(b)
+	return h.Sum(nil)
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
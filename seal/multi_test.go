@@ -0,0 +1,125 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package seal
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+func TestSealMulti(t *testing.T) {
+	var (
+		recipients    []dh.Keypair
+		recipientPubs []dh.PublicKey
+	)
+	for i := 0; i < 3; i++ {
+		kp, err := dh.X25519.GenerateKeypair(rand.Reader)
+		require.NoError(t, err, "GenerateKeypair - recipient")
+		recipients = append(recipients, kp)
+		recipientPubs = append(recipientPubs, kp.Public())
+	}
+	sender, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(t, err, "GenerateKeypair - sender")
+	other, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(t, err, "GenerateKeypair - other")
+
+	payload := make([]byte, 100000)
+	_, _ = rand.Read(payload)
+
+	for _, v := range []string{
+		"Noise_N_25519_ChaChaPoly_BLAKE2s",
+		"Noise_X_25519_AESGCM_SHA256",
+	} {
+		t.Run(v, func(t *testing.T) {
+			require := require.New(t)
+
+			protocol, err := nyquist.NewProtocol(v)
+			require.NoError(err, "NewProtocol")
+			hasSender := protocol.Pattern.String() != "N"
+
+			sealCfg := &Config{
+				Protocol: protocol,
+			}
+			if hasSender {
+				sealCfg.LocalStatic = sender
+			}
+
+			sealed, err := SealMulti(sealCfg, recipientPubs, payload)
+			require.NoError(err, "SealMulti")
+
+			for i, recipient := range recipients {
+				opened, senderStatic, err := OpenMulti(&Config{
+					Protocol:    protocol,
+					LocalStatic: recipient,
+				}, sealed)
+				require.NoError(err, "OpenMulti(%d)", i)
+				require.Equal(payload, opened, "OpenMulti(%d) - payload", i)
+				if hasSender {
+					require.Equal(sender.Public().Bytes(), senderStatic.Bytes(), "OpenMulti(%d) - sender", i)
+				} else {
+					require.Nil(senderStatic, "OpenMulti(%d) - sender", i)
+				}
+			}
+
+			_, _, err = OpenMulti(&Config{
+				Protocol:    protocol,
+				LocalStatic: other,
+			}, sealed)
+			require.Equal(ErrNotRecipient, err, "OpenMulti - not a recipient")
+
+			tampered := append([]byte{}, sealed...)
+			tampered[len(tampered)-1] ^= 0xa5
+			_, _, err = OpenMulti(&Config{
+				Protocol:    protocol,
+				LocalStatic: recipients[0],
+			}, tampered)
+			require.Equal(errMalformedMulti, err, "OpenMulti - tampered payload")
+
+			_, _, err = OpenMulti(&Config{
+				Protocol:    protocol,
+				LocalStatic: recipients[0],
+			}, sealed[:40])
+			require.Equal(errMalformedMulti, err, "OpenMulti - truncated")
+		})
+	}
+
+	t.Run("NoRecipients", func(t *testing.T) {
+		protocol, err := nyquist.NewProtocol("Noise_N_25519_ChaChaPoly_BLAKE2s")
+		require.NoError(t, err, "NewProtocol")
+
+		_, err = SealMulti(&Config{Protocol: protocol}, nil, payload)
+		require.Equal(t, errNoRecipient, err, "SealMulti - no recipients")
+	})
+}
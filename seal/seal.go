@@ -0,0 +1,137 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package seal implements one-shot message encryption to a recipient's
+// static public key, using a one-way handshake pattern (N, K, X), with
+// the payload carried in the handshake message.
+//
+// This is intended for store-and-forward use cases, where managing a
+// HandshakeState is undesirable.  SealMulti and OpenMulti extend this to
+// multiple recipients, for group messaging.
+package seal // import "gitlab.com/yawning/nyquist.git/seal"
+
+import (
+	"errors"
+	"io"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+var (
+	errNotOneWay   = errors.New("nyquist/seal: protocol pattern is not one-way")
+	errNoRecipient = errors.New("nyquist/seal: no recipient key")
+)
+
+// Config is a seal/open configuration.
+type Config struct {
+	// Protocol is the protocol to use.  The pattern must be one-way.
+	Protocol *nyquist.Protocol
+
+	// Prologue is the optional pre-handshake prologue input to be included
+	// in the handshake hash.
+	Prologue []byte
+
+	// LocalStatic is the local static keypair.  When sealing, this is
+	// the sender's keypair (K, X), when opening, this is the recipient's
+	// keypair.
+	LocalStatic dh.Keypair
+
+	// RemoteStatic is the remote static public key.  When sealing, this
+	// is the recipient's public key, when opening, this is the sender's
+	// public key (K).
+	RemoteStatic dh.PublicKey
+
+	// PreSharedKeys is the vector of pre-shared keys for PSK mode
+	// protocols.
+	PreSharedKeys [][]byte
+
+	// Rng is the entropy source to be used when sealing.  If the value
+	// is `nil`, `crypto/rand.Reader` will be used.
+	Rng io.Reader
+
+	// MaxMessageSize specifies the maximum sealed message size.  See
+	// `nyquist.HandshakeConfig.MaxMessageSize` for details.
+	MaxMessageSize int
+}
+
+func (cfg *Config) newHandshake(isInitiator bool) (*nyquist.HandshakeState, error) {
+	if cfg.Protocol == nil || !cfg.Protocol.Pattern.IsOneWay() {
+		return nil, errNotOneWay
+	}
+
+	return nyquist.NewHandshake(&nyquist.HandshakeConfig{
+		Protocol:       cfg.Protocol,
+		Prologue:       cfg.Prologue,
+		LocalStatic:    cfg.LocalStatic,
+		RemoteStatic:   cfg.RemoteStatic,
+		PreSharedKeys:  cfg.PreSharedKeys,
+		Rng:            cfg.Rng,
+		MaxMessageSize: cfg.MaxMessageSize,
+		IsInitiator:    isInitiator,
+	})
+}
+
+// Seal encrypts and authenticates payload to the recipient, and returns
+// the resulting message.
+func Seal(cfg *Config, payload []byte) ([]byte, error) {
+	if cfg.RemoteStatic == nil {
+		return nil, errNoRecipient
+	}
+
+	hs, err := cfg.newHandshake(true)
+	if err != nil {
+		return nil, err
+	}
+	defer hs.Reset()
+
+	msg, err := hs.WriteMessage(nil, payload)
+	if err != nyquist.ErrDone {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// Open decrypts and authenticates message, and returns the resulting
+// payload, and the sender's static public key if any.
+func Open(cfg *Config, message []byte) ([]byte, dh.PublicKey, error) {
+	hs, err := cfg.newHandshake(false)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer hs.Reset()
+
+	payload, err := hs.ReadMessage(nil, message)
+	if err != nyquist.ErrDone {
+		return nil, nil, err
+	}
+
+	return payload, hs.GetStatus().RemoteStatic, nil
+}
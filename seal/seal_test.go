@@ -0,0 +1,117 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package seal
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+func TestSeal(t *testing.T) {
+	recipient, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(t, err, "GenerateKeypair - recipient")
+	sender, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(t, err, "GenerateKeypair - sender")
+	other, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(t, err, "GenerateKeypair - other")
+
+	payload := []byte("Ab ovo usque ad mala")
+
+	for _, v := range []string{
+		"Noise_N_25519_ChaChaPoly_BLAKE2s",
+		"Noise_K_25519_AESGCM_SHA256",
+		"Noise_X_25519_ChaChaPoly_BLAKE2b",
+	} {
+		t.Run(v, func(t *testing.T) {
+			require := require.New(t)
+
+			protocol, err := nyquist.NewProtocol(v)
+			require.NoError(err, "NewProtocol")
+
+			sealCfg := &Config{
+				Protocol:     protocol,
+				RemoteStatic: recipient.Public(),
+			}
+			openCfg := &Config{
+				Protocol:    protocol,
+				LocalStatic: recipient,
+			}
+			hasSender := protocol.Pattern.String() != "N"
+			if hasSender {
+				sealCfg.LocalStatic = sender
+				if protocol.Pattern.String() == "K" {
+					openCfg.RemoteStatic = sender.Public()
+				}
+			}
+
+			sealed, err := Seal(sealCfg, payload)
+			require.NoError(err, "Seal")
+
+			opened, senderStatic, err := Open(openCfg, sealed)
+			require.NoError(err, "Open")
+			require.Equal(payload, opened, "Open - payload")
+			if hasSender {
+				require.Equal(sender.Public().Bytes(), senderStatic.Bytes(), "Open - sender")
+			} else {
+				require.Nil(senderStatic, "Open - sender")
+			}
+
+			// Wrong recipient.
+			_, _, err = Open(&Config{
+				Protocol:     protocol,
+				LocalStatic:  other,
+				RemoteStatic: openCfg.RemoteStatic,
+			}, sealed)
+			require.Error(err, "Open - wrong recipient")
+
+			// Corrupted message.
+			sealed[len(sealed)-1] ^= 0x01
+			_, _, err = Open(openCfg, sealed)
+			require.True(errors.Is(err, nyquist.ErrOpen), "Open - corrupted")
+		})
+	}
+
+	t.Run("NotOneWay", func(t *testing.T) {
+		protocol, err := nyquist.NewProtocol("Noise_XX_25519_ChaChaPoly_BLAKE2s")
+		require.NoError(t, err, "NewProtocol")
+
+		_, err = Seal(&Config{
+			Protocol:     protocol,
+			RemoteStatic: recipient.Public(),
+		}, payload)
+		require.Equal(t, errNotOneWay, err, "Seal")
+	})
+}
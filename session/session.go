@@ -0,0 +1,284 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package session implements a manager for live transport sessions, keyed
+// by the peer's static public key.
+//
+// The manager deduplicates concurrent handshakes with the same peer, so
+// that at most one outgoing handshake per peer is in progress at any
+// given time.
+package session // import "gitlab.com/yawning/nyquist.git/session"
+
+import (
+	"errors"
+	"sync"
+
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+var (
+	// ErrClosed is the error returned when the Manager is closed.
+	ErrClosed = errors.New("nyquist/session: manager closed")
+
+	// ErrHandshakePanicked is the error returned to concurrent callers of
+	// GetOrDial when the shared HandshakeFunc panics.
+	ErrHandshakePanicked = errors.New("nyquist/session: handshake panicked")
+)
+
+// Session is a live transport session.
+type Session interface {
+	// Close closes the session.
+	Close() error
+}
+
+// HandshakeFunc establishes a new session with a peer.
+type HandshakeFunc func() (Session, error)
+
+type entry struct {
+	peer    dh.PublicKey
+	session Session
+}
+
+type pendingCall struct {
+	done    chan struct{}
+	session Session
+	err     error
+}
+
+// Manager tracks live sessions by peer static public key.
+type Manager struct {
+	mu sync.Mutex
+
+	sessions map[string]*entry
+	pending  map[string]*pendingCall
+
+	// OnEvict, if set, is called (without the lock held) when a session
+	// is removed from the Manager, prior to it being closed.
+	OnEvict func(dh.PublicKey, Session)
+
+	closed bool
+}
+
+func peerKey(peer dh.PublicKey) string {
+	return string(peer.Bytes())
+}
+
+// Get returns the live session for the peer, if any.
+func (m *Manager) Get(peer dh.PublicKey) (Session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.sessions[peerKey(peer)]
+	if !ok {
+		return nil, false
+	}
+	return e.session, true
+}
+
+// GetOrDial returns the live session for the peer if one exists, otherwise
+// it establishes a new session with fn.  Concurrent calls for the same
+// peer will share the result of a single call to fn.  Errors are not
+// cached.
+//
+// If a session for the peer is added (eg: via an incoming handshake)
+// while fn is in progress, the existing session is kept, and the newly
+// established session is closed.
+func (m *Manager) GetOrDial(peer dh.PublicKey, fn HandshakeFunc) (Session, error) {
+	k := peerKey(peer)
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if e, ok := m.sessions[k]; ok {
+		m.mu.Unlock()
+		return e.session, nil
+	}
+	if call, ok := m.pending[k]; ok {
+		m.mu.Unlock()
+		<-call.done
+		return call.session, call.err
+	}
+	call := &pendingCall{
+		done: make(chan struct{}),
+		err:  ErrHandshakePanicked,
+	}
+	m.pending[k] = call
+	m.mu.Unlock()
+
+	// Release the waiters even if fn panics, in which case they will see
+	// ErrHandshakePanicked.
+	defer func() {
+		m.mu.Lock()
+		if m.pending[k] == call {
+			delete(m.pending, k)
+		}
+		m.mu.Unlock()
+		close(call.done)
+	}()
+
+	call.session, call.err = fn()
+
+	var stale Session
+	m.mu.Lock()
+	delete(m.pending, k)
+	if call.err == nil {
+		e, ok := m.sessions[k]
+		switch {
+		case m.closed:
+			stale, call.session, call.err = call.session, nil, ErrClosed
+		case ok:
+			stale, call.session = call.session, e.session
+		default:
+			m.sessions[k] = &entry{
+				peer:    peer,
+				session: call.session,
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	if stale != nil {
+		stale.Close()
+	}
+
+	return call.session, call.err
+}
+
+// Add adds a session established with the peer (eg: via an incoming
+// handshake), replacing and evicting the existing session if any.
+func (m *Manager) Add(peer dh.PublicKey, s Session) error {
+	k := peerKey(peer)
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrClosed
+	}
+	old := m.sessions[k]
+	m.sessions[k] = &entry{
+		peer:    peer,
+		session: s,
+	}
+	m.mu.Unlock()
+
+	if old != nil && old.session != s {
+		m.evict(old)
+	}
+
+	return nil
+}
+
+// Delete removes the session from the Manager, iff it is the current
+// session for the peer, without closing it.  This is intended to be
+// called when a session is closed or fails.
+func (m *Manager) Delete(peer dh.PublicKey, s Session) bool {
+	k := peerKey(peer)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.sessions[k]; ok && e.session == s {
+		delete(m.sessions, k)
+		return true
+	}
+	return false
+}
+
+// Evict removes and closes the live session for the peer, if any.
+func (m *Manager) Evict(peer dh.PublicKey) bool {
+	k := peerKey(peer)
+
+	m.mu.Lock()
+	e, ok := m.sessions[k]
+	delete(m.sessions, k)
+	m.mu.Unlock()
+
+	if ok {
+		m.evict(e)
+	}
+	return ok
+}
+
+// Range calls fn for each live session, until fn returns false.  The
+// Manager must not be modified from within fn.
+func (m *Manager) Range(fn func(dh.PublicKey, Session) bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, e := range m.sessions {
+		if !fn(e.peer, e.session) {
+			return
+		}
+	}
+}
+
+// Len returns the number of live sessions.
+func (m *Manager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.sessions)
+}
+
+// Close evicts all live sessions, and prevents new sessions from being
+// added.
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrClosed
+	}
+	m.closed = true
+	sessions := m.sessions
+	m.sessions = make(map[string]*entry)
+	m.mu.Unlock()
+
+	for _, e := range sessions {
+		m.evict(e)
+	}
+
+	return nil
+}
+
+func (m *Manager) evict(e *entry) {
+	if m.OnEvict != nil {
+		m.OnEvict(e.peer, e.session)
+	}
+	e.session.Close()
+}
+
+// NewManager constructs a new Manager.
+func NewManager() *Manager {
+	return &Manager{
+		sessions: make(map[string]*entry),
+		pending:  make(map[string]*pendingCall),
+	}
+}
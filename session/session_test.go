@@ -0,0 +1,237 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package session
+
+import (
+	"crypto/rand"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+type testSession struct {
+	closed int32
+}
+
+func (s *testSession) Close() error {
+	atomic.AddInt32(&s.closed, 1)
+	return nil
+}
+
+func (s *testSession) isClosed() bool {
+	return atomic.LoadInt32(&s.closed) != 0
+}
+
+func mustGenerateKey(t *testing.T) dh.PublicKey {
+	kp, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(t, err, "GenerateKeypair")
+	return kp.Public()
+}
+
+func TestManager(t *testing.T) {
+	t.Run("Dedup", func(t *testing.T) {
+		require := require.New(t)
+
+		m := NewManager()
+		peer := mustGenerateKey(t)
+
+		var (
+			calls   int32
+			release = make(chan struct{})
+			wg      sync.WaitGroup
+		)
+		fn := func() (Session, error) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return &testSession{}, nil
+		}
+
+		const n = 16
+		results := make([]Session, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				s, err := m.GetOrDial(peer, fn)
+				require.NoError(err, "GetOrDial")
+				results[i] = s
+			}(i)
+		}
+		close(release)
+		wg.Wait()
+
+		require.EqualValues(1, atomic.LoadInt32(&calls), "handshake calls")
+		for _, s := range results {
+			require.Equal(results[0], s, "shared session")
+		}
+
+		s, ok := m.Get(peer)
+		require.True(ok, "Get")
+		require.Equal(results[0], s, "Get - session")
+		require.Equal(1, m.Len(), "Len")
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		require := require.New(t)
+
+		m := NewManager()
+		peer := mustGenerateKey(t)
+		errTest := errors.New("test handshake failure")
+
+		_, err := m.GetOrDial(peer, func() (Session, error) {
+			return nil, errTest
+		})
+		require.Equal(errTest, err, "GetOrDial - failure")
+		_, ok := m.Get(peer)
+		require.False(ok, "Get - after failure")
+
+		s, err := m.GetOrDial(peer, func() (Session, error) {
+			return &testSession{}, nil
+		})
+		require.NoError(err, "GetOrDial - retry")
+		require.NotNil(s, "GetOrDial - retry")
+	})
+
+	t.Run("AddDuringDial", func(t *testing.T) {
+		require := require.New(t)
+
+		m := NewManager()
+		peer := mustGenerateKey(t)
+
+		incoming, dialed := &testSession{}, &testSession{}
+		s, err := m.GetOrDial(peer, func() (Session, error) {
+			require.NoError(m.Add(peer, incoming), "Add - during dial")
+			return dialed, nil
+		})
+		require.NoError(err, "GetOrDial")
+		require.Equal(incoming, s, "GetOrDial - existing session kept")
+		require.True(dialed.isClosed(), "dialed session closed")
+		require.False(incoming.isClosed(), "incoming session open")
+
+		s, ok := m.Get(peer)
+		require.True(ok, "Get")
+		require.Equal(incoming, s, "Get - session")
+	})
+
+	t.Run("Panic", func(t *testing.T) {
+		require := require.New(t)
+
+		m := NewManager()
+		peer := mustGenerateKey(t)
+
+		waitErr := make(chan error, 1)
+		require.Panics(func() {
+			_, _ = m.GetOrDial(peer, func() (Session, error) {
+				go func() {
+					_, err := m.GetOrDial(peer, func() (Session, error) {
+						return &testSession{}, nil
+					})
+					waitErr <- err
+				}()
+				panic("test handshake panic")
+			})
+		}, "GetOrDial - panic")
+
+		// The concurrent caller must not block forever, and depending on
+		// timing either shares the failure or dials a new session.
+		if err := <-waitErr; err != nil {
+			require.Equal(ErrHandshakePanicked, err, "GetOrDial - concurrent")
+		}
+
+		s, err := m.GetOrDial(peer, func() (Session, error) {
+			return &testSession{}, nil
+		})
+		require.NoError(err, "GetOrDial - after panic")
+		require.NotNil(s, "GetOrDial - after panic")
+	})
+
+	t.Run("Eviction", func(t *testing.T) {
+		require := require.New(t)
+
+		var evicted []Session
+		m := NewManager()
+		m.OnEvict = func(_ dh.PublicKey, s Session) {
+			evicted = append(evicted, s)
+		}
+		peer := mustGenerateKey(t)
+
+		s1, s2 := &testSession{}, &testSession{}
+		require.NoError(m.Add(peer, s1), "Add - s1")
+		require.NoError(m.Add(peer, s2), "Add - s2")
+		require.True(s1.isClosed(), "s1 closed on replace")
+		require.False(s2.isClosed(), "s2 open")
+		require.Equal([]Session{s1}, evicted, "OnEvict - replace")
+
+		require.False(m.Delete(peer, s1), "Delete - stale")
+		require.True(m.Evict(peer), "Evict")
+		require.True(s2.isClosed(), "s2 closed on evict")
+		require.False(m.Evict(peer), "Evict - missing")
+		require.Equal(0, m.Len(), "Len")
+
+		s3 := &testSession{}
+		require.NoError(m.Add(peer, s3), "Add - s3")
+		require.True(m.Delete(peer, s3), "Delete")
+		require.False(s3.isClosed(), "s3 not closed on delete")
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		require := require.New(t)
+
+		m := NewManager()
+		sessions := make([]*testSession, 4)
+		for i := range sessions {
+			sessions[i] = &testSession{}
+			require.NoError(m.Add(mustGenerateKey(t), sessions[i]), "Add")
+		}
+
+		var n int
+		m.Range(func(dh.PublicKey, Session) bool {
+			n++
+			return true
+		})
+		require.Equal(len(sessions), n, "Range")
+
+		require.NoError(m.Close(), "Close")
+		for _, s := range sessions {
+			require.True(s.isClosed(), "session closed")
+		}
+		require.Equal(ErrClosed, m.Close(), "Close - again")
+		require.Equal(ErrClosed, m.Add(mustGenerateKey(t), &testSession{}), "Add - closed")
+		_, err := m.GetOrDial(mustGenerateKey(t), func() (Session, error) {
+			return &testSession{}, nil
+		})
+		require.Equal(ErrClosed, err, "GetOrDial - closed")
+	})
+}
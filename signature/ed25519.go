@@ -0,0 +1,174 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package signature
+
+import (
+	"io"
+
+	"github.com/oasisprotocol/curve25519-voi/primitives/ed25519"
+)
+
+// Ed25519 is the Ed25519 (RFC 8032) signature scheme.
+var Ed25519 Scheme = &schemeEd25519{}
+
+type schemeEd25519 struct{}
+
+func (sc *schemeEd25519) String() string {
+	return "Ed25519"
+}
+
+func (sc *schemeEd25519) GenerateKey(rng io.Reader) (PrivateKey, error) {
+	var seed [ed25519.SeedSize]byte
+	if _, err := io.ReadFull(rng, seed[:]); err != nil {
+		return nil, err
+	}
+	defer func() {
+		for i := range seed {
+			seed[i] = 0
+		}
+	}()
+
+	var sk PrivateKeyEd25519
+	if err := sk.UnmarshalBinary(seed[:]); err != nil {
+		return nil, err
+	}
+
+	return &sk, nil
+}
+
+func (sc *schemeEd25519) ParsePrivateKey(data []byte) (PrivateKey, error) {
+	var sk PrivateKeyEd25519
+	if err := sk.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+
+	return &sk, nil
+}
+
+func (sc *schemeEd25519) ParsePublicKey(data []byte) (PublicKey, error) {
+	var pk PublicKeyEd25519
+	if err := pk.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+
+	return &pk, nil
+}
+
+func (sc *schemeEd25519) PublicKeySize() int {
+	return ed25519.PublicKeySize
+}
+
+func (sc *schemeEd25519) SignatureSize() int {
+	return ed25519.SignatureSize
+}
+
+// PrivateKeyEd25519 is an Ed25519 private key.
+type PrivateKeyEd25519 struct {
+	privateKey ed25519.PrivateKey
+	publicKey  PublicKeyEd25519
+}
+
+// MarshalBinary marshals the private key's seed to binary form.
+func (sk *PrivateKeyEd25519) MarshalBinary() ([]byte, error) {
+	if sk.privateKey == nil {
+		return nil, ErrMalformedPrivateKey
+	}
+	return sk.privateKey.Seed(), nil
+}
+
+// UnmarshalBinary unmarshals the private key from the binary form of its
+// seed, and re-derives the corresponding public key.
+func (sk *PrivateKeyEd25519) UnmarshalBinary(data []byte) error {
+	if len(data) != ed25519.SeedSize {
+		return ErrMalformedPrivateKey
+	}
+
+	sk.privateKey = ed25519.NewKeyFromSeed(data)
+	copy(sk.publicKey.rawPublicKey[:], sk.privateKey[ed25519.SeedSize:])
+
+	return nil
+}
+
+// DropPrivate discards the private key.
+func (sk *PrivateKeyEd25519) DropPrivate() {
+	for i := range sk.privateKey {
+		sk.privateKey[i] = 0
+	}
+	sk.privateKey = nil
+}
+
+// Public returns the public key corresponding to the private key.
+func (sk *PrivateKeyEd25519) Public() PublicKey {
+	return &sk.publicKey
+}
+
+// Sign signs the message.  Ed25519 is deterministic, so the entropy source
+// is unused.
+func (sk *PrivateKeyEd25519) Sign(rng io.Reader, message []byte) ([]byte, error) {
+	if sk.privateKey == nil {
+		return nil, ErrMalformedPrivateKey
+	}
+	return ed25519.Sign(sk.privateKey, message), nil
+}
+
+// PublicKeyEd25519 is an Ed25519 public key.
+type PublicKeyEd25519 struct {
+	rawPublicKey [ed25519.PublicKeySize]byte
+}
+
+// MarshalBinary marshals the public key to binary form.
+func (pk *PublicKeyEd25519) MarshalBinary() ([]byte, error) {
+	out := make([]byte, 0, len(pk.rawPublicKey))
+	return append(out, pk.rawPublicKey[:]...), nil
+}
+
+// UnmarshalBinary unmarshals the public key from binary form.
+func (pk *PublicKeyEd25519) UnmarshalBinary(data []byte) error {
+	if len(data) != ed25519.PublicKeySize {
+		return ErrMalformedPublicKey
+	}
+
+	copy(pk.rawPublicKey[:], data)
+
+	return nil
+}
+
+// Bytes returns the binary serialized public key.
+//
+// Warning: Altering the returned slice is unsupported and will lead to
+// unexpected behavior.
+func (pk *PublicKeyEd25519) Bytes() []byte {
+	return pk.rawPublicKey[:]
+}
+
+// Verify returns true iff the signature is valid for the message.
+func (pk *PublicKeyEd25519) Verify(message, signature []byte) bool {
+	return ed25519.Verify(pk.rawPublicKey[:], message, signature)
+}
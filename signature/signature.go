@@ -0,0 +1,121 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package signature implements the signature scheme abstract interface
+// used by the Noise Signatures extension, and standard signature schemes.
+//
+// New schemes (eg: Ed448, ECDSA-P256, ML-DSA) are supported by
+// implementing the interfaces, and calling `Register`.  As handshake
+// messages are parsed by length, all public keys and signatures for a
+// given scheme must be fixed size.
+package signature // import "gitlab.com/yawning/nyquist.git/signature"
+
+import (
+	"encoding"
+	"errors"
+	"io"
+)
+
+var (
+	// ErrMalformedPrivateKey is the error returned when a serialized
+	// private key is malformed.
+	ErrMalformedPrivateKey = errors.New("nyquist/signature: malformed private key")
+
+	// ErrMalformedPublicKey is the error returned when a serialized public
+	// key is malformed.
+	ErrMalformedPublicKey = errors.New("nyquist/signature: malformed public key")
+
+	supportedSchemes = map[string]Scheme{
+		"Ed25519": Ed25519,
+	}
+)
+
+// Scheme is a signature scheme.
+type Scheme interface {
+	// String returns the string representation of the signature scheme
+	// name, as used in protocol names.
+	String() string
+
+	// GenerateKey generates a new private key using the provided entropy
+	// source.
+	GenerateKey(rng io.Reader) (PrivateKey, error)
+
+	// ParsePrivateKey parses a binary encoded private key.
+	ParsePrivateKey(data []byte) (PrivateKey, error)
+
+	// ParsePublicKey parses a binary encoded public key.
+	ParsePublicKey(data []byte) (PublicKey, error)
+
+	// PublicKeySize returns the size of public keys in bytes.
+	PublicKeySize() int
+
+	// SignatureSize returns the size of signatures in bytes.
+	SignatureSize() int
+}
+
+// FromString returns a Scheme by algorithm name, or nil.
+func FromString(s string) Scheme {
+	return supportedSchemes[s]
+}
+
+// PrivateKey is a signing private key.
+type PrivateKey interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+
+	// DropPrivate discards the private key.
+	DropPrivate()
+
+	// Public returns the public key corresponding to the private key.
+	Public() PublicKey
+
+	// Sign signs the message.  The entropy source is only used by
+	// randomized schemes.
+	Sign(rng io.Reader, message []byte) ([]byte, error)
+}
+
+// PublicKey is a signature verification public key.
+type PublicKey interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+
+	// Bytes returns the binary serialized public key.
+	//
+	// Warning: Altering the returned slice is unsupported and will lead
+	// to unexpected behavior.
+	Bytes() []byte
+
+	// Verify returns true iff the signature is valid for the message.
+	Verify(message, signature []byte) bool
+}
+
+// Register registers a new signature scheme for use with `FromString()`.
+func Register(scheme Scheme) {
+	supportedSchemes[scheme.String()] = scheme
+}
@@ -0,0 +1,100 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package signature
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignature(t *testing.T) {
+	for _, scheme := range supportedSchemes {
+		t.Run(scheme.String(), func(t *testing.T) {
+			require := require.New(t)
+
+			require.Equal(scheme, FromString(scheme.String()), "FromString")
+
+			sk, err := scheme.GenerateKey(rand.Reader)
+			require.NoError(err, "GenerateKey")
+			pk := sk.Public()
+			require.Len(pk.Bytes(), scheme.PublicKeySize(), "PublicKeySize")
+
+			msg := []byte("handshake hash")
+			sig, err := sk.Sign(rand.Reader, msg)
+			require.NoError(err, "Sign")
+			require.Len(sig, scheme.SignatureSize(), "SignatureSize")
+			require.True(pk.Verify(msg, sig), "Verify")
+			require.False(pk.Verify([]byte("other message"), sig), "Verify - wrong message")
+
+			sig[0] ^= 1
+			require.False(pk.Verify(msg, sig), "Verify - tampered signature")
+			sig[0] ^= 1
+
+			raw, err := sk.MarshalBinary()
+			require.NoError(err, "MarshalBinary(private)")
+			sk2, err := scheme.ParsePrivateKey(raw)
+			require.NoError(err, "ParsePrivateKey")
+			require.Equal(pk.Bytes(), sk2.Public().Bytes(), "ParsePrivateKey - public key")
+
+			pk2, err := scheme.ParsePublicKey(pk.Bytes())
+			require.NoError(err, "ParsePublicKey")
+			require.True(pk2.Verify(msg, sig), "Verify - parsed public key")
+
+			_, err = scheme.ParsePrivateKey(raw[1:])
+			require.Equal(ErrMalformedPrivateKey, err, "ParsePrivateKey - truncated")
+			_, err = scheme.ParsePublicKey(pk.Bytes()[1:])
+			require.Equal(ErrMalformedPublicKey, err, "ParsePublicKey - truncated")
+
+			sk.DropPrivate()
+			_, err = sk.Sign(rand.Reader, msg)
+			require.Equal(ErrMalformedPrivateKey, err, "Sign - dropped private key")
+		})
+	}
+}
+
+func TestEd25519(t *testing.T) {
+	require := require.New(t)
+
+	// RFC 8032 Section 7.1, TEST 1.
+	seed, _ := hex.DecodeString("9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60")
+	expectedPub, _ := hex.DecodeString("d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a")
+	expectedSig, _ := hex.DecodeString("e5564300c360ac729086e2cc806e828a84877f1eb8e5d974d873e065224901555fb8821590a33bacc61e39701cf9b46bd25bf5f0595bbe24655141438e7a100b")
+
+	sk, err := Ed25519.ParsePrivateKey(seed)
+	require.NoError(err, "ParsePrivateKey")
+	require.Equal(expectedPub, sk.Public().Bytes(), "Public")
+
+	sig, err := sk.Sign(nil, nil)
+	require.NoError(err, "Sign")
+	require.Equal(expectedSig, sig, "Sign")
+}
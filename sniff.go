@@ -0,0 +1,154 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package nyquist
+
+import (
+	"errors"
+	"sort"
+
+	"gitlab.com/yawning/nyquist.git/pattern"
+)
+
+// ErrNoMatch is the error returned when no candidate handshake configuration
+// was able to process the initiator's first message.
+var ErrNoMatch = errors.New("nyquist: no handshake configuration matched")
+
+// Sniffer is a responder that accepts any of several handshake
+// configurations, selecting the one to use by trial-processing the
+// initiator's first message against each.
+//
+// Candidates whose first message is authenticated (contains a DH or `psk`
+// token) are tried first, in increasing order of the number of DH
+// operations required, followed by the remaining candidates.  Note that a
+// candidate whose first message is unauthenticated (eg: NN, XX) will
+// accept any sufficiently long message.
+type Sniffer struct {
+	// Configs are the candidate handshake configurations.  All must be
+	// responder configurations.
+	Configs []*HandshakeConfig
+
+	// Exhaustive, if set, will trial-process the first message against
+	// all candidates, even after one succeeds, so that the time taken does
+	// not reveal which candidate matched.
+	Exhaustive bool
+}
+
+// ReadMessage creates a handshake for each candidate configuration, and
+// processes the initiator's first message, returning the handshake of the
+// first candidate to succeed, the candidate's index in Configs, and the
+// message payload appended to dst.
+//
+// As with HandshakeState.ReadMessage, ErrDone is returned if the returned
+// handshake is complete (one-way patterns).
+func (sn *Sniffer) ReadMessage(dst, msg []byte) (*HandshakeState, int, []byte, error) {
+	for _, cfg := range sn.Configs {
+		if cfg.IsInitiator {
+			return nil, -1, nil, ErrInvalidConfig
+		}
+	}
+
+	var (
+		winner        *HandshakeState
+		winnerIdx     = -1
+		winnerPayload []byte
+		winnerErr     error
+	)
+	for _, idx := range sn.trialOrder() {
+		hs, err := NewHandshake(sn.Configs[idx])
+		if err != nil {
+			if winner != nil {
+				winner.Reset()
+				zero(winnerPayload)
+			}
+			return nil, -1, nil, err
+		}
+
+		payload, err := hs.ReadMessage(nil, msg)
+		if (err == nil || err == ErrDone) && winner == nil {
+			winner, winnerIdx, winnerPayload, winnerErr = hs, idx, payload, err
+			if !sn.Exhaustive {
+				break
+			}
+			continue
+		}
+		hs.Reset()
+	}
+
+	if winner == nil {
+		return nil, -1, nil, ErrNoMatch
+	}
+
+	dst = append(dst, winnerPayload...)
+	zero(winnerPayload)
+
+	return winner, winnerIdx, dst, winnerErr
+}
+
+func (sn *Sniffer) trialOrder() []int {
+	type candidate struct {
+		idx             int
+		unauthenticated bool
+		cost            int
+	}
+
+	candidates := make([]candidate, 0, len(sn.Configs))
+	for i, cfg := range sn.Configs {
+		c := candidate{
+			idx:             i,
+			unauthenticated: true,
+		}
+		if msgs := cfg.Protocol.Pattern.Messages(); len(msgs) > 0 {
+			for _, v := range msgs[0] {
+				switch v {
+				case pattern.Token_ee, pattern.Token_es, pattern.Token_se, pattern.Token_ss:
+					c.cost++
+					c.unauthenticated = false
+				case pattern.Token_psk:
+					c.unauthenticated = false
+				}
+			}
+		}
+		candidates = append(candidates, c)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.unauthenticated != b.unauthenticated {
+			return !a.unauthenticated
+		}
+		return a.cost < b.cost
+	})
+
+	order := make([]int, 0, len(candidates))
+	for _, v := range candidates {
+		order = append(order, v.idx)
+	}
+	return order
+}
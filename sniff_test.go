@@ -0,0 +1,137 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package nyquist
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+func TestSniffer(t *testing.T) {
+	require := require.New(t)
+
+	mustProtocol := func(s string) *Protocol {
+		protocol, err := NewProtocol(s)
+		require.NoError(err, "NewProtocol(%s)", s)
+		return protocol
+	}
+	protoIK := mustProtocol("Noise_IK_25519_ChaChaPoly_BLAKE2s")
+	protoNpsk0 := mustProtocol("Noise_Npsk0_25519_ChaChaPoly_BLAKE2s")
+	protoNN := mustProtocol("Noise_NN_25519_ChaChaPoly_BLAKE2s")
+
+	responderStatic, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(err, "GenerateKeypair - responder")
+	initiatorStatic, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(err, "GenerateKeypair - initiator")
+	psk := make([]byte, PreSharedKeySize)
+	_, _ = rand.Read(psk)
+
+	responderConfigs := []*HandshakeConfig{
+		{Protocol: protoNN},
+		{Protocol: protoNpsk0, LocalStatic: responderStatic, PreSharedKeys: [][]byte{psk}},
+		{Protocol: protoIK, LocalStatic: responderStatic},
+	}
+
+	initiate := func(cfg *HandshakeConfig) (*HandshakeState, []byte) {
+		cfg.IsInitiator = true
+		hs, err := NewHandshake(cfg)
+		require.NoError(err, "NewHandshake - initiator")
+		msg, err := hs.WriteMessage(nil, []byte("sniff me"))
+		require.True(err == nil || err == ErrDone, "WriteMessage: %v", err)
+		return hs, msg
+	}
+
+	for _, exhaustive := range []bool{false, true} {
+		sn := &Sniffer{
+			Configs:    responderConfigs,
+			Exhaustive: exhaustive,
+		}
+
+		// IK
+		initiator, msg := initiate(&HandshakeConfig{
+			Protocol:     protoIK,
+			LocalStatic:  initiatorStatic,
+			RemoteStatic: responderStatic.Public(),
+		})
+		responder, idx, payload, err := sn.ReadMessage(nil, msg)
+		require.NoError(err, "ReadMessage - IK")
+		require.Equal(2, idx, "ReadMessage - IK index")
+		require.Equal([]byte("sniff me"), payload, "ReadMessage - IK payload")
+
+		msg, err = responder.WriteMessage(nil, nil)
+		require.Equal(ErrDone, err, "WriteMessage - IK responder")
+		_, err = initiator.ReadMessage(nil, msg)
+		require.Equal(ErrDone, err, "ReadMessage - IK initiator")
+		require.Equal(initiator.GetStatus().HandshakeHash, responder.GetStatus().HandshakeHash, "IK HandshakeHash")
+		require.Equal(initiatorStatic.Public().Bytes(), responder.GetStatus().RemoteStatic.Bytes(), "IK RemoteStatic")
+
+		// Npsk0 (one-way)
+		_, msg = initiate(&HandshakeConfig{
+			Protocol:      protoNpsk0,
+			RemoteStatic:  responderStatic.Public(),
+			PreSharedKeys: [][]byte{psk},
+		})
+		_, idx, payload, err = sn.ReadMessage(nil, msg)
+		require.Equal(ErrDone, err, "ReadMessage - Npsk0")
+		require.Equal(1, idx, "ReadMessage - Npsk0 index")
+		require.Equal([]byte("sniff me"), payload, "ReadMessage - Npsk0 payload")
+
+		// NN (unauthenticated, tried last)
+		_, msg = initiate(&HandshakeConfig{
+			Protocol: protoNN,
+		})
+		_, idx, _, err = sn.ReadMessage(nil, msg)
+		require.NoError(err, "ReadMessage - NN")
+		require.Equal(0, idx, "ReadMessage - NN index")
+	}
+
+	// No match.
+	sn := &Sniffer{
+		Configs: responderConfigs[1:],
+	}
+	_, msg := initiate(&HandshakeConfig{
+		Protocol:     protoIK,
+		LocalStatic:  initiatorStatic,
+		RemoteStatic: initiatorStatic.Public(), // Wrong responder key.
+	})
+	_, _, _, err = sn.ReadMessage(nil, msg)
+	require.Equal(ErrNoMatch, err, "ReadMessage - no match")
+
+	// Initiator configs are invalid.
+	sn = &Sniffer{
+		Configs: []*HandshakeConfig{{Protocol: protoNN, IsInitiator: true}},
+	}
+	_, _, _, err = sn.ReadMessage(nil, msg)
+	require.Equal(ErrInvalidConfig, err, "ReadMessage - initiator config")
+}
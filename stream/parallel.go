@@ -0,0 +1,448 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package stream
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+
+	"gitlab.com/yawning/nyquist.git"
+)
+
+// DefaultSegmentSize is the default amount of plaintext in each
+// independently keyed segment in the parallel segmented mode.
+const DefaultSegmentSize = 32 * DefaultChunkSize
+
+var (
+	errInvalidSegmentSize = errors.New("nyquist/stream: invalid segment size")
+	errInvalidKey         = errors.New("nyquist/stream: invalid segment master key")
+
+	segmentLabel = []byte("nyquist/stream: segment")
+)
+
+// ParallelConfig is the configuration for the parallel segmented mode.
+//
+// In this mode, the stream is split into segments of SegmentSize bytes of
+// plaintext, each of which is encrypted with a distinct key derived from
+// the master key and the segment index.  Each segment is a sequence of
+// chunks in the same format as the sequential mode, with the chunk index
+// within the segment used as the nonce.  As the segments are independent,
+// they are encrypted and decrypted across multiple goroutines.
+type ParallelConfig struct {
+	// Protocol is the protocol that supplies the cipher and hash
+	// functions.
+	Protocol *nyquist.Protocol
+
+	// Key is the master key, from which the segment keys are derived, for
+	// example with `nyquist.DeriveASK`.  It must be at least 32 bytes.
+	Key []byte
+
+	// ChunkSize is the maximum size of each plaintext chunk.  If the value
+	// is `0`, `DefaultChunkSize` will be used.
+	ChunkSize int
+
+	// SegmentSize is the size of each segment's plaintext, and must be a
+	// multiple of ChunkSize.  If the value is `0`, `DefaultSegmentSize`
+	// will be used.
+	SegmentSize int
+
+	// Parallelism is the maximum number of segments processed at once.  If
+	// the value is `0`, `runtime.GOMAXPROCS(0)` will be used.
+	Parallelism int
+}
+
+type segmenter struct {
+	protocol    *nyquist.Protocol
+	key         []byte
+	chunkSize   int
+	segmentSize int
+	parallelism int
+
+	nextSegment uint64
+}
+
+func (s *segmenter) init(cfg *ParallelConfig) error {
+	if len(cfg.Key) < nyquist.SymmetricKeySize {
+		return errInvalidKey
+	}
+
+	s.protocol = cfg.Protocol
+	s.key = append([]byte{}, cfg.Key...)
+	s.chunkSize, s.segmentSize, s.parallelism = cfg.ChunkSize, cfg.SegmentSize, cfg.Parallelism
+	if s.chunkSize == 0 {
+		s.chunkSize = DefaultChunkSize
+	}
+	if s.segmentSize == 0 {
+		s.segmentSize = DefaultSegmentSize
+	}
+	if s.parallelism <= 0 {
+		s.parallelism = runtime.GOMAXPROCS(0)
+	}
+	if s.chunkSize < 0 || s.chunkSize > 0xffff {
+		return errInvalidChunkSize
+	}
+	if s.segmentSize < s.chunkSize || s.segmentSize%s.chunkSize != 0 {
+		return errInvalidSegmentSize
+	}
+
+	return nil
+}
+
+func (s *segmenter) segmentAEAD(idx uint64) (cipher.AEAD, error) {
+	var rawIdx [8]byte
+	binary.BigEndian.PutUint64(rawIdx[:], idx)
+	label := append(append([]byte{}, segmentLabel...), rawIdx[:]...)
+
+	k := nyquist.DeriveASK(s.protocol.Hash, s.key, label)
+	defer zero(k)
+
+	return s.protocol.Cipher.New(k[:nyquist.SymmetricKeySize])
+}
+
+// run invokes fn for each of n segments, concurrently.
+func (s *segmenter) run(n int, fn func(i int) error) error {
+	errs := make([]error, n)
+
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = fn(i)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	s.nextSegment += uint64(n)
+
+	return nil
+}
+
+func (s *segmenter) reset() {
+	zero(s.key)
+}
+
+// ParallelWriter is an encrypting io.WriteCloser using the parallel
+// segmented mode.
+type ParallelWriter struct {
+	segmenter
+
+	w   io.Writer
+	buf []byte
+	err error
+}
+
+// Write encrypts and writes p.
+func (w *ParallelWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	var n int
+	for len(p) > 0 {
+		// Only flush a full batch of segments once it is known that it
+		// does not contain the final one.
+		if len(w.buf) == cap(w.buf) {
+			if w.err = w.flush(false); w.err != nil {
+				return n, w.err
+			}
+		}
+		toCopy := cap(w.buf) - len(w.buf)
+		if toCopy > len(p) {
+			toCopy = len(p)
+		}
+		w.buf = append(w.buf, p[:toCopy]...)
+		p = p[toCopy:]
+		n += toCopy
+	}
+
+	return n, nil
+}
+
+// Close writes the final segment, and sanitizes the master key.  It does
+// not close the underlying writer.
+func (w *ParallelWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.flush(true)
+	w.reset()
+	zero(w.buf[:cap(w.buf)])
+	if w.err != nil {
+		return w.err
+	}
+	w.err = errClosed
+	return nil
+}
+
+func (w *ParallelWriter) flush(isFinal bool) error {
+	n := (len(w.buf) + w.segmentSize - 1) / w.segmentSize
+	if n == 0 {
+		// Empty stream, the final segment consists of an empty chunk.
+		n = 1
+	}
+
+	out := make([][]byte, n)
+	err := w.run(n, func(i int) error {
+		start := i * w.segmentSize
+		end := start + w.segmentSize
+		if end > len(w.buf) {
+			end = len(w.buf)
+		}
+
+		var err error
+		out[i], err = w.sealSegment(w.nextSegment+uint64(i), w.buf[start:end], isFinal && i == n-1)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, b := range out {
+		if _, err = w.w.Write(b); err != nil {
+			return err
+		}
+	}
+	w.buf = w.buf[:0]
+
+	return nil
+}
+
+func (w *ParallelWriter) sealSegment(idx uint64, plaintext []byte, isFinal bool) ([]byte, error) {
+	aead, err := w.segmentAEAD(idx)
+	if err != nil {
+		return nil, err
+	}
+
+	numChunks := (len(plaintext) + w.chunkSize - 1) / w.chunkSize
+	if numChunks == 0 {
+		numChunks = 1
+	}
+	out := make([]byte, 0, len(plaintext)+numChunks*(2+aead.Overhead()))
+	for j := 0; j < numChunks; j++ {
+		start := j * w.chunkSize
+		end := start + w.chunkSize
+		if end > len(plaintext) {
+			end = len(plaintext)
+		}
+
+		ad := adChunk
+		if isFinal && j == numChunks-1 {
+			ad = adFinal
+		}
+
+		hdrOff := len(out)
+		out = append(out, 0, 0)
+		out = aead.Seal(out, w.protocol.Cipher.EncodeNonce(uint64(j)), plaintext[start:end], ad)
+		binary.BigEndian.PutUint16(out[hdrOff:], uint16(len(out)-hdrOff-2))
+	}
+
+	return out, nil
+}
+
+// NewParallelWriter returns a ParallelWriter that will encrypt data to w.
+// The caller must call Close to finalize the encrypted stream.
+func NewParallelWriter(w io.Writer, cfg *ParallelConfig) (*ParallelWriter, error) {
+	pw := &ParallelWriter{
+		w: w,
+	}
+	if err := pw.init(cfg); err != nil {
+		return nil, err
+	}
+	pw.buf = make([]byte, 0, pw.segmentSize*pw.parallelism)
+
+	return pw, nil
+}
+
+// ParallelReader is a decrypting io.Reader using the parallel segmented
+// mode.
+type ParallelReader struct {
+	segmenter
+
+	r io.Reader
+
+	buf     []byte
+	err     error
+	isFinal bool
+}
+
+// Read reads and decrypts data into p.
+func (r *ParallelReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.readSegments()
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *ParallelReader) readSegments() error {
+	if r.isFinal {
+		// Ensure that there is nothing after the final chunk.
+		var tmp [1]byte
+		if n, _ := io.ReadFull(r.r, tmp[:]); n != 0 {
+			return ErrTrailingData
+		}
+		r.reset()
+		return io.EOF
+	}
+
+	// Read up to a full batch of segments worth of chunks.
+	chunksPerSegment := r.segmentSize / r.chunkSize
+	var (
+		segments           [][][]byte
+		truncated, partial bool
+	)
+	for !truncated && len(segments) < r.parallelism {
+		var chunks [][]byte
+		for len(chunks) < chunksPerSegment {
+			ciphertext, err := ReadFrame(r.r)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// A partial frame is trailing data if it follows the
+				// final chunk, which is not yet known.
+				truncated, partial = true, err == io.ErrUnexpectedEOF
+				break
+			}
+			if err != nil {
+				return err
+			}
+			chunks = append(chunks, ciphertext)
+		}
+		if len(chunks) > 0 {
+			segments = append(segments, chunks)
+		}
+	}
+	if len(segments) == 0 {
+		return ErrTruncated
+	}
+
+	n := len(segments)
+	out := make([][]byte, n)
+	finalIdx := make([]int, n)
+	err := r.run(n, func(i int) error {
+		var err error
+		out[i], finalIdx[i], err = r.openSegment(r.nextSegment+uint64(i), segments[i])
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Only the last chunk of the last segment may be final, and a short
+	// batch must end with the final chunk.
+	for i, idx := range finalIdx {
+		switch {
+		case idx < 0:
+		case i == n-1 && idx == len(segments[i])-1:
+			r.isFinal = true
+		default:
+			return ErrTrailingData
+		}
+	}
+	switch {
+	case r.isFinal && partial:
+		return ErrTrailingData
+	case !r.isFinal && truncated:
+		return ErrTruncated
+	}
+
+	for _, b := range out {
+		r.buf = append(r.buf, b...)
+	}
+
+	return nil
+}
+
+// openSegment decrypts a segment, and returns the plaintext and the index
+// of the final chunk if any (or -1).
+func (r *ParallelReader) openSegment(idx uint64, chunks [][]byte) ([]byte, int, error) {
+	aead, err := r.segmentAEAD(idx)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	var (
+		out      []byte
+		finalIdx = -1
+	)
+	for j, ciphertext := range chunks {
+		nonce := r.protocol.Cipher.EncodeNonce(uint64(j))
+
+		// Note: Decryption is not done in-place as a failed AEAD open
+		// may overwrite the destination buffer.
+		plaintext, err := aead.Open(nil, nonce, ciphertext, adChunk)
+		if err != nil {
+			if plaintext, err = aead.Open(nil, nonce, ciphertext, adFinal); err != nil {
+				return nil, -1, nyquist.ErrOpen
+			}
+			if finalIdx >= 0 {
+				return nil, -1, ErrTrailingData
+			}
+			finalIdx = j
+		}
+		out = append(out, plaintext...)
+	}
+
+	return out, finalIdx, nil
+}
+
+// NewParallelReader returns a ParallelReader that will decrypt data from r.
+// The ParallelConfig must match the one used to encrypt the data, with the
+// exception of Parallelism.
+func NewParallelReader(r io.Reader, cfg *ParallelConfig) (*ParallelReader, error) {
+	pr := &ParallelReader{
+		r: r,
+	}
+	if err := pr.init(cfg); err != nil {
+		return nil, err
+	}
+
+	return pr, nil
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
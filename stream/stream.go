@@ -0,0 +1,243 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package stream implements a STREAM-style chunked streaming AEAD layer
+// on top of a CipherState, so that arbitrarily large transfers can be
+// encrypted and decrypted incrementally, with truncation detection.
+//
+// Each chunk is a 16 bit big endian length prefixed transport message,
+// with the associated data set to a single byte, that is 1 for the final
+// chunk and 0 otherwise.  The ordering of chunks is enforced by the
+// CipherState's nonce.
+package stream // import "gitlab.com/yawning/nyquist.git/stream"
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"gitlab.com/yawning/nyquist.git"
+)
+
+// DefaultChunkSize is the default maximum size of each plaintext chunk.
+const DefaultChunkSize = 32768
+
+var (
+	// ErrTruncated is the error returned when the encrypted stream is
+	// truncated.
+	ErrTruncated = errors.New("nyquist/stream: truncated ciphertext")
+
+	// ErrTrailingData is the error returned when there is data following
+	// the final chunk.
+	ErrTrailingData = errors.New("nyquist/stream: trailing data after final chunk")
+
+	errClosed           = errors.New("nyquist/stream: writer is closed")
+	errInvalidChunkSize = errors.New("nyquist/stream: invalid chunk size")
+
+	adChunk = []byte{0x00}
+	adFinal = []byte{0x01}
+)
+
+// WriteFrame writes a 16 bit big endian length prefixed frame to w.
+func WriteFrame(w io.Writer, b []byte) error {
+	if len(b) > 0xffff {
+		return nyquist.ErrMessageSize
+	}
+	frame := make([]byte, 2, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	_, err := w.Write(append(frame, b...))
+	return err
+}
+
+// ReadFrame reads a 16 bit big endian length prefixed frame from r.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Writer is an encrypting io.WriteCloser.
+type Writer struct {
+	w         io.Writer
+	cs        *nyquist.CipherState
+	buf       []byte
+	chunkSize int
+	err       error
+}
+
+// Write encrypts and writes p.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	var n int
+	for len(p) > 0 {
+		// Only flush a full chunk once it is known that it is not the
+		// final one.
+		if len(w.buf) == w.chunkSize {
+			if w.err = w.flush(false); w.err != nil {
+				return n, w.err
+			}
+		}
+		toCopy := w.chunkSize - len(w.buf)
+		if toCopy > len(p) {
+			toCopy = len(p)
+		}
+		w.buf = append(w.buf, p[:toCopy]...)
+		p = p[toCopy:]
+		n += toCopy
+	}
+
+	return n, nil
+}
+
+// Close writes the final chunk and resets the CipherState.  It does not
+// close the underlying writer.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.err = w.flush(true); w.err != nil {
+		return w.err
+	}
+	w.cs.Reset()
+	w.err = errClosed
+	return nil
+}
+
+func (w *Writer) flush(isFinal bool) error {
+	ad := adChunk
+	if isFinal {
+		ad = adFinal
+	}
+	ciphertext, err := w.cs.EncryptWithAd(nil, ad, w.buf)
+	if err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+	return WriteFrame(w.w, ciphertext)
+}
+
+// NewWriter returns a Writer that will encrypt data to w with cs, using
+// the default chunk size.  The caller must call Close to finalize the
+// encrypted stream.
+func NewWriter(w io.Writer, cs *nyquist.CipherState) *Writer {
+	sw, _ := NewWriterSize(w, cs, DefaultChunkSize)
+	return sw
+}
+
+// NewWriterSize returns a Writer that will encrypt data to w with cs,
+// using the specified chunk size.  The caller must call Close to finalize
+// the encrypted stream.
+func NewWriterSize(w io.Writer, cs *nyquist.CipherState, chunkSize int) (*Writer, error) {
+	if chunkSize <= 0 || chunkSize > 0xffff {
+		return nil, errInvalidChunkSize
+	}
+	return &Writer{
+		w:         w,
+		cs:        cs,
+		buf:       make([]byte, 0, chunkSize),
+		chunkSize: chunkSize,
+	}, nil
+}
+
+// Reader is a decrypting io.Reader.
+type Reader struct {
+	r  io.Reader
+	cs *nyquist.CipherState
+
+	buf     []byte
+	err     error
+	isFinal bool
+}
+
+// Read reads and decrypts data into p.
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.readChunk()
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *Reader) readChunk() error {
+	if r.isFinal {
+		// Ensure that there is nothing after the final chunk.
+		var tmp [1]byte
+		if n, _ := io.ReadFull(r.r, tmp[:]); n != 0 {
+			return ErrTrailingData
+		}
+		r.cs.Reset()
+		return io.EOF
+	}
+
+	ciphertext, err := ReadFrame(r.r)
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		return ErrTruncated
+	default:
+		return err
+	}
+
+	// Try the common case first.  Note: Decryption is not done in-place
+	// as a failed AEAD open may overwrite the destination buffer.
+	plaintext, err := r.cs.DecryptWithAd(nil, adChunk, ciphertext)
+	if err == nyquist.ErrOpen {
+		plaintext, err = r.cs.DecryptWithAd(nil, adFinal, ciphertext)
+		r.isFinal = err == nil
+	}
+	if err != nil {
+		return err
+	}
+	r.buf = plaintext
+
+	return nil
+}
+
+// NewReader returns a Reader that will decrypt data from r with cs.
+// The CipherState is reset once the final chunk has been read.
+func NewReader(r io.Reader, cs *nyquist.CipherState) *Reader {
+	return &Reader{
+		r:  r,
+		cs: cs,
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package stream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git"
+)
+
+func newCipherStates(t *testing.T) (*nyquist.CipherState, *nyquist.CipherState) {
+	require := require.New(t)
+
+	protocol, err := nyquist.NewProtocol("Noise_NN_25519_ChaChaPoly_BLAKE2s")
+	require.NoError(err, "NewProtocol")
+
+	alice, err := nyquist.NewHandshake(&nyquist.HandshakeConfig{
+		Protocol:    protocol,
+		IsInitiator: true,
+	})
+	require.NoError(err, "NewHandshake - alice")
+	defer alice.Reset()
+
+	bob, err := nyquist.NewHandshake(&nyquist.HandshakeConfig{
+		Protocol: protocol,
+	})
+	require.NoError(err, "NewHandshake - bob")
+	defer bob.Reset()
+
+	msg, err := alice.WriteMessage(nil, nil)
+	require.NoError(err, "alice.WriteMessage")
+	_, err = bob.ReadMessage(nil, msg)
+	require.NoError(err, "bob.ReadMessage")
+	msg, err = bob.WriteMessage(nil, nil)
+	require.Equal(nyquist.ErrDone, err, "bob.WriteMessage")
+	_, err = alice.ReadMessage(nil, msg)
+	require.Equal(nyquist.ErrDone, err, "alice.ReadMessage")
+
+	return alice.GetStatus().CipherStates[0], bob.GetStatus().CipherStates[0]
+}
+
+func TestStream(t *testing.T) {
+	t.Run("RoundTrip", func(t *testing.T) {
+		for _, chunkSize := range []int{1, 7, 1024, DefaultChunkSize} {
+			for _, sz := range []int{0, 1, chunkSize, 3*chunkSize + 1, 100000} {
+				require := require.New(t)
+				enc, dec := newCipherStates(t)
+
+				plaintext := make([]byte, sz)
+				_, _ = rand.Read(plaintext)
+
+				var buf bytes.Buffer
+				w, err := NewWriterSize(&buf, enc, chunkSize)
+				require.NoError(err, "NewWriterSize(%d)", chunkSize)
+				_, err = w.Write(plaintext)
+				require.NoError(err, "Write(%d, %d)", chunkSize, sz)
+				require.NoError(w.Close(), "Close(%d, %d)", chunkSize, sz)
+				_, err = w.Write(plaintext)
+				require.Error(err, "Write - after close")
+
+				decrypted, err := ioutil.ReadAll(NewReader(&buf, dec))
+				require.NoError(err, "ReadAll(%d, %d)", chunkSize, sz)
+				require.Equal(plaintext, decrypted, "round trip(%d, %d)", chunkSize, sz)
+			}
+		}
+	})
+
+	t.Run("Tampering", func(t *testing.T) {
+		const chunkSize = 16
+		plaintext := make([]byte, 3*chunkSize)
+		frameSize := 2 + chunkSize + 16
+
+		encrypt := func(t *testing.T) ([]byte, *nyquist.CipherState) {
+			enc, dec := newCipherStates(t)
+			var buf bytes.Buffer
+			w, err := NewWriterSize(&buf, enc, chunkSize)
+			require.NoError(t, err, "NewWriterSize")
+			_, _ = w.Write(plaintext)
+			require.NoError(t, w.Close(), "Close")
+			return buf.Bytes(), dec
+		}
+		decrypt := func(b []byte, cs *nyquist.CipherState) error {
+			_, err := io.Copy(ioutil.Discard, NewReader(bytes.NewReader(b), cs))
+			return err
+		}
+
+		for _, v := range []struct {
+			name   string
+			mutate func([]byte) []byte
+			err    error
+		}{
+			{"Untampered", func(b []byte) []byte { return b }, nil},
+			{"TruncatedChunk", func(b []byte) []byte { return b[:2*frameSize] }, ErrTruncated},
+			{"TruncatedFrame", func(b []byte) []byte { return b[:len(b)-1] }, ErrTruncated},
+			{"TrailingData", func(b []byte) []byte { return append(b, 0x00) }, ErrTrailingData},
+			{"Reordered", func(b []byte) []byte {
+				out := append([]byte{}, b[frameSize:2*frameSize]...)
+				out = append(out, b[:frameSize]...)
+				return append(out, b[2*frameSize:]...)
+			}, nyquist.ErrOpen},
+			{"Corrupted", func(b []byte) []byte {
+				b[frameSize+5] ^= 0x01
+				return b
+			}, nyquist.ErrOpen},
+		} {
+			t.Run(v.name, func(t *testing.T) {
+				ciphertext, dec := encrypt(t)
+				err := decrypt(v.mutate(append([]byte{}, ciphertext...)), dec)
+				require.Equal(t, v.err, err, "decrypt")
+			})
+		}
+	})
+
+	t.Run("Parallel", testParallel)
+
+	t.Run("InvalidChunkSize", func(t *testing.T) {
+		enc, _ := newCipherStates(t)
+		for _, sz := range []int{-1, 0, 0x10000} {
+			_, err := NewWriterSize(ioutil.Discard, enc, sz)
+			require.Equal(t, errInvalidChunkSize, err, "NewWriterSize(%d)", sz)
+		}
+	})
+}
+
+func testParallel(t *testing.T) {
+	protocol, err := nyquist.NewProtocol("Noise_NN_25519_ChaChaPoly_BLAKE2s")
+	require.NoError(t, err, "NewProtocol")
+
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+
+	const (
+		chunkSize   = 16
+		segmentSize = 4 * chunkSize
+	)
+	newCfg := func(parallelism int) *ParallelConfig {
+		return &ParallelConfig{
+			Protocol:    protocol,
+			Key:         key,
+			ChunkSize:   chunkSize,
+			SegmentSize: segmentSize,
+			Parallelism: parallelism,
+		}
+	}
+	encrypt := func(t *testing.T, plaintext []byte, parallelism int) []byte {
+		var buf bytes.Buffer
+		w, err := NewParallelWriter(&buf, newCfg(parallelism))
+		require.NoError(t, err, "NewParallelWriter")
+		_, err = w.Write(plaintext)
+		require.NoError(t, err, "Write")
+		require.NoError(t, w.Close(), "Close")
+		_, err = w.Write(plaintext)
+		require.Error(t, err, "Write - after close")
+		return buf.Bytes()
+	}
+	decrypt := func(b []byte, parallelism int) ([]byte, error) {
+		r, err := NewParallelReader(bytes.NewReader(b), newCfg(parallelism))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	}
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		for _, sz := range []int{0, 1, chunkSize, segmentSize, 3*segmentSize + 1, 8 * segmentSize, 100000} {
+			for _, parallelism := range [][2]int{{1, 1}, {4, 4}, {3, 5}, {8, 2}} {
+				require := require.New(t)
+
+				plaintext := make([]byte, sz)
+				_, _ = rand.Read(plaintext)
+
+				ciphertext := encrypt(t, plaintext, parallelism[0])
+				decrypted, err := decrypt(ciphertext, parallelism[1])
+				require.NoError(err, "decrypt(%d, %v)", sz, parallelism)
+				require.Equal(plaintext, decrypted, "round trip(%d, %v)", sz, parallelism)
+			}
+		}
+	})
+
+	t.Run("Tampering", func(t *testing.T) {
+		plaintext := make([]byte, 3*segmentSize)
+		ciphertext := encrypt(t, plaintext, 2)
+		segmentLen := (segmentSize / chunkSize) * (2 + chunkSize + 16)
+
+		for _, v := range []struct {
+			name   string
+			mutate func([]byte) []byte
+			err    error
+		}{
+			{"Untampered", func(b []byte) []byte { return b }, nil},
+			{"TruncatedSegment", func(b []byte) []byte { return b[:2*segmentLen] }, ErrTruncated},
+			{"TruncatedFrame", func(b []byte) []byte { return b[:len(b)-1] }, ErrTruncated},
+			{"TrailingData", func(b []byte) []byte { return append(b, 0x00) }, ErrTrailingData},
+			{"Reordered", func(b []byte) []byte {
+				out := append([]byte{}, b[segmentLen:2*segmentLen]...)
+				out = append(out, b[:segmentLen]...)
+				return append(out, b[2*segmentLen:]...)
+			}, nyquist.ErrOpen},
+			{"Corrupted", func(b []byte) []byte {
+				b[segmentLen+5] ^= 0x01
+				return b
+			}, nyquist.ErrOpen},
+		} {
+			t.Run(v.name, func(t *testing.T) {
+				_, err := decrypt(v.mutate(append([]byte{}, ciphertext...)), 2)
+				require.Equal(t, v.err, err, "decrypt")
+			})
+		}
+	})
+
+	t.Run("InvalidConfig", func(t *testing.T) {
+		cfg := newCfg(1)
+		cfg.SegmentSize = chunkSize + 1
+		_, err := NewParallelWriter(ioutil.Discard, cfg)
+		require.Equal(t, errInvalidSegmentSize, err, "NewParallelWriter - segment size")
+
+		cfg = newCfg(1)
+		cfg.Key = key[:16]
+		_, err = NewParallelWriter(ioutil.Discard, cfg)
+		require.Equal(t, errInvalidKey, err, "NewParallelWriter - key")
+	})
+}
@@ -30,9 +30,7 @@
 package nyquist
 
 import (
-	"io"
-
-	"golang.org/x/crypto/hkdf"
+	gohash "hash"
 
 	"gitlab.com/yawning/nyquist.git/cipher"
 	"gitlab.com/yawning/nyquist.git/hash"
@@ -51,6 +49,14 @@ type SymmetricState struct {
 	ck []byte
 	h  []byte
 
+	// The hash instance and scratch buffers are reused across MixHash,
+	// MixKey, and Split to avoid allocating on every call.
+	hashInstance gohash.Hash
+	hmacPad      []byte
+	hmacInner    []byte
+	hkdfKey      []byte
+	hkdfCtr      [1]byte
+
 	hashLen int
 }
 
@@ -61,7 +67,8 @@ func (ss *SymmetricState) InitializeSymmetric(protocolName []byte) {
 		ss.h = make([]byte, ss.hashLen)
 		copy(ss.h, protocolName)
 	} else {
-		h := ss.hash.New()
+		h := ss.hashInstance
+		h.Reset()
 		_, _ = h.Write(protocolName)
 		ss.h = h.Sum(nil)
 	}
@@ -78,13 +85,14 @@ func (ss *SymmetricState) MixKey(inputKeyMaterial []byte) {
 	tempK := make([]byte, ss.hashLen)
 
 	ss.hkdfHash(inputKeyMaterial, ss.ck, tempK)
-	tempK = truncateTo32BytesMax(tempK)
-	ss.cs.InitializeKey(tempK)
+	ss.cs.InitializeKey(truncateTo32BytesMax(tempK))
+	zero(tempK)
 }
 
 // MixHash mixes the provided data with the handshake hash.
 func (ss *SymmetricState) MixHash(data []byte) {
-	h := ss.hash.New()
+	h := ss.hashInstance
+	h.Reset()
 	_, _ = h.Write(ss.h)
 	_, _ = h.Write(data)
 	ss.h = h.Sum(ss.h[:0])
@@ -97,8 +105,9 @@ func (ss *SymmetricState) MixKeyAndHash(inputKeyMaterial []byte) {
 
 	ss.hkdfHash(inputKeyMaterial, ss.ck, tempH, tempK)
 	ss.MixHash(tempH)
-	tempK = truncateTo32BytesMax(tempK)
-	ss.cs.InitializeKey(tempK)
+	ss.cs.InitializeKey(truncateTo32BytesMax(tempK))
+	zero(tempH)
+	zero(tempK)
 }
 
 // GetHandshakeHash returns the handshake hash `h`.
@@ -130,7 +139,10 @@ func (ss *SymmetricState) DecryptAndHash(dst, ciphertext []byte) ([]byte, error)
 
 	ss.MixHash(ciphertext)
 
-	return ss.cs.DecryptWithAd(dst, hPrev, ciphertext)
+	dst, err := ss.cs.DecryptWithAd(dst, hPrev, ciphertext)
+	zero(hPrev)
+
+	return dst, err
 }
 
 // Split returns a pair of CipherState objects for encrypted transport messages.
@@ -138,16 +150,30 @@ func (ss *SymmetricState) Split() (*CipherState, *CipherState) {
 	tempK1, tempK2 := make([]byte, ss.hashLen), make([]byte, ss.hashLen)
 
 	ss.hkdfHash(nil, tempK1, tempK2)
-	tempK1 = truncateTo32BytesMax(tempK1)
-	tempK2 = truncateTo32BytesMax(tempK2)
 
 	c1, c2 := newCipherState(ss.cipher, ss.cs.maxMessageSize), newCipherState(ss.cipher, ss.cs.maxMessageSize)
-	c1.InitializeKey(tempK1)
-	c2.InitializeKey(tempK2)
+	c1.InitializeKey(truncateTo32BytesMax(tempK1))
+	c2.InitializeKey(truncateTo32BytesMax(tempK2))
+	zero(tempK1)
+	zero(tempK2)
 
 	return c1, c2
 }
 
+// trafficKeys returns the keys of the CipherStates returned by Split.
+func (ss *SymmetricState) trafficKeys() [][]byte {
+	tempK1, tempK2 := make([]byte, ss.hashLen), make([]byte, ss.hashLen)
+	ss.hkdfHash(nil, tempK1, tempK2)
+
+	keys := make([][]byte, 0, 2)
+	for _, k := range [][]byte{tempK1, tempK2} {
+		keys = append(keys, append([]byte{}, truncateTo32BytesMax(k)...))
+		zero(k)
+	}
+
+	return keys
+}
+
 // CipherState returns the SymmetricState's encapsualted CipherState.
 //
 // Warning: There should be no reason to call this, ever.
@@ -156,32 +182,78 @@ func (ss *SymmetricState) CipherState() *CipherState {
 }
 
 func (ss *SymmetricState) hkdfHash(inputKeyMaterial []byte, outputs ...[]byte) {
-	// There is no way to sanitize the HKDF reader state.  While it is tempting
-	// to just write a HKDF implementation that supports sanitization, neither
-	// `crypto/hmac` nor the actual hash function implementations support
-	// sanitization correctly either due to:
+	// HKDF is implemented directly on top of the reusable hash instance,
+	// rather than via `x/crypto/hkdf` and `crypto/hmac`, both of which
+	// allocate new hash instances on every call.
 	//
-	//  * `Reset()`ing a HMAC instance resets it to the keyed (initialized)
-	//     state.
-	//  * All of the concrete hash function implementations do not `Reset()`
-	//    the cloned instance when `Sum([]byte)` is called.
+	// Note: There is no way to sanitize the hash instance's internal state,
+	// as none of the concrete hash function implementations clear anything
+	// on `Reset()`.  This is no worse than the alternative.
 
-	r := hkdf.New(ss.hash.New, inputKeyMaterial, ss.ck, nil)
-	for _, output := range outputs {
+	// Outputs may alias the chaining key, so the PRK must be derived first.
+	ss.hkdfKey = ss.hmac(ss.hkdfKey[:0], ss.ck, inputKeyMaterial)
+
+	var prev []byte
+	for i, output := range outputs {
 		if len(output) != ss.hashLen {
 			panic("nyquist/SymmetricState: non-HASHLEN sized output to HKDF-HASH")
 		}
-		_, _ = io.ReadFull(r, output)
+		ss.hkdfCtr[0] = byte(i + 1)
+		_ = ss.hmac(output[:0], ss.hkdfKey, prev, ss.hkdfCtr[:])
+		prev = output
 	}
+
+	zero(ss.hkdfKey)
+	zero(ss.hmacInner)
+}
+
+// hmac appends HMAC-HASH(key, data...) to dst, and returns the resulting
+// slice.  The key MUST be at most the hash function's block size, which
+// is always the case as all keys are HASHLEN bytes.
+func (ss *SymmetricState) hmac(dst, key []byte, data ...[]byte) []byte {
+	h, pad := ss.hashInstance, ss.hmacPad
+	if len(key) > len(pad) {
+		panic("nyquist/SymmetricState: oversized HMAC key")
+	}
+
+	setPad := func(v byte) {
+		copy(pad, key)
+		for i := len(key); i < len(pad); i++ {
+			pad[i] = 0
+		}
+		for i := range pad {
+			pad[i] ^= v
+		}
+	}
+
+	setPad(0x36)
+	h.Reset()
+	_, _ = h.Write(pad)
+	for _, v := range data {
+		_, _ = h.Write(v)
+	}
+	ss.hmacInner = h.Sum(ss.hmacInner[:0])
+
+	setPad(0x5c)
+	h.Reset()
+	_, _ = h.Write(pad)
+	_, _ = h.Write(ss.hmacInner)
+	dst = h.Sum(dst)
+
+	zero(pad)
+
+	return dst
 }
 
-// Reset clears the SymmetricState, to prevent future calls.
+// Reset clears the SymmetricState, to prevent future calls, overwriting
+// the chaining key and the encapsulated CipherState's key.
 //
 // Warning: The transcript hash (`h`) is left intact to allow for clearing
 // this state as early as possible, while preserving the ability to call
 // `GetHandshakeHash`.
 func (ss *SymmetricState) Reset() {
 	if ss.ck != nil {
+		zero(ss.ck)
 		ss.ck = nil
 	}
 	if ss.cs != nil {
@@ -191,10 +263,16 @@ func (ss *SymmetricState) Reset() {
 }
 
 func newSymmetricState(cipher cipher.Cipher, hash hash.Hash, maxMessageSize int) *SymmetricState {
+	h := hash.New()
+	hashLen := hash.Size()
 	return &SymmetricState{
-		cipher:  cipher,
-		hash:    hash,
-		cs:      newCipherState(cipher, maxMessageSize),
-		hashLen: hash.Size(),
+		cipher:       cipher,
+		hash:         hash,
+		cs:           newCipherState(cipher, maxMessageSize),
+		hashInstance: h,
+		hmacPad:      make([]byte, h.BlockSize()),
+		hmacInner:    make([]byte, 0, hashLen),
+		hkdfKey:      make([]byte, 0, hashLen),
+		hashLen:      hashLen,
 	}
 }
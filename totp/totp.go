@@ -0,0 +1,231 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package totp implements a time-based pre-shared key provider, in the
+// style of TOTP (RFC 6238), for pairing flows where a short-lived shared
+// code bootstraps a full Noise session.
+//
+// The PSK for each time step is derived from the shared secret and the
+// time step counter with HKDF-SHA256.  The counter is not secret, and
+// the initiator should send the counter it used in the clear ahead of
+// the handshake (eg: as transport negotiation data), so that the
+// responder can check that it is within the permitted clock skew, and
+// derive the matching PSK.  Where that is not possible, the responder
+// may try each of the Candidates in turn, with a fresh handshake for
+// each.
+//
+// Note that the handshake transcript allows an attacker to guess the
+// shared secret offline, so the secret must have sufficient entropy to
+// resist brute force for the lifetime of the derived keys.  Low entropy
+// secrets (eg: short numeric codes) require a PAKE instead (see the pake
+// package).
+package totp // import "gitlab.com/yawning/nyquist.git/totp"
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/clock"
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+const (
+	// DefaultPeriod is the default time step.
+	DefaultPeriod = 30 * time.Second
+
+	// CounterSize is the size of an encoded time step counter.
+	CounterSize = 8
+
+	pskLabel = "nyquist/totp: psk"
+)
+
+var (
+	// ErrOutOfWindow is the error returned when a time step counter is
+	// outside of the permitted clock skew.
+	ErrOutOfWindow = errors.New("nyquist/totp: counter outside of window")
+
+	// ErrMalformedCounter is the error returned when an encoded time step
+	// counter is malformed.
+	ErrMalformedCounter = errors.New("nyquist/totp: malformed counter")
+
+	errNoSecret      = errors.New("nyquist/totp: no shared secret")
+	errInvalidPeriod = errors.New("nyquist/totp: invalid period")
+)
+
+// Provider derives time-based pre-shared keys from a shared secret.
+type Provider struct {
+	// Secret is the shared secret.
+	Secret []byte
+
+	// Period is the time step, and defaults to DefaultPeriod if unset.
+	Period time.Duration
+
+	// Skew is the number of time steps before and after the current
+	// step that are accepted, to allow for clock skew and latency.
+	Skew uint64
+
+	// Clock is the optional clock, and defaults to the system clock if
+	// unset.
+	Clock clock.Clock
+}
+
+func (p *Provider) period() (time.Duration, error) {
+	switch {
+	case p.Period == 0:
+		return DefaultPeriod, nil
+	case p.Period < 0:
+		return 0, errInvalidPeriod
+	default:
+		return p.Period, nil
+	}
+}
+
+// Counter returns the current time step counter.
+func (p *Provider) Counter() (uint64, error) {
+	period, err := p.period()
+	if err != nil {
+		return 0, err
+	}
+
+	now := clock.Get(p.Clock).Now().UnixNano()
+	if now < 0 {
+		return 0, nil
+	}
+	return uint64(now / int64(period)), nil
+}
+
+// PSK returns the pre-shared key for the time step counter.
+func (p *Provider) PSK(counter uint64) ([]byte, error) {
+	if len(p.Secret) == 0 {
+		return nil, errNoSecret
+	}
+
+	info := make([]byte, 0, len(pskLabel)+CounterSize)
+	info = append(info, pskLabel...)
+	info = AppendCounter(info, counter)
+
+	psk := make([]byte, nyquist.PreSharedKeySize)
+	r := hkdf.New(sha256.New, p.Secret, nil, info)
+	_, _ = io.ReadFull(r, psk)
+
+	return psk, nil
+}
+
+// Current returns the current time step counter, and the corresponding
+// pre-shared key, for use by the initiator.
+func (p *Provider) Current() (uint64, []byte, error) {
+	counter, err := p.Counter()
+	if err != nil {
+		return 0, nil, err
+	}
+	psk, err := p.PSK(counter)
+	if err != nil {
+		return 0, nil, err
+	}
+	return counter, psk, nil
+}
+
+// Accept returns the pre-shared key for the peer's time step counter,
+// iff it is within the permitted clock skew of the current time step.
+func (p *Provider) Accept(counter uint64) ([]byte, error) {
+	current, err := p.Counter()
+	if err != nil {
+		return nil, err
+	}
+
+	delta := current - counter
+	if counter > current {
+		delta = counter - current
+	}
+	if delta > p.Skew {
+		return nil, ErrOutOfWindow
+	}
+
+	return p.PSK(counter)
+}
+
+// Candidates returns the pre-shared keys for every time step within the
+// permitted clock skew, most likely first.
+func (p *Provider) Candidates() ([][]byte, error) {
+	current, err := p.Counter()
+	if err != nil {
+		return nil, err
+	}
+
+	counters := []uint64{current}
+	for i := uint64(1); i <= p.Skew; i++ {
+		if current >= i {
+			counters = append(counters, current-i)
+		}
+		if current+i > current {
+			counters = append(counters, current+i)
+		}
+	}
+
+	psks := make([][]byte, 0, len(counters))
+	for _, counter := range counters {
+		psk, err := p.PSK(counter)
+		if err != nil {
+			return nil, err
+		}
+		psks = append(psks, psk)
+	}
+
+	return psks, nil
+}
+
+// PreSharedKeyFunc returns a nyquist.HandshakeConfig.PreSharedKeyFunc
+// that supplies the pre-shared key for the peer's time step counter,
+// checked with Accept, for every `psk` token.
+func (p *Provider) PreSharedKeyFunc(counter uint64) func(int, dh.PublicKey) ([]byte, error) {
+	return func(int, dh.PublicKey) ([]byte, error) {
+		return p.Accept(counter)
+	}
+}
+
+// AppendCounter appends the encoded time step counter to b.
+func AppendCounter(b []byte, counter uint64) []byte {
+	var tmp [CounterSize]byte
+	binary.BigEndian.PutUint64(tmp[:], counter)
+	return append(b, tmp[:]...)
+}
+
+// ParseCounter parses an encoded time step counter.
+func ParseCounter(b []byte) (uint64, error) {
+	if len(b) != CounterSize {
+		return 0, ErrMalformedCounter
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
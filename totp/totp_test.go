@@ -0,0 +1,166 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package totp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/clock"
+)
+
+func TestProvider(t *testing.T) {
+	secret := []byte("correct horse battery staple, but longer")
+	clk := clock.NewFake(time.Unix(1700000000, 0))
+
+	initiator := &Provider{Secret: secret, Clock: clk}
+	responder := &Provider{Secret: secret, Skew: 1, Clock: clk}
+
+	t.Run("Counter", func(t *testing.T) {
+		require := require.New(t)
+
+		counter, err := initiator.Counter()
+		require.NoError(err, "Counter")
+		require.EqualValues(1700000000/30, counter, "Counter - default period")
+
+		p := &Provider{Secret: secret, Period: time.Minute, Clock: clk}
+		counter, err = p.Counter()
+		require.NoError(err, "Counter - custom period")
+		require.EqualValues(1700000000/60, counter, "Counter - custom period")
+
+		p.Period = -time.Second
+		_, err = p.Counter()
+		require.Equal(errInvalidPeriod, err, "Counter - negative period")
+	})
+
+	t.Run("Accept", func(t *testing.T) {
+		require := require.New(t)
+
+		counter, psk, err := initiator.Current()
+		require.NoError(err, "Current")
+		require.Len(psk, nyquist.PreSharedKeySize, "Current - PSK size")
+
+		for _, c := range []uint64{counter - 1, counter, counter + 1} {
+			accepted, err := responder.Accept(c)
+			require.NoError(err, "Accept(%d)", c)
+			expected, _ := initiator.PSK(c)
+			require.Equal(expected, accepted, "Accept(%d)", c)
+		}
+		require.Equal(psk, mustAccept(t, responder, counter), "Accept - current")
+		require.NotEqual(psk, mustAccept(t, responder, counter+1), "Accept - counter bound")
+
+		for _, c := range []uint64{counter - 2, counter + 2, 0} {
+			_, err = responder.Accept(c)
+			require.Equal(ErrOutOfWindow, err, "Accept(%d)", c)
+		}
+
+		other := &Provider{Secret: []byte("a different shared secret"), Clock: clk}
+		otherPSK, err := other.PSK(counter)
+		require.NoError(err, "PSK - other secret")
+		require.NotEqual(psk, otherPSK, "PSK - secret bound")
+
+		_, err = (&Provider{Clock: clk}).PSK(counter)
+		require.Equal(errNoSecret, err, "PSK - no secret")
+	})
+
+	t.Run("Candidates", func(t *testing.T) {
+		require := require.New(t)
+
+		counter, psk, err := initiator.Current()
+		require.NoError(err, "Current")
+
+		candidates, err := responder.Candidates()
+		require.NoError(err, "Candidates")
+		require.Len(candidates, 3, "Candidates")
+		require.Equal(psk, candidates[0], "Candidates - current first")
+		require.Equal(mustAccept(t, responder, counter-1), candidates[1], "Candidates - previous")
+		require.Equal(mustAccept(t, responder, counter+1), candidates[2], "Candidates - next")
+	})
+
+	t.Run("Handshake", func(t *testing.T) {
+		require := require.New(t)
+
+		protocol, err := nyquist.NewProtocol("Noise_NNpsk0_25519_ChaChaPoly_BLAKE2s")
+		require.NoError(err, "NewProtocol")
+
+		doHandshake := func(advance time.Duration) error {
+			counter, psk, err := initiator.Current()
+			require.NoError(err, "Current")
+			wire := AppendCounter(nil, counter)
+
+			clk.Advance(advance)
+
+			alice, err := nyquist.NewHandshake(&nyquist.HandshakeConfig{
+				Protocol:      protocol,
+				PreSharedKeys: [][]byte{psk},
+				IsInitiator:   true,
+			})
+			require.NoError(err, "NewHandshake(alice)")
+			defer alice.Reset()
+
+			peerCounter, err := ParseCounter(wire)
+			require.NoError(err, "ParseCounter")
+			bob, err := nyquist.NewHandshake(&nyquist.HandshakeConfig{
+				Protocol:         protocol,
+				PreSharedKeyFunc: responder.PreSharedKeyFunc(peerCounter),
+			})
+			require.NoError(err, "NewHandshake(bob)")
+			defer bob.Reset()
+
+			msg, err := alice.WriteMessage(nil, nil)
+			require.NoError(err, "alice.WriteMessage")
+			_, err = bob.ReadMessage(nil, msg)
+			return err
+		}
+
+		require.NoError(doHandshake(15*time.Second), "handshake - within window")
+		require.ErrorIs(doHandshake(90*time.Second), ErrOutOfWindow, "handshake - stale counter")
+	})
+
+	t.Run("ParseCounter", func(t *testing.T) {
+		require := require.New(t)
+
+		counter, err := ParseCounter(AppendCounter(nil, 0x0102030405060708))
+		require.NoError(err, "ParseCounter")
+		require.EqualValues(0x0102030405060708, counter, "ParseCounter")
+
+		_, err = ParseCounter([]byte{1, 2, 3})
+		require.Equal(ErrMalformedCounter, err, "ParseCounter - truncated")
+	})
+}
+
+func mustAccept(t *testing.T, p *Provider, counter uint64) []byte {
+	psk, err := p.Accept(counter)
+	require.NoError(t, err, "Accept(%d)", counter)
+	return psk
+}
@@ -0,0 +1,245 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package trace implements recording of handshake executions, in a
+// structured format aligned with the models generated by Noise Explorer.
+//
+// Messages are named `A`, `B`, `C`, ... in order, with the direction and
+// tokens written in the same notation as the Noise Explorer models, so
+// that the properties proven for each message by the formal analysis can
+// be cross-checked against the recorded concrete execution (eg: that the
+// payload of a message was encrypted under keys derived from the expected
+// DH and PSK tokens).
+package trace // import "gitlab.com/yawning/nyquist.git/trace"
+
+import (
+	"encoding/json"
+	"sync"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/pattern"
+	"gitlab.com/yawning/nyquist.git/vectors"
+)
+
+const (
+	// DirectionInitiator is the direction of messages sent by the
+	// initiator.
+	DirectionInitiator = "->"
+
+	// DirectionResponder is the direction of messages sent by the
+	// responder.
+	DirectionResponder = "<-"
+
+	// RoleInitiator is the initiator role.
+	RoleInitiator = "initiator"
+
+	// RoleResponder is the responder role.
+	RoleResponder = "responder"
+)
+
+// Trace is a recorded handshake execution.
+type Trace struct {
+	// Protocol is the protocol name.
+	Protocol string `json:"protocol"`
+
+	// Role is the local role (`initiator`, `responder`).
+	Role string `json:"role"`
+
+	// PreMessages are the pattern's pre-messages.
+	PreMessages []PreMessage `json:"pre_messages,omitempty"`
+
+	// Messages are the handshake messages processed so far.
+	Messages []Message `json:"messages"`
+}
+
+// PreMessage is a pre-message.
+type PreMessage struct {
+	// Direction is the pre-message direction (`->`, `<-`).
+	Direction string `json:"direction"`
+
+	// Tokens are the pre-message tokens.
+	Tokens []string `json:"tokens"`
+}
+
+// Message is a recorded handshake message.
+type Message struct {
+	// Name is the message name, as in Noise Explorer (`A`, `B`, ...).
+	Name string `json:"name"`
+
+	// Direction is the message direction (`->`, `<-`).
+	Direction string `json:"direction"`
+
+	// Tokens are the message tokens.
+	Tokens []string `json:"tokens"`
+
+	// Sent is true iff the message was sent by the local side.
+	Sent bool `json:"sent"`
+
+	// KeysMixed are the DH and `psk` tokens of every message up to and
+	// including this one, that were mixed into the key used to encrypt
+	// the payload.
+	KeysMixed []string `json:"keys_mixed"`
+
+	// Encrypted is true iff the payload was encrypted.
+	Encrypted bool `json:"encrypted"`
+
+	// Payload is the message payload.
+	Payload vectors.HexBuffer `json:"payload"`
+
+	// Ciphertext is the message, as sent on the wire.
+	Ciphertext vectors.HexBuffer `json:"ciphertext"`
+
+	// HandshakeHash is the handshake hash (`h`) after the message.
+	HandshakeHash vectors.HexBuffer `json:"h"`
+}
+
+// Recorder records a handshake as a Trace.  It implements
+// nyquist.HandshakeTracer, and must only be used for a single handshake.
+type Recorder struct {
+	sync.Mutex
+
+	pattern pattern.Pattern
+	trace   Trace
+}
+
+// NewRecorder creates a new Recorder for a handshake with the provided
+// protocol and role.
+func NewRecorder(protocol *nyquist.Protocol, isInitiator bool) *Recorder {
+	r := &Recorder{
+		pattern: protocol.Pattern,
+		trace: Trace{
+			Protocol: protocol.String(),
+			Role:     RoleResponder,
+		},
+	}
+	if isInitiator {
+		r.trace.Role = RoleInitiator
+	}
+	for idx, msg := range protocol.Pattern.PreMessages() {
+		if len(msg) == 0 {
+			continue
+		}
+		r.trace.PreMessages = append(r.trace.PreMessages, PreMessage{
+			Direction: direction(idx),
+			Tokens:    tokenStrings(msg),
+		})
+	}
+
+	return r
+}
+
+// OnMessage implements nyquist.HandshakeTracer.
+func (r *Recorder) OnMessage(idx int, isWrite bool, payload, message, handshakeHash []byte) {
+	r.Lock()
+	defer r.Unlock()
+
+	messages := r.pattern.Messages()
+	if idx >= len(messages) || idx != len(r.trace.Messages) {
+		return
+	}
+
+	var keysMixed []string
+	encrypted := keyedByPreMessages(r.pattern)
+	for _, msg := range messages[:idx+1] {
+		for _, v := range msg {
+			switch v {
+			case pattern.Token_ee, pattern.Token_es, pattern.Token_se, pattern.Token_ss, pattern.Token_psk:
+				keysMixed = append(keysMixed, v.String())
+				encrypted = true
+			case pattern.Token_e:
+				// In PSK mode, `e` also calls `MixKey()`.
+				encrypted = encrypted || r.pattern.NumPSKs() > 0
+			}
+		}
+	}
+
+	r.trace.Messages = append(r.trace.Messages, Message{
+		Name:          messageName(idx),
+		Direction:     direction(idx),
+		Tokens:        tokenStrings(messages[idx]),
+		Sent:          isWrite,
+		KeysMixed:     keysMixed,
+		Encrypted:     encrypted,
+		Payload:       append([]byte{}, payload...),
+		Ciphertext:    append([]byte{}, message...),
+		HandshakeHash: append([]byte{}, handshakeHash...),
+	})
+}
+
+// Trace returns a copy of the recorded trace.
+func (r *Recorder) Trace() *Trace {
+	r.Lock()
+	defer r.Unlock()
+
+	t := r.trace
+	t.Messages = append([]Message{}, r.trace.Messages...)
+	return &t
+}
+
+// MarshalJSON returns the JSON serialization of the recorded trace.
+func (r *Recorder) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.Trace())
+}
+
+func keyedByPreMessages(pa pattern.Pattern) bool {
+	if pa.NumPSKs() == 0 {
+		return false
+	}
+	for _, msg := range pa.PreMessages() {
+		for _, v := range msg {
+			if v == pattern.Token_e {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func direction(idx int) string {
+	if idx&1 == 0 {
+		return DirectionInitiator
+	}
+	return DirectionResponder
+}
+
+func messageName(idx int) string {
+	name := string(rune('A' + idx%26))
+	if idx >= 26 {
+		name = messageName(idx/26-1) + name
+	}
+	return name
+}
+
+func tokenStrings(msg pattern.Message) []string {
+	ret := make([]string, 0, len(msg))
+	for _, v := range msg {
+		ret = append(ret, v.String())
+	}
+	return ret
+}
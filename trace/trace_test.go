@@ -0,0 +1,163 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git"
+)
+
+func runHandshake(t *testing.T, protocolName string, psks [][]byte) (*Recorder, *Recorder, *nyquist.HandshakeStatus) {
+	require := require.New(t)
+
+	protocol, err := nyquist.NewProtocol(protocolName)
+	require.NoError(err, "NewProtocol")
+	aliceStatic, err := protocol.DH.GenerateKeypair(rand.Reader)
+	require.NoError(err, "GenerateKeypair(alice)")
+	bobStatic, err := protocol.DH.GenerateKeypair(rand.Reader)
+	require.NoError(err, "GenerateKeypair(bob)")
+
+	aliceRec, bobRec := NewRecorder(protocol, true), NewRecorder(protocol, false)
+	aliceHs, err := nyquist.NewHandshake(&nyquist.HandshakeConfig{
+		Protocol:      protocol,
+		LocalStatic:   aliceStatic,
+		RemoteStatic:  bobStatic.Public(),
+		PreSharedKeys: psks,
+		Tracer:        aliceRec,
+		IsInitiator:   true,
+	})
+	require.NoError(err, "NewHandshake(alice)")
+	defer aliceHs.Reset()
+	bobHs, err := nyquist.NewHandshake(&nyquist.HandshakeConfig{
+		Protocol:      protocol,
+		LocalStatic:   bobStatic,
+		RemoteStatic:  aliceStatic.Public(),
+		PreSharedKeys: psks,
+		Tracer:        bobRec,
+	})
+	require.NoError(err, "NewHandshake(bob)")
+	defer bobHs.Reset()
+
+	w, r := aliceHs, bobHs
+	for {
+		msg, err := w.WriteMessage(nil, []byte("payload"))
+		if err != nil && err != nyquist.ErrDone {
+			require.NoError(err, "WriteMessage")
+		}
+		_, rErr := r.ReadMessage(nil, msg)
+		require.Equal(err, rErr, "ReadMessage")
+		if err == nyquist.ErrDone {
+			break
+		}
+		w, r = r, w
+	}
+
+	return aliceRec, bobRec, aliceHs.GetStatus()
+}
+
+func TestRecorder(t *testing.T) {
+	t.Run("XX", func(t *testing.T) {
+		require := require.New(t)
+
+		aliceRec, bobRec, status := runHandshake(t, "Noise_XX_25519_ChaChaPoly_BLAKE2s", nil)
+		alice, bob := aliceRec.Trace(), bobRec.Trace()
+
+		require.Equal("Noise_XX_25519_ChaChaPoly_BLAKE2s", alice.Protocol, "Protocol")
+		require.Equal(RoleInitiator, alice.Role, "Role - alice")
+		require.Equal(RoleResponder, bob.Role, "Role - bob")
+		require.Empty(alice.PreMessages, "PreMessages")
+		require.Len(alice.Messages, 3, "Messages")
+
+		for i, v := range []struct {
+			name      string
+			direction string
+			tokens    []string
+			keysMixed []string
+			encrypted bool
+		}{
+			{"A", DirectionInitiator, []string{"e"}, nil, false},
+			{"B", DirectionResponder, []string{"e", "ee", "s", "es"}, []string{"ee", "es"}, true},
+			{"C", DirectionInitiator, []string{"s", "se"}, []string{"ee", "es", "se"}, true},
+		} {
+			am, bm := alice.Messages[i], bob.Messages[i]
+			require.Equal(v.name, am.Name, "Name(%d)", i)
+			require.Equal(v.direction, am.Direction, "Direction(%d)", i)
+			require.Equal(v.tokens, am.Tokens, "Tokens(%d)", i)
+			require.Equal(v.keysMixed, am.KeysMixed, "KeysMixed(%d)", i)
+			require.Equal(v.encrypted, am.Encrypted, "Encrypted(%d)", i)
+			require.Equal(i&1 == 0, am.Sent, "Sent(%d) - alice", i)
+			require.Equal(i&1 != 0, bm.Sent, "Sent(%d) - bob", i)
+
+			// Both sides observe the same execution.
+			require.Equal(am.Ciphertext, bm.Ciphertext, "Ciphertext(%d)", i)
+			require.Equal(am.Payload, bm.Payload, "Payload(%d)", i)
+			require.Equal(am.HandshakeHash, bm.HandshakeHash, "HandshakeHash(%d)", i)
+		}
+		require.EqualValues(status.HandshakeHash, alice.Messages[2].HandshakeHash, "HandshakeHash - final")
+		require.NotEqual([]byte("payload"), []byte(alice.Messages[1].Ciphertext[32:]), "Ciphertext - encrypted")
+
+		b, err := json.Marshal(aliceRec)
+		require.NoError(err, "json.Marshal")
+		var decoded Trace
+		require.NoError(json.Unmarshal(b, &decoded), "json.Unmarshal")
+		require.Equal(alice, &decoded, "json round trip")
+	})
+
+	t.Run("PreMessagesAndPSK", func(t *testing.T) {
+		require := require.New(t)
+
+		psk := make([]byte, nyquist.PreSharedKeySize)
+		aliceRec, _, _ := runHandshake(t, "Noise_NKpsk2_25519_ChaChaPoly_BLAKE2s", [][]byte{psk})
+		alice := aliceRec.Trace()
+
+		require.Equal([]PreMessage{{DirectionResponder, []string{"s"}}}, alice.PreMessages, "PreMessages")
+		require.Equal([]string{"es"}, alice.Messages[0].KeysMixed, "KeysMixed(A)")
+		require.Equal([]string{"es", "ee", "psk"}, alice.Messages[1].KeysMixed, "KeysMixed(B)")
+
+		// In PSK mode, `e` keys the cipher, even without a DH.
+		aliceRec, _, _ = runHandshake(t, "Noise_NNpsk2_25519_ChaChaPoly_BLAKE2s", [][]byte{psk})
+		alice = aliceRec.Trace()
+		require.Nil(alice.Messages[0].KeysMixed, "KeysMixed(A) - NNpsk2")
+		require.True(alice.Messages[0].Encrypted, "Encrypted(A) - NNpsk2")
+	})
+
+	t.Run("MessageName", func(t *testing.T) {
+		require := require.New(t)
+
+		require.Equal("A", messageName(0), "messageName(0)")
+		require.Equal("Z", messageName(25), "messageName(25)")
+		require.Equal("AA", messageName(26), "messageName(26)")
+	})
+}
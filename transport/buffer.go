@@ -0,0 +1,114 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+// Flush sends any data buffered due to write coalescing.
+func (c *Conn) Flush() error {
+	if err := c.ensureHandshake(); err != nil {
+		return err
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	return c.flush()
+}
+
+// flush sends the buffered data.  The caller must hold c.out.
+func (c *Conn) flush() error {
+	if c.out.err != nil {
+		return c.out.err
+	}
+	if c.flushTimerArmed {
+		c.flushTimer.Stop()
+		c.flushTimerArmed = false
+	}
+	if len(c.writeBuf) == 0 {
+		return nil
+	}
+
+	_, err := c.writeData(nil, c.writeBuf)
+	zero(c.writeBuf)
+	c.writeBuf = c.writeBuf[:0]
+
+	return err
+}
+
+// bufferWrite appends p to the write buffer, sending full buffers.  The
+// caller must hold c.out.
+func (c *Conn) bufferWrite(p []byte) (int, error) {
+	if c.out.err != nil {
+		return 0, c.out.err
+	}
+
+	bufSize := c.cfg.WriteBufferSize
+	if maxPayload := c.maxRecordPayload(0); bufSize > maxPayload {
+		bufSize = maxPayload
+	}
+	if c.writeBuf == nil {
+		c.writeBuf = make([]byte, 0, bufSize)
+	}
+
+	var n int
+	for len(p) > 0 {
+		toBuffer := bufSize - len(c.writeBuf)
+		if toBuffer > len(p) {
+			toBuffer = len(p)
+		}
+		c.writeBuf = append(c.writeBuf, p[:toBuffer]...)
+		n += toBuffer
+		p = p[toBuffer:]
+
+		if len(c.writeBuf) == bufSize {
+			if err := c.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+
+	if len(c.writeBuf) > 0 && c.cfg.WriteBufferDelay > 0 && !c.flushTimerArmed {
+		if c.flushTimer == nil {
+			c.flushTimer = c.cfg.clock().AfterFunc(c.cfg.WriteBufferDelay, c.onFlushTimer)
+		} else {
+			c.flushTimer.Reset(c.cfg.WriteBufferDelay)
+		}
+		c.flushTimerArmed = true
+	}
+
+	return n, nil
+}
+
+func (c *Conn) onFlushTimer() {
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	c.flushTimerArmed = false
+	_ = c.flush()
+}
@@ -0,0 +1,153 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git/clock"
+)
+
+func TestWriteBuffer(t *testing.T) {
+	protoNN := mustProtocol(t, "Noise_NN_25519_ChaChaPoly_BLAKE2s")
+
+	t.Run("Flush", func(t *testing.T) {
+		require := require.New(t)
+
+		server, client := newTestConnPair(t, &Config{
+			Protocol: protoNN,
+		}, &Config{
+			Protocol:        protoNN,
+			WriteBufferSize: 64,
+		})
+		defer client.Close()
+		defer server.Close()
+
+		for i := 0; i < 10; i++ {
+			_, err := client.Write([]byte("hi"))
+			require.NoError(err, "client.Write")
+		}
+		require.Zero(client.Stats().Write.Records, "Write.Records - buffered")
+
+		require.NoError(client.Flush(), "client.Flush")
+		require.EqualValues(1, client.Stats().Write.Records, "Write.Records - flushed")
+
+		b := make([]byte, 20)
+		_, err := io.ReadFull(server, b)
+		require.NoError(err, "server.Read")
+		require.Equal([]byte("hihihihihihihihihihi"), b, "server.Read - coalesced")
+	})
+
+	t.Run("Full", func(t *testing.T) {
+		require := require.New(t)
+
+		server, client := newTestConnPair(t, &Config{
+			Protocol: protoNN,
+		}, &Config{
+			Protocol:        protoNN,
+			WriteBufferSize: 16,
+		})
+		defer client.Close()
+		defer server.Close()
+
+		msg := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+		_, err := client.Write(msg)
+		require.NoError(err, "client.Write")
+		require.EqualValues(2, client.Stats().Write.Records, "Write.Records - full buffers sent")
+		require.EqualValues(32, client.Stats().Write.Bytes, "Write.Bytes - full buffers sent")
+
+		// Close flushes the remainder.
+		require.NoError(client.Close(), "client.Close")
+		b, err := io.ReadAll(server)
+		require.NoError(err, "server.Read")
+		require.Equal(msg, b, "server.Read")
+	})
+
+	t.Run("Delay", func(t *testing.T) {
+		require := require.New(t)
+
+		clk := clock.NewFake(time.Now())
+		server, client := newTestConnPair(t, &Config{
+			Protocol: protoNN,
+		}, &Config{
+			Protocol:         protoNN,
+			WriteBufferSize:  1024,
+			WriteBufferDelay: 10 * time.Millisecond,
+			Clock:            clk,
+		})
+		defer client.Close()
+		defer server.Close()
+
+		_, err := client.Write([]byte("delayed"))
+		require.NoError(err, "client.Write")
+		clk.Advance(5 * time.Millisecond)
+		require.Zero(client.Stats().Write.Records, "Write.Records - before delay")
+		clk.Advance(5 * time.Millisecond)
+		require.EqualValues(1, client.Stats().Write.Records, "Write.Records - after delay")
+
+		b := make([]byte, 7)
+		_, err = io.ReadFull(server, b)
+		require.NoError(err, "server.Read")
+		require.Equal([]byte("delayed"), b, "server.Read")
+	})
+
+	t.Run("AssociatedData", func(t *testing.T) {
+		require := require.New(t)
+
+		server, client := newTestConnPair(t, &Config{
+			Protocol: protoNN,
+		}, &Config{
+			Protocol:        protoNN,
+			WriteBufferSize: 1024,
+		})
+		defer client.Close()
+		defer server.Close()
+
+		// Writes with associated data are not buffered, and preserve order.
+		_, err := client.Write([]byte("first"))
+		require.NoError(err, "client.Write")
+		_, err = client.WriteWithAD([]byte("ad"), []byte("second"))
+		require.NoError(err, "client.WriteWithAD")
+
+		b := make([]byte, 5)
+		_, err = io.ReadFull(server, b)
+		require.NoError(err, "server.Read")
+		require.Equal([]byte("first"), b, "server.Read")
+		b = make([]byte, 6)
+		n, ad, err := server.ReadWithAD(b)
+		require.NoError(err, "server.ReadWithAD")
+		require.Equal([]byte("second"), b[:n], "server.ReadWithAD")
+		require.Equal([]byte("ad"), ad, "server.ReadWithAD - ad")
+	})
+}
@@ -0,0 +1,254 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"io"
+	"time"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/clock"
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+// DefaultHandshakeTimeout is the default maximum duration that a Listener
+// will wait for an incoming connection to complete the handshake.
+const DefaultHandshakeTimeout = 30 * time.Second
+
+// Config is a transport configuration.
+//
+// A Config may be reused across multiple connections, and must not be
+// modified after it has been passed to any of the functions in this
+// package.
+type Config struct {
+	// Protocol is the noise protocol to use.  For servers, this is the
+	// only protocol accepted, unless AcceptProtocols is set.  One-way
+	// patterns are not supported.
+	Protocol *nyquist.Protocol
+
+	// AcceptProtocols is the list of protocols accepted by servers.  If
+	// empty, only Protocol will be accepted.
+	AcceptProtocols []*nyquist.Protocol
+
+	// Prologue is the optional pre-handshake prologue input to be included
+	// in the handshake hash.
+	Prologue []byte
+
+	// LocalStatic is the local static keypair, if any (`s`).
+	LocalStatic dh.Keypair
+
+	// RemoteStatic is the remote static public key, if any (`rs`).
+	RemoteStatic dh.PublicKey
+
+	// PreSharedKeys is the vector of pre-shared symmetric key for PSK mode
+	// handshakes.
+	PreSharedKeys [][]byte
+
+	// TicketStore is the server-side store for resumption tickets.  If
+	// set, servers will issue a resumption ticket to the client after
+	// each successful handshake, and accept resumption tickets for PSK
+	// mode handshakes.
+	TicketStore TicketStore
+
+	// Rng is the entropy source to be used when generating new DH key pairs.
+	// If the value is `nil`, `crypto/rand.Reader` will be used.
+	Rng io.Reader
+
+	// MaxRecordSize is the maximum amount of application data sent in
+	// each record, with larger writes being split into multiple records.
+	// If 0, or larger than the maximum that fits in a single Noise
+	// message, the maximum is used.
+	MaxRecordSize int
+
+	// IdleTimeout is the duration after which a connection with no
+	// records sent or received is closed.  If 0, connections will never
+	// be closed due to inactivity.
+	IdleTimeout time.Duration
+
+	// MaxLifetime is the maximum duration that traffic keys may be used
+	// for, after which LifetimeAction is taken.  If 0, the traffic keys
+	// may be used indefinitely.
+	MaxLifetime time.Duration
+
+	// LifetimeAction is the action taken when MaxLifetime is exceeded.
+	LifetimeAction LifetimeAction
+
+	// HandshakeTimeout is the maximum duration that a Listener will wait
+	// for an incoming connection to complete the handshake, after which
+	// the connection is closed.  If 0, DefaultHandshakeTimeout is used,
+	// and if negative, there is no limit.
+	HandshakeTimeout time.Duration
+
+	// MaxPendingHandshakes is the maximum number of incomplete handshakes
+	// on a Listener, beyond which the least recently active handshake is
+	// aborted.  If 0, there is no limit.
+	MaxPendingHandshakes int
+
+	// MaxPendingHandshakeMemory is the maximum estimated memory used by
+	// incomplete handshakes on a Listener, in bytes, beyond which the
+	// least recently active handshakes are aborted.  The estimate is a
+	// fixed per-handshake cost, plus the handshake data received.  If 0,
+	// there is no limit.
+	MaxPendingHandshakeMemory int64
+
+	// ProxyProtocol requires servers to read a PROXY protocol v1 or v2
+	// header before the handshake, with the original source address
+	// exposed via ConnectionState.  This must only be enabled when all
+	// connections are accepted via a trusted proxy or load balancer.
+	ProxyProtocol bool
+
+	// WriteBufferSize enables write coalescing if > 0.  Writes without
+	// associated data are buffered, and sent as a single record once
+	// WriteBufferSize bytes (limited to the maximum record payload) are
+	// buffered, WriteBufferDelay elapses, or Flush is called.
+	WriteBufferSize int
+
+	// WriteBufferDelay is the maximum duration that data is buffered for
+	// when write coalescing is enabled.  If 0, buffered data is only sent
+	// when the buffer is full, or on Flush.
+	WriteBufferDelay time.Duration
+
+	// Suites is the optional list of additional handshake configurations
+	// accepted by servers, so that a single listener may serve clients
+	// using different patterns, DH functions, or static keys (eg: during
+	// a migration).  Only the handshake parameters (Protocol,
+	// AcceptProtocols, Prologue, LocalStatic, RemoteStatic, PreSharedKeys,
+	// TicketStore and Rng) of each suite are used.
+	//
+	// The suite is selected by the protocol in the client's negotiation
+	// data, starting with the Config itself.  If more than one suite
+	// accepts the protocol, each is tried in order, until one successfully
+	// processes the client's first handshake message.  Note that this only
+	// distinguishes between suites if the first message is authenticated
+	// (eg: NK, IK), and otherwise the first suite is used.
+	Suites []*Config
+
+	// NegotiationData, if set, is called to produce application data
+	// (eg: routing hints, version information) carried in the cleartext
+	// negotiation data of the first handshake message sent by each side.
+	// The data is not encrypted, but is bound into the handshake hash.
+	NegotiationData func() ([]byte, error)
+
+	// OnNegotiationData, if set, is called with the peer's application
+	// negotiation data (nil if none) from the first handshake message
+	// received, before it is processed.  Returning an error aborts the
+	// handshake.
+	OnNegotiationData func(data []byte) error
+
+	// OnRekey, if set, is called whenever a traffic key changes after the
+	// initial handshake (eg: to log and correlate key lifetimes).  It is
+	// called synchronously with internal locks held, and must not call
+	// into the connection.
+	OnRekey func(RekeyEvent)
+
+	// OnControl, if set, is called with each control frame received
+	// from the peer (see Conn.WriteControl).  It is called synchronously
+	// from Read with internal locks held, must not call into the
+	// connection, and must not retain payload.  Control frames are
+	// discarded if unset.
+	OnControl func(typ byte, payload []byte)
+
+	// KeyEscrow enables session key escrow if set.  See KeyEscrow for the
+	// (considerable) caveats.
+	KeyEscrow *KeyEscrow
+
+	// Clock is the clock used for IdleTimeout, MaxLifetime, WriteBufferDelay
+	// and connection statistics.  If nil, the system clock is used.
+	// Deadlines on the underlying connection always use the system clock.
+	Clock clock.Clock
+}
+
+func (cfg *Config) clock() clock.Clock {
+	return clock.Get(cfg.Clock)
+}
+
+func (cfg *Config) handshakeTimeout() time.Duration {
+	switch {
+	case cfg.HandshakeTimeout == 0:
+		return DefaultHandshakeTimeout
+	case cfg.HandshakeTimeout < 0:
+		return 0
+	default:
+		return cfg.HandshakeTimeout
+	}
+}
+
+func (cfg *Config) acceptProtocol(name string) *nyquist.Protocol {
+	if len(cfg.AcceptProtocols) == 0 {
+		if cfg.Protocol != nil && cfg.Protocol.String() == name {
+			return cfg.Protocol
+		}
+		return nil
+	}
+	for _, v := range cfg.AcceptProtocols {
+		if v.String() == name {
+			return v
+		}
+	}
+	return nil
+}
+
+// serverSuites returns the configurations that accept the named protocol,
+// in order of preference.
+func (cfg *Config) serverSuites(name string) []*Config {
+	var suites []*Config
+	if cfg.acceptProtocol(name) != nil {
+		suites = append(suites, cfg)
+	}
+	for _, v := range cfg.Suites {
+		if v.acceptProtocol(name) != nil {
+			suites = append(suites, cfg.withSuite(v))
+		}
+	}
+	return suites
+}
+
+func (cfg *Config) withSuite(suite *Config) *Config {
+	newCfg := *cfg
+	newCfg.Protocol = suite.Protocol
+	newCfg.AcceptProtocols = suite.AcceptProtocols
+	newCfg.Prologue = suite.Prologue
+	newCfg.LocalStatic = suite.LocalStatic
+	newCfg.RemoteStatic = suite.RemoteStatic
+	newCfg.PreSharedKeys = suite.PreSharedKeys
+	newCfg.TicketStore = suite.TicketStore
+	newCfg.Rng = suite.Rng
+	newCfg.Suites = nil
+	return &newCfg
+}
+
+// TicketStore is a server-side store of resumption tickets.
+type TicketStore interface {
+	// Put stores the resumption PSK associated with a ticket.
+	Put(ticket, psk []byte) error
+
+	// Get returns the resumption PSK associated with a ticket, if any.
+	Get(ticket []byte) ([]byte, bool)
+}
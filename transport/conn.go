@@ -0,0 +1,1212 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package transport implements a net.Conn that runs a Noise handshake,
+// followed by encrypted transport messages, over a stream-oriented
+// connection.
+//
+// The framing is modeled after NoiseSocket.  Each handshake message is
+// sent as:
+//
+//	negotiation_data_len  uint16 (big endian)
+//	negotiation_data      [negotiation_data_len]byte
+//	noise_message_len     uint16 (big endian)
+//	noise_message         [noise_message_len]byte
+//
+// The client's first negotiation data specifies the protocol name, an
+// optional resumption ticket, and optional application data.  A server
+// rejecting the handshake responds with `reject`, and otherwise may
+// include application data in its first response.  All other negotiation
+// data is empty.  The client's negotiation data is bound into the
+// handshake via the prologue, and the server's via MixHash prior to
+// processing the handshake message.
+//
+// Each transport message is sent as:
+//
+//	frame_len  uint16 (big endian)
+//	ad_len     uint8
+//	ad         [ad_len]byte
+//	ciphertext [frame_len - 1 - ad_len]byte
+//
+// where the optional ad is cleartext associated data supplied via
+// WriteWithAD, and the ciphertext is a noise message with a plaintext
+// consisting of a single byte record type followed by the record body.
+// Connections are closed with an authenticated close record, so that
+// truncation can be detected.  Application control frames (see
+// Conn.WriteControl) use a dedicated record type, and are never mixed
+// into the data stream.
+package transport // import "gitlab.com/yawning/nyquist.git/transport"
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/clock"
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+const (
+	maxFrameSize = nyquist.DefaultMaxMessageSize
+
+	// recordOverhead is the size of the AD length and record type.
+	recordOverhead = 1 + 1
+
+	// MaxADSize is the maximum size of the per-record associated data.
+	MaxADSize = 255
+
+	recordTypeData        = 0x00
+	recordTypeTicket      = 0x01
+	recordTypeClose       = 0x02
+	recordTypeKeyUpdate   = 0x03
+	recordTypeRenegotiate = 0x04
+	recordTypeChangeKeys  = 0x05
+
+	ticketSize = 16
+
+	closeNotifyTimeout = 5 * time.Second
+)
+
+var (
+	// ErrADRequired is the error returned by Read when the next record
+	// has associated data, which must be read with ReadWithAD.
+	ErrADRequired = errors.New("nyquist/transport: record has associated data")
+
+	// ErrRejected is the error returned when the server rejects the
+	// handshake (eg: unsupported protocol, stale resumption state).
+	ErrRejected = errors.New("nyquist/transport: handshake rejected by peer")
+
+	errUnsupportedProtocol = errors.New("nyquist/transport: unsupported protocol")
+	errOneWay              = errors.New("nyquist/transport: one-way patterns are not supported")
+	errInvalidTicket       = errors.New("nyquist/transport: invalid resumption ticket")
+	errMalformedNegData    = errors.New("nyquist/transport: malformed negotiation data")
+	errMalformedRecord     = errors.New("nyquist/transport: malformed record")
+	errClosed              = errors.New("nyquist/transport: use of closed connection")
+	errWriteClosed         = errors.New("nyquist/transport: write to half-closed connection")
+	errADSize              = errors.New("nyquist/transport: associated data too large")
+
+	prologuePrefix = []byte("nyquist/transport")
+	resumptionASK  = []byte("nyquist/transport: resumption")
+	rejectNegData  = []byte("reject")
+)
+
+// negDataApp is the prefix of a server's negotiation data carrying
+// application data, distinguishing it from a rejection.
+const negDataApp = 0x00
+
+type halfConn struct {
+	sync.Mutex
+
+	cs            *nyquist.CipherState
+	err           error
+	keyCreated    time.Time
+	keyGeneration uint64
+}
+
+func (hc *halfConn) reset(err error) {
+	hc.Lock()
+	defer hc.Unlock()
+
+	if hc.cs != nil {
+		hc.cs.Reset()
+		hc.cs = nil
+	}
+	if hc.err == nil {
+		hc.err = err
+	}
+}
+
+// Conn is a Noise protocol transport connection.
+type Conn struct {
+	// Accessed atomically, and must be 64 bit aligned.
+	lastActivity   int64
+	inStats        halfStats
+	outStats       halfStats
+	renegotiations uint64
+
+	conn     net.Conn
+	cfg      *Config
+	isClient bool
+
+	protocol   *nyquist.Protocol
+	didResume  bool
+	ticket     []byte
+	sourceAddr net.Addr
+
+	handshakeMu       sync.Mutex
+	handshakeDone     bool
+	handshakeErr      error
+	handshakeComplete uint32
+
+	stateMu       sync.Mutex
+	remoteStatic  dh.PublicKey
+	handshakeHash []byte
+	keyEscrowed   bool
+	resumptionPSK []byte
+
+	reneg   *nyquist.HandshakeState
+	renegIn *nyquist.CipherState
+
+	writeBuf        []byte
+	flushTimer      clock.Timer
+	flushTimerArmed bool
+
+	handshakeStarted time.Time
+	established      time.Time
+
+	in       halfConn
+	out      halfConn
+	readBuf  []byte
+	readAD   []byte
+	rawBuf   []byte
+	rawStart int
+	rawEnd   int
+
+	onTicket func(ticket, psk []byte)
+
+	timerMu       sync.Mutex
+	idleTimer     clock.Timer
+	lifetimeTimer clock.Timer
+
+	closeOnce   sync.Once
+	closeMu     sync.Mutex
+	closeReason error
+	closeErr    error
+}
+
+// Protocol returns the negotiated protocol.
+func (c *Conn) Protocol() *nyquist.Protocol {
+	return c.protocol
+}
+
+// RemoteStatic returns the peer's static public key, if any.
+func (c *Conn) RemoteStatic() dh.PublicKey {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	return c.remoteStatic
+}
+
+// HandshakeHash returns the handshake hash of the most recent handshake.
+func (c *Conn) HandshakeHash() []byte {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	return c.handshakeHash
+}
+
+// DidResume returns true iff the handshake used a resumption ticket.
+func (c *Conn) DidResume() bool {
+	return c.didResume
+}
+
+// ConnectionState is the state of a connection, for use in authorization
+// decisions and logging.
+type ConnectionState struct {
+	// Protocol is the negotiated protocol name.
+	Protocol string
+
+	// IsClient is true iff the local side is the client.
+	IsClient bool
+
+	// RemoteStatic is the peer's static public key, if any.
+	RemoteStatic dh.PublicKey
+
+	// HandshakeHash is the handshake hash of the most recent handshake.
+	HandshakeHash []byte
+
+	// DidResume is true iff the initial handshake used a resumption ticket.
+	DidResume bool
+
+	// Rekeys is the number of traffic key updates, in both directions.
+	Rekeys uint64
+
+	// Renegotiations is the number of completed renegotiations.
+	Renegotiations uint64
+
+	// SourceAddr is the original source address from the PROXY protocol
+	// header, if any.
+	SourceAddr net.Addr
+
+	// KeyEscrowed is true iff the session keys of the most recent
+	// handshake were emitted to a key escrow recipient.
+	KeyEscrowed bool
+}
+
+// ConnectionState returns the state of the connection.  It is safe to call
+// concurrently with other methods.
+func (c *Conn) ConnectionState() ConnectionState {
+	c.stateMu.Lock()
+	remoteStatic, handshakeHash, keyEscrowed := c.remoteStatic, c.handshakeHash, c.keyEscrowed
+	c.stateMu.Unlock()
+
+	var protocolName string
+	if c.protocol != nil {
+		protocolName = c.protocol.String()
+	}
+
+	return ConnectionState{
+		Protocol:       protocolName,
+		IsClient:       c.isClient,
+		RemoteStatic:   remoteStatic,
+		HandshakeHash:  append([]byte{}, handshakeHash...),
+		DidResume:      c.didResume,
+		Rekeys:         atomic.LoadUint64(&c.inStats.rekeys) + atomic.LoadUint64(&c.outStats.rekeys),
+		Renegotiations: atomic.LoadUint64(&c.renegotiations),
+		SourceAddr:     c.sourceAddr,
+		KeyEscrowed:    keyEscrowed,
+	}
+}
+
+// Read reads data from the connection.  If the next record has associated
+// data, ErrADRequired is returned, and the record must be read with
+// ReadWithAD instead.
+func (c *Conn) Read(p []byte) (int, error) {
+	if err := c.ensureHandshake(); err != nil {
+		return 0, err
+	}
+
+	c.in.Lock()
+	defer c.in.Unlock()
+
+	if err := c.fillReadBuf(); err != nil {
+		return 0, err
+	}
+	if len(c.readAD) != 0 {
+		return 0, ErrADRequired
+	}
+
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+
+	return n, nil
+}
+
+// ReadWithAD reads data from the connection, along with the record's
+// cleartext associated data.  The data returned by each call is from a
+// single record, so a record larger than p will be returned across
+// multiple calls, each returning the record's associated data.
+func (c *Conn) ReadWithAD(p []byte) (int, []byte, error) {
+	if err := c.ensureHandshake(); err != nil {
+		return 0, nil, err
+	}
+
+	c.in.Lock()
+	defer c.in.Unlock()
+
+	if err := c.fillReadBuf(); err != nil {
+		return 0, nil, err
+	}
+
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+
+	return n, c.readAD, nil
+}
+
+// ReadRecord returns the (remaining) data of the next record, along with
+// the record's cleartext associated data, without copying.  Records are
+// decrypted in place, so the returned data is a view into the connection's
+// receive buffer, and is only valid until the next call to a read method.
+func (c *Conn) ReadRecord() ([]byte, []byte, error) {
+	if err := c.ensureHandshake(); err != nil {
+		return nil, nil, err
+	}
+
+	c.in.Lock()
+	defer c.in.Unlock()
+
+	if err := c.fillReadBuf(); err != nil {
+		return nil, nil, err
+	}
+
+	b := c.readBuf
+	c.readBuf = nil
+
+	return b, c.readAD, nil
+}
+
+// fillReadBuf processes records until application data is available.
+// The caller must hold c.in.
+func (c *Conn) fillReadBuf() error {
+	for len(c.readBuf) == 0 {
+		if c.in.err != nil {
+			return c.in.err
+		}
+
+		recordType, ad, body, err := c.readRecord()
+		if err != nil {
+			if reason := c.getCloseReason(); reason != nil {
+				err = reason
+			} else if isTimeout(err) {
+				// Partial frames are buffered, so reads may be retried.
+				return err
+			}
+			c.in.err = err
+			continue
+		}
+		c.touch()
+		c.inStats.onRecord(c.in.cs, recordType, len(body), c.now())
+
+		if len(ad) != 0 && recordType != recordTypeData {
+			c.in.err = errMalformedRecord
+			continue
+		}
+
+		switch recordType {
+		case recordTypeData:
+			// The body is decrypted in place in the receive buffer, but
+			// the associated data may be retained by the caller.
+			c.readBuf, c.readAD = body, nil
+			if len(ad) != 0 {
+				c.readAD = append([]byte{}, ad...)
+			}
+		case recordTypeTicket:
+			if c.isClient && c.onTicket != nil && len(body) == ticketSize {
+				c.onTicket(append([]byte{}, body...), c.getResumptionPSK())
+			}
+		case recordTypeClose:
+			c.in.err = io.EOF
+		case recordTypeKeyUpdate:
+			if len(body) != 0 {
+				c.in.err = errMalformedRecord
+				continue
+			}
+			if err := c.in.cs.Rekey(); err != nil {
+				c.in.err = err
+				continue
+			}
+			c.onRekey(&c.in, RekeyKeyUpdate)
+		case recordTypeRenegotiate:
+			c.in.err = c.onRenegotiate(body)
+		case recordTypeChangeKeys:
+			c.in.err = c.onChangeKeys(body)
+		case recordTypeControl:
+			c.in.err = c.onControl(body)
+		default:
+			c.in.err = errMalformedRecord
+		}
+	}
+
+	return nil
+}
+
+func (c *Conn) readRecord() (byte, []byte, []byte, error) {
+	frame, err := c.readRawFrame()
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if len(frame) < 1 || len(frame) < 1+int(frame[0]) {
+		return 0, nil, nil, errMalformedRecord
+	}
+
+	var ad []byte
+	if adLen := int(frame[0]); adLen > 0 {
+		ad = frame[1 : 1+adLen]
+	}
+	ciphertext := frame[1+len(ad):]
+
+	plaintext, err := c.in.cs.DecryptWithAd(ciphertext[:0], ad, ciphertext)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if len(plaintext) == 0 {
+		return 0, nil, nil, errMalformedRecord
+	}
+
+	return plaintext[0], ad, plaintext[1:], nil
+}
+
+// readRawFrame reads the next length prefixed frame from the underlying
+// connection.  Partially read frames are retained across calls, so that
+// errors such as timeouts are recoverable.
+//
+// The returned frame is a view into the receive buffer, that is only valid
+// until the next call.
+func (c *Conn) readRawFrame() ([]byte, error) {
+	if c.rawBuf == nil {
+		c.rawBuf = make([]byte, 2+maxFrameSize)
+	}
+
+	for {
+		avail := c.rawBuf[c.rawStart:c.rawEnd]
+		need := 2
+		if len(avail) >= 2 {
+			need += int(binary.BigEndian.Uint16(avail))
+			if len(avail) >= need {
+				frame := avail[2:need]
+				c.rawStart += need
+				if c.rawStart == c.rawEnd {
+					c.rawStart, c.rawEnd = 0, 0
+				}
+				return frame, nil
+			}
+		}
+
+		if need > len(c.rawBuf)-c.rawStart {
+			c.rawEnd = copy(c.rawBuf, avail)
+			c.rawStart = 0
+		}
+
+		n, err := c.conn.Read(c.rawBuf[c.rawEnd:])
+		c.rawEnd += n
+		if err != nil {
+			if err == io.EOF {
+				// The peer must send a close record first.
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+}
+
+// Write writes data to the connection.
+func (c *Conn) Write(p []byte) (int, error) {
+	return c.write(nil, p)
+}
+
+// WriteWithAD writes data to the connection, with cleartext associated
+// data that is sent alongside, and authenticated with each record.  The
+// peer must read the data with ReadWithAD.  As each record carries the
+// associated data, len(ad) may be at most MaxADSize.
+func (c *Conn) WriteWithAD(ad, p []byte) (int, error) {
+	if len(ad) > MaxADSize {
+		return 0, errADSize
+	}
+	return c.write(ad, p)
+}
+
+func (c *Conn) write(ad, p []byte) (int, error) {
+	if err := c.ensureHandshake(); err != nil {
+		return 0, err
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	if c.cfg.WriteBufferSize > 0 {
+		if len(ad) == 0 {
+			return c.bufferWrite(p)
+		}
+		if err := c.flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	return c.writeData(ad, p)
+}
+
+// writeData writes p as one or more data records.  The caller must hold
+// c.out.
+func (c *Conn) writeData(ad, p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if c.out.err != nil {
+			return n, c.out.err
+		}
+		if c.out.err = c.maybeUpdateKey(); c.out.err != nil {
+			return n, c.out.err
+		}
+
+		toWrite := len(p)
+		if maxPayload := c.maxRecordPayload(len(ad)); toWrite > maxPayload {
+			toWrite = maxPayload
+		}
+		if err := c.writeRecordWithAD(recordTypeData, ad, p[:toWrite]); err != nil {
+			if reason := c.getCloseReason(); reason != nil {
+				err = reason
+			}
+			c.out.err = err
+			return n, err
+		}
+		c.touch()
+		n += toWrite
+		p = p[toWrite:]
+	}
+
+	return n, nil
+}
+
+// ReadFrom implements io.ReaderFrom.  Data is read from r in record sized
+// chunks, and each chunk is sent as a single record.  The connection is
+// only locked while each record is written, so a blocked r does not
+// prevent the connection from being closed.
+func (c *Conn) ReadFrom(r io.Reader) (int64, error) {
+	if err := c.ensureHandshake(); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, c.maxRecordPayload(0))
+	defer zero(buf)
+
+	var n int64
+	for {
+		nr, rErr := r.Read(buf)
+		if nr > 0 {
+			c.out.Lock()
+			err := c.flush()
+			if err == nil {
+				_, err = c.writeData(nil, buf[:nr])
+			}
+			c.out.Unlock()
+			if err != nil {
+				return n, err
+			}
+			n += int64(nr)
+		}
+
+		switch rErr {
+		case nil:
+		case io.EOF:
+			return n, nil
+		default:
+			return n, rErr
+		}
+	}
+}
+
+// WriteTo implements io.WriterTo.  Decrypted records are written to w one
+// at a time, and the connection is only locked while each record is read,
+// so a blocked w does not prevent the connection from being closed.  It
+// returns when the peer closes the connection, or on error.
+func (c *Conn) WriteTo(w io.Writer) (int64, error) {
+	if err := c.ensureHandshake(); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, c.recordPayloadLimit(0))
+	defer zero(buf)
+
+	var n int64
+	for {
+		c.in.Lock()
+		err := c.fillReadBuf()
+		if err == nil && len(c.readAD) != 0 {
+			err = ErrADRequired
+		}
+		var nr int
+		if err == nil {
+			nr = copy(buf, c.readBuf)
+			c.readBuf = c.readBuf[nr:]
+		}
+		c.in.Unlock()
+
+		switch err {
+		case nil:
+		case io.EOF:
+			return n, nil
+		default:
+			return n, err
+		}
+
+		nw, err := w.Write(buf[:nr])
+		n += int64(nw)
+		if err != nil {
+			return n, err
+		}
+		if nw != nr {
+			return n, io.ErrShortWrite
+		}
+	}
+}
+
+// recordPayloadLimit returns the maximum record payload that fits in a
+// frame, with the negotiated cipher.
+func (c *Conn) recordPayloadLimit(adLen int) int {
+	return c.protocol.Cipher.MaxPlaintextSize() - recordOverhead - adLen
+}
+
+func (c *Conn) maxRecordPayload(adLen int) int {
+	maxPayload := c.recordPayloadLimit(adLen)
+	if sz := c.cfg.MaxRecordSize; sz > 0 && sz < maxPayload {
+		maxPayload = sz
+	}
+	return maxPayload
+}
+
+func (c *Conn) writeRecord(recordType byte, body []byte) error {
+	return c.writeRecordWithAD(recordType, nil, body)
+}
+
+func (c *Conn) writeRecordWithAD(recordType byte, ad, body []byte) error {
+	plaintext := make([]byte, 0, 1+len(body))
+	plaintext = append(plaintext, recordType)
+	plaintext = append(plaintext, body...)
+
+	frame := make([]byte, 3, 3+len(ad)+len(plaintext)+c.protocol.Cipher.Overhead())
+	frame[2] = byte(len(ad))
+	frame = append(frame, ad...)
+	frame, err := c.out.cs.EncryptWithAd(frame, ad, plaintext)
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint16(frame, uint16(len(frame)-2))
+
+	if _, err = c.conn.Write(frame); err != nil {
+		return err
+	}
+	c.outStats.onRecord(c.out.cs, recordType, len(body), c.now())
+
+	return nil
+}
+
+// Close flushes any buffered data, sends an authenticated close record,
+// and closes the connection.
+func (c *Conn) Close() error {
+	return c.closeWithError(errClosed)
+}
+
+// CloseWrite flushes any buffered data, sends an authenticated close record
+// indicating that no more data will be written, and shuts down the writing
+// side of the underlying connection if supported.  Data may continue to be
+// read until the peer closes its writing side.
+func (c *Conn) CloseWrite() error {
+	if err := c.ensureHandshake(); err != nil {
+		return err
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	if err := c.flush(); err != nil {
+		return err
+	}
+	if err := c.writeRecord(recordTypeClose, nil); err != nil {
+		c.out.err = err
+		return err
+	}
+	c.out.err = errWriteClosed
+
+	if cw, ok := c.conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *Conn) closeWithError(reason error) error {
+	c.closeOnce.Do(func() {
+		c.stopTimers()
+
+		c.closeMu.Lock()
+		c.closeReason = reason
+		c.closeMu.Unlock()
+
+		// Unblock any pending writes, and send the close record.
+		_ = c.conn.SetWriteDeadline(time.Now().Add(closeNotifyTimeout))
+		c.out.Lock()
+		if c.out.err == nil && c.out.cs != nil && c.flush() == nil {
+			_ = c.writeRecord(recordTypeClose, nil)
+		}
+		c.out.Unlock()
+
+		c.closeErr = c.conn.Close()
+		c.in.reset(reason)
+		c.out.reset(reason)
+		c.resetRenegotiation()
+
+		c.stateMu.Lock()
+		zero(c.resumptionPSK)
+		c.stateMu.Unlock()
+	})
+	return c.closeErr
+}
+
+func (c *Conn) getCloseReason() error {
+	c.closeMu.Lock()
+	defer c.closeMu.Unlock()
+
+	return c.closeReason
+}
+
+// LocalAddr returns the local network address.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines associated with the
+// connection.  A zero value for t means Read and Write will not time out.
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline on the underlying connection.
+// A zero value for t means Read will not time out.  Reads that time out
+// may be retried, as partially received records are buffered.  Reads that
+// can be satisfied from already decrypted data will succeed regardless
+// of the deadline.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline on the underlying connection.
+// A zero value for t means Write will not time out.  After a Write has
+// timed out, the connection state is corrupt and all future writes will
+// return the same error.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+func (c *Conn) newHandshake(protocol *nyquist.Protocol, negData []byte, psks [][]byte, remoteStatic dh.PublicKey) (*nyquist.HandshakeState, error) {
+	if protocol.Pattern.IsOneWay() {
+		return nil, errOneWay
+	}
+
+	prologue := make([]byte, 0, len(prologuePrefix)+2+len(negData)+len(c.cfg.Prologue))
+	prologue = append(prologue, prologuePrefix...)
+	prologue = append(prologue, byte(len(negData)>>8), byte(len(negData)))
+	prologue = append(prologue, negData...)
+	prologue = append(prologue, c.cfg.Prologue...)
+
+	return nyquist.NewHandshake(&nyquist.HandshakeConfig{
+		Protocol:      protocol,
+		Prologue:      prologue,
+		LocalStatic:   c.cfg.LocalStatic,
+		RemoteStatic:  remoteStatic,
+		PreSharedKeys: psks,
+		Rng:           c.cfg.Rng,
+		EnableASK:     true,
+		IsInitiator:   c.isClient,
+
+		ExportTrafficKeys: c.cfg.KeyEscrow != nil,
+	})
+}
+
+func (c *Conn) clientHandshake(ticket []byte) error {
+	protocol := c.cfg.Protocol
+	if protocol == nil {
+		return nyquist.ErrInvalidConfig
+	}
+	var appData []byte
+	if c.cfg.NegotiationData != nil {
+		var err error
+		if appData, err = c.cfg.NegotiationData(); err != nil {
+			return err
+		}
+	}
+	negData, err := encodeNegData(protocol.String(), ticket, appData)
+	if err != nil {
+		return err
+	}
+
+	hs, err := c.newHandshake(protocol, negData, c.cfg.PreSharedKeys, c.cfg.RemoteStatic)
+	if err != nil {
+		return err
+	}
+	defer hs.Reset()
+
+	c.protocol = protocol
+	c.didResume = ticket != nil
+
+	return c.runHandshake(hs, 0, negData)
+}
+
+func (c *Conn) serverHandshake() error {
+	if c.cfg.ProxyProtocol {
+		sourceAddr, err := readProxyHeader(c.conn)
+		if err != nil {
+			return err
+		}
+		c.sourceAddr = sourceAddr
+	}
+
+	negData, msg, err := readHandshakeFrame(c.conn)
+	if err != nil {
+		return err
+	}
+
+	hs, err := c.serverTrialHandshake(negData, msg)
+	if err != nil {
+		// Let the client know so that it can fall back, if possible.
+		_ = writeHandshakeFrame(c.conn, rejectNegData, nil)
+		return err
+	}
+	defer hs.Reset()
+
+	return c.runHandshake(hs, 1, nil)
+}
+
+// serverTrialHandshake selects the suite used for the connection, by
+// processing the client's first handshake message with each suite that
+// accepts the requested protocol, in order.
+func (c *Conn) serverTrialHandshake(negData, msg []byte) (*nyquist.HandshakeState, error) {
+	protocolName, _, appData, err := decodeNegData(negData)
+	if err != nil {
+		return nil, err
+	}
+	if c.cfg.OnNegotiationData != nil {
+		if err = c.cfg.OnNegotiationData(appData); err != nil {
+			return nil, err
+		}
+	}
+	suites := c.cfg.serverSuites(protocolName)
+	if len(suites) == 0 {
+		return nil, errUnsupportedProtocol
+	}
+
+	var tickets ticketLookup
+	baseCfg := c.cfg
+	for _, suite := range suites {
+		c.cfg = suite
+
+		var hs *nyquist.HandshakeState
+		if hs, err = c.serverNewHandshake(negData, &tickets); err != nil {
+			continue
+		}
+		if _, err = hs.ReadMessage(nil, msg); err == nil || err == nyquist.ErrDone {
+			return hs, nil
+		}
+		hs.Reset()
+	}
+	c.cfg = baseCfg
+
+	return nil, err
+}
+
+// ticketLookup memoizes the resumption PSK lookups of the trial
+// handshakes, as TicketStore.Get consumes the ticket, and suites may share
+// a TicketStore.
+type ticketLookup struct {
+	stores []TicketStore
+	psks   [][]byte
+}
+
+func (tl *ticketLookup) get(store TicketStore, ticket []byte) ([]byte, bool) {
+	for i, v := range tl.stores {
+		if v == store {
+			return tl.psks[i], tl.psks[i] != nil
+		}
+	}
+
+	psk, ok := store.Get(ticket)
+	if !ok {
+		psk = nil
+	}
+	tl.stores = append(tl.stores, store)
+	tl.psks = append(tl.psks, psk)
+
+	return psk, ok
+}
+
+func (c *Conn) serverNewHandshake(negData []byte, tickets *ticketLookup) (*nyquist.HandshakeState, error) {
+	protocolName, ticket, _, err := decodeNegData(negData)
+	if err != nil {
+		return nil, err
+	}
+
+	protocol := c.cfg.acceptProtocol(protocolName)
+	if protocol == nil {
+		return nil, errUnsupportedProtocol
+	}
+
+	psks := c.cfg.PreSharedKeys
+	if ticket != nil {
+		if c.cfg.TicketStore == nil || protocol.Pattern.NumPSKs() != 1 {
+			return nil, errInvalidTicket
+		}
+		psk, ok := tickets.get(c.cfg.TicketStore, ticket)
+		if !ok {
+			return nil, errInvalidTicket
+		}
+		psks = [][]byte{psk}
+	}
+
+	c.protocol = protocol
+	c.didResume = ticket != nil
+
+	return c.newHandshake(protocol, negData, psks, c.cfg.RemoteStatic)
+}
+
+func (c *Conn) runHandshake(hs *nyquist.HandshakeState, idx int, negData []byte) error {
+	var err error
+	for ; err != nyquist.ErrDone; idx++ {
+		if (idx&1 == 0) == c.isClient {
+			var frameNegData []byte
+			switch idx {
+			case 0:
+				frameNegData = negData
+			case 1:
+				if frameNegData, err = c.serverNegData(hs); err != nil {
+					return err
+				}
+			}
+			var msg []byte
+			if msg, err = hs.WriteMessage(nil, nil); err != nil && err != nyquist.ErrDone {
+				return err
+			}
+			if wrErr := writeHandshakeFrame(c.conn, frameNegData, msg); wrErr != nil {
+				return wrErr
+			}
+		} else {
+			peerNegData, msg, rdErr := readHandshakeFrame(c.conn)
+			if rdErr != nil {
+				return rdErr
+			}
+			if idx == 1 && c.isClient {
+				if err = c.onServerNegData(hs, peerNegData); err != nil {
+					return err
+				}
+			} else if len(peerNegData) != 0 {
+				return errMalformedNegData
+			}
+			if _, err = hs.ReadMessage(nil, msg); err != nil && err != nyquist.ErrDone {
+				return err
+			}
+		}
+	}
+
+	status := hs.GetStatus()
+	c.in.cs, c.out.cs = c.splitCipherStates(status)
+	c.setHandshakeStatus(status)
+	if err = c.escrowKeys(status); err != nil {
+		return err
+	}
+
+	if !c.isClient && c.cfg.TicketStore != nil {
+		return c.issueTicket()
+	}
+
+	return nil
+}
+
+// serverNegData returns the negotiation data for the server's first
+// response, binding it into the handshake if it is non-empty.
+func (c *Conn) serverNegData(hs *nyquist.HandshakeState) ([]byte, error) {
+	if c.cfg.NegotiationData == nil {
+		return nil, nil
+	}
+	appData, err := c.cfg.NegotiationData()
+	if err != nil || len(appData) == 0 {
+		return nil, err
+	}
+
+	negData := append([]byte{negDataApp}, appData...)
+	hs.SymmetricState().MixHash(negData)
+
+	return negData, nil
+}
+
+// onServerNegData handles the negotiation data of the server's first
+// response, binding it into the handshake if it is non-empty.
+func (c *Conn) onServerNegData(hs *nyquist.HandshakeState, negData []byte) error {
+	var appData []byte
+	if len(negData) != 0 {
+		switch {
+		case bytes.Equal(negData, rejectNegData):
+			return ErrRejected
+		case negData[0] != negDataApp:
+			return errMalformedNegData
+		}
+		appData = negData[1:]
+		hs.SymmetricState().MixHash(negData)
+	}
+	if c.cfg.OnNegotiationData != nil {
+		return c.cfg.OnNegotiationData(appData)
+	}
+	return nil
+}
+
+// splitCipherStates returns the inbound and outbound CipherStates of a
+// completed handshake.
+func (c *Conn) splitCipherStates(status *nyquist.HandshakeStatus) (*nyquist.CipherState, *nyquist.CipherState) {
+	cs := status.CipherStates
+	if c.isClient {
+		return cs[1], cs[0]
+	}
+	return cs[0], cs[1]
+}
+
+// setHandshakeStatus updates the connection state from the status of a
+// completed handshake.
+func (c *Conn) setHandshakeStatus(status *nyquist.HandshakeStatus) {
+	ask := nyquist.DeriveASK(c.protocol.Hash, status.ASKMaster, resumptionASK)
+	zero(status.ASKMaster)
+
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	c.remoteStatic = status.RemoteStatic
+	c.handshakeHash = status.HandshakeHash
+	zero(c.resumptionPSK)
+	c.resumptionPSK = append([]byte{}, ask[:nyquist.PreSharedKeySize]...)
+	zero(ask)
+}
+
+func (c *Conn) issueTicket() error {
+	ticket := make([]byte, ticketSize)
+	if _, err := io.ReadFull(rand.Reader, ticket); err != nil {
+		return err
+	}
+	if err := c.cfg.TicketStore.Put(ticket, c.getResumptionPSK()); err != nil {
+		return err
+	}
+	return c.writeRecord(recordTypeTicket, ticket)
+}
+
+func newConn(conn net.Conn, cfg *Config, isClient bool) *Conn {
+	return &Conn{
+		conn:     conn,
+		cfg:      cfg,
+		isClient: isClient,
+	}
+}
+
+// Client returns a new client side transport connection, using conn as the
+// underlying transport, after completing the handshake.
+func Client(conn net.Conn, cfg *Config) (*Conn, error) {
+	return ClientContext(context.Background(), conn, cfg)
+}
+
+// Server returns a new server side transport connection, using conn as the
+// underlying transport, after completing the handshake.
+func Server(conn net.Conn, cfg *Config) (*Conn, error) {
+	return ServerContext(context.Background(), conn, cfg)
+}
+
+// Dial connects to the given network address using net.Dial, and then
+// completes the handshake.
+func Dial(network, address string, cfg *Config) (*Conn, error) {
+	return DialContext(context.Background(), network, address, cfg)
+}
+
+func encodeNegData(protocolName string, ticket, appData []byte) ([]byte, error) {
+	if len(protocolName) > 0xff || len(ticket) > 0xff || len(appData) > 0xffff {
+		return nil, errMalformedNegData
+	}
+
+	b := make([]byte, 0, 2+len(protocolName)+len(ticket)+2+len(appData))
+	b = append(b, byte(len(protocolName)))
+	b = append(b, protocolName...)
+	b = append(b, byte(len(ticket)))
+	b = append(b, ticket...)
+	if len(appData) > 0 {
+		b = append(b, byte(len(appData)>>8), byte(len(appData)))
+		b = append(b, appData...)
+	}
+	return b, nil
+}
+
+func decodeNegData(b []byte) (string, []byte, []byte, error) {
+	if len(b) < 1 || len(b) < 1+int(b[0])+1 {
+		return "", nil, nil, errMalformedNegData
+	}
+	protocolName, b := string(b[1:1+b[0]]), b[1+b[0]:]
+	if len(b) < 1+int(b[0]) {
+		return "", nil, nil, errMalformedNegData
+	}
+
+	var ticket []byte
+	if b[0] > 0 {
+		ticket = b[1 : 1+b[0]]
+	}
+	b = b[1+b[0]:]
+
+	// The application data is optional, and omitted entirely if empty.
+	var appData []byte
+	if len(b) > 0 {
+		if len(b) <= 2 || len(b) != 2+int(binary.BigEndian.Uint16(b)) {
+			return "", nil, nil, errMalformedNegData
+		}
+		appData = b[2:]
+	}
+	return protocolName, ticket, appData, nil
+}
+
+func writeHandshakeFrame(w io.Writer, negData, msg []byte) error {
+	if len(negData) > maxFrameSize || len(msg) > maxFrameSize {
+		return nyquist.ErrMessageSize
+	}
+
+	b := make([]byte, 0, 4+len(negData)+len(msg))
+	b = append(b, byte(len(negData)>>8), byte(len(negData)))
+	b = append(b, negData...)
+	b = append(b, byte(len(msg)>>8), byte(len(msg)))
+	b = append(b, msg...)
+
+	_, err := w.Write(b)
+	return err
+}
+
+func readHandshakeFrame(r io.Reader) ([]byte, []byte, error) {
+	negData, err := readFrame(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, err := readFrame(r)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, nil, err
+	}
+	return negData, msg, nil
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var aLongTimeAgo = time.Unix(1, 0)
+
+// ContextNetDialer is the optional interface implemented by NetDialers
+// that support dialing with a context.
+type ContextNetDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// handshakeContext runs fn, a handshake over conn, such that it is bounded
+// by the context's deadline and is interrupted on cancellation.  The
+// deadline on conn is cleared once fn returns.
+func handshakeContext(ctx context.Context, conn net.Conn, fn func() error) (err error) {
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+		defer func() {
+			_ = conn.SetDeadline(time.Time{})
+		}()
+	}
+
+	if ctx.Done() != nil {
+		doneCh := make(chan struct{})
+		interruptCh := make(chan error, 1)
+		defer func() {
+			close(doneCh)
+			if ctxErr := <-interruptCh; ctxErr != nil {
+				// The handshake was interrupted, report why.
+				err = ctxErr
+				_ = conn.SetDeadline(time.Time{})
+			}
+		}()
+		go func() {
+			select {
+			case <-ctx.Done():
+				_ = conn.SetDeadline(aLongTimeAgo)
+				interruptCh <- ctx.Err()
+			case <-doneCh:
+				interruptCh <- nil
+			}
+		}()
+	}
+
+	if err = fn(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		// The conn's deadline may expire before the context notices.
+		if deadline, ok := ctx.Deadline(); ok && isTimeout(err) && !time.Now().Before(deadline) {
+			return context.DeadlineExceeded
+		}
+	}
+	return err
+}
+
+// ClientContext returns a new client side transport connection, using conn
+// as the underlying transport, after completing the handshake.
+//
+// If the context expires or is canceled before the handshake completes,
+// the handshake is aborted and the context's error is returned.  Any
+// deadline on conn is cleared on return.
+func ClientContext(ctx context.Context, conn net.Conn, cfg *Config) (*Conn, error) {
+	return newClientContext(ctx, conn, cfg, nil)
+}
+
+func newClientContext(ctx context.Context, conn net.Conn, cfg *Config, ticket []byte) (*Conn, error) {
+	c := newConn(conn, cfg, true)
+	c.ticket = ticket
+	if err := c.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ServerContext returns a new server side transport connection, using conn
+// as the underlying transport, after completing the handshake.
+//
+// If the context expires or is canceled before the handshake completes,
+// the handshake is aborted and the context's error is returned.  Any
+// deadline on conn is cleared on return.
+func ServerContext(ctx context.Context, conn net.Conn, cfg *Config) (*Conn, error) {
+	c := newConn(conn, cfg, false)
+	if err := c.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClient returns a new client side transport connection, using conn as
+// the underlying transport, without completing the handshake.  The
+// handshake is completed on the first I/O, or by calling Handshake.
+func NewClient(conn net.Conn, cfg *Config) *Conn {
+	return newConn(conn, cfg, true)
+}
+
+// NewServer returns a new server side transport connection, using conn as
+// the underlying transport, without completing the handshake.  The
+// handshake is completed on the first I/O, or by calling Handshake.
+func NewServer(conn net.Conn, cfg *Config) *Conn {
+	return newConn(conn, cfg, false)
+}
+
+// Handshake completes the handshake, if it has not yet been completed.
+// Most callers do not need to call this explicitly, as the handshake is
+// completed on the first I/O.
+func (c *Conn) Handshake() error {
+	return c.HandshakeContext(context.Background())
+}
+
+// HandshakeContext completes the handshake, if it has not yet been
+// completed, bounded by the context.  A failed handshake is not retried,
+// and subsequent calls return the same error.
+func (c *Conn) HandshakeContext(ctx context.Context) error {
+	c.handshakeMu.Lock()
+	defer c.handshakeMu.Unlock()
+
+	if c.handshakeDone {
+		return c.handshakeErr
+	}
+	c.handshakeDone = true
+
+	fn := c.serverHandshake
+	if c.isClient {
+		fn = func() error {
+			return c.clientHandshake(c.ticket)
+		}
+	}
+
+	c.handshakeStarted = c.now()
+	if c.handshakeErr = handshakeContext(ctx, c.conn, fn); c.handshakeErr != nil {
+		return c.handshakeErr
+	}
+	c.startTimers()
+	atomic.StoreUint32(&c.handshakeComplete, 1)
+
+	return nil
+}
+
+func (c *Conn) ensureHandshake() error {
+	if atomic.LoadUint32(&c.handshakeComplete) == 1 {
+		return nil
+	}
+	return c.Handshake()
+}
+
+// DialContext connects to the given network address using net.Dialer,
+// and then completes the handshake, with both bounded by the context.
+func DialContext(ctx context.Context, network, address string, cfg *Config) (*Conn, error) {
+	var d net.Dialer
+	rawConn, err := d.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := ClientContext(ctx, rawConn, cfg)
+	if err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,201 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshakeContext(t *testing.T) {
+	serverStatic, clientStatic := mustKeypair(t), mustKeypair(t)
+	protoXX := mustProtocol(t, "Noise_XX_25519_ChaChaPoly_BLAKE2s")
+	clientCfg := &Config{
+		Protocol:    protoXX,
+		LocalStatic: clientStatic,
+	}
+
+	// A server that accepts connections, but never responds.
+	blackHole, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "net.Listen")
+	defer blackHole.Close()
+	go func() {
+		for {
+			conn, err := blackHole.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	t.Run("Deadline", func(t *testing.T) {
+		require := require.New(t)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		_, err := DialContext(ctx, "tcp", blackHole.Addr().String(), clientCfg)
+		require.Equal(context.DeadlineExceeded, err, "DialContext")
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		require := require.New(t)
+
+		rawConn, err := net.Dial("tcp", blackHole.Addr().String())
+		require.NoError(err, "net.Dial")
+		defer rawConn.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+
+		_, err = ClientContext(ctx, rawConn, clientCfg)
+		require.Equal(context.Canceled, err, "ClientContext")
+
+		_, err = ClientContext(ctx, rawConn, clientCfg)
+		require.Equal(context.Canceled, err, "ClientContext - already canceled")
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		require := require.New(t)
+
+		l := startEchoServer(t, &Config{
+			Protocol:    protoXX,
+			LocalStatic: serverStatic,
+		})
+		defer l.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+		defer cancel()
+
+		conn, err := (&Dialer{Config: clientCfg}).DialContext(ctx, "tcp", l.Addr().String())
+		require.NoError(err, "Dialer.DialContext")
+		defer conn.Close()
+
+		// The context's deadline must not apply after the handshake.
+		<-ctx.Done()
+		echo(t, conn, []byte("after deadline"))
+	})
+}
+
+func TestLazyHandshake(t *testing.T) {
+	serverStatic, clientStatic := mustKeypair(t), mustKeypair(t)
+	protoXX := mustProtocol(t, "Noise_XX_25519_ChaChaPoly_BLAKE2s")
+
+	newRawPair := func(t *testing.T) (net.Conn, net.Conn) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err, "net.Listen")
+		defer l.Close()
+
+		connCh := make(chan net.Conn, 1)
+		go func() {
+			conn, _ := l.Accept()
+			connCh <- conn
+		}()
+
+		client, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err, "net.Dial")
+		server := <-connCh
+		require.NotNil(t, server, "Accept")
+
+		return server, client
+	}
+
+	t.Run("FirstIO", func(t *testing.T) {
+		require := require.New(t)
+
+		rawServer, rawClient := newRawPair(t)
+		server := NewServer(rawServer, &Config{
+			Protocol:    protoXX,
+			LocalStatic: serverStatic,
+		})
+		defer server.Close()
+		client := NewClient(rawClient, &Config{
+			Protocol:    protoXX,
+			LocalStatic: clientStatic,
+		})
+		defer client.Close()
+
+		require.Nil(client.HandshakeHash(), "HandshakeHash - before I/O")
+		require.Zero(client.Stats().Established, "Stats - before I/O")
+
+		errCh := make(chan error, 1)
+		go func() {
+			if err := server.Handshake(); err != nil {
+				errCh <- err
+				return
+			}
+			buf := make([]byte, 64)
+			n, err := server.Read(buf)
+			if err == nil {
+				_, err = server.Write(buf[:n])
+			}
+			errCh <- err
+		}()
+
+		msg := []byte("lazy handshake")
+		_, err := client.Write(msg)
+		require.NoError(err, "client.Write")
+		buf := make([]byte, len(msg))
+		_, err = client.Read(buf)
+		require.NoError(err, "client.Read")
+		require.Equal(msg, buf, "echo")
+		require.NoError(<-errCh, "server")
+
+		require.NoError(client.Handshake(), "Handshake - after completion")
+		require.Equal(server.HandshakeHash(), client.HandshakeHash(), "HandshakeHash")
+	})
+
+	t.Run("StickyError", func(t *testing.T) {
+		require := require.New(t)
+
+		rawServer, rawClient := newRawPair(t)
+		defer rawServer.Close()
+		client := NewClient(rawClient, &Config{
+			Protocol:    protoXX,
+			LocalStatic: clientStatic,
+		})
+		defer client.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := client.HandshakeContext(ctx)
+		require.Equal(context.Canceled, err, "HandshakeContext")
+
+		_, err = client.Write([]byte("never sent"))
+		require.Equal(context.Canceled, err, "Write - after failed handshake")
+		require.Equal(context.Canceled, client.Handshake(), "Handshake - after failed handshake")
+	})
+}
@@ -0,0 +1,92 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import "errors"
+
+const (
+	// MaxControlSize is the maximum size of a control frame payload.
+	MaxControlSize = 4096
+
+	recordTypeControl = 0x06
+)
+
+var errControlSize = errors.New("nyquist/transport: control frame too large")
+
+// WriteControl sends a typed control frame to the peer.  Control frames
+// are carried in their own record type, separate from the data stream,
+// and are delivered to the peer's Config.OnControl in order relative to
+// data.  They are intended for low-volume signaling (eg: flow control
+// hints, application keep-alives), and len(payload) may be at most
+// MaxControlSize.
+//
+// Any buffered data is flushed before the control frame is sent.
+func (c *Conn) WriteControl(typ byte, payload []byte) error {
+	if len(payload) > MaxControlSize {
+		return errControlSize
+	}
+	if err := c.ensureHandshake(); err != nil {
+		return err
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	if err := c.flush(); err != nil {
+		return err
+	}
+	if c.out.err = c.maybeUpdateKey(); c.out.err != nil {
+		return c.out.err
+	}
+
+	body := make([]byte, 0, 1+len(payload))
+	body = append(body, typ)
+	body = append(body, payload...)
+	if err := c.writeRecord(recordTypeControl, body); err != nil {
+		if reason := c.getCloseReason(); reason != nil {
+			err = reason
+		}
+		c.out.err = err
+		return err
+	}
+	c.touch()
+
+	return nil
+}
+
+func (c *Conn) onControl(body []byte) error {
+	if len(body) == 0 {
+		return errMalformedRecord
+	}
+	if c.cfg.OnControl != nil {
+		c.cfg.OnControl(body[0], body[1:])
+	}
+	return nil
+}
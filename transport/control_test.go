@@ -0,0 +1,130 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type controlFrame struct {
+	typ     byte
+	payload []byte
+}
+
+func TestControl(t *testing.T) {
+	serverStatic, clientStatic := mustKeypair(t), mustKeypair(t)
+	protoXX := mustProtocol(t, "Noise_XX_25519_ChaChaPoly_BLAKE2s")
+
+	t.Run("Interleaved", func(t *testing.T) {
+		require := require.New(t)
+
+		var frames []controlFrame
+		server, client := newTestConnPair(t, &Config{
+			Protocol:    protoXX,
+			LocalStatic: serverStatic,
+			OnControl: func(typ byte, payload []byte) {
+				frames = append(frames, controlFrame{typ, append([]byte{}, payload...)})
+			},
+		}, &Config{
+			Protocol:        protoXX,
+			LocalStatic:     clientStatic,
+			WriteBufferSize: 1024,
+		})
+		defer client.Close()
+		defer server.Close()
+
+		// Buffered data is flushed ahead of the control frame.
+		_, err := client.Write([]byte("before"))
+		require.NoError(err, "client.Write")
+		require.NoError(client.WriteControl(0x01, []byte("ping")), "client.WriteControl")
+		require.NoError(client.WriteControl(0x02, nil), "client.WriteControl - empty")
+		_, err = client.Write([]byte("after"))
+		require.NoError(err, "client.Write")
+		require.NoError(client.CloseWrite(), "client.CloseWrite")
+
+		b := make([]byte, 6)
+		_, err = io.ReadFull(server, b)
+		require.NoError(err, "server.Read - before")
+		require.Equal([]byte("before"), b, "data before control")
+		require.Empty(frames, "control frames not yet read")
+
+		b, err = io.ReadAll(server)
+		require.NoError(err, "server.Read - after")
+		require.Equal([]byte("after"), b, "data after control")
+		require.Equal([]controlFrame{
+			{0x01, []byte("ping")},
+			{0x02, []byte{}},
+		}, frames, "control frames")
+	})
+
+	t.Run("Unhandled", func(t *testing.T) {
+		require := require.New(t)
+
+		server, client := newTestConnPair(t, &Config{
+			Protocol:    protoXX,
+			LocalStatic: serverStatic,
+		}, &Config{
+			Protocol:    protoXX,
+			LocalStatic: clientStatic,
+		})
+		defer client.Close()
+		defer server.Close()
+
+		require.NoError(client.WriteControl(0x01, []byte("ignored")), "client.WriteControl")
+		_, err := client.Write([]byte("data"))
+		require.NoError(err, "client.Write")
+
+		b := make([]byte, 4)
+		_, err = io.ReadFull(server, b)
+		require.NoError(err, "server.Read")
+		require.Equal([]byte("data"), b, "data after unhandled control")
+	})
+
+	t.Run("Oversized", func(t *testing.T) {
+		require := require.New(t)
+
+		server, client := newTestConnPair(t, &Config{
+			Protocol:    protoXX,
+			LocalStatic: serverStatic,
+		}, &Config{
+			Protocol:    protoXX,
+			LocalStatic: clientStatic,
+		})
+		defer client.Close()
+		defer server.Close()
+
+		err := client.WriteControl(0x01, make([]byte, MaxControlSize+1))
+		require.Equal(errControlSize, err, "client.WriteControl - oversized")
+		require.NoError(client.WriteControl(0x01, make([]byte, MaxControlSize)), "client.WriteControl - max")
+	})
+}
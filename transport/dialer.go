@@ -0,0 +1,312 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"net/url"
+	"sync"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+// ClientSessionState is the resumption state cached by a Dialer for a
+// server.
+type ClientSessionState struct {
+	// RemoteStatic is the server's static public key, learned from a
+	// previous handshake.
+	RemoteStatic dh.PublicKey
+
+	// Ticket is the resumption ticket issued by the server, if any.
+	Ticket []byte
+
+	// PreSharedKey is the resumption PSK associated with Ticket.
+	PreSharedKey []byte
+}
+
+// ClientSessionCache is a cache of ClientSessionState objects, keyed by
+// server address.
+type ClientSessionCache interface {
+	// Get returns the ClientSessionState associated with a given key.
+	Get(key string) (*ClientSessionState, bool)
+
+	// Put adds the ClientSessionState to the cache with the given key.
+	// A nil state removes the cache entry.
+	Put(key string, state *ClientSessionState)
+}
+
+type lruEntry struct {
+	key   string
+	state *ClientSessionState
+}
+
+type lruSessionCache struct {
+	sync.Mutex
+
+	m        map[string]*list.Element
+	q        *list.List
+	capacity int
+}
+
+func (c *lruSessionCache) Get(key string) (*ClientSessionState, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if elem, ok := c.m[key]; ok {
+		c.q.MoveToFront(elem)
+		return elem.Value.(*lruEntry).state, true
+	}
+	return nil, false
+}
+
+func (c *lruSessionCache) Put(key string, state *ClientSessionState) {
+	c.Lock()
+	defer c.Unlock()
+
+	if elem, ok := c.m[key]; ok {
+		if state == nil {
+			c.q.Remove(elem)
+			delete(c.m, key)
+			return
+		}
+		elem.Value.(*lruEntry).state = state
+		c.q.MoveToFront(elem)
+		return
+	}
+	if state == nil {
+		return
+	}
+
+	if c.q.Len() >= c.capacity {
+		elem := c.q.Back()
+		c.q.Remove(elem)
+		delete(c.m, elem.Value.(*lruEntry).key)
+	}
+	c.m[key] = c.q.PushFront(&lruEntry{
+		key:   key,
+		state: state,
+	})
+}
+
+// NewLRUClientSessionCache returns a ClientSessionCache with the given
+// capacity that uses an LRU strategy.  If capacity is < 1, a default
+// capacity is used instead.
+func NewLRUClientSessionCache(capacity int) ClientSessionCache {
+	const defaultCapacity = 64
+
+	if capacity < 1 {
+		capacity = defaultCapacity
+	}
+	return &lruSessionCache{
+		m:        make(map[string]*list.Element),
+		q:        list.New(),
+		capacity: capacity,
+	}
+}
+
+// NetDialer is the interface for the underlying dialer used by Dialer.
+// If it also implements ContextNetDialer, DialContext will be used by
+// Dialer.DialContext.
+type NetDialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
+// Dialer is a transport dialer that caches the server's static public key
+// and resumption tickets, to use faster handshake patterns when
+// reconnecting.
+//
+// If a handshake using cached resumption state fails, the cached state is
+// discarded, and the connection is retried with Config.Protocol.  As the
+// server's static public key is then learned afresh and cached (trust on
+// first use), an active attacker that causes the resumption handshake to
+// fail can substitute its own static public key, unless Config.Protocol
+// authenticates the server by other means.  Set RequireCachedStatic to
+// prevent this.
+type Dialer struct {
+	// NetDialer is the underlying dialer.  If nil, a zero valued
+	// net.Dialer is used.
+	NetDialer NetDialer
+
+	// Proxy is the optional upstream proxy that the underlying connection
+	// is established through, via NetDialer.  The supported schemes are
+	// "socks5" (or "socks5h"), and "http" (HTTP CONNECT), with optional
+	// credentials in the URL's user information.  Host names are always
+	// resolved by the proxy, so this is suitable for use with Tor.
+	Proxy *url.URL
+
+	// Config is the transport configuration, Config.Protocol is used for
+	// full handshakes (eg: XX).
+	Config *Config
+
+	// ResumeProtocol is the protocol used when the server's static public
+	// key is cached (eg: IK).  If nil, cached static public keys are not
+	// used.
+	ResumeProtocol *nyquist.Protocol
+
+	// ResumePSKProtocol is the protocol used when a resumption ticket is
+	// cached (eg: IKpsk2).  It must take exactly one PSK.  If nil, cached
+	// resumption tickets are not used.
+	ResumePSKProtocol *nyquist.Protocol
+
+	// SessionCache is the resumption state cache.  If nil, resumption is
+	// disabled.
+	SessionCache ClientSessionCache
+
+	// RequireCachedStatic, if set, makes a failed handshake using a cached
+	// static public key return the error, instead of discarding the cached
+	// static public key and retrying with Config.Protocol.  Resumption
+	// tickets are still single use.  It only applies to handshakes using
+	// ResumeProtocol or ResumePSKProtocol.
+	RequireCachedStatic bool
+
+	// RetryPolicy is the policy for retrying connections that fail due to
+	// transient errors.  If nil, connections are not retried.
+	RetryPolicy *RetryPolicy
+}
+
+// Dial connects to the address on the named network, and completes the
+// handshake.
+func (d *Dialer) Dial(network, address string) (*Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address on the named network, and completes
+// the handshake, with both (including any retries) bounded by the context.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (*Conn, error) {
+	for attempt := 0; ; attempt++ {
+		conn, err := d.dialContext(ctx, network, address)
+		if err == nil || !d.RetryPolicy.shouldRetry(ctx, attempt, err) {
+			return conn, err
+		}
+		if waitErr := d.RetryPolicy.wait(ctx, attempt); waitErr != nil {
+			return nil, err
+		}
+	}
+}
+
+func (d *Dialer) dialContext(ctx context.Context, network, address string) (*Conn, error) {
+	var state *ClientSessionState
+	if d.SessionCache != nil {
+		state, _ = d.SessionCache.Get(address)
+	}
+
+	if cfg, ticket := d.resumeConfig(state); cfg != nil {
+		// Tickets are single use.
+		if ticket != nil {
+			d.SessionCache.Put(address, &ClientSessionState{
+				RemoteStatic: state.RemoteStatic,
+			})
+		}
+
+		conn, isHandshakeErr, err := d.dial(ctx, network, address, cfg, ticket)
+		if err == nil || !isHandshakeErr {
+			return conn, err
+		}
+
+		// The handshake failed, discard the cached state and retry.
+		if d.RequireCachedStatic {
+			return nil, err
+		}
+		d.SessionCache.Put(address, nil)
+	}
+
+	conn, _, err := d.dial(ctx, network, address, d.Config, nil)
+	return conn, err
+}
+
+func (d *Dialer) resumeConfig(state *ClientSessionState) (*Config, []byte) {
+	if state == nil {
+		return nil, nil
+	}
+
+	cfg := *d.Config
+	switch {
+	case state.Ticket != nil && d.ResumePSKProtocol != nil && d.ResumePSKProtocol.Pattern.NumPSKs() == 1:
+		cfg.Protocol = d.ResumePSKProtocol
+		cfg.RemoteStatic = state.RemoteStatic
+		cfg.PreSharedKeys = [][]byte{state.PreSharedKey}
+		return &cfg, state.Ticket
+	case state.RemoteStatic != nil && d.ResumeProtocol != nil:
+		cfg.Protocol = d.ResumeProtocol
+		cfg.RemoteStatic = state.RemoteStatic
+		return &cfg, nil
+	default:
+		return nil, nil
+	}
+}
+
+func (d *Dialer) dial(ctx context.Context, network, address string, cfg *Config, ticket []byte) (*Conn, bool, error) {
+	netDialer := d.NetDialer
+	if netDialer == nil {
+		netDialer = &net.Dialer{}
+	}
+
+	var (
+		rawConn net.Conn
+		err     error
+	)
+	switch ctxDialer, ok := netDialer.(ContextNetDialer); {
+	case d.Proxy != nil:
+		rawConn, err = dialUpstream(ctx, netDialer, d.Proxy, network, address)
+	case ok:
+		rawConn, err = ctxDialer.DialContext(ctx, network, address)
+	default:
+		rawConn, err = netDialer.Dial(network, address)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	conn, err := newClientContext(ctx, rawConn, cfg, ticket)
+	if err != nil {
+		rawConn.Close()
+		// Context errors are not the fault of the cached state.
+		return nil, ctx.Err() == nil, err
+	}
+
+	if d.SessionCache != nil && conn.RemoteStatic() != nil {
+		remoteStatic := conn.RemoteStatic()
+		d.SessionCache.Put(address, &ClientSessionState{
+			RemoteStatic: remoteStatic,
+		})
+		conn.onTicket = func(ticket, psk []byte) {
+			d.SessionCache.Put(address, &ClientSessionState{
+				RemoteStatic: remoteStatic,
+				Ticket:       append([]byte{}, ticket...),
+				PreSharedKey: psk,
+			})
+		}
+	}
+
+	return conn, false, nil
+}
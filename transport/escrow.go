@@ -0,0 +1,198 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"errors"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/seal"
+)
+
+var (
+	errEscrowConfig          = errors.New("nyquist/transport: invalid key escrow configuration")
+	errMalformedEscrowRecord = errors.New("nyquist/transport: malformed key escrow record")
+)
+
+// KeyEscrow is a session key escrow configuration.
+//
+// WARNING: Key escrow allows whoever holds the escrow recipient's private
+// key to decrypt all traffic on every connection established with it
+// enabled, past and future.  It exists solely for regulated environments
+// that are legally required to be able to recover traffic, and must not
+// be enabled otherwise.  The peer is NOT notified that escrow is enabled.
+type KeyEscrow struct {
+	// Seal is the configuration used to seal each EscrowRecord to the
+	// escrow recipient (`RemoteStatic`), with a one-way pattern (eg:
+	// `Noise_N_25519_ChaChaPoly_BLAKE2s`).
+	Seal *seal.Config
+
+	// Emit is called with each sealed EscrowRecord, on completion of the
+	// initial handshake and of every renegotiation.  If it returns an
+	// error, the handshake fails, so that no traffic is ever sent with
+	// keys that were not escrowed.
+	Emit func(sealed []byte) error
+}
+
+// EscrowRecord is the session secrets emitted to the escrow recipient.
+//
+// The traffic keys are the initial keys of each direction, used with
+// nonces starting from 0.  Key updates use the Noise `REKEY()` function,
+// so later keys can be derived from them, while renegotiations emit a new
+// EscrowRecord.
+type EscrowRecord struct {
+	// Protocol is the negotiated protocol name.
+	Protocol string
+
+	// IsClient is true iff the record was emitted by the client.
+	IsClient bool
+
+	// HandshakeHash is the handshake hash of the handshake.
+	HandshakeHash []byte
+
+	// ClientWriteKey is the traffic key for the client to server direction.
+	ClientWriteKey []byte
+
+	// ServerWriteKey is the traffic key for the server to client direction.
+	ServerWriteKey []byte
+}
+
+// MarshalBinary serializes the EscrowRecord.
+func (r *EscrowRecord) MarshalBinary() ([]byte, error) {
+	fields := [][]byte{[]byte(r.Protocol), r.HandshakeHash, r.ClientWriteKey, r.ServerWriteKey}
+
+	b := make([]byte, 0, 1+len(fields)+len(r.Protocol)+len(r.HandshakeHash)+2*32)
+	var flags byte
+	if r.IsClient {
+		flags |= 1
+	}
+	b = append(b, flags)
+	for _, f := range fields {
+		if len(f) > 255 {
+			return nil, errMalformedEscrowRecord
+		}
+		b = append(b, byte(len(f)))
+		b = append(b, f...)
+	}
+
+	return b, nil
+}
+
+// UnmarshalBinary deserializes the EscrowRecord.
+func (r *EscrowRecord) UnmarshalBinary(data []byte) error {
+	if len(data) < 1 || data[0] > 1 {
+		return errMalformedEscrowRecord
+	}
+	isClient := data[0] == 1
+	data = data[1:]
+
+	var fields [4][]byte
+	for i := range fields {
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return errMalformedEscrowRecord
+		}
+		fields[i] = append([]byte{}, data[1:1+int(data[0])]...)
+		data = data[1+int(data[0]):]
+	}
+	if len(data) != 0 {
+		return errMalformedEscrowRecord
+	}
+
+	*r = EscrowRecord{
+		Protocol:       string(fields[0]),
+		IsClient:       isClient,
+		HandshakeHash:  fields[1],
+		ClientWriteKey: fields[2],
+		ServerWriteKey: fields[3],
+	}
+
+	return nil
+}
+
+// OpenEscrowRecord opens a sealed EscrowRecord, with the escrow recipient's
+// seal configuration.
+func OpenEscrowRecord(cfg *seal.Config, sealed []byte) (*EscrowRecord, error) {
+	b, _, err := seal.Open(cfg, sealed)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(b)
+
+	var r EscrowRecord
+	if err = r.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// escrowKeys emits the traffic keys of a completed handshake to the
+// escrow recipient, if key escrow is enabled.
+func (c *Conn) escrowKeys(status *nyquist.HandshakeStatus) error {
+	escrow := c.cfg.KeyEscrow
+	if escrow == nil {
+		return nil
+	}
+	defer func() {
+		for _, k := range status.TrafficKeys {
+			zero(k)
+		}
+	}()
+	if escrow.Seal == nil || escrow.Emit == nil || len(status.TrafficKeys) != 2 {
+		return errEscrowConfig
+	}
+
+	r := &EscrowRecord{
+		Protocol:       c.protocol.String(),
+		IsClient:       c.isClient,
+		HandshakeHash:  status.HandshakeHash,
+		ClientWriteKey: status.TrafficKeys[0],
+		ServerWriteKey: status.TrafficKeys[1],
+	}
+	b, err := r.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	defer zero(b)
+
+	sealed, err := seal.Seal(escrow.Seal, b)
+	if err != nil {
+		return err
+	}
+	if err = escrow.Emit(sealed); err != nil {
+		return err
+	}
+
+	c.stateMu.Lock()
+	c.keyEscrowed = true
+	c.stateMu.Unlock()
+
+	return nil
+}
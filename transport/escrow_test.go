@@ -0,0 +1,188 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/seal"
+)
+
+func TestKeyEscrow(t *testing.T) {
+	protoNN := mustProtocol(t, "Noise_NN_25519_ChaChaPoly_BLAKE2s")
+	protoSeal := mustProtocol(t, "Noise_N_25519_ChaChaPoly_BLAKE2s")
+	escrowStatic := mustKeypair(t)
+
+	var (
+		mu      sync.Mutex
+		records [][]byte
+	)
+	serverCfg := &Config{
+		Protocol: protoNN,
+		KeyEscrow: &KeyEscrow{
+			Seal: &seal.Config{
+				Protocol:     protoSeal,
+				RemoteStatic: escrowStatic.Public(),
+			},
+			Emit: func(sealed []byte) error {
+				mu.Lock()
+				defer mu.Unlock()
+				records = append(records, sealed)
+				return nil
+			},
+		},
+	}
+	clientCfg := &Config{
+		Protocol: protoNN,
+	}
+	openCfg := &seal.Config{
+		Protocol:    protoSeal,
+		LocalStatic: escrowStatic,
+	}
+
+	// checkKey ensures that key is the key of cs, without altering cs.
+	checkKey := func(t *testing.T, cs *nyquist.CipherState, key []byte) {
+		aead, err := protoNN.Cipher.New(key)
+		require.NoError(t, err, "Cipher.New")
+
+		cs = cs.Clone()
+		defer cs.Reset()
+		n := cs.Nonce()
+		ct, err := cs.EncryptWithAd(nil, []byte("ad"), []byte("escrowed"))
+		require.NoError(t, err, "EncryptWithAd")
+		require.Equal(t, aead.Seal(nil, protoNN.Cipher.EncodeNonce(n), []byte("escrowed"), []byte("ad")), ct, "escrowed key")
+	}
+
+	t.Run("Handshake", func(t *testing.T) {
+		require := require.New(t)
+
+		server, client := newTestConnPair(t, serverCfg, clientCfg)
+		defer client.Close()
+		defer server.Close()
+
+		require.True(server.ConnectionState().KeyEscrowed, "KeyEscrowed - server")
+		require.False(client.ConnectionState().KeyEscrowed, "KeyEscrowed - client")
+
+		mu.Lock()
+		require.Len(records, 1, "Emit")
+		sealed := records[0]
+		mu.Unlock()
+
+		_, err := OpenEscrowRecord(&seal.Config{
+			Protocol:    protoSeal,
+			LocalStatic: mustKeypair(t),
+		}, sealed)
+		require.Error(err, "OpenEscrowRecord - wrong recipient key")
+		r, err := OpenEscrowRecord(openCfg, sealed)
+		require.NoError(err, "OpenEscrowRecord")
+		require.Equal(protoNN.String(), r.Protocol, "Protocol")
+		require.False(r.IsClient, "IsClient")
+		require.Equal(server.HandshakeHash(), r.HandshakeHash, "HandshakeHash")
+
+		client.out.Lock()
+		checkKey(t, client.out.cs, r.ClientWriteKey)
+		client.out.Unlock()
+		server.out.Lock()
+		checkKey(t, server.out.cs, r.ServerWriteKey)
+		server.out.Unlock()
+
+		// Renegotiation emits a new record.
+		go func() {
+			_, _ = io.Copy(server, server)
+		}()
+		require.NoError(client.Renegotiate(), "Renegotiate")
+		msg := []byte("after renegotiation")
+		_, err = client.Write(msg)
+		require.NoError(err, "Write")
+		_, err = io.ReadFull(client, make([]byte, len(msg)))
+		require.NoError(err, "Read")
+
+		mu.Lock()
+		require.Len(records, 2, "Emit - renegotiation")
+		sealed = records[1]
+		mu.Unlock()
+		r, err = OpenEscrowRecord(openCfg, sealed)
+		require.NoError(err, "OpenEscrowRecord - renegotiation")
+		require.Equal(server.HandshakeHash(), r.HandshakeHash, "HandshakeHash - renegotiation")
+	})
+
+	t.Run("EmitFailure", func(t *testing.T) {
+		require := require.New(t)
+
+		errEmit := errors.New("escrow unavailable")
+		cfg := *serverCfg
+		cfg.KeyEscrow = &KeyEscrow{
+			Seal: serverCfg.KeyEscrow.Seal,
+			Emit: func([]byte) error {
+				return errEmit
+			},
+		}
+
+		l := startEchoServer(t, &cfg)
+		defer l.Close()
+
+		// The server aborts the handshake, so no data is ever echoed.
+		client, err := Dial("tcp", l.Addr().String(), clientCfg)
+		if err == nil {
+			defer client.Close()
+			_, _ = client.Write([]byte("not escrowed"))
+			_, err = client.Read(make([]byte, 1))
+		}
+		require.Error(err, "Read - escrow failure")
+	})
+
+	t.Run("Record", func(t *testing.T) {
+		require := require.New(t)
+
+		r := &EscrowRecord{
+			Protocol:       protoNN.String(),
+			IsClient:       true,
+			HandshakeHash:  []byte("handshake hash"),
+			ClientWriteKey: []byte("client key"),
+			ServerWriteKey: []byte("server key"),
+		}
+		b, err := r.MarshalBinary()
+		require.NoError(err, "MarshalBinary")
+
+		var r2 EscrowRecord
+		require.NoError(r2.UnmarshalBinary(b), "UnmarshalBinary")
+		require.Equal(r, &r2, "UnmarshalBinary")
+
+		for _, bad := range [][]byte{nil, {2}, b[:len(b)-1], append(append([]byte{}, b...), 0)} {
+			require.Equal(errMalformedEscrowRecord, r2.UnmarshalBinary(bad), "UnmarshalBinary - malformed")
+		}
+	})
+}
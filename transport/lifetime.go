@@ -0,0 +1,157 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// LifetimeAction is the action taken when a connection's traffic keys
+// exceed Config.MaxLifetime.
+type LifetimeAction int
+
+const (
+	// LifetimeClose closes the connection.
+	LifetimeClose LifetimeAction = iota
+
+	// LifetimeKeyUpdate transparently updates the outgoing traffic key,
+	// by sending a key update record and calling `Rekey()`.  The peer
+	// updates its incoming traffic key on receipt of the record.
+	//
+	// As the new key is derived from the old key, compromise of the
+	// current key does not expose earlier traffic, but does expose all
+	// subsequent traffic.
+	LifetimeKeyUpdate
+
+	// LifetimeRenegotiate renegotiates the connection (see
+	// Conn.Renegotiate), so that the new traffic keys are derived from
+	// fresh ephemeral keys.  The old traffic keys remain in use until the
+	// renegotiation completes, which requires the application to be
+	// reading from the connection.  As only clients may initiate
+	// renegotiation, servers use LifetimeKeyUpdate instead.
+	LifetimeRenegotiate
+)
+
+var (
+	// ErrIdleTimeout is the error returned when a connection is closed
+	// due to Config.IdleTimeout being exceeded.
+	ErrIdleTimeout = errors.New("nyquist/transport: idle timeout")
+
+	// ErrLifetimeExceeded is the error returned when a connection is closed
+	// due to Config.MaxLifetime being exceeded.
+	ErrLifetimeExceeded = errors.New("nyquist/transport: maximum lifetime exceeded")
+)
+
+func (c *Conn) touch() {
+	if c.cfg.IdleTimeout > 0 {
+		atomic.StoreInt64(&c.lastActivity, c.now().UnixNano())
+	}
+}
+
+func (c *Conn) now() time.Time {
+	return c.cfg.clock().Now()
+}
+
+func (c *Conn) startTimers() {
+	clk := c.cfg.clock()
+	now := clk.Now()
+	c.out.keyCreated = now
+	c.established = now
+
+	c.timerMu.Lock()
+	defer c.timerMu.Unlock()
+
+	if c.cfg.IdleTimeout > 0 {
+		atomic.StoreInt64(&c.lastActivity, now.UnixNano())
+		c.idleTimer = clk.AfterFunc(c.cfg.IdleTimeout, c.onIdleTimer)
+	}
+	if c.cfg.MaxLifetime > 0 && c.cfg.LifetimeAction == LifetimeClose {
+		c.lifetimeTimer = clk.AfterFunc(c.cfg.MaxLifetime, func() {
+			_ = c.closeWithError(ErrLifetimeExceeded)
+		})
+	}
+}
+
+func (c *Conn) stopTimers() {
+	c.timerMu.Lock()
+	defer c.timerMu.Unlock()
+
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+	if c.lifetimeTimer != nil {
+		c.lifetimeTimer.Stop()
+	}
+}
+
+func (c *Conn) onIdleTimer() {
+	lastActivity := time.Unix(0, atomic.LoadInt64(&c.lastActivity))
+	if remaining := c.cfg.IdleTimeout - c.now().Sub(lastActivity); remaining > 0 {
+		c.timerMu.Lock()
+		c.idleTimer.Reset(remaining)
+		c.timerMu.Unlock()
+		return
+	}
+
+	_ = c.closeWithError(ErrIdleTimeout)
+}
+
+// maybeUpdateKey sends a key update record and rekeys the outgoing traffic
+// key, or starts a renegotiation, if required by the lifetime policy.  The
+// caller must hold c.out.
+func (c *Conn) maybeUpdateKey() error {
+	if c.cfg.MaxLifetime <= 0 || c.cfg.LifetimeAction == LifetimeClose {
+		return nil
+	}
+	if c.now().Sub(c.out.keyCreated) < c.cfg.MaxLifetime {
+		return nil
+	}
+
+	if c.cfg.LifetimeAction == LifetimeRenegotiate && c.isClient {
+		if c.reneg != nil || c.renegIn != nil {
+			// The outgoing traffic key is replaced on completion.
+			return nil
+		}
+		return c.startRenegotiation()
+	}
+
+	if err := c.writeRecord(recordTypeKeyUpdate, nil); err != nil {
+		return err
+	}
+	if err := c.out.cs.Rekey(); err != nil {
+		return err
+	}
+	c.out.keyCreated = c.now()
+	c.onRekey(&c.out, RekeyLifetime)
+
+	return nil
+}
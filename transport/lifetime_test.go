@@ -0,0 +1,359 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git/clock"
+)
+
+func newTestConnPair(t *testing.T, serverCfg, clientCfg *Config) (*Conn, *Conn) {
+	require := require.New(t)
+
+	l, err := Listen("tcp", "127.0.0.1:0", serverCfg)
+	require.NoError(err, "Listen")
+	defer l.Close()
+
+	connCh := make(chan *Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(connCh)
+			return
+		}
+		connCh <- conn.(*Conn)
+	}()
+
+	client, err := Dial("tcp", l.Addr().String(), clientCfg)
+	require.NoError(err, "Dial")
+	server, ok := <-connCh
+	require.True(ok, "Accept")
+
+	return server, client
+}
+
+func TestLifetime(t *testing.T) {
+	serverStatic, clientStatic := mustKeypair(t), mustKeypair(t)
+	protoXX := mustProtocol(t, "Noise_XX_25519_ChaChaPoly_BLAKE2s")
+
+	t.Run("AuthenticatedClose", func(t *testing.T) {
+		require := require.New(t)
+
+		server, client := newTestConnPair(t, &Config{
+			Protocol:    protoXX,
+			LocalStatic: serverStatic,
+		}, &Config{
+			Protocol:    protoXX,
+			LocalStatic: clientStatic,
+		})
+		defer client.Close()
+
+		require.NoError(server.Close(), "server.Close")
+		_, err := client.Read(make([]byte, 1))
+		require.Equal(io.EOF, err, "client.Read - close record")
+	})
+
+	t.Run("CloseWrite", func(t *testing.T) {
+		require := require.New(t)
+
+		server, client := newTestConnPair(t, &Config{
+			Protocol:    protoXX,
+			LocalStatic: serverStatic,
+		}, &Config{
+			Protocol:    protoXX,
+			LocalStatic: clientStatic,
+		})
+		defer client.Close()
+		defer server.Close()
+
+		// The client sends the request, and half-closes.
+		_, err := client.Write([]byte("request"))
+		require.NoError(err, "client.Write")
+		require.NoError(client.CloseWrite(), "client.CloseWrite")
+		_, err = client.Write([]byte("after CloseWrite"))
+		require.Equal(errWriteClosed, err, "client.Write - after CloseWrite")
+
+		// The server reads until EOF, and responds.
+		b, err := io.ReadAll(server)
+		require.NoError(err, "server.Read")
+		require.Equal([]byte("request"), b, "server.Read - request")
+		_, err = server.Write([]byte("response"))
+		require.NoError(err, "server.Write")
+		require.NoError(server.Close(), "server.Close")
+
+		b, err = io.ReadAll(client)
+		require.NoError(err, "client.Read")
+		require.Equal([]byte("response"), b, "client.Read - response")
+	})
+
+	t.Run("Truncation", func(t *testing.T) {
+		require := require.New(t)
+
+		server, client := newTestConnPair(t, &Config{
+			Protocol:    protoXX,
+			LocalStatic: serverStatic,
+		}, &Config{
+			Protocol:    protoXX,
+			LocalStatic: clientStatic,
+		})
+		defer client.Close()
+		defer server.Close()
+
+		require.NoError(server.NetConn().Close(), "server.NetConn().Close")
+		_, err := client.Read(make([]byte, 1))
+		require.Equal(io.ErrUnexpectedEOF, err, "client.Read - truncated")
+	})
+
+	t.Run("IdleTimeout", func(t *testing.T) {
+		require := require.New(t)
+
+		server, client := newTestConnPair(t, &Config{
+			Protocol:    protoXX,
+			LocalStatic: serverStatic,
+			IdleTimeout: 200 * time.Millisecond,
+		}, &Config{
+			Protocol:    protoXX,
+			LocalStatic: clientStatic,
+		})
+		defer client.Close()
+		defer server.Close()
+
+		// Activity defers the timeout.
+		for i := 0; i < 4; i++ {
+			time.Sleep(100 * time.Millisecond)
+			_, err := client.Write([]byte{byte(i)})
+			require.NoError(err, "client.Write")
+			b := make([]byte, 1)
+			_, err = io.ReadFull(server, b)
+			require.NoError(err, "server.Read")
+		}
+
+		_, err := client.Read(make([]byte, 1))
+		require.Equal(io.EOF, err, "client.Read - idle timeout")
+		_, err = server.Write([]byte("after timeout"))
+		require.Equal(ErrIdleTimeout, err, "server.Write - idle timeout")
+	})
+
+	t.Run("IdleTimeout/Clock", func(t *testing.T) {
+		require := require.New(t)
+
+		clk := clock.NewFake(time.Now())
+		server, client := newTestConnPair(t, &Config{
+			Protocol:    protoXX,
+			LocalStatic: serverStatic,
+			IdleTimeout: time.Minute,
+			Clock:       clk,
+		}, &Config{
+			Protocol:    protoXX,
+			LocalStatic: clientStatic,
+		})
+		defer client.Close()
+		defer server.Close()
+
+		clk.Advance(59 * time.Second)
+		_, err := client.Write([]byte("ping"))
+		require.NoError(err, "client.Write")
+		_, err = io.ReadFull(server, make([]byte, 4))
+		require.NoError(err, "server.Read")
+
+		// Activity defers the timeout.
+		clk.Advance(59 * time.Second)
+		_, err = server.Write([]byte("pong"))
+		require.NoError(err, "server.Write - before timeout")
+
+		clk.Advance(time.Minute)
+		_, err = server.Write([]byte("after timeout"))
+		require.Equal(ErrIdleTimeout, err, "server.Write - idle timeout")
+	})
+
+	t.Run("MaxLifetime/Close", func(t *testing.T) {
+		require := require.New(t)
+
+		server, client := newTestConnPair(t, &Config{
+			Protocol:    protoXX,
+			LocalStatic: serverStatic,
+		}, &Config{
+			Protocol:    protoXX,
+			LocalStatic: clientStatic,
+			MaxLifetime: 100 * time.Millisecond,
+		})
+		defer client.Close()
+		defer server.Close()
+
+		start := time.Now()
+		_, err := server.Read(make([]byte, 1))
+		require.Equal(io.EOF, err, "server.Read - lifetime exceeded")
+		require.True(time.Since(start) >= 50*time.Millisecond, "lifetime enforced early")
+		_, err = client.Read(make([]byte, 1))
+		require.Equal(ErrLifetimeExceeded, err, "client.Read - lifetime exceeded")
+	})
+
+	t.Run("MaxLifetime/KeyUpdate", func(t *testing.T) {
+		require := require.New(t)
+
+		var serverEvents, clientEvents rekeyRecorder
+		cfg := &Config{
+			Protocol:       protoXX,
+			LocalStatic:    serverStatic,
+			MaxLifetime:    20 * time.Millisecond,
+			LifetimeAction: LifetimeKeyUpdate,
+			OnRekey:        serverEvents.OnRekey,
+		}
+		server, client := newTestConnPair(t, cfg, &Config{
+			Protocol:       protoXX,
+			LocalStatic:    clientStatic,
+			MaxLifetime:    20 * time.Millisecond,
+			LifetimeAction: LifetimeKeyUpdate,
+			OnRekey:        clientEvents.OnRekey,
+		})
+		defer client.Close()
+		defer server.Close()
+
+		b := make([]byte, 5)
+		for i := 0; i < 4; i++ {
+			time.Sleep(30 * time.Millisecond)
+
+			_, err := client.Write([]byte("hello"))
+			require.NoError(err, "client.Write")
+			_, err = io.ReadFull(server, b)
+			require.NoError(err, "server.Read")
+			require.Equal([]byte("hello"), b, "server.Read")
+
+			_, err = server.Write([]byte("world"))
+			require.NoError(err, "server.Write")
+			_, err = io.ReadFull(client, b)
+			require.NoError(err, "client.Read")
+			require.Equal([]byte("world"), b, "client.Read")
+		}
+
+		// Each side rekeys its outgoing key once per write, and the peer
+		// follows on the key update record.
+		for _, events := range []*rekeyRecorder{&serverEvents, &clientEvents} {
+			var writeGen, readGen uint64
+			for _, ev := range events.get() {
+				if ev.IsWrite {
+					writeGen++
+					require.Equal(RekeyLifetime, ev.Reason, "Reason - write")
+					require.Equal(writeGen, ev.Generation, "Generation - write")
+				} else {
+					readGen++
+					require.Equal(RekeyKeyUpdate, ev.Reason, "Reason - read")
+					require.Equal(readGen, ev.Generation, "Generation - read")
+				}
+			}
+			require.EqualValues(4, writeGen, "write rekeys")
+			require.EqualValues(4, readGen, "read rekeys")
+		}
+	})
+
+	t.Run("MaxLifetime/Renegotiate", func(t *testing.T) {
+		require := require.New(t)
+
+		clk := clock.NewFake(time.Now())
+		var clientEvents rekeyRecorder
+		server, client := newTestConnPair(t, &Config{
+			Protocol:    protoXX,
+			LocalStatic: serverStatic,
+		}, &Config{
+			Protocol:       protoXX,
+			LocalStatic:    clientStatic,
+			MaxLifetime:    time.Minute,
+			LifetimeAction: LifetimeRenegotiate,
+			OnRekey:        clientEvents.OnRekey,
+			Clock:          clk,
+		})
+		defer client.Close()
+		defer server.Close()
+
+		go func() {
+			_, _ = io.Copy(server, server)
+		}()
+
+		msg, b := []byte("hello"), make([]byte, 5)
+		hashes := [][]byte{client.HandshakeHash()}
+		for i := 1; i <= 2; i++ {
+			clk.Advance(time.Minute)
+
+			// The first write starts the renegotiation, which completes
+			// as the client reads the echoed data.
+			for j := 0; j < 3; j++ {
+				_, err := client.Write(msg)
+				require.NoError(err, "client.Write")
+				_, err = io.ReadFull(client, b)
+				require.NoError(err, "client.Read")
+				require.Equal(msg, b, "client.Read - echo")
+			}
+
+			h := client.HandshakeHash()
+			require.Equal(h, server.HandshakeHash(), "HandshakeHash - match")
+			require.NotEqual(hashes[len(hashes)-1], h, "HandshakeHash - fresh")
+			hashes = append(hashes, h)
+			require.EqualValues(i, client.Stats().Renegotiations, "client Renegotiations")
+		}
+
+		require.Equal([]RekeyEvent{
+			{Reason: RekeyRenegotiation, IsWrite: true, Generation: 1},
+			{Reason: RekeyRenegotiation, IsWrite: false, Generation: 1},
+			{Reason: RekeyRenegotiation, IsWrite: true, Generation: 2},
+			{Reason: RekeyRenegotiation, IsWrite: false, Generation: 2},
+		}, clientEvents.withoutTime(), "OnRekey")
+	})
+}
+
+type rekeyRecorder struct {
+	sync.Mutex
+	events []RekeyEvent
+}
+
+func (r *rekeyRecorder) OnRekey(ev RekeyEvent) {
+	r.Lock()
+	defer r.Unlock()
+	r.events = append(r.events, ev)
+}
+
+func (r *rekeyRecorder) get() []RekeyEvent {
+	r.Lock()
+	defer r.Unlock()
+	return append([]RekeyEvent{}, r.events...)
+}
+
+func (r *rekeyRecorder) withoutTime() []RekeyEvent {
+	events := r.get()
+	for i := range events {
+		events[i].Time = time.Time{}
+	}
+	return events
+}
@@ -0,0 +1,173 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// Listener is a transport listener.  Handshakes with incoming connections
+// are completed concurrently, and only connections that successfully
+// complete the handshake are returned by Accept.  Connections that fail to
+// complete the handshake within the configured HandshakeTimeout, or before
+// the listener is closed, are closed.
+//
+// The number and estimated memory of incomplete handshakes may be bounded
+// with Config.MaxPendingHandshakes and Config.MaxPendingHandshakeMemory,
+// in which case the least recently active handshakes are aborted to admit
+// new connections, so that initiators that stall mid-handshake can not
+// exhaust server resources.
+type Listener struct {
+	inner   net.Listener
+	cfg     *Config
+	pending pendingHandshakes
+
+	connCh    chan *Conn
+	closeCh   chan struct{}
+	closeOnce sync.Once
+
+	errMu sync.Mutex
+	err   error
+}
+
+// Accept waits for and returns the next connection that has completed the
+// handshake.  The returned connection will be a *Conn.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connCh:
+		return conn, nil
+	case <-l.closeCh:
+		l.errMu.Lock()
+		defer l.errMu.Unlock()
+		return nil, l.err
+	}
+}
+
+// Close closes the listener.
+func (l *Listener) Close() error {
+	err := l.inner.Close()
+	l.shutdown(errClosed)
+	return err
+}
+
+// Stats returns a snapshot of the listener's handshake statistics.
+func (l *Listener) Stats() ListenerStats {
+	return l.pending.stats()
+}
+
+// Addr returns the listener's network address.
+func (l *Listener) Addr() net.Addr {
+	return l.inner.Addr()
+}
+
+func (l *Listener) shutdown(err error) {
+	l.closeOnce.Do(func() {
+		l.errMu.Lock()
+		l.err = err
+		l.errMu.Unlock()
+		close(l.closeCh)
+	})
+}
+
+func (l *Listener) acceptLoop() {
+	for {
+		rawConn, err := l.inner.Accept()
+		if err != nil {
+			l.shutdown(err)
+			return
+		}
+
+		go l.handshake(rawConn)
+	}
+}
+
+func (l *Listener) handshake(rawConn net.Conn) {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	if timeout := l.cfg.handshakeTimeout(); timeout > 0 {
+		var timeoutCancelFn context.CancelFunc
+		ctx, timeoutCancelFn = context.WithTimeout(ctx, timeout)
+		defer timeoutCancelFn()
+	}
+	go func() {
+		select {
+		case <-l.closeCh:
+			cancelFn()
+		case <-ctx.Done():
+		}
+	}()
+
+	p := l.pending.add(cancelFn)
+	conn, err := ServerContext(ctx, &pendingConn{
+		Conn: rawConn,
+		ph:   &l.pending,
+		p:    p,
+	}, l.cfg)
+	l.pending.remove(p, err == nil)
+	if err != nil {
+		rawConn.Close()
+		return
+	}
+
+	select {
+	case l.connCh <- conn:
+	case <-l.closeCh:
+		conn.Close()
+	}
+}
+
+// NewListener creates a Listener which accepts connections from an inner
+// listener, and completes the handshake with each connection.
+func NewListener(inner net.Listener, cfg *Config) *Listener {
+	l := &Listener{
+		inner:   inner,
+		cfg:     cfg,
+		connCh:  make(chan *Conn),
+		closeCh: make(chan struct{}),
+	}
+	l.pending.maxCount = cfg.MaxPendingHandshakes
+	l.pending.maxMemory = cfg.MaxPendingHandshakeMemory
+	go l.acceptLoop()
+
+	return l
+}
+
+// Listen creates a transport listener accepting connections on the given
+// network address using net.Listen.
+func Listen(network, laddr string, cfg *Config) (*Listener, error) {
+	inner, err := net.Listen(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewListener(inner, cfg), nil
+}
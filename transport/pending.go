@@ -0,0 +1,193 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// pendingHandshakeCost is the estimated fixed memory cost of an
+// incomplete handshake, excluding the handshake data received.
+const pendingHandshakeCost = 4096
+
+// ListenerStats is a snapshot of a listener's handshake statistics.
+type ListenerStats struct {
+	// PendingHandshakes is the number of incomplete handshakes.
+	PendingHandshakes int
+
+	// PendingMemory is the estimated memory used by incomplete
+	// handshakes, in bytes.
+	PendingMemory int64
+
+	// Completed is the number of handshakes that have completed.
+	Completed uint64
+
+	// Failed is the number of handshakes that have failed or timed out,
+	// excluding those that were evicted.
+	Failed uint64
+
+	// Evicted is the number of incomplete handshakes that were aborted to
+	// stay within Config.MaxPendingHandshakes or
+	// Config.MaxPendingHandshakeMemory.
+	Evicted uint64
+}
+
+type pendingHandshake struct {
+	cancelFn context.CancelFunc
+	elem     *list.Element
+	cost     int64
+	evicted  bool
+	done     uint32
+}
+
+// pendingHandshakes tracks the incomplete handshakes of a listener, in
+// least recently active order, evicting the least recently active when
+// over the limits.
+type pendingHandshakes struct {
+	maxCount  int
+	maxMemory int64
+
+	mu        sync.Mutex
+	lru       list.List
+	memory    int64
+	completed uint64
+	failed    uint64
+	evicted   uint64
+}
+
+func (ph *pendingHandshakes) add(cancelFn context.CancelFunc) *pendingHandshake {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	p := &pendingHandshake{
+		cancelFn: cancelFn,
+		cost:     pendingHandshakeCost,
+	}
+	p.elem = ph.lru.PushFront(p)
+	ph.memory += p.cost
+	ph.enforceLimits()
+
+	return p
+}
+
+// onRead marks the handshake as active, and accounts for the n bytes of
+// handshake data received.
+func (ph *pendingHandshakes) onRead(p *pendingHandshake, n int) {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	if p.evicted || p.elem == nil {
+		return
+	}
+	ph.lru.MoveToFront(p.elem)
+	p.cost += int64(n)
+	ph.memory += int64(n)
+	ph.enforceLimits()
+}
+
+// remove stops tracking the handshake, once it has completed or failed.
+func (ph *pendingHandshakes) remove(p *pendingHandshake, completed bool) {
+	atomic.StoreUint32(&p.done, 1)
+
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	switch {
+	case p.evicted:
+	case completed:
+		ph.completed++
+	default:
+		ph.failed++
+	}
+	if p.elem != nil {
+		ph.lru.Remove(p.elem)
+		ph.memory -= p.cost
+		p.elem = nil
+	}
+}
+
+// enforceLimits evicts the least recently active handshakes until within
+// the limits.  The caller must hold ph.mu.
+func (ph *pendingHandshakes) enforceLimits() {
+	for {
+		overCount := ph.maxCount > 0 && ph.lru.Len() > ph.maxCount
+		overMemory := ph.maxMemory > 0 && ph.memory > ph.maxMemory
+		if !overCount && !overMemory {
+			return
+		}
+
+		p := ph.lru.Remove(ph.lru.Back()).(*pendingHandshake)
+		ph.memory -= p.cost
+		p.elem = nil
+		p.evicted = true
+		ph.evicted++
+		p.cancelFn()
+	}
+}
+
+func (ph *pendingHandshakes) stats() ListenerStats {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	return ListenerStats{
+		PendingHandshakes: ph.lru.Len(),
+		PendingMemory:     ph.memory,
+		Completed:         ph.completed,
+		Failed:            ph.failed,
+		Evicted:           ph.evicted,
+	}
+}
+
+// pendingConn tracks the activity of an incomplete handshake.
+type pendingConn struct {
+	net.Conn
+
+	ph *pendingHandshakes
+	p  *pendingHandshake
+}
+
+func (c *pendingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && atomic.LoadUint32(&c.p.done) == 0 {
+		c.ph.onRead(c.p, n)
+	}
+	return n, err
+}
+
+func (c *pendingConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func requireClosedByPeer(t *testing.T, conn net.Conn, msg string) {
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	require.Error(t, err, msg)
+	netErr, ok := err.(net.Error)
+	require.False(t, ok && netErr.Timeout(), msg)
+}
+
+func requireStillOpen(t *testing.T, conn net.Conn, msg string) {
+	_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	netErr, ok := err.(net.Error)
+	require.True(t, ok && netErr.Timeout(), msg)
+}
+
+func TestPendingHandshakes(t *testing.T) {
+	serverStatic, clientStatic := mustKeypair(t), mustKeypair(t)
+	protoXX := mustProtocol(t, "Noise_XX_25519_ChaChaPoly_BLAKE2s")
+
+	dialStalled := func(t *testing.T, l *Listener, expectedPending int) net.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err, "net.Dial")
+		t.Cleanup(func() { conn.Close() })
+		require.Eventually(t, func() bool {
+			return l.Stats().PendingHandshakes == expectedPending
+		}, 5*time.Second, time.Millisecond, "PendingHandshakes")
+		return conn
+	}
+
+	t.Run("Count", func(t *testing.T) {
+		require := require.New(t)
+
+		l, err := Listen("tcp", "127.0.0.1:0", &Config{
+			Protocol:             protoXX,
+			LocalStatic:          serverStatic,
+			MaxPendingHandshakes: 2,
+		})
+		require.NoError(err, "Listen")
+		defer l.Close()
+
+		stalled1 := dialStalled(t, l, 1)
+		stalled2 := dialStalled(t, l, 2)
+
+		// Activity on the oldest makes the other the least recently active.
+		_, err = stalled1.Write([]byte{0x00})
+		require.NoError(err, "stalled1.Write")
+		require.Eventually(func() bool {
+			return l.Stats().PendingMemory == 2*pendingHandshakeCost+1
+		}, 5*time.Second, time.Millisecond, "PendingMemory")
+
+		// A new connection evicts the least recently active handshake.
+		stalled3 := dialStalled(t, l, 2)
+		requireClosedByPeer(t, stalled2, "stalled2 - evicted")
+		requireStillOpen(t, stalled1, "stalled1 - active")
+		requireStillOpen(t, stalled3, "stalled3 - new")
+
+		// Legitimate clients can still connect.
+		go func() {
+			conn, err := l.Accept()
+			if err == nil {
+				defer conn.Close()
+			}
+		}()
+		client, err := Dial("tcp", l.Addr().String(), &Config{
+			Protocol:    protoXX,
+			LocalStatic: clientStatic,
+		})
+		require.NoError(err, "Dial")
+		defer client.Close()
+
+		require.Eventually(func() bool {
+			return l.Stats().Completed == 1
+		}, 5*time.Second, time.Millisecond, "Completed")
+		// The client evicted stalled1, and completed.
+		requireClosedByPeer(t, stalled1, "stalled1 - evicted")
+		stats := l.Stats()
+		require.EqualValues(1, stats.PendingHandshakes, "PendingHandshakes")
+		require.EqualValues(2, stats.Evicted, "Evicted")
+		require.EqualValues(0, stats.Failed, "Failed")
+	})
+
+	t.Run("Memory", func(t *testing.T) {
+		require := require.New(t)
+
+		l, err := Listen("tcp", "127.0.0.1:0", &Config{
+			Protocol:                  protoXX,
+			LocalStatic:               serverStatic,
+			MaxPendingHandshakeMemory: 2*pendingHandshakeCost + 512,
+		})
+		require.NoError(err, "Listen")
+		defer l.Close()
+
+		stalled1 := dialStalled(t, l, 1)
+		stalled2 := dialStalled(t, l, 2)
+
+		// A partial handshake message pushes the estimate over the limit.
+		_, err = stalled2.Write(append([]byte{0xff, 0xff}, make([]byte, 1024)...))
+		require.NoError(err, "stalled2.Write")
+		requireClosedByPeer(t, stalled1, "stalled1 - evicted")
+		requireStillOpen(t, stalled2, "stalled2 - active")
+
+		stats := l.Stats()
+		require.EqualValues(1, stats.PendingHandshakes, "PendingHandshakes")
+		require.EqualValues(pendingHandshakeCost+1026, stats.PendingMemory, "PendingMemory")
+		require.EqualValues(1, stats.Evicted, "Evicted")
+	})
+
+	t.Run("Failed", func(t *testing.T) {
+		require := require.New(t)
+
+		l, err := Listen("tcp", "127.0.0.1:0", &Config{
+			Protocol:    protoXX,
+			LocalStatic: serverStatic,
+		})
+		require.NoError(err, "Listen")
+		defer l.Close()
+
+		conn := dialStalled(t, l, 1)
+		conn.Close()
+		require.Eventually(func() bool {
+			stats := l.Stats()
+			return stats.PendingHandshakes == 0 && stats.Failed == 1
+		}, 5*time.Second, time.Millisecond, "Failed")
+		require.EqualValues(0, l.Stats().PendingMemory, "PendingMemory")
+	})
+}
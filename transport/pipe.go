@@ -0,0 +1,300 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const pipeReadSize = 32 * 1024
+
+// PipeConn is a net.Conn backed by an arbitrary reader and writer (eg:
+// stdin/stdout, a serial port, a SSH channel), for running a Conn over
+// links that are not a net.Conn.
+//
+// Reads are serviced by a background goroutine, so that read deadlines
+// (and therefore the handshake timeout) are honored even if the reader
+// does not support them.  Writes block until the underlying writer
+// returns, and the write deadline is only checked before each write.
+type PipeConn struct {
+	r io.Reader
+	w io.Writer
+
+	startOnce sync.Once
+	readCh    chan pipeRead
+	pending   []byte
+	readErr   error
+	readMu    sync.Mutex
+	writeMu   sync.Mutex
+
+	readDeadline  pipeDeadline
+	writeDeadline pipeDeadline
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+	closeErr  error
+}
+
+type pipeRead struct {
+	b   []byte
+	err error
+}
+
+// NewPipeConn returns a PipeConn that reads from r and writes to w.  If r
+// or w implement io.Closer, they are closed when the PipeConn is closed,
+// and CloseWrite closes w if it is distinct from r.
+//
+// Example (netcat-style client over stdin/stdout):
+//
+//	conn, err := transport.Client(transport.NewPipeConn(os.Stdin, os.Stdout), cfg)
+func NewPipeConn(r io.Reader, w io.Writer) *PipeConn {
+	return &PipeConn{
+		r:             r,
+		w:             w,
+		readCh:        make(chan pipeRead),
+		readDeadline:  makePipeDeadline(),
+		writeDeadline: makePipeDeadline(),
+		closeCh:       make(chan struct{}),
+	}
+}
+
+// PipeClient runs the client side of a Noise session over r and w.
+func PipeClient(r io.Reader, w io.Writer, cfg *Config) (*Conn, error) {
+	return Client(NewPipeConn(r, w), cfg)
+}
+
+// PipeServer runs the server side of a Noise session over r and w.
+func PipeServer(r io.Reader, w io.Writer, cfg *Config) (*Conn, error) {
+	return Server(NewPipeConn(r, w), cfg)
+}
+
+// Read implements net.Conn.
+func (pc *PipeConn) Read(p []byte) (int, error) {
+	pc.readMu.Lock()
+	defer pc.readMu.Unlock()
+
+	if len(pc.pending) == 0 && pc.readErr == nil {
+		if isClosedChan(pc.closeCh) {
+			return 0, net.ErrClosed
+		}
+		if isClosedChan(pc.readDeadline.wait()) {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		pc.startOnce.Do(func() {
+			go pc.readWorker()
+		})
+		select {
+		case rd := <-pc.readCh:
+			pc.pending, pc.readErr = rd.b, rd.err
+		case <-pc.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-pc.closeCh:
+			return 0, net.ErrClosed
+		}
+	}
+
+	n := copy(p, pc.pending)
+	pc.pending = pc.pending[n:]
+	if len(pc.pending) == 0 && pc.readErr != nil {
+		return n, pc.readErr
+	}
+	return n, nil
+}
+
+func (pc *PipeConn) readWorker() {
+	for {
+		buf := make([]byte, pipeReadSize)
+		n, err := pc.r.Read(buf)
+		if n == 0 && err == nil {
+			continue
+		}
+
+		select {
+		case pc.readCh <- pipeRead{buf[:n], err}:
+		case <-pc.closeCh:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Write implements net.Conn.
+func (pc *PipeConn) Write(p []byte) (int, error) {
+	pc.writeMu.Lock()
+	defer pc.writeMu.Unlock()
+
+	if isClosedChan(pc.closeCh) {
+		return 0, net.ErrClosed
+	}
+	if isClosedChan(pc.writeDeadline.wait()) {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	return pc.w.Write(p)
+}
+
+// Close implements net.Conn.
+func (pc *PipeConn) Close() error {
+	pc.closeOnce.Do(func() {
+		close(pc.closeCh)
+		if c, ok := pc.r.(io.Closer); ok {
+			pc.closeErr = c.Close()
+		}
+		if c, ok := pc.w.(io.Closer); ok && !pc.sameRW() {
+			if err := c.Close(); pc.closeErr == nil {
+				pc.closeErr = err
+			}
+		}
+	})
+	return pc.closeErr
+}
+
+// CloseWrite closes the writer if it is distinct from the reader and
+// implements io.Closer, and otherwise does nothing.
+func (pc *PipeConn) CloseWrite() error {
+	pc.writeMu.Lock()
+	defer pc.writeMu.Unlock()
+
+	if c, ok := pc.w.(io.Closer); ok && !pc.sameRW() {
+		return c.Close()
+	}
+	return nil
+}
+
+func (pc *PipeConn) sameRW() bool {
+	rc, rOk := pc.r.(io.Closer)
+	wc, wOk := pc.w.(io.Closer)
+	return rOk && wOk && rc == wc
+}
+
+// LocalAddr implements net.Conn.
+func (pc *PipeConn) LocalAddr() net.Addr {
+	return pipeAddr{}
+}
+
+// RemoteAddr implements net.Conn.
+func (pc *PipeConn) RemoteAddr() net.Addr {
+	return pipeAddr{}
+}
+
+// SetDeadline implements net.Conn.
+func (pc *PipeConn) SetDeadline(t time.Time) error {
+	pc.readDeadline.set(t)
+	pc.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline implements net.Conn.
+func (pc *PipeConn) SetReadDeadline(t time.Time) error {
+	pc.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn.
+func (pc *PipeConn) SetWriteDeadline(t time.Time) error {
+	pc.writeDeadline.set(t)
+	return nil
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string {
+	return "pipe"
+}
+
+func (pipeAddr) String() string {
+	return "pipe"
+}
+
+// pipeDeadline is a deadline, that closes a channel when it expires.
+type pipeDeadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makePipeDeadline() pipeDeadline {
+	return pipeDeadline{cancel: make(chan struct{})}
+}
+
+func (d *pipeDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // Wait for the timer callback to finish.
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *pipeDeadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type closeTracker struct {
+	io.Reader
+	closed bool
+}
+
+func (ct *closeTracker) Close() error {
+	ct.closed = true
+	return nil
+}
+
+func TestPipeConn(t *testing.T) {
+	t.Run("Session", func(t *testing.T) {
+		require := require.New(t)
+
+		// Two unidirectional pipes, as with a child process' stdin/stdout.
+		c2sR, c2sW := io.Pipe()
+		s2cR, s2cW := io.Pipe()
+
+		cfg := &Config{
+			Protocol: mustProtocol(t, "Noise_NN_25519_ChaChaPoly_BLAKE2s"),
+		}
+		type result struct {
+			conn *Conn
+			err  error
+		}
+		serverCh := make(chan result, 1)
+		go func() {
+			conn, err := PipeServer(c2sR, s2cW, cfg)
+			serverCh <- result{conn, err}
+		}()
+
+		client, err := PipeClient(s2cR, c2sW, cfg)
+		require.NoError(err, "PipeClient")
+		defer client.Close()
+		res := <-serverCh
+		require.NoError(res.err, "PipeServer")
+		server := res.conn
+		defer server.Close()
+
+		go func() {
+			_, _ = client.Write([]byte("over a pipe"))
+			_ = client.CloseWrite()
+		}()
+		b, err := io.ReadAll(server)
+		require.NoError(err, "ReadAll")
+		require.Equal([]byte("over a pipe"), b, "ReadAll")
+	})
+
+	t.Run("ReadDeadline", func(t *testing.T) {
+		require := require.New(t)
+
+		r, w := io.Pipe()
+		pc := NewPipeConn(r, io.Discard)
+		defer pc.Close()
+
+		require.NoError(pc.SetReadDeadline(time.Now().Add(50*time.Millisecond)), "SetReadDeadline")
+		_, err := pc.Read(make([]byte, 1))
+		require.ErrorIs(err, os.ErrDeadlineExceeded, "Read - deadline")
+
+		// Data read after the deadline is not lost.
+		go func() {
+			_, _ = w.Write([]byte("late"))
+		}()
+		require.NoError(pc.SetReadDeadline(time.Time{}), "SetReadDeadline - clear")
+		b := make([]byte, 4)
+		_, err = io.ReadFull(pc, b)
+		require.NoError(err, "Read")
+		require.Equal([]byte("late"), b, "Read")
+
+		require.NoError(pc.SetWriteDeadline(time.Now().Add(-time.Second)), "SetWriteDeadline")
+		_, err = pc.Write([]byte("x"))
+		require.ErrorIs(err, os.ErrDeadlineExceeded, "Write - deadline")
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		require := require.New(t)
+
+		r, w := &closeTracker{Reader: eofReader{}}, &closeTracker{}
+		pc := NewPipeConn(r, struct {
+			io.Writer
+			io.Closer
+		}{io.Discard, w})
+
+		b, err := io.ReadAll(pc)
+		require.NoError(err, "ReadAll")
+		require.Empty(b, "ReadAll")
+
+		require.NoError(pc.CloseWrite(), "CloseWrite")
+		require.True(w.closed, "CloseWrite - writer closed")
+		require.False(r.closed, "CloseWrite - reader open")
+
+		require.NoError(pc.Close(), "Close")
+		require.True(r.closed, "Close - reader closed")
+		_, err = pc.Write([]byte("x"))
+		require.Error(err, "Write - closed")
+	})
+}
+
+type eofReader struct{}
+
+func (eofReader) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
@@ -0,0 +1,315 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"gitlab.com/yawning/nyquist.git/clock"
+)
+
+const (
+	// DefaultPoolSize is the default number of idle connections that a
+	// Pool keeps per peer.
+	DefaultPoolSize = 1
+
+	// DefaultPoolMaxIdle is the default maximum duration that a Pool keeps
+	// an idle connection for, before replacing it.
+	DefaultPoolMaxIdle = 30 * time.Second
+
+	// poolRetryInterval is the delay before a Pool retries establishing
+	// connections to a peer, after a failure.
+	poolRetryInterval = time.Second
+)
+
+var errPoolClosed = errors.New("nyquist/transport: pool closed")
+
+// Pool keeps a number of fully handshaked connections to frequently used
+// peers warm, and hands them out on Dial, for latency-critical request
+// paths.  Connections are replenished in the background as they are
+// handed out, or expire.
+//
+// Idle connections are not monitored, so MaxIdle should be less than the
+// peer's idle timeout.  As the connections are established ahead of use,
+// the pool is only suitable for protocols where the client speaks first.
+type Pool struct {
+	// Dialer is the dialer used to establish connections.
+	Dialer *Dialer
+
+	// Size is the number of idle connections kept per peer.  If 0,
+	// DefaultPoolSize is used.
+	Size int
+
+	// MaxIdle is the maximum duration that an idle connection is kept,
+	// before being closed and replaced.  If 0, DefaultPoolMaxIdle is
+	// used, and if negative, there is no limit.
+	MaxIdle time.Duration
+
+	mu     sync.Mutex
+	peers  map[poolKey]*poolPeer
+	ctx    context.Context
+	cancel context.CancelFunc
+	closed bool
+}
+
+type poolKey struct {
+	network, address string
+}
+
+type poolPeer struct {
+	idle       []*poolConn
+	dialing    int
+	retryTimer clock.Timer
+	removed    bool
+}
+
+type poolConn struct {
+	conn  *Conn
+	timer clock.Timer
+}
+
+func (p *Pool) size() int {
+	if p.Size > 0 {
+		return p.Size
+	}
+	return DefaultPoolSize
+}
+
+func (p *Pool) maxIdle() time.Duration {
+	switch {
+	case p.MaxIdle == 0:
+		return DefaultPoolMaxIdle
+	case p.MaxIdle < 0:
+		return 0
+	default:
+		return p.MaxIdle
+	}
+}
+
+func (p *Pool) clock() clock.Clock {
+	return p.Dialer.Config.clock()
+}
+
+// init lazily initializes the pool.  The caller must hold p.mu.
+func (p *Pool) init() {
+	if p.peers == nil {
+		p.peers = make(map[poolKey]*poolPeer)
+		p.ctx, p.cancel = context.WithCancel(context.Background())
+	}
+}
+
+// Warm starts keeping connections to the address on the named network
+// warm.
+func (p *Pool) Warm(network, address string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return errPoolClosed
+	}
+	p.init()
+
+	key := poolKey{network, address}
+	if p.peers[key] != nil {
+		return nil
+	}
+	peer := &poolPeer{}
+	p.peers[key] = peer
+	p.fill(key, peer)
+
+	return nil
+}
+
+// Remove stops keeping connections to the address on the named network
+// warm, and closes the idle connections.
+func (p *Pool) Remove(network, address string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := poolKey{network, address}
+	if peer := p.peers[key]; peer != nil {
+		delete(p.peers, key)
+		peer.close()
+	}
+}
+
+// Idle returns the number of idle connections to the address on the named
+// network.
+func (p *Pool) Idle(network, address string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if peer := p.peers[poolKey{network, address}]; peer != nil {
+		return len(peer.idle)
+	}
+	return 0
+}
+
+// Dial returns a warm connection to the address on the named network if
+// one is available, and otherwise connects with Dialer.
+func (p *Pool) Dial(network, address string) (*Conn, error) {
+	return p.DialContext(context.Background(), network, address)
+}
+
+// DialContext returns a warm connection to the address on the named
+// network if one is available, and otherwise connects with Dialer,
+// bounded by the context.
+func (p *Pool) DialContext(ctx context.Context, network, address string) (*Conn, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, errPoolClosed
+	}
+	key := poolKey{network, address}
+	if peer := p.peers[key]; peer != nil {
+		if n := len(peer.idle); n > 0 {
+			// Hand out the most recently established connection, as it
+			// is the least likely to have been closed by the peer.
+			pc := peer.idle[n-1]
+			peer.idle = peer.idle[:n-1]
+			if pc.timer != nil {
+				pc.timer.Stop()
+			}
+			p.fill(key, peer)
+			p.mu.Unlock()
+			return pc.conn, nil
+		}
+	}
+	p.mu.Unlock()
+
+	return p.Dialer.DialContext(ctx, network, address)
+}
+
+// Close closes the pool, and all idle connections.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	if p.cancel != nil {
+		p.cancel()
+	}
+	for key, peer := range p.peers {
+		delete(p.peers, key)
+		peer.close()
+	}
+
+	return nil
+}
+
+// fill starts establishing connections to the peer, until the pool is
+// full.  The caller must hold p.mu.
+func (p *Pool) fill(key poolKey, peer *poolPeer) {
+	if peer.retryTimer != nil {
+		return
+	}
+	for need := p.size() - len(peer.idle) - peer.dialing; need > 0; need-- {
+		peer.dialing++
+		go p.dialOne(key, peer)
+	}
+}
+
+func (p *Pool) dialOne(key poolKey, peer *poolPeer) {
+	conn, err := p.Dialer.DialContext(p.ctx, key.network, key.address)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	peer.dialing--
+	if p.closed || peer.removed {
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
+
+	if err != nil {
+		// Back off, rather than hammering an unreachable peer.
+		if peer.retryTimer == nil {
+			peer.retryTimer = p.clock().AfterFunc(poolRetryInterval, func() {
+				p.mu.Lock()
+				defer p.mu.Unlock()
+
+				peer.retryTimer = nil
+				if !p.closed && !peer.removed {
+					p.fill(key, peer)
+				}
+			})
+		}
+		return
+	}
+
+	pc := &poolConn{conn: conn}
+	if maxIdle := p.maxIdle(); maxIdle > 0 {
+		pc.timer = p.clock().AfterFunc(maxIdle, func() {
+			p.expire(key, peer, pc)
+		})
+	}
+	peer.idle = append(peer.idle, pc)
+}
+
+// expire closes and replaces an idle connection that has exceeded MaxIdle.
+func (p *Pool) expire(key poolKey, peer *poolPeer, pc *poolConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, v := range peer.idle {
+		if v == pc {
+			peer.idle = append(peer.idle[:i], peer.idle[i+1:]...)
+			go pc.conn.Close()
+			if !p.closed && !peer.removed {
+				p.fill(key, peer)
+			}
+			return
+		}
+	}
+}
+
+// close closes the peer's idle connections.  The caller must hold p.mu.
+func (peer *poolPeer) close() {
+	peer.removed = true
+	if peer.retryTimer != nil {
+		peer.retryTimer.Stop()
+		peer.retryTimer = nil
+	}
+	for _, pc := range peer.idle {
+		if pc.timer != nil {
+			pc.timer.Stop()
+		}
+		go pc.conn.Close()
+	}
+	peer.idle = nil
+}
@@ -0,0 +1,137 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git/clock"
+)
+
+func TestPool(t *testing.T) {
+	serverStatic, clientStatic := mustKeypair(t), mustKeypair(t)
+	protoXX := mustProtocol(t, "Noise_XX_25519_ChaChaPoly_BLAKE2s")
+
+	l := startEchoServer(t, &Config{
+		Protocol:    protoXX,
+		LocalStatic: serverStatic,
+	})
+	defer l.Close()
+	addr := l.Addr().String()
+
+	requireCompleted := func(t *testing.T, n uint64) {
+		require.Eventually(t, func() bool {
+			return l.Stats().Completed == n
+		}, 5*time.Second, time.Millisecond, "Completed")
+	}
+	requireIdle := func(t *testing.T, p *Pool, n int) {
+		require.Eventually(t, func() bool {
+			return p.Idle("tcp", addr) == n
+		}, 5*time.Second, time.Millisecond, "Idle")
+	}
+
+	clk := clock.NewFake(time.Now())
+	p := &Pool{
+		Dialer: &Dialer{
+			Config: &Config{
+				Protocol:    protoXX,
+				LocalStatic: clientStatic,
+				Clock:       clk,
+			},
+		},
+		Size:    2,
+		MaxIdle: time.Minute,
+	}
+	defer p.Close()
+
+	t.Run("Warm", func(t *testing.T) {
+		require.NoError(t, p.Warm("tcp", addr), "Warm")
+		requireIdle(t, p, 2)
+		requireCompleted(t, 2)
+	})
+
+	t.Run("Dial", func(t *testing.T) {
+		require := require.New(t)
+
+		conn, err := p.Dial("tcp", addr)
+		require.NoError(err, "Dial")
+		defer conn.Close()
+		require.NotNil(conn.ConnectionState().HandshakeHash, "HandshakeHash")
+		echo(t, conn, []byte("warm connection"))
+
+		// The connection handed out is replaced.
+		requireCompleted(t, 3)
+		requireIdle(t, p, 2)
+	})
+
+	t.Run("MaxIdle", func(t *testing.T) {
+		clk.Advance(time.Minute)
+		requireCompleted(t, 5)
+		requireIdle(t, p, 2)
+	})
+
+	t.Run("Cold", func(t *testing.T) {
+		require := require.New(t)
+
+		l2 := startEchoServer(t, &Config{
+			Protocol:    protoXX,
+			LocalStatic: serverStatic,
+		})
+		defer l2.Close()
+
+		conn, err := p.Dial("tcp", l2.Addr().String())
+		require.NoError(err, "Dial - not warmed")
+		defer conn.Close()
+		echo(t, conn, []byte("cold connection"))
+		require.Zero(p.Idle("tcp", l2.Addr().String()), "Idle - not warmed")
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		p.Remove("tcp", addr)
+		require.Zero(t, p.Idle("tcp", addr), "Idle")
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		require := require.New(t)
+
+		require.NoError(p.Warm("tcp", addr), "Warm")
+		requireIdle(t, p, 2)
+
+		require.NoError(p.Close(), "Close")
+		require.Zero(p.Idle("tcp", addr), "Idle")
+
+		_, err := p.Dial("tcp", addr)
+		require.Equal(errPoolClosed, err, "Dial - closed")
+		require.Equal(errPoolClosed, p.Warm("tcp", addr), "Warm - closed")
+	})
+}
@@ -0,0 +1,195 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	proxyV1Prefix    = "PROXY "
+	proxyV1MaxLen    = 107
+	proxyV2HeaderLen = 16
+
+	proxyV2CmdLocal = 0x0
+	proxyV2CmdProxy = 0x1
+
+	proxyV2AFInet  = 0x1
+	proxyV2AFInet6 = 0x2
+	proxyV2AFUnix  = 0x3
+
+	proxyV2ProtoStream = 0x1
+	proxyV2ProtoDgram  = 0x2
+)
+
+var (
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errMalformedProxyHeader = errors.New("nyquist/transport: malformed PROXY protocol header")
+)
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from r, and
+// returns the original source address, if any.  Care is taken to never
+// read past the end of the header.
+func readProxyHeader(r io.Reader) (net.Addr, error) {
+	// The shortest possible header ("PROXY UNKNOWN\r\n") is longer than
+	// the v2 signature, so this never over-reads.
+	var hdr [proxyV1MaxLen]byte
+	if _, err := io.ReadFull(r, hdr[:len(proxyV2Signature)]); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.Equal(hdr[:len(proxyV2Signature)], proxyV2Signature):
+		return readProxyV2(r, hdr[:])
+	case bytes.HasPrefix(hdr[:], []byte(proxyV1Prefix)):
+		return readProxyV1(r, hdr[:])
+	default:
+		return nil, errMalformedProxyHeader
+	}
+}
+
+func readProxyV1(r io.Reader, hdr []byte) (net.Addr, error) {
+	// The v1 header is terminated by CRLF, so it must be read a byte at
+	// a time.
+	n := len(proxyV2Signature)
+	for {
+		if n == len(hdr) {
+			return nil, errMalformedProxyHeader
+		}
+		if _, err := io.ReadFull(r, hdr[n:n+1]); err != nil {
+			return nil, err
+		}
+		n++
+		if hdr[n-1] == '\n' {
+			break
+		}
+	}
+	if hdr[n-2] != '\r' {
+		return nil, errMalformedProxyHeader
+	}
+
+	fields := strings.Split(string(hdr[len(proxyV1Prefix):n-2]), " ")
+	switch fields[0] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, errMalformedProxyHeader
+	}
+	if len(fields) != 5 {
+		return nil, errMalformedProxyHeader
+	}
+
+	ip := net.ParseIP(fields[1])
+	if ip == nil || (ip.To4() != nil) != (fields[0] == "TCP4") {
+		return nil, errMalformedProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if err != nil {
+		return nil, errMalformedProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(r io.Reader, hdr []byte) (net.Addr, error) {
+	if _, err := io.ReadFull(r, hdr[len(proxyV2Signature):proxyV2HeaderLen]); err != nil {
+		return nil, err
+	}
+
+	verCmd, famProto := hdr[12], hdr[13]
+	if verCmd>>4 != 0x2 {
+		return nil, errMalformedProxyHeader
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch verCmd & 0x0f {
+	case proxyV2CmdLocal:
+		return nil, nil
+	case proxyV2CmdProxy:
+	default:
+		return nil, errMalformedProxyHeader
+	}
+
+	var (
+		ip   net.IP
+		port int
+	)
+	switch famProto >> 4 {
+	case proxyV2AFInet:
+		if len(body) < 12 {
+			return nil, errMalformedProxyHeader
+		}
+		ip = net.IP(append([]byte{}, body[0:4]...))
+		port = int(binary.BigEndian.Uint16(body[8:]))
+	case proxyV2AFInet6:
+		if len(body) < 36 {
+			return nil, errMalformedProxyHeader
+		}
+		ip = net.IP(append([]byte{}, body[0:16]...))
+		port = int(binary.BigEndian.Uint16(body[32:]))
+	case proxyV2AFUnix:
+		if len(body) < 216 {
+			return nil, errMalformedProxyHeader
+		}
+		name := body[0:108]
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		network := "unix"
+		if famProto&0x0f == proxyV2ProtoDgram {
+			network = "unixgram"
+		}
+		return &net.UnixAddr{Name: string(name), Net: network}, nil
+	default:
+		// AF_UNSPEC, or unknown, the address is not meaningful.
+		return nil, nil
+	}
+
+	switch famProto & 0x0f {
+	case proxyV2ProtoStream:
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	case proxyV2ProtoDgram:
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	default:
+		return nil, nil
+	}
+}
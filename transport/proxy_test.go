@@ -0,0 +1,147 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func proxyV2Header(cmd, famProto byte, body []byte) []byte {
+	hdr := append([]byte{}, proxyV2Signature...)
+	hdr = append(hdr, 0x20|cmd, famProto, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:], uint16(len(body)))
+	return append(hdr, body...)
+}
+
+func TestProxyHeader(t *testing.T) {
+	v4Body := []byte{
+		192, 0, 2, 1, // src
+		198, 51, 100, 1, // dst
+		0x30, 0x39, // src port
+		0x01, 0xbb, // dst port
+	}
+	v6Body := make([]byte, 36)
+	copy(v6Body, net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(v6Body[32:], 443)
+	unixBody := make([]byte, 216)
+	copy(unixBody, "/tmp/client.sock")
+
+	trailer := []byte("handshake")
+
+	for _, v := range []struct {
+		name string
+		hdr  []byte
+		addr net.Addr
+	}{
+		{"V1/TCP4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\n"), &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 12345}},
+		{"V1/TCP6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 443 8443\r\n"), &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}},
+		{"V1/UNKNOWN", []byte("PROXY UNKNOWN\r\n"), nil},
+		{"V2/TCP4", proxyV2Header(proxyV2CmdProxy, 0x11, v4Body), &net.TCPAddr{IP: net.IP{192, 0, 2, 1}, Port: 12345}},
+		{"V2/UDP4", proxyV2Header(proxyV2CmdProxy, 0x12, v4Body), &net.UDPAddr{IP: net.IP{192, 0, 2, 1}, Port: 12345}},
+		{"V2/TCP6", proxyV2Header(proxyV2CmdProxy, 0x21, v6Body), &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}},
+		{"V2/Unix", proxyV2Header(proxyV2CmdProxy, 0x31, unixBody), &net.UnixAddr{Name: "/tmp/client.sock", Net: "unix"}},
+		{"V2/TLVs", proxyV2Header(proxyV2CmdProxy, 0x11, append(append([]byte{}, v4Body...), 0x04, 0x00, 0x01, 0xff)), &net.TCPAddr{IP: net.IP{192, 0, 2, 1}, Port: 12345}},
+		{"V2/Local", proxyV2Header(proxyV2CmdLocal, 0x00, nil), nil},
+	} {
+		t.Run(v.name, func(t *testing.T) {
+			require := require.New(t)
+
+			r := bytes.NewReader(append(append([]byte{}, v.hdr...), trailer...))
+			addr, err := readProxyHeader(r)
+			require.NoError(err, "readProxyHeader")
+			require.Equal(v.addr, addr, "source address")
+
+			rest := make([]byte, r.Len())
+			_, _ = r.Read(rest)
+			require.Equal(trailer, rest, "no over-read")
+		})
+	}
+
+	for _, v := range []struct {
+		name string
+		hdr  []byte
+	}{
+		{"NotProxy", []byte("Noise_XX_25519_ChaChaPoly\r\n")},
+		{"V1/NoCR", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\n")},
+		{"V1/FamilyMismatch", []byte("PROXY TCP4 2001:db8::1 2001:db8::2 443 8443\r\n")},
+		{"V1/BadPort", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n")},
+		{"V1/TooLong", append([]byte("PROXY TCP4 "), bytes.Repeat([]byte{'1'}, proxyV1MaxLen)...)},
+		{"V2/BadVersion", append(append([]byte{}, proxyV2Signature...), 0x11, 0x11, 0, 0)},
+		{"V2/ShortBody", proxyV2Header(proxyV2CmdProxy, 0x11, v4Body[:8])},
+	} {
+		t.Run("Malformed/"+v.name, func(t *testing.T) {
+			_, err := readProxyHeader(bytes.NewReader(v.hdr))
+			require.Equal(t, errMalformedProxyHeader, err, "readProxyHeader")
+		})
+	}
+
+	t.Run("Listener", func(t *testing.T) {
+		require := require.New(t)
+
+		protoNN := mustProtocol(t, "Noise_NN_25519_ChaChaPoly_BLAKE2s")
+		l, err := Listen("tcp", "127.0.0.1:0", &Config{
+			Protocol:      protoNN,
+			ProxyProtocol: true,
+		})
+		require.NoError(err, "Listen")
+		defer l.Close()
+
+		connCh := make(chan *Conn, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				close(connCh)
+				return
+			}
+			connCh <- conn.(*Conn)
+		}()
+
+		rawConn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(err, "net.Dial")
+		_, err = rawConn.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 12345 443\r\n"))
+		require.NoError(err, "Write - PROXY header")
+
+		client, err := Client(rawConn, &Config{Protocol: protoNN})
+		require.NoError(err, "Client")
+		defer client.Close()
+
+		server, ok := <-connCh
+		require.True(ok, "Accept")
+		defer server.Close()
+
+		require.Equal(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 12345}, server.ConnectionState().SourceAddr, "SourceAddr")
+		require.Nil(client.ConnectionState().SourceAddr, "SourceAddr - client")
+	})
+}
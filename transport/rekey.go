@@ -0,0 +1,96 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import "time"
+
+// RekeyReason is the reason for a traffic key change.
+type RekeyReason int
+
+const (
+	// RekeyLifetime is an outgoing traffic key update due to
+	// Config.MaxLifetime being exceeded.
+	RekeyLifetime RekeyReason = iota
+
+	// RekeyKeyUpdate is an incoming traffic key update due to a key update
+	// record sent by the peer.
+	RekeyKeyUpdate
+
+	// RekeyRenegotiation is a traffic key change due to a completed
+	// renegotiation.
+	RekeyRenegotiation
+)
+
+// String returns the string representation of a RekeyReason.
+func (r RekeyReason) String() string {
+	switch r {
+	case RekeyLifetime:
+		return "lifetime"
+	case RekeyKeyUpdate:
+		return "key update"
+	case RekeyRenegotiation:
+		return "renegotiation"
+	default:
+		return "[unknown rekey reason]"
+	}
+}
+
+// RekeyEvent is a traffic key change notification.
+type RekeyEvent struct {
+	// Reason is the reason for the key change.
+	Reason RekeyReason
+
+	// IsWrite is true iff the outgoing traffic key changed, and false
+	// if the incoming traffic key changed.
+	IsWrite bool
+
+	// Generation is the new key generation for the direction, where the
+	// key from the initial handshake is generation 0.
+	Generation uint64
+
+	// Time is the time of the key change.
+	Time time.Time
+}
+
+// onRekey records a traffic key change for hc, and notifies the
+// application.  The caller must hold hc.
+func (c *Conn) onRekey(hc *halfConn, reason RekeyReason) {
+	hc.keyGeneration++
+	if c.cfg.OnRekey == nil {
+		return
+	}
+
+	c.cfg.OnRekey(RekeyEvent{
+		Reason:     reason,
+		IsWrite:    hc == &c.out,
+		Generation: hc.keyGeneration,
+		Time:       c.now(),
+	})
+}
@@ -0,0 +1,262 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+var (
+	errRenegotiateServer     = errors.New("nyquist/transport: only clients may initiate renegotiation")
+	errRenegotiateInProgress = errors.New("nyquist/transport: renegotiation in progress")
+
+	renegotiationPrologue = []byte("nyquist/transport: renegotiation")
+)
+
+// Renegotiate initiates a new handshake over the established connection,
+// so that fresh ephemeral keys are used for the traffic keys.  Only clients
+// may initiate renegotiation.
+//
+// The handshake messages are carried in records, and the handshake is
+// completed in the background as records are read from the connection,
+// so the application must be reading from the connection.  Once the
+// handshake is complete, each direction atomically switches to the new
+// traffic keys, and application data may be sent and received throughout.
+//
+// The renegotiation handshake uses the same protocol, is bound to the
+// previous handshake hash via the prologue, uses a PSK derived from the
+// previous handshake for any `psk` tokens, and fails if the peer's static
+// public key changes.
+func (c *Conn) Renegotiate() error {
+	if !c.isClient {
+		return errRenegotiateServer
+	}
+	if err := c.ensureHandshake(); err != nil {
+		return err
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	if c.out.err != nil {
+		return c.out.err
+	}
+
+	return c.startRenegotiation()
+}
+
+// startRenegotiation sends the initiator's first renegotiation handshake
+// message.  The caller must hold c.out.
+func (c *Conn) startRenegotiation() error {
+	if c.reneg != nil || c.renegIn != nil {
+		return errRenegotiateInProgress
+	}
+
+	hs, err := c.newRenegotiationHandshake()
+	if err != nil {
+		return err
+	}
+	msg, err := hs.WriteMessage(nil, nil)
+	if err != nil {
+		hs.Reset()
+		return err
+	}
+	if err = c.writeRenegotiationRecord(msg); err != nil {
+		hs.Reset()
+		c.out.err = err
+		return err
+	}
+	c.reneg = hs
+
+	return nil
+}
+
+func (c *Conn) newRenegotiationHandshake() (*nyquist.HandshakeState, error) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	prologue := make([]byte, 0, len(renegotiationPrologue)+len(c.handshakeHash))
+	prologue = append(prologue, renegotiationPrologue...)
+	prologue = append(prologue, c.handshakeHash...)
+
+	psks := make([][]byte, c.protocol.Pattern.NumPSKs())
+	for i := range psks {
+		psks[i] = c.resumptionPSK
+	}
+
+	cfg := &nyquist.HandshakeConfig{
+		Protocol:      c.protocol,
+		Prologue:      prologue,
+		LocalStatic:   c.cfg.LocalStatic,
+		RemoteStatic:  c.remoteStatic,
+		PreSharedKeys: psks,
+		Rng:           c.cfg.Rng,
+		EnableASK:     true,
+		IsInitiator:   c.isClient,
+
+		ExportTrafficKeys: c.cfg.KeyEscrow != nil,
+	}
+	if c.remoteStatic != nil {
+		cfg.ExpectedRemoteStatics = []dh.PublicKey{c.remoteStatic}
+	}
+
+	return nyquist.NewHandshake(cfg)
+}
+
+// onRenegotiate processes a renegotiation handshake message, and sends the
+// response if any.  The caller must hold c.in.
+func (c *Conn) onRenegotiate(msg []byte) error {
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	if c.out.err != nil {
+		return c.out.err
+	}
+
+	if c.reneg == nil {
+		if c.isClient || c.renegIn != nil {
+			return errMalformedRecord
+		}
+		hs, err := c.newRenegotiationHandshake()
+		if err != nil {
+			return err
+		}
+		c.reneg = hs
+	}
+
+	_, err := c.reneg.ReadMessage(nil, msg)
+	if err == nil {
+		if msg, err = c.reneg.WriteMessage(nil, nil); err == nil || err == nyquist.ErrDone {
+			if wrErr := c.writeRenegotiationRecord(msg); wrErr != nil {
+				c.out.err = wrErr
+				err = wrErr
+			}
+		}
+	}
+	switch err {
+	case nil:
+		return nil
+	case nyquist.ErrDone:
+		return c.finishRenegotiation()
+	default:
+		c.reneg.Reset()
+		c.reneg = nil
+		return err
+	}
+}
+
+// finishRenegotiation switches the outbound direction to the new traffic
+// key, and retains the new inbound traffic key until the peer switches.
+// The caller must hold c.out.
+func (c *Conn) finishRenegotiation() error {
+	hs := c.reneg
+	defer hs.Reset()
+	c.reneg = nil
+
+	status := hs.GetStatus()
+	in, out := c.splitCipherStates(status)
+	c.setHandshakeStatus(status)
+	if err := c.escrowKeys(status); err != nil {
+		in.Reset()
+		out.Reset()
+		c.out.err = err
+		return err
+	}
+
+	// The change keys record is the last record sent with the old key.
+	if err := c.writeRecord(recordTypeChangeKeys, nil); err != nil {
+		in.Reset()
+		out.Reset()
+		c.out.err = err
+		return err
+	}
+	c.out.cs.Reset()
+	c.out.cs = out
+	c.out.keyCreated = c.now()
+	c.renegIn = in
+	atomic.AddUint64(&c.renegotiations, 1)
+	c.onRekey(&c.out, RekeyRenegotiation)
+
+	return nil
+}
+
+// onChangeKeys switches the inbound direction to the new traffic key.  The
+// caller must hold c.in.
+func (c *Conn) onChangeKeys(body []byte) error {
+	if len(body) != 0 {
+		return errMalformedRecord
+	}
+
+	c.out.Lock()
+	in := c.renegIn
+	c.renegIn = nil
+	c.out.Unlock()
+	if in == nil {
+		return errMalformedRecord
+	}
+
+	c.in.cs.Reset()
+	c.in.cs = in
+	c.onRekey(&c.in, RekeyRenegotiation)
+
+	return nil
+}
+
+func (c *Conn) writeRenegotiationRecord(msg []byte) error {
+	if len(msg) > c.recordPayloadLimit(0) {
+		return nyquist.ErrMessageSize
+	}
+	return c.writeRecord(recordTypeRenegotiate, msg)
+}
+
+func (c *Conn) resetRenegotiation() {
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	if c.reneg != nil {
+		c.reneg.Reset()
+		c.reneg = nil
+	}
+	if c.renegIn != nil {
+		c.renegIn.Reset()
+		c.renegIn = nil
+	}
+}
+
+func (c *Conn) getResumptionPSK() []byte {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	return append([]byte{}, c.resumptionPSK...)
+}
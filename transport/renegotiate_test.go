@@ -0,0 +1,174 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git"
+)
+
+func TestRenegotiate(t *testing.T) {
+	serverStatic, clientStatic := mustKeypair(t), mustKeypair(t)
+	psk := make([]byte, 32)
+	_, _ = rand.Read(psk)
+
+	for _, v := range []struct {
+		name       string
+		serverCfg  *Config
+		clientCfg  *Config
+		hasStatics bool
+	}{
+		{
+			"NN",
+			&Config{Protocol: mustProtocol(t, "Noise_NN_25519_ChaChaPoly_BLAKE2s")},
+			&Config{Protocol: mustProtocol(t, "Noise_NN_25519_ChaChaPoly_BLAKE2s")},
+			false,
+		},
+		{
+			"XX",
+			&Config{
+				Protocol:    mustProtocol(t, "Noise_XX_25519_ChaChaPoly_BLAKE2s"),
+				LocalStatic: serverStatic,
+			},
+			&Config{
+				Protocol:    mustProtocol(t, "Noise_XX_25519_ChaChaPoly_BLAKE2s"),
+				LocalStatic: clientStatic,
+			},
+			true,
+		},
+		{
+			"IKpsk2",
+			&Config{
+				Protocol:      mustProtocol(t, "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"),
+				LocalStatic:   serverStatic,
+				PreSharedKeys: [][]byte{psk},
+			},
+			&Config{
+				Protocol:      mustProtocol(t, "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"),
+				LocalStatic:   clientStatic,
+				RemoteStatic:  serverStatic.Public(),
+				PreSharedKeys: [][]byte{psk},
+			},
+			true,
+		},
+	} {
+		t.Run(v.name, func(t *testing.T) {
+			require := require.New(t)
+
+			var events rekeyRecorder
+			v.clientCfg.OnRekey = events.OnRekey
+			server, client := newTestConnPair(t, v.serverCfg, v.clientCfg)
+			defer client.Close()
+			defer server.Close()
+
+			go func() {
+				_, _ = io.Copy(server, server)
+			}()
+
+			require.Equal(errRenegotiateServer, server.Renegotiate(), "server.Renegotiate")
+
+			echo := func() {
+				msg := []byte("renegotiation")
+				_, err := client.Write(msg)
+				require.NoError(err, "client.Write")
+				b := make([]byte, len(msg))
+				_, err = io.ReadFull(client, b)
+				require.NoError(err, "client.Read")
+				require.Equal(msg, b, "client.Read - echo")
+			}
+
+			hashes := [][]byte{client.HandshakeHash()}
+			for i := 1; i <= 2; i++ {
+				require.NoError(client.Renegotiate(), "client.Renegotiate")
+				require.Equal(errRenegotiateInProgress, client.Renegotiate(), "client.Renegotiate - in progress")
+
+				// Data flows throughout the renegotiation.
+				for j := 0; j < 3; j++ {
+					echo()
+				}
+
+				h := client.HandshakeHash()
+				require.Equal(h, server.HandshakeHash(), "HandshakeHash - match")
+				for _, prev := range hashes {
+					require.NotEqual(prev, h, "HandshakeHash - fresh")
+				}
+				hashes = append(hashes, h)
+
+				require.EqualValues(i, client.Stats().Renegotiations, "client Renegotiations")
+				require.EqualValues(i, server.Stats().Renegotiations, "server Renegotiations")
+				if v.hasStatics {
+					require.Equal(serverStatic.Public().Bytes(), client.RemoteStatic().Bytes(), "client RemoteStatic")
+					require.Equal(clientStatic.Public().Bytes(), server.RemoteStatic().Bytes(), "server RemoteStatic")
+				}
+			}
+
+			require.Equal([]RekeyEvent{
+				{Reason: RekeyRenegotiation, IsWrite: true, Generation: 1},
+				{Reason: RekeyRenegotiation, IsWrite: false, Generation: 1},
+				{Reason: RekeyRenegotiation, IsWrite: true, Generation: 2},
+				{Reason: RekeyRenegotiation, IsWrite: false, Generation: 2},
+			}, events.withoutTime(), "OnRekey")
+		})
+	}
+
+	t.Run("ChangedStatic", func(t *testing.T) {
+		require := require.New(t)
+
+		protoXX := mustProtocol(t, "Noise_XX_25519_ChaChaPoly_BLAKE2s")
+		server, client := newTestConnPair(t, &Config{
+			Protocol:    protoXX,
+			LocalStatic: serverStatic,
+		}, &Config{
+			Protocol:    protoXX,
+			LocalStatic: clientStatic,
+		})
+		defer client.Close()
+		defer server.Close()
+
+		// The server's static key changes between handshakes.
+		server.cfg = &Config{
+			Protocol:    protoXX,
+			LocalStatic: mustKeypair(t),
+		}
+		go func() {
+			_, _ = io.Copy(server, server)
+		}()
+
+		require.NoError(client.Renegotiate(), "client.Renegotiate")
+		_, err := client.Read(make([]byte, 1))
+		require.True(errors.Is(err, nyquist.ErrUnexpectedRemoteStatic), "client.Read - changed static: %v", err)
+	})
+}
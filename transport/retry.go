@@ -0,0 +1,119 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"gitlab.com/yawning/nyquist.git"
+)
+
+const (
+	defaultInitialBackoff = 100 * time.Millisecond
+	defaultMaxBackoff     = 5 * time.Second
+)
+
+// RetryPolicy is a Dialer's policy for retrying connections whose
+// handshake fails due to a transient error.  Each retry establishes a new
+// connection, and performs a new handshake with a freshly generated
+// ephemeral keypair.
+type RetryPolicy struct {
+	// MaxRetries is the maximum number of times a connection will be
+	// retried.
+	MaxRetries int
+
+	// InitialBackoff is the delay before the first retry, which is doubled
+	// for each subsequent retry.  If 0, a default of 100 ms is used.
+	InitialBackoff time.Duration
+
+	// MaxBackoff is the maximum delay between retries.  If 0, a default of
+	// 5 s is used.
+	MaxBackoff time.Duration
+
+	// IsTransient returns true iff a connection that failed with err
+	// should be retried.  If nil, IsTransientError is used.
+	IsTransient func(err error) bool
+}
+
+// IsTransientError returns true iff err is likely to be transient, that is
+// a handshake message failed to authenticate (eg: due to corruption in
+// transit), or a network operation timed out.
+func IsTransientError(err error) bool {
+	if errors.Is(err, nyquist.ErrOpen) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (p *RetryPolicy) shouldRetry(ctx context.Context, attempt int, err error) bool {
+	if p == nil || attempt >= p.MaxRetries || ctx.Err() != nil {
+		return false
+	}
+
+	isTransient := p.IsTransient
+	if isTransient == nil {
+		isTransient = IsTransientError
+	}
+	return isTransient(err)
+}
+
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	delay, maxDelay := p.InitialBackoff, p.MaxBackoff
+	if delay <= 0 {
+		delay = defaultInitialBackoff
+	}
+	if maxDelay <= 0 {
+		maxDelay = defaultMaxBackoff
+	}
+	for i := 0; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+func (p *RetryPolicy) wait(ctx context.Context, attempt int) error {
+	timer := time.NewTimer(p.backoff(attempt))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
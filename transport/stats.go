@@ -0,0 +1,120 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"sync/atomic"
+	"time"
+
+	"gitlab.com/yawning/nyquist.git"
+)
+
+// Stats is a snapshot of a connection's statistics.
+type Stats struct {
+	// HandshakeDuration is the time taken to complete the handshake.
+	HandshakeDuration time.Duration
+
+	// Established is the time that the initial handshake completed.
+	Established time.Time
+
+	// Renegotiations is the number of completed renegotiations.
+	Renegotiations uint64
+
+	// Read and Write are the statistics for each direction.
+	Read, Write DirectionStats
+}
+
+// DirectionStats is a snapshot of the statistics for one direction of a
+// connection.
+type DirectionStats struct {
+	// Bytes is the number of application data bytes.
+	Bytes uint64
+
+	// Records is the number of application data records.
+	Records uint64
+
+	// Nonce is the current nonce of the traffic key, which includes
+	// records other than application data.
+	Nonce uint64
+
+	// Rekeys is the number of traffic key updates.
+	Rekeys uint64
+
+	// LastActivity is the time the last record was processed, or the zero
+	// time if there has been none.
+	LastActivity time.Time
+}
+
+// halfStats is the statistics for one direction of a connection.  All
+// fields are accessed atomically.
+type halfStats struct {
+	bytes        uint64
+	records      uint64
+	nonce        uint64
+	rekeys       uint64
+	lastActivity int64
+}
+
+func (s *halfStats) onRecord(cs *nyquist.CipherState, recordType byte, bodyLen int, now time.Time) {
+	switch recordType {
+	case recordTypeData:
+		atomic.AddUint64(&s.bytes, uint64(bodyLen))
+		atomic.AddUint64(&s.records, 1)
+	case recordTypeKeyUpdate:
+		atomic.AddUint64(&s.rekeys, 1)
+	}
+	atomic.StoreUint64(&s.nonce, cs.Nonce())
+	atomic.StoreInt64(&s.lastActivity, now.UnixNano())
+}
+
+func (s *halfStats) snapshot() DirectionStats {
+	ds := DirectionStats{
+		Bytes:   atomic.LoadUint64(&s.bytes),
+		Records: atomic.LoadUint64(&s.records),
+		Nonce:   atomic.LoadUint64(&s.nonce),
+		Rekeys:  atomic.LoadUint64(&s.rekeys),
+	}
+	if t := atomic.LoadInt64(&s.lastActivity); t != 0 {
+		ds.LastActivity = time.Unix(0, t)
+	}
+	return ds
+}
+
+// Stats returns a snapshot of the connection's statistics.  It is safe to
+// call concurrently with other methods.
+func (c *Conn) Stats() Stats {
+	return Stats{
+		HandshakeDuration: c.established.Sub(c.handshakeStarted),
+		Established:       c.established,
+		Renegotiations:    atomic.LoadUint64(&c.renegotiations),
+		Read:              c.inStats.snapshot(),
+		Write:             c.outStats.snapshot(),
+	}
+}
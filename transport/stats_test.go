@@ -0,0 +1,97 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	require := require.New(t)
+
+	protoXX := mustProtocol(t, "Noise_XX_25519_ChaChaPoly_BLAKE2s")
+	server, client := newTestConnPair(t, &Config{
+		Protocol:       protoXX,
+		LocalStatic:    mustKeypair(t),
+		MaxLifetime:    20 * time.Millisecond,
+		LifetimeAction: LifetimeKeyUpdate,
+	}, &Config{
+		Protocol:    protoXX,
+		LocalStatic: mustKeypair(t),
+	})
+	defer client.Close()
+	defer server.Close()
+
+	stats := client.Stats()
+	require.True(stats.HandshakeDuration > 0, "HandshakeDuration")
+	require.False(stats.Established.IsZero(), "Established")
+	require.Zero(stats.Write.Records, "Write.Records - initial")
+	require.True(stats.Write.LastActivity.IsZero(), "Write.LastActivity - initial")
+
+	const numWrites = 3
+	msg := []byte("hello world")
+	b := make([]byte, len(msg))
+	for i := 0; i < numWrites; i++ {
+		_, err := client.Write(msg)
+		require.NoError(err, "client.Write")
+		_, err = io.ReadFull(server, b)
+		require.NoError(err, "server.Read")
+	}
+
+	stats = client.Stats()
+	require.EqualValues(numWrites*len(msg), stats.Write.Bytes, "Write.Bytes")
+	require.EqualValues(numWrites, stats.Write.Records, "Write.Records")
+	require.EqualValues(numWrites, stats.Write.Nonce, "Write.Nonce")
+	require.False(stats.Write.LastActivity.IsZero(), "Write.LastActivity")
+
+	serverStats := server.Stats()
+	require.Equal(stats.Write.Bytes, serverStats.Read.Bytes, "server Read.Bytes")
+	require.Equal(stats.Write.Records, serverStats.Read.Records, "server Read.Records")
+	require.Equal(stats.Write.Nonce, serverStats.Read.Nonce, "server Read.Nonce")
+
+	// The server's traffic key expires, and it is updated on the next write.
+	time.Sleep(30 * time.Millisecond)
+	_, err := server.Write(msg)
+	require.NoError(err, "server.Write")
+	_, err = io.ReadFull(client, b)
+	require.NoError(err, "client.Read")
+
+	serverStats, stats = server.Stats(), client.Stats()
+	require.EqualValues(1, serverStats.Write.Rekeys, "server Write.Rekeys")
+	require.EqualValues(1, stats.Read.Rekeys, "client Read.Rekeys")
+	require.EqualValues(1, stats.Read.Records, "client Read.Records")
+	require.Equal(serverStats.Write.Nonce, stats.Read.Nonce, "client Read.Nonce")
+	require.EqualValues(1, client.ConnectionState().Rekeys, "client ConnectionState - Rekeys")
+	require.EqualValues(1, server.ConnectionState().Rekeys, "server ConnectionState - Rekeys")
+}
@@ -0,0 +1,277 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"gitlab.com/yawning/nyquist.git/clock"
+)
+
+const (
+	// DefaultTicketLifetime is the default resumption ticket lifetime.
+	DefaultTicketLifetime = 24 * time.Hour
+
+	defaultTicketCacheCapacity = 4096
+
+	ticketCacheVersion = 0x01
+
+	// maxTicketCacheVecSize is the maximum size of a ticket or PSK, as
+	// the serialized lengths are a single byte.
+	maxTicketCacheVecSize = 255
+)
+
+var (
+	errTicketCacheMagic = errors.New("nyquist/transport: malformed ticket cache")
+	errTicketCacheSize  = errors.New("nyquist/transport: ticket or PSK too large")
+
+	ticketCacheMagic = []byte("nyquist-tickets")
+)
+
+type ticketEntry struct {
+	ticket string
+	psk    []byte
+	expiry time.Time
+}
+
+// TicketCache is a bounded in-memory TicketStore with expiry and
+// single-use enforcement.  When full, the oldest ticket is evicted.
+//
+// The cache contents may be persisted across restarts with Save and Load.
+type TicketCache struct {
+	mu sync.Mutex
+
+	m        map[string]*list.Element
+	q        *list.List
+	capacity int
+	lifetime time.Duration
+	clk      clock.Clock
+}
+
+// SetClock sets the clock used for ticket expiry.  If clk is nil, the
+// system clock is used.
+func (c *TicketCache) SetClock(clk clock.Clock) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.clk = clock.Get(clk)
+}
+
+// Put stores the resumption PSK associated with a ticket.  The ticket and
+// PSK may each be at most 255 bytes.
+func (c *TicketCache) Put(ticket, psk []byte) error {
+	if len(ticket) > maxTicketCacheVecSize || len(psk) > maxTicketCacheVecSize {
+		return errTicketCacheSize
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.put(string(ticket), append([]byte{}, psk...), c.clk.Now().Add(c.lifetime))
+
+	return nil
+}
+
+func (c *TicketCache) put(ticket string, psk []byte, expiry time.Time) {
+	if elem, ok := c.m[ticket]; ok {
+		c.remove(elem)
+	}
+	for c.q.Len() >= c.capacity {
+		c.remove(c.q.Back())
+	}
+	c.m[ticket] = c.q.PushFront(&ticketEntry{
+		ticket: ticket,
+		psk:    psk,
+		expiry: expiry,
+	})
+}
+
+// Get returns and removes the resumption PSK associated with a ticket,
+// iff it exists and has not expired.
+func (c *TicketCache) Get(ticket []byte) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.m[string(ticket)]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*ticketEntry)
+	c.q.Remove(elem)
+	delete(c.m, entry.ticket)
+
+	if !c.clk.Now().Before(entry.expiry) {
+		zero(entry.psk)
+		return nil, false
+	}
+
+	return entry.psk, true
+}
+
+// Len returns the number of tickets in the cache, including expired
+// tickets that have yet to be purged.
+func (c *TicketCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.q.Len()
+}
+
+// Purge removes all expired tickets.
+func (c *TicketCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clk.Now()
+	for elem := c.q.Front(); elem != nil; {
+		next := elem.Next()
+		if !now.Before(elem.Value.(*ticketEntry).expiry) {
+			c.remove(elem)
+		}
+		elem = next
+	}
+}
+
+func (c *TicketCache) remove(elem *list.Element) {
+	entry := elem.Value.(*ticketEntry)
+	zero(entry.psk)
+	c.q.Remove(elem)
+	delete(c.m, entry.ticket)
+}
+
+// Save writes the unexpired tickets to w.
+//
+// Warning: The serialized cache contains the resumption PSKs in the clear,
+// and must be stored securely.
+func (c *TicketCache) Save(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	_, _ = bw.Write(ticketCacheMagic)
+	_ = bw.WriteByte(ticketCacheVersion)
+
+	now := c.clk.Now()
+	var tmp [8]byte
+	for elem := c.q.Back(); elem != nil; elem = elem.Prev() {
+		entry := elem.Value.(*ticketEntry)
+		if !now.Before(entry.expiry) {
+			continue
+		}
+
+		_ = bw.WriteByte(byte(len(entry.ticket)))
+		_, _ = bw.WriteString(entry.ticket)
+		_ = bw.WriteByte(byte(len(entry.psk)))
+		_, _ = bw.Write(entry.psk)
+		binary.BigEndian.PutUint64(tmp[:], uint64(entry.expiry.UnixNano()))
+		_, _ = bw.Write(tmp[:])
+	}
+
+	return bw.Flush()
+}
+
+// Load reads tickets previously written by Save from r, and adds the
+// unexpired tickets to the cache.
+func (c *TicketCache) Load(r io.Reader) error {
+	br := bufio.NewReader(r)
+
+	hdr := make([]byte, len(ticketCacheMagic)+1)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return errTicketCacheMagic
+	}
+	if string(hdr[:len(ticketCacheMagic)]) != string(ticketCacheMagic) || hdr[len(ticketCacheMagic)] != ticketCacheVersion {
+		return errTicketCacheMagic
+	}
+
+	readVec := func() ([]byte, error) {
+		l, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, l)
+		if _, err = io.ReadFull(br, b); err != nil {
+			return nil, errTicketCacheMagic
+		}
+		return b, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clk.Now()
+	for {
+		ticket, err := readVec()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errTicketCacheMagic
+		}
+		psk, err := readVec()
+		if err != nil {
+			return errTicketCacheMagic
+		}
+		var tmp [8]byte
+		if _, err = io.ReadFull(br, tmp[:]); err != nil {
+			return errTicketCacheMagic
+		}
+		expiry := time.Unix(0, int64(binary.BigEndian.Uint64(tmp[:])))
+
+		if now.Before(expiry) {
+			c.put(string(ticket), psk, expiry)
+		}
+	}
+}
+
+// NewTicketCache creates a new TicketCache holding at most capacity tickets,
+// each valid for lifetime.  If capacity or lifetime are < 1, defaults will
+// be used instead.
+func NewTicketCache(capacity int, lifetime time.Duration) *TicketCache {
+	if capacity < 1 {
+		capacity = defaultTicketCacheCapacity
+	}
+	if lifetime < 1 {
+		lifetime = DefaultTicketLifetime
+	}
+
+	return &TicketCache{
+		m:        make(map[string]*list.Element),
+		q:        list.New(),
+		capacity: capacity,
+		lifetime: lifetime,
+		clk:      clock.System,
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git/clock"
+)
+
+func TestTicketCache(t *testing.T) {
+	ticket := func(i byte) []byte {
+		return bytes.Repeat([]byte{i}, ticketSize)
+	}
+	psk := func(i byte) []byte {
+		return bytes.Repeat([]byte{i}, 32)
+	}
+
+	t.Run("SingleUse", func(t *testing.T) {
+		require := require.New(t)
+
+		c := NewTicketCache(0, 0)
+		require.NoError(c.Put(ticket(1), psk(1)), "Put")
+		require.Equal(1, c.Len(), "Len")
+
+		b, ok := c.Get(ticket(1))
+		require.True(ok, "Get")
+		require.Equal(psk(1), b, "Get - psk")
+
+		_, ok = c.Get(ticket(1))
+		require.False(ok, "Get - reuse")
+		_, ok = c.Get(ticket(2))
+		require.False(ok, "Get - missing")
+	})
+
+	t.Run("Capacity", func(t *testing.T) {
+		require := require.New(t)
+
+		c := NewTicketCache(2, 0)
+		for i := byte(1); i <= 3; i++ {
+			require.NoError(c.Put(ticket(i), psk(i)), "Put(%d)", i)
+		}
+		require.Equal(2, c.Len(), "Len")
+
+		_, ok := c.Get(ticket(1))
+		require.False(ok, "Get - evicted")
+		_, ok = c.Get(ticket(3))
+		require.True(ok, "Get - newest")
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		require := require.New(t)
+
+		clk := clock.NewFake(time.Now())
+		c := NewTicketCache(0, 50*time.Millisecond)
+		c.SetClock(clk)
+		require.NoError(c.Put(ticket(1), psk(1)), "Put(1)")
+		require.NoError(c.Put(ticket(2), psk(2)), "Put(2)")
+		clk.Advance(50 * time.Millisecond)
+		require.NoError(c.Put(ticket(3), psk(3)), "Put(3)")
+
+		_, ok := c.Get(ticket(1))
+		require.False(ok, "Get - expired")
+
+		c.Purge()
+		require.Equal(1, c.Len(), "Len - after Purge")
+		_, ok = c.Get(ticket(3))
+		require.True(ok, "Get - unexpired")
+	})
+
+	t.Run("Persistence", func(t *testing.T) {
+		require := require.New(t)
+
+		c := NewTicketCache(0, time.Hour)
+		for i := byte(1); i <= 3; i++ {
+			require.NoError(c.Put(ticket(i), psk(i)), "Put(%d)", i)
+		}
+		_, _ = c.Get(ticket(2))
+
+		var buf bytes.Buffer
+		require.NoError(c.Save(&buf), "Save")
+		serialized := buf.Bytes()
+
+		c2 := NewTicketCache(0, time.Hour)
+		require.NoError(c2.Load(bytes.NewReader(serialized)), "Load")
+		require.Equal(2, c2.Len(), "Len - after Load")
+		for _, i := range []byte{1, 3} {
+			b, ok := c2.Get(ticket(i))
+			require.True(ok, "Get(%d) - after Load", i)
+			require.Equal(psk(i), b, "Get(%d) - psk", i)
+		}
+		_, ok := c2.Get(ticket(2))
+		require.False(ok, "Get - used before Save")
+
+		err := NewTicketCache(0, 0).Load(bytes.NewReader(serialized[:len(serialized)-1]))
+		require.Equal(errTicketCacheMagic, err, "Load - truncated")
+		err = NewTicketCache(0, 0).Load(bytes.NewReader([]byte("not a ticket cache")))
+		require.Equal(errTicketCacheMagic, err, "Load - bad magic")
+	})
+	t.Run("Size", func(t *testing.T) {
+		require := require.New(t)
+
+		c := NewTicketCache(0, time.Hour)
+		big := bytes.Repeat([]byte{0x42}, maxTicketCacheVecSize+1)
+		require.Equal(errTicketCacheSize, c.Put(big, psk(1)), "Put - oversized ticket")
+		require.Equal(errTicketCacheSize, c.Put(ticket(1), big), "Put - oversized psk")
+		require.Zero(c.Len(), "Len - after oversized Put")
+
+		// The largest allowed ticket and PSK survive a round trip.
+		maxTicket, maxPSK := big[:maxTicketCacheVecSize], bytes.Repeat([]byte{0x43}, maxTicketCacheVecSize)
+		require.NoError(c.Put(maxTicket, maxPSK), "Put - maximum size")
+		require.NoError(c.Put(ticket(2), psk(2)), "Put")
+
+		var buf bytes.Buffer
+		require.NoError(c.Save(&buf), "Save")
+		c2 := NewTicketCache(0, time.Hour)
+		require.NoError(c2.Load(&buf), "Load")
+		b, ok := c2.Get(maxTicket)
+		require.True(ok, "Get - maximum size")
+		require.Equal(maxPSK, b, "Get - maximum size psk")
+		b, ok = c2.Get(ticket(2))
+		require.True(ok, "Get - after maximum size")
+		require.Equal(psk(2), b, "Get - psk after maximum size")
+	})
+}
@@ -0,0 +1,981 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/cipher"
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+// maxRecordPayload is the maximum record payload with the 16 byte tags used
+// by the standard ciphers.
+const maxRecordPayload = maxFrameSize - recordOverhead - 16
+
+func mustProtocol(t *testing.T, s string) *nyquist.Protocol {
+	protocol, err := nyquist.NewProtocol(s)
+	require.NoError(t, err, "NewProtocol(%s)", s)
+	return protocol
+}
+
+func mustKeypair(t *testing.T) dh.Keypair {
+	kp, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(t, err, "GenerateKeypair")
+	return kp
+}
+
+func startEchoServer(t *testing.T, cfg *Config) *Listener {
+	l, err := Listen("tcp", "127.0.0.1:0", cfg)
+	require.NoError(t, err, "Listen")
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return l
+}
+
+func echo(t *testing.T, conn *Conn, msg []byte) {
+	require := require.New(t)
+
+	go func() {
+		_, _ = conn.Write(msg)
+	}()
+	buf := make([]byte, len(msg))
+	_, err := io.ReadFull(conn, buf)
+	require.NoError(err, "ReadFull")
+	require.Equal(msg, buf, "echo")
+}
+
+func TestTransport(t *testing.T) {
+	serverStatic, clientStatic := mustKeypair(t), mustKeypair(t)
+	protoXX := mustProtocol(t, "Noise_XX_25519_ChaChaPoly_BLAKE2s")
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		require := require.New(t)
+
+		l := startEchoServer(t, &Config{
+			Protocol:    protoXX,
+			LocalStatic: serverStatic,
+		})
+		defer l.Close()
+
+		conn, err := Dial("tcp", l.Addr().String(), &Config{
+			Protocol:    protoXX,
+			LocalStatic: clientStatic,
+		})
+		require.NoError(err, "Dial")
+		defer conn.Close()
+
+		require.Equal(serverStatic.Public().Bytes(), conn.RemoteStatic().Bytes(), "RemoteStatic")
+		require.Equal(protoXX, conn.Protocol(), "Protocol")
+		require.False(conn.DidResume(), "DidResume")
+
+		state := conn.ConnectionState()
+		require.Equal(protoXX.String(), state.Protocol, "ConnectionState - Protocol")
+		require.True(state.IsClient, "ConnectionState - IsClient")
+		require.Equal(serverStatic.Public().Bytes(), state.RemoteStatic.Bytes(), "ConnectionState - RemoteStatic")
+		require.Equal(conn.HandshakeHash(), state.HandshakeHash, "ConnectionState - HandshakeHash")
+		require.False(state.DidResume, "ConnectionState - DidResume")
+		require.Zero(state.Rekeys, "ConnectionState - Rekeys")
+
+		msg := make([]byte, 3*maxRecordPayload+17)
+		_, _ = rand.Read(msg)
+		echo(t, conn, msg)
+		echo(t, conn, []byte("short message"))
+
+		require.NoError(conn.Close(), "Close")
+		_, err = conn.Write([]byte("after close"))
+		require.Error(err, "Write - after close")
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		require := require.New(t)
+
+		l := startEchoServer(t, &Config{
+			Protocol:    protoXX,
+			LocalStatic: serverStatic,
+		})
+		defer l.Close()
+
+		_, err := Dial("tcp", l.Addr().String(), &Config{
+			Protocol:    mustProtocol(t, "Noise_NN_25519_ChaChaPoly_BLAKE2s"),
+			LocalStatic: clientStatic,
+		})
+		require.Equal(ErrRejected, err, "Dial - unsupported protocol")
+
+		_, err = Dial("tcp", l.Addr().String(), &Config{
+			Protocol:    protoXX,
+			LocalStatic: clientStatic,
+			Prologue:    []byte("mismatched prologue"),
+		})
+		require.Error(err, "Dial - mismatched prologue")
+	})
+
+	t.Run("Dialer", func(t *testing.T) {
+		require := require.New(t)
+
+		protoIK := mustProtocol(t, "Noise_IK_25519_ChaChaPoly_BLAKE2s")
+		protoIKpsk2 := mustProtocol(t, "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s")
+		tickets := NewTicketCache(0, 0)
+
+		l := startEchoServer(t, &Config{
+			Protocol:        protoXX,
+			AcceptProtocols: []*nyquist.Protocol{protoXX, protoIK, protoIKpsk2},
+			LocalStatic:     serverStatic,
+			TicketStore:     tickets,
+		})
+		defer l.Close()
+		addr := l.Addr().String()
+
+		cache := NewLRUClientSessionCache(0)
+		d := &Dialer{
+			Config: &Config{
+				Protocol:    protoXX,
+				LocalStatic: clientStatic,
+			},
+			ResumeProtocol:    protoIK,
+			ResumePSKProtocol: protoIKpsk2,
+			SessionCache:      cache,
+		}
+
+		dialAndCheck := func(expectedProtocol *nyquist.Protocol, expectedResume bool) {
+			conn, err := d.Dial("tcp", addr)
+			require.NoError(err, "Dial")
+			defer conn.Close()
+
+			require.Equal(expectedProtocol, conn.Protocol(), "Protocol")
+			require.Equal(expectedResume, conn.DidResume(), "DidResume")
+			require.Equal(serverStatic.Public().Bytes(), conn.RemoteStatic().Bytes(), "RemoteStatic")
+
+			// Process the ticket.
+			echo(t, conn, []byte("ping"))
+		}
+
+		// Full handshake, then resumption via ticket.
+		dialAndCheck(protoXX, false)
+		state, ok := cache.Get(addr)
+		require.True(ok, "cache.Get")
+		require.NotNil(state.Ticket, "cached ticket")
+		dialAndCheck(protoIKpsk2, true)
+		dialAndCheck(protoIKpsk2, true)
+
+		// Replayed (stale) ticket, falls back to XX.
+		cache.Put(addr, state)
+		dialAndCheck(protoXX, false)
+
+		// Cached static without a ticket uses IK.
+		cache.Put(addr, &ClientSessionState{
+			RemoteStatic: serverStatic.Public(),
+		})
+		dialAndCheck(protoIK, false)
+
+		// Stale cached static, falls back to XX.
+		cache.Put(addr, &ClientSessionState{
+			RemoteStatic: mustKeypair(t).Public(),
+		})
+		dialAndCheck(protoXX, false)
+
+		// Unless the cached static is required, in which case it is
+		// retained, and the handshake failure is returned.
+		staleStatic := mustKeypair(t).Public()
+		cache.Put(addr, &ClientSessionState{
+			RemoteStatic: staleStatic,
+		})
+		d.RequireCachedStatic = true
+		_, err := d.Dial("tcp", addr)
+		require.Error(err, "Dial - stale cached static, required")
+		state, ok = cache.Get(addr)
+		require.True(ok, "cache.Get - stale cached static, required")
+		require.Equal(staleStatic.Bytes(), state.RemoteStatic.Bytes(), "cached static retained")
+		d.RequireCachedStatic = false
+
+		// Dial failures are returned as is.
+		l.Close()
+		_, err = d.Dial("tcp", addr)
+		_, isOpError := err.(*net.OpError)
+		require.True(isOpError, "Dial - closed listener: %v", err)
+	})
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	require := require.New(t)
+
+	serverStatic := mustKeypair(t)
+	l := startEchoServer(t, &Config{
+		Protocol:         mustProtocol(t, "Noise_XX_25519_ChaChaPoly_BLAKE2s"),
+		LocalStatic:      serverStatic,
+		HandshakeTimeout: 100 * time.Millisecond,
+	})
+	defer l.Close()
+
+	// A half-open initiator that never sends anything should be
+	// disconnected by the server once the handshake timeout expires.
+	rawConn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(err, "net.Dial")
+	defer rawConn.Close()
+
+	start := time.Now()
+	err = rawConn.SetReadDeadline(start.Add(5 * time.Second))
+	require.NoError(err, "SetReadDeadline")
+	_, err = rawConn.Read(make([]byte, 1))
+	require.Equal(io.EOF, err, "Read - server closed connection")
+	require.Less(time.Since(start), 5*time.Second, "handshake timeout")
+}
+
+type corruptingDialer struct {
+	numCorrupt int
+	numDials   int
+}
+
+func (d *corruptingDialer) Dial(network, address string) (net.Conn, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	d.numDials++
+	if d.numDials > d.numCorrupt {
+		return conn, nil
+	}
+	return &corruptingConn{Conn: conn}, nil
+}
+
+type corruptingConn struct {
+	net.Conn
+
+	off int
+}
+
+func (c *corruptingConn) Read(p []byte) (int, error) {
+	// Corrupt a byte in the middle of the server's first handshake
+	// message.
+	const corruptOff = 40
+
+	n, err := c.Conn.Read(p)
+	if c.off <= corruptOff && c.off+n > corruptOff {
+		p[corruptOff-c.off] ^= 0xa5
+	}
+	c.off += n
+	return n, err
+}
+
+func TestDialerRetry(t *testing.T) {
+	require := require.New(t)
+
+	protoXX := mustProtocol(t, "Noise_XX_25519_ChaChaPoly_BLAKE2s")
+	l := startEchoServer(t, &Config{
+		Protocol:    protoXX,
+		LocalStatic: mustKeypair(t),
+	})
+	defer l.Close()
+
+	netDialer := &corruptingDialer{numCorrupt: 2}
+	d := &Dialer{
+		NetDialer: netDialer,
+		Config: &Config{
+			Protocol:    protoXX,
+			LocalStatic: mustKeypair(t),
+		},
+	}
+
+	// Without a retry policy, the failure is returned.
+	_, err := d.Dial("tcp", l.Addr().String())
+	require.ErrorIs(err, nyquist.ErrOpen, "Dial - no retries")
+	require.True(IsTransientError(err), "IsTransientError")
+
+	// With a retry policy, the connection is retried.
+	d.RetryPolicy = &RetryPolicy{
+		MaxRetries:     3,
+		InitialBackoff: time.Millisecond,
+	}
+	conn, err := d.Dial("tcp", l.Addr().String())
+	require.NoError(err, "Dial - retries")
+	defer conn.Close()
+	require.Equal(3, netDialer.numDials, "Dial - number of attempts")
+	echo(t, conn, []byte("retried"))
+
+	// Non-transient failures are not retried.
+	netDialer.numDials = 0
+	d.Config.Protocol = mustProtocol(t, "Noise_NN_25519_ChaChaPoly_BLAKE2s")
+	_, err = d.Dial("tcp", l.Addr().String())
+	require.Equal(ErrRejected, err, "Dial - rejected")
+	require.Equal(1, netDialer.numDials, "Dial - rejected, number of attempts")
+
+	// The number of retries is bounded.
+	netDialer.numDials, netDialer.numCorrupt = 0, 10
+	d.Config.Protocol = protoXX
+	_, err = d.Dial("tcp", l.Addr().String())
+	require.ErrorIs(err, nyquist.ErrOpen, "Dial - retries exhausted")
+	require.Equal(4, netDialer.numDials, "Dial - retries exhausted, number of attempts")
+}
+
+func TestLRUClientSessionCache(t *testing.T) {
+	require := require.New(t)
+
+	cache := NewLRUClientSessionCache(2)
+	a, b, c := &ClientSessionState{}, &ClientSessionState{}, &ClientSessionState{}
+
+	cache.Put("a", a)
+	cache.Put("b", b)
+	_, ok := cache.Get("a") // "b" is now the least recently used.
+	require.True(ok, "Get(a)")
+	cache.Put("c", c)
+
+	_, ok = cache.Get("b")
+	require.False(ok, "Get(b) - evicted")
+	state, ok := cache.Get("a")
+	require.True(ok, "Get(a)")
+	require.True(state == a, "Get(a) - state")
+	state, ok = cache.Get("c")
+	require.True(ok, "Get(c)")
+	require.True(state == c, "Get(c) - state")
+
+	cache.Put("a", nil)
+	_, ok = cache.Get("a")
+	require.False(ok, "Get(a) - removed")
+}
+
+func TestNegotiationData(t *testing.T) {
+	require := require.New(t)
+
+	for _, ticket := range [][]byte{nil, bytes.Repeat([]byte{0x42}, ticketSize)} {
+		for _, appData := range [][]byte{nil, []byte("region=eu-west")} {
+			b, err := encodeNegData("Noise_XX_25519_ChaChaPoly_BLAKE2s", ticket, appData)
+			require.NoError(err, "encodeNegData")
+
+			name, decodedTicket, decodedAppData, err := decodeNegData(b)
+			require.NoError(err, "decodeNegData")
+			require.Equal("Noise_XX_25519_ChaChaPoly_BLAKE2s", name, "protocol name")
+			require.Equal(ticket, decodedTicket, "ticket")
+			require.Equal(appData, decodedAppData, "application data")
+
+			_, _, _, err = decodeNegData(b[:len(b)-1])
+			require.Equal(errMalformedNegData, err, "decodeNegData - truncated")
+			_, _, _, err = decodeNegData(append(b, 0x00))
+			require.Equal(errMalformedNegData, err, "decodeNegData - trailing")
+		}
+	}
+
+	_, err := encodeNegData("Noise_XX_25519_ChaChaPoly_BLAKE2s", nil, make([]byte, 0x10000))
+	require.Equal(errMalformedNegData, err, "encodeNegData - oversized application data")
+}
+
+func TestNegotiationDataCallbacks(t *testing.T) {
+	protoNN := mustProtocol(t, "Noise_NN_25519_ChaChaPoly_BLAKE2s")
+
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	handshake := func(clientCfg, serverCfg *Config, wrap func(net.Conn) net.Conn) (*Conn, *Conn, error, error) {
+		rawClient, rawServer := net.Pipe()
+		ch := make(chan result)
+		go func() {
+			conn, err := Server(rawServer, serverCfg)
+			if err != nil {
+				rawServer.Close()
+			}
+			ch <- result{conn, err}
+		}()
+		client, err := Client(wrap(rawClient), clientCfg)
+		if err != nil {
+			rawClient.Close()
+		}
+		res := <-ch
+		return client, res.conn, err, res.err
+	}
+	noWrap := func(c net.Conn) net.Conn { return c }
+
+	newConfigs := func(clientData, serverData []byte, clientSeen, serverSeen *[]byte) (*Config, *Config) {
+		mk := func(data []byte, seen *[]byte) *Config {
+			return &Config{
+				Protocol: protoNN,
+				NegotiationData: func() ([]byte, error) {
+					return data, nil
+				},
+				OnNegotiationData: func(data []byte) error {
+					*seen = data
+					return nil
+				},
+			}
+		}
+		return mk(clientData, clientSeen), mk(serverData, serverSeen)
+	}
+
+	t.Run("Exchange", func(t *testing.T) {
+		require := require.New(t)
+
+		var clientSeen, serverSeen []byte
+		clientCfg, serverCfg := newConfigs([]byte("route=eu"), []byte("version=2"), &clientSeen, &serverSeen)
+		client, server, clientErr, serverErr := handshake(clientCfg, serverCfg, noWrap)
+		require.NoError(clientErr, "Client")
+		require.NoError(serverErr, "Server")
+		require.Equal([]byte("route=eu"), serverSeen, "OnNegotiationData - server")
+		require.Equal([]byte("version=2"), clientSeen, "OnNegotiationData - client")
+		require.Equal(client.ConnectionState().HandshakeHash, server.ConnectionState().HandshakeHash, "HandshakeHash")
+		client.NetConn().Close()
+
+		// Absent application data is reported as nil.
+		clientCfg, serverCfg = newConfigs(nil, nil, &clientSeen, &serverSeen)
+		client, _, clientErr, serverErr = handshake(clientCfg, serverCfg, noWrap)
+		require.NoError(clientErr, "Client - no data")
+		require.NoError(serverErr, "Server - no data")
+		require.Nil(serverSeen, "OnNegotiationData - server, no data")
+		require.Nil(clientSeen, "OnNegotiationData - client, no data")
+		client.NetConn().Close()
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		require := require.New(t)
+
+		var clientSeen, serverSeen []byte
+		clientCfg, serverCfg := newConfigs([]byte("route=mars"), nil, &clientSeen, &serverSeen)
+		serverCfg.OnNegotiationData = func(data []byte) error {
+			return errors.New("unroutable")
+		}
+		_, _, clientErr, serverErr := handshake(clientCfg, serverCfg, noWrap)
+		require.Equal(ErrRejected, clientErr, "Client")
+		require.EqualError(serverErr, "unroutable", "Server")
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		require := require.New(t)
+
+		// Altering the server's negotiation data must break the handshake.
+		var clientSeen, serverSeen []byte
+		clientCfg, serverCfg := newConfigs(nil, []byte("version=2"), &clientSeen, &serverSeen)
+		_, _, clientErr, _ := handshake(clientCfg, serverCfg, func(c net.Conn) net.Conn {
+			// Corrupt the first byte of the application data, after the
+			// length and prefix.
+			return &corruptingConn{Conn: c, off: 40 - 3}
+		})
+		require.Error(clientErr, "Client")
+		require.Equal(append([]byte{'v' ^ 0xa5}, "ersion=2"...), clientSeen, "OnNegotiationData - tampered")
+	})
+}
+
+type splitConn struct {
+	net.Conn
+
+	splitDelay time.Duration
+}
+
+func (c *splitConn) Write(p []byte) (int, error) {
+	if c.splitDelay == 0 || len(p) < 4 {
+		return c.Conn.Write(p)
+	}
+
+	n, err := c.Conn.Write(p[:3])
+	if err != nil {
+		return n, err
+	}
+	time.Sleep(c.splitDelay)
+	n2, err := c.Conn.Write(p[3:])
+	return n + n2, err
+}
+
+func TestDeadlines(t *testing.T) {
+	require := require.New(t)
+
+	protoNN := mustProtocol(t, "Noise_NN_25519_ChaChaPoly_BLAKE2s")
+	cfg := &Config{
+		Protocol: protoNN,
+	}
+
+	rawClient, rawServer := net.Pipe()
+	split := &splitConn{Conn: rawServer}
+
+	serverCh := make(chan *Conn, 1)
+	go func() {
+		conn, err := Server(split, cfg)
+		if err != nil {
+			close(serverCh)
+			return
+		}
+		serverCh <- conn
+	}()
+	client, err := Client(rawClient, cfg)
+	require.NoError(err, "Client")
+	server, ok := <-serverCh
+	require.True(ok, "Server")
+	defer func() {
+		// net.Pipe is unbuffered, so close the side that is not expected
+		// to send a close record first.
+		client.Close()
+		server.Close()
+	}()
+
+	isTimeout := func(err error) bool {
+		netErr, ok := err.(net.Error)
+		return ok && netErr.Timeout()
+	}
+
+	// Timeout with no data.
+	require.NoError(client.SetReadDeadline(time.Now().Add(50*time.Millisecond)), "SetReadDeadline")
+	_, err = client.Read(make([]byte, 1))
+	require.True(isTimeout(err), "Read - timeout: %v", err)
+
+	// Timeout with a partially received record, that must be completed
+	// by a subsequent Read.
+	msg := []byte("split across a timeout")
+	split.splitDelay = 200 * time.Millisecond
+	go func() {
+		_, _ = server.Write(msg)
+	}()
+	require.NoError(client.SetReadDeadline(time.Now().Add(100*time.Millisecond)), "SetReadDeadline")
+	_, err = client.Read(make([]byte, 1))
+	require.True(isTimeout(err), "Read - partial record timeout: %v", err)
+
+	require.NoError(client.SetReadDeadline(time.Time{}), "SetReadDeadline - clear")
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(client, buf)
+	require.NoError(err, "ReadFull - after timeout")
+	require.Equal(msg, buf, "ReadFull - after timeout")
+
+	// Write timeouts are fatal.
+	require.NoError(client.SetWriteDeadline(time.Now().Add(50*time.Millisecond)), "SetWriteDeadline")
+	_, err = client.Write([]byte("nobody is reading"))
+	require.True(isTimeout(err), "Write - timeout: %v", err)
+	require.NoError(client.SetWriteDeadline(time.Time{}), "SetWriteDeadline - clear")
+	_, err = client.Write([]byte("still broken"))
+	require.True(isTimeout(err), "Write - after timeout: %v", err)
+}
+
+func TestAssociatedData(t *testing.T) {
+	require := require.New(t)
+
+	protoNN := mustProtocol(t, "Noise_NN_25519_ChaChaPoly_BLAKE2s")
+	cfg := &Config{
+		Protocol: protoNN,
+	}
+	server, client := newTestConnPair(t, cfg, cfg)
+	defer client.Close()
+	defer server.Close()
+
+	_, err := client.WriteWithAD(make([]byte, MaxADSize+1), []byte("oversized"))
+	require.Error(err, "WriteWithAD - oversized AD")
+
+	ad := []byte("routing header")
+	msg := make([]byte, 2*maxRecordPayload)
+	_, _ = rand.Read(msg)
+	go func() {
+		_, _ = client.WriteWithAD(ad, msg)
+		_, _ = client.Write([]byte("no ad"))
+	}()
+
+	_, err = server.Read(make([]byte, 1))
+	require.Equal(ErrADRequired, err, "Read - record with AD")
+
+	var got []byte
+	buf := make([]byte, 4096)
+	for len(got) < len(msg) {
+		n, recordAD, err := server.ReadWithAD(buf)
+		require.NoError(err, "ReadWithAD")
+		require.Equal(ad, recordAD, "ReadWithAD - ad")
+		got = append(got, buf[:n]...)
+	}
+	require.Equal(msg, got, "ReadWithAD - data")
+
+	n, recordAD, err := server.ReadWithAD(buf)
+	require.NoError(err, "ReadWithAD - no AD")
+	require.Nil(recordAD, "ReadWithAD - no AD")
+	require.Equal([]byte("no ad"), buf[:n], "ReadWithAD - no AD")
+}
+
+func TestReadRecord(t *testing.T) {
+	require := require.New(t)
+
+	protoNN := mustProtocol(t, "Noise_NN_25519_ChaChaPoly_BLAKE2s")
+	cfg := &Config{
+		Protocol: protoNN,
+	}
+	server, client := newTestConnPair(t, cfg, cfg)
+	defer client.Close()
+	defer server.Close()
+
+	msg := make([]byte, maxRecordPayload+100)
+	_, _ = rand.Read(msg)
+	ad := []byte("header")
+	go func() {
+		_, _ = client.Write(msg)
+		_, _ = client.WriteWithAD(ad, []byte("with ad"))
+	}()
+
+	b, recordAD, err := server.ReadRecord()
+	require.NoError(err, "ReadRecord")
+	require.Nil(recordAD, "ReadRecord - ad")
+	require.Equal(msg[:maxRecordPayload], b, "ReadRecord - first record")
+
+	// A partially read record returns the remainder.
+	tmp := make([]byte, 10)
+	_, err = io.ReadFull(server, tmp)
+	require.NoError(err, "Read")
+	require.Equal(msg[maxRecordPayload:maxRecordPayload+10], tmp, "Read - partial")
+	b, _, err = server.ReadRecord()
+	require.NoError(err, "ReadRecord - remainder")
+	require.Equal(msg[maxRecordPayload+10:], b, "ReadRecord - remainder")
+
+	b, recordAD, err = server.ReadRecord()
+	require.NoError(err, "ReadRecord - with ad")
+	require.Equal([]byte("with ad"), b, "ReadRecord - with ad")
+	require.Equal(ad, recordAD, "ReadRecord - ad")
+}
+
+func TestMaxRecordSize(t *testing.T) {
+	require := require.New(t)
+
+	protoNN := mustProtocol(t, "Noise_NN_25519_ChaChaPoly_BLAKE2s")
+	const maxRecordSize = 100
+
+	server, client := newTestConnPair(t, &Config{
+		Protocol: protoNN,
+	}, &Config{
+		Protocol:      protoNN,
+		MaxRecordSize: maxRecordSize,
+	})
+	defer client.Close()
+	defer server.Close()
+
+	msg := make([]byte, 10*maxRecordSize+1)
+	_, _ = rand.Read(msg)
+	go func() {
+		_, _ = client.Write(msg)
+	}()
+
+	var (
+		got        []byte
+		numRecords int
+	)
+	buf := make([]byte, len(msg))
+	for len(got) < len(msg) {
+		// ReadWithAD never returns data from more than one record.
+		n, _, err := server.ReadWithAD(buf)
+		require.NoError(err, "ReadWithAD")
+		require.LessOrEqual(n, maxRecordSize, "record size")
+		got = append(got, buf[:n]...)
+		numRecords++
+	}
+	require.Equal(msg, got, "data")
+	require.Equal(11, numRecords, "number of records")
+}
+
+func TestCipherOverhead(t *testing.T) {
+	require := require.New(t)
+
+	truncated, err := cipher.UnsafeTruncated(cipher.ChaChaPoly, 8)
+	require.NoError(err, "UnsafeTruncated")
+	protocol := mustProtocol(t, "Noise_NN_25519_ChaChaPoly_BLAKE2s")
+	protocol.Cipher = truncated
+	cfg := &Config{
+		Protocol: protocol,
+	}
+	server, client := newTestConnPair(t, cfg, cfg)
+	defer client.Close()
+	defer server.Close()
+
+	// Records are sized based on the negotiated cipher's overhead.
+	require.Equal(maxRecordPayload+8, client.maxRecordPayload(0), "maxRecordPayload")
+
+	msg := make([]byte, 2*maxRecordPayload)
+	_, _ = rand.Read(msg)
+	go func() {
+		_, _ = client.Write(msg)
+	}()
+
+	b, _, err := server.ReadRecord()
+	require.NoError(err, "ReadRecord")
+	require.Equal(msg[:maxRecordPayload+8], b, "ReadRecord - first record")
+	got := append([]byte{}, b...)
+	for len(got) < len(msg) {
+		b, _, err = server.ReadRecord()
+		require.NoError(err, "ReadRecord")
+		got = append(got, b...)
+	}
+	require.Equal(msg, got, "ReadRecord - data")
+}
+
+func TestCopy(t *testing.T) {
+	require := require.New(t)
+
+	protoNN := mustProtocol(t, "Noise_NN_25519_ChaChaPoly_BLAKE2s")
+	server, client := newTestConnPair(t, &Config{
+		Protocol: protoNN,
+	}, &Config{
+		Protocol: protoNN,
+	})
+	defer server.Close()
+
+	msg := make([]byte, 3*maxRecordPayload+17)
+	_, _ = rand.Read(msg)
+
+	// io.Copy uses ReadFrom when copying to the connection, and WriteTo
+	// when copying from it.
+	writeErrCh := make(chan error, 1)
+	go func() {
+		// Hide bytes.Reader's WriteTo, so that ReadFrom is used.
+		n, err := io.Copy(client, struct{ io.Reader }{bytes.NewReader(msg)})
+		if err == nil && n != int64(len(msg)) {
+			err = io.ErrShortWrite
+		}
+		if err == nil {
+			err = client.Close()
+		}
+		writeErrCh <- err
+	}()
+
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, server)
+	require.NoError(err, "io.Copy - from conn")
+	require.EqualValues(len(msg), n, "io.Copy - from conn")
+	require.Equal(msg, buf.Bytes(), "data")
+	require.NoError(<-writeErrCh, "io.Copy - to conn")
+}
+
+// blockingReadWriter signals entry to Read or Write, and blocks until
+// released.
+type blockingReadWriter struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (rw *blockingReadWriter) Read(p []byte) (int, error) {
+	close(rw.entered)
+	<-rw.release
+	return copy(p, "x"), nil
+}
+
+func (rw *blockingReadWriter) Write(p []byte) (int, error) {
+	close(rw.entered)
+	<-rw.release
+	return len(p), nil
+}
+
+func newBlockingReadWriter() *blockingReadWriter {
+	return &blockingReadWriter{
+		entered: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+}
+
+func TestCopyClose(t *testing.T) {
+	protoNN := mustProtocol(t, "Noise_NN_25519_ChaChaPoly_BLAKE2s")
+
+	closeWithTimeout := func(t *testing.T, conn *Conn) {
+		closeCh := make(chan error, 1)
+		go func() {
+			closeCh <- conn.Close()
+		}()
+		select {
+		case <-closeCh:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Close blocked by io.Copy")
+		}
+	}
+
+	t.Run("ReadFrom", func(t *testing.T) {
+		require := require.New(t)
+
+		server, client := newTestConnPair(t, &Config{
+			Protocol: protoNN,
+		}, &Config{
+			Protocol: protoNN,
+		})
+		defer server.Close()
+
+		src := newBlockingReadWriter()
+		copyErrCh := make(chan error, 1)
+		go func() {
+			_, err := io.Copy(client, struct{ io.Reader }{src})
+			copyErrCh <- err
+		}()
+
+		<-src.entered
+		closeWithTimeout(t, client)
+		close(src.release)
+		require.Error(<-copyErrCh, "io.Copy - to closed conn")
+	})
+
+	t.Run("WriteTo", func(t *testing.T) {
+		require := require.New(t)
+
+		server, client := newTestConnPair(t, &Config{
+			Protocol: protoNN,
+		}, &Config{
+			Protocol: protoNN,
+		})
+		defer server.Close()
+
+		dst := newBlockingReadWriter()
+		copyErrCh := make(chan error, 1)
+		go func() {
+			_, err := io.Copy(struct{ io.Writer }{dst}, client)
+			copyErrCh <- err
+		}()
+
+		_, err := server.Write([]byte("hello"))
+		require.NoError(err, "server.Write")
+
+		<-dst.entered
+		closeWithTimeout(t, client)
+		close(dst.release)
+		require.Error(<-copyErrCh, "io.Copy - from closed conn")
+	})
+}
+
+func TestSuites(t *testing.T) {
+	oldStatic, newStatic, xxStatic, gcmStatic := mustKeypair(t), mustKeypair(t), mustKeypair(t), mustKeypair(t)
+
+	protoXX := mustProtocol(t, "Noise_XX_25519_ChaChaPoly_BLAKE2s")
+	protoXXGCM := mustProtocol(t, "Noise_XX_25519_AESGCM_SHA256")
+	protoNK := mustProtocol(t, "Noise_NK_25519_ChaChaPoly_BLAKE2s")
+
+	l := startEchoServer(t, &Config{
+		Protocol:    protoNK,
+		LocalStatic: oldStatic,
+		Suites: []*Config{
+			{
+				Protocol:    protoNK,
+				LocalStatic: newStatic,
+			},
+			{
+				Protocol:    protoXXGCM,
+				LocalStatic: gcmStatic,
+			},
+			{
+				Protocol:    protoXX,
+				LocalStatic: xxStatic,
+				Prologue:    []byte("suite prologue"),
+			},
+		},
+	})
+	defer l.Close()
+
+	for _, v := range []struct {
+		name         string
+		cfg          *Config
+		remoteStatic dh.PublicKey
+	}{
+		{"NK/Old", &Config{Protocol: protoNK, RemoteStatic: oldStatic.Public()}, oldStatic.Public()},
+		{"NK/New", &Config{Protocol: protoNK, RemoteStatic: newStatic.Public()}, newStatic.Public()},
+		{"XX/AESGCM", &Config{Protocol: protoXXGCM, LocalStatic: mustKeypair(t)}, gcmStatic.Public()},
+		{"XX/Prologue", &Config{Protocol: protoXX, LocalStatic: mustKeypair(t), Prologue: []byte("suite prologue")}, xxStatic.Public()},
+	} {
+		t.Run(v.name, func(t *testing.T) {
+			require := require.New(t)
+
+			conn, err := Dial("tcp", l.Addr().String(), v.cfg)
+			require.NoError(err, "Dial")
+			defer conn.Close()
+
+			require.Equal(v.remoteStatic.Bytes(), conn.RemoteStatic().Bytes(), "RemoteStatic")
+			echo(t, conn, []byte("multi-suite"))
+		})
+	}
+
+	t.Run("SharedTicketStore", func(t *testing.T) {
+		require := require.New(t)
+
+		// Key migration, with both suites sharing a ticket store.  The
+		// old suite is tried first, and must not consume tickets issued
+		// by the new suite.
+		protoIK := mustProtocol(t, "Noise_IK_25519_ChaChaPoly_BLAKE2s")
+		protoIKpsk2 := mustProtocol(t, "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s")
+		accept := []*nyquist.Protocol{protoIK, protoIKpsk2}
+		tickets := NewTicketCache(0, 0)
+
+		l := startEchoServer(t, &Config{
+			Protocol:        protoIK,
+			AcceptProtocols: accept,
+			LocalStatic:     oldStatic,
+			TicketStore:     tickets,
+			Suites: []*Config{
+				{
+					Protocol:        protoIK,
+					AcceptProtocols: accept,
+					LocalStatic:     newStatic,
+					TicketStore:     tickets,
+				},
+			},
+		})
+		defer l.Close()
+
+		d := &Dialer{
+			Config: &Config{
+				Protocol:     protoIK,
+				LocalStatic:  mustKeypair(t),
+				RemoteStatic: newStatic.Public(),
+			},
+			ResumePSKProtocol: protoIKpsk2,
+			SessionCache:      NewLRUClientSessionCache(0),
+		}
+		for _, expectedResume := range []bool{false, true, true} {
+			conn, err := d.Dial("tcp", l.Addr().String())
+			require.NoError(err, "Dial")
+			require.Equal(expectedResume, conn.DidResume(), "DidResume")
+			require.Equal(newStatic.Public().Bytes(), conn.RemoteStatic().Bytes(), "RemoteStatic")
+
+			// Process the ticket.
+			echo(t, conn, []byte("shared ticket store"))
+			conn.Close()
+		}
+	})
+
+	t.Run("Rejected", func(t *testing.T) {
+		_, err := Dial("tcp", l.Addr().String(), &Config{
+			Protocol:     protoNK,
+			RemoteStatic: mustKeypair(t).Public(),
+		})
+		require.Equal(t, ErrRejected, err, "Dial - unknown static key")
+
+		_, err = Dial("tcp", l.Addr().String(), &Config{
+			Protocol: mustProtocol(t, "Noise_NN_25519_ChaChaPoly_BLAKE2s"),
+		})
+		require.Equal(t, ErrRejected, err, "Dial - unsupported protocol")
+	})
+}
@@ -0,0 +1,112 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+)
+
+var upgradePrologue = []byte("nyquist/transport: upgrade")
+
+type upgradeConn struct {
+	net.Conn
+
+	r io.Reader
+}
+
+func (c *upgradeConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func newUpgrade(conn net.Conn, br *bufio.Reader, transcript []byte, cfg *Config) (net.Conn, *Config, error) {
+	// Drain anything the application has read ahead, as it is the start
+	// of the handshake.
+	if br != nil && br.Buffered() > 0 {
+		buffered, err := br.Peek(br.Buffered())
+		if err != nil {
+			return nil, nil, err
+		}
+		conn = &upgradeConn{
+			Conn: conn,
+			r:    io.MultiReader(bytes.NewReader(append([]byte{}, buffered...)), conn),
+		}
+		if _, err = br.Discard(len(buffered)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Bind the cleartext exchange into the handshake, so that tampering
+	// with it is detected.
+	prologue := make([]byte, 0, len(upgradePrologue)+4+len(transcript)+len(cfg.Prologue))
+	prologue = append(prologue, upgradePrologue...)
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], uint32(len(transcript)))
+	prologue = append(prologue, l[:]...)
+	prologue = append(prologue, transcript...)
+	prologue = append(prologue, cfg.Prologue...)
+
+	upgradeCfg := *cfg
+	upgradeCfg.Prologue = prologue
+
+	return conn, &upgradeCfg, nil
+}
+
+// UpgradeClient upgrades an established cleartext connection to a client
+// side transport connection, STARTTLS style, after completing the
+// handshake.
+//
+// If the application reads from conn via br, any data buffered by br is
+// treated as the start of the handshake.  The transcript is the cleartext
+// exchanged prior to the upgrade (eg: the "start secure" exchange), which
+// is bound into the handshake via the prologue, and must be identical on
+// both sides.
+func UpgradeClient(ctx context.Context, conn net.Conn, br *bufio.Reader, transcript []byte, cfg *Config) (*Conn, error) {
+	conn, cfg, err := newUpgrade(conn, br, transcript, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return ClientContext(ctx, conn, cfg)
+}
+
+// UpgradeServer upgrades an established cleartext connection to a server
+// side transport connection, STARTTLS style, after completing the
+// handshake.  See UpgradeClient for details.
+func UpgradeServer(ctx context.Context, conn net.Conn, br *bufio.Reader, transcript []byte, cfg *Config) (*Conn, error) {
+	conn, cfg, err := newUpgrade(conn, br, transcript, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return ServerContext(ctx, conn, cfg)
+}
@@ -0,0 +1,134 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpgrade(t *testing.T) {
+	protoNN := mustProtocol(t, "Noise_NN_25519_ChaChaPoly_BLAKE2s")
+	cfg := &Config{
+		Protocol: protoNN,
+	}
+
+	const startLine = "STARTNOISE\n"
+
+	runUpgrade := func(t *testing.T, serverTranscript string) (*Conn, error) {
+		require := require.New(t)
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(err, "net.Listen")
+		defer l.Close()
+
+		type result struct {
+			conn *Conn
+			err  error
+		}
+		serverCh := make(chan result, 1)
+		go func() {
+			rawConn, err := l.Accept()
+			if err != nil {
+				serverCh <- result{nil, err}
+				return
+			}
+
+			// Give the client time to pipeline the start of the
+			// handshake, so that it is read ahead by br.
+			time.Sleep(100 * time.Millisecond)
+
+			br := bufio.NewReader(rawConn)
+			line, err := br.ReadString('\n')
+			if err != nil || line != startLine {
+				rawConn.Close()
+				serverCh <- result{nil, err}
+				return
+			}
+
+			conn, err := UpgradeServer(context.Background(), rawConn, br, []byte(serverTranscript), cfg)
+			if err != nil {
+				rawConn.Close()
+			}
+			serverCh <- result{conn, err}
+		}()
+
+		rawConn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(err, "net.Dial")
+		defer func() {
+			if t.Failed() {
+				rawConn.Close()
+			}
+		}()
+
+		_, err = io.WriteString(rawConn, startLine)
+		require.NoError(err, "WriteString")
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		client, clientErr := UpgradeClient(ctx, rawConn, nil, []byte(startLine), cfg)
+		res := <-serverCh
+		if clientErr != nil {
+			rawConn.Close()
+			if res.conn != nil {
+				res.conn.Close()
+			}
+			return nil, clientErr
+		}
+		require.NoError(res.err, "UpgradeServer")
+
+		go func() {
+			defer res.conn.Close()
+			_, _ = io.Copy(res.conn, res.conn)
+		}()
+
+		return client, nil
+	}
+
+	t.Run("Ok", func(t *testing.T) {
+		client, err := runUpgrade(t, startLine)
+		require.NoError(t, err, "UpgradeClient")
+		defer client.Close()
+
+		echo(t, client, []byte("upgraded"))
+	})
+
+	t.Run("TranscriptMismatch", func(t *testing.T) {
+		_, err := runUpgrade(t, "STARTPLAINTEXT\n")
+		require.Error(t, err, "UpgradeClient - transcript mismatch")
+	})
+}
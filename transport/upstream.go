@@ -0,0 +1,279 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const (
+	socksVersion = 0x05
+
+	socksAuthNone         = 0x00
+	socksAuthUserPass     = 0x02
+	socksAuthNoAcceptable = 0xff
+
+	socksCmdConnect = 0x01
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	maxConnectResponseSize = 4096
+)
+
+var (
+	errProxyScheme    = errors.New("nyquist/transport: unsupported upstream proxy scheme")
+	errProxyNetwork   = errors.New("nyquist/transport: upstream proxies only support tcp")
+	errProxyAuth      = errors.New("nyquist/transport: upstream proxy authentication failed")
+	errProxyRejected  = errors.New("nyquist/transport: upstream proxy rejected the connection")
+	errProxyMalformed = errors.New("nyquist/transport: malformed upstream proxy response")
+)
+
+// dialUpstream connects to the address on the named network via the
+// upstream proxy, with the proxy handshake bounded by the context.
+// Host names are always resolved by the proxy, to avoid leaking DNS
+// queries when the proxy is Tor.
+func dialUpstream(ctx context.Context, netDialer NetDialer, proxy *url.URL, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, errProxyNetwork
+	}
+
+	var (
+		handshakeFn func(net.Conn, string) error
+		defaultPort string
+	)
+	switch proxy.Scheme {
+	case "socks5", "socks5h":
+		handshakeFn = func(conn net.Conn, address string) error {
+			return socks5Handshake(conn, proxy.User, address)
+		}
+		defaultPort = "1080"
+	case "http":
+		handshakeFn = func(conn net.Conn, address string) error {
+			return httpConnectHandshake(conn, proxy.User, address)
+		}
+		defaultPort = "80"
+	default:
+		return nil, errProxyScheme
+	}
+
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), defaultPort)
+	}
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if ctxDialer, ok := netDialer.(ContextNetDialer); ok {
+		conn, err = ctxDialer.DialContext(ctx, "tcp", proxyAddr)
+	} else {
+		conn, err = netDialer.Dial("tcp", proxyAddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = handshakeContext(ctx, conn, func() error {
+		return handshakeFn(conn, address)
+	}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func socks5Handshake(conn net.Conn, user *url.Userinfo, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
+	}
+
+	// Method negotiation (RFC 1928).
+	method := byte(socksAuthNone)
+	if user != nil {
+		method = socksAuthUserPass
+	}
+	if _, err = conn.Write([]byte{socksVersion, 1, method}); err != nil {
+		return err
+	}
+	var resp [4]byte
+	if _, err = io.ReadFull(conn, resp[:2]); err != nil {
+		return err
+	}
+	switch {
+	case resp[0] != socksVersion:
+		return errProxyMalformed
+	case resp[1] == socksAuthNoAcceptable:
+		return errProxyAuth
+	case resp[1] != method:
+		return errProxyMalformed
+	}
+
+	// Username/password authentication (RFC 1929).  Tor uses the
+	// credentials for stream isolation.
+	if method == socksAuthUserPass {
+		username := user.Username()
+		password, _ := user.Password()
+		if len(username) == 0 || len(username) > 255 || len(password) > 255 {
+			return errProxyAuth
+		}
+		req := []byte{0x01, byte(len(username))}
+		req = append(req, username...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		if _, err = conn.Write(req); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(conn, resp[:2]); err != nil {
+			return err
+		}
+		if resp[0] != 0x01 {
+			return errProxyMalformed
+		}
+		if resp[1] != 0x00 {
+			return errProxyAuth
+		}
+	}
+
+	req := []byte{socksVersion, socksCmdConnect, 0x00}
+	switch ip := net.ParseIP(host); {
+	case ip == nil:
+		if len(host) == 0 || len(host) > 255 {
+			return errProxyMalformed
+		}
+		req = append(req, socksAtypDomain, byte(len(host)))
+		req = append(req, host...)
+	case ip.To4() != nil:
+		req = append(req, socksAtypIPv4)
+		req = append(req, ip.To4()...)
+	default:
+		req = append(req, socksAtypIPv6)
+		req = append(req, ip.To16()...)
+	}
+	var portBuf [2]byte
+	binary.BigEndian.PutUint16(portBuf[:], uint16(port))
+	req = append(req, portBuf[:]...)
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+
+	if _, err = io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[0] != socksVersion {
+		return errProxyMalformed
+	}
+	if resp[1] != 0x00 {
+		return errProxyRejected
+	}
+
+	// Discard the bound address.
+	var addrLen int
+	switch resp[3] {
+	case socksAtypIPv4:
+		addrLen = net.IPv4len
+	case socksAtypIPv6:
+		addrLen = net.IPv6len
+	case socksAtypDomain:
+		if _, err = io.ReadFull(conn, resp[:1]); err != nil {
+			return err
+		}
+		addrLen = int(resp[0])
+	default:
+		return errProxyMalformed
+	}
+	_, err = io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
+
+func httpConnectHandshake(conn net.Conn, user *url.Userinfo, address string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+
+	// Read the response a byte at a time, so that nothing past the end
+	// of the header is consumed.
+	var buf []byte
+	for !bytes.HasSuffix(buf, []byte("\r\n\r\n")) {
+		if len(buf) == maxConnectResponseSize {
+			return errProxyMalformed
+		}
+		var b [1]byte
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return err
+		}
+		buf = append(buf, b[0])
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf)), req)
+	if err != nil {
+		return errProxyMalformed
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusProxyAuthRequired:
+		return errProxyAuth
+	default:
+		return errProxyRejected
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package transport
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// startTestProxy starts a proxy server, that uses handshakeFn to read the
+// target address from each connection, and then relays traffic to it.
+// Each target address is sent on the returned channel.
+func startTestProxy(t *testing.T, handshakeFn func(*bufio.ReadWriter) (string, bool)) (net.Listener, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "net.Listen")
+
+	targetCh := make(chan string, 16)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+
+				rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+				target, ok := handshakeFn(rw)
+				_ = rw.Flush()
+				if !ok {
+					return
+				}
+				targetCh <- target
+
+				targetConn, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer targetConn.Close()
+				go func() {
+					_, _ = io.Copy(targetConn, rw)
+				}()
+				_, _ = io.Copy(conn, targetConn)
+			}()
+		}
+	}()
+
+	return l, targetCh
+}
+
+func socks5TestHandshake(rw *bufio.ReadWriter) (string, bool) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(rw, hdr[:2]); err != nil {
+		return "", false
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return "", false
+	}
+	if methods[0] == socksAuthUserPass {
+		_, _ = rw.Write([]byte{socksVersion, socksAuthUserPass})
+		_ = rw.Flush()
+
+		var l [1]byte
+		_, _ = io.ReadFull(rw, hdr[:2])
+		username := make([]byte, hdr[1])
+		_, _ = io.ReadFull(rw, username)
+		_, _ = io.ReadFull(rw, l[:])
+		password := make([]byte, l[0])
+		_, _ = io.ReadFull(rw, password)
+		if string(username) != "user" || string(password) != "isolation-token" {
+			_, _ = rw.Write([]byte{0x01, 0x01})
+			return "", false
+		}
+		_, _ = rw.Write([]byte{0x01, 0x00})
+	} else {
+		_, _ = rw.Write([]byte{socksVersion, socksAuthNone})
+	}
+	_ = rw.Flush()
+
+	if _, err := io.ReadFull(rw, hdr[:]); err != nil {
+		return "", false
+	}
+	var host string
+	switch hdr[3] {
+	case socksAtypIPv4:
+		ip := make([]byte, net.IPv4len)
+		_, _ = io.ReadFull(rw, ip)
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		var l [1]byte
+		_, _ = io.ReadFull(rw, l[:])
+		name := make([]byte, l[0])
+		_, _ = io.ReadFull(rw, name)
+		host = string(name)
+	default:
+		return "", false
+	}
+	var port [2]byte
+	_, _ = io.ReadFull(rw, port[:])
+
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+	if host == "rejected.invalid" {
+		_, _ = rw.Write([]byte{socksVersion, 0x05, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+		return "", false
+	}
+	_, _ = rw.Write([]byte{socksVersion, 0x00, 0x00, socksAtypIPv4, 127, 0, 0, 1, 0x04, 0x38})
+	return target, true
+}
+
+func httpConnectTestHandshake(rw *bufio.ReadWriter) (string, bool) {
+	req, err := http.ReadRequest(rw.Reader)
+	if err != nil || req.Method != http.MethodConnect {
+		return "", false
+	}
+	if auth := req.Header.Get("Proxy-Authorization"); auth != "" {
+		// BasicAuth only examines the Authorization header.
+		r := &http.Request{Header: http.Header{"Authorization": []string{auth}}}
+		if username, password, ok := r.BasicAuth(); !ok || username != "user" || password != "hunter2" {
+			_, _ = rw.WriteString("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return "", false
+		}
+	}
+	_, _ = rw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+	return req.Host, true
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	serverStatic, clientStatic := mustKeypair(t), mustKeypair(t)
+	protoXX := mustProtocol(t, "Noise_XX_25519_ChaChaPoly_BLAKE2s")
+
+	l := startEchoServer(t, &Config{
+		Protocol:    protoXX,
+		LocalStatic: serverStatic,
+	})
+	defer l.Close()
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	require.NoError(t, err, "SplitHostPort")
+
+	socksProxy, socksTargetCh := startTestProxy(t, socks5TestHandshake)
+	defer socksProxy.Close()
+	httpProxy, httpTargetCh := startTestProxy(t, httpConnectTestHandshake)
+	defer httpProxy.Close()
+
+	for _, v := range []struct {
+		name     string
+		proxy    string
+		targetCh <-chan string
+	}{
+		{"SOCKS5", "socks5://" + socksProxy.Addr().String(), socksTargetCh},
+		{"SOCKS5/Auth", "socks5h://user:isolation-token@" + socksProxy.Addr().String(), socksTargetCh},
+		{"HTTP", "http://" + httpProxy.Addr().String(), httpTargetCh},
+		{"HTTP/Auth", "http://user:hunter2@" + httpProxy.Addr().String(), httpTargetCh},
+	} {
+		t.Run(v.name, func(t *testing.T) {
+			require := require.New(t)
+
+			proxyURL, err := url.Parse(v.proxy)
+			require.NoError(err, "url.Parse")
+
+			d := &Dialer{
+				Proxy: proxyURL,
+				Config: &Config{
+					Protocol:    protoXX,
+					LocalStatic: clientStatic,
+				},
+			}
+
+			// The host name must be passed to the proxy unresolved.
+			address := net.JoinHostPort("localhost", port)
+			conn, err := d.Dial("tcp", address)
+			require.NoError(err, "Dial")
+			defer conn.Close()
+			require.Equal(address, <-v.targetCh, "proxy target")
+
+			echo(t, conn, []byte("via upstream proxy"))
+		})
+	}
+
+	for _, v := range []struct {
+		name    string
+		proxy   string
+		address string
+		err     error
+	}{
+		{"SOCKS5/Rejected", "socks5://" + socksProxy.Addr().String(), "rejected.invalid:443", errProxyRejected},
+		{"SOCKS5/BadAuth", "socks5://user:wrong@" + socksProxy.Addr().String(), "localhost:443", errProxyAuth},
+		{"HTTP/BadAuth", "http://user:wrong@" + httpProxy.Addr().String(), "localhost:443", errProxyAuth},
+		{"BadScheme", "ftp://" + httpProxy.Addr().String(), "localhost:443", errProxyScheme},
+	} {
+		t.Run(v.name, func(t *testing.T) {
+			proxyURL, err := url.Parse(v.proxy)
+			require.NoError(t, err, "url.Parse")
+
+			d := &Dialer{
+				Proxy: proxyURL,
+				Config: &Config{
+					Protocol:    protoXX,
+					LocalStatic: clientStatic,
+				},
+			}
+			_, err = d.Dial("tcp", v.address)
+			require.Equal(t, v.err, err, "Dial")
+		})
+	}
+
+	t.Run("UDP", func(t *testing.T) {
+		proxyURL, _ := url.Parse("socks5://" + socksProxy.Addr().String())
+		_, err := (&Dialer{Proxy: proxyURL, Config: &Config{Protocol: protoXX}}).Dial("udp", "localhost:443")
+		require.Equal(t, errProxyNetwork, err, "Dial")
+	})
+}
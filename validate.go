@@ -0,0 +1,207 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package nyquist
+
+import (
+	"crypto/rand"
+	"strconv"
+	"strings"
+
+	"gitlab.com/yawning/nyquist.git/pattern"
+)
+
+// ValidationError is the error returned by HandshakeConfig.Validate,
+// listing every problem found with the configuration.  It matches
+// ErrInvalidConfig via `errors.Is`.
+type ValidationError struct {
+	Problems []string
+}
+
+// Error returns the string representation of the error.
+func (e *ValidationError) Error() string {
+	return "nyquist: invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// Is returns true iff target is ErrInvalidConfig.
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalidConfig
+}
+
+// Validate checks the configuration against the protocol's handshake
+// pattern, and returns a ValidationError listing every problem found, or
+// nil if the configuration is usable.
+//
+// Note: NewHandshake does not call Validate, so that problems that only
+// affect later handshake messages are reported when those messages are
+// processed.
+func (cfg *HandshakeConfig) Validate() error {
+	var problems []string
+	addProblem := func(problem string) {
+		problems = append(problems, problem)
+	}
+	done := func() error {
+		if len(problems) == 0 {
+			return nil
+		}
+		return &ValidationError{Problems: problems}
+	}
+
+	protocol := cfg.Protocol
+	if protocol == nil {
+		addProblem("no protocol")
+		return done()
+	}
+	if protocol.Pattern == nil || protocol.DH == nil || protocol.Cipher == nil || protocol.Hash == nil {
+		addProblem("incomplete protocol")
+		return done()
+	}
+	pa := protocol.Pattern
+	if err := pattern.IsValid(pa); err != nil {
+		addProblem("invalid pattern: " + err.Error())
+		return done()
+	}
+
+	// Figure out what the local side needs, and the size of the largest
+	// handshake message (with an empty payload).
+	var (
+		needs struct {
+			localS, localEPreset, remoteSPreset, remoteEPreset, localGenE bool
+		}
+		hasKey    bool
+		maxMsgLen int
+	)
+	localSide, isPSK := 0, pa.NumPSKs() > 0
+	if !cfg.IsInitiator {
+		localSide = 1
+	}
+	for idx, msg := range pa.PreMessages() {
+		for _, v := range msg {
+			switch {
+			case v == pattern.Token_s && idx == localSide:
+				needs.localS = true
+			case v == pattern.Token_s:
+				needs.remoteSPreset = true
+			case v == pattern.Token_e && idx == localSide:
+				needs.localEPreset = true
+			case v == pattern.Token_e:
+				needs.remoteEPreset = true
+			}
+			if v == pattern.Token_e && isPSK {
+				hasKey = true
+			}
+		}
+	}
+	overhead := protocol.Cipher.Overhead()
+	dhLen := protocol.DH.Size()
+	for idx, msg := range pa.Messages() {
+		isLocal := idx&1 == localSide
+		var msgLen int
+		for _, v := range msg {
+			switch v {
+			case pattern.Token_e:
+				msgLen += dhLen
+				if isLocal && !needs.localEPreset {
+					needs.localGenE = true
+				}
+				hasKey = hasKey || isPSK
+			case pattern.Token_s:
+				msgLen += dhLen
+				if hasKey {
+					msgLen += overhead
+				}
+				needs.localS = needs.localS || isLocal
+			case pattern.Token_se:
+				needs.localS = needs.localS || cfg.IsInitiator
+				hasKey = true
+			case pattern.Token_es:
+				needs.localS = needs.localS || !cfg.IsInitiator
+				hasKey = true
+			case pattern.Token_ss:
+				needs.localS = true
+				hasKey = true
+			default:
+				hasKey = true
+			}
+		}
+		if hasKey {
+			msgLen += overhead
+		}
+		if msgLen > maxMsgLen {
+			maxMsgLen = msgLen
+		}
+	}
+
+	if needs.localS && cfg.LocalStatic == nil {
+		addProblem("the pattern requires the local static keypair (LocalStatic)")
+	}
+	if cfg.LocalStatic != nil && len(cfg.LocalStatic.Public().Bytes()) != dhLen {
+		addProblem("LocalStatic is not a " + protocol.DH.String() + " keypair")
+	}
+	if needs.localEPreset && cfg.LocalEphemeral == nil {
+		addProblem("the pattern's pre-messages require the local ephemeral keypair (LocalEphemeral)")
+	}
+	if cfg.LocalEphemeral != nil && len(cfg.LocalEphemeral.Public().Bytes()) != dhLen {
+		addProblem("LocalEphemeral is not a " + protocol.DH.String() + " keypair")
+	}
+	if needs.remoteSPreset && cfg.RemoteStatic == nil {
+		addProblem("the pattern's pre-messages require the remote static public key (RemoteStatic)")
+	}
+	if cfg.RemoteStatic != nil && len(cfg.RemoteStatic.Bytes()) != dhLen {
+		addProblem("RemoteStatic is not a " + protocol.DH.String() + " public key")
+	}
+	if needs.remoteSPreset && cfg.RemoteStatic != nil && !cfg.isExpectedRemoteStatic(cfg.RemoteStatic) {
+		addProblem("RemoteStatic is not one of ExpectedRemoteStatics")
+	}
+	if needs.remoteEPreset && cfg.RemoteEphemeral == nil {
+		addProblem("the pattern's pre-messages require the remote ephemeral public key (RemoteEphemeral)")
+	}
+	if cfg.RemoteEphemeral != nil && len(cfg.RemoteEphemeral.Bytes()) != dhLen {
+		addProblem("RemoteEphemeral is not a " + protocol.DH.String() + " public key")
+	}
+
+	if n := pa.NumPSKs(); n != len(cfg.PreSharedKeys) && (len(cfg.PreSharedKeys) != 0 || cfg.PreSharedKeyFunc == nil) {
+		addProblem("the pattern requires " + strconv.Itoa(n) + " pre-shared key(s), " + strconv.Itoa(len(cfg.PreSharedKeys)) + " provided")
+	}
+	for i, psk := range cfg.PreSharedKeys {
+		if len(psk) != PreSharedKeySize {
+			addProblem("pre-shared key " + strconv.Itoa(i) + " is " + strconv.Itoa(len(psk)) + " bytes, expected " + strconv.Itoa(PreSharedKeySize))
+		}
+	}
+
+	if needs.localGenE && cfg.LocalEphemeral == nil && cfg.Rng == nil && rand.Reader == nil {
+		addProblem("the pattern requires generating an ephemeral keypair, and no entropy source is available")
+	}
+
+	if mms := cfg.getMaxMessageSize(); mms > 0 && maxMsgLen > mms {
+		addProblem("MaxMessageSize " + strconv.Itoa(mms) + " is smaller than the largest handshake message (" + strconv.Itoa(maxMsgLen) + " bytes)")
+	}
+
+	return done()
+}
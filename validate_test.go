@@ -0,0 +1,134 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package nyquist
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git/dh"
+)
+
+// wrongSizeKeypair is a keypair for a different DH function, with a
+// public key that is not `DHLEN` bytes in size.
+type wrongSizeKeypair struct {
+	dh.Keypair
+}
+
+func (kp *wrongSizeKeypair) Public() dh.PublicKey {
+	return &wrongSizePublicKey{kp.Keypair.Public()}
+}
+
+type wrongSizePublicKey struct {
+	dh.PublicKey
+}
+
+func (pk *wrongSizePublicKey) Bytes() []byte {
+	return pk.PublicKey.Bytes()[:16]
+}
+
+func mustKeypair25519(t *testing.T) dh.Keypair {
+	kp, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(t, err, "GenerateKeypair(25519)")
+	return kp
+}
+
+func TestHandshakeConfigValidate(t *testing.T) {
+	mustProtocol := func(s string) *Protocol {
+		protocol, err := NewProtocol(s)
+		require.NoError(t, err, "NewProtocol(%s)", s)
+		return protocol
+	}
+
+	s25519, err := dh.X25519.GenerateKeypair(rand.Reader)
+	require.NoError(t, err, "GenerateKeypair(25519)")
+	wrongSize := &wrongSizeKeypair{mustKeypair25519(t)}
+	psk := make([]byte, PreSharedKeySize)
+
+	t.Run("Valid", func(t *testing.T) {
+		for _, cfg := range []*HandshakeConfig{
+			{Protocol: mustProtocol("Noise_NN_25519_ChaChaPoly_BLAKE2s"), IsInitiator: true},
+			{Protocol: mustProtocol("Noise_XX_25519_ChaChaPoly_BLAKE2s"), LocalStatic: s25519},
+			{
+				Protocol:     mustProtocol("Noise_KK_25519_ChaChaPoly_BLAKE2s"),
+				LocalStatic:  s25519,
+				RemoteStatic: s25519.Public(),
+				IsInitiator:  true,
+			},
+			{
+				Protocol:      mustProtocol("Noise_Npsk0_25519_ChaChaPoly_BLAKE2s"),
+				RemoteStatic:  s25519.Public(),
+				PreSharedKeys: [][]byte{psk},
+				IsInitiator:   true,
+			},
+			{
+				// The responder does not need a static key for NK.
+				Protocol:    mustProtocol("Noise_NK_25519_ChaChaPoly_BLAKE2s"),
+				LocalStatic: s25519,
+			},
+		} {
+			require.NoError(t, cfg.Validate(), "Validate(%s, %v)", cfg.Protocol, cfg.IsInitiator)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		require := require.New(t)
+
+		err := (&HandshakeConfig{}).Validate()
+		require.True(errors.Is(err, ErrInvalidConfig), "Validate(no protocol)")
+
+		cfg := &HandshakeConfig{
+			Protocol:       mustProtocol("Noise_KKpsk0_25519_ChaChaPoly_BLAKE2s"),
+			LocalEphemeral: wrongSize,
+			PreSharedKeys:  [][]byte{psk[:16], psk},
+			MaxMessageSize: 32,
+			IsInitiator:    true,
+		}
+		err = cfg.Validate()
+		require.True(errors.Is(err, ErrInvalidConfig), "Validate - errors.Is(ErrInvalidConfig)")
+
+		var vErr *ValidationError
+		require.True(errors.As(err, &vErr), "Validate - errors.As(*ValidationError)")
+		require.Len(vErr.Problems, 6, "Validate - number of problems: %v", vErr.Problems)
+		for _, v := range []string{
+			"LocalStatic",
+			"LocalEphemeral is not a 25519 keypair",
+			"RemoteStatic",
+			"requires 1 pre-shared key(s), 2 provided",
+			"pre-shared key 0 is 16 bytes",
+			"MaxMessageSize 32",
+		} {
+			require.Contains(err.Error(), v, "Validate - error message")
+		}
+	})
+}
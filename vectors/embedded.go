@@ -0,0 +1,76 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package vectors
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+)
+
+//go:embed data/*.txt
+var embeddedFS embed.FS
+
+var errNoSuchSet = errors.New("nyquist/vectors: no such embedded vector set")
+
+// EmbeddedSets returns the names of the embedded reference vector sets
+// (eg: `cacophony`, `snow`), in lexicographic order.
+func EmbeddedSets() []string {
+	ents, err := embeddedFS.ReadDir("data")
+	if err != nil {
+		panic("nyquist/vectors: failed to read embedded vectors: " + err.Error())
+	}
+
+	var sets []string
+	for _, ent := range ents {
+		sets = append(sets, strings.TrimSuffix(ent.Name(), ".txt"))
+	}
+	sort.Strings(sets)
+
+	return sets
+}
+
+// LoadEmbedded loads the embedded reference vector set with the given name.
+func LoadEmbedded(name string) (*File, error) {
+	b, err := embeddedFS.ReadFile(path.Join("data", name+".txt"))
+	if err != nil {
+		return nil, errNoSuchSet
+	}
+
+	var f File
+	if err = json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
@@ -0,0 +1,699 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package vectors
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// Format is a vector file encoding.
+type Format int
+
+const (
+	// FormatJSON is the JSON encoding, with byte strings hex encoded.
+	FormatJSON Format = iota
+
+	// FormatCBOR is the CBOR (RFC 8949) encoding, with byte strings as
+	// CBOR byte strings.
+	FormatCBOR
+
+	// FormatMsgpack is the MessagePack encoding, with byte strings as
+	// MessagePack bin values.
+	FormatMsgpack
+)
+
+// In all formats, a File is encoded as a map keyed by the JSON field names,
+// and decoders ignore unknown keys.  The binary decoders only support the
+// subset of each format required to represent a File, and definite length
+// CBOR items.
+
+const maxDecodeDepth = 16
+
+var (
+	errUnknownFormat   = errors.New("nyquist/vectors: unknown vector file format")
+	errMalformedBinary = errors.New("nyquist/vectors: malformed binary vector file")
+	errUnsupportedType = errors.New("nyquist/vectors: unsupported type")
+	errTypeMismatch    = errors.New("nyquist/vectors: type mismatch")
+)
+
+// String returns the name of the format.
+func (f Format) String() string {
+	switch f {
+	case FormatJSON:
+		return "json"
+	case FormatCBOR:
+		return "cbor"
+	case FormatMsgpack:
+		return "msgpack"
+	default:
+		return "[unknown format]"
+	}
+}
+
+// ParseFormat returns the Format with the given name.
+func ParseFormat(s string) (Format, error) {
+	for _, f := range []Format{FormatJSON, FormatCBOR, FormatMsgpack} {
+		if strings.EqualFold(s, f.String()) {
+			return f, nil
+		}
+	}
+	return 0, errUnknownFormat
+}
+
+// DetectFormat returns the Format of an encoded vector file.
+func DetectFormat(b []byte) (Format, error) {
+	b = bytes.TrimLeft(b, " \t\r\n")
+	if len(b) == 0 {
+		return 0, errUnknownFormat
+	}
+
+	switch c := b[0]; {
+	case c == '{':
+		return FormatJSON, nil
+	case c>>5 == cborMajorMap, bytes.HasPrefix(b, cborSelfDescribe):
+		return FormatCBOR, nil
+	case c&0xf0 == 0x80, c == 0xde, c == 0xdf:
+		return FormatMsgpack, nil
+	default:
+		return 0, errUnknownFormat
+	}
+}
+
+// Marshal encodes a vector file in the given format.
+func Marshal(f *File, format Format) ([]byte, error) {
+	var enc binaryEncoder
+	switch format {
+	case FormatJSON:
+		return json.Marshal(f)
+	case FormatCBOR:
+		enc = &cborEncoder{}
+	case FormatMsgpack:
+		enc = &msgpackEncoder{}
+	default:
+		return nil, errUnknownFormat
+	}
+
+	if err := encodeValue(enc, reflect.ValueOf(f).Elem()); err != nil {
+		return nil, err
+	}
+	return enc.bytes(), nil
+}
+
+// Unmarshal decodes a vector file in the given format.
+func Unmarshal(b []byte, format Format) (*File, error) {
+	var (
+		f   File
+		v   interface{}
+		err error
+	)
+	switch format {
+	case FormatJSON:
+		if err = json.Unmarshal(b, &f); err != nil {
+			return nil, err
+		}
+		return &f, nil
+	case FormatCBOR:
+		dec := &cborDecoder{b: b}
+		if bytes.HasPrefix(b, cborSelfDescribe) {
+			dec.b = b[len(cborSelfDescribe):]
+		}
+		v, err = dec.decode(0)
+		if err == nil && len(dec.b) != 0 {
+			err = errMalformedBinary
+		}
+	case FormatMsgpack:
+		dec := &msgpackDecoder{b: b}
+		v, err = dec.decode(0)
+		if err == nil && len(dec.b) != 0 {
+			err = errMalformedBinary
+		}
+	default:
+		return nil, errUnknownFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = assignValue(reflect.ValueOf(&f).Elem(), v); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// binaryEncoder is the interface implemented by the binary format
+// encoders.
+type binaryEncoder interface {
+	writeMap(n int)
+	writeArray(n int)
+	writeBytes(b []byte)
+	writeString(s string)
+	writeBool(b bool)
+	writeNil()
+	bytes() []byte
+}
+
+type structField struct {
+	name      string
+	omitEmpty bool
+	index     int
+}
+
+func structFields(t reflect.Type) []structField {
+	var fields []structField
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("json")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		fields = append(fields, structField{
+			name:      parts[0],
+			omitEmpty: len(parts) > 1 && parts[1] == "omitempty",
+			index:     i,
+		})
+	}
+	return fields
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	default:
+		return false
+	}
+}
+
+func encodeValue(enc binaryEncoder, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		var fields []structField
+		for _, f := range structFields(v.Type()) {
+			if f.omitEmpty && isEmptyValue(v.Field(f.index)) {
+				continue
+			}
+			fields = append(fields, f)
+		}
+		enc.writeMap(len(fields))
+		for _, f := range fields {
+			enc.writeString(f.name)
+			if err := encodeValue(enc, v.Field(f.index)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			enc.writeBytes(v.Bytes())
+			return nil
+		}
+		if v.IsNil() {
+			enc.writeNil()
+			return nil
+		}
+		enc.writeArray(v.Len())
+		for i := 0; i < v.Len(); i++ {
+			if err := encodeValue(enc, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.String:
+		enc.writeString(v.String())
+	case reflect.Bool:
+		enc.writeBool(v.Bool())
+	default:
+		return errUnsupportedType
+	}
+	return nil
+}
+
+// decodedMap is a decoded map, with the keys in encoded order.
+type decodedMap struct {
+	keys   []string
+	values []interface{}
+}
+
+func assignValue(dst reflect.Value, v interface{}) error {
+	if v == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+
+	switch dst.Kind() {
+	case reflect.Struct:
+		m, ok := v.(*decodedMap)
+		if !ok {
+			return errTypeMismatch
+		}
+		fields := make(map[string]int)
+		for _, f := range structFields(dst.Type()) {
+			fields[f.name] = f.index
+		}
+		for i, k := range m.keys {
+			idx, ok := fields[k]
+			if !ok {
+				continue
+			}
+			if err := assignValue(dst.Field(idx), m.values[i]); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		if dst.Type().Elem().Kind() == reflect.Uint8 {
+			b, ok := v.([]byte)
+			if !ok {
+				return errTypeMismatch
+			}
+			if len(b) == 0 {
+				b = nil
+			}
+			dst.SetBytes(b)
+			return nil
+		}
+		a, ok := v.([]interface{})
+		if !ok {
+			return errTypeMismatch
+		}
+		s := reflect.MakeSlice(dst.Type(), len(a), len(a))
+		for i := range a {
+			if err := assignValue(s.Index(i), a[i]); err != nil {
+				return err
+			}
+		}
+		dst.Set(s)
+	case reflect.String:
+		s, ok := v.(string)
+		if !ok {
+			return errTypeMismatch
+		}
+		dst.SetString(s)
+	case reflect.Bool:
+		b, ok := v.(bool)
+		if !ok {
+			return errTypeMismatch
+		}
+		dst.SetBool(b)
+	default:
+		return errUnsupportedType
+	}
+	return nil
+}
+
+// readN consumes n bytes from b.
+func readN(b *[]byte, n uint64) ([]byte, error) {
+	if uint64(len(*b)) < n {
+		return nil, errMalformedBinary
+	}
+	ret := (*b)[:n]
+	*b = (*b)[n:]
+	return ret, nil
+}
+
+func readUint(b *[]byte, size int) (uint64, error) {
+	buf, err := readN(b, uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(buf[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(buf)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(buf)), nil
+	default:
+		return binary.BigEndian.Uint64(buf), nil
+	}
+}
+
+// checkCount rejects container lengths that can not possibly fit in the
+// remaining input, to avoid excessive allocations.
+func checkCount(b []byte, n uint64) (int, error) {
+	if n > uint64(len(b)) || n > math.MaxInt32 {
+		return 0, errMalformedBinary
+	}
+	return int(n), nil
+}
+
+const (
+	cborMajorUint   = 0
+	cborMajorNegInt = 1
+	cborMajorBytes  = 2
+	cborMajorText   = 3
+	cborMajorArray  = 4
+	cborMajorMap    = 5
+	cborMajorTag    = 6
+	cborMajorSimple = 7
+
+	cborFalse = 0xf4
+	cborTrue  = 0xf5
+	cborNull  = 0xf6
+)
+
+var cborSelfDescribe = []byte{0xd9, 0xd9, 0xf7}
+
+type cborEncoder struct {
+	buf []byte
+}
+
+func (e *cborEncoder) writeHead(major byte, n uint64) {
+	switch {
+	case n < 24:
+		e.buf = append(e.buf, major<<5|byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, major<<5|24, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, major<<5|25, byte(n>>8), byte(n))
+	case n <= math.MaxUint32:
+		e.buf = append(e.buf, major<<5|26)
+		e.buf = append(e.buf, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	default:
+		e.buf = append(e.buf, major<<5|27)
+		var tmp [8]byte
+		binary.BigEndian.PutUint64(tmp[:], n)
+		e.buf = append(e.buf, tmp[:]...)
+	}
+}
+
+func (e *cborEncoder) writeMap(n int)   { e.writeHead(cborMajorMap, uint64(n)) }
+func (e *cborEncoder) writeArray(n int) { e.writeHead(cborMajorArray, uint64(n)) }
+
+func (e *cborEncoder) writeBytes(b []byte) {
+	e.writeHead(cborMajorBytes, uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *cborEncoder) writeString(s string) {
+	e.writeHead(cborMajorText, uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *cborEncoder) writeBool(b bool) {
+	if b {
+		e.buf = append(e.buf, cborTrue)
+	} else {
+		e.buf = append(e.buf, cborFalse)
+	}
+}
+
+func (e *cborEncoder) writeNil() {
+	e.buf = append(e.buf, cborNull)
+}
+
+func (e *cborEncoder) bytes() []byte {
+	return e.buf
+}
+
+type cborDecoder struct {
+	b []byte
+}
+
+func (d *cborDecoder) decode(depth int) (interface{}, error) {
+	if depth > maxDecodeDepth {
+		return nil, errMalformedBinary
+	}
+
+	hdr, err := readN(&d.b, 1)
+	if err != nil {
+		return nil, err
+	}
+	major, info := hdr[0]>>5, hdr[0]&0x1f
+
+	if major == cborMajorSimple {
+		switch hdr[0] {
+		case cborFalse:
+			return false, nil
+		case cborTrue:
+			return true, nil
+		case cborNull:
+			return nil, nil
+		default:
+			return nil, errUnsupportedType
+		}
+	}
+
+	var n uint64
+	switch {
+	case info < 24:
+		n = uint64(info)
+	case info <= 27:
+		if n, err = readUint(&d.b, 1<<(info-24)); err != nil {
+			return nil, err
+		}
+	default:
+		// Indefinite lengths, and reserved values.
+		return nil, errMalformedBinary
+	}
+
+	switch major {
+	case cborMajorUint:
+		return n, nil
+	case cborMajorNegInt:
+		if n > math.MaxInt64 {
+			return nil, errMalformedBinary
+		}
+		return -1 - int64(n), nil
+	case cborMajorBytes:
+		b, err := readN(&d.b, n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, b...), nil
+	case cborMajorText:
+		b, err := readN(&d.b, n)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case cborMajorArray:
+		cnt, err := checkCount(d.b, n)
+		if err != nil {
+			return nil, err
+		}
+		a := make([]interface{}, 0, cnt)
+		for i := 0; i < cnt; i++ {
+			v, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+		return a, nil
+	case cborMajorMap:
+		cnt, err := checkCount(d.b, n)
+		if err != nil {
+			return nil, err
+		}
+		return decodeMap(cnt, func() (interface{}, error) {
+			return d.decode(depth + 1)
+		})
+	default: // cborMajorTag
+		// Tags are ignored.
+		return d.decode(depth + 1)
+	}
+}
+
+func decodeMap(n int, decodeFn func() (interface{}, error)) (*decodedMap, error) {
+	m := &decodedMap{
+		keys:   make([]string, 0, n),
+		values: make([]interface{}, 0, n),
+	}
+	for i := 0; i < n; i++ {
+		k, err := decodeFn()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, errMalformedBinary
+		}
+		v, err := decodeFn()
+		if err != nil {
+			return nil, err
+		}
+		m.keys = append(m.keys, key)
+		m.values = append(m.values, v)
+	}
+	return m, nil
+}
+
+type msgpackEncoder struct {
+	buf []byte
+}
+
+func (e *msgpackEncoder) writeLen(n int, fix, fixMax byte, tag8, tag16, tag32 byte) {
+	switch {
+	case fix != 0 && n <= int(fixMax):
+		e.buf = append(e.buf, fix|byte(n))
+	case tag8 != 0 && n <= math.MaxUint8:
+		e.buf = append(e.buf, tag8, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, tag16, byte(n>>8), byte(n))
+	default:
+		e.buf = append(e.buf, tag32, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+}
+
+func (e *msgpackEncoder) writeMap(n int)   { e.writeLen(n, 0x80, 15, 0, 0xde, 0xdf) }
+func (e *msgpackEncoder) writeArray(n int) { e.writeLen(n, 0x90, 15, 0, 0xdc, 0xdd) }
+
+func (e *msgpackEncoder) writeBytes(b []byte) {
+	e.writeLen(len(b), 0, 0, 0xc4, 0xc5, 0xc6)
+	e.buf = append(e.buf, b...)
+}
+
+func (e *msgpackEncoder) writeString(s string) {
+	e.writeLen(len(s), 0xa0, 31, 0xd9, 0xda, 0xdb)
+	e.buf = append(e.buf, s...)
+}
+
+func (e *msgpackEncoder) writeBool(b bool) {
+	if b {
+		e.buf = append(e.buf, 0xc3)
+	} else {
+		e.buf = append(e.buf, 0xc2)
+	}
+}
+
+func (e *msgpackEncoder) writeNil() {
+	e.buf = append(e.buf, 0xc0)
+}
+
+func (e *msgpackEncoder) bytes() []byte {
+	return e.buf
+}
+
+type msgpackDecoder struct {
+	b []byte
+}
+
+func (d *msgpackDecoder) decode(depth int) (interface{}, error) {
+	if depth > maxDecodeDepth {
+		return nil, errMalformedBinary
+	}
+
+	hdr, err := readN(&d.b, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		n    uint64
+		kind byte
+	)
+	switch c := hdr[0]; {
+	case c <= 0x7f:
+		return uint64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c <= 0x8f:
+		n, kind = uint64(c&0x0f), 'm'
+	case c <= 0x9f:
+		n, kind = uint64(c&0x0f), 'a'
+	case c <= 0xbf:
+		n, kind = uint64(c&0x1f), 's'
+	case c == 0xc0:
+		return nil, nil
+	case c == 0xc2:
+		return false, nil
+	case c == 0xc3:
+		return true, nil
+	case c >= 0xc4 && c <= 0xc6:
+		n, err = readUint(&d.b, 1<<(c-0xc4))
+		kind = 'b'
+	case c >= 0xcc && c <= 0xcf:
+		return readUint(&d.b, 1<<(c-0xcc))
+	case c >= 0xd0 && c <= 0xd3:
+		var u uint64
+		if u, err = readUint(&d.b, 1<<(c-0xd0)); err != nil {
+			return nil, err
+		}
+		shift := 64 - 8*(1<<(c-0xd0))
+		return int64(u<<shift) >> shift, nil
+	case c >= 0xd9 && c <= 0xdb:
+		n, err = readUint(&d.b, 1<<(c-0xd9))
+		kind = 's'
+	case c == 0xdc || c == 0xdd:
+		n, err = readUint(&d.b, 2<<(c-0xdc))
+		kind = 'a'
+	case c == 0xde || c == 0xdf:
+		n, err = readUint(&d.b, 2<<(c-0xde))
+		kind = 'm'
+	default:
+		return nil, errUnsupportedType
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case 'b':
+		b, err := readN(&d.b, n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, b...), nil
+	case 's':
+		b, err := readN(&d.b, n)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	case 'a':
+		cnt, err := checkCount(d.b, n)
+		if err != nil {
+			return nil, err
+		}
+		a := make([]interface{}, 0, cnt)
+		for i := 0; i < cnt; i++ {
+			v, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+		return a, nil
+	default: // 'm'
+		cnt, err := checkCount(d.b, n)
+		if err != nil {
+			return nil, err
+		}
+		return decodeMap(cnt, func() (interface{}, error) {
+			return d.decode(depth + 1)
+		})
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package vectors
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormats(t *testing.T) {
+	for _, set := range EmbeddedSets() {
+		f, err := LoadEmbedded(set)
+		require.NoError(t, err, "LoadEmbedded(%s)", set)
+
+		jsonBytes, err := Marshal(f, FormatJSON)
+		require.NoError(t, err, "Marshal(%s, json)", set)
+
+		for _, format := range []Format{FormatJSON, FormatCBOR, FormatMsgpack} {
+			t.Run(set+"/"+format.String(), func(t *testing.T) {
+				require := require.New(t)
+
+				b, err := Marshal(f, format)
+				require.NoError(err, "Marshal")
+				if format != FormatJSON {
+					require.Less(len(b), len(jsonBytes), "smaller than JSON")
+				}
+
+				detected, err := DetectFormat(b)
+				require.NoError(err, "DetectFormat")
+				require.Equal(format, detected, "DetectFormat")
+
+				f2, err := Unmarshal(b, format)
+				require.NoError(err, "Unmarshal")
+				require.Equal(f, f2, "round trip")
+
+				_, err = Unmarshal(b[:len(b)-1], format)
+				require.Error(err, "Unmarshal - truncated")
+			})
+		}
+	}
+
+	t.Run("ParseFormat", func(t *testing.T) {
+		require := require.New(t)
+
+		for _, format := range []Format{FormatJSON, FormatCBOR, FormatMsgpack} {
+			f, err := ParseFormat(format.String())
+			require.NoError(err, "ParseFormat(%s)", format)
+			require.Equal(format, f, "ParseFormat(%s)", format)
+		}
+		f, err := ParseFormat("MsgPack")
+		require.NoError(err, "ParseFormat - case insensitive")
+		require.Equal(FormatMsgpack, f, "ParseFormat - case insensitive")
+
+		_, err = ParseFormat("yaml")
+		require.Equal(errUnknownFormat, err, "ParseFormat - unknown")
+	})
+
+	t.Run("CBOR/Encoding", func(t *testing.T) {
+		require := require.New(t)
+
+		enc := &cborEncoder{}
+		enc.writeMap(1)
+		enc.writeString("a")
+		enc.writeArray(2)
+		enc.writeBytes(bytes.Repeat([]byte{0xff}, 300))
+		enc.writeBool(true)
+
+		expected := append([]byte{0xa1, 0x61, 'a', 0x82, 0x59, 0x01, 0x2c}, bytes.Repeat([]byte{0xff}, 300)...)
+		expected = append(expected, 0xf5)
+		require.Equal(expected, enc.bytes(), "encoding")
+	})
+
+	t.Run("CBOR/Decoding", func(t *testing.T) {
+		require := require.New(t)
+
+		// Self-describe tag, unknown keys of various types, and a tagged
+		// vector name.
+		b := []byte{
+			0xd9, 0xd9, 0xf7,
+			0xa3,
+			0x67, 'u', 'n', 'k', 'n', 'o', 'w', 'n', 0x38, 0x63, // -100
+			0x64, 'n', 'u', 'l', 'l', 0xf6,
+			0x67, 'v', 'e', 'c', 't', 'o', 'r', 's', 0x81,
+			0xa2,
+			0x64, 'n', 'a', 'm', 'e', 0xc0, 0x61, 'x',
+			0x64, 'f', 'a', 'i', 'l', 0xf5,
+		}
+		format, err := DetectFormat(b)
+		require.NoError(err, "DetectFormat")
+		require.Equal(FormatCBOR, format, "DetectFormat")
+
+		f, err := Unmarshal(b, FormatCBOR)
+		require.NoError(err, "Unmarshal")
+		require.Equal(&File{Vectors: []Vector{{Name: "x", Fail: true}}}, f, "Unmarshal")
+
+		for _, v := range []struct {
+			name string
+			b    []byte
+			err  error
+		}{
+			{"Indefinite", []byte{0xbf, 0xff}, errMalformedBinary},
+			{"NonStringKey", []byte{0xa1, 0x01, 0x01}, errMalformedBinary},
+			{"Float", []byte{0xa1, 0x61, 'a', 0xf9, 0x3c, 0x00}, errUnsupportedType},
+			{"HugeArray", []byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, errMalformedBinary},
+			{"TypeMismatch", []byte{0xa1, 0x67, 'v', 'e', 'c', 't', 'o', 'r', 's', 0x01}, errTypeMismatch},
+			{"Trailing", []byte{0xa0, 0x00}, errMalformedBinary},
+		} {
+			_, err = Unmarshal(v.b, FormatCBOR)
+			require.Equal(v.err, err, "Unmarshal - %s", v.name)
+		}
+	})
+
+	t.Run("Msgpack/Encoding", func(t *testing.T) {
+		require := require.New(t)
+
+		enc := &msgpackEncoder{}
+		enc.writeMap(1)
+		enc.writeString(string(bytes.Repeat([]byte{'a'}, 40)))
+		enc.writeArray(20)
+		enc.writeBytes([]byte{0x01})
+		enc.writeBool(false)
+
+		expected := append([]byte{0x81, 0xd9, 40}, bytes.Repeat([]byte{'a'}, 40)...)
+		expected = append(expected, 0xdc, 0x00, 0x14, 0xc4, 0x01, 0x01, 0xc2)
+		require.Equal(expected, enc.bytes(), "encoding")
+	})
+
+	t.Run("Msgpack/Decoding", func(t *testing.T) {
+		require := require.New(t)
+
+		b := []byte{
+			0x83,
+			0xa7, 'u', 'n', 'k', 'n', 'o', 'w', 'n', 0xd1, 0xff, 0x9c, // -100
+			0xa4, 'n', 'u', 'l', 'l', 0xc0,
+			0xa7, 'v', 'e', 'c', 't', 'o', 'r', 's', 0x91,
+			0x82,
+			0xa4, 'n', 'a', 'm', 'e', 0xa1, 'x',
+			0xae, 'h', 'a', 'n', 'd', 's', 'h', 'a', 'k', 'e', '_', 'h', 'a', 's', 'h', 0xc4, 0x02, 0xab, 0xcd,
+		}
+		format, err := DetectFormat(b)
+		require.NoError(err, "DetectFormat")
+		require.Equal(FormatMsgpack, format, "DetectFormat")
+
+		f, err := Unmarshal(b, FormatMsgpack)
+		require.NoError(err, "Unmarshal")
+		require.Equal(&File{Vectors: []Vector{{Name: "x", HandshakeHash: HexBuffer{0xab, 0xcd}}}}, f, "Unmarshal")
+
+		for _, v := range []struct {
+			name string
+			b    []byte
+			err  error
+		}{
+			{"NonStringKey", []byte{0x81, 0x01, 0x01}, errMalformedBinary},
+			{"Float", []byte{0x81, 0xa1, 'a', 0xca, 0, 0, 0, 0}, errUnsupportedType},
+			{"HugeMap", []byte{0xdf, 0xff, 0xff, 0xff, 0xff}, errMalformedBinary},
+			{"TypeMismatch", []byte{0x81, 0xa7, 'v', 'e', 'c', 't', 'o', 'r', 's', 0xc3}, errTypeMismatch},
+		} {
+			_, err = Unmarshal(v.b, FormatMsgpack)
+			require.Equal(v.err, err, "Unmarshal - %s", v.name)
+		}
+	})
+
+	t.Run("DetectFormat/Unknown", func(t *testing.T) {
+		for _, b := range [][]byte{nil, []byte("  "), []byte("[]"), {0x00}} {
+			_, err := DetectFormat(b)
+			require.Equal(t, errUnknownFormat, err, "DetectFormat(%x)", b)
+		}
+	})
+}
@@ -0,0 +1,271 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package vectors
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+)
+
+var errMalformedProtocolName = errors.New("nyquist/vectors: malformed protocol name")
+
+// ProtocolName is a parsed protocol name.
+type ProtocolName struct {
+	// Pattern is the handshake pattern name, including any modifiers
+	// (eg: `XXpsk0+psk2`).
+	Pattern string
+
+	// BasePattern is the handshake pattern name, without modifiers
+	// (eg: `XX`).
+	BasePattern string
+
+	// Modifiers are the pattern modifiers (eg: `psk0`, `psk2`).
+	Modifiers []string
+
+	// DH is the DH function name (eg: `25519`).
+	DH string
+
+	// Cipher is the cipher function name (eg: `ChaChaPoly`).
+	Cipher string
+
+	// Hash is the hash function name (eg: `BLAKE2s`).
+	Hash string
+}
+
+// HasPSK returns true iff the pattern has any `psk` modifiers.
+func (pn *ProtocolName) HasPSK() bool {
+	for _, m := range pn.Modifiers {
+		if strings.HasPrefix(m, "psk") {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseProtocolName parses a protocol name into its components.  The
+// components are not checked against the supported primitives.
+func ParseProtocolName(s string) (*ProtocolName, error) {
+	parts := strings.Split(s, "_")
+	if len(parts) != 5 || parts[0] != "Noise" {
+		return nil, errMalformedProtocolName
+	}
+	for _, part := range parts[1:] {
+		if part == "" {
+			return nil, errMalformedProtocolName
+		}
+	}
+
+	pn := &ProtocolName{
+		Pattern:     parts[1],
+		BasePattern: parts[1],
+		DH:          parts[2],
+		Cipher:      parts[3],
+		Hash:        parts[4],
+	}
+
+	// Modifiers start at the first lower case character.
+	if idx := strings.IndexFunc(parts[1], func(r rune) bool {
+		return r >= 'a' && r <= 'z'
+	}); idx >= 0 {
+		pn.BasePattern = parts[1][:idx]
+		pn.Modifiers = strings.Split(parts[1][idx:], "+")
+	}
+	if pn.BasePattern == "" {
+		return nil, errMalformedProtocolName
+	}
+
+	return pn, nil
+}
+
+// Filter is a predicate used to select vectors.
+type Filter func(*Vector) bool
+
+// Not returns a Filter that matches vectors that do not match f.
+func Not(f Filter) Filter {
+	return func(v *Vector) bool {
+		return !f(v)
+	}
+}
+
+func protocolNameFilter(fn func(*ProtocolName) bool) Filter {
+	return func(v *Vector) bool {
+		name := v.ProtocolName
+		if name == "" {
+			name = v.Name
+		}
+		pn, err := ParseProtocolName(name)
+		if err != nil {
+			return false
+		}
+		return fn(pn)
+	}
+}
+
+func matchesAny(s string, names []string) bool {
+	for _, name := range names {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ByPattern returns a Filter that matches vectors where the pattern name,
+// either with or without modifiers, is one of the given names.
+func ByPattern(names ...string) Filter {
+	return protocolNameFilter(func(pn *ProtocolName) bool {
+		return matchesAny(pn.Pattern, names) || matchesAny(pn.BasePattern, names)
+	})
+}
+
+// ByDH returns a Filter that matches vectors using one of the named DH
+// functions.
+func ByDH(names ...string) Filter {
+	return protocolNameFilter(func(pn *ProtocolName) bool {
+		return matchesAny(pn.DH, names)
+	})
+}
+
+// ByCipher returns a Filter that matches vectors using one of the named
+// cipher functions.
+func ByCipher(names ...string) Filter {
+	return protocolNameFilter(func(pn *ProtocolName) bool {
+		return matchesAny(pn.Cipher, names)
+	})
+}
+
+// ByHash returns a Filter that matches vectors using one of the named hash
+// functions.
+func ByHash(names ...string) Filter {
+	return protocolNameFilter(func(pn *ProtocolName) bool {
+		return matchesAny(pn.Hash, names)
+	})
+}
+
+// PSK is a Filter that matches vectors using pre-shared keys.
+func PSK(v *Vector) bool {
+	return protocolNameFilter((*ProtocolName).HasPSK)(v)
+}
+
+// Fallback is a Filter that matches vectors exercising a fallback
+// handshake.
+func Fallback(v *Vector) bool {
+	return v.IsFallback()
+}
+
+// KEM is a Filter that matches vectors using hybrid or post-quantum KEMs.
+func KEM(v *Vector) bool {
+	return v.RequiresKEM()
+}
+
+// SupportedBy returns a Filter that matches vectors where isSupported
+// returns true for the protocol name, and the fallback protocol name if
+// any (eg: to intersect with the protocols supported by an implementation).
+func SupportedBy(isSupported func(protocolName string) bool) Filter {
+	return func(v *Vector) bool {
+		name := v.ProtocolName
+		if name == "" {
+			name = v.Name
+		}
+		if !isSupported(name) {
+			return false
+		}
+		if fallbackName := v.FallbackProtocolName(); fallbackName != "" {
+			return isSupported(fallbackName)
+		}
+		return true
+	}
+}
+
+// Select returns a new File, containing the vectors that match all of the
+// filters, in order.  The vectors are shared with f.
+func (f *File) Select(filters ...Filter) *File {
+	var ret File
+	for i := range f.Vectors {
+		v := &f.Vectors[i]
+		matches := true
+		for _, filter := range filters {
+			if !filter(v) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			ret.Vectors = append(ret.Vectors, *v)
+		}
+	}
+	return &ret
+}
+
+// Deduplicate returns a new File, with vectors that are identical to a
+// previous vector (ignoring Name) removed.
+func (f *File) Deduplicate() *File {
+	var ret File
+	seen := make(map[string]bool)
+	for _, v := range f.Vectors {
+		cmpV := v
+		if cmpV.ProtocolName == "" {
+			cmpV.ProtocolName = cmpV.Name
+		}
+		cmpV.Name = ""
+		b, err := json.Marshal(&cmpV)
+		if err != nil {
+			panic("nyquist/vectors: failed to serialize vector: " + err.Error())
+		}
+		if seen[string(b)] {
+			continue
+		}
+		seen[string(b)] = true
+		ret.Vectors = append(ret.Vectors, v)
+	}
+	return &ret
+}
+
+// ProtocolNames returns the distinct protocol names of the vectors, in
+// lexicographic order.
+func (f *File) ProtocolNames() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, v := range f.Vectors {
+		name := v.ProtocolName
+		if name == "" {
+			name = v.Name
+		}
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
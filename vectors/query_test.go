@@ -0,0 +1,142 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package vectors
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProtocolName(t *testing.T) {
+	require := require.New(t)
+
+	pn, err := ParseProtocolName("Noise_XXpsk0+psk2_448_AESGCM_SHA512")
+	require.NoError(err, "ParseProtocolName")
+	require.Equal(&ProtocolName{
+		Pattern:     "XXpsk0+psk2",
+		BasePattern: "XX",
+		Modifiers:   []string{"psk0", "psk2"},
+		DH:          "448",
+		Cipher:      "AESGCM",
+		Hash:        "SHA512",
+	}, pn, "ParseProtocolName")
+	require.True(pn.HasPSK(), "HasPSK")
+
+	pn, err = ParseProtocolName("Noise_I1K1_25519_ChaChaPoly_BLAKE2s")
+	require.NoError(err, "ParseProtocolName - deferred")
+	require.Equal("I1K1", pn.BasePattern, "BasePattern - deferred")
+	require.Nil(pn.Modifiers, "Modifiers - deferred")
+	require.False(pn.HasPSK(), "HasPSK - deferred")
+
+	for _, s := range []string{
+		"",
+		"Noise_XX_25519_ChaChaPoly",
+		"NoisePSK_XX_25519_ChaChaPoly_BLAKE2s",
+		"Noise_psk0_25519_ChaChaPoly_BLAKE2s",
+		"Noise__25519_ChaChaPoly_BLAKE2s",
+	} {
+		_, err = ParseProtocolName(s)
+		require.Equal(errMalformedProtocolName, err, "ParseProtocolName(%s)", s)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	f, err := LoadEmbedded("snow")
+	require.NoError(t, err, "LoadEmbedded")
+
+	protocolNamesMatch := func(t *testing.T, f *File, fn func(string) bool) {
+		require.NotEmpty(t, f.Vectors, "no vectors selected")
+		for _, v := range f.Vectors {
+			require.True(t, fn(v.ProtocolName), "unexpected vector: %s", v.ProtocolName)
+		}
+	}
+
+	t.Run("Primitives", func(t *testing.T) {
+		sel := f.Select(ByPattern("IK"), ByDH("25519"), ByCipher("AESGCM"), ByHash("SHA256", "SHA512"))
+		protocolNamesMatch(t, sel, func(s string) bool {
+			return strings.HasPrefix(s, "Noise_IK") && strings.Contains(s, "_25519_AESGCM_SHA")
+		})
+
+		// Modifiers are matched when the full pattern name is given.
+		sel = f.Select(ByPattern("IKpsk0+psk2"))
+		protocolNamesMatch(t, sel, func(s string) bool {
+			return strings.HasPrefix(s, "Noise_IKpsk0+psk2_")
+		})
+	})
+
+	t.Run("Flags", func(t *testing.T) {
+		protocolNamesMatch(t, f.Select(PSK), func(s string) bool {
+			return strings.Contains(s, "psk")
+		})
+		protocolNamesMatch(t, f.Select(Not(PSK)), func(s string) bool {
+			return !strings.Contains(s, "psk")
+		})
+		require.Len(t, f.Select(Not(PSK)).Vectors, len(f.Vectors)-len(f.Select(PSK).Vectors), "PSK partitions")
+		require.Empty(t, f.Select(Fallback).Vectors, "Fallback")
+		require.Empty(t, f.Select(KEM).Vectors, "KEM")
+	})
+
+	t.Run("SupportedBy", func(t *testing.T) {
+		sel := f.Select(SupportedBy(func(s string) bool {
+			return !strings.Contains(s, "BLAKE2")
+		}))
+		protocolNamesMatch(t, sel, func(s string) bool {
+			return !strings.Contains(s, "BLAKE2")
+		})
+
+		fallback := &File{Vectors: []Vector{{ProtocolName: "Noise_IK_25519_ChaChaPoly_SHA256", Fallback: true}}}
+		require.Empty(t, fallback.Select(SupportedBy(func(s string) bool {
+			return !strings.Contains(s, "fallback")
+		})).Vectors, "SupportedBy - unsupported fallback")
+	})
+
+	t.Run("Deduplicate", func(t *testing.T) {
+		require := require.New(t)
+
+		dup := &File{Vectors: append(append([]Vector{}, f.Vectors[:4]...), f.Vectors[:4]...)}
+		dup.Vectors[5].Name = "renamed duplicate"
+		dup.Vectors[6].HandshakeHash = HexBuffer{0x01}
+
+		dedup := dup.Deduplicate()
+		require.Len(dedup.Vectors, 5, "Deduplicate")
+		require.Equal(f.Vectors[:4], dedup.Vectors[:4], "Deduplicate - order preserved")
+		require.Equal(dup.Vectors[6], dedup.Vectors[4], "Deduplicate - distinct vector kept")
+	})
+
+	t.Run("ProtocolNames", func(t *testing.T) {
+		require := require.New(t)
+
+		names := f.Select(ByPattern("NN"), Not(PSK)).ProtocolNames()
+		require.Len(names, 8, "ProtocolNames")
+		require.Equal("Noise_NN_25519_AESGCM_BLAKE2b", names[0], "ProtocolNames - sorted")
+	})
+}
@@ -0,0 +1,190 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package runner
+
+import (
+	_ "embed" // For the golden transcripts.
+	"errors"
+	"fmt"
+	"sort"
+
+	"golang.org/x/crypto/sha3"
+
+	"gitlab.com/yawning/nyquist.git/cipher"
+	"gitlab.com/yawning/nyquist.git/dh"
+	"gitlab.com/yawning/nyquist.git/pattern"
+	"gitlab.com/yawning/nyquist.git/vectors"
+)
+
+// The golden transcripts are regenerated with:
+//
+//	nyquist vectors generate -golden -format cbor -out vectors/runner/data/golden.cbor
+//
+//go:embed data/golden.cbor
+var goldenData []byte
+
+const (
+	goldenSeedPrefix    = "nyquist golden transcript: "
+	goldenDefaultSuffix = "ChaChaPoly_BLAKE2s"
+)
+
+var (
+	errGoldenMissing  = errors.New("nyquist/vectors/runner: golden transcript missing")
+	errGoldenMismatch = errors.New("nyquist/vectors/runner: golden transcript mismatch")
+
+	// The primitives are referred to by name, as some of them can be
+	// omitted from the build.
+	goldenDHs      = []string{"25519", "448"}
+	goldenCiphers  = []string{"ChaChaPoly", "AESGCM", "ChaCha8Poly", "ChaCha12Poly", "AESOCB", "DeoxysII"}
+	goldenHashes   = []string{"SHA256", "SHA512", "SHA512/256", "BLAKE2s", "BLAKE2b"}
+	goldenPatterns = []pattern.Pattern{
+		pattern.N, pattern.K, pattern.X,
+		pattern.Npsk0, pattern.Kpsk0, pattern.Xpsk1,
+
+		pattern.NN, pattern.NK, pattern.NX,
+		pattern.XN, pattern.XK, pattern.XX,
+		pattern.KN, pattern.KK, pattern.KX,
+		pattern.IN, pattern.IK, pattern.IX,
+		pattern.NNpsk0, pattern.NNpsk2, pattern.NKpsk0, pattern.NKpsk2, pattern.NXpsk2,
+		pattern.XNpsk3, pattern.XKpsk3, pattern.XXpsk3,
+		pattern.KNpsk0, pattern.KNpsk2, pattern.KKpsk0, pattern.KKpsk2, pattern.KXpsk2,
+		pattern.INpsk1, pattern.INpsk2, pattern.IKpsk1, pattern.IKpsk2, pattern.IXpsk2,
+
+		pattern.NK1, pattern.NX1,
+		pattern.X1N, pattern.X1K, pattern.XK1, pattern.X1K1, pattern.X1X, pattern.XX1, pattern.X1X1,
+		pattern.K1N, pattern.K1K, pattern.KK1, pattern.K1K1, pattern.K1X, pattern.KX1, pattern.K1X1,
+		pattern.I1N, pattern.I1K, pattern.IK1, pattern.I1K1, pattern.I1X, pattern.IX1, pattern.I1X1,
+	}
+
+	// goldenFallbackPattern is the pattern used to generate the fallback
+	// transcripts, with the fallback pattern being XXfallback.
+	goldenFallbackPattern = pattern.IK
+)
+
+// GoldenNames returns the names of the golden transcripts for the
+// primitives included in the build, in lexicographic order.  There is a transcript for every built-in pattern
+// with each DH function, and for every combination of built-in primitives
+// with the XX and XXfallback patterns.  The fallback transcripts are named
+// after the fallback protocol (eg: `Noise_XXfallback_25519_ChaChaPoly_BLAKE2s`).
+func GoldenNames() []string {
+	m := make(map[string]bool)
+	for _, dhName := range goldenDHs {
+		if dh.FromString(dhName) == nil {
+			continue
+		}
+		for _, pa := range goldenPatterns {
+			m["Noise_"+pa.String()+"_"+dhName+"_"+goldenDefaultSuffix] = true
+		}
+		for _, cipherName := range goldenCiphers {
+			if cipher.FromString(cipherName) == nil {
+				continue
+			}
+			for _, hashName := range goldenHashes {
+				suite := dhName + "_" + cipherName + "_" + hashName
+				m["Noise_"+pattern.XX.String()+"_"+suite] = true
+				m["Noise_"+pattern.XXfallback.String()+"_"+suite] = true
+			}
+		}
+	}
+
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// GenerateGolden deterministically generates the golden transcripts.  The
+// entropy for each transcript is derived from the transcript name, so
+// the output only changes if the protocol implementation does.
+func GenerateGolden() (*vectors.File, error) {
+	var f vectors.File
+	for _, name := range GoldenNames() {
+		v, err := generateGolden(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		f.Vectors = append(f.Vectors, *v)
+	}
+
+	return &f, nil
+}
+
+// LoadGolden loads the embedded golden transcripts.
+func LoadGolden() (*vectors.File, error) {
+	return vectors.Unmarshal(goldenData, vectors.FormatCBOR)
+}
+
+// SelfTest verifies the embedded golden transcripts, and returns nil iff
+// every transcript listed by GoldenNames is present and passes.  This
+// covers the suites (eg: DeoxysII, X448) that are absent from the external
+// reference vectors.
+func SelfTest() error {
+	f, err := LoadGolden()
+	if err != nil {
+		return err
+	}
+
+	transcripts := make(map[string]*vectors.Vector)
+	for i := range f.Vectors {
+		v := &f.Vectors[i]
+		transcripts[v.Name] = v
+	}
+
+	for _, name := range GoldenNames() {
+		v := transcripts[name]
+		if v == nil {
+			return fmt.Errorf("%w: %s", errGoldenMissing, name)
+		}
+		if err = Verify(v); err != nil {
+			return fmt.Errorf("%w: %s: %v", errGoldenMismatch, name, err)
+		}
+	}
+
+	return nil
+}
+
+func generateGolden(name string) (*vectors.Vector, error) {
+	rng := sha3.NewShake256()
+	_, _ = rng.Write([]byte(goldenSeedPrefix + name))
+
+	pn, err := vectors.ParseProtocolName(name)
+	if err != nil {
+		return nil, err
+	}
+	if pn.Pattern != pattern.XXfallback.String() {
+		return Generate(name, rng)
+	}
+
+	protocolName := "Noise_" + goldenFallbackPattern.String() + "_" + pn.DH + "_" + pn.Cipher + "_" + pn.Hash
+	return GenerateFallback(protocolName, pn.Pattern, rng)
+}
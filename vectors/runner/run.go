@@ -0,0 +1,74 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package runner
+
+import (
+	"errors"
+	"testing"
+
+	"gitlab.com/yawning/nyquist.git/vectors"
+)
+
+// RunVectors verifies every vector in the embedded reference vector sets
+// for which protocolFilter returns true, as subtests of t.  A nil filter
+// selects all vectors.  Vectors that require unsupported functionality
+// are skipped.
+func RunVectors(t *testing.T, protocolFilter func(protocolName string) bool) {
+	for _, set := range vectors.EmbeddedSets() {
+		t.Run(set, func(t *testing.T) {
+			f, err := vectors.LoadEmbedded(set)
+			if err != nil {
+				t.Fatalf("LoadEmbedded(%s): %v", set, err)
+			}
+
+			for i := range f.Vectors {
+				v := &f.Vectors[i]
+				if protocolFilter != nil && !protocolFilter(v.ProtocolName) {
+					continue
+				}
+
+				name := v.Name
+				if name == "" {
+					name = v.ProtocolName
+				}
+				t.Run(name, func(t *testing.T) {
+					err := Verify(v)
+					switch {
+					case err == nil:
+					case errors.Is(err, ErrUnsupported):
+						t.Skip(err)
+					default:
+						t.Fatal(err)
+					}
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,650 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package runner implements a test vector runner and generator.
+package runner // import "gitlab.com/yawning/nyquist.git/vectors/runner"
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/dh"
+	"gitlab.com/yawning/nyquist.git/pattern"
+	"gitlab.com/yawning/nyquist.git/vectors"
+)
+
+const numTransportMessages = 2
+
+var (
+	// ErrUnsupported is the error returned when a test vector requires
+	// functionality that is not supported.
+	ErrUnsupported = errors.New("nyquist/vectors/runner: vector not supported")
+
+	errEntropyDisallowed = errors.New("nyquist/vectors/runner: entropy source used during vector execution")
+
+	generatedPrologue = []byte("nyquist test vector")
+)
+
+type failReader struct{}
+
+func (r *failReader) Read(p []byte) (int, error) {
+	return 0, errEntropyDisallowed
+}
+
+// Verify executes a test vector, from the point of view of both the
+// initiator and the responder, and returns nil iff the vector passes.
+func Verify(v *vectors.Vector) error {
+	if v.Fail {
+		return fmt.Errorf("%w: fail vectors", ErrUnsupported)
+	}
+	if v.RequiresKEM() {
+		return fmt.Errorf("%w: KEM vectors", ErrUnsupported)
+	}
+
+	protocol, err := newProtocol(v.ProtocolName)
+	if err != nil {
+		return err
+	}
+	if protocol.String() != v.ProtocolName {
+		return fmt.Errorf("derived protocol name mismatch: '%s'", protocol.String())
+	}
+
+	fallbackProtocol, err := fallbackProtocolFromVector(v)
+	if err != nil {
+		return err
+	}
+
+	initCfg, respCfg, err := configsFromVector(v, protocol)
+	if err != nil {
+		return err
+	}
+
+	for _, cfg := range []*nyquist.HandshakeConfig{initCfg, respCfg} {
+		if err = verifyMessages(cfg, fallbackProtocol, v); err != nil {
+			side := "responder"
+			if cfg.IsInitiator {
+				side = "initiator"
+			}
+			return fmt.Errorf("%s: %w", side, err)
+		}
+	}
+
+	if v.IsMultiPSK() {
+		if err = verifyPSKOrder(v, protocol, fallbackProtocol); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newProtocol returns the Protocol for a protocol name.  Unlike
+// nyquist.NewProtocol, PSK modifier combinations that have not been
+// registered (eg: the multi-PSK patterns used by the snow vectors) are
+// derived from the base pattern.
+func newProtocol(protocolName string) (*nyquist.Protocol, error) {
+	protocol, err := nyquist.NewProtocol(protocolName)
+	if err == nil {
+		return protocol, nil
+	}
+
+	parts := strings.Split(protocolName, "_")
+	if len(parts) == 5 {
+		if idx := strings.Index(parts[1], "psk"); idx > 0 {
+			modifier := parts[1][idx:]
+			parts[1] = parts[1][:idx]
+			if protocol, _ = nyquist.NewProtocol(strings.Join(parts, "_")); protocol != nil {
+				pa, pskErr := pattern.MakePSK(protocol.Pattern, modifier)
+				if pskErr == nil && pattern.IsValid(pa) == nil {
+					protocol.Pattern = pa
+					return protocol, nil
+				}
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %v", ErrUnsupported, err)
+}
+
+// verifyPSKOrder checks that a multi-PSK vector fails if the pre-shared keys
+// are supplied in the reverse order, to ensure that each PSK is applied at
+// the position given by the pattern's modifiers.
+func verifyPSKOrder(v *vectors.Vector, protocol, fallbackProtocol *nyquist.Protocol) error {
+	reverse := func(psks []vectors.HexBuffer) ([]vectors.HexBuffer, bool) {
+		var (
+			ret     = make([]vectors.HexBuffer, 0, len(psks))
+			changed bool
+		)
+		for i := len(psks) - 1; i >= 0; i-- {
+			changed = changed || !bytes.Equal(psks[i], psks[len(ret)])
+			ret = append(ret, psks[i])
+		}
+		return ret, changed
+	}
+
+	reversed := *v
+	initPsks, initChanged := reverse(v.InitPsks)
+	respPsks, respChanged := reverse(v.RespPsks)
+	if !initChanged && !respChanged {
+		// Reordering the PSKs is a no-op.
+		return nil
+	}
+	reversed.InitPsks, reversed.RespPsks = initPsks, respPsks
+
+	initCfg, respCfg, err := configsFromVector(&reversed, protocol)
+	if err != nil {
+		return err
+	}
+	for _, cfg := range []*nyquist.HandshakeConfig{initCfg, respCfg} {
+		if err = verifyMessages(cfg, fallbackProtocol, &reversed); err == nil {
+			return fmt.Errorf("vector passes with the PSKs reversed")
+		}
+	}
+
+	return nil
+}
+
+// fallbackProtocolFromVector returns the fallback protocol for a vector,
+// if any.
+func fallbackProtocolFromVector(v *vectors.Vector) (*nyquist.Protocol, error) {
+	if !v.IsFallback() {
+		return nil, nil
+	}
+
+	protocolName := v.FallbackProtocolName()
+	if protocolName == "" {
+		return nil, fmt.Errorf("%w: malformed protocol name", ErrUnsupported)
+	}
+	protocol, err := nyquist.NewProtocol(protocolName)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+	if protocol.String() != protocolName {
+		return nil, fmt.Errorf("derived fallback protocol name mismatch: '%s'", protocol.String())
+	}
+	return protocol, nil
+}
+
+// isWriter returns true iff the party is responsible for writing message
+// `idx`, given the number of handshake messages in the pattern.
+func isWriter(protocol *nyquist.Protocol, isInitiator bool, idx int) bool {
+	if protocol.Pattern.IsOneWay() && idx >= len(protocol.Pattern.Messages()) {
+		// One-way patterns only go from the initiator to the responder.
+		return isInitiator
+	}
+	return (idx&1 == 0) == isInitiator
+}
+
+func verifyMessages(cfg *nyquist.HandshakeConfig, fallbackProtocol *nyquist.Protocol, v *vectors.Vector) error {
+	hs, err := nyquist.NewHandshake(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create handshake: %w", err)
+	}
+	handshakes := []*nyquist.HandshakeState{hs}
+	defer func() {
+		for _, v := range handshakes {
+			v.Reset()
+		}
+	}()
+
+	var (
+		status     *nyquist.HandshakeStatus
+		txCs, rxCs *nyquist.CipherState
+	)
+	defer func() {
+		for _, cs := range []*nyquist.CipherState{txCs, rxCs} {
+			if cs != nil {
+				cs.Reset()
+			}
+		}
+	}()
+	isInitiator := cfg.IsInitiator
+	doFallback := func() error {
+		if hs, err = hs.Fallback(fallbackProtocol); err != nil {
+			return fmt.Errorf("failed to fall back: %w", err)
+		}
+		handshakes = append(handshakes, hs)
+		isInitiator = !isInitiator
+		return nil
+	}
+	for idx, msg := range v.Messages {
+		var dst, expectedDst []byte
+
+		isWrite := isWriter(cfg.Protocol, cfg.IsInitiator, idx)
+		if fallbackProtocol != nil && idx == 1 && cfg.IsInitiator {
+			// The initiator falls back on receiving the responder's
+			// first fallback message.
+			if err = doFallback(); err != nil {
+				return err
+			}
+		}
+		if status == nil {
+			// Handshake message(s).
+			if isWrite {
+				dst, err = hs.WriteMessage(nil, msg.Payload)
+				expectedDst = msg.Ciphertext
+			} else {
+				dst, err = hs.ReadMessage(nil, msg.Ciphertext)
+				expectedDst = msg.Payload
+			}
+			if fallbackProtocol != nil && idx == 0 && !cfg.IsInitiator {
+				// The responder is expected to fail to process the
+				// initiator's first message, and fall back.
+				if err == nil || err == nyquist.ErrDone {
+					return fmt.Errorf("handshake message %d: unexpected success", idx)
+				}
+				if err = doFallback(); err != nil {
+					return err
+				}
+				continue
+			}
+			switch err {
+			case nyquist.ErrDone:
+				status = hs.GetStatus()
+				if len(v.HandshakeHash) > 0 && !bytes.Equal(v.HandshakeHash, status.HandshakeHash) {
+					return fmt.Errorf("handshake hash mismatch")
+				}
+				txCs, rxCs = status.CipherStates[0], status.CipherStates[1]
+				if !isInitiator {
+					txCs, rxCs = rxCs, txCs
+				}
+			case nil:
+			default:
+				return fmt.Errorf("handshake message %d: %w", idx, err)
+			}
+		} else {
+			// Transport message(s).
+			if isWrite {
+				dst, err = txCs.EncryptWithAd(nil, nil, msg.Payload)
+				expectedDst = msg.Ciphertext
+			} else {
+				dst, err = rxCs.DecryptWithAd(nil, nil, msg.Ciphertext)
+				expectedDst = msg.Payload
+			}
+			if err != nil {
+				return fmt.Errorf("transport message %d: %w", idx, err)
+			}
+		}
+		if !bytes.Equal(expectedDst, dst) {
+			return fmt.Errorf("message %d: output mismatch", idx)
+		}
+	}
+
+	if status == nil {
+		return fmt.Errorf("handshake did not complete")
+	}
+
+	return nil
+}
+
+func configsFromVector(v *vectors.Vector, protocol *nyquist.Protocol) (*nyquist.HandshakeConfig, *nyquist.HandshakeConfig, error) {
+	parsePrivate := func(b []byte, what string) (dh.Keypair, error) {
+		if len(b) == 0 {
+			return nil, nil
+		}
+		kp, err := protocol.DH.ParsePrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", what, err)
+		}
+		return kp, nil
+	}
+	parsePublic := func(b []byte, what string) (dh.PublicKey, error) {
+		if len(b) == 0 {
+			return nil, nil
+		}
+		pk, err := protocol.DH.ParsePublicKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", what, err)
+		}
+		return pk, nil
+	}
+	toPSKs := func(psks []vectors.HexBuffer, what string) ([][]byte, error) {
+		if len(psks) != protocol.Pattern.NumPSKs() {
+			return nil, fmt.Errorf("unexpected number of %s: %d", what, len(psks))
+		}
+		var ret [][]byte
+		for _, psk := range psks {
+			ret = append(ret, []byte(psk))
+		}
+		return ret, nil
+	}
+
+	var (
+		initCfg = &nyquist.HandshakeConfig{
+			Protocol:    protocol,
+			Prologue:    v.InitPrologue,
+			Rng:         &failReader{},
+			IsInitiator: true,
+		}
+		respCfg = &nyquist.HandshakeConfig{
+			Protocol: protocol,
+			Prologue: v.RespPrologue,
+			Rng:      &failReader{},
+		}
+		err error
+	)
+
+	if initCfg.LocalStatic, err = parsePrivate(v.InitStatic, "init_static"); err != nil {
+		return nil, nil, err
+	}
+	if initCfg.LocalEphemeral, err = parsePrivate(v.InitEphemeral, "init_ephemeral"); err != nil {
+		return nil, nil, err
+	}
+	if initCfg.RemoteStatic, err = parsePublic(v.InitRemoteStatic, "init_remote_static"); err != nil {
+		return nil, nil, err
+	}
+	if initCfg.PreSharedKeys, err = toPSKs(v.InitPsks, "init_psks"); err != nil {
+		return nil, nil, err
+	}
+
+	if respCfg.LocalStatic, err = parsePrivate(v.RespStatic, "resp_static"); err != nil {
+		return nil, nil, err
+	}
+	if respCfg.LocalEphemeral, err = parsePrivate(v.RespEphemeral, "resp_ephemeral"); err != nil {
+		return nil, nil, err
+	}
+	if respCfg.RemoteStatic, err = parsePublic(v.RespRemoteStatic, "resp_remote_static"); err != nil {
+		return nil, nil, err
+	}
+	if respCfg.PreSharedKeys, err = toPSKs(v.RespPsks, "resp_psks"); err != nil {
+		return nil, nil, err
+	}
+
+	return initCfg, respCfg, nil
+}
+
+// patternKeys is the set of keys required by each side of a pattern.
+type patternKeys struct {
+	initS, initE, respS, respE bool
+	initRS, respRS             bool
+}
+
+func getPatternKeys(pa pattern.Pattern) patternKeys {
+	var keys patternKeys
+
+	mark := func(idx int, msg pattern.Message) {
+		for _, v := range msg {
+			isInitiator := idx&1 == 0
+			switch {
+			case v == pattern.Token_s && isInitiator:
+				keys.initS = true
+			case v == pattern.Token_s:
+				keys.respS = true
+			case v == pattern.Token_e && isInitiator:
+				keys.initE = true
+			case v == pattern.Token_e:
+				keys.respE = true
+			}
+		}
+	}
+	for idx, msg := range pa.PreMessages() {
+		mark(idx, msg)
+		for _, v := range msg {
+			if v != pattern.Token_s {
+				continue
+			}
+			if idx == 0 {
+				keys.respRS = true
+			} else {
+				keys.initRS = true
+			}
+		}
+	}
+	for idx, msg := range pa.Messages() {
+		mark(idx, msg)
+	}
+
+	return keys
+}
+
+// Generate generates a new test vector for the provided protocol name,
+// using the provided entropy source for all keys.
+func Generate(protocolName string, rng io.Reader) (*vectors.Vector, error) {
+	return generate(protocolName, "", rng)
+}
+
+// GenerateFallback generates a new fallback test vector for the provided
+// protocol name and fallback pattern name (eg: `XXfallback`), using the
+// provided entropy source for all keys.  The initiator is given a stale
+// copy of the responder's static public key, so that the responder fails
+// to process the first message and falls back.
+func GenerateFallback(protocolName, fallbackPattern string, rng io.Reader) (*vectors.Vector, error) {
+	if fallbackPattern == "" {
+		fallbackPattern = vectors.DefaultFallbackPattern
+	}
+	return generate(protocolName, fallbackPattern, rng)
+}
+
+func generate(protocolName, fallbackPattern string, rng io.Reader) (*vectors.Vector, error) {
+	protocol, err := newProtocol(protocolName)
+	if err != nil {
+		return nil, err
+	}
+
+	genPrivate := func() (vectors.HexBuffer, dh.PublicKey, error) {
+		kp, genErr := protocol.DH.GenerateKeypair(rng)
+		if genErr != nil {
+			return nil, nil, genErr
+		}
+		b, genErr := kp.MarshalBinary()
+		if genErr != nil {
+			return nil, nil, genErr
+		}
+		return b, kp.Public(), nil
+	}
+
+	v := &vectors.Vector{
+		Name:            protocolName,
+		ProtocolName:    protocolName,
+		InitPrologue:    append([]byte{}, generatedPrologue...),
+		RespPrologue:    append([]byte{}, generatedPrologue...),
+		Fallback:        fallbackPattern != "",
+		FallbackPattern: fallbackPattern,
+	}
+
+	keys := getPatternKeys(protocol.Pattern)
+	var fallbackProtocol *nyquist.Protocol
+	if v.Fallback {
+		if fallbackProtocol, err = fallbackProtocolFromVector(v); err != nil {
+			return nil, err
+		}
+		v.Name = fallbackProtocol.String()
+
+		// The roles are reversed in the fallback pattern.
+		fbKeys := getPatternKeys(fallbackProtocol.Pattern)
+		keys.initS = keys.initS || fbKeys.respS
+		keys.initE = keys.initE || fbKeys.respE
+		keys.respS = keys.respS || fbKeys.initS
+		keys.respE = keys.respE || fbKeys.initE
+	}
+
+	var initStatic, respStatic dh.PublicKey
+	if keys.initS {
+		if v.InitStatic, initStatic, err = genPrivate(); err != nil {
+			return nil, err
+		}
+	}
+	if keys.initE {
+		if v.InitEphemeral, _, err = genPrivate(); err != nil {
+			return nil, err
+		}
+	}
+	if keys.respS {
+		if v.RespStatic, respStatic, err = genPrivate(); err != nil {
+			return nil, err
+		}
+	}
+	if keys.respE {
+		if v.RespEphemeral, _, err = genPrivate(); err != nil {
+			return nil, err
+		}
+	}
+	if keys.initRS {
+		if v.Fallback {
+			if _, respStatic, err = genPrivate(); err != nil {
+				return nil, err
+			}
+		}
+		v.InitRemoteStatic = append([]byte{}, respStatic.Bytes()...)
+	}
+	if keys.respRS {
+		v.RespRemoteStatic = append([]byte{}, initStatic.Bytes()...)
+	}
+	for i := 0; i < protocol.Pattern.NumPSKs(); i++ {
+		psk := make([]byte, nyquist.PreSharedKeySize)
+		if _, err = io.ReadFull(rng, psk); err != nil {
+			return nil, err
+		}
+		v.InitPsks = append(v.InitPsks, psk)
+		v.RespPsks = append(v.RespPsks, append([]byte{}, psk...))
+	}
+
+	if err = runGenerate(v, protocol, fallbackProtocol); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func runGenerate(v *vectors.Vector, protocol, fallbackProtocol *nyquist.Protocol) error {
+	initCfg, respCfg, err := configsFromVector(v, protocol)
+	if err != nil {
+		return err
+	}
+
+	initHs, err := nyquist.NewHandshake(initCfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		initHs.Reset()
+	}()
+	respHs, err := nyquist.NewHandshake(respCfg)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		respHs.Reset()
+	}()
+
+	numHandshakeMessages := len(protocol.Pattern.Messages())
+	initIsInitiator := true
+	for idx := 0; idx < numHandshakeMessages; idx++ {
+		w, r := initHs, respHs
+		if !isWriter(protocol, true, idx) {
+			w, r = r, w
+		}
+
+		payload := []byte(fmt.Sprintf("handshake payload %d", idx))
+		ciphertext, wErr := w.WriteMessage(nil, payload)
+		_, rErr := r.ReadMessage(nil, ciphertext)
+
+		if fallbackProtocol != nil && idx == 0 {
+			if wErr != nil || rErr == nil {
+				return fmt.Errorf("handshake message %d: expected responder failure: %v/%v", idx, wErr, rErr)
+			}
+
+			oldInitHs, oldRespHs := initHs, respHs
+			if initHs, err = oldInitHs.Fallback(fallbackProtocol); err != nil {
+				initHs = oldInitHs
+				return err
+			}
+			oldInitHs.Reset()
+			if respHs, err = oldRespHs.Fallback(fallbackProtocol); err != nil {
+				respHs = oldRespHs
+				return err
+			}
+			oldRespHs.Reset()
+
+			// The template's first message is the fallback pattern's
+			// pre-message.
+			numHandshakeMessages = 1 + len(fallbackProtocol.Pattern.Messages())
+			initIsInitiator = false
+		} else {
+			if wErr != rErr {
+				return fmt.Errorf("handshake message %d: %v/%v", idx, wErr, rErr)
+			}
+			if wErr != nil && wErr != nyquist.ErrDone {
+				return fmt.Errorf("handshake message %d: %w", idx, wErr)
+			}
+		}
+
+		v.Messages = append(v.Messages, vectors.Message{
+			Payload:    payload,
+			Ciphertext: ciphertext,
+		})
+	}
+
+	initStatus, respStatus := initHs.GetStatus(), respHs.GetStatus()
+	if initStatus.Err != nyquist.ErrDone || respStatus.Err != nyquist.ErrDone {
+		return fmt.Errorf("handshake did not complete")
+	}
+	v.HandshakeHash = append([]byte{}, initStatus.HandshakeHash...)
+
+	initTx, initRx := initStatus.CipherStates[0], initStatus.CipherStates[1]
+	respRx, respTx := respStatus.CipherStates[0], respStatus.CipherStates[1]
+	if !initIsInitiator {
+		initTx, initRx = initRx, initTx
+		respRx, respTx = respTx, respRx
+	}
+	defer func() {
+		for _, cs := range []*nyquist.CipherState{initTx, initRx, respTx, respRx} {
+			if cs != nil {
+				cs.Reset()
+			}
+		}
+	}()
+	for i := 0; i < numTransportMessages; i++ {
+		idx := numHandshakeMessages + i
+		tx, rx := initTx, respRx
+		if !isWriter(protocol, true, idx) {
+			tx, rx = respTx, initRx
+		}
+
+		payload := []byte(fmt.Sprintf("transport payload %d", i))
+		ciphertext, err := tx.EncryptWithAd(nil, nil, payload)
+		if err != nil {
+			return fmt.Errorf("transport message %d: %w", idx, err)
+		}
+		if _, err = rx.DecryptWithAd(nil, nil, ciphertext); err != nil {
+			return fmt.Errorf("transport message %d: %w", idx, err)
+		}
+
+		v.Messages = append(v.Messages, vectors.Message{
+			Payload:    payload,
+			Ciphertext: ciphertext,
+		})
+	}
+
+	return nil
+}
@@ -0,0 +1,268 @@
+// Copyright (C) 2021 Yawning Angel. All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+// 1. Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright
+// notice, this list of conditions and the following disclaimer in the
+// documentation and/or other materials provided with the distribution.
+//
+// 3. Neither the name of the copyright holder nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS
+// IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED
+// TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// HOLDER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED
+// TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR
+// PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF
+// LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING
+// NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package runner
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/yawning/nyquist.git"
+	"gitlab.com/yawning/nyquist.git/vectors"
+)
+
+func TestRunner(t *testing.T) {
+	for _, v := range []struct {
+		n  string
+		fn func(*testing.T)
+	}{
+		{"Verify", testRunnerVerify},
+		{"Generate", testRunnerGenerate},
+		{"Fallback", testRunnerFallback},
+		{"RunVectors", testRunnerRunVectors},
+		{"Deferred", testRunnerDeferred},
+		{"Golden", testRunnerGolden},
+	} {
+		t.Run(v.n, v.fn)
+	}
+}
+
+func testRunnerVerify(t *testing.T) {
+	require := require.New(t)
+
+	vectorsFile, err := vectors.LoadEmbedded("cacophony")
+	require.NoError(err, "LoadEmbedded")
+
+	var numPassed int
+	for _, v := range vectorsFile.Vectors {
+		err = Verify(&v)
+		if errors.Is(err, ErrUnsupported) {
+			continue
+		}
+		require.NoError(err, "Verify(%s)", v.ProtocolName)
+		numPassed++
+
+		// Tampering with the vector should cause verification to fail.
+		tampered := v
+		tampered.Messages = append([]vectors.Message{}, v.Messages...)
+		tampered.Messages[0].Ciphertext = append(vectors.HexBuffer{}, v.Messages[0].Ciphertext...)
+		tampered.Messages[0].Ciphertext[0] ^= 0xa5
+		err = Verify(&tampered)
+		require.Error(err, "Verify(%s) - tampered", v.ProtocolName)
+	}
+	require.NotZero(numPassed, "verified at least one vector")
+}
+
+func testRunnerGenerate(t *testing.T) {
+	for _, protocolName := range []string{
+		"Noise_N_25519_ChaChaPoly_BLAKE2s",
+		"Noise_Kpsk0_448_AESGCM_SHA512",
+		"Noise_XX_25519_DeoxysII_BLAKE2b",
+		"Noise_IKpsk2_25519_ChaChaPoly_SHA256",
+		"Noise_X1K1_448_ChaChaPoly_BLAKE2s",
+		"Noise_NK_25519_AESGCM_SHA512/256",
+		"Noise_XK_25519_AESOCB_SHA256",
+		"Noise_XXpsk0+psk3_25519_AESGCM_SHA256",
+		"Noise_NXpsk0+psk1+psk2_448_ChaChaPoly_BLAKE2b",
+	} {
+		t.Run(protocolName, func(t *testing.T) {
+			require := require.New(t)
+			if !isSupported(protocolName) {
+				t.Skip("protocol not included in the build")
+			}
+
+			v, err := Generate(protocolName, rand.Reader)
+			require.NoError(err, "Generate")
+			require.NotEmpty(v.HandshakeHash, "Generate - handshake hash")
+
+			b, err := json.Marshal(&vectors.File{Vectors: []vectors.Vector{*v}})
+			require.NoError(err, "json.Marshal")
+
+			var vectorsFile vectors.File
+			err = json.Unmarshal(b, &vectorsFile)
+			require.NoError(err, "json.Unmarshal")
+
+			err = Verify(&vectorsFile.Vectors[0])
+			require.NoError(err, "Verify")
+
+			if v.IsMultiPSK() {
+				// Supplying the PSKs out of order should cause
+				// verification to fail.
+				swapped := vectorsFile.Vectors[0]
+				swapped.InitPsks = append([]vectors.HexBuffer{}, v.InitPsks...)
+				swapped.InitPsks[0], swapped.InitPsks[1] = swapped.InitPsks[1], swapped.InitPsks[0]
+				err = Verify(&swapped)
+				require.Error(err, "Verify - swapped PSKs")
+			}
+		})
+	}
+
+	_, err := Generate("Noise_XX_25519_ChaChaPoly_MD5", rand.Reader)
+	require.True(t, errors.Is(err, ErrUnsupported), "Generate(unsupported)")
+}
+
+// isSupported returns false iff the protocol uses a primitive that was
+// excluded from the build via a build tag.
+func isSupported(protocolName string) bool {
+	_, err := nyquist.NewProtocol(protocolName)
+	return err != nyquist.ErrProtocolNotSupported
+}
+
+func testRunnerFallback(t *testing.T) {
+	require := require.New(t)
+
+	for _, protocolName := range []string{
+		"Noise_IK_25519_ChaChaPoly_BLAKE2s",
+		"Noise_IK_448_AESGCM_SHA512",
+	} {
+		if !isSupported(protocolName) {
+			continue
+		}
+		v, err := GenerateFallback(protocolName, "", rand.Reader)
+		require.NoError(err, "GenerateFallback(%s)", protocolName)
+		require.True(v.IsFallback(), "GenerateFallback - IsFallback")
+		require.Len(v.Messages, 1+2+numTransportMessages, "GenerateFallback - messages")
+
+		err = Verify(v)
+		require.NoError(err, "Verify(%s)", v.Name)
+
+		// Tampering with a fallback message should cause verification to
+		// fail.
+		tampered := *v
+		tampered.Messages = append([]vectors.Message{}, v.Messages...)
+		tampered.Messages[2].Ciphertext = append(vectors.HexBuffer{}, v.Messages[2].Ciphertext...)
+		tampered.Messages[2].Ciphertext[0] ^= 0xa5
+		err = Verify(&tampered)
+		require.Error(err, "Verify(%s) - tampered", v.Name)
+
+		// The responder must fail to process the first message.
+		unstale := *v
+		unstale.InitRemoteStatic = nil
+		err = Verify(&unstale)
+		require.Error(err, "Verify(%s) - no stale key", v.Name)
+	}
+
+	fn := filepath.Join("..", "..", "testdata", "nyquist-fallback.txt")
+	b, err := ioutil.ReadFile(fn)
+	require.NoError(err, "ReadFile(%v)", fn)
+
+	var vectorsFile vectors.File
+	err = json.Unmarshal(b, &vectorsFile)
+	require.NoError(err, "json.Unmarshal")
+	require.NotEmpty(vectorsFile.Vectors, "fallback vectors")
+	for _, v := range vectorsFile.Vectors {
+		if !isSupported(v.ProtocolName) {
+			continue
+		}
+		err = Verify(&v)
+		require.NoError(err, "Verify(%s)", v.Name)
+	}
+}
+
+func testRunnerRunVectors(t *testing.T) {
+	RunVectors(t, func(protocolName string) bool {
+		return strings.HasSuffix(protocolName, "_25519_ChaChaPoly_BLAKE2s")
+	})
+}
+
+func testRunnerDeferred(t *testing.T) {
+	require := require.New(t)
+
+	// Every deferred pattern should be backed by reference vectors.
+	numPassed := make(map[string]int)
+	for _, set := range vectors.EmbeddedSets() {
+		vectorsFile, err := vectors.LoadEmbedded(set)
+		require.NoError(err, "LoadEmbedded(%s)", set)
+
+		deferred := vectorsFile.Select(func(v *vectors.Vector) bool {
+			pn, err := vectors.ParseProtocolName(v.ProtocolName)
+			return err == nil && strings.Contains(pn.BasePattern, "1")
+		})
+		for i := range deferred.Vectors {
+			v := &deferred.Vectors[i]
+			if !isSupported(v.ProtocolName) {
+				continue
+			}
+			err = Verify(v)
+			require.NoError(err, "Verify(%s)", v.ProtocolName)
+			pn, _ := vectors.ParseProtocolName(v.ProtocolName)
+			numPassed[pn.Pattern]++
+		}
+	}
+
+	for _, name := range []string{
+		"NK1", "NX1",
+		"X1N", "X1K", "XK1", "X1K1", "X1X", "XX1", "X1X1",
+		"K1N", "K1K", "KK1", "K1K1", "K1X", "KX1", "K1X1",
+		"I1N", "I1K", "IK1", "I1K1", "I1X", "IX1", "I1X1",
+	} {
+		require.NotZero(numPassed[name], "vectors for %s", name)
+	}
+}
+
+func testRunnerGolden(t *testing.T) {
+	require := require.New(t)
+
+	require.NoError(SelfTest(), "SelfTest")
+
+	names := GoldenNames()
+	require.Contains(names, "Noise_I1X1_25519_ChaChaPoly_BLAKE2s", "GoldenNames - pattern")
+	require.Contains(names, "Noise_XX_25519_AESGCM_SHA512/256", "GoldenNames - primitives")
+	require.Contains(names, "Noise_XXfallback_25519_ChaCha8Poly_BLAKE2b", "GoldenNames - fallback")
+
+	// Regenerating the transcripts must be bit-for-bit identical to the
+	// embedded copy.
+	golden, err := LoadGolden()
+	require.NoError(err, "LoadGolden")
+	embedded := make(map[string][]byte)
+	for i := range golden.Vectors {
+		v := &golden.Vectors[i]
+		b, err := json.Marshal(v)
+		require.NoError(err, "json.Marshal(%s)", v.Name)
+		embedded[v.Name] = b
+	}
+
+	f, err := GenerateGolden()
+	require.NoError(err, "GenerateGolden")
+	require.Len(f.Vectors, len(names), "GenerateGolden - count")
+	for i := range f.Vectors {
+		v := &f.Vectors[i]
+		b, err := json.Marshal(v)
+		require.NoError(err, "json.Marshal(%s)", v.Name)
+		require.True(bytes.Equal(embedded[v.Name], b), "GenerateGolden(%s) - matches embedded transcript", v.Name)
+	}
+}
@@ -27,9 +27,16 @@
 // NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
 // SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 
-// Package vectors provides types for the JSON formatted test vectors.
+// Package vectors provides types for the test vectors, which may be encoded
+// as JSON (the de facto standard format), CBOR, or MessagePack.
 package vectors // import "gitlab.com/yawning/nyquist.git/vectors"
 
+import "strings"
+
+// DefaultFallbackPattern is the fallback pattern used by fallback vectors
+// that do not specify one.
+const DefaultFallbackPattern = "XXfallback"
+
 // Message is a test vector handshake message.
 type Message struct {
 	Payload    HexBuffer `json:"payload"`
@@ -45,6 +52,10 @@ type Vector struct {
 	Fallback        bool   `json:"fallback"`
 	FallbackPattern string `json:"fallback_pattern"`
 
+	// InitPsks and RespPsks are the pre-shared keys, in the order that the
+	// corresponding `psk` tokens are processed (which for multi-PSK
+	// patterns, is the order of the modifiers, eg: `psk0+psk2`).
+
 	InitPrologue     HexBuffer   `json:"init_prologue"`
 	InitPsks         []HexBuffer `json:"init_psks"`
 	InitStatic       HexBuffer   `json:"init_static"`
@@ -57,11 +68,79 @@ type Vector struct {
 	RespEphemeral    HexBuffer   `json:"resp_ephemeral"`
 	RespRemoteStatic HexBuffer   `json:"resp_remote_static"`
 
+	// The following fields are used by hybrid forward secrecy (`hfs`)
+	// and post-quantum (KEM-based) vectors.  Keys are in the encoding
+	// used by the respective KEM, and the KEM ciphertexts are those
+	// produced by each side, in the order that they appear in the
+	// handshake.
+
+	InitHybridEphemeral HexBuffer `json:"init_hybrid_ephemeral,omitempty"`
+	RespHybridEphemeral HexBuffer `json:"resp_hybrid_ephemeral,omitempty"`
+
+	InitKEMStatic       HexBuffer   `json:"init_kem_static,omitempty"`
+	InitKEMEphemeral    HexBuffer   `json:"init_kem_ephemeral,omitempty"`
+	InitRemoteKEMStatic HexBuffer   `json:"init_remote_kem_static,omitempty"`
+	InitKEMCiphertexts  []HexBuffer `json:"init_kem_ciphertexts,omitempty"`
+
+	RespKEMStatic       HexBuffer   `json:"resp_kem_static,omitempty"`
+	RespKEMEphemeral    HexBuffer   `json:"resp_kem_ephemeral,omitempty"`
+	RespRemoteKEMStatic HexBuffer   `json:"resp_remote_kem_static,omitempty"`
+	RespKEMCiphertexts  []HexBuffer `json:"resp_kem_ciphertexts,omitempty"`
+
 	HandshakeHash HexBuffer `json:"handshake_hash"`
 
 	Messages []Message `json:"messages"`
 }
 
+// RequiresKEM returns true iff the vector uses any of the hybrid or
+// post-quantum KEM fields.
+func (v *Vector) RequiresKEM() bool {
+	for _, b := range []HexBuffer{
+		v.InitHybridEphemeral,
+		v.RespHybridEphemeral,
+		v.InitKEMStatic,
+		v.InitKEMEphemeral,
+		v.InitRemoteKEMStatic,
+		v.RespKEMStatic,
+		v.RespKEMEphemeral,
+		v.RespRemoteKEMStatic,
+	} {
+		if len(b) > 0 {
+			return true
+		}
+	}
+	return len(v.InitKEMCiphertexts) > 0 || len(v.RespKEMCiphertexts) > 0
+}
+
+// IsMultiPSK returns true iff the vector uses more than one pre-shared key.
+func (v *Vector) IsMultiPSK() bool {
+	return len(v.InitPsks) > 1 || len(v.RespPsks) > 1
+}
+
+// IsFallback returns true iff the vector exercises a fallback handshake.
+func (v *Vector) IsFallback() bool {
+	return v.Fallback || v.FallbackPattern != ""
+}
+
+// FallbackProtocolName returns the protocol name of the fallback handshake,
+// derived from ProtocolName and FallbackPattern, or the empty string if
+// the vector does not exercise a fallback handshake.
+func (v *Vector) FallbackProtocolName() string {
+	if !v.IsFallback() {
+		return ""
+	}
+
+	fallbackPattern := v.FallbackPattern
+	if fallbackPattern == "" {
+		fallbackPattern = DefaultFallbackPattern
+	}
+	parts := strings.SplitN(v.ProtocolName, "_", 3)
+	if len(parts) != 3 {
+		return ""
+	}
+	return parts[0] + "_" + fallbackPattern + "_" + parts[2]
+}
+
 // File is a collection of test vectors.
 type File struct {
 	Vectors []Vector `json:"vectors"`
@@ -37,6 +37,7 @@ import (
 
 	"github.com/stretchr/testify/require"
 
+	"gitlab.com/yawning/nyquist.git/cipher"
 	"gitlab.com/yawning/nyquist.git/dh"
 	"gitlab.com/yawning/nyquist.git/pattern"
 	"gitlab.com/yawning/nyquist.git/vectors"
@@ -46,13 +47,22 @@ func TestVectors(t *testing.T) {
 	// Register the multi-PSK suites covered by the snow test vectors.
 	t.Run("RegisterMultiPSK", doRegisterMultiPSK)
 
+	// The canonical vector sets are embedded in the vectors package.
+	for _, name := range vectors.EmbeddedSets() {
+		t.Run(name, func(t *testing.T) {
+			vectorsFile, err := vectors.LoadEmbedded(name)
+			require.NoError(t, err, "LoadEmbedded(%v)", name)
+			doTestVectors(t, vectorsFile, false)
+		})
+	}
+
 	srcImpls := []struct {
 		name   string
 		skipOk bool
 	}{
-		{"cacophony", false},
-		{"snow", false},
 		{"noise-c-basic", true}, // PSK patterns use a non-current name.
+		{"nyquist-fallback", false},
+		{"nyquist-chacha-reduced", false},
 	}
 
 	for _, v := range srcImpls {
@@ -101,6 +111,10 @@ func doTestVectorsFile(t *testing.T, impl string, skipOk bool) {
 	err = json.Unmarshal(b, &vectorsFile)
 	require.NoError(err, "json.Unmarshal")
 
+	doTestVectors(t, &vectorsFile, skipOk)
+}
+
+func doTestVectors(t *testing.T, vectorsFile *vectors.File, skipOk bool) {
 	for _, v := range vectorsFile.Vectors {
 		if v.Name == "" {
 			v.Name = v.ProtocolName
@@ -122,13 +136,25 @@ func doTestVector(t *testing.T, v *vectors.Vector, skipOk bool) {
 	if v.Fail {
 		t.Skip("fail tests not supported")
 	}
-	if v.Fallback || v.FallbackPattern != "" {
-		t.Skip("fallback patterns not supported")
+	if v.RequiresKEM() {
+		t.Skip("KEM tests not supported")
 	}
 
 	require := require.New(t)
 	initCfg, respCfg := configsFromVector(t, v, skipOk)
 
+	var fallback *Protocol
+	if v.IsFallback() {
+		fallbackName := v.FallbackProtocolName()
+		var err error
+		fallback, err = NewProtocol(fallbackName)
+		if err == ErrProtocolNotSupported && skipOk {
+			t.Skipf("fallback protocol not supported")
+		}
+		require.NoError(err, "NewProtocol(%v)", fallbackName)
+		require.Equal(fallbackName, fallback.String(), "derived fallback protocol name matches test case")
+	}
+
 	initHs, err := NewHandshake(initCfg)
 	require.NoError(err, "NewHandshake(initCfg)")
 	defer initHs.Reset()
@@ -138,17 +164,23 @@ func doTestVector(t *testing.T, v *vectors.Vector, skipOk bool) {
 	defer respHs.Reset()
 
 	t.Run("Initiator", func(t *testing.T) {
-		doTestVectorMessages(t, initHs, v)
+		doTestVectorMessages(t, initHs, fallback, v)
 	})
 	t.Run("Responder", func(t *testing.T) {
-		doTestVectorMessages(t, respHs, v)
+		doTestVectorMessages(t, respHs, fallback, v)
 	})
 }
 
-func doTestVectorMessages(t *testing.T, hs *HandshakeState, v *vectors.Vector) {
+func doTestVectorMessages(t *testing.T, hs *HandshakeState, fallback *Protocol, v *vectors.Vector) {
 	require := require.New(t)
 
 	writeOnEven := hs.isInitiator
+	doFallback := func() {
+		fallbackHs, err := hs.Fallback(fallback)
+		require.NoError(err, "Fallback")
+		hs = fallbackHs
+		t.Cleanup(fallbackHs.Reset)
+	}
 
 	var (
 		status     *HandshakeStatus
@@ -160,6 +192,12 @@ func doTestVectorMessages(t *testing.T, hs *HandshakeState, v *vectors.Vector) {
 			err              error
 		)
 
+		if fallback != nil && idx == 1 && writeOnEven {
+			// The initiator falls back on receiving the responder's first
+			// fallback message.
+			doFallback()
+		}
+
 		if status == nil {
 			// Handshake message(s).
 			if (idx&1 == 0) == writeOnEven {
@@ -170,6 +208,14 @@ func doTestVectorMessages(t *testing.T, hs *HandshakeState, v *vectors.Vector) {
 				expectedDst = msg.Payload
 			}
 
+			if fallback != nil && idx == 0 && !writeOnEven {
+				// The responder fails to process the initiator's first
+				// message, and falls back.
+				require.Error(err, "Handshake Message - %d, expected failure", idx)
+				doFallback()
+				continue
+			}
+
 			switch err {
 			case ErrDone:
 				status = hs.GetStatus()
@@ -231,12 +277,22 @@ func doTestVectorMessages(t *testing.T, hs *HandshakeState, v *vectors.Vector) {
 	}
 }
 
+// isOmitted returns true iff the protocol uses a DH or cipher function that
+// was excluded from the build via a build tag.
+func isOmitted(protoName string) bool {
+	pn, err := vectors.ParseProtocolName(protoName)
+	if err != nil {
+		return false
+	}
+	return dh.FromString(pn.DH) == nil || cipher.FromString(pn.Cipher) == nil
+}
+
 func configsFromVector(t *testing.T, v *vectors.Vector, skipOk bool) (*HandshakeConfig, *HandshakeConfig) {
 	require := require.New(t)
 
 	protoName := v.ProtocolName
 	protocol, err := NewProtocol(protoName)
-	if err == ErrProtocolNotSupported && skipOk {
+	if err == ErrProtocolNotSupported && (skipOk || isOmitted(protoName)) {
 		t.Skipf("protocol not supported")
 	}
 	require.NoError(err, "NewProtocol(%v)", protoName)